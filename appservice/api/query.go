@@ -19,6 +19,7 @@ package api
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
@@ -41,6 +42,49 @@ type AppServiceInternalAPI interface {
 		req *UserIDExistsRequest,
 		resp *UserIDExistsResponse,
 	) error
+	// Query the third party protocols provided by the application services
+	Protocols(
+		ctx context.Context,
+		req *ProtocolRequest,
+		resp *ProtocolResponse,
+	) error
+	// Look up third party locations, e.g. IRC channels, in the application services
+	Locations(
+		ctx context.Context,
+		req *LocationRequest,
+		resp *LocationResponse,
+	) error
+	// Look up third party users in the application services
+	User(
+		ctx context.Context,
+		req *UserRequest,
+		resp *UserResponse,
+	) error
+	// Query the state of the transaction queues of the application services
+	QueryTransactionQueues(
+		ctx context.Context,
+		req *QueryTransactionQueuesRequest,
+		resp *QueryTransactionQueuesResponse,
+	) error
+	// Pause or resume delivery of transactions to an application service
+	PerformTransactionQueuePause(
+		ctx context.Context,
+		req *PerformTransactionQueuePauseRequest,
+		resp *PerformTransactionQueuePauseResponse,
+	) error
+	// Discard the events queued for an application service
+	PerformTransactionQueueDiscard(
+		ctx context.Context,
+		req *PerformTransactionQueueDiscardRequest,
+		resp *PerformTransactionQueueDiscardResponse,
+	) error
+	// Queue the events of transactions which were already sent to an
+	// application service again
+	PerformTransactionQueueReplay(
+		ctx context.Context,
+		req *PerformTransactionQueueReplayRequest,
+		resp *PerformTransactionQueueReplayResponse,
+	) error
 }
 
 // RoomAliasExistsRequest is a request to an application service
@@ -77,6 +121,157 @@ type UserIDExistsResponse struct {
 	UserIDExists bool `json:"exists"`
 }
 
+// ProtocolRequest is a request for the metadata of a third party protocol, or
+// of all protocols if Protocol is empty.
+type ProtocolRequest struct {
+	Protocol string `json:"protocol,omitempty"`
+}
+
+// ProtocolResponse is a response with the metadata of third party protocols,
+// merged from all application services which provide them.
+type ProtocolResponse struct {
+	Protocols map[string]ASProtocolResponse `json:"protocols"`
+	Exists    bool                          `json:"exists"`
+}
+
+// ASProtocolResponse is the metadata of a third party protocol.
+// https://spec.matrix.org/v1.4/application-service-api/#get_matrixappv1thirdpartyprotocolprotocol
+type ASProtocolResponse struct {
+	FieldTypes     map[string]FieldType `json:"field_types,omitempty"`
+	Icon           string               `json:"icon"`
+	Instances      []ProtocolInstance   `json:"instances"`
+	LocationFields []string             `json:"location_fields"`
+	UserFields     []string             `json:"user_fields"`
+}
+
+// FieldType describes a field which is used to look up third party locations and users.
+type FieldType struct {
+	Placeholder string `json:"placeholder"`
+	Regexp      string `json:"regexp"`
+}
+
+// ProtocolInstance is an instance of a third party protocol, e.g. an IRC network.
+type ProtocolInstance struct {
+	Description string          `json:"desc"`
+	Icon        string          `json:"icon,omitempty"`
+	NetworkID   string          `json:"network_id,omitempty"`
+	InstanceID  string          `json:"instance_id,omitempty"`
+	Fields      json.RawMessage `json:"fields,omitempty"`
+}
+
+// LocationRequest is a request to look up third party locations, either by the
+// fields of the protocol in Params, or by the room alias in Params if Protocol
+// is empty. Params is an encoded query string.
+type LocationRequest struct {
+	Protocol string `json:"protocol,omitempty"`
+	Params   string `json:"params,omitempty"`
+}
+
+// LocationResponse is a response with the third party locations found by all
+// application services which provide the protocol.
+type LocationResponse struct {
+	Locations []ASLocationResponse `json:"locations,omitempty"`
+	Exists    bool                 `json:"exists"`
+}
+
+// ASLocationResponse is a third party location and the room alias which is bridged to it.
+// https://spec.matrix.org/v1.4/application-service-api/#get_matrixappv1thirdpartylocationprotocol
+type ASLocationResponse struct {
+	Alias    string          `json:"alias"`
+	Fields   json.RawMessage `json:"fields"`
+	Protocol string          `json:"protocol"`
+}
+
+// UserRequest is a request to look up third party users, either by the fields
+// of the protocol in Params, or by the Matrix user ID in Params if Protocol is
+// empty. Params is an encoded query string.
+type UserRequest struct {
+	Protocol string `json:"protocol,omitempty"`
+	Params   string `json:"params,omitempty"`
+}
+
+// UserResponse is a response with the third party users found by all application
+// services which provide the protocol.
+type UserResponse struct {
+	Users  []ASUserResponse `json:"users,omitempty"`
+	Exists bool             `json:"exists"`
+}
+
+// ASUserResponse is a third party user and the Matrix user ID which is bridged to it.
+// https://spec.matrix.org/v1.4/application-service-api/#get_matrixappv1thirdpartyuserprotocol
+type ASUserResponse struct {
+	Protocol string          `json:"protocol"`
+	UserID   string          `json:"userid"`
+	Fields   json.RawMessage `json:"fields"`
+}
+
+// TransactionQueue is the state of the transaction queue of an application service.
+type TransactionQueue struct {
+	AppServiceID string `json:"appservice_id"`
+	// The number of room events waiting to be sent
+	QueuedEvents int `json:"queued_events"`
+	// Whether delivery was paused by an admin
+	Paused bool `json:"paused"`
+	// The ID of the latest transaction which was sent successfully, or 0
+	LastTxnID     int                         `json:"last_txn_id"`
+	LastSuccessTS gomatrixserverlib.Timestamp `json:"last_success_ts,omitempty"`
+	// The error of the latest transaction which failed
+	LastError   string                      `json:"last_error,omitempty"`
+	LastErrorTS gomatrixserverlib.Timestamp `json:"last_error_ts,omitempty"`
+	// When a failed transaction will be retried, if the worker is backing off
+	BackoffUntilTS gomatrixserverlib.Timestamp `json:"backoff_until_ts,omitempty"`
+}
+
+// QueryTransactionQueuesRequest is a request for the transaction queue of an
+// application service, or of all application services if AppServiceID is empty.
+type QueryTransactionQueuesRequest struct {
+	AppServiceID string `json:"appservice_id,omitempty"`
+}
+
+// QueryTransactionQueuesResponse is a response with the transaction queues.
+type QueryTransactionQueuesResponse struct {
+	Queues []TransactionQueue `json:"queues"`
+}
+
+// PerformTransactionQueuePauseRequest is a request to pause or resume delivery
+// of transactions to an application service.
+type PerformTransactionQueuePauseRequest struct {
+	AppServiceID string `json:"appservice_id"`
+	Paused       bool   `json:"paused"`
+}
+
+// PerformTransactionQueuePauseResponse is a response to PerformTransactionQueuePause.
+type PerformTransactionQueuePauseResponse struct {
+	AppServiceExists bool `json:"appservice_exists"`
+}
+
+// PerformTransactionQueueDiscardRequest is a request to discard everything which
+// is queued for an application service.
+type PerformTransactionQueueDiscardRequest struct {
+	AppServiceID string `json:"appservice_id"`
+}
+
+// PerformTransactionQueueDiscardResponse is a response to PerformTransactionQueueDiscard.
+type PerformTransactionQueueDiscardResponse struct {
+	AppServiceExists bool `json:"appservice_exists"`
+	// The number of room events which were discarded
+	Discarded int64 `json:"discarded"`
+}
+
+// PerformTransactionQueueReplayRequest is a request to send the events of the
+// transaction with the given ID, and of all later transactions, again.
+type PerformTransactionQueueReplayRequest struct {
+	AppServiceID string `json:"appservice_id"`
+	FromTxnID    int    `json:"from_txn_id"`
+}
+
+// PerformTransactionQueueReplayResponse is a response to PerformTransactionQueueReplay.
+type PerformTransactionQueueReplayResponse struct {
+	AppServiceExists bool `json:"appservice_exists"`
+	// The number of room events which were queued again
+	Replayed int64 `json:"replayed"`
+}
+
 // RetrieveUserProfile is a wrapper that queries both the local database and
 // application services for a given user's profile
 // TODO: Remove this, it's called from federationapi and clientapi but is a pure function
@@ -18,10 +18,11 @@ import (
 	"context"
 	"crypto/tls"
 	"net/http"
-	"sync"
+	"reflect"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 
 	appserviceAPI "github.com/matrix-org/dendrite/appservice/api"
@@ -31,6 +32,7 @@ import (
 	"github.com/matrix-org/dendrite/appservice/storage"
 	"github.com/matrix-org/dendrite/appservice/types"
 	"github.com/matrix-org/dendrite/appservice/workers"
+	keyserverAPI "github.com/matrix-org/dendrite/keyserver/api"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/base"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -48,6 +50,7 @@ func NewInternalAPI(
 	base *base.BaseDendrite,
 	userAPI userapi.UserInternalAPI,
 	rsAPI roomserverAPI.RoomserverInternalAPI,
+	keyAPI keyserverAPI.AppserviceKeyAPI,
 ) appserviceAPI.AppServiceInternalAPI {
 	client := &http.Client{
 		Timeout: time.Second * 30,
@@ -70,14 +73,9 @@ func NewInternalAPI(
 	// Wrap application services in a type that relates the application service and
 	// a sync.Cond object that can be used to notify workers when there are new
 	// events to be sent out.
-	workerStates := make([]types.ApplicationServiceWorkerState, len(base.Cfg.Derived.ApplicationServices))
-	for i, appservice := range base.Cfg.Derived.ApplicationServices {
-		m := sync.Mutex{}
-		ws := types.ApplicationServiceWorkerState{
-			AppService: appservice,
-			Cond:       sync.NewCond(&m),
-		}
-		workerStates[i] = ws
+	states := make([]*types.ApplicationServiceWorkerState, len(base.Cfg.Derived.AppServices()))
+	for i, appservice := range base.Cfg.Derived.AppServices() {
+		states[i] = types.NewWorkerState(appservice)
 
 		// Create bot account for this AS if it doesn't already exist
 		if err = generateAppServiceAccount(userAPI, appservice); err != nil {
@@ -86,33 +84,164 @@ func NewInternalAPI(
 			}).WithError(err).Panicf("failed to generate bot account for appservice")
 		}
 	}
+	workerStates := types.NewWorkerStates(states)
 
 	// Create appserivce query API with an HTTP client that will be used for all
 	// outbound and inbound requests (inbound only for the internal API)
 	appserviceQueryAPI := &query.AppServiceQueryAPI{
-		HTTPClient: client,
-		Cfg:        base.Cfg,
-	}
-
-	// Only consume if we actually have ASes to track, else we'll just chew cycles needlessly.
-	// We can't add ASes at runtime so this is safe to do.
-	if len(workerStates) > 0 {
-		consumer := consumers.NewOutputRoomEventConsumer(
-			base.ProcessContext, base.Cfg, js, appserviceDB,
-			rsAPI, workerStates,
-		)
-		if err := consumer.Start(); err != nil {
-			logrus.WithError(err).Panicf("failed to start appservice roomserver consumer")
-		}
+		HTTPClient:   client,
+		Cfg:          base.Cfg,
+		WorkerStates: workerStates,
+		DB:           appserviceDB,
+	}
+
+	// Always consume, even if there are no ASes to track yet, as ASes can be added
+	// at runtime when the config is reloaded.
+	consumer := consumers.NewOutputRoomEventConsumer(
+		base.ProcessContext, base.Cfg, js, appserviceDB,
+		rsAPI, workerStates,
+	)
+	if err := consumer.Start(); err != nil {
+		logrus.WithError(err).Panicf("failed to start appservice roomserver consumer")
+	}
+
+	typingConsumer := consumers.NewOutputTypingConsumer(
+		base.ProcessContext, base.Cfg, js, rsAPI, workerStates,
+	)
+	if err := typingConsumer.Start(); err != nil {
+		logrus.WithError(err).Panicf("failed to start appservice typing consumer")
+	}
+	receiptConsumer := consumers.NewOutputReceiptConsumer(
+		base.ProcessContext, base.Cfg, js, rsAPI, workerStates,
+	)
+	if err := receiptConsumer.Start(); err != nil {
+		logrus.WithError(err).Panicf("failed to start appservice receipt consumer")
+	}
+	presenceConsumer := consumers.NewOutputPresenceConsumer(
+		base.ProcessContext, base.Cfg, js, workerStates,
+	)
+	if err := presenceConsumer.Start(); err != nil {
+		logrus.WithError(err).Panicf("failed to start appservice presence consumer")
+	}
+	sendToDeviceConsumer := consumers.NewOutputSendToDeviceEventConsumer(
+		base.ProcessContext, base.Cfg, js, keyAPI, workerStates,
+	)
+	if err := sendToDeviceConsumer.Start(); err != nil {
+		logrus.WithError(err).Panicf("failed to start appservice send-to-device consumer")
+	}
+	keyChangeConsumer := consumers.NewOutputKeyChangeEventConsumer(
+		base.ProcessContext, base.Cfg, js, rsAPI, workerStates,
+	)
+	if err := keyChangeConsumer.Start(); err != nil {
+		logrus.WithError(err).Panicf("failed to start appservice key change consumer")
 	}
 
 	// Create application service transaction workers
-	if err := workers.SetupTransactionWorkers(client, appserviceDB, workerStates); err != nil {
+	if err := workers.SetupTransactionWorkers(client, appserviceDB, workerStates.All()); err != nil {
 		logrus.WithError(err).Panicf("failed to start app service transaction workers")
 	}
+
+	prometheus.MustRegister(workers.NewQueueCollector(appserviceDB, workerStates))
+
+	// Start and stop workers when the application services are reloaded, and
+	// look up the protocols which they provide again
+	base.OnConfigReload(func(cfg *config.Dendrite) {
+		reloadWorkerStates(client, appserviceDB, userAPI, workerStates, cfg.Derived.AppServices())
+		appserviceQueryAPI.ClearProtocolCache()
+	})
 	return appserviceQueryAPI
 }
 
+// reloadWorkerStates replaces the worker states with ones for the given application
+// services. Workers of unchanged application services keep running. Workers of
+// changed or removed application services are stopped, and new workers are started
+// for changed or added ones. Queued room events are kept in the database, so they
+// are sent by the new worker of a changed application service. The new worker only
+// starts once the old one has exited, carrying on with the transaction which the
+// old one was sending, so that nothing is sent twice.
+func reloadWorkerStates(
+	client *http.Client,
+	appserviceDB storage.Database,
+	userAPI userapi.AppserviceUserAPI,
+	workerStates *types.WorkerStates,
+	appservices []config.ApplicationService,
+) {
+	oldStates := map[string]*types.ApplicationServiceWorkerState{}
+	for _, ws := range workerStates.All() {
+		oldStates[ws.AppService.ID] = ws
+	}
+
+	states := make([]*types.ApplicationServiceWorkerState, 0, len(appservices))
+	var started []*types.ApplicationServiceWorkerState
+	replaced := map[*types.ApplicationServiceWorkerState]*types.ApplicationServiceWorkerState{}
+	for _, appservice := range appservices {
+		if ws, ok := oldStates[appservice.ID]; ok && !appserviceChanged(ws.AppService, appservice) {
+			delete(oldStates, appservice.ID)
+			states = append(states, ws)
+			continue
+		}
+		if err := generateAppServiceAccount(userAPI, appservice); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"appservice": appservice.ID,
+			}).WithError(err).Error("failed to generate bot account for appservice")
+			// Keep the old worker, if any, so that nothing is lost.
+			if ws, ok := oldStates[appservice.ID]; ok {
+				delete(oldStates, appservice.ID)
+				states = append(states, ws)
+			}
+			continue
+		}
+		ws := types.NewWorkerState(appservice)
+		states = append(states, ws)
+		if old, ok := oldStates[appservice.ID]; ok {
+			delete(oldStates, appservice.ID)
+			ws.SetPaused(old.Status().Paused)
+			ws.QueuePendingData(old.Stop())
+			replaced[ws] = old
+			continue
+		}
+		started = append(started, ws)
+	}
+	for _, ws := range oldStates {
+		logrus.WithField("appservice", ws.AppService.ID).Info("Application service was removed")
+		ws.Stop()
+	}
+
+	workerStates.Set(states)
+	for _, ws := range started {
+		workers.StartTransactionWorker(client, appserviceDB, ws)
+	}
+	for ws, old := range replaced {
+		go func(ws, old *types.ApplicationServiceWorkerState) {
+			// The old worker may be in the middle of sending a transaction.
+			<-old.Done()
+			ws.SetInflight(old.TakeInflight())
+			// Data which was queued for the old worker while it was stopping.
+			ws.QueuePendingData(old.Stop())
+			workers.StartTransactionWorker(client, appserviceDB, ws)
+		}(ws, old)
+	}
+}
+
+// appserviceChanged returns true if the registration of the application service
+// differs, ignoring the compiled namespace regexes.
+func appserviceChanged(a, b config.ApplicationService) bool {
+	stripRegexps := func(as config.ApplicationService) config.ApplicationService {
+		namespaces := make(map[string][]config.ApplicationServiceNamespace, len(as.NamespaceMap))
+		for key, namespaceSlice := range as.NamespaceMap {
+			stripped := make([]config.ApplicationServiceNamespace, len(namespaceSlice))
+			for i, namespace := range namespaceSlice {
+				namespace.RegexpObject = nil
+				stripped[i] = namespace
+			}
+			namespaces[key] = stripped
+		}
+		as.NamespaceMap = namespaces
+		return as
+	}
+	return !reflect.DeepEqual(stripRegexps(a), stripRegexps(b))
+}
+
 // generateAppServiceAccounts creates a dummy account based off the
 // `sender_localpart` field of each application service if it doesn't
 // exist already
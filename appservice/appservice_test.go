@@ -0,0 +1,100 @@
+package appservice
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/appservice/storage"
+	"github.com/matrix-org/dendrite/appservice/types"
+	"github.com/matrix-org/dendrite/appservice/workers"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/test"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+type reloadUserAPI struct{}
+
+func (u *reloadUserAPI) PerformAccountCreation(ctx context.Context, req *userapi.PerformAccountCreationRequest, res *userapi.PerformAccountCreationResponse) error {
+	return nil
+}
+
+func (u *reloadUserAPI) PerformDeviceCreation(ctx context.Context, req *userapi.PerformDeviceCreationRequest, res *userapi.PerformDeviceCreationResponse) error {
+	return nil
+}
+
+type transactionRequest struct {
+	path  string
+	token string
+}
+
+func TestReloadWorkerStatesHandsOverTransaction(t *testing.T) {
+	connStr, closeDB := test.PrepareDBConnectionString(t, test.DBTypeSQLite)
+	defer closeDB()
+	db, err := storage.NewDatabase(nil, &config.DatabaseOptions{
+		ConnectionString: config.DataSource(connStr),
+	})
+	if err != nil {
+		t.Fatalf("NewDatabase returned %s", err)
+	}
+
+	// The first transaction fails once the application service was reloaded.
+	requests := make(chan transactionRequest, 10)
+	release := make(chan struct{})
+	first := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests <- transactionRequest{req.URL.Path, req.Header.Get("Authorization")}
+		if first {
+			first = false
+			<-release
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+
+	as := config.ApplicationService{ID: "bridge", URL: srv.URL, HSToken: "old", SenderLocalpart: "bridge"}
+	ws := types.NewWorkerState(as)
+	workerStates := types.NewWorkerStates([]*types.ApplicationServiceWorkerState{ws})
+	workers.StartTransactionWorker(srv.Client(), db, ws)
+	ws.NotifyEphemeralEvent(json.RawMessage(`{"type":"m.typing"}`))
+
+	var sent transactionRequest
+	select {
+	case sent = <-requests:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("expected a transaction to be sent")
+	}
+
+	changed := as
+	changed.HSToken = "new"
+	reloadWorkerStates(srv.Client(), db, &reloadUserAPI{}, workerStates, []config.ApplicationService{changed})
+
+	// The new worker waits for the old one to finish sending.
+	select {
+	case req := <-requests:
+		t.Fatalf("expected no transaction while the old worker is sending, got %+v", req)
+	case <-time.After(time.Millisecond * 100):
+	}
+	close(release)
+
+	// The new worker sends the transaction again, rather than a new one.
+	select {
+	case req := <-requests:
+		if req.path != sent.path || req.token != "Bearer new" {
+			t.Fatalf("expected the transaction %s to be sent by the new worker, got %+v", sent.path, req)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("expected the transaction to be sent again")
+	}
+	select {
+	case req := <-requests:
+		t.Fatalf("expected no further transactions, got %+v", req)
+	case <-time.After(time.Millisecond * 100):
+	}
+	workerStates.All()[0].Stop()
+}
@@ -0,0 +1,67 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"encoding/json"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/matrix-org/dendrite/appservice/types"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// ephemeralEvent is an EDU as sent to application services in transactions.
+// https://github.com/matrix-org/matrix-spec-proposals/pull/2409
+type ephemeralEvent struct {
+	Type    string      `json:"type"`
+	RoomID  string      `json:"room_id,omitempty"`
+	Sender  string      `json:"sender,omitempty"`
+	Content interface{} `json:"content"`
+}
+
+// ephemeralWorkerStates returns the workers of the application services which
+// receive ephemeral events.
+func ephemeralWorkerStates(workerStates []*types.ApplicationServiceWorkerState) []*types.ApplicationServiceWorkerState {
+	var states []*types.ApplicationServiceWorkerState
+	for _, ws := range workerStates {
+		if ws.AppService.URL != "" && ws.AppService.ReceiveEphemeral {
+			states = append(states, ws)
+		}
+	}
+	return states
+}
+
+// queueEphemeralEvent queues the event to be sent to the application services
+// which are interested in it.
+func queueEphemeralEvent(
+	workerStates []*types.ApplicationServiceWorkerState, event *ephemeralEvent,
+	isInterested func(appservice *config.ApplicationService) bool,
+) {
+	var eventJSON json.RawMessage
+	for _, ws := range workerStates {
+		if !isInterested(&ws.AppService) {
+			continue
+		}
+		if eventJSON == nil {
+			var err error
+			if eventJSON, err = json.Marshal(event); err != nil {
+				log.WithError(err).Errorf("failed to marshal %s event for application services", event.Type)
+				return
+			}
+		}
+		ws.NotifyEphemeralEvent(eventJSON)
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/matrix-org/dendrite/appservice/types"
+	keyAPI "github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/jetstream"
+	"github.com/matrix-org/dendrite/setup/process"
+)
+
+// OutputKeyChangeEventConsumer sends device list changes to the application
+// services which have enabled MSC3202, if the user whose device list changed
+// shares a room with any of the users in their exclusive namespaces.
+type OutputKeyChangeEventConsumer struct {
+	ctx          context.Context
+	jetstream    nats.JetStreamContext
+	durable      string
+	topic        string
+	rsAPI        api.AppserviceRoomserverAPI
+	workerStates *types.WorkerStates
+}
+
+// NewOutputKeyChangeEventConsumer creates a new OutputKeyChangeEventConsumer. Call Start() to begin consuming key changes.
+func NewOutputKeyChangeEventConsumer(
+	process *process.ProcessContext,
+	cfg *config.Dendrite,
+	js nats.JetStreamContext,
+	rsAPI api.AppserviceRoomserverAPI,
+	workerStates *types.WorkerStates,
+) *OutputKeyChangeEventConsumer {
+	return &OutputKeyChangeEventConsumer{
+		ctx:          process.Context(),
+		jetstream:    js,
+		durable:      cfg.Global.JetStream.Durable("AppserviceKeyChangeConsumer"),
+		topic:        cfg.Global.JetStream.Prefixed(jetstream.OutputKeyChangeEvent),
+		rsAPI:        rsAPI,
+		workerStates: workerStates,
+	}
+}
+
+// Start consuming key changes.
+func (c *OutputKeyChangeEventConsumer) Start() error {
+	return jetstream.JetStreamConsumer(
+		c.ctx, c.jetstream, c.topic, c.durable, c.onMessage,
+		nats.DeliverNew(), nats.ManualAck(),
+	)
+}
+
+func (c *OutputKeyChangeEventConsumer) onMessage(ctx context.Context, msg *nats.Msg) bool {
+	var m keyAPI.DeviceMessage
+	if err := json.Unmarshal(msg.Data, &m); err != nil {
+		log.WithError(err).Errorf("output log: key change parse failure")
+		return true
+	}
+	var userID string
+	switch {
+	case m.DeviceKeys != nil:
+		userID = m.DeviceKeys.UserID
+	case m.OutputCrossSigningKeyUpdate != nil:
+		userID = m.OutputCrossSigningKeyUpdate.UserID
+	default:
+		return true
+	}
+	workerStates := msc3202WorkerStates(c.workerStates.All())
+	if len(workerStates) == 0 {
+		return true
+	}
+
+	sharedUsers, err := querySharedUsers(ctx, c.rsAPI, userID)
+	if err != nil {
+		log.WithError(err).Error("failed to query users sharing rooms for key change")
+		return false
+	}
+	for _, ws := range workerStates {
+		if appserviceSharesRoom(&ws.AppService, userID, sharedUsers) {
+			ws.NotifyDeviceListChange(userID, false)
+		}
+	}
+	return true
+}
+
+// msc3202WorkerStates returns the workers of the application services which
+// receive device list changes and one-time key counts.
+func msc3202WorkerStates(workerStates []*types.ApplicationServiceWorkerState) []*types.ApplicationServiceWorkerState {
+	var states []*types.ApplicationServiceWorkerState
+	for _, ws := range workerStates {
+		if ws.AppService.URL != "" && ws.AppService.MSC3202 {
+			states = append(states, ws)
+		}
+	}
+	return states
+}
+
+// querySharedUsers returns the users who share at least one room with the user.
+func querySharedUsers(ctx context.Context, rsAPI api.AppserviceRoomserverAPI, userID string) (map[string]int, error) {
+	var res api.QuerySharedUsersResponse
+	if err := rsAPI.QuerySharedUsers(ctx, &api.QuerySharedUsersRequest{
+		UserID: userID,
+	}, &res); err != nil {
+		return nil, err
+	}
+	return res.UserIDsToCount, nil
+}
+
+// appserviceSharesRoom returns true if the user is in the exclusive namespace of
+// the application service, or shares a room with any user who is.
+func appserviceSharesRoom(appservice *config.ApplicationService, userID string, sharedUsers map[string]int) bool {
+	if appservice.OwnsNamespaceCoveringUserId(userID) {
+		return true
+	}
+	for sharedUserID := range sharedUsers {
+		if appservice.OwnsNamespaceCoveringUserId(sharedUserID) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/nats-io/nats.go"
+
+	"github.com/matrix-org/dendrite/appservice/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/jetstream"
+	"github.com/matrix-org/dendrite/setup/process"
+	syncTypes "github.com/matrix-org/dendrite/syncapi/types"
+)
+
+// OutputPresenceConsumer sends the presence of the users in their namespaces
+// to the application services which receive ephemeral events.
+type OutputPresenceConsumer struct {
+	ctx          context.Context
+	jetstream    nats.JetStreamContext
+	durable      string
+	topic        string
+	workerStates *types.WorkerStates
+}
+
+// NewOutputPresenceConsumer creates a new OutputPresenceConsumer. Call Start() to begin consuming presence events.
+func NewOutputPresenceConsumer(
+	process *process.ProcessContext,
+	cfg *config.Dendrite,
+	js nats.JetStreamContext,
+	workerStates *types.WorkerStates,
+) *OutputPresenceConsumer {
+	return &OutputPresenceConsumer{
+		ctx:          process.Context(),
+		jetstream:    js,
+		durable:      cfg.Global.JetStream.Durable("AppservicePresenceConsumer"),
+		topic:        cfg.Global.JetStream.Prefixed(jetstream.OutputPresenceEvent),
+		workerStates: workerStates,
+	}
+}
+
+// Start consuming presence events.
+func (c *OutputPresenceConsumer) Start() error {
+	return jetstream.JetStreamConsumer(
+		c.ctx, c.jetstream, c.topic, c.durable, c.onMessage,
+		nats.DeliverNew(), nats.ManualAck(), nats.HeadersOnly(),
+	)
+}
+
+func (c *OutputPresenceConsumer) onMessage(ctx context.Context, msg *nats.Msg) bool {
+	userID := msg.Header.Get(jetstream.UserID)
+	ts, err := strconv.Atoi(msg.Header.Get("last_active_ts"))
+	if err != nil {
+		return true
+	}
+	presence := msg.Header.Get("presence")
+	p := syncTypes.PresenceInternal{LastActiveTS: gomatrixserverlib.Timestamp(ts)}
+	// Only online users can be currently active.
+	currentlyActive := presence == syncTypes.PresenceOnline.String() && p.CurrentlyActive()
+	content := syncTypes.PresenceClientResponse{
+		CurrentlyActive: &currentlyActive,
+		LastActiveAgo:   p.LastActiveAgo(),
+		Presence:        presence,
+	}
+	if data, ok := msg.Header["status_msg"]; ok && len(data) > 0 {
+		statusMsg := msg.Header.Get("status_msg")
+		content.StatusMsg = &statusMsg
+	}
+
+	event := &ephemeralEvent{
+		Type:    gomatrixserverlib.MPresence,
+		Sender:  userID,
+		Content: content,
+	}
+	queueEphemeralEvent(ephemeralWorkerStates(c.workerStates.All()), event, func(appservice *config.ApplicationService) bool {
+		return appservice.IsInterestedInUserID(userID)
+	})
+	return true
+}
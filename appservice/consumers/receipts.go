@@ -0,0 +1,108 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/matrix-org/dendrite/appservice/types"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/jetstream"
+	"github.com/matrix-org/dendrite/setup/process"
+)
+
+// OutputReceiptConsumer sends read receipts to the application services which
+// receive ephemeral events.
+type OutputReceiptConsumer struct {
+	ctx          context.Context
+	jetstream    nats.JetStreamContext
+	durable      string
+	topic        string
+	rsAPI        api.AppserviceRoomserverAPI
+	workerStates *types.WorkerStates
+}
+
+// NewOutputReceiptConsumer creates a new OutputReceiptConsumer. Call Start() to begin consuming receipts.
+func NewOutputReceiptConsumer(
+	process *process.ProcessContext,
+	cfg *config.Dendrite,
+	js nats.JetStreamContext,
+	rsAPI api.AppserviceRoomserverAPI,
+	workerStates *types.WorkerStates,
+) *OutputReceiptConsumer {
+	return &OutputReceiptConsumer{
+		ctx:          process.Context(),
+		jetstream:    js,
+		durable:      cfg.Global.JetStream.Durable("AppserviceReceiptConsumer"),
+		topic:        cfg.Global.JetStream.Prefixed(jetstream.OutputReceiptEvent),
+		rsAPI:        rsAPI,
+		workerStates: workerStates,
+	}
+}
+
+// Start consuming receipts.
+func (c *OutputReceiptConsumer) Start() error {
+	return jetstream.JetStreamConsumer(
+		c.ctx, c.jetstream, c.topic, c.durable, c.onMessage,
+		nats.DeliverNew(), nats.ManualAck(), nats.HeadersOnly(),
+	)
+}
+
+type receiptTS struct {
+	TS       gomatrixserverlib.Timestamp `json:"ts"`
+	ThreadID string                      `json:"thread_id,omitempty"`
+}
+
+func (c *OutputReceiptConsumer) onMessage(ctx context.Context, msg *nats.Msg) bool {
+	userID := msg.Header.Get(jetstream.UserID)
+	roomID := msg.Header.Get(jetstream.RoomID)
+	eventID := msg.Header.Get(jetstream.EventID)
+	receiptType := msg.Header.Get("type")
+	// Private receipts are only for the user's own devices.
+	if receiptType == "m.read.private" {
+		return true
+	}
+	timestamp, err := strconv.ParseUint(msg.Header.Get("timestamp"), 10, 64)
+	if err != nil {
+		log.WithError(err).Errorf("output log: receipt parse failure")
+		return true
+	}
+
+	event := &ephemeralEvent{
+		Type:   gomatrixserverlib.MReceipt,
+		RoomID: roomID,
+		Content: map[string]map[string]map[string]receiptTS{
+			eventID: {
+				receiptType: {
+					userID: {
+						TS:       gomatrixserverlib.Timestamp(timestamp),
+						ThreadID: msg.Header.Get("thread_id"),
+					},
+				},
+			},
+		},
+	}
+	queueEphemeralEvent(ephemeralWorkerStates(c.workerStates.All()), event, func(appservice *config.ApplicationService) bool {
+		return appservice.IsInterestedInUserID(userID) ||
+			appserviceIsInterestedInRoom(ctx, c.rsAPI, roomID, appservice)
+	})
+	return true
+}
@@ -39,7 +39,7 @@ type OutputRoomEventConsumer struct {
 	asDB         storage.Database
 	rsAPI        api.AppserviceRoomserverAPI
 	serverName   string
-	workerStates []types.ApplicationServiceWorkerState
+	workerStates *types.WorkerStates
 }
 
 // NewOutputRoomEventConsumer creates a new OutputRoomEventConsumer. Call
@@ -50,7 +50,7 @@ func NewOutputRoomEventConsumer(
 	js nats.JetStreamContext,
 	appserviceDB storage.Database,
 	rsAPI api.AppserviceRoomserverAPI,
-	workerStates []types.ApplicationServiceWorkerState,
+	workerStates *types.WorkerStates,
 ) *OutputRoomEventConsumer {
 	return &OutputRoomEventConsumer{
 		ctx:          process.Context(),
@@ -123,9 +123,100 @@ func (s *OutputRoomEventConsumer) onMessage(ctx context.Context, msg *nats.Msg)
 		return true
 	}
 
+	if output.Type == api.OutputTypeNewRoomEvent {
+		for _, event := range events {
+			s.notifyDeviceListChanges(ctx, event)
+		}
+	}
+
 	return true
 }
 
+// notifyDeviceListChanges tells the application services which have enabled MSC3202
+// about users whose device lists they are now interested in, because they started to
+// share a room with the users in their exclusive namespaces, or are no longer
+// interested in, because they don't share a room anymore.
+func (s *OutputRoomEventConsumer) notifyDeviceListChanges(ctx context.Context, event *gomatrixserverlib.HeaderedEvent) {
+	if event.Type() != gomatrixserverlib.MRoomMember || event.StateKey() == nil {
+		return
+	}
+	workerStates := msc3202WorkerStates(s.workerStates.All())
+	if len(workerStates) == 0 {
+		return
+	}
+	membership, err := event.Membership()
+	if err != nil {
+		return
+	}
+	userID := *event.StateKey()
+	left := membership == gomatrixserverlib.Leave || membership == gomatrixserverlib.Ban
+	if !left && membership != gomatrixserverlib.Join {
+		return
+	}
+
+	members, err := joinedMembers(ctx, s.rsAPI, event.RoomID())
+	if err != nil {
+		log.WithError(err).WithField("room_id", event.RoomID()).Error("failed to get members of room")
+		return
+	}
+	for _, ws := range workerStates {
+		if !ws.AppService.OwnsNamespaceCoveringUserId(userID) {
+			// Another user joined or left, which only matters if the application service has users in the room.
+			for _, member := range members {
+				if ws.AppService.OwnsNamespaceCoveringUserId(member) {
+					s.notifyDeviceListChange(ctx, ws, userID, left)
+					break
+				}
+			}
+			continue
+		}
+		// A user of the application service joined or left, so all other members of the room matter.
+		for _, member := range members {
+			if !ws.AppService.OwnsNamespaceCoveringUserId(member) {
+				s.notifyDeviceListChange(ctx, ws, member, left)
+			}
+		}
+	}
+}
+
+// notifyDeviceListChange sends the user's device list as changed if the user joined a
+// room with users of the application service, or as left if the user left it and
+// doesn't share any other rooms with them.
+func (s *OutputRoomEventConsumer) notifyDeviceListChange(
+	ctx context.Context, ws *types.ApplicationServiceWorkerState, userID string, left bool,
+) {
+	if !left {
+		ws.NotifyDeviceListChange(userID, false)
+		return
+	}
+	sharedUsers, err := querySharedUsers(ctx, s.rsAPI, userID)
+	if err != nil {
+		log.WithError(err).Error("failed to query users sharing rooms for membership change")
+		return
+	}
+	if !appserviceSharesRoom(&ws.AppService, userID, sharedUsers) {
+		ws.NotifyDeviceListChange(userID, true)
+	}
+}
+
+// joinedMembers returns the user IDs of the users who are joined to the room.
+func joinedMembers(ctx context.Context, rsAPI api.AppserviceRoomserverAPI, roomID string) ([]string, error) {
+	var res api.QueryMembershipsForRoomResponse
+	if err := rsAPI.QueryMembershipsForRoom(ctx, &api.QueryMembershipsForRoomRequest{
+		RoomID:     roomID,
+		JoinedOnly: true,
+	}, &res); err != nil {
+		return nil, err
+	}
+	members := make([]string, 0, len(res.JoinEvents))
+	for _, ev := range res.JoinEvents {
+		if ev.StateKey != nil {
+			members = append(members, *ev.StateKey)
+		}
+	}
+	return members, nil
+}
+
 // filterRoomserverEvents takes in events and decides whether any of them need
 // to be passed on to an external application service. It does this by checking
 // each namespace of each registered application service, and if there is a
@@ -135,7 +226,7 @@ func (s *OutputRoomEventConsumer) filterRoomserverEvents(
 	ctx context.Context,
 	events []*gomatrixserverlib.HeaderedEvent,
 ) error {
-	for _, ws := range s.workerStates {
+	for _, ws := range s.workerStates.All() {
 		for _, event := range events {
 			// Check if this event is interesting to this application service
 			if s.appserviceIsInterestedInEvent(ctx, event, ws.AppService) {
@@ -155,22 +246,22 @@ func (s *OutputRoomEventConsumer) filterRoomserverEvents(
 	return nil
 }
 
-// appserviceJoinedAtEvent returns a boolean depending on whether a given
-// appservice has membership at the time a given event was created.
-func (s *OutputRoomEventConsumer) appserviceJoinedAtEvent(ctx context.Context, event *gomatrixserverlib.HeaderedEvent, appservice config.ApplicationService) bool {
+// appserviceJoinedRoom returns true if any of the users in the application
+// service's namespace are joined to the room.
+func appserviceJoinedRoom(ctx context.Context, rsAPI api.AppserviceRoomserverAPI, roomID string, appservice *config.ApplicationService) bool {
 	// TODO: This is only checking the current room state, not the state at
 	// the event in question. Pretty sure this is what Synapse does too, but
 	// until we have a lighter way of checking the state before the event that
 	// doesn't involve state res, then this is probably OK.
 	membershipReq := &api.QueryMembershipsForRoomRequest{
-		RoomID:     event.RoomID(),
+		RoomID:     roomID,
 		JoinedOnly: true,
 	}
 	membershipRes := &api.QueryMembershipsForRoomResponse{}
 
 	// XXX: This could potentially race if the state for the event is not known yet
 	// e.g. the event came over federation but we do not have the full state persisted.
-	if err := s.rsAPI.QueryMembershipsForRoom(ctx, membershipReq, membershipRes); err == nil {
+	if err := rsAPI.QueryMembershipsForRoom(ctx, membershipReq, membershipRes); err == nil {
 		for _, ev := range membershipRes.JoinEvents {
 			var membership gomatrixserverlib.MemberContent
 			if err = json.Unmarshal(ev.Content, &membership); err != nil || ev.StateKey == nil {
@@ -182,16 +273,39 @@ func (s *OutputRoomEventConsumer) appserviceJoinedAtEvent(ctx context.Context, e
 		}
 	} else {
 		log.WithFields(log.Fields{
-			"room_id": event.RoomID(),
+			"room_id": roomID,
 		}).WithError(err).Errorf("Unable to get membership for room")
 	}
 	return false
 }
 
-// appserviceIsInterestedInEvent returns a boolean depending on whether a given
-// event falls within one of a given application service's namespaces.
-//
-// TODO: This should be cached, see https://github.com/matrix-org/dendrite/issues/1682
+// appserviceIsInterestedInRoom returns true if the room or any of its aliases
+// are in the application service's namespace, or any of the users in its
+// namespace are joined to the room.
+func appserviceIsInterestedInRoom(ctx context.Context, rsAPI api.AppserviceRoomserverAPI, roomID string, appservice *config.ApplicationService) bool {
+	if appservice.IsInterestedInRoomID(roomID) {
+		return true
+	}
+
+	// Check all known room aliases of the room
+	queryReq := api.GetAliasesForRoomIDRequest{RoomID: roomID}
+	var queryRes api.GetAliasesForRoomIDResponse
+	if err := rsAPI.GetAliasesForRoomID(ctx, &queryReq, &queryRes); err == nil {
+		for _, alias := range queryRes.Aliases {
+			if appservice.IsInterestedInRoomAlias(alias) {
+				return true
+			}
+		}
+	} else {
+		log.WithFields(log.Fields{
+			"room_id": roomID,
+		}).WithError(err).Errorf("Unable to get aliases for room")
+	}
+
+	// Check if any of the members in the room match the appservice
+	return appserviceJoinedRoom(ctx, rsAPI, roomID, appservice)
+}
+
 func (s *OutputRoomEventConsumer) appserviceIsInterestedInEvent(ctx context.Context, event *gomatrixserverlib.HeaderedEvent, appservice config.ApplicationService) bool {
 	// No reason to queue events if they'll never be sent to the application
 	// service
@@ -199,9 +313,8 @@ func (s *OutputRoomEventConsumer) appserviceIsInterestedInEvent(ctx context.Cont
 		return false
 	}
 
-	// Check Room ID and Sender of the event
-	if appservice.IsInterestedInUserID(event.Sender()) ||
-		appservice.IsInterestedInRoomID(event.RoomID()) {
+	// Check the sender of the event
+	if appservice.IsInterestedInUserID(event.Sender()) {
 		return true
 	}
 
@@ -211,21 +324,5 @@ func (s *OutputRoomEventConsumer) appserviceIsInterestedInEvent(ctx context.Cont
 		}
 	}
 
-	// Check all known room aliases of the room the event came from
-	queryReq := api.GetAliasesForRoomIDRequest{RoomID: event.RoomID()}
-	var queryRes api.GetAliasesForRoomIDResponse
-	if err := s.rsAPI.GetAliasesForRoomID(ctx, &queryReq, &queryRes); err == nil {
-		for _, alias := range queryRes.Aliases {
-			if appservice.IsInterestedInRoomAlias(alias) {
-				return true
-			}
-		}
-	} else {
-		log.WithFields(log.Fields{
-			"room_id": event.RoomID(),
-		}).WithError(err).Errorf("Unable to get aliases for room")
-	}
-
-	// Check if any of the members in the room match the appservice
-	return s.appserviceJoinedAtEvent(ctx, event, appservice)
+	return appserviceIsInterestedInRoom(ctx, s.rsAPI, event.RoomID(), &appservice)
 }
@@ -0,0 +1,144 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/matrix-org/dendrite/appservice/types"
+	keyAPI "github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/jetstream"
+	"github.com/matrix-org/dendrite/setup/process"
+	syncTypes "github.com/matrix-org/dendrite/syncapi/types"
+)
+
+// toDeviceEvent is a to-device message as sent to application services in transactions.
+// https://github.com/matrix-org/matrix-spec-proposals/pull/2409
+type toDeviceEvent struct {
+	Type       string          `json:"type"`
+	Sender     string          `json:"sender"`
+	Content    json.RawMessage `json:"content"`
+	ToUserID   string          `json:"to_user_id"`
+	ToDeviceID string          `json:"to_device_id"`
+}
+
+// OutputSendToDeviceEventConsumer sends to-device messages for the users in their
+// exclusive namespaces to the application services which receive ephemeral events.
+// The application services which have enabled MSC3202 are also sent the one-time
+// key counts of the devices, as these are usually used up by the senders of the
+// messages.
+type OutputSendToDeviceEventConsumer struct {
+	ctx          context.Context
+	jetstream    nats.JetStreamContext
+	durable      string
+	topic        string
+	serverName   gomatrixserverlib.ServerName
+	keyAPI       keyAPI.AppserviceKeyAPI
+	workerStates *types.WorkerStates
+}
+
+// NewOutputSendToDeviceEventConsumer creates a new OutputSendToDeviceEventConsumer. Call Start() to begin consuming to-device messages.
+func NewOutputSendToDeviceEventConsumer(
+	process *process.ProcessContext,
+	cfg *config.Dendrite,
+	js nats.JetStreamContext,
+	keyAPI keyAPI.AppserviceKeyAPI,
+	workerStates *types.WorkerStates,
+) *OutputSendToDeviceEventConsumer {
+	return &OutputSendToDeviceEventConsumer{
+		ctx:          process.Context(),
+		jetstream:    js,
+		durable:      cfg.Global.JetStream.Durable("AppserviceSendToDeviceConsumer"),
+		topic:        cfg.Global.JetStream.Prefixed(jetstream.OutputSendToDeviceEvent),
+		serverName:   cfg.Global.ServerName,
+		keyAPI:       keyAPI,
+		workerStates: workerStates,
+	}
+}
+
+// Start consuming to-device messages.
+func (c *OutputSendToDeviceEventConsumer) Start() error {
+	return jetstream.JetStreamConsumer(
+		c.ctx, c.jetstream, c.topic, c.durable, c.onMessage,
+		nats.DeliverNew(), nats.ManualAck(),
+	)
+}
+
+func (c *OutputSendToDeviceEventConsumer) onMessage(ctx context.Context, msg *nats.Msg) bool {
+	userID := msg.Header.Get(jetstream.UserID)
+	_, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil || domain != c.serverName {
+		return true
+	}
+	var states []*types.ApplicationServiceWorkerState
+	for _, ws := range c.workerStates.All() {
+		if ws.AppService.URL != "" && (ws.AppService.ReceiveEphemeral || ws.AppService.MSC3202) &&
+			ws.AppService.OwnsNamespaceCoveringUserId(userID) {
+			states = append(states, ws)
+		}
+	}
+	if len(states) == 0 {
+		return true
+	}
+
+	var output syncTypes.OutputSendToDeviceEvent
+	if err = json.Unmarshal(msg.Data, &output); err != nil {
+		log.WithError(err).Errorf("output log: message parse failure")
+		return true
+	}
+	eventJSON, err := json.Marshal(toDeviceEvent{
+		Type:       output.Type,
+		Sender:     output.Sender,
+		Content:    output.Content,
+		ToUserID:   output.UserID,
+		ToDeviceID: output.DeviceID,
+	})
+	if err != nil {
+		log.WithError(err).Errorf("failed to marshal to-device message for application services")
+		return true
+	}
+
+	var counts map[string]int
+	for _, ws := range states {
+		if ws.AppService.ReceiveEphemeral {
+			ws.NotifyToDeviceEvent(eventJSON)
+		}
+		if !ws.AppService.MSC3202 {
+			continue
+		}
+		if counts == nil {
+			var res keyAPI.QueryOneTimeKeysResponse
+			if err = c.keyAPI.QueryOneTimeKeys(ctx, &keyAPI.QueryOneTimeKeysRequest{
+				UserID:   output.UserID,
+				DeviceID: output.DeviceID,
+			}, &res); err != nil || res.Error != nil {
+				log.WithError(err).WithField("key_error", res.Error).Error("failed to query one-time key counts")
+				continue
+			}
+			counts = res.Count.KeyCount
+			if counts == nil {
+				counts = map[string]int{}
+			}
+		}
+		ws.NotifyOneTimeKeysCount(output.UserID, output.DeviceID, counts)
+	}
+	return true
+}
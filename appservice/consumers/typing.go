@@ -0,0 +1,119 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/matrix-org/dendrite/appservice/types"
+	"github.com/matrix-org/dendrite/internal/caching"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/jetstream"
+	"github.com/matrix-org/dendrite/setup/process"
+)
+
+// OutputTypingConsumer sends typing notifications to the application services
+// which receive ephemeral events.
+type OutputTypingConsumer struct {
+	ctx          context.Context
+	jetstream    nats.JetStreamContext
+	durable      string
+	topic        string
+	rsAPI        api.AppserviceRoomserverAPI
+	workerStates *types.WorkerStates
+	eduCache     *caching.EDUCache
+}
+
+// NewOutputTypingConsumer creates a new OutputTypingConsumer. Call Start() to begin consuming typing events.
+func NewOutputTypingConsumer(
+	process *process.ProcessContext,
+	cfg *config.Dendrite,
+	js nats.JetStreamContext,
+	rsAPI api.AppserviceRoomserverAPI,
+	workerStates *types.WorkerStates,
+) *OutputTypingConsumer {
+	c := &OutputTypingConsumer{
+		ctx:          process.Context(),
+		jetstream:    js,
+		durable:      cfg.Global.JetStream.Durable("AppserviceTypingConsumer"),
+		topic:        cfg.Global.JetStream.Prefixed(jetstream.OutputTypingEvent),
+		rsAPI:        rsAPI,
+		workerStates: workerStates,
+		eduCache:     caching.NewTypingCache(),
+	}
+	c.eduCache.SetTimeoutCallback(func(userID, roomID string, latestSyncPosition int64) {
+		c.sendTypingUsers(c.ctx, roomID)
+	})
+	return c
+}
+
+// Start consuming typing events. Typing notifications are only kept in memory,
+// so old ones aren't sent.
+func (c *OutputTypingConsumer) Start() error {
+	return jetstream.JetStreamConsumer(
+		c.ctx, c.jetstream, c.topic, c.durable, c.onMessage,
+		nats.DeliverNew(), nats.ManualAck(), nats.HeadersOnly(),
+	)
+}
+
+func (c *OutputTypingConsumer) onMessage(ctx context.Context, msg *nats.Msg) bool {
+	roomID := msg.Header.Get(jetstream.RoomID)
+	userID := msg.Header.Get(jetstream.UserID)
+	typing, err := strconv.ParseBool(msg.Header.Get("typing"))
+	if err != nil {
+		log.WithError(err).Errorf("output log: typing parse failure")
+		return true
+	}
+	timeout, err := strconv.Atoi(msg.Header.Get("timeout_ms"))
+	if err != nil {
+		log.WithError(err).Errorf("output log: timeout_ms parse failure")
+		return true
+	}
+
+	if typing {
+		expiry := time.Now().Add(time.Duration(timeout) * time.Millisecond)
+		c.eduCache.AddTypingUser(userID, roomID, &expiry)
+	} else {
+		c.eduCache.RemoveUser(userID, roomID)
+	}
+	c.sendTypingUsers(ctx, roomID)
+	return true
+}
+
+// sendTypingUsers sends the users who are typing in the room to the
+// application services which are interested in the room.
+func (c *OutputTypingConsumer) sendTypingUsers(ctx context.Context, roomID string) {
+	userIDs := c.eduCache.GetTypingUsers(roomID)
+	if userIDs == nil {
+		userIDs = []string{}
+	}
+	event := &ephemeralEvent{
+		Type:   gomatrixserverlib.MTyping,
+		RoomID: roomID,
+		Content: map[string][]string{
+			"user_ids": userIDs,
+		},
+	}
+	queueEphemeralEvent(ephemeralWorkerStates(c.workerStates.All()), event, func(appservice *config.ApplicationService) bool {
+		return appserviceIsInterestedInRoom(ctx, c.rsAPI, roomID, appservice)
+	})
+}
@@ -0,0 +1,97 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package internal contains helpers shared by the application service components.
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// PathPrefixV1 is the prefix of the application service API endpoints.
+// https://spec.matrix.org/v1.4/application-service-api/
+const PathPrefixV1 = "/_matrix/app/v1"
+
+// Request makes a request to an endpoint of the application service API, e.g. "/transactions/1".
+// The path must already be escaped, and may include a query string. The request is made to the /_matrix/app/v1 endpoint with the
+// hs_token in the Authorization header. If the application service doesn't know that endpoint,
+// the request is retried with the legacy unprefixed path and the hs_token in the query string.
+// The caller must close the body of the returned response.
+func Request(
+	ctx context.Context, client *http.Client, appservice *config.ApplicationService,
+	method, path string, body []byte,
+) (*http.Response, error) {
+	baseURL := strings.TrimSuffix(appservice.URL, "/")
+	resp, err := doRequest(ctx, client, method, baseURL+PathPrefixV1+path, appservice.HSToken, true, body)
+	if err != nil || !isUnknownEndpoint(resp) {
+		return resp, err
+	}
+	return doRequest(ctx, client, method, baseURL+path, appservice.HSToken, false, body)
+}
+
+func doRequest(
+	ctx context.Context, client *http.Client,
+	method, address, token string, authHeader bool, body []byte,
+) (*http.Response, error) {
+	if !authHeader {
+		separator := "?"
+		if strings.Contains(address, "?") {
+			separator = "&"
+		}
+		address += separator + "access_token=" + url.QueryEscape(token)
+	}
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, address, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	if authHeader {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return client.Do(req)
+}
+
+// isUnknownEndpoint returns true if the response says that the endpoint doesn't exist, rather
+// than that the requested user or room alias doesn't exist. If not, the response body is left
+// readable for the caller.
+func isUnknownEndpoint(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusNotFound && resp.StatusCode != http.StatusMethodNotAllowed {
+		return false
+	}
+	data, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	if err != nil {
+		return false
+	}
+	var errResp struct {
+		ErrCode string `json:"errcode"`
+	}
+	_ = json.Unmarshal(data, &errResp)
+	return errResp.ErrCode != "M_NOT_FOUND"
+}
@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func TestRequest(t *testing.T) {
+	tests := []struct {
+		name       string
+		legacy     bool // whether the AS only supports the legacy paths
+		path       string
+		wantStatus int
+		wantPaths  []string
+	}{
+		{
+			name:       "v1 endpoint",
+			path:       "/users/%40alice%3Alocalhost",
+			wantStatus: http.StatusOK,
+			wantPaths:  []string{"/_matrix/app/v1/users/@alice:localhost"},
+		},
+		{
+			name:       "v1 endpoint, unknown user",
+			path:       "/users/%40bob%3Alocalhost",
+			wantStatus: http.StatusNotFound,
+			wantPaths:  []string{"/_matrix/app/v1/users/@bob:localhost"},
+		},
+		{
+			name:       "legacy endpoint",
+			legacy:     true,
+			path:       "/users/%40alice%3Alocalhost",
+			wantStatus: http.StatusOK,
+			wantPaths:  []string{"/_matrix/app/v1/users/@alice:localhost", "/users/@alice:localhost"},
+		},
+		{
+			name:       "legacy endpoint with query string",
+			legacy:     true,
+			path:       "/users/%40alice%3Alocalhost?foo=bar",
+			wantStatus: http.StatusOK,
+			wantPaths:  []string{"/_matrix/app/v1/users/@alice:localhost", "/users/@alice:localhost"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotPaths []string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				gotPaths = append(gotPaths, req.URL.Path)
+				v1 := req.URL.Path != "/users/@alice:localhost" && req.URL.Path != "/users/@bob:localhost"
+				if v1 == tt.legacy {
+					w.WriteHeader(http.StatusNotFound)
+					_, _ = w.Write([]byte(`{"errcode":"M_UNRECOGNIZED"}`))
+					return
+				}
+				if v1 && req.Header.Get("Authorization") != "Bearer hs_token" {
+					t.Errorf("missing authorization header")
+				}
+				if !v1 && req.URL.Query().Get("access_token") != "hs_token" {
+					t.Errorf("missing access_token")
+				}
+				if strings.HasSuffix(req.URL.Path, "@bob:localhost") {
+					w.WriteHeader(http.StatusNotFound)
+					_, _ = w.Write([]byte(`{"errcode":"M_NOT_FOUND"}`))
+					return
+				}
+				_, _ = w.Write([]byte(`{}`))
+			}))
+			defer srv.Close()
+
+			appservice := &config.ApplicationService{
+				URL:     srv.URL,
+				HSToken: "hs_token",
+			}
+			resp, err := Request(context.Background(), srv.Client(), appservice, http.MethodGet, tt.path, nil)
+			if err != nil {
+				t.Fatalf("failed to make request: %s", err)
+			}
+			defer resp.Body.Close() // nolint: errcheck
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("got status %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if _, err = io.ReadAll(resp.Body); err != nil {
+				t.Fatalf("failed to read body: %s", err)
+			}
+			if len(gotPaths) != len(tt.wantPaths) {
+				t.Fatalf("got requests to %v, want %v", gotPaths, tt.wantPaths)
+			}
+			for i := range gotPaths {
+				if gotPaths[i] != tt.wantPaths[i] {
+					t.Fatalf("got requests to %v, want %v", gotPaths, tt.wantPaths)
+				}
+			}
+		})
+	}
+}
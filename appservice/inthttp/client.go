@@ -13,6 +13,14 @@ import (
 const (
 	AppServiceRoomAliasExistsPath = "/appservice/RoomAliasExists"
 	AppServiceUserIDExistsPath    = "/appservice/UserIDExists"
+	AppServiceProtocolsPath       = "/appservice/Protocols"
+	AppServiceLocationsPath       = "/appservice/Locations"
+	AppServiceUserPath            = "/appservice/User"
+
+	AppServiceQueryTransactionQueuesPath         = "/appservice/queryTransactionQueues"
+	AppServicePerformTransactionQueuePausePath   = "/appservice/performTransactionQueuePause"
+	AppServicePerformTransactionQueueDiscardPath = "/appservice/performTransactionQueueDiscard"
+	AppServicePerformTransactionQueueReplayPath  = "/appservice/performTransactionQueueReplay"
 )
 
 // httpAppServiceQueryAPI contains the URL to an appservice query API and a
@@ -58,3 +66,87 @@ func (h *httpAppServiceQueryAPI) UserIDExists(
 		h.httpClient, ctx, request, response,
 	)
 }
+
+// Protocols implements AppServiceQueryAPI
+func (h *httpAppServiceQueryAPI) Protocols(
+	ctx context.Context,
+	request *api.ProtocolRequest,
+	response *api.ProtocolResponse,
+) error {
+	return httputil.CallInternalRPCAPI(
+		"Protocols", h.appserviceURL+AppServiceProtocolsPath,
+		h.httpClient, ctx, request, response,
+	)
+}
+
+// Locations implements AppServiceQueryAPI
+func (h *httpAppServiceQueryAPI) Locations(
+	ctx context.Context,
+	request *api.LocationRequest,
+	response *api.LocationResponse,
+) error {
+	return httputil.CallInternalRPCAPI(
+		"Locations", h.appserviceURL+AppServiceLocationsPath,
+		h.httpClient, ctx, request, response,
+	)
+}
+
+// User implements AppServiceQueryAPI
+func (h *httpAppServiceQueryAPI) User(
+	ctx context.Context,
+	request *api.UserRequest,
+	response *api.UserResponse,
+) error {
+	return httputil.CallInternalRPCAPI(
+		"User", h.appserviceURL+AppServiceUserPath,
+		h.httpClient, ctx, request, response,
+	)
+}
+
+// QueryTransactionQueues implements AppServiceQueryAPI
+func (h *httpAppServiceQueryAPI) QueryTransactionQueues(
+	ctx context.Context,
+	request *api.QueryTransactionQueuesRequest,
+	response *api.QueryTransactionQueuesResponse,
+) error {
+	return httputil.CallInternalRPCAPI(
+		"QueryTransactionQueues", h.appserviceURL+AppServiceQueryTransactionQueuesPath,
+		h.httpClient, ctx, request, response,
+	)
+}
+
+// PerformTransactionQueuePause implements AppServiceQueryAPI
+func (h *httpAppServiceQueryAPI) PerformTransactionQueuePause(
+	ctx context.Context,
+	request *api.PerformTransactionQueuePauseRequest,
+	response *api.PerformTransactionQueuePauseResponse,
+) error {
+	return httputil.CallInternalRPCAPI(
+		"PerformTransactionQueuePause", h.appserviceURL+AppServicePerformTransactionQueuePausePath,
+		h.httpClient, ctx, request, response,
+	)
+}
+
+// PerformTransactionQueueDiscard implements AppServiceQueryAPI
+func (h *httpAppServiceQueryAPI) PerformTransactionQueueDiscard(
+	ctx context.Context,
+	request *api.PerformTransactionQueueDiscardRequest,
+	response *api.PerformTransactionQueueDiscardResponse,
+) error {
+	return httputil.CallInternalRPCAPI(
+		"PerformTransactionQueueDiscard", h.appserviceURL+AppServicePerformTransactionQueueDiscardPath,
+		h.httpClient, ctx, request, response,
+	)
+}
+
+// PerformTransactionQueueReplay implements AppServiceQueryAPI
+func (h *httpAppServiceQueryAPI) PerformTransactionQueueReplay(
+	ctx context.Context,
+	request *api.PerformTransactionQueueReplayRequest,
+	response *api.PerformTransactionQueueReplayResponse,
+) error {
+	return httputil.CallInternalRPCAPI(
+		"PerformTransactionQueueReplay", h.appserviceURL+AppServicePerformTransactionQueueReplayPath,
+		h.httpClient, ctx, request, response,
+	)
+}
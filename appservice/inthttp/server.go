@@ -17,4 +17,39 @@ func AddRoutes(a api.AppServiceInternalAPI, internalAPIMux *mux.Router) {
 		AppServiceUserIDExistsPath,
 		httputil.MakeInternalRPCAPI("AppserviceUserIDExists", a.UserIDExists),
 	)
+
+	internalAPIMux.Handle(
+		AppServiceProtocolsPath,
+		httputil.MakeInternalRPCAPI("AppserviceProtocols", a.Protocols),
+	)
+
+	internalAPIMux.Handle(
+		AppServiceLocationsPath,
+		httputil.MakeInternalRPCAPI("AppserviceLocations", a.Locations),
+	)
+
+	internalAPIMux.Handle(
+		AppServiceUserPath,
+		httputil.MakeInternalRPCAPI("AppserviceUser", a.User),
+	)
+
+	internalAPIMux.Handle(
+		AppServiceQueryTransactionQueuesPath,
+		httputil.MakeInternalRPCAPI("AppserviceQueryTransactionQueues", a.QueryTransactionQueues),
+	)
+
+	internalAPIMux.Handle(
+		AppServicePerformTransactionQueuePausePath,
+		httputil.MakeInternalRPCAPI("AppservicePerformTransactionQueuePause", a.PerformTransactionQueuePause),
+	)
+
+	internalAPIMux.Handle(
+		AppServicePerformTransactionQueueDiscardPath,
+		httputil.MakeInternalRPCAPI("AppservicePerformTransactionQueueDiscard", a.PerformTransactionQueueDiscard),
+	)
+
+	internalAPIMux.Handle(
+		AppServicePerformTransactionQueueReplayPath,
+		httputil.MakeInternalRPCAPI("AppservicePerformTransactionQueueReplay", a.PerformTransactionQueueReplay),
+	)
 }
@@ -18,22 +18,52 @@ package query
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/url"
+	"sync"
 
 	"github.com/matrix-org/dendrite/appservice/api"
+	"github.com/matrix-org/dendrite/appservice/internal"
+	"github.com/matrix-org/dendrite/appservice/storage"
+	"github.com/matrix-org/dendrite/appservice/types"
 	"github.com/matrix-org/dendrite/setup/config"
-	opentracing "github.com/opentracing/opentracing-go"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
 )
 
+var tracer = otel.Tracer("github.com/matrix-org/dendrite/appservice/query")
+
 const roomAliasExistsPath = "/rooms/"
 const userIDExistsPath = "/users/"
+const protocolPath = "/thirdparty/protocol/"
+const locationPath = "/thirdparty/location"
+const userPath = "/thirdparty/user"
 
 // AppServiceQueryAPI is an implementation of api.AppServiceQueryAPI
 type AppServiceQueryAPI struct {
 	HTTPClient *http.Client
 	Cfg        *config.Dendrite
+	// The workers of the application services and the database of their
+	// transaction queues
+	WorkerStates *types.WorkerStates
+	DB           storage.Database
+	// The metadata of the third party protocols, which rarely changes. The
+	// generation is bumped whenever the cache is cleared, so that lookups
+	// which were in progress don't fill it with outdated responses.
+	protocolCache    map[string]api.ASProtocolResponse
+	protocolCacheGen int
+	protocolCacheMu  sync.Mutex
+}
+
+// ClearProtocolCache forgets the metadata of the third party protocols, e.g.
+// because the application services were reloaded.
+func (a *AppServiceQueryAPI) ClearProtocolCache() {
+	a.protocolCacheMu.Lock()
+	defer a.protocolCacheMu.Unlock()
+	a.protocolCache = nil
+	a.protocolCacheGen++
 }
 
 // RoomAliasExists performs a request to '/room/{roomAlias}' on all known
@@ -43,30 +73,18 @@ func (a *AppServiceQueryAPI) RoomAliasExists(
 	request *api.RoomAliasExistsRequest,
 	response *api.RoomAliasExistsResponse,
 ) error {
-	span, ctx := opentracing.StartSpanFromContext(ctx, "ApplicationServiceRoomAlias")
-	defer span.Finish()
+	ctx, span := tracer.Start(ctx, "ApplicationServiceRoomAlias")
+	defer span.End()
 
 	// Determine which application service should handle this request
-	for _, appservice := range a.Cfg.Derived.ApplicationServices {
+	for _, appservice := range a.Cfg.Derived.AppServices() {
 		if appservice.URL != "" && appservice.IsInterestedInRoomAlias(request.Alias) {
-			// The full path to the rooms API, includes hs token
-			URL, err := url.Parse(appservice.URL + roomAliasExistsPath)
-			if err != nil {
-				return err
-			}
-
-			URL.Path += request.Alias
-			apiURL := URL.String() + "?access_token=" + appservice.HSToken
-
 			// Send a request to each application service. If one responds that it has
 			// created the room, immediately return.
-			req, err := http.NewRequest(http.MethodGet, apiURL, nil)
-			if err != nil {
-				return err
-			}
-			req = req.WithContext(ctx)
-
-			resp, err := a.HTTPClient.Do(req)
+			resp, err := internal.Request(
+				ctx, a.HTTPClient, &appservice, http.MethodGet,
+				roomAliasExistsPath+url.PathEscape(request.Alias), nil,
+			)
 			if resp != nil {
 				defer func() {
 					err = resp.Body.Close()
@@ -110,27 +128,18 @@ func (a *AppServiceQueryAPI) UserIDExists(
 	request *api.UserIDExistsRequest,
 	response *api.UserIDExistsResponse,
 ) error {
-	span, ctx := opentracing.StartSpanFromContext(ctx, "ApplicationServiceUserID")
-	defer span.Finish()
+	ctx, span := tracer.Start(ctx, "ApplicationServiceUserID")
+	defer span.End()
 
 	// Determine which application service should handle this request
-	for _, appservice := range a.Cfg.Derived.ApplicationServices {
+	for _, appservice := range a.Cfg.Derived.AppServices() {
 		if appservice.URL != "" && appservice.IsInterestedInUserID(request.UserID) {
-			// The full path to the rooms API, includes hs token
-			URL, err := url.Parse(appservice.URL + userIDExistsPath)
-			if err != nil {
-				return err
-			}
-			URL.Path += request.UserID
-			apiURL := URL.String() + "?access_token=" + appservice.HSToken
-
 			// Send a request to each application service. If one responds that it has
 			// created the user, immediately return.
-			req, err := http.NewRequest(http.MethodGet, apiURL, nil)
-			if err != nil {
-				return err
-			}
-			resp, err := a.HTTPClient.Do(req.WithContext(ctx))
+			resp, err := internal.Request(
+				ctx, a.HTTPClient, &appservice, http.MethodGet,
+				userIDExistsPath+url.PathEscape(request.UserID), nil,
+			)
 			if resp != nil {
 				defer func() {
 					err = resp.Body.Close()
@@ -165,3 +174,198 @@ func (a *AppServiceQueryAPI) UserIDExists(
 	response.UserIDExists = false
 	return nil
 }
+
+// Protocols returns the metadata of the requested third party protocol, or of all
+// protocols, merging the instances of all application services which provide it.
+func (a *AppServiceQueryAPI) Protocols(
+	ctx context.Context,
+	request *api.ProtocolRequest,
+	response *api.ProtocolResponse,
+) error {
+	ctx, span := tracer.Start(ctx, "ApplicationServiceProtocols")
+	defer span.End()
+
+	protocols := []string{request.Protocol}
+	if request.Protocol == "" {
+		protocols = nil
+		seen := map[string]struct{}{}
+		for _, appservice := range a.Cfg.Derived.AppServices() {
+			for _, protocol := range appservice.Protocols {
+				if _, ok := seen[protocol]; !ok {
+					seen[protocol] = struct{}{}
+					protocols = append(protocols, protocol)
+				}
+			}
+		}
+	}
+
+	response.Protocols = make(map[string]api.ASProtocolResponse, len(protocols))
+	for _, protocol := range protocols {
+		if res, ok := a.queryProtocol(ctx, protocol); ok {
+			response.Protocols[protocol] = res
+		}
+	}
+	response.Exists = len(response.Protocols) > 0
+	return nil
+}
+
+func (a *AppServiceQueryAPI) queryProtocol(ctx context.Context, protocol string) (api.ASProtocolResponse, bool) {
+	a.protocolCacheMu.Lock()
+	cached, ok := a.protocolCache[protocol]
+	gen := a.protocolCacheGen
+	a.protocolCacheMu.Unlock()
+	if ok {
+		return cached, true
+	}
+
+	var merged api.ASProtocolResponse
+	found := false
+	for _, appservice := range a.appservicesForProtocol(protocol) {
+		var res api.ASProtocolResponse
+		ok, err := requestThirdParty(ctx, a.HTTPClient, &appservice, protocolPath+url.PathEscape(protocol), &res)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"appservice_id": appservice.ID,
+				"protocol":      protocol,
+			}).WithError(err).Warn("unable to query protocol on application service")
+		}
+		if !ok || err != nil {
+			continue
+		}
+		// Instances of different application services may have the same network ID,
+		// so the instance ID includes the application service ID.
+		for i := range res.Instances {
+			if res.Instances[i].InstanceID == "" && res.Instances[i].NetworkID != "" {
+				res.Instances[i].InstanceID = appservice.ID + "|" + res.Instances[i].NetworkID
+			}
+		}
+		if !found {
+			merged = res
+			found = true
+		} else {
+			merged.Instances = append(merged.Instances, res.Instances...)
+		}
+	}
+	if !found {
+		return merged, false
+	}
+	if merged.Instances == nil {
+		merged.Instances = []api.ProtocolInstance{}
+	}
+
+	a.protocolCacheMu.Lock()
+	if a.protocolCacheGen == gen {
+		if a.protocolCache == nil {
+			a.protocolCache = map[string]api.ASProtocolResponse{}
+		}
+		a.protocolCache[protocol] = merged
+	}
+	a.protocolCacheMu.Unlock()
+	return merged, true
+}
+
+// Locations looks up third party locations in all application services which
+// provide the protocol, or in all application services which provide any protocol
+// if looking up the location by room alias.
+func (a *AppServiceQueryAPI) Locations(
+	ctx context.Context,
+	request *api.LocationRequest,
+	response *api.LocationResponse,
+) error {
+	ctx, span := tracer.Start(ctx, "ApplicationServiceLocations")
+	defer span.End()
+
+	path := locationPath
+	if request.Protocol != "" {
+		path += "/" + url.PathEscape(request.Protocol)
+	}
+	if request.Params != "" {
+		path += "?" + request.Params
+	}
+	for _, appservice := range a.appservicesForProtocol(request.Protocol) {
+		var res []api.ASLocationResponse
+		if _, err := requestThirdParty(ctx, a.HTTPClient, &appservice, path, &res); err != nil {
+			log.WithFields(log.Fields{
+				"appservice_id": appservice.ID,
+				"protocol":      request.Protocol,
+			}).WithError(err).Warn("unable to look up locations on application service")
+			continue
+		}
+		response.Locations = append(response.Locations, res...)
+	}
+	response.Exists = len(response.Locations) > 0
+	return nil
+}
+
+// User looks up third party users in all application services which provide the
+// protocol, or in all application services which provide any protocol if looking
+// up the user by Matrix user ID.
+func (a *AppServiceQueryAPI) User(
+	ctx context.Context,
+	request *api.UserRequest,
+	response *api.UserResponse,
+) error {
+	ctx, span := tracer.Start(ctx, "ApplicationServiceUser")
+	defer span.End()
+
+	path := userPath
+	if request.Protocol != "" {
+		path += "/" + url.PathEscape(request.Protocol)
+	}
+	if request.Params != "" {
+		path += "?" + request.Params
+	}
+	for _, appservice := range a.appservicesForProtocol(request.Protocol) {
+		var res []api.ASUserResponse
+		if _, err := requestThirdParty(ctx, a.HTTPClient, &appservice, path, &res); err != nil {
+			log.WithFields(log.Fields{
+				"appservice_id": appservice.ID,
+				"protocol":      request.Protocol,
+			}).WithError(err).Warn("unable to look up users on application service")
+			continue
+		}
+		response.Users = append(response.Users, res...)
+	}
+	response.Exists = len(response.Users) > 0
+	return nil
+}
+
+// appservicesForProtocol returns the application services which provide the
+// protocol, or which provide any protocol if the protocol is empty.
+func (a *AppServiceQueryAPI) appservicesForProtocol(protocol string) []config.ApplicationService {
+	var appservices []config.ApplicationService
+	for _, appservice := range a.Cfg.Derived.AppServices() {
+		if appservice.URL == "" {
+			continue
+		}
+		for _, p := range appservice.Protocols {
+			if protocol == "" || p == protocol {
+				appservices = append(appservices, appservice)
+				break
+			}
+		}
+	}
+	return appservices
+}
+
+// requestThirdParty makes a GET request to a third party endpoint of the
+// application service and decodes the JSON response into res. Returns false
+// if the application service found nothing.
+func requestThirdParty(
+	ctx context.Context, client *http.Client, appservice *config.ApplicationService,
+	path string, res interface{},
+) (bool, error) {
+	resp, err := internal.Request(ctx, client, appservice, http.MethodGet, path, nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, json.NewDecoder(resp.Body).Decode(res)
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("application service responded with status code %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,94 @@
+package query
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/appservice/api"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func TestThirdPartyLookups(t *testing.T) {
+	protocolRequests := 0
+	newAppservice := func(network string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			switch req.URL.Path {
+			case "/_matrix/app/v1/thirdparty/protocol/irc":
+				protocolRequests++
+				_, _ = w.Write([]byte(`{"user_fields":["network","nickname"],"location_fields":["network","channel"],"icon":"mxc://example.org/irc","field_types":{},"instances":[{"desc":"` + network + `","network_id":"` + network + `"}]}`))
+			case "/_matrix/app/v1/thirdparty/location/irc":
+				if req.URL.Query().Get("network") != network {
+					w.WriteHeader(http.StatusNotFound)
+					_, _ = w.Write([]byte(`{"errcode":"M_NOT_FOUND"}`))
+					return
+				}
+				_, _ = w.Write([]byte(`[{"alias":"#irc_` + network + `:localhost","protocol":"irc","fields":{"network":"` + network + `"}}]`))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+				_, _ = w.Write([]byte(`{"errcode":"M_UNRECOGNIZED"}`))
+			}
+		}))
+	}
+	srv1 := newAppservice("libera")
+	defer srv1.Close()
+	srv2 := newAppservice("oftc")
+	defer srv2.Close()
+
+	cfg := &config.Dendrite{}
+	cfg.Derived = config.Derived{
+		ApplicationServices: []config.ApplicationService{
+			{ID: "irc1", URL: srv1.URL, Protocols: []string{"irc"}},
+			{ID: "irc2", URL: srv2.URL, Protocols: []string{"irc"}},
+			{ID: "other", URL: srv2.URL},
+		},
+	}
+	asAPI := &AppServiceQueryAPI{HTTPClient: http.DefaultClient, Cfg: cfg}
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		var res api.ProtocolResponse
+		if err := asAPI.Protocols(ctx, &api.ProtocolRequest{}, &res); err != nil {
+			t.Fatalf("failed to query protocols: %s", err)
+		}
+		irc, ok := res.Protocols["irc"]
+		if !res.Exists || !ok || len(res.Protocols) != 1 {
+			t.Fatalf("expected only the irc protocol, got %+v", res.Protocols)
+		}
+		if len(irc.Instances) != 2 {
+			t.Fatalf("expected instances of both appservices, got %+v", irc.Instances)
+		}
+		if irc.Instances[0].InstanceID != "irc1|libera" || irc.Instances[1].InstanceID != "irc2|oftc" {
+			t.Fatalf("unexpected instance IDs in %+v", irc.Instances)
+		}
+	}
+	if protocolRequests != 2 {
+		t.Fatalf("expected the protocol to be cached, got %d requests", protocolRequests)
+	}
+
+	// The protocol is looked up again once the cache was cleared.
+	asAPI.ClearProtocolCache()
+	if err := asAPI.Protocols(ctx, &api.ProtocolRequest{}, &api.ProtocolResponse{}); err != nil {
+		t.Fatalf("failed to query protocols: %s", err)
+	}
+	if protocolRequests != 4 {
+		t.Fatalf("expected the protocol to be queried again, got %d requests", protocolRequests)
+	}
+
+	var protoRes api.ProtocolResponse
+	if err := asAPI.Protocols(ctx, &api.ProtocolRequest{Protocol: "xmpp"}, &protoRes); err != nil {
+		t.Fatalf("failed to query protocol: %s", err)
+	}
+	if protoRes.Exists {
+		t.Fatalf("expected unknown protocol, got %+v", protoRes.Protocols)
+	}
+
+	var locRes api.LocationResponse
+	if err := asAPI.Locations(ctx, &api.LocationRequest{Protocol: "irc", Params: "network=oftc"}, &locRes); err != nil {
+		t.Fatalf("failed to look up locations: %s", err)
+	}
+	if !locRes.Exists || len(locRes.Locations) != 1 || locRes.Locations[0].Alias != "#irc_oftc:localhost" {
+		t.Fatalf("unexpected locations %+v", locRes.Locations)
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/matrix-org/dendrite/appservice/api"
+	"github.com/matrix-org/dendrite/appservice/types"
+)
+
+// QueryTransactionQueues returns the state of the transaction queues of the
+// application services which receive transactions.
+func (a *AppServiceQueryAPI) QueryTransactionQueues(
+	ctx context.Context,
+	request *api.QueryTransactionQueuesRequest,
+	response *api.QueryTransactionQueuesResponse,
+) error {
+	response.Queues = []api.TransactionQueue{}
+	for _, ws := range a.WorkerStates.All() {
+		if ws.AppService.URL == "" {
+			continue
+		}
+		if request.AppServiceID != "" && ws.AppService.ID != request.AppServiceID {
+			continue
+		}
+		count, err := a.DB.CountEventsWithAppServiceID(ctx, ws.AppService.ID)
+		if err != nil {
+			return fmt.Errorf("a.DB.CountEventsWithAppServiceID: %w", err)
+		}
+		status := ws.Status()
+		response.Queues = append(response.Queues, api.TransactionQueue{
+			AppServiceID:   ws.AppService.ID,
+			QueuedEvents:   count,
+			Paused:         status.Paused,
+			LastTxnID:      status.LastTxnID,
+			LastSuccessTS:  asTimestamp(status.LastSuccess),
+			LastError:      status.LastError,
+			LastErrorTS:    asTimestamp(status.LastErrorTime),
+			BackoffUntilTS: asTimestamp(status.BackoffUntil),
+		})
+	}
+	return nil
+}
+
+// PerformTransactionQueuePause pauses or resumes delivery of transactions to the
+// application service. Events keep being queued while delivery is paused.
+func (a *AppServiceQueryAPI) PerformTransactionQueuePause(
+	ctx context.Context,
+	request *api.PerformTransactionQueuePauseRequest,
+	response *api.PerformTransactionQueuePauseResponse,
+) error {
+	ws := a.workerState(request.AppServiceID)
+	if ws == nil {
+		return nil
+	}
+	response.AppServiceExists = true
+	ws.SetPaused(request.Paused)
+	log.WithFields(log.Fields{
+		"appservice": request.AppServiceID,
+		"paused":     request.Paused,
+	}).Info("Changed delivery of transactions to application service")
+	return nil
+}
+
+// PerformTransactionQueueDiscard discards all room events and other data which
+// are queued for the application service, including the transaction which the
+// worker is currently trying to send.
+func (a *AppServiceQueryAPI) PerformTransactionQueueDiscard(
+	ctx context.Context,
+	request *api.PerformTransactionQueueDiscardRequest,
+	response *api.PerformTransactionQueueDiscardResponse,
+) error {
+	ws := a.workerState(request.AppServiceID)
+	if ws == nil {
+		return nil
+	}
+	response.AppServiceExists = true
+	ws.Discard()
+	discarded, err := a.DB.RemoveEventsWithAppServiceID(ctx, request.AppServiceID)
+	if err != nil {
+		return fmt.Errorf("a.DB.RemoveEventsWithAppServiceID: %w", err)
+	}
+	response.Discarded = discarded
+	log.WithFields(log.Fields{
+		"appservice": request.AppServiceID,
+		"discarded":  discarded,
+	}).Warn("Discarded events queued for application service")
+	return nil
+}
+
+// PerformTransactionQueueReplay queues the events of the given transaction and of
+// all later transactions again, if they were sent recently enough to be kept. They
+// are sent in new transactions after the events which are already queued.
+func (a *AppServiceQueryAPI) PerformTransactionQueueReplay(
+	ctx context.Context,
+	request *api.PerformTransactionQueueReplayRequest,
+	response *api.PerformTransactionQueueReplayResponse,
+) error {
+	ws := a.workerState(request.AppServiceID)
+	if ws == nil {
+		return nil
+	}
+	response.AppServiceExists = true
+	replayed, err := a.DB.ReplayEventsFromTxnID(ctx, request.AppServiceID, request.FromTxnID)
+	if err != nil {
+		return fmt.Errorf("a.DB.ReplayEventsFromTxnID: %w", err)
+	}
+	response.Replayed = replayed
+	if replayed > 0 {
+		ws.NotifyNewEvents()
+	}
+	log.WithFields(log.Fields{
+		"appservice":  request.AppServiceID,
+		"from_txn_id": request.FromTxnID,
+		"replayed":    replayed,
+	}).Info("Replaying transactions to application service")
+	return nil
+}
+
+// workerState returns the worker state of the application service, or nil if
+// there is no such application service or it doesn't receive transactions.
+func (a *AppServiceQueryAPI) workerState(appserviceID string) *types.ApplicationServiceWorkerState {
+	for _, ws := range a.WorkerStates.All() {
+		if ws.AppService.ID == appserviceID && ws.AppService.URL != "" {
+			return ws
+		}
+	}
+	return nil
+}
+
+func asTimestamp(t time.Time) gomatrixserverlib.Timestamp {
+	if t.IsZero() {
+		return 0
+	}
+	return gomatrixserverlib.AsTimestamp(t)
+}
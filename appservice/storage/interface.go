@@ -16,6 +16,7 @@ package storage
 
 import (
 	"context"
+	"time"
 
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -25,6 +26,9 @@ type Database interface {
 	GetEventsWithAppServiceID(ctx context.Context, appServiceID string, limit int) (int, int, []gomatrixserverlib.HeaderedEvent, bool, error)
 	CountEventsWithAppServiceID(ctx context.Context, appServiceID string) (int, error)
 	UpdateTxnIDForEvents(ctx context.Context, appserviceID string, maxID, txnID int) error
-	RemoveEventsBeforeAndIncludingID(ctx context.Context, appserviceID string, eventTableID int) error
+	MarkEventsSentBeforeAndIncludingID(ctx context.Context, appserviceID string, eventTableID int, retention time.Duration) error
+	RemoveEventsWithAppServiceID(ctx context.Context, appserviceID string) (int64, error)
+	ReplayEventsFromTxnID(ctx context.Context, appserviceID string, txnID int) (int64, error)
+	GetLatestSentTxnID(ctx context.Context, appserviceID string) (int, error)
 	GetLatestTxnID(ctx context.Context) (int, error)
 }
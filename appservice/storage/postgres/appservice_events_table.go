@@ -21,6 +21,7 @@ import (
 	"encoding/json"
 	"time"
 
+	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/gomatrixserverlib"
 	log "github.com/sirupsen/logrus"
 )
@@ -58,6 +59,9 @@ const updateTxnIDForEventsSQL = "" +
 const deleteEventsBeforeAndIncludingIDSQL = "" +
 	"DELETE FROM appservice_events WHERE as_id = $1 AND id <= $2"
 
+const deleteEventsByApplicationServiceIDSQL = "" +
+	"DELETE FROM appservice_events WHERE as_id = $1"
+
 const (
 	// A transaction ID number that no transaction should ever have. Used for
 	// checking again the default value.
@@ -70,6 +74,7 @@ type eventsStatements struct {
 	insertEventStmt                        *sql.Stmt
 	updateTxnIDForEventsStmt               *sql.Stmt
 	deleteEventsBeforeAndIncludingIDStmt   *sql.Stmt
+	deleteEventsByApplicationServiceIDStmt *sql.Stmt
 }
 
 func (s *eventsStatements) prepare(db *sql.DB) (err error) {
@@ -93,6 +98,9 @@ func (s *eventsStatements) prepare(db *sql.DB) (err error) {
 	if s.deleteEventsBeforeAndIncludingIDStmt, err = db.Prepare(deleteEventsBeforeAndIncludingIDSQL); err != nil {
 		return
 	}
+	if s.deleteEventsByApplicationServiceIDStmt, err = db.Prepare(deleteEventsByApplicationServiceIDSQL); err != nil {
+		return
+	}
 
 	return
 }
@@ -248,9 +256,24 @@ func (s *eventsStatements) updateTxnIDForEvents(
 // deleteEventsBeforeAndIncludingID removes events matching given IDs from the database.
 func (s *eventsStatements) deleteEventsBeforeAndIncludingID(
 	ctx context.Context,
+	txn *sql.Tx,
 	appserviceID string,
 	eventTableID int,
 ) (err error) {
-	_, err = s.deleteEventsBeforeAndIncludingIDStmt.ExecContext(ctx, appserviceID, eventTableID)
+	_, err = sqlutil.TxStmt(txn, s.deleteEventsBeforeAndIncludingIDStmt).ExecContext(ctx, appserviceID, eventTableID)
 	return
 }
+
+// deleteEventsByApplicationServiceID removes all events queued for the
+// application service from the database, returning how many were removed.
+func (s *eventsStatements) deleteEventsByApplicationServiceID(
+	ctx context.Context,
+	txn *sql.Tx,
+	appserviceID string,
+) (int64, error) {
+	res, err := sqlutil.TxStmt(txn, s.deleteEventsByApplicationServiceIDStmt).ExecContext(ctx, appserviceID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
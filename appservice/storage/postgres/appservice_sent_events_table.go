@@ -0,0 +1,126 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const appserviceSentEventsSchema = `
+-- Stores events which were sent to application services, so that the
+-- transactions can be replayed
+CREATE TABLE IF NOT EXISTS appservice_sent_events (
+	id BIGSERIAL NOT NULL PRIMARY KEY,
+	-- The ID of the application service the event was sent to
+	as_id TEXT NOT NULL,
+	-- JSON representation of the event
+	headered_event_json TEXT NOT NULL,
+	-- The ID of the transaction that the event was sent in
+	txn_id BIGINT NOT NULL,
+	-- When the transaction was sent successfully
+	sent_ts BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS appservice_sent_events_as_id_txn_id ON appservice_sent_events(as_id, txn_id);
+`
+
+const insertSentEventsSQL = "" +
+	"INSERT INTO appservice_sent_events(as_id, headered_event_json, txn_id, sent_ts) " +
+	"SELECT as_id, headered_event_json, txn_id, $1::BIGINT FROM appservice_events " +
+	"WHERE as_id = $2 AND id <= $3 ORDER BY id ASC"
+
+const deleteSentEventsBeforeTSSQL = "" +
+	"DELETE FROM appservice_sent_events WHERE as_id = $1 AND sent_ts < $2"
+
+const selectMaxSentTxnIDSQL = "" +
+	"SELECT COALESCE(MAX(txn_id), 0) FROM appservice_sent_events WHERE as_id = $1"
+
+const requeueSentEventsFromTxnIDSQL = "" +
+	"INSERT INTO appservice_events(as_id, headered_event_json, txn_id) " +
+	"SELECT as_id, headered_event_json, -1 FROM appservice_sent_events " +
+	"WHERE as_id = $1 AND txn_id >= $2 ORDER BY txn_id ASC, id ASC"
+
+const deleteSentEventsFromTxnIDSQL = "" +
+	"DELETE FROM appservice_sent_events WHERE as_id = $1 AND txn_id >= $2"
+
+type sentEventsStatements struct {
+	insertSentEventsStmt           *sql.Stmt
+	deleteSentEventsBeforeTSStmt   *sql.Stmt
+	selectMaxSentTxnIDStmt         *sql.Stmt
+	requeueSentEventsFromTxnIDStmt *sql.Stmt
+	deleteSentEventsFromTxnIDStmt  *sql.Stmt
+}
+
+func (s *sentEventsStatements) prepare(db *sql.DB) (err error) {
+	if _, err = db.Exec(appserviceSentEventsSchema); err != nil {
+		return
+	}
+	return sqlutil.StatementList{
+		{&s.insertSentEventsStmt, insertSentEventsSQL},
+		{&s.deleteSentEventsBeforeTSStmt, deleteSentEventsBeforeTSSQL},
+		{&s.selectMaxSentTxnIDStmt, selectMaxSentTxnIDSQL},
+		{&s.requeueSentEventsFromTxnIDStmt, requeueSentEventsFromTxnIDSQL},
+		{&s.deleteSentEventsFromTxnIDStmt, deleteSentEventsFromTxnIDSQL},
+	}.Prepare(db)
+}
+
+// insertSentEvents copies the queued events up to and including the given ID
+// into the sent events.
+func (s *sentEventsStatements) insertSentEvents(
+	ctx context.Context, txn *sql.Tx, appserviceID string, eventTableID int, sentTS gomatrixserverlib.Timestamp,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.insertSentEventsStmt).ExecContext(ctx, sentTS, appserviceID, eventTableID)
+	return err
+}
+
+// deleteSentEventsBeforeTS removes the sent events which were sent before the
+// given time.
+func (s *sentEventsStatements) deleteSentEventsBeforeTS(
+	ctx context.Context, txn *sql.Tx, appserviceID string, ts gomatrixserverlib.Timestamp,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteSentEventsBeforeTSStmt).ExecContext(ctx, appserviceID, ts)
+	return err
+}
+
+// selectMaxSentTxnID returns the ID of the latest transaction which was sent
+// successfully and hasn't been removed yet, or 0 if there is none.
+func (s *sentEventsStatements) selectMaxSentTxnID(
+	ctx context.Context, appserviceID string,
+) (txnID int, err error) {
+	err = s.selectMaxSentTxnIDStmt.QueryRowContext(ctx, appserviceID).Scan(&txnID)
+	return
+}
+
+// requeueSentEventsFromTxnID queues the events which were sent in the given
+// transaction or later again, and removes them from the sent events. Returns
+// the number of events which were queued.
+func (s *sentEventsStatements) requeueSentEventsFromTxnID(
+	ctx context.Context, txn *sql.Tx, appserviceID string, txnID int,
+) (int64, error) {
+	res, err := sqlutil.TxStmt(txn, s.requeueSentEventsFromTxnIDStmt).ExecContext(ctx, appserviceID, txnID)
+	if err != nil {
+		return 0, err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	_, err = sqlutil.TxStmt(txn, s.deleteSentEventsFromTxnIDStmt).ExecContext(ctx, appserviceID, txnID)
+	return count, err
+}
@@ -18,6 +18,7 @@ package postgres
 import (
 	"context"
 	"database/sql"
+	"time"
 
 	// Import postgres database driver
 	_ "github.com/lib/pq"
@@ -29,10 +30,11 @@ import (
 
 // Database stores events intended to be later sent to application services
 type Database struct {
-	events eventsStatements
-	txnID  txnStatements
-	db     *sql.DB
-	writer sqlutil.Writer
+	events     eventsStatements
+	sentEvents sentEventsStatements
+	txnID      txnStatements
+	db         *sql.DB
+	writer     sqlutil.Writer
 }
 
 // NewDatabase opens a new database
@@ -52,6 +54,9 @@ func (d *Database) prepare() error {
 	if err := d.events.prepare(d.db); err != nil {
 		return err
 	}
+	if err := d.sentEvents.prepare(d.db); err != nil {
+		return err
+	}
 
 	return d.txnID.prepare(d.db)
 }
@@ -96,15 +101,64 @@ func (d *Database) UpdateTxnIDForEvents(
 	return d.events.updateTxnIDForEvents(ctx, appserviceID, maxID, txnID)
 }
 
-// RemoveEventsBeforeAndIncludingID removes all events from the database that
-// are less than or equal to a given maximum ID. IDs here are implemented as a
-// serial, thus this should always delete events in chronological order.
-func (d *Database) RemoveEventsBeforeAndIncludingID(
+// MarkEventsSentBeforeAndIncludingID removes all events from the queue that
+// are less than or equal to a given maximum ID, as they were sent successfully.
+// They are kept as sent events for the given retention period, so that they
+// can be replayed. Older sent events are removed.
+func (d *Database) MarkEventsSentBeforeAndIncludingID(
 	ctx context.Context,
 	appserviceID string,
 	eventTableID int,
+	retention time.Duration,
 ) error {
-	return d.events.deleteEventsBeforeAndIncludingID(ctx, appserviceID, eventTableID)
+	now := time.Now()
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		if retention > 0 {
+			if err := d.sentEvents.insertSentEvents(ctx, txn, appserviceID, eventTableID, gomatrixserverlib.AsTimestamp(now)); err != nil {
+				return err
+			}
+		}
+		if err := d.sentEvents.deleteSentEventsBeforeTS(ctx, txn, appserviceID, gomatrixserverlib.AsTimestamp(now.Add(-retention))); err != nil {
+			return err
+		}
+		return d.events.deleteEventsBeforeAndIncludingID(ctx, txn, appserviceID, eventTableID)
+	})
+}
+
+// RemoveEventsWithAppServiceID removes all events which are queued for an
+// application service, returning the number of events which were removed.
+func (d *Database) RemoveEventsWithAppServiceID(
+	ctx context.Context,
+	appserviceID string,
+) (count int64, err error) {
+	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		count, err = d.events.deleteEventsByApplicationServiceID(ctx, txn, appserviceID)
+		return err
+	})
+	return
+}
+
+// ReplayEventsFromTxnID queues the sent events of the given transaction and all
+// later transactions again, returning the number of events which were queued.
+func (d *Database) ReplayEventsFromTxnID(
+	ctx context.Context,
+	appserviceID string,
+	txnID int,
+) (count int64, err error) {
+	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		count, err = d.sentEvents.requeueSentEventsFromTxnID(ctx, txn, appserviceID, txnID)
+		return err
+	})
+	return
+}
+
+// GetLatestSentTxnID returns the ID of the latest transaction which was sent
+// successfully to an application service, or 0 if it isn't known.
+func (d *Database) GetLatestSentTxnID(
+	ctx context.Context,
+	appserviceID string,
+) (int, error) {
+	return d.sentEvents.selectMaxSentTxnID(ctx, appserviceID)
 }
 
 // GetLatestTxnID returns the latest available transaction id
@@ -59,6 +59,9 @@ const updateTxnIDForEventsSQL = "" +
 const deleteEventsBeforeAndIncludingIDSQL = "" +
 	"DELETE FROM appservice_events WHERE as_id = $1 AND id <= $2"
 
+const deleteEventsByApplicationServiceIDSQL = "" +
+	"DELETE FROM appservice_events WHERE as_id = $1"
+
 const (
 	// A transaction ID number that no transaction should ever have. Used for
 	// checking again the default value.
@@ -73,6 +76,7 @@ type eventsStatements struct {
 	insertEventStmt                        *sql.Stmt
 	updateTxnIDForEventsStmt               *sql.Stmt
 	deleteEventsBeforeAndIncludingIDStmt   *sql.Stmt
+	deleteEventsByApplicationServiceIDStmt *sql.Stmt
 }
 
 func (s *eventsStatements) prepare(db *sql.DB, writer sqlutil.Writer) (err error) {
@@ -98,6 +102,9 @@ func (s *eventsStatements) prepare(db *sql.DB, writer sqlutil.Writer) (err error
 	if s.deleteEventsBeforeAndIncludingIDStmt, err = db.Prepare(deleteEventsBeforeAndIncludingIDSQL); err != nil {
 		return
 	}
+	if s.deleteEventsByApplicationServiceIDStmt, err = db.Prepare(deleteEventsByApplicationServiceIDSQL); err != nil {
+		return
+	}
 
 	return
 }
@@ -257,11 +264,24 @@ func (s *eventsStatements) updateTxnIDForEvents(
 // deleteEventsBeforeAndIncludingID removes events matching given IDs from the database.
 func (s *eventsStatements) deleteEventsBeforeAndIncludingID(
 	ctx context.Context,
+	txn *sql.Tx,
 	appserviceID string,
 	eventTableID int,
 ) (err error) {
-	return s.writer.Do(s.db, nil, func(txn *sql.Tx) error {
-		_, err := s.deleteEventsBeforeAndIncludingIDStmt.ExecContext(ctx, appserviceID, eventTableID)
-		return err
-	})
+	_, err = sqlutil.TxStmt(txn, s.deleteEventsBeforeAndIncludingIDStmt).ExecContext(ctx, appserviceID, eventTableID)
+	return
+}
+
+// deleteEventsByApplicationServiceID removes all events queued for the
+// application service from the database, returning how many were removed.
+func (s *eventsStatements) deleteEventsByApplicationServiceID(
+	ctx context.Context,
+	txn *sql.Tx,
+	appserviceID string,
+) (int64, error) {
+	res, err := sqlutil.TxStmt(txn, s.deleteEventsByApplicationServiceIDStmt).ExecContext(ctx, appserviceID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
 }
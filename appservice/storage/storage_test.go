@@ -0,0 +1,92 @@
+package storage_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/appservice/storage"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/test"
+)
+
+func mustCreateDatabase(t *testing.T, dbType test.DBType) (storage.Database, func()) {
+	connStr, close := test.PrepareDBConnectionString(t, dbType)
+	db, err := storage.NewDatabase(nil, &config.DatabaseOptions{
+		ConnectionString: config.DataSource(connStr),
+	})
+	if err != nil {
+		t.Fatalf("NewDatabase returned %s", err)
+	}
+	return db, close
+}
+
+func TestReplayAndDiscardEvents(t *testing.T) {
+	ctx := context.Background()
+	alice := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateDatabase(t, dbType)
+		defer close()
+
+		for _, event := range room.Events() {
+			if err := db.StoreEvent(ctx, "bridge", event); err != nil {
+				t.Fatalf("failed to store event: %s", err)
+			}
+		}
+		txnID, maxID, events, _, err := db.GetEventsWithAppServiceID(ctx, "bridge", 50)
+		if err != nil {
+			t.Fatalf("failed to get events: %s", err)
+		}
+		if txnID != -1 || len(events) != len(room.Events()) {
+			t.Fatalf("expected %d new events, got %d in transaction %d", len(room.Events()), len(events), txnID)
+		}
+		if txnID, err = db.GetLatestTxnID(ctx); err != nil {
+			t.Fatalf("failed to get transaction ID: %s", err)
+		}
+		if err = db.UpdateTxnIDForEvents(ctx, "bridge", maxID, txnID); err != nil {
+			t.Fatalf("failed to update transaction ID: %s", err)
+		}
+		if err = db.MarkEventsSentBeforeAndIncludingID(ctx, "bridge", maxID, time.Hour); err != nil {
+			t.Fatalf("failed to mark events as sent: %s", err)
+		}
+
+		count, err := db.CountEventsWithAppServiceID(ctx, "bridge")
+		if err != nil || count != 0 {
+			t.Fatalf("expected no queued events, got %d (%v)", count, err)
+		}
+		lastTxnID, err := db.GetLatestSentTxnID(ctx, "bridge")
+		if err != nil || lastTxnID != txnID {
+			t.Fatalf("expected latest sent transaction %d, got %d (%v)", txnID, lastTxnID, err)
+		}
+
+		// Only transactions of the application service are replayed.
+		if replayed, err := db.ReplayEventsFromTxnID(ctx, "other", txnID); err != nil || replayed != 0 {
+			t.Fatalf("expected no replayed events, got %d (%v)", replayed, err)
+		}
+		if replayed, err := db.ReplayEventsFromTxnID(ctx, "bridge", txnID+1); err != nil || replayed != 0 {
+			t.Fatalf("expected no replayed events, got %d (%v)", replayed, err)
+		}
+		replayed, err := db.ReplayEventsFromTxnID(ctx, "bridge", txnID)
+		if err != nil || replayed != int64(len(room.Events())) {
+			t.Fatalf("expected %d replayed events, got %d (%v)", len(room.Events()), replayed, err)
+		}
+		_, _, events, _, err = db.GetEventsWithAppServiceID(ctx, "bridge", 50)
+		if err != nil {
+			t.Fatalf("failed to get events: %s", err)
+		}
+		for i, event := range room.Events() {
+			if events[i].EventID() != event.EventID() {
+				t.Fatalf("expected replayed event %d to be %s, got %s", i, event.EventID(), events[i].EventID())
+			}
+		}
+
+		discarded, err := db.RemoveEventsWithAppServiceID(ctx, "bridge")
+		if err != nil || discarded != int64(len(room.Events())) {
+			t.Fatalf("expected %d discarded events, got %d (%v)", len(room.Events()), discarded, err)
+		}
+		if count, err = db.CountEventsWithAppServiceID(ctx, "bridge"); err != nil || count != 0 {
+			t.Fatalf("expected no queued events, got %d (%v)", count, err)
+		}
+	})
+}
@@ -13,7 +13,9 @@
 package types
 
 import (
+	"encoding/json"
 	"sync"
+	"time"
 
 	"github.com/matrix-org/dendrite/setup/config"
 )
@@ -21,6 +23,10 @@ import (
 const (
 	// AppServiceDeviceID is the AS dummy device ID
 	AppServiceDeviceID = "AS_Device"
+	// maxEphemeralEvents is the most ephemeral events and to-device messages
+	// which are queued for an AS. Older ones are dropped, as they are likely
+	// outdated by the time the AS is reachable again.
+	maxEphemeralEvents = 1000
 )
 
 // ApplicationServiceWorkerState is a type that couples an application service,
@@ -34,6 +40,99 @@ type ApplicationServiceWorkerState struct {
 	EventsReady bool
 	// Backoff exponent (2^x secs). Max 6, aka 64s.
 	Backoff int
+	// Data other than room events ready to be sent, protected by Cond.L
+	pending PendingData
+	// Whether the worker should stop, protected by Cond.L
+	stopped bool
+	// Whether delivery was paused by an admin, protected by Cond.L
+	paused bool
+	// How often the queue was discarded by an admin, protected by Cond.L
+	discards int
+	// The outcome of the latest transactions, protected by Cond.L
+	status DeliveryStatus
+	// Closed when the worker should stop, and once it has exited
+	stop chan struct{}
+	done chan struct{}
+	// The transaction which the worker is to send first, e.g. the one which
+	// the previous worker was still trying to send, protected by Cond.L
+	inflight      PendingData
+	inflightTxnID int
+}
+
+// DeliveryStatus describes how delivery of transactions to an application
+// service is going.
+type DeliveryStatus struct {
+	// Whether delivery was paused by an admin
+	Paused bool
+	// The ID of the latest transaction which was sent successfully, or 0
+	LastTxnID int
+	// When the latest transaction was sent successfully
+	LastSuccess time.Time
+	// The error of the latest transaction which failed, and when it failed
+	LastError     string
+	LastErrorTime time.Time
+	// When the worker will retry after the latest failed transaction, zero if
+	// the worker isn't backing off
+	BackoffUntil time.Time
+}
+
+// NewWorkerState returns the state for a worker of the application service.
+func NewWorkerState(appservice config.ApplicationService) *ApplicationServiceWorkerState {
+	return &ApplicationServiceWorkerState{
+		AppService: appservice,
+		Cond:       sync.NewCond(&sync.Mutex{}),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+// WorkerStates holds the worker states of all application services. They are
+// replaced when the application services are reloaded, so they should be looked
+// up again for each event.
+type WorkerStates struct {
+	mu     sync.RWMutex
+	states []*ApplicationServiceWorkerState
+}
+
+// NewWorkerStates returns WorkerStates holding the given worker states.
+func NewWorkerStates(states []*ApplicationServiceWorkerState) *WorkerStates {
+	return &WorkerStates{states: states}
+}
+
+// All returns the current worker states.
+func (w *WorkerStates) All() []*ApplicationServiceWorkerState {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.states
+}
+
+// Set replaces the worker states.
+func (w *WorkerStates) Set(states []*ApplicationServiceWorkerState) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.states = states
+}
+
+// PendingData is the data other than room events which is sent to an application
+// service in a transaction.
+type PendingData struct {
+	// Ephemeral events (MSC2409)
+	Ephemeral []json.RawMessage
+	// To-device messages (MSC2409)
+	ToDevice []json.RawMessage
+	// Users whose device lists changed, or who no longer share a room with
+	// the users of the application service (MSC3202)
+	DeviceListsChanged map[string]struct{}
+	DeviceListsLeft    map[string]struct{}
+	// One-time key counts by user ID and device ID (MSC3202)
+	OneTimeKeysCounts map[string]map[string]map[string]int
+}
+
+// IsEmpty returns true if there is no data to send.
+func (p *PendingData) IsEmpty() bool {
+	return len(p.Ephemeral) == 0 && len(p.ToDevice) == 0 &&
+		len(p.DeviceListsChanged) == 0 && len(p.DeviceListsLeft) == 0 &&
+		len(p.OneTimeKeysCounts) == 0
 }
 
 // NotifyNewEvents wakes up all waiting goroutines, notifying that events remain
@@ -45,11 +144,86 @@ func (a *ApplicationServiceWorkerState) NotifyNewEvents() {
 	a.Cond.L.Unlock()
 }
 
+// NotifyEphemeralEvent queues an ephemeral event, such as a typing notification,
+// to be sent in the next transaction.
+func (a *ApplicationServiceWorkerState) NotifyEphemeralEvent(event json.RawMessage) {
+	a.notifyPending(func(p *PendingData) {
+		p.Ephemeral = appendCapped(p.Ephemeral, event)
+	})
+}
+
+// NotifyToDeviceEvent queues a to-device message to be sent in the next transaction.
+func (a *ApplicationServiceWorkerState) NotifyToDeviceEvent(event json.RawMessage) {
+	a.notifyPending(func(p *PendingData) {
+		p.ToDevice = appendCapped(p.ToDevice, event)
+	})
+}
+
+// NotifyDeviceListChange queues a change to the device list of the user to be
+// sent in the next transaction. If left is true, the user no longer shares a room
+// with any users of the application service. Only the latest change is sent.
+func (a *ApplicationServiceWorkerState) NotifyDeviceListChange(userID string, left bool) {
+	a.notifyPending(func(p *PendingData) {
+		if p.DeviceListsChanged == nil {
+			p.DeviceListsChanged = map[string]struct{}{}
+			p.DeviceListsLeft = map[string]struct{}{}
+		}
+		if left {
+			delete(p.DeviceListsChanged, userID)
+			p.DeviceListsLeft[userID] = struct{}{}
+		} else {
+			delete(p.DeviceListsLeft, userID)
+			p.DeviceListsChanged[userID] = struct{}{}
+		}
+	})
+}
+
+// NotifyOneTimeKeysCount queues the one-time key counts of the device to be sent
+// in the next transaction. Only the latest counts are sent.
+func (a *ApplicationServiceWorkerState) NotifyOneTimeKeysCount(userID, deviceID string, counts map[string]int) {
+	a.notifyPending(func(p *PendingData) {
+		if p.OneTimeKeysCounts == nil {
+			p.OneTimeKeysCounts = map[string]map[string]map[string]int{}
+		}
+		if p.OneTimeKeysCounts[userID] == nil {
+			p.OneTimeKeysCounts[userID] = map[string]map[string]int{}
+		}
+		p.OneTimeKeysCounts[userID][deviceID] = counts
+	})
+}
+
+func (a *ApplicationServiceWorkerState) notifyPending(update func(p *PendingData)) {
+	a.Cond.L.Lock()
+	update(&a.pending)
+	a.EventsReady = true
+	a.Cond.Broadcast()
+	a.Cond.L.Unlock()
+}
+
+// TakePendingData removes the queued data from the queue and returns it. At most
+// limit ephemeral events and limit to-device messages are returned.
+func (a *ApplicationServiceWorkerState) TakePendingData(limit int) PendingData {
+	a.Cond.L.Lock()
+	defer a.Cond.L.Unlock()
+	data := PendingData{
+		DeviceListsChanged: a.pending.DeviceListsChanged,
+		DeviceListsLeft:    a.pending.DeviceListsLeft,
+		OneTimeKeysCounts:  a.pending.OneTimeKeysCounts,
+	}
+	data.Ephemeral, a.pending.Ephemeral = takeN(a.pending.Ephemeral, limit)
+	data.ToDevice, a.pending.ToDevice = takeN(a.pending.ToDevice, limit)
+	a.pending.DeviceListsChanged = nil
+	a.pending.DeviceListsLeft = nil
+	a.pending.OneTimeKeysCounts = nil
+	return data
+}
+
 // FinishEventProcessing marks all events of this worker as being sent to the
 // application service.
 func (a *ApplicationServiceWorkerState) FinishEventProcessing() {
 	a.Cond.L.Lock()
-	a.EventsReady = false
+	// There may be more data, which arrived while sending.
+	a.EventsReady = !a.pending.IsEmpty()
 	a.Cond.L.Unlock()
 }
 
@@ -57,8 +231,186 @@ func (a *ApplicationServiceWorkerState) FinishEventProcessing() {
 // condition for a broadcast or similar wakeup, if there are no events ready.
 func (a *ApplicationServiceWorkerState) WaitForNewEvents() {
 	a.Cond.L.Lock()
-	if !a.EventsReady {
+	for (!a.EventsReady || a.paused) && !a.stopped {
 		a.Cond.Wait()
 	}
 	a.Cond.L.Unlock()
 }
+
+// SetPaused pauses or resumes delivery of transactions. Events are still queued
+// while delivery is paused.
+func (a *ApplicationServiceWorkerState) SetPaused(paused bool) {
+	a.Cond.L.Lock()
+	defer a.Cond.L.Unlock()
+	a.paused = paused
+	a.status.Paused = paused
+	a.Cond.Broadcast()
+}
+
+// Discard drops the queued data other than room events, and tells the worker to
+// drop the transaction it is currently trying to send. The queued room events
+// must be removed from the database by the caller.
+func (a *ApplicationServiceWorkerState) Discard() {
+	a.Cond.L.Lock()
+	defer a.Cond.L.Unlock()
+	a.pending = PendingData{}
+	a.discards++
+}
+
+// Discards returns how often the queue was discarded, so that the worker can
+// tell whether its current transaction was discarded.
+func (a *ApplicationServiceWorkerState) Discards() int {
+	a.Cond.L.Lock()
+	defer a.Cond.L.Unlock()
+	return a.discards
+}
+
+// Status returns the delivery status of the worker.
+func (a *ApplicationServiceWorkerState) Status() DeliveryStatus {
+	a.Cond.L.Lock()
+	defer a.Cond.L.Unlock()
+	return a.status
+}
+
+// SetLastTxnID sets the ID of the latest transaction which was sent successfully,
+// e.g. as stored in the database when the worker starts.
+func (a *ApplicationServiceWorkerState) SetLastTxnID(txnID int) {
+	a.Cond.L.Lock()
+	defer a.Cond.L.Unlock()
+	a.status.LastTxnID = txnID
+}
+
+// TransactionSent records that the transaction was sent successfully.
+func (a *ApplicationServiceWorkerState) TransactionSent(txnID int) {
+	a.Cond.L.Lock()
+	defer a.Cond.L.Unlock()
+	a.status.LastTxnID = txnID
+	a.status.LastSuccess = time.Now()
+	a.status.BackoffUntil = time.Time{}
+}
+
+// TransactionFailed records that sending a transaction failed, and that the
+// worker backs off until the given time.
+func (a *ApplicationServiceWorkerState) TransactionFailed(err error, backoffUntil time.Time) {
+	a.Cond.L.Lock()
+	defer a.Cond.L.Unlock()
+	a.status.LastError = err.Error()
+	a.status.LastErrorTime = time.Now()
+	a.status.BackoffUntil = backoffUntil
+}
+
+// Stop tells the worker to stop, e.g. because the application service was changed
+// or removed when the application services were reloaded. The queued data which
+// the worker hasn't taken yet is returned, so that it can be handed to a new worker.
+// The transaction which the worker was sending is only known once it is Done.
+func (a *ApplicationServiceWorkerState) Stop() PendingData {
+	a.Cond.L.Lock()
+	defer a.Cond.L.Unlock()
+	if !a.stopped {
+		a.stopped = true
+		close(a.stop)
+	}
+	a.Cond.Broadcast()
+	pending := a.pending
+	a.pending = PendingData{}
+	return pending
+}
+
+// Stopping returns a channel which is closed when the worker should stop, so
+// that it can stop waiting, e.g. when backing off.
+func (a *ApplicationServiceWorkerState) Stopping() <-chan struct{} {
+	return a.stop
+}
+
+// Exited records that the worker has exited, along with the transaction which
+// it was sending, if it wasn't sent successfully yet.
+func (a *ApplicationServiceWorkerState) Exited(pending PendingData, txnID int) {
+	a.SetInflight(pending, txnID)
+	close(a.done)
+}
+
+// Done returns a channel which is closed once the worker has exited.
+func (a *ApplicationServiceWorkerState) Done() <-chan struct{} {
+	return a.done
+}
+
+// SetInflight sets the transaction which the worker sends first, e.g. the one
+// which the previous worker of the application service was still trying to send.
+// The transaction ID is only set for transactions without room events.
+func (a *ApplicationServiceWorkerState) SetInflight(pending PendingData, txnID int) {
+	a.Cond.L.Lock()
+	defer a.Cond.L.Unlock()
+	a.inflight, a.inflightTxnID = pending, txnID
+	if !pending.IsEmpty() {
+		a.EventsReady = true
+		a.Cond.Broadcast()
+	}
+}
+
+// TakeInflight removes the transaction which the worker sends first and returns it.
+func (a *ApplicationServiceWorkerState) TakeInflight() (PendingData, int) {
+	a.Cond.L.Lock()
+	defer a.Cond.L.Unlock()
+	pending, txnID := a.inflight, a.inflightTxnID
+	a.inflight, a.inflightTxnID = PendingData{}, 0
+	return pending, txnID
+}
+
+// Stopped returns true if the worker should stop.
+func (a *ApplicationServiceWorkerState) Stopped() bool {
+	a.Cond.L.Lock()
+	defer a.Cond.L.Unlock()
+	return a.stopped
+}
+
+// QueuePendingData queues data which was taken from another worker of the same
+// application service, to be sent in the next transaction.
+func (a *ApplicationServiceWorkerState) QueuePendingData(data PendingData) {
+	if data.IsEmpty() {
+		return
+	}
+	a.notifyPending(func(p *PendingData) {
+		for _, event := range data.Ephemeral {
+			p.Ephemeral = appendCapped(p.Ephemeral, event)
+		}
+		for _, event := range data.ToDevice {
+			p.ToDevice = appendCapped(p.ToDevice, event)
+		}
+		if p.DeviceListsChanged == nil {
+			p.DeviceListsChanged = map[string]struct{}{}
+			p.DeviceListsLeft = map[string]struct{}{}
+		}
+		for userID := range data.DeviceListsChanged {
+			p.DeviceListsChanged[userID] = struct{}{}
+		}
+		for userID := range data.DeviceListsLeft {
+			p.DeviceListsLeft[userID] = struct{}{}
+		}
+		if p.OneTimeKeysCounts == nil {
+			p.OneTimeKeysCounts = map[string]map[string]map[string]int{}
+		}
+		for userID, devices := range data.OneTimeKeysCounts {
+			if p.OneTimeKeysCounts[userID] == nil {
+				p.OneTimeKeysCounts[userID] = map[string]map[string]int{}
+			}
+			for deviceID, counts := range devices {
+				p.OneTimeKeysCounts[userID][deviceID] = counts
+			}
+		}
+	})
+}
+
+func appendCapped(events []json.RawMessage, event json.RawMessage) []json.RawMessage {
+	events = append(events, event)
+	if len(events) > maxEphemeralEvents {
+		events = events[len(events)-maxEphemeralEvents:]
+	}
+	return events
+}
+
+func takeN(events []json.RawMessage, n int) (taken, remaining []json.RawMessage) {
+	if len(events) < n {
+		n = len(events)
+	}
+	return events[:n:n], events[n:]
+}
@@ -0,0 +1,109 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workers
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/matrix-org/dendrite/appservice/storage"
+	"github.com/matrix-org/dendrite/appservice/types"
+)
+
+var transactionsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "appservice",
+		Name:      "transactions_total",
+		Help:      "The number of transactions sent to each application service by whether they succeeded or failed",
+	},
+	[]string{"appservice_id", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(transactionsTotal)
+}
+
+var (
+	queuedEventsDesc = prometheus.NewDesc(
+		"dendrite_appservice_queued_events",
+		"The number of room events queued for each application service",
+		[]string{"appservice_id"}, nil,
+	)
+	lastTxnIDDesc = prometheus.NewDesc(
+		"dendrite_appservice_last_txn_id",
+		"The ID of the latest transaction which was sent successfully to each application service",
+		[]string{"appservice_id"}, nil,
+	)
+	backoffSecondsDesc = prometheus.NewDesc(
+		"dendrite_appservice_backoff_seconds",
+		"How long until the worker of each application service retries a failed transaction",
+		[]string{"appservice_id"}, nil,
+	)
+	pausedDesc = prometheus.NewDesc(
+		"dendrite_appservice_paused",
+		"Whether delivery to each application service was paused by an admin",
+		[]string{"appservice_id"}, nil,
+	)
+)
+
+// queueCollector collects the state of the transaction queues of the current
+// application services when the metrics are scraped, as they can change when
+// the application services are reloaded.
+type queueCollector struct {
+	db           storage.Database
+	workerStates *types.WorkerStates
+}
+
+// NewQueueCollector returns a collector for the state of the transaction queues
+// of the application services.
+func NewQueueCollector(db storage.Database, workerStates *types.WorkerStates) prometheus.Collector {
+	return &queueCollector{db, workerStates}
+}
+
+func (c *queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queuedEventsDesc
+	ch <- lastTxnIDDesc
+	ch <- backoffSecondsDesc
+	ch <- pausedDesc
+}
+
+func (c *queueCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, ws := range c.workerStates.All() {
+		id := ws.AppService.ID
+		if count, err := c.db.CountEventsWithAppServiceID(ctx, id); err != nil {
+			log.WithField("appservice", id).WithError(err).Warn("unable to count queued events for metrics")
+		} else {
+			ch <- prometheus.MustNewConstMetric(queuedEventsDesc, prometheus.GaugeValue, float64(count), id)
+		}
+		status := ws.Status()
+		ch <- prometheus.MustNewConstMetric(lastTxnIDDesc, prometheus.GaugeValue, float64(status.LastTxnID), id)
+		var backoff float64
+		if remaining := time.Until(status.BackoffUntil); remaining > 0 {
+			backoff = remaining.Seconds()
+		}
+		ch <- prometheus.MustNewConstMetric(backoffSecondsDesc, prometheus.GaugeValue, backoff, id)
+		var paused float64
+		if status.Paused {
+			paused = 1
+		}
+		ch <- prometheus.MustNewConstMetric(pausedDesc, prometheus.GaugeValue, paused, id)
+	}
+}
@@ -15,15 +15,15 @@
 package workers
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"math"
 	"net/http"
-	"net/url"
+	"sort"
 	"time"
 
+	"github.com/matrix-org/dendrite/appservice/internal"
 	"github.com/matrix-org/dendrite/appservice/storage"
 	"github.com/matrix-org/dendrite/appservice/types"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -34,6 +34,9 @@ import (
 var (
 	// Maximum size of events sent in each transaction.
 	transactionBatchSize = 50
+	// How long the events of successful transactions are kept, so that the
+	// transactions can be replayed.
+	sentEventsRetention = 24 * time.Hour
 )
 
 // SetupTransactionWorkers spawns a separate goroutine for each application
@@ -44,21 +47,34 @@ var (
 func SetupTransactionWorkers(
 	client *http.Client,
 	appserviceDB storage.Database,
-	workerStates []types.ApplicationServiceWorkerState,
+	workerStates []*types.ApplicationServiceWorkerState,
 ) error {
 	// Create a worker that handles transmitting events to a single homeserver
 	for _, workerState := range workerStates {
-		// Don't create a worker if this AS doesn't want to receive events
-		if workerState.AppService.URL != "" {
-			go worker(client, appserviceDB, workerState)
-		}
+		StartTransactionWorker(client, appserviceDB, workerState)
 	}
 	return nil
 }
 
+// StartTransactionWorker spawns the worker for a single application service,
+// e.g. one which was added when the application services were reloaded. The
+// worker runs until the worker state is stopped.
+func StartTransactionWorker(
+	client *http.Client,
+	appserviceDB storage.Database,
+	workerState *types.ApplicationServiceWorkerState,
+) {
+	// Don't create a worker if this AS doesn't want to receive events
+	if workerState.AppService.URL != "" {
+		go worker(client, appserviceDB, workerState)
+	} else {
+		workerState.Exited(types.PendingData{}, 0)
+	}
+}
+
 // worker is a goroutine that sends any queued events to the application service
 // it is given.
-func worker(client *http.Client, db storage.Database, ws types.ApplicationServiceWorkerState) {
+func worker(client *http.Client, db storage.Database, ws *types.ApplicationServiceWorkerState) {
 	log.WithFields(log.Fields{
 		"appservice": ws.AppService.ID,
 	}).Info("Starting application service")
@@ -75,14 +91,53 @@ func worker(client *http.Client, db storage.Database, ws types.ApplicationServic
 	if eventCount > 0 {
 		ws.NotifyNewEvents()
 	}
+	lastTxnID, err := db.GetLatestSentTxnID(ctx, ws.AppService.ID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"appservice": ws.AppService.ID,
+		}).WithError(err).Warn("appservice worker unable to read latest transaction ID from DB")
+	}
+	ws.SetLastTxnID(lastTxnID)
+	discards := ws.Discards()
+
+	// The data other than room events which is sent in the current transaction.
+	// It is sent again when the transaction is retried, until it succeeds.
+	// The ID of the current transaction is kept too if it has no room events,
+	// so that the application service can tell retries apart from new
+	// transactions. Transactions with room events get their ID from the
+	// database. A worker which replaces another one carries on with the
+	// transaction which that was sending.
+	pending, pendingTxnID := ws.TakeInflight()
 
 	// Loop forever and keep waiting for more events to send
 	for {
 		// Wait for more events if we've sent all the events in the database
 		ws.WaitForNewEvents()
 
+		// The application service was changed or removed when the application
+		// services were reloaded, so a new worker takes over if necessary.
+		if ws.Stopped() {
+			log.WithFields(log.Fields{
+				"appservice": ws.AppService.ID,
+			}).Info("Stopping application service")
+			ws.Exited(pending, pendingTxnID)
+			return
+		}
+
+		// Drop the current transaction if the queue was discarded by an admin.
+		// Its room events were removed from the database already.
+		if d := ws.Discards(); d != discards {
+			discards = d
+			pending = types.PendingData{}
+			pendingTxnID = 0
+		}
+
+		if pending.IsEmpty() {
+			pending = ws.TakePendingData(transactionBatchSize)
+		}
+
 		// Batch events up into a transaction
-		transactionJSON, txnID, maxEventID, eventsRemaining, err := createTransaction(ctx, db, ws.AppService.ID)
+		transactionJSON, txnID, maxEventID, eventsRemaining, err := createTransaction(ctx, db, ws.AppService.ID, &pending, &pendingTxnID)
 		if err != nil {
 			log.WithFields(log.Fields{
 				"appservice": ws.AppService.ID,
@@ -90,21 +145,31 @@ func worker(client *http.Client, db storage.Database, ws types.ApplicationServic
 
 			return
 		}
+		if transactionJSON == nil {
+			// There was nothing to send
+			ws.FinishEventProcessing()
+			continue
+		}
 
 		// Send the events off to the application service
 		// Backoff if the application service does not respond
-		err = send(client, ws.AppService, txnID, transactionJSON)
+		err = send(ctx, client, &ws.AppService, txnID, transactionJSON)
 		if err != nil {
 			log.WithFields(log.Fields{
 				"appservice": ws.AppService.ID,
 			}).WithError(err).Error("unable to send event")
+			transactionsTotal.WithLabelValues(ws.AppService.ID, "failure").Inc()
 			// Backoff
-			backoff(&ws, err)
+			backoff(ws, err)
 			continue
 		}
 
 		// We sent successfully, hooray!
+		transactionsTotal.WithLabelValues(ws.AppService.ID, "success").Inc()
 		ws.Backoff = 0
+		ws.TransactionSent(txnID)
+		pending = types.PendingData{}
+		pendingTxnID = 0
 
 		// Transactions have a maximum event size, so there may still be some events
 		// left over to send. Keep sending until none are left
@@ -112,8 +177,8 @@ func worker(client *http.Client, db storage.Database, ws types.ApplicationServic
 			ws.FinishEventProcessing()
 		}
 
-		// Remove sent events from the DB
-		err = db.RemoveEventsBeforeAndIncludingID(ctx, ws.AppService.ID, maxEventID)
+		// Remove sent events from the queue, keeping them for replaying
+		err = db.MarkEventsSentBeforeAndIncludingID(ctx, ws.AppService.ID, maxEventID, sentEventsRetention)
 		if err != nil {
 			log.WithFields(log.Fields{
 				"appservice": ws.AppService.ID,
@@ -138,44 +203,87 @@ func backoff(ws *types.ApplicationServiceWorkerState, err error) {
 	if ws.Backoff > 6 {
 		ws.Backoff = 6
 	}
+	ws.TransactionFailed(err, time.Now().Add(backoffSeconds))
+
+	// Backoff, unless the worker is told to stop in the meantime
+	timer := time.NewTimer(backoffSeconds)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ws.Stopping():
+	}
+}
 
-	// Backoff
-	time.Sleep(backoffSeconds)
+// transaction is the body of a transaction sent to an application service. It
+// includes ephemeral events and to-device messages as per MSC2409, and device
+// list changes and one-time key counts as per MSC3202.
+type transaction struct {
+	Events                 []gomatrixserverlib.ClientEvent      `json:"events"`
+	Ephemeral              []json.RawMessage                    `json:"de.sorunome.msc2409.ephemeral,omitempty"`
+	ToDevice               []json.RawMessage                    `json:"de.sorunome.msc2409.to_device,omitempty"`
+	DeviceLists            *deviceLists                         `json:"org.matrix.msc3202.device_lists,omitempty"`
+	OneTimeKeysCounts      map[string]map[string]map[string]int `json:"org.matrix.msc3202.device_one_time_keys_count,omitempty"`
+	UnusedFallbackKeyTypes map[string]map[string][]string       `json:"org.matrix.msc3202.device_unused_fallback_key_types,omitempty"`
+}
+
+type deviceLists struct {
+	Changed []string `json:"changed"`
+	Left    []string `json:"left"`
 }
 
 // createTransaction takes in a slice of AS events, stores them in an AS
-// transaction, and JSON-encodes the results.
+// transaction along with the given pending data, and JSON-encodes the
+// results. Returns a nil transactionJSON if there is nothing to send.
+// If pendingTxnID is set, the transaction is a retry of one without room
+// events, which is sent again as it was. Otherwise pendingTxnID is set to
+// the ID of a new transaction without room events.
 func createTransaction(
 	ctx context.Context,
 	db storage.Database,
 	appserviceID string,
+	pending *types.PendingData,
+	pendingTxnID *int,
 ) (
 	transactionJSON []byte,
 	txnID, maxID int,
 	eventsRemaining bool,
 	err error,
 ) {
-	// Retrieve the latest events from the DB (will return old events if they weren't successfully sent)
-	txnID, maxID, events, eventsRemaining, err := db.GetEventsWithAppServiceID(ctx, appserviceID, transactionBatchSize)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"appservice": appserviceID,
-		}).WithError(err).Fatalf("appservice worker unable to read queued events from DB")
-
-		return
-	}
-
-	// Check if these events do not already have a transaction ID
-	if txnID == -1 {
-		// If not, grab next available ID from the DB
-		txnID, err = db.GetLatestTxnID(ctx)
+	var events []gomatrixserverlib.HeaderedEvent
+	if *pendingTxnID != 0 {
+		// Room events which arrived in the meantime are sent in the next
+		// transaction.
+		txnID, eventsRemaining = *pendingTxnID, true
+	} else {
+		// Retrieve the latest events from the DB (will return old events if they weren't successfully sent)
+		txnID, maxID, events, eventsRemaining, err = db.GetEventsWithAppServiceID(ctx, appserviceID, transactionBatchSize)
 		if err != nil {
-			return nil, 0, 0, false, err
+			log.WithFields(log.Fields{
+				"appservice": appserviceID,
+			}).WithError(err).Fatalf("appservice worker unable to read queued events from DB")
+
+			return
+		}
+		if len(events) == 0 && pending.IsEmpty() {
+			return
 		}
 
-		// Mark new events with current transactionID
-		if err = db.UpdateTxnIDForEvents(ctx, appserviceID, maxID, txnID); err != nil {
-			return nil, 0, 0, false, err
+		// Check if these events do not already have a transaction ID. A transaction
+		// with only pending data always gets a new one.
+		if txnID == -1 || len(events) == 0 {
+			// If not, grab next available ID from the DB
+			txnID, err = db.GetLatestTxnID(ctx)
+			if err != nil {
+				return nil, 0, 0, false, err
+			}
+
+			// Mark new events with current transactionID
+			if err = db.UpdateTxnIDForEvents(ctx, appserviceID, maxID, txnID); err != nil {
+				return nil, 0, 0, false, err
+			}
+		}
+		if len(events) == 0 {
+			*pendingTxnID = txnID
 		}
 	}
 
@@ -185,11 +293,30 @@ func createTransaction(
 	}
 
 	// Create a transaction and store the events inside
-	transaction := gomatrixserverlib.ApplicationServiceTransaction{
-		Events: gomatrixserverlib.HeaderedToClientEvents(ev, gomatrixserverlib.FormatAll),
+	txn := transaction{
+		Events:            gomatrixserverlib.HeaderedToClientEvents(ev, gomatrixserverlib.FormatAll),
+		Ephemeral:         pending.Ephemeral,
+		ToDevice:          pending.ToDevice,
+		OneTimeKeysCounts: pending.OneTimeKeysCounts,
+	}
+	if len(pending.DeviceListsChanged) > 0 || len(pending.DeviceListsLeft) > 0 {
+		txn.DeviceLists = &deviceLists{
+			Changed: sortedUserIDs(pending.DeviceListsChanged),
+			Left:    sortedUserIDs(pending.DeviceListsLeft),
+		}
+	}
+	// Fallback keys aren't supported, so no device has any unused ones.
+	if len(pending.OneTimeKeysCounts) > 0 {
+		txn.UnusedFallbackKeyTypes = make(map[string]map[string][]string, len(pending.OneTimeKeysCounts))
+		for userID, devices := range pending.OneTimeKeysCounts {
+			txn.UnusedFallbackKeyTypes[userID] = make(map[string][]string, len(devices))
+			for deviceID := range devices {
+				txn.UnusedFallbackKeyTypes[userID][deviceID] = []string{}
+			}
+		}
 	}
 
-	transactionJSON, err = json.Marshal(transaction)
+	transactionJSON, err = json.Marshal(txn)
 	if err != nil {
 		return
 	}
@@ -197,23 +324,30 @@ func createTransaction(
 	return
 }
 
+func sortedUserIDs(userIDs map[string]struct{}) []string {
+	sorted := make([]string, 0, len(userIDs))
+	for userID := range userIDs {
+		sorted = append(sorted, userID)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
 // send sends events to an application service. Returns an error if an OK was not
 // received back from the application service or the request timed out.
 func send(
+	ctx context.Context,
 	client *http.Client,
-	appservice config.ApplicationService,
+	appservice *config.ApplicationService,
 	txnID int,
 	transaction []byte,
 ) (err error) {
 	// PUT a transaction to our AS
-	// https://matrix.org/docs/spec/application_service/r0.1.2#put-matrix-app-v1-transactions-txnid
-	address := fmt.Sprintf("%s/transactions/%d?access_token=%s", appservice.URL, txnID, url.QueryEscape(appservice.HSToken))
-	req, err := http.NewRequest("PUT", address, bytes.NewBuffer(transaction))
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := client.Do(req)
+	// https://spec.matrix.org/v1.4/application-service-api/#put_matrixappv1transactionstxnid
+	resp, err := internal.Request(
+		ctx, client, appservice, http.MethodPut,
+		fmt.Sprintf("/transactions/%d", txnID), transaction,
+	)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,75 @@
+package workers
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/dendrite/appservice/storage"
+	"github.com/matrix-org/dendrite/appservice/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/test"
+)
+
+func TestCreateTransactionRetryWithoutEvents(t *testing.T) {
+	ctx := context.Background()
+	alice := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		connStr, close := test.PrepareDBConnectionString(t, dbType)
+		defer close()
+		db, err := storage.NewDatabase(nil, &config.DatabaseOptions{
+			ConnectionString: config.DataSource(connStr),
+		})
+		if err != nil {
+			t.Fatalf("NewDatabase returned %s", err)
+		}
+
+		pending := types.PendingData{Ephemeral: []json.RawMessage{[]byte(`{"type":"m.typing"}`)}}
+		var pendingTxnID int
+		_, txnID, _, _, err := createTransaction(ctx, db, "bridge", &pending, &pendingTxnID)
+		if err != nil {
+			t.Fatalf("createTransaction failed: %s", err)
+		}
+		if pendingTxnID == 0 || pendingTxnID != txnID {
+			t.Fatalf("expected the transaction ID %d to be kept, got %d", txnID, pendingTxnID)
+		}
+
+		// Retrying the transaction reuses its ID, and leaves out the room
+		// events which arrived in the meantime.
+		if err = db.StoreEvent(ctx, "bridge", room.Events()[0]); err != nil {
+			t.Fatalf("failed to store event: %s", err)
+		}
+		transactionJSON, retryTxnID, _, eventsRemaining, err := createTransaction(ctx, db, "bridge", &pending, &pendingTxnID)
+		if err != nil {
+			t.Fatalf("createTransaction failed: %s", err)
+		}
+		if retryTxnID != txnID {
+			t.Fatalf("expected the retry to have transaction ID %d, got %d", txnID, retryTxnID)
+		}
+		var txn transaction
+		if err = json.Unmarshal(transactionJSON, &txn); err != nil {
+			t.Fatalf("failed to unmarshal transaction: %s", err)
+		}
+		if len(txn.Events) != 0 || len(txn.Ephemeral) != 1 || !eventsRemaining {
+			t.Fatalf("expected the retry to only have the ephemeral event, got %s", transactionJSON)
+		}
+
+		// Once it was sent, the room events get a new transaction.
+		pending, pendingTxnID = types.PendingData{}, 0
+		transactionJSON, nextTxnID, _, _, err := createTransaction(ctx, db, "bridge", &pending, &pendingTxnID)
+		if err != nil {
+			t.Fatalf("createTransaction failed: %s", err)
+		}
+		if nextTxnID == txnID || pendingTxnID != 0 {
+			t.Fatalf("expected a new transaction with room events, got %d (kept %d)", nextTxnID, pendingTxnID)
+		}
+		txn = transaction{}
+		if err = json.Unmarshal(transactionJSON, &txn); err != nil {
+			t.Fatalf("failed to unmarshal transaction: %s", err)
+		}
+		if len(txn.Events) != 1 {
+			t.Fatalf("expected the room event to be sent, got %s", transactionJSON)
+		}
+	})
+}
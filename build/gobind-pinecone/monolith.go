@@ -283,7 +283,7 @@ func (m *DendriteMonolith) Start() {
 	m.userAPI = userapi.NewInternalAPI(base, &cfg.UserAPI, cfg.Derived.ApplicationServices, keyAPI, rsAPI, base.PushGatewayHTTPClient())
 	keyAPI.SetUserAPI(m.userAPI)
 
-	asAPI := appservice.NewInternalAPI(base, m.userAPI, rsAPI)
+	asAPI := appservice.NewInternalAPI(base, m.userAPI, rsAPI, keyAPI)
 
 	// The underlying roomserver implementation needs to be able to call the fedsender.
 	// This is different to rsAPI which can be the http client which doesn't need this dependency
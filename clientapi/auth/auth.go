@@ -63,8 +63,9 @@ func VerifyUserFromRequest(
 	}
 	var res api.QueryAccessTokenResponse
 	err = userAPI.QueryAccessToken(req.Context(), &api.QueryAccessTokenRequest{
-		AccessToken:      token,
-		AppServiceUserID: req.URL.Query().Get("user_id"),
+		AccessToken:        token,
+		AppServiceUserID:   req.URL.Query().Get("user_id"),
+		AppServiceDeviceID: appServiceDeviceID(req),
 	}, &res)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryAccessToken failed")
@@ -88,6 +89,15 @@ func VerifyUserFromRequest(
 	return res.Device, nil
 }
 
+// appServiceDeviceID returns the device which an appservice is masquerading as, if any.
+// https://github.com/matrix-org/matrix-spec-proposals/pull/3202
+func appServiceDeviceID(req *http.Request) string {
+	if deviceID := req.URL.Query().Get("device_id"); deviceID != "" {
+		return deviceID
+	}
+	return req.URL.Query().Get("org.matrix.msc3202.device_id")
+}
+
 // GenerateAccessToken creates a new access token. Returns an error if failed to generate
 // random bytes.
 func GenerateAccessToken() (string, error) {
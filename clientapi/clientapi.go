@@ -20,10 +20,12 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/producers"
 	"github.com/matrix-org/dendrite/clientapi/routing"
 	federationAPI "github.com/matrix-org/dendrite/federationapi/api"
+	"github.com/matrix-org/dendrite/internal/httputil"
 	"github.com/matrix-org/dendrite/internal/transactions"
 	keyserverAPI "github.com/matrix-org/dendrite/keyserver/api"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/base"
+	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/setup/jetstream"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -56,6 +58,11 @@ func AddPublicRoutes(
 		ServerName:             cfg.Matrix.ServerName,
 	}
 
+	rateLimits := httputil.NewRateLimits(&cfg.RateLimiting)
+	base.OnConfigReload(func(cfg *config.Dendrite) {
+		rateLimits.Update(&cfg.ClientAPI.RateLimiting)
+	})
+
 	routing.Setup(
 		base.PublicClientAPIMux,
 		base.PublicWellKnownAPIMux,
@@ -65,5 +72,6 @@ func AddPublicRoutes(
 		userAPI, userDirectoryProvider, federation,
 		syncProducer, transactionsCache, fsAPI, keyAPI,
 		extRoomsProvider, mscCfg, natsClient,
+		rateLimits, base.ReloadConfig,
 	)
 }
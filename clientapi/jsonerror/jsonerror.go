@@ -55,6 +55,12 @@ func Forbidden(msg string) *MatrixError {
 	return &MatrixError{"M_FORBIDDEN", msg}
 }
 
+// Unauthorized is an error when the client has not correctly authenticated,
+// e.g. by supplying an invalid registration token.
+func Unauthorized(msg string) *MatrixError {
+	return &MatrixError{"M_UNAUTHORIZED", msg}
+}
+
 // BadJSON is an error when the client supplies malformed JSON.
 func BadJSON(msg string) *MatrixError {
 	return &MatrixError{"M_BAD_JSON", msg}
@@ -162,6 +168,12 @@ func UnableToAuthoriseJoin(msg string) *MatrixError {
 	return &MatrixError{"M_UNABLE_TO_AUTHORISE_JOIN", msg}
 }
 
+// UnknownPos is an error that is returned when a sliding sync request refers
+// to a position which the server doesn't know about, or has forgotten.
+func UnknownPos(msg string) *MatrixError {
+	return &MatrixError{"M_UNKNOWN_POS", msg}
+}
+
 // LeaveServerNoticeError is an error returned when trying to reject an invite
 // for a server notice room.
 func LeaveServerNoticeError() *MatrixError {
@@ -19,6 +19,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/matrix-org/dendrite/setup/jetstream"
@@ -38,11 +39,16 @@ type SyncAPIProducer struct {
 	JetStream              nats.JetStreamContext
 	ServerName             gomatrixserverlib.ServerName
 	UserAPI                userapi.ClientUserAPI
+
+	lastActivity sync.Map // user ID -> time.Time
 }
 
+// How often users who keep being active have their presence updated.
+const activityGranularity = time.Minute
+
 func (p *SyncAPIProducer) SendReceipt(
 	ctx context.Context,
-	userID, roomID, eventID, receiptType string, timestamp gomatrixserverlib.Timestamp,
+	userID, roomID, eventID, receiptType, threadID string, timestamp gomatrixserverlib.Timestamp,
 ) error {
 	m := &nats.Msg{
 		Subject: p.TopicReceiptEvent,
@@ -53,8 +59,12 @@ func (p *SyncAPIProducer) SendReceipt(
 	m.Header.Set(jetstream.EventID, eventID)
 	m.Header.Set("type", receiptType)
 	m.Header.Set("timestamp", fmt.Sprintf("%d", timestamp))
+	if threadID != "" {
+		m.Header.Set("thread_id", threadID)
+	}
 
 	log.WithFields(log.Fields{}).Tracef("Producing to topic '%s'", p.TopicReceiptEvent)
+	jetstream.InjectSpan(ctx, m)
 	_, err := p.JetStream.PublishMsg(m, nats.Context(ctx))
 	return err
 }
@@ -122,6 +132,7 @@ func (p *SyncAPIProducer) SendToDevice(
 		}
 		m.Header.Set("sender", sender)
 		m.Header.Set(jetstream.UserID, userID)
+		jetstream.InjectSpan(ctx, m)
 		if _, err = p.JetStream.PublishMsg(m, nats.Context(ctx)); err != nil {
 			log.WithError(err).Error("sendToDevice failed t.Producer.SendMessage")
 			return err
@@ -142,6 +153,7 @@ func (p *SyncAPIProducer) SendTyping(
 	m.Header.Set("typing", strconv.FormatBool(typing))
 	m.Header.Set("timeout_ms", strconv.Itoa(int(timeoutMS)))
 
+	jetstream.InjectSpan(ctx, m)
 	_, err := p.JetStream.PublishMsg(m, nats.Context(ctx))
 	return err
 }
@@ -158,6 +170,19 @@ func (p *SyncAPIProducer) SendPresence(
 
 	m.Header.Set("last_active_ts", strconv.Itoa(int(gomatrixserverlib.AsTimestamp(time.Now()))))
 
+	jetstream.InjectSpan(ctx, m)
 	_, err := p.JetStream.PublishMsg(m, nats.Context(ctx))
 	return err
 }
+
+// SendActivity marks the user as online and active, because they sent an event,
+// a receipt or a read marker. To limit the number of presence updates, this is
+// only sent once a minute while the user keeps being active.
+func (p *SyncAPIProducer) SendActivity(ctx context.Context, userID string) error {
+	now := time.Now()
+	if last, ok := p.lastActivity.Load(userID); ok && now.Sub(last.(time.Time)) < activityGranularity {
+		return nil
+	}
+	p.lastActivity.Store(userID, now)
+	return p.SendPresence(ctx, userID, types.PresenceOnline, nil)
+}
@@ -178,9 +178,14 @@ func SaveReadMarker(
 		return util.ErrorResponse(err)
 	}
 
-	// Handle the read receipt that may be included in the read marker
+	// Handle the read receipts that may be included in the read marker
+	if r.ReadPrivate != "" {
+		if res := sendReceipt(req, syncProducer, device, roomID, "m.read.private", r.ReadPrivate, ""); res.Code != http.StatusOK {
+			return res
+		}
+	}
 	if r.Read != "" {
-		return SetReceipt(req, syncProducer, device, roomID, "m.read", r.Read)
+		return sendReceipt(req, syncProducer, device, roomID, "m.read", r.Read, "")
 	}
 
 	return util.JSONResponse{
@@ -3,10 +3,16 @@ package routing
 import (
 	"encoding/json"
 	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
+	appserviceAPI "github.com/matrix-org/dendrite/appservice/api"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/internal/httputil"
+	keyserverAPI "github.com/matrix-org/dendrite/keyserver/api"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
@@ -90,6 +96,38 @@ func AdminEvacuateUser(req *http.Request, cfg *config.ClientAPI, device *userapi
 	}
 }
 
+// AdminPolicyRules returns the active ban rules from the moderation policy
+// lists configured in room_server.policy_lists.
+func AdminPolicyRules(req *http.Request, cfg *config.ClientAPI, device *userapi.Device, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	res := &roomserverAPI.QueryPolicyRulesResponse{}
+	if err := rsAPI.QueryPolicyRules(req.Context(), &roomserverAPI.QueryPolicyRulesRequest{}, res); err != nil {
+		return util.ErrorResponse(err)
+	}
+	if res.Rules == nil {
+		res.Rules = []roomserverAPI.PolicyRule{}
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: res,
+	}
+}
+
+// AdminReloadConfig reloads the config file, e.g. to pick up changes to the
+// application service registrations, without restarting Dendrite.
+func AdminReloadConfig(req *http.Request, cfg *config.ClientAPI, device *userapi.Device, reloadConfig func() error) util.JSONResponse {
+	if err := reloadConfig(); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to reload config")
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.Unknown(err.Error()),
+		}
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct{}{},
+	}
+}
+
 func AdminResetPassword(req *http.Request, cfg *config.ClientAPI, device *userapi.Device, userAPI userapi.ClientUserAPI) util.JSONResponse {
 	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 	if err != nil {
@@ -138,3 +176,502 @@ func AdminResetPassword(req *http.Request, cfg *config.ClientAPI, device *userap
 		},
 	}
 }
+
+// AdminShadowBan sets (POST) or clears (DELETE) the shadow-ban flag on a
+// local account.
+func AdminShadowBan(req *http.Request, cfg *config.ClientAPI, device *userapi.Device, userAPI userapi.ClientUserAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	userID, ok := vars["userID"]
+	if !ok {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("Expecting user ID."),
+		}
+	}
+	localpart, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return util.MessageResponse(http.StatusBadRequest, err.Error())
+	}
+	if domain != cfg.Matrix.ServerName {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("User ID must belong to this server."),
+		}
+	}
+	shadowBanReq := &userapi.PerformAccountShadowBanRequest{
+		Localpart:    localpart,
+		ShadowBanned: req.Method != http.MethodDelete,
+	}
+	shadowBanRes := &userapi.PerformAccountShadowBanResponse{}
+	if err := userAPI.PerformAccountShadowBan(req.Context(), shadowBanReq, shadowBanRes); err != nil {
+		return jsonerror.InternalAPIError(req.Context(), err)
+	}
+	if !shadowBanRes.AccountExists {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("User not found."),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct {
+			ShadowBanned bool `json:"shadow_banned"`
+		}{
+			ShadowBanned: shadowBanReq.ShadowBanned,
+		},
+	}
+}
+
+// AdminPushers returns the pushers of a local account along with the state
+// of the deliveries to their push gateways.
+func AdminPushers(req *http.Request, cfg *config.ClientAPI, device *userapi.Device, userAPI userapi.ClientUserAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	userID, ok := vars["userID"]
+	if !ok {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("Expecting user ID."),
+		}
+	}
+	localpart, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return util.MessageResponse(http.StatusBadRequest, err.Error())
+	}
+	if domain != cfg.Matrix.ServerName {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("User ID must belong to this server."),
+		}
+	}
+	statusReq := &userapi.QueryPusherStatusRequest{
+		Localpart: localpart,
+	}
+	statusRes := &userapi.QueryPusherStatusResponse{}
+	if err := userAPI.QueryPusherStatus(req.Context(), statusReq, statusRes); err != nil {
+		return jsonerror.InternalAPIError(req.Context(), err)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: statusRes,
+	}
+}
+
+// validRegistrationTokenRegex matches the characters allowed in registration
+// tokens by the spec, i.e. the unreserved URI characters.
+var validRegistrationTokenRegex = regexp.MustCompile(`^[A-Za-z0-9._~-]{1,64}$`)
+
+// adminRegistrationTokenRequest is the body of requests to create or update
+// registration tokens. Fields are raw so that an explicit null can be told
+// apart from a field which wasn't given.
+type adminRegistrationTokenRequest struct {
+	Token       *string         `json:"token"`
+	Length      *int            `json:"length"`
+	UsesAllowed json.RawMessage `json:"uses_allowed"`
+	ExpiryTime  json.RawMessage `json:"expiry_time"`
+}
+
+// parseNullableInt parses a raw JSON field which may be missing, null or
+// a number. The returned bool is true if the field was present.
+func parseNullableInt(raw json.RawMessage) (*int64, bool, error) {
+	if len(raw) == 0 {
+		return nil, false, nil
+	}
+	var value *int64
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil, true, err
+	}
+	if value != nil && *value < 0 {
+		return nil, true, strconv.ErrRange
+	}
+	return value, true, nil
+}
+
+func (r *adminRegistrationTokenRequest) parse() (usesAllowed *int32, updateUses bool, expiryTime *gomatrixserverlib.Timestamp, updateExpiry bool, resErr *util.JSONResponse) {
+	uses, updateUses, err := parseNullableInt(r.UsesAllowed)
+	if err != nil || (uses != nil && *uses > 1<<31-1) {
+		return nil, false, nil, false, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("uses_allowed must be a non-negative integer or null"),
+		}
+	}
+	if uses != nil {
+		u := int32(*uses)
+		usesAllowed = &u
+	}
+	expiry, updateExpiry, err := parseNullableInt(r.ExpiryTime)
+	if err != nil {
+		return nil, false, nil, false, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("expiry_time must be a non-negative integer or null"),
+		}
+	}
+	if expiry != nil {
+		if *expiry < int64(gomatrixserverlib.AsTimestamp(time.Now())) {
+			return nil, false, nil, false, &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidParam("expiry_time must not be in the past"),
+			}
+		}
+		e := gomatrixserverlib.Timestamp(*expiry)
+		expiryTime = &e
+	}
+	return usesAllowed, updateUses, expiryTime, updateExpiry, nil
+}
+
+func AdminListRegistrationTokens(req *http.Request, cfg *config.ClientAPI, device *userapi.Device, userAPI userapi.ClientUserAPI) util.JSONResponse {
+	queryReq := &userapi.QueryRegistrationTokensRequest{}
+	if valid := req.URL.Query().Get("valid"); valid != "" {
+		v, err := strconv.ParseBool(valid)
+		if err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidParam("valid must be true or false"),
+			}
+		}
+		queryReq.Valid = &v
+	}
+	queryRes := &userapi.QueryRegistrationTokensResponse{}
+	if err := userAPI.QueryRegistrationTokens(req.Context(), queryReq, queryRes); err != nil {
+		return jsonerror.InternalAPIError(req.Context(), err)
+	}
+	if queryRes.Tokens == nil {
+		queryRes.Tokens = []userapi.RegistrationToken{}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct {
+			RegistrationTokens []userapi.RegistrationToken `json:"registration_tokens"`
+		}{
+			RegistrationTokens: queryRes.Tokens,
+		},
+	}
+}
+
+func AdminCreateRegistrationToken(req *http.Request, cfg *config.ClientAPI, device *userapi.Device, userAPI userapi.ClientUserAPI) util.JSONResponse {
+	request := adminRegistrationTokenRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("Failed to decode request body: " + err.Error()),
+		}
+	}
+	createReq := &userapi.PerformRegistrationTokenCreationRequest{}
+	if request.Token != nil {
+		if !validRegistrationTokenRegex.MatchString(*request.Token) {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidParam("token must consist of 1 to 64 characters from [A-Za-z0-9._~-]"),
+			}
+		}
+		createReq.Token = *request.Token
+	} else if request.Length != nil {
+		if *request.Length <= 0 || *request.Length > 64 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidParam("length must be between 1 and 64"),
+			}
+		}
+		createReq.Length = *request.Length
+	}
+	var resErr *util.JSONResponse
+	createReq.UsesAllowed, _, createReq.ExpiryTime, _, resErr = request.parse()
+	if resErr != nil {
+		return *resErr
+	}
+	createRes := &userapi.PerformRegistrationTokenCreationResponse{}
+	if err := userAPI.PerformRegistrationTokenCreation(req.Context(), createReq, createRes); err != nil {
+		return jsonerror.InternalAPIError(req.Context(), err)
+	}
+	if !createRes.Created {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("Registration token already exists."),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: createRes.Token,
+	}
+}
+
+func AdminRegistrationToken(req *http.Request, cfg *config.ClientAPI, device *userapi.Device, userAPI userapi.ClientUserAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	token, ok := vars["token"]
+	if !ok {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("Expecting registration token."),
+		}
+	}
+	notFound := util.JSONResponse{
+		Code: http.StatusNotFound,
+		JSON: jsonerror.NotFound("Registration token not found."),
+	}
+
+	switch req.Method {
+	case http.MethodPut:
+		request := adminRegistrationTokenRequest{}
+		if err = json.NewDecoder(req.Body).Decode(&request); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("Failed to decode request body: " + err.Error()),
+			}
+		}
+		updateReq := &userapi.PerformRegistrationTokenUpdateRequest{Token: token}
+		var resErr *util.JSONResponse
+		updateReq.UsesAllowed, updateReq.UpdateUsesAllowed, updateReq.ExpiryTime, updateReq.UpdateExpiryTime, resErr = request.parse()
+		if resErr != nil {
+			return *resErr
+		}
+		updateRes := &userapi.PerformRegistrationTokenUpdateResponse{}
+		if err = userAPI.PerformRegistrationTokenUpdate(req.Context(), updateReq, updateRes); err != nil {
+			return jsonerror.InternalAPIError(req.Context(), err)
+		}
+		if updateRes.Token == nil {
+			return notFound
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: updateRes.Token,
+		}
+
+	case http.MethodDelete:
+		deleteRes := &userapi.PerformRegistrationTokenDeletionResponse{}
+		if err = userAPI.PerformRegistrationTokenDeletion(req.Context(), &userapi.PerformRegistrationTokenDeletionRequest{
+			Token: token,
+		}, deleteRes); err != nil {
+			return jsonerror.InternalAPIError(req.Context(), err)
+		}
+		if !deleteRes.Deleted {
+			return notFound
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct{}{},
+		}
+
+	default:
+		queryRes := &userapi.QueryRegistrationTokensResponse{}
+		if err = userAPI.QueryRegistrationTokens(req.Context(), &userapi.QueryRegistrationTokensRequest{
+			Token: token,
+		}, queryRes); err != nil {
+			return jsonerror.InternalAPIError(req.Context(), err)
+		}
+		if len(queryRes.Tokens) == 0 {
+			return notFound
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: queryRes.Tokens[0],
+		}
+	}
+}
+
+// AdminStaleDeviceLists returns the remote users whose device lists are
+// stale and waiting to be fetched, optionally only those on the server given
+// in the server_name query parameter.
+func AdminStaleDeviceLists(req *http.Request, cfg *config.ClientAPI, device *userapi.Device, keyAPI keyserverAPI.ClientKeyAPI) util.JSONResponse {
+	staleReq := &keyserverAPI.QueryStaleDeviceListsRequest{
+		ServerName: gomatrixserverlib.ServerName(req.URL.Query().Get("server_name")),
+	}
+	staleRes := &keyserverAPI.QueryStaleDeviceListsResponse{}
+	if err := keyAPI.QueryStaleDeviceLists(req.Context(), staleReq, staleRes); err != nil {
+		return jsonerror.InternalAPIError(req.Context(), err)
+	}
+	userIDs := staleRes.UserIDs
+	if userIDs == nil {
+		userIDs = []string{}
+	}
+	sort.Strings(userIDs)
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct {
+			UserIDs []string `json:"user_ids"`
+		}{
+			UserIDs: userIDs,
+		},
+	}
+}
+
+// AdminResyncDeviceLists fetches the device list of the given remote user, or
+// the device lists of all known users on the given remote server.
+func AdminResyncDeviceLists(req *http.Request, cfg *config.ClientAPI, device *userapi.Device, keyAPI keyserverAPI.ClientKeyAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	resyncReq := &keyserverAPI.PerformDeviceListResyncRequest{}
+	if userID, ok := vars["userID"]; ok {
+		_, domain, err := gomatrixserverlib.SplitID('@', userID)
+		if err != nil {
+			return util.MessageResponse(http.StatusBadRequest, err.Error())
+		}
+		resyncReq.UserID, resyncReq.ServerName = userID, domain
+	} else {
+		resyncReq.ServerName = gomatrixserverlib.ServerName(vars["serverName"])
+	}
+	if resyncReq.ServerName == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("Expecting user ID or server name."),
+		}
+	}
+	if resyncReq.ServerName == cfg.Matrix.ServerName {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("Device lists of local users are always up to date."),
+		}
+	}
+	resyncRes := &keyserverAPI.PerformDeviceListResyncResponse{}
+	if err = keyAPI.PerformDeviceListResync(req.Context(), resyncReq, resyncRes); err != nil {
+		return jsonerror.InternalAPIError(req.Context(), err)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct {
+			Count int64 `json:"count"`
+		}{
+			Count: resyncRes.Count,
+		},
+	}
+}
+
+// AdminAppserviceQueues returns the state of the transaction queues of all
+// application services, or of the application service in the URL.
+func AdminAppserviceQueues(req *http.Request, cfg *config.ClientAPI, device *userapi.Device, asAPI appserviceAPI.AppServiceInternalAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	queuesReq := &appserviceAPI.QueryTransactionQueuesRequest{
+		AppServiceID: vars["appserviceID"],
+	}
+	queuesRes := &appserviceAPI.QueryTransactionQueuesResponse{}
+	if err = asAPI.QueryTransactionQueues(req.Context(), queuesReq, queuesRes); err != nil {
+		return jsonerror.InternalAPIError(req.Context(), err)
+	}
+	if queuesReq.AppServiceID == "" {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: queuesRes,
+		}
+	}
+	if len(queuesRes.Queues) == 0 {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Application service not found."),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: queuesRes.Queues[0],
+	}
+}
+
+// AdminAppserviceQueuePause pauses delivery of transactions to the application
+// service in the URL, or resumes it if the method is DELETE.
+func AdminAppserviceQueuePause(req *http.Request, cfg *config.ClientAPI, device *userapi.Device, asAPI appserviceAPI.AppServiceInternalAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	pauseReq := &appserviceAPI.PerformTransactionQueuePauseRequest{
+		AppServiceID: vars["appserviceID"],
+		Paused:       req.Method != http.MethodDelete,
+	}
+	pauseRes := &appserviceAPI.PerformTransactionQueuePauseResponse{}
+	if err = asAPI.PerformTransactionQueuePause(req.Context(), pauseReq, pauseRes); err != nil {
+		return jsonerror.InternalAPIError(req.Context(), err)
+	}
+	if !pauseRes.AppServiceExists {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Application service not found."),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct {
+			Paused bool `json:"paused"`
+		}{
+			Paused: pauseReq.Paused,
+		},
+	}
+}
+
+// AdminAppserviceQueueDiscard discards everything which is queued for the
+// application service in the URL.
+func AdminAppserviceQueueDiscard(req *http.Request, cfg *config.ClientAPI, device *userapi.Device, asAPI appserviceAPI.AppServiceInternalAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	discardReq := &appserviceAPI.PerformTransactionQueueDiscardRequest{
+		AppServiceID: vars["appserviceID"],
+	}
+	discardRes := &appserviceAPI.PerformTransactionQueueDiscardResponse{}
+	if err = asAPI.PerformTransactionQueueDiscard(req.Context(), discardReq, discardRes); err != nil {
+		return jsonerror.InternalAPIError(req.Context(), err)
+	}
+	if !discardRes.AppServiceExists {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Application service not found."),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct {
+			Discarded int64 `json:"discarded"`
+		}{
+			Discarded: discardRes.Discarded,
+		},
+	}
+}
+
+// AdminAppserviceQueueReplay sends the events of the transaction in the URL, and
+// of all later transactions, to the application service in the URL again.
+func AdminAppserviceQueueReplay(req *http.Request, cfg *config.ClientAPI, device *userapi.Device, asAPI appserviceAPI.AppServiceInternalAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	txnID, err := strconv.Atoi(vars["txnID"])
+	if err != nil || txnID < 1 {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("Transaction ID must be a positive integer."),
+		}
+	}
+	replayReq := &appserviceAPI.PerformTransactionQueueReplayRequest{
+		AppServiceID: vars["appserviceID"],
+		FromTxnID:    txnID,
+	}
+	replayRes := &appserviceAPI.PerformTransactionQueueReplayResponse{}
+	if err = asAPI.PerformTransactionQueueReplay(req.Context(), replayReq, replayRes); err != nil {
+		return jsonerror.InternalAPIError(req.Context(), err)
+	}
+	if !replayRes.AppServiceExists {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Application service not found."),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct {
+			Replayed int64 `json:"replayed"`
+		}{
+			Replayed: replayRes.Replayed,
+		},
+	}
+}
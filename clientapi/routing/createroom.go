@@ -30,6 +30,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/internal/policy"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
@@ -140,6 +141,7 @@ func CreateRoom(
 	cfg *config.ClientAPI,
 	profileAPI api.ClientUserAPI, rsAPI roomserverAPI.ClientRoomserverAPI,
 	asAPI appserviceAPI.AppServiceInternalAPI,
+	checker policy.Checker,
 ) util.JSONResponse {
 	var r createRoomRequest
 	resErr := httputil.UnmarshalJSONRequest(req, &r)
@@ -149,6 +151,16 @@ func CreateRoom(
 	if resErr = r.Validate(); resErr != nil {
 		return *resErr
 	}
+	request, err := json.Marshal(r)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("json.Marshal failed")
+		return jsonerror.InternalServerError()
+	}
+	// Soft-failing room creation makes no sense as the client would expect to
+	// be able to use the room, so treat it as a rejection.
+	if decision := checker.CheckRoomCreation(req.Context(), device.UserID, request); !decision.Allowed() {
+		return decision.RejectResponse()
+	}
 	evTime, err := httputil.ParseTSParam(req)
 	if err != nil {
 		return util.JSONResponse{
@@ -496,7 +508,8 @@ func createRoom(
 	}
 
 	// If this is a direct message then we should invite the participants.
-	if len(r.Invite) > 0 {
+	// Invites from shadow-banned users are silently dropped.
+	if len(r.Invite) > 0 && !device.ShadowBanned {
 		// Build some stripped state for the invite.
 		var globalStrippedState []gomatrixserverlib.InviteV2StrippedState
 		for _, event := range builtEvents {
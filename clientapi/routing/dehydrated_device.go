@@ -0,0 +1,239 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	keyapi "github.com/matrix-org/dendrite/keyserver/api"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/tidwall/gjson"
+)
+
+// https://github.com/matrix-org/matrix-spec-proposals/pull/3814
+type putDehydratedDeviceRequest struct {
+	// optional: if empty, an ID is generated
+	DeviceID                 string                     `json:"device_id"`
+	DeviceData               json.RawMessage            `json:"device_data"`
+	InitialDeviceDisplayName *string                    `json:"initial_device_display_name"`
+	DeviceKeys               json.RawMessage            `json:"device_keys"`
+	OneTimeKeys              map[string]json.RawMessage `json:"one_time_keys"`
+}
+
+type dehydratedDeviceResponse struct {
+	DeviceID   string          `json:"device_id"`
+	DeviceData json.RawMessage `json:"device_data,omitempty"`
+}
+
+// PutDehydratedDevice implements PUT /dehydrated_device. The dehydrated device is a normal device of the user,
+// so it receives to-device messages while the user's other devices are offline. Any previous dehydrated device
+// is deleted.
+func PutDehydratedDevice(
+	req *http.Request, userAPI userapi.ClientUserAPI, keyAPI keyapi.ClientKeyAPI, device *userapi.Device,
+) util.JSONResponse {
+	var r putDehydratedDeviceRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if !gjson.ParseBytes(r.DeviceData).IsObject() {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("device_data must be an object"),
+		}
+	}
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+
+	// Creating a device with the ID of an existing device replaces it, so only allow
+	// that for the current dehydrated device.
+	var dehydratedRes keyapi.QueryDehydratedDeviceResponse
+	if err = keyAPI.QueryDehydratedDevice(req.Context(), &keyapi.QueryDehydratedDeviceRequest{
+		UserID: device.UserID,
+	}, &dehydratedRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("keyAPI.QueryDehydratedDevice failed")
+		return jsonerror.InternalServerError()
+	}
+	var deviceID *string
+	if r.DeviceID != "" {
+		if r.DeviceID != dehydratedRes.DeviceID {
+			var devicesRes userapi.QueryDevicesResponse
+			if err = userAPI.QueryDevices(req.Context(), &userapi.QueryDevicesRequest{
+				UserID: device.UserID,
+			}, &devicesRes); err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryDevices failed")
+				return jsonerror.InternalServerError()
+			}
+			for _, dev := range devicesRes.Devices {
+				if dev.ID == r.DeviceID {
+					return util.JSONResponse{
+						Code: http.StatusBadRequest,
+						JSON: jsonerror.InvalidParam("device_id is already in use"),
+					}
+				}
+			}
+		}
+		deviceID = &r.DeviceID
+	}
+
+	// Every device needs an access token, but the one of the dehydrated device
+	// is never handed out, as the device is only used by claiming it.
+	accessToken, err := auth.GenerateAccessToken()
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("auth.GenerateAccessToken failed")
+		return jsonerror.InternalServerError()
+	}
+	var createRes userapi.PerformDeviceCreationResponse
+	if err = userAPI.PerformDeviceCreation(req.Context(), &userapi.PerformDeviceCreationRequest{
+		Localpart:         localpart,
+		AccessToken:       accessToken,
+		DeviceID:          deviceID,
+		DeviceDisplayName: r.InitialDeviceDisplayName,
+		IPAddr:            req.RemoteAddr,
+		UserAgent:         req.UserAgent(),
+	}, &createRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformDeviceCreation failed")
+		return jsonerror.InternalServerError()
+	}
+	dehydratedDeviceID := createRes.Device.ID
+
+	var storeRes keyapi.PerformStoreDehydratedDeviceResponse
+	if err = keyAPI.PerformStoreDehydratedDevice(req.Context(), &keyapi.PerformStoreDehydratedDeviceRequest{
+		UserID:     device.UserID,
+		DeviceID:   dehydratedDeviceID,
+		DeviceData: r.DeviceData,
+	}, &storeRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("keyAPI.PerformStoreDehydratedDevice failed")
+		return jsonerror.InternalServerError()
+	}
+	if storeRes.ReplacedDeviceID != "" && storeRes.ReplacedDeviceID != dehydratedDeviceID {
+		if err = userAPI.PerformDeviceDeletion(req.Context(), &userapi.PerformDeviceDeletionRequest{
+			UserID:    device.UserID,
+			DeviceIDs: []string{storeRes.ReplacedDeviceID},
+		}, &userapi.PerformDeviceDeletionResponse{}); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformDeviceDeletion failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+
+	if r.DeviceKeys != nil || r.OneTimeKeys != nil {
+		uploadReq := &keyapi.PerformUploadKeysRequest{
+			DeviceID: dehydratedDeviceID,
+			UserID:   device.UserID,
+		}
+		if r.DeviceKeys != nil {
+			uploadReq.DeviceKeys = []keyapi.DeviceKeys{
+				{
+					DeviceID: dehydratedDeviceID,
+					UserID:   device.UserID,
+					KeyJSON:  r.DeviceKeys,
+				},
+			}
+		}
+		if r.OneTimeKeys != nil {
+			uploadReq.OneTimeKeys = []keyapi.OneTimeKeys{
+				{
+					DeviceID: dehydratedDeviceID,
+					UserID:   device.UserID,
+					KeyJSON:  r.OneTimeKeys,
+				},
+			}
+		}
+		var uploadRes keyapi.PerformUploadKeysResponse
+		if err = keyAPI.PerformUploadKeys(req.Context(), uploadReq, &uploadRes); err != nil {
+			return util.ErrorResponse(err)
+		}
+		if uploadRes.Error != nil {
+			util.GetLogger(req.Context()).WithError(uploadRes.Error).Error("Failed to PerformUploadKeys")
+			return jsonerror.InternalServerError()
+		}
+		if len(uploadRes.KeyErrors) > 0 {
+			util.GetLogger(req.Context()).WithField("key_errors", uploadRes.KeyErrors).Error("Failed to upload one or more keys")
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: uploadRes.KeyErrors,
+			}
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: dehydratedDeviceResponse{DeviceID: dehydratedDeviceID},
+	}
+}
+
+// GetDehydratedDevice implements GET /dehydrated_device
+func GetDehydratedDevice(
+	req *http.Request, keyAPI keyapi.ClientKeyAPI, device *userapi.Device,
+) util.JSONResponse {
+	var res keyapi.QueryDehydratedDeviceResponse
+	if err := keyAPI.QueryDehydratedDevice(req.Context(), &keyapi.QueryDehydratedDeviceRequest{
+		UserID: device.UserID,
+	}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("keyAPI.QueryDehydratedDevice failed")
+		return jsonerror.InternalServerError()
+	}
+	if res.DeviceID == "" {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("No dehydrated device"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: dehydratedDeviceResponse{
+			DeviceID:   res.DeviceID,
+			DeviceData: res.DeviceData,
+		},
+	}
+}
+
+// DeleteDehydratedDevice implements DELETE /dehydrated_device
+func DeleteDehydratedDevice(
+	req *http.Request, userAPI userapi.ClientUserAPI, keyAPI keyapi.ClientKeyAPI, device *userapi.Device,
+) util.JSONResponse {
+	var res keyapi.PerformRemoveDehydratedDeviceResponse
+	if err := keyAPI.PerformRemoveDehydratedDevice(req.Context(), &keyapi.PerformRemoveDehydratedDeviceRequest{
+		UserID: device.UserID,
+	}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("keyAPI.PerformRemoveDehydratedDevice failed")
+		return jsonerror.InternalServerError()
+	}
+	if res.DeviceID == "" {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("No dehydrated device"),
+		}
+	}
+	if err := userAPI.PerformDeviceDeletion(req.Context(), &userapi.PerformDeviceDeletionRequest{
+		UserID:    device.UserID,
+		DeviceIDs: []string{res.DeviceID},
+	}, &userapi.PerformDeviceDeletionResponse{}); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformDeviceDeletion failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: dehydratedDeviceResponse{DeviceID: res.DeviceID},
+	}
+}
@@ -0,0 +1,127 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	keyapi "github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/dendrite/test/testrig"
+	"github.com/matrix-org/dendrite/userapi"
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+// dehydratedDeviceKeyAPI keeps the dehydrated devices in memory.
+type dehydratedDeviceKeyAPI struct {
+	keyapi.ClientKeyAPI
+	mu      sync.Mutex
+	devices map[string]keyapi.QueryDehydratedDeviceResponse
+}
+
+func (k *dehydratedDeviceKeyAPI) QueryDehydratedDevice(ctx context.Context, req *keyapi.QueryDehydratedDeviceRequest, res *keyapi.QueryDehydratedDeviceResponse) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	*res = k.devices[req.UserID]
+	return nil
+}
+
+func (k *dehydratedDeviceKeyAPI) PerformStoreDehydratedDevice(ctx context.Context, req *keyapi.PerformStoreDehydratedDeviceRequest, res *keyapi.PerformStoreDehydratedDeviceResponse) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	res.ReplacedDeviceID = k.devices[req.UserID].DeviceID
+	k.devices[req.UserID] = keyapi.QueryDehydratedDeviceResponse{
+		DeviceID:   req.DeviceID,
+		DeviceData: req.DeviceData,
+	}
+	return nil
+}
+
+func (k *dehydratedDeviceKeyAPI) PerformRemoveDehydratedDevice(ctx context.Context, req *keyapi.PerformRemoveDehydratedDeviceRequest, res *keyapi.PerformRemoveDehydratedDeviceResponse) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if dev, ok := k.devices[req.UserID]; ok && (req.DeviceID == "" || req.DeviceID == dev.DeviceID) {
+		res.DeviceID = dev.DeviceID
+		delete(k.devices, req.UserID)
+	}
+	return nil
+}
+
+func (k *dehydratedDeviceKeyAPI) PerformUploadKeys(ctx context.Context, req *keyapi.PerformUploadKeysRequest, res *keyapi.PerformUploadKeysResponse) error {
+	return nil
+}
+
+func (k *dehydratedDeviceKeyAPI) PerformDeleteKeys(ctx context.Context, req *keyapi.PerformDeleteKeysRequest, res *keyapi.PerformDeleteKeysResponse) error {
+	return nil
+}
+
+func TestDehydratedDevicesOfDifferentUsers(t *testing.T) {
+	ctx := context.Background()
+	// only one DBType, since the userapi consumers register prometheus metrics
+	base, close := testrig.CreateBaseDendrite(t, test.DBTypeSQLite)
+	defer close()
+	keyAPI := &dehydratedDeviceKeyAPI{devices: map[string]keyapi.QueryDehydratedDeviceResponse{}}
+	userAPI := userapi.NewInternalAPI(base, &base.Cfg.UserAPI, nil, keyAPI, nil, nil)
+
+	devices := map[string]*api.Device{}
+	for _, localpart := range []string{"alice", "bob"} {
+		if err := userAPI.PerformAccountCreation(ctx, &api.PerformAccountCreationRequest{
+			AccountType: api.AccountTypeUser,
+			Localpart:   localpart,
+			Password:    "password",
+		}, &api.PerformAccountCreationResponse{}); err != nil {
+			t.Fatalf("failed to create account: %s", err)
+		}
+		var deviceRes api.PerformDeviceCreationResponse
+		if err := userAPI.PerformDeviceCreation(ctx, &api.PerformDeviceCreationRequest{
+			Localpart:   localpart,
+			AccessToken: localpart + "_access_token",
+		}, &deviceRes); err != nil {
+			t.Fatalf("failed to create device: %s", err)
+		}
+		devices[localpart] = deviceRes.Device
+	}
+
+	// Both users can create a dehydrated device.
+	dehydrated := map[string]string{}
+	for localpart, device := range devices {
+		req := httptest.NewRequest(http.MethodPut, "/dehydrated_device", strings.NewReader(`{"device_data":{"algorithm":"m.dehydration.v1"}}`))
+		res := PutDehydratedDevice(req, userAPI, keyAPI, device)
+		if res.Code != http.StatusOK {
+			t.Fatalf("failed to create dehydrated device for %s: %d %+v", localpart, res.Code, res.JSON)
+		}
+		dehydrated[localpart] = res.JSON.(dehydratedDeviceResponse).DeviceID
+
+		var devicesRes api.QueryDevicesResponse
+		if err := userAPI.QueryDevices(ctx, &api.QueryDevicesRequest{UserID: device.UserID}, &devicesRes); err != nil {
+			t.Fatalf("failed to query devices: %s", err)
+		}
+		if len(devicesRes.Devices) != 2 {
+			t.Fatalf("expected %s to have 2 devices, got %d", localpart, len(devicesRes.Devices))
+		}
+	}
+
+	// Both dehydrated devices can be claimed, which deletes them.
+	for localpart, device := range devices {
+		req := httptest.NewRequest(http.MethodGet, "/dehydrated_device", nil)
+		res := GetDehydratedDevice(req, keyAPI, device)
+		if res.Code != http.StatusOK || res.JSON.(dehydratedDeviceResponse).DeviceID != dehydrated[localpart] {
+			t.Fatalf("expected the dehydrated device of %s, got %d %+v", localpart, res.Code, res.JSON)
+		}
+		req = httptest.NewRequest(http.MethodDelete, "/dehydrated_device", nil)
+		if res = DeleteDehydratedDevice(req, userAPI, keyAPI, device); res.Code != http.StatusOK {
+			t.Fatalf("failed to claim the dehydrated device of %s: %d %+v", localpart, res.Code, res.JSON)
+		}
+
+		var devicesRes api.QueryDevicesResponse
+		if err := userAPI.QueryDevices(ctx, &api.QueryDevicesRequest{UserID: device.UserID}, &devicesRes); err != nil {
+			t.Fatalf("failed to query devices: %s", err)
+		}
+		if len(devicesRes.Devices) != 1 || devicesRes.Devices[0].ID != device.ID {
+			t.Fatalf("expected only the device of %s to be left, got %+v", localpart, devicesRes.Devices)
+		}
+	}
+}
@@ -146,7 +146,7 @@ func SetLocalAlias(
 			JSON: jsonerror.BadJSON("User ID must be in the form '@localpart:domain'"),
 		}
 	}
-	for _, appservice := range cfg.Derived.ApplicationServices {
+	for _, appservice := range cfg.Derived.AppServices() {
 		// Don't prevent AS from creating aliases in its own namespace
 		// Note that Dendrite uses SenderLocalpart as UserID for AS users
 		if reqUserID != appservice.SenderLocalpart {
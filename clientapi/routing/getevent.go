@@ -102,7 +102,7 @@ func GetEvent(
 
 	var appService *config.ApplicationService
 	if device.AppserviceID != "" {
-		for _, as := range cfg.Derived.ApplicationServices {
+		for _, as := range cfg.Derived.AppServices() {
 			if as.ID == device.AppserviceID {
 				appService = &as
 				break
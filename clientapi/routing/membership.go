@@ -27,6 +27,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/clientapi/threepid"
 	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/internal/policy"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -209,12 +210,37 @@ func SendInvite(
 	req *http.Request, profileAPI userapi.ClientUserAPI, device *userapi.Device,
 	roomID string, cfg *config.ClientAPI,
 	rsAPI roomserverAPI.ClientRoomserverAPI, asAPI appserviceAPI.AppServiceInternalAPI,
+	checker policy.Checker,
 ) util.JSONResponse {
 	body, evTime, _, reqErr := extractRequestData(req, roomID, rsAPI)
 	if reqErr != nil {
 		return *reqErr
 	}
 
+	// Pretend that invites from shadow-banned users succeeded.
+	if device.ShadowBanned {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct{}{},
+		}
+	}
+
+	// Ask the policy module about the invite. Soft-failed invites get the
+	// same treatment as invites from shadow-banned users.
+	invitee := body.UserID
+	if invitee == "" {
+		invitee = body.Address
+	}
+	switch decision := checker.CheckInvite(req.Context(), device.UserID, invitee, roomID); decision.Action {
+	case policy.ActionReject:
+		return decision.RejectResponse()
+	case policy.ActionSoftFail:
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct{}{},
+		}
+	}
+
 	inviteStored, jsonErrResp := checkAndProcessThreepid(
 		req, device, body, cfg, rsAPI, profileAPI, roomID, evTime,
 	)
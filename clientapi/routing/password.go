@@ -7,6 +7,8 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/threepid"
+	"github.com/matrix-org/dendrite/clientapi/userutil"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -24,6 +26,8 @@ type newPasswordAuth struct {
 	Type    string `json:"type"`
 	Session string `json:"session"`
 	auth.PasswordRequest
+	// Used for password resets, which use m.login.email.identity
+	ThreePIDCreds threepid.Credentials `json:"threepid_creds"`
 }
 
 func Password(
@@ -85,8 +89,120 @@ func Password(
 		return *resErr
 	}
 
+	return setPassword(req, userAPI, device.UserID, r.NewPassword, r.LogoutDevices, device)
+}
+
+// PasswordReset implements POST /account/password for requests without an
+// access token, which must instead prove ownership of an email address
+// belonging to the account.
+func PasswordReset(
+	req *http.Request,
+	userAPI api.ClientUserAPI,
+	cfg *config.ClientAPI,
+) util.JSONResponse {
+	if !cfg.Matrix.Email.Enabled {
+		return util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.MissingToken("Missing access token"),
+		}
+	}
+
+	var r newPasswordRequest
+	r.LogoutDevices = true
+
+	// Unmarshal the request.
+	resErr := httputil.UnmarshalJSONRequest(req, &r)
+	if resErr != nil {
+		return *resErr
+	}
+
+	// Retrieve or generate the sessionID
+	sessionID := r.Auth.Session
+	if sessionID == "" {
+		// Generate a new, random session ID
+		sessionID = util.RandomString(sessionIDLength)
+	}
+
+	// Require email auth to reset the password.
+	if r.Auth.Type != authtypes.LoginTypeEmail {
+		return util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: newUserInteractiveResponse(
+				sessionID,
+				[]authtypes.Flow{
+					{
+						Stages: []authtypes.LoginType{authtypes.LoginTypeEmail},
+					},
+				},
+				nil,
+			),
+		}
+	}
+
+	// Check that the email address has been validated.
+	session, err := queryValidatedThreePIDSession(req.Context(), userAPI, r.Auth.ThreePIDCreds)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("queryValidatedThreePIDSession failed")
+		return jsonerror.InternalServerError()
+	}
+	if session == nil {
+		return util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.MatrixError{
+				ErrCode: "M_THREEPID_AUTH_FAILED",
+				Err:     "Email address has not been validated",
+			},
+		}
+	}
+
+	// Check the new password strength.
+	if resErr = validatePassword(r.NewPassword); resErr != nil {
+		return *resErr
+	}
+
+	// Find the account the email address belongs to.
+	res := &api.QueryLocalpartForThreePIDResponse{}
+	if err = userAPI.QueryLocalpartForThreePID(req.Context(), &api.QueryLocalpartForThreePIDRequest{
+		ThreePID: session.Address,
+		Medium:   session.Medium,
+	}, res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryLocalpartForThreePID failed")
+		return jsonerror.InternalServerError()
+	}
+	if res.Localpart == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MatrixError{
+				ErrCode: "M_THREEPID_NOT_FOUND",
+				Err:     "Email address not found",
+			},
+		}
+	}
+
+	userID := userutil.MakeUserID(res.Localpart, cfg.Matrix.ServerName)
+	resp := setPassword(req, userAPI, userID, r.NewPassword, r.LogoutDevices, nil)
+	if resp.Code == http.StatusOK {
+		// Don't allow the session to be used to reset the password again.
+		if err = userAPI.PerformThreePIDSessionDeletion(req.Context(), &api.PerformThreePIDSessionDeletionRequest{
+			SessionID: session.SessionID,
+		}, &struct{}{}); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("PerformThreePIDSessionDeletion failed")
+		}
+	}
+	return resp
+}
+
+// setPassword updates the password of the user and, if requested, logs out
+// all of their devices apart from the given one, which may be nil.
+func setPassword(
+	req *http.Request,
+	userAPI api.ClientUserAPI,
+	userID, newPassword string,
+	logoutDevices bool,
+	device *api.Device,
+) util.JSONResponse {
 	// Get the local part.
-	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
 		return jsonerror.InternalServerError()
@@ -95,7 +211,7 @@ func Password(
 	// Ask the user API to perform the password change.
 	passwordReq := &api.PerformPasswordUpdateRequest{
 		Localpart: localpart,
-		Password:  r.NewPassword,
+		Password:  newPassword,
 	}
 	passwordRes := &api.PerformPasswordUpdateResponse{}
 	if err := userAPI.PerformPasswordUpdate(req.Context(), passwordReq, passwordRes); err != nil {
@@ -109,11 +225,16 @@ func Password(
 
 	// If the request asks us to log out all other devices then
 	// ask the user API to do that.
-	if r.LogoutDevices {
+	if logoutDevices {
+		var exceptDeviceID string
+		var sessionID int64
+		if device != nil {
+			exceptDeviceID, sessionID = device.ID, device.SessionID
+		}
 		logoutReq := &api.PerformDeviceDeletionRequest{
-			UserID:         device.UserID,
+			UserID:         userID,
 			DeviceIDs:      nil,
-			ExceptDeviceID: device.ID,
+			ExceptDeviceID: exceptDeviceID,
 		}
 		logoutRes := &api.PerformDeviceDeletionResponse{}
 		if err := userAPI.PerformDeviceDeletion(req.Context(), logoutReq, logoutRes); err != nil {
@@ -123,7 +244,7 @@ func Password(
 
 		pushersReq := &api.PerformPusherDeletionRequest{
 			Localpart: localpart,
-			SessionID: device.SessionID,
+			SessionID: sessionID,
 		}
 		if err := userAPI.PerformPusherDeletion(req.Context(), pushersReq, &struct{}{}); err != nil {
 			util.GetLogger(req.Context()).WithError(err).Error("PerformPusherDeletion failed")
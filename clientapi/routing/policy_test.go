@@ -0,0 +1,138 @@
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/policy"
+	"github.com/matrix-org/dendrite/internal/transactions"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/test"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+// fixedChecker returns the same decision for everything.
+type fixedChecker struct {
+	policy.AllowAll
+	decision policy.Decision
+}
+
+func (c fixedChecker) CheckEvent(context.Context, policy.Origin, *gomatrixserverlib.HeaderedEvent) policy.Decision {
+	return c.decision
+}
+
+func (c fixedChecker) CheckRoomCreation(context.Context, string, json.RawMessage) policy.Decision {
+	return c.decision
+}
+
+func (c fixedChecker) CheckInvite(context.Context, string, string, string) policy.Decision {
+	return c.decision
+}
+
+// policyRoomserverAPI can build events in the test room, but fails the test
+// if anything is sent into it.
+type policyRoomserverAPI struct {
+	*shadowBanRoomserverAPI
+}
+
+func (r *policyRoomserverAPI) QueryLatestEventsAndState(ctx context.Context, req *roomserverAPI.QueryLatestEventsAndStateRequest, res *roomserverAPI.QueryLatestEventsAndStateResponse) error {
+	res.RoomExists = true
+	res.RoomVersion = r.room.Version
+	for _, ev := range r.room.CurrentState() {
+		for _, tuple := range req.StateToFetch {
+			if ev.Type() == tuple.EventType && ev.StateKeyEquals(tuple.StateKey) {
+				res.StateEvents = append(res.StateEvents, ev)
+			}
+		}
+	}
+	events := r.room.Events()
+	latest := events[len(events)-1]
+	res.LatestEvents = []gomatrixserverlib.EventReference{latest.EventReference()}
+	res.Depth = latest.Depth() + 1
+	return nil
+}
+
+func TestPolicyCheckerSendPaths(t *testing.T) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	device := &userapi.Device{
+		ID:          "ALICEDEVICE",
+		UserID:      alice.ID,
+		AccessToken: "alice_access_token",
+	}
+	cfg := &config.ClientAPI{
+		Matrix: &config.Global{
+			ServerName: "test",
+			KeyID:      "ed25519:test",
+			PrivateKey: test.PrivateKeyA,
+		},
+	}
+	rsAPI := &policyRoomserverAPI{&shadowBanRoomserverAPI{t: t, room: room}}
+	userAPI := &shadowBanUserAPI{}
+
+	reject := fixedChecker{decision: policy.Decision{
+		Action:  policy.ActionReject,
+		ErrCode: "M_SPAM",
+		Error:   "no spam please",
+	}}
+	softFail := fixedChecker{decision: policy.Decision{Action: policy.ActionSoftFail}}
+
+	newMessage := func() *http.Request {
+		return test.NewRequest(t, http.MethodPut, "/", test.WithJSONBody(t, map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "spam",
+		}))
+	}
+
+	t.Run("SendEvent rejected", func(t *testing.T) {
+		txnID := "txn1"
+		res := SendEvent(newMessage(), device, room.ID, "m.room.message", &txnID, nil, cfg, rsAPI, transactions.New(), reject)
+		if res.Code != http.StatusForbidden {
+			t.Fatalf("expected HTTP 403, got %d: %+v", res.Code, res.JSON)
+		}
+		if errCode := res.JSON.(jsonerror.MatrixError).ErrCode; errCode != "M_SPAM" {
+			t.Fatalf("expected errcode M_SPAM, got %s", errCode)
+		}
+	})
+
+	t.Run("SendEvent soft-failed", func(t *testing.T) {
+		txnID := "txn1"
+		res := SendEvent(newMessage(), device, room.ID, "m.room.message", &txnID, nil, cfg, rsAPI, transactions.New(), softFail)
+		if res.Code != http.StatusOK {
+			t.Fatalf("expected HTTP 200, got %d: %+v", res.Code, res.JSON)
+		}
+	})
+
+	for name, checker := range map[string]fixedChecker{"rejected": reject, "soft-failed": softFail} {
+		t.Run("SendInvite "+name, func(t *testing.T) {
+			req := test.NewRequest(t, http.MethodPost, "/", test.WithJSONBody(t, map[string]interface{}{
+				"user_id": bob.ID,
+			}))
+			res := SendInvite(req, userAPI, device, room.ID, cfg, rsAPI, nil, checker)
+			want := http.StatusForbidden
+			if checker.decision.Action == policy.ActionSoftFail {
+				want = http.StatusOK
+			}
+			if res.Code != want {
+				t.Fatalf("expected HTTP %d, got %d: %+v", want, res.Code, res.JSON)
+			}
+		})
+	}
+
+	t.Run("CreateRoom soft-failed", func(t *testing.T) {
+		req := test.NewRequest(t, http.MethodPost, "/", test.WithJSONBody(t, map[string]interface{}{
+			"name": "spam room",
+		}))
+		res := CreateRoom(req, device, cfg, userAPI, rsAPI, nil, softFail)
+		if res.Code != http.StatusForbidden {
+			t.Fatalf("expected HTTP 403, got %d: %+v", res.Code, res.JSON)
+		}
+	})
+}
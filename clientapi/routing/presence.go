@@ -85,6 +85,23 @@ func SetPresence(
 	}
 }
 
+// markActive marks the user as active if their request succeeded.
+func markActive(
+	req *http.Request,
+	cfg *config.ClientAPI,
+	device *api.Device,
+	producer *producers.SyncAPIProducer,
+	res util.JSONResponse,
+) util.JSONResponse {
+	if !cfg.Matrix.Presence.EnableOutbound || res.Code != http.StatusOK {
+		return res
+	}
+	if err := producer.SendActivity(req.Context(), device.UserID); err != nil {
+		log.WithError(err).Error("failed to mark user as active")
+	}
+	return res
+}
+
 func GetPresence(
 	req *http.Request,
 	device *api.Device,
@@ -94,6 +111,7 @@ func GetPresence(
 ) util.JSONResponse {
 	msg := nats.NewMsg(presenceTopic)
 	msg.Header.Set(jetstream.UserID, userID)
+	jetstream.InjectSpan(req.Context(), msg)
 
 	presence, err := natsClient.RequestMsg(msg, time.Second*10)
 	if err != nil {
@@ -125,12 +143,17 @@ func GetPresence(
 
 	p := types.PresenceInternal{LastActiveTS: gomatrixserverlib.Timestamp(lastActive)}
 	currentlyActive := p.CurrentlyActive()
+	presenceStatus := presence.Header.Get("presence")
+	if presenceStatus != types.PresenceOnline.String() {
+		// Only online users can be currently active.
+		currentlyActive = false
+	}
 	return util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: types.PresenceClientResponse{
 			CurrentlyActive: &currentlyActive,
 			LastActiveAgo:   p.LastActiveAgo(),
-			Presence:        presence.Header.Get("presence"),
+			Presence:        presenceStatus,
 			StatusMsg:       &statusMsg,
 		},
 	}
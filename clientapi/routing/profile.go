@@ -24,6 +24,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/internal/policy"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
@@ -93,6 +94,7 @@ func GetAvatarURL(
 func SetAvatarURL(
 	req *http.Request, profileAPI userapi.ClientUserAPI,
 	device *userapi.Device, userID string, cfg *config.ClientAPI, rsAPI api.ClientRoomserverAPI,
+	checker policy.Checker,
 ) util.JSONResponse {
 	if userID != device.UserID {
 		return util.JSONResponse{
@@ -112,6 +114,10 @@ func SetAvatarURL(
 		}
 	}
 
+	if resErr := checkProfileChange(req.Context(), checker, userID, "avatar_url", r.AvatarURL); resErr != nil {
+		return *resErr
+	}
+
 	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
@@ -222,6 +228,7 @@ func GetDisplayName(
 func SetDisplayName(
 	req *http.Request, profileAPI userapi.ClientUserAPI,
 	device *userapi.Device, userID string, cfg *config.ClientAPI, rsAPI api.ClientRoomserverAPI,
+	checker policy.Checker,
 ) util.JSONResponse {
 	if userID != device.UserID {
 		return util.JSONResponse{
@@ -241,6 +248,10 @@ func SetDisplayName(
 		}
 	}
 
+	if resErr := checkProfileChange(req.Context(), checker, userID, "displayname", r.DisplayName); resErr != nil {
+		return *resErr
+	}
+
 	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
@@ -405,3 +416,22 @@ func buildMembershipEvents(
 
 	return evs, nil
 }
+
+// checkProfileChange asks the policy module whether the user may change their
+// profile. Returns a response to send to the client if the change should not
+// go ahead. Soft-failed changes look like they succeeded.
+func checkProfileChange(
+	ctx context.Context, checker policy.Checker, userID, field, value string,
+) *util.JSONResponse {
+	switch decision := checker.CheckProfileChange(ctx, userID, field, value); decision.Action {
+	case policy.ActionReject:
+		res := decision.RejectResponse()
+		return &res
+	case policy.ActionSoftFail:
+		return &util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct{}{},
+		}
+	}
+	return nil
+}
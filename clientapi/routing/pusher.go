@@ -17,9 +17,12 @@ package routing
 import (
 	"net/http"
 	"net/url"
+	"strings"
 
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/email"
+	"github.com/matrix-org/dendrite/setup/config"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
@@ -57,7 +60,7 @@ func GetPushers(
 // The behaviour of this endpoint varies depending on the values in the JSON body.
 func SetPusher(
 	req *http.Request, device *userapi.Device,
-	userAPI userapi.ClientUserAPI,
+	userAPI userapi.ClientUserAPI, cfg *config.ClientAPI,
 ) util.JSONResponse {
 	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
 	if err != nil {
@@ -92,6 +95,11 @@ func SetPusher(
 		}
 
 	}
+	if body.Kind == userapi.EmailKind {
+		if resErr := validateEmailPusher(req, &body, localpart, userAPI, cfg); resErr != nil {
+			return *resErr
+		}
+	}
 	body.Localpart = localpart
 	body.SessionID = device.SessionID
 	err = userAPI.PerformPusherSet(req.Context(), &body, &struct{}{})
@@ -106,6 +114,77 @@ func SetPusher(
 	}
 }
 
+// validateEmailPusher checks that an email pusher can be created, i.e. that
+// we send emails ourselves and the pushkey is an email address the user has
+// validated.
+func validateEmailPusher(
+	req *http.Request, body *userapi.PerformPusherSetRequest, localpart string,
+	userAPI userapi.ClientUserAPI, cfg *config.ClientAPI,
+) *util.JSONResponse {
+	if !cfg.Matrix.Email.Enabled {
+		res := invalidParam("email pushers are not supported by this server")
+		return &res
+	}
+	if body.AppID != "m.email" {
+		res := invalidParam("app_id must be m.email for email pushers")
+		return &res
+	}
+	var res userapi.QueryThreePIDsForLocalpartResponse
+	if err := userAPI.QueryThreePIDsForLocalpart(req.Context(), &userapi.QueryThreePIDsForLocalpartRequest{
+		Localpart: localpart,
+	}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("QueryThreePIDsForLocalpart failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	for _, threePID := range res.ThreePIDs {
+		if threePID.Medium == "email" && strings.EqualFold(threePID.Address, body.PushKey) {
+			return nil
+		}
+	}
+	resErr := invalidParam("pushkey must be an email address associated with the account")
+	return &resErr
+}
+
+// UnsubscribeEmailPusher handles the unsubscribe links in notification
+// emails, see email.UnsubscribeURL. The link is followed with GET from
+// the email, or with POST by email clients which support one-click
+// unsubscribing (RFC 8058). Either way, the parameters are in the query.
+func UnsubscribeEmailPusher(
+	req *http.Request, userAPI userapi.ClientUserAPI, cfg *config.ClientAPI,
+) util.JSONResponse {
+	query := req.URL.Query()
+	userID := query.Get("user_id")
+	appID := query.Get("app_id")
+	pushKey := query.Get("pushkey")
+	if !email.ValidUnsubscribeToken(cfg.Matrix, userID, appID, pushKey, query.Get("token")) {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Invalid unsubscribe token"),
+		}
+	}
+	localpart, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil || domain != cfg.Matrix.ServerName {
+		return invalidParam("user_id must be a local user")
+	}
+	err = userAPI.PerformPusherSet(req.Context(), &userapi.PerformPusherSetRequest{
+		Pusher: userapi.Pusher{
+			AppID:   appID,
+			PushKey: pushKey,
+		},
+		Localpart: localpart,
+		Append:    true,
+	}, &struct{}{})
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("PerformPusherSet failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
 func invalidParam(msg string) util.JSONResponse {
 	return util.JSONResponse{
 		Code: http.StatusBadRequest,
@@ -15,10 +15,15 @@
 package routing
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"strings"
 	"time"
 
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/clientapi/producers"
 	"github.com/matrix-org/gomatrixserverlib"
 
@@ -27,22 +32,68 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// receiptRequest is the optional body of a receipt request.
+type receiptRequest struct {
+	// ThreadID is "main" for receipts on the main timeline, the ID of the
+	// thread root for receipts in a thread, or empty for unthreaded receipts.
+	ThreadID string `json:"thread_id,omitempty"`
+}
+
 func SetReceipt(req *http.Request, syncProducer *producers.SyncAPIProducer, device *userapi.Device, roomID, receiptType, eventID string) util.JSONResponse {
+	// The body is optional, as it was only added for threaded receipts.
+	var r receiptRequest
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("The request body could not be read: " + err.Error()),
+			}
+		}
+	}
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, &r); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON: " + err.Error()),
+			}
+		}
+	}
+	if r.ThreadID != "" && r.ThreadID != "main" && !strings.HasPrefix(r.ThreadID, "$") {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("thread_id must be \"main\" or the event ID of a thread root"),
+		}
+	}
+	return sendReceipt(req, syncProducer, device, roomID, receiptType, eventID, r.ThreadID)
+}
+
+func sendReceipt(req *http.Request, syncProducer *producers.SyncAPIProducer, device *userapi.Device, roomID, receiptType, eventID, threadID string) util.JSONResponse {
 	timestamp := gomatrixserverlib.AsTimestamp(time.Now())
 	logrus.WithFields(logrus.Fields{
 		"roomID":      roomID,
 		"receiptType": receiptType,
 		"eventID":     eventID,
+		"threadID":    threadID,
 		"userId":      device.UserID,
 		"timestamp":   timestamp,
 	}).Debug("Setting receipt")
 
-	// currently only m.read is accepted
-	if receiptType != "m.read" {
-		return util.MessageResponse(400, fmt.Sprintf("receipt type must be m.read not '%s'", receiptType))
+	// currently only read receipts are accepted
+	if receiptType != "m.read" && receiptType != "m.read.private" {
+		return util.MessageResponse(400, fmt.Sprintf("receipt type must be m.read or m.read.private not '%s'", receiptType))
+	}
+
+	// Receipts from shadow-banned users are silently dropped.
+	if device.ShadowBanned {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct{}{},
+		}
 	}
 
-	if err := syncProducer.SendReceipt(req.Context(), device.UserID, roomID, eventID, receiptType, timestamp); err != nil {
+	if err := syncProducer.SendReceipt(req.Context(), device.UserID, roomID, eventID, receiptType, threadID, timestamp); err != nil {
 		return util.ErrorResponse(err)
 	}
 
@@ -77,6 +77,10 @@ type sessionsDict struct {
 	// If a UIA session is started by trying to delete device1, and then UIA is completed by deleting device2,
 	// the delete request will fail for device2 since the UIA was initiated by trying to delete device1.
 	deleteSessionToDeviceID map[string]string
+	// registrationTokens holds the registration token used by each session, along with a function
+	// which releases the pending use of that token if the session expires before registering.
+	registrationTokens       map[string]string
+	registrationTokenRelease map[string]func()
 }
 
 // defaultTimeout is the timeout used to clean up sessions
@@ -118,6 +122,12 @@ func (d *sessionsDict) deleteSession(sessionID string) {
 	delete(d.sessions, sessionID)
 	delete(d.deleteSessionToDeviceID, sessionID)
 	delete(d.sessionCompletedResult, sessionID)
+	delete(d.registrationTokens, sessionID)
+	// release the registration token if the session expired without registering
+	if release, ok := d.registrationTokenRelease[sessionID]; ok {
+		delete(d.registrationTokenRelease, sessionID)
+		go release()
+	}
 	// stop the timer, e.g. because the registration was completed
 	if t, ok := d.timer[sessionID]; ok {
 		if !t.Stop() {
@@ -132,11 +142,13 @@ func (d *sessionsDict) deleteSession(sessionID string) {
 
 func newSessionsDict() *sessionsDict {
 	return &sessionsDict{
-		sessions:                make(map[string][]authtypes.LoginType),
-		sessionCompletedResult:  make(map[string]registerResponse),
-		params:                  make(map[string]registerRequest),
-		timer:                   make(map[string]*time.Timer),
-		deleteSessionToDeviceID: make(map[string]string),
+		sessions:                 make(map[string][]authtypes.LoginType),
+		sessionCompletedResult:   make(map[string]registerResponse),
+		params:                   make(map[string]registerRequest),
+		timer:                    make(map[string]*time.Timer),
+		deleteSessionToDeviceID:  make(map[string]string),
+		registrationTokens:       make(map[string]string),
+		registrationTokenRelease: make(map[string]func()),
 	}
 }
 
@@ -177,6 +189,38 @@ func (d *sessionsDict) addDeviceToDelete(sessionID, deviceID string) {
 	d.deleteSessionToDeviceID[sessionID] = deviceID
 }
 
+// addRegistrationToken records the registration token used by a session, and
+// a function which releases the pending use of the token if the session expires.
+// Returns false, without recording anything, if the session already has a token.
+func (d *sessionsDict) addRegistrationToken(sessionID, token string, release func()) bool {
+	d.startTimer(defaultTimeOut, sessionID)
+	d.Lock()
+	defer d.Unlock()
+	if _, ok := d.registrationTokens[sessionID]; ok {
+		return false
+	}
+	d.registrationTokens[sessionID] = token
+	d.registrationTokenRelease[sessionID] = release
+	return true
+}
+
+func (d *sessionsDict) getRegistrationToken(sessionID string) (string, bool) {
+	d.RLock()
+	defer d.RUnlock()
+	token, ok := d.registrationTokens[sessionID]
+	return token, ok
+}
+
+// completeRegistrationToken returns the registration token used by a session,
+// if any, and stops it from being released when the session expires.
+func (d *sessionsDict) completeRegistrationToken(sessionID string) (string, bool) {
+	d.Lock()
+	defer d.Unlock()
+	token, ok := d.registrationTokens[sessionID]
+	delete(d.registrationTokenRelease, sessionID)
+	return token, ok
+}
+
 func (d *sessionsDict) addCompletedRegistration(sessionID string, response registerResponse) {
 	d.Lock()
 	defer d.Unlock()
@@ -236,6 +280,8 @@ type authDict struct {
 
 	// Recaptcha
 	Response string `json:"response"`
+	// Registration token
+	Token string `json:"token"`
 	// TODO: Lots of custom keys depending on the type
 }
 
@@ -396,6 +442,72 @@ func validateRecaptcha(
 	return nil
 }
 
+// validateRegistrationToken returns an error response if the registration token
+// is invalid. Otherwise the token is marked as pending for the given session.
+func validateRegistrationToken(
+	ctx context.Context,
+	cfg *config.ClientAPI,
+	userAPI userapi.ClientUserAPI,
+	sessionID, token string,
+) *util.JSONResponse {
+	if !cfg.RegistrationRequiresToken {
+		return &util.JSONResponse{
+			Code: http.StatusConflict,
+			JSON: jsonerror.Unknown("Registration token registration is disabled"),
+		}
+	}
+
+	// Don't count the token twice if the client repeats this stage, and don't
+	// let a session take pending uses of more than one token.
+	if existing, ok := sessions.getRegistrationToken(sessionID); ok {
+		if existing == token {
+			return nil
+		}
+		return &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.Unauthorized("A different registration token was already used for this session"),
+		}
+	}
+
+	if token == "" {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingParam("Registration token is required"),
+		}
+	}
+
+	res := &userapi.PerformRegistrationTokenUseResponse{}
+	if err := userAPI.PerformRegistrationTokenUse(ctx, &userapi.PerformRegistrationTokenUseRequest{
+		Token: token,
+		Use:   userapi.RegistrationTokenUseBegin,
+	}, res); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("userAPI.PerformRegistrationTokenUse failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if !res.Valid {
+		return &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.Unauthorized("Invalid registration token"),
+		}
+	}
+
+	release := func() {
+		if err := userAPI.PerformRegistrationTokenUse(context.Background(), &userapi.PerformRegistrationTokenUseRequest{
+			Token: token,
+			Use:   userapi.RegistrationTokenUseRelease,
+		}, &userapi.PerformRegistrationTokenUseResponse{}); err != nil {
+			log.WithError(err).Error("Failed to release registration token")
+		}
+	}
+	if !sessions.addRegistrationToken(sessionID, token, release) {
+		// Another request for the same session got there first.
+		release()
+		return validateRegistrationToken(ctx, cfg, userAPI, sessionID, token)
+	}
+	return nil
+}
+
 // UserIDIsWithinApplicationServiceNamespace checks to see if a given userID
 // falls within any of the namespaces of a given Application Service. If no
 // Application Service is given, it will check to see if it matches any
@@ -432,7 +544,7 @@ func UserIDIsWithinApplicationServiceNamespace(
 	}
 
 	// Loop through all known application service's namespaces and see if any match
-	for _, knownAppService := range cfg.Derived.ApplicationServices {
+	for _, knownAppService := range cfg.Derived.AppServices() {
 		if knownAppService.SenderLocalpart == local {
 			return true
 		}
@@ -456,7 +568,7 @@ func UsernameMatchesMultipleExclusiveNamespaces(
 
 	// Check namespaces and see if more than one match
 	matchCount := 0
-	for _, appservice := range cfg.Derived.ApplicationServices {
+	for _, appservice := range cfg.Derived.AppServices() {
 		if appservice.OwnsNamespaceCoveringUserId(userID) {
 			if matchCount++; matchCount > 1 {
 				return true
@@ -473,7 +585,7 @@ func UsernameMatchesExclusiveNamespaces(
 	username string,
 ) bool {
 	userID := userutil.MakeUserID(username, cfg.Matrix.ServerName)
-	return cfg.Derived.ExclusiveApplicationServicesUsernameRegexp.MatchString(userID)
+	return cfg.Derived.ExclusiveUsernameRegexp().MatchString(userID)
 }
 
 // validateApplicationService checks if a provided application service token
@@ -488,7 +600,7 @@ func validateApplicationService(
 	// Check if the token if the application service is valid with one we have
 	// registered in the config.
 	var matchedApplicationService *config.ApplicationService
-	for _, appservice := range cfg.Derived.ApplicationServices {
+	for _, appservice := range cfg.Derived.AppServices() {
 		if appservice.ASToken == accessToken {
 			matchedApplicationService = &appservice
 			break
@@ -737,7 +849,7 @@ func handleRegistrationFlow(
 	// service namespace. Skip this check if no app services are registered.
 	// If an access token is provided, ignore this check this is an appservice
 	// request and we will validate in validateApplicationService
-	if len(cfg.Derived.ApplicationServices) != 0 &&
+	if len(cfg.Derived.AppServices()) != 0 &&
 		UsernameMatchesExclusiveNamespaces(cfg, r.Username) {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
@@ -756,6 +868,16 @@ func handleRegistrationFlow(
 		// Add Recaptcha to the list of completed registration stages
 		sessions.addCompletedSessionStage(sessionID, authtypes.LoginTypeRecaptcha)
 
+	case authtypes.LoginTypeRegistrationToken:
+		// Check given registration token
+		resErr := validateRegistrationToken(req.Context(), cfg, userAPI, sessionID, r.Auth.Token)
+		if resErr != nil {
+			return *resErr
+		}
+
+		// Add the registration token to the list of completed registration stages
+		sessions.addCompletedSessionStage(sessionID, authtypes.LoginTypeRegistrationToken)
+
 	case authtypes.LoginTypeDummy:
 		// there is nothing to do
 		// Add Dummy to the list of completed registration stages
@@ -835,10 +957,14 @@ func checkAndCompleteFlow(
 ) util.JSONResponse {
 	if checkFlowCompleted(flow, cfg.Derived.Registration.Flows) {
 		// This flow was completed, registration can continue
-		return completeRegistration(
+		res := completeRegistration(
 			req.Context(), userAPI, r.Username, r.Password, "", req.RemoteAddr, req.UserAgent(), sessionID,
 			r.InhibitLogin, r.InitialDisplayName, r.DeviceID, userapi.AccountTypeUser,
 		)
+		if res.Code == http.StatusOK {
+			completeRegistrationTokenUse(req.Context(), userAPI, sessionID)
+		}
+		return res
 	}
 	sessions.addParams(sessionID, r)
 	// There are still more stages to complete.
@@ -850,6 +976,21 @@ func checkAndCompleteFlow(
 	}
 }
 
+// completeRegistrationTokenUse marks the pending use of the registration token
+// used by the session, if any, as completed.
+func completeRegistrationTokenUse(ctx context.Context, userAPI userapi.ClientUserAPI, sessionID string) {
+	token, ok := sessions.completeRegistrationToken(sessionID)
+	if !ok {
+		return
+	}
+	if err := userAPI.PerformRegistrationTokenUse(ctx, &userapi.PerformRegistrationTokenUseRequest{
+		Token: token,
+		Use:   userapi.RegistrationTokenUseComplete,
+	}, &userapi.PerformRegistrationTokenUseResponse{}); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("Failed to complete registration token use")
+	}
+}
+
 // completeRegistration runs some rudimentary checks against the submitted
 // input, then if successful creates an account and a newly associated device
 // We pass in each individual part of the request here instead of just passing a
@@ -1024,7 +1165,7 @@ func RegisterAvailable(
 
 	// Check if this username is reserved by an application service
 	userID := userutil.MakeUserID(username, cfg.Matrix.ServerName)
-	for _, appservice := range cfg.Derived.ApplicationServices {
+	for _, appservice := range cfg.Derived.AppServices() {
 		if appservice.OwnsNamespaceCoveringUserId(userID) {
 			return util.JSONResponse{
 				Code: http.StatusBadRequest,
@@ -1059,6 +1200,46 @@ func RegisterAvailable(
 	}
 }
 
+// RegistrationTokenValidity checks if a registration token can be used to register.
+func RegistrationTokenValidity(
+	req *http.Request,
+	cfg *config.ClientAPI,
+	userAPI userapi.ClientUserAPI,
+) util.JSONResponse {
+	if !cfg.RegistrationRequiresToken {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Registration tokens are not enabled on this server."),
+		}
+	}
+
+	token := req.URL.Query().Get("token")
+	if token == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("Missing token parameter."),
+		}
+	}
+
+	valid := true
+	res := &userapi.QueryRegistrationTokensResponse{}
+	if err := userAPI.QueryRegistrationTokens(req.Context(), &userapi.QueryRegistrationTokensRequest{
+		Token: token,
+		Valid: &valid,
+	}, res); err != nil {
+		return jsonerror.InternalAPIError(req.Context(), err)
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct {
+			Valid bool `json:"valid"`
+		}{
+			Valid: len(res.Tokens) > 0,
+		},
+	}
+}
+
 func handleSharedSecretRegistration(userAPI userapi.ClientUserAPI, sr *SharedSecretRegistration, req *http.Request) util.JSONResponse {
 	ssrr, err := NewSharedSecretRegistrationRequest(req.Body)
 	if err != nil {
@@ -15,12 +15,15 @@
 package routing
 
 import (
+	"context"
+	"net/http"
 	"regexp"
 	"testing"
 	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
 )
 
 var (
@@ -260,4 +263,76 @@ func TestSessionCleanUp(t *testing.T) {
 			t.Error("expected session to device to be delete")
 		}
 	})
+
+	t.Run("registration token is released when session expires", func(t *testing.T) {
+		dummySession := "helloWorld4"
+		released := make(chan struct{})
+		s.addRegistrationToken(dummySession, "token", func() { close(released) })
+		s.startTimer(time.Millisecond, dummySession)
+		select {
+		case <-released:
+		case <-time.After(time.Second):
+			t.Fatal("expected registration token to be released")
+		}
+		if _, ok := s.getRegistrationToken(dummySession); ok {
+			t.Error("expected registration token to be deleted")
+		}
+	})
+
+	t.Run("registration token is not released once the registration completed", func(t *testing.T) {
+		dummySession := "helloWorld5"
+		released := make(chan struct{})
+		s.addRegistrationToken(dummySession, "token", func() { close(released) })
+		if s.addRegistrationToken(dummySession, "other", func() {}) {
+			t.Error("expected a second registration token not to be recorded")
+		}
+		if token, ok := s.completeRegistrationToken(dummySession); !ok || token != "token" {
+			t.Errorf("expected registration token %q, got %q", "token", token)
+		}
+		s.deleteSession(dummySession)
+		select {
+		case <-released:
+			t.Fatal("expected registration token not to be released")
+		case <-time.After(time.Millisecond * 50):
+		}
+	})
+}
+
+type registrationTokenUserAPI struct {
+	userapi.ClientUserAPI
+	pending map[string]int
+}
+
+func (a *registrationTokenUserAPI) PerformRegistrationTokenUse(ctx context.Context, req *userapi.PerformRegistrationTokenUseRequest, res *userapi.PerformRegistrationTokenUseResponse) error {
+	switch req.Use {
+	case userapi.RegistrationTokenUseBegin:
+		a.pending[req.Token]++
+		res.Valid = true
+	case userapi.RegistrationTokenUseRelease:
+		a.pending[req.Token]--
+	}
+	return nil
+}
+
+func TestValidateRegistrationToken(t *testing.T) {
+	cfg := &config.ClientAPI{RegistrationRequiresToken: true}
+	userAPI := &registrationTokenUserAPI{pending: map[string]int{}}
+	sessionID := "registrationTokenSession"
+	defer sessions.deleteSession(sessionID)
+
+	if resErr := validateRegistrationToken(context.Background(), cfg, userAPI, sessionID, "first"); resErr != nil {
+		t.Fatalf("expected the token to be valid, got %+v", resErr)
+	}
+	// Repeating the stage with the same token doesn't take another use.
+	if resErr := validateRegistrationToken(context.Background(), cfg, userAPI, sessionID, "first"); resErr != nil {
+		t.Fatalf("expected the token to be valid, got %+v", resErr)
+	}
+	// A different token can't be used by the same session.
+	resErr := validateRegistrationToken(context.Background(), cfg, userAPI, sessionID, "second")
+	if resErr == nil || resErr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected a different token to be rejected, got %+v", resErr)
+	}
+	if userAPI.pending["first"] != 1 || userAPI.pending["second"] != 0 {
+		t.Fatalf("unexpected pending uses %+v", userAPI.pending)
+	}
 }
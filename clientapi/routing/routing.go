@@ -26,8 +26,10 @@ import (
 	clientutil "github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/clientapi/threepid"
 	federationAPI "github.com/matrix-org/dendrite/federationapi/api"
 	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/internal/policy"
 	"github.com/matrix-org/dendrite/internal/transactions"
 	keyserverAPI "github.com/matrix-org/dendrite/keyserver/api"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
@@ -61,12 +63,23 @@ func Setup(
 	keyAPI keyserverAPI.ClientKeyAPI,
 	extRoomsProvider api.ExtraPublicRoomsProvider,
 	mscCfg *config.MSCs, natsClient *nats.Conn,
+	rateLimits *httputil.RateLimits,
+	reloadConfig func() error,
 ) {
 	prometheus.MustRegister(amtRegUsers, sendEventDuration)
 
-	rateLimits := httputil.NewRateLimits(&cfg.RateLimiting)
 	userInteractiveAuth := auth.NewUserInteractive(userAPI, cfg)
 
+	checker := policy.NewChecker(&cfg.Matrix.Policy)
+
+	var mailer *threepid.Mailer
+	if cfg.Matrix.Email.Enabled {
+		var err error
+		if mailer, err = threepid.NewMailer(cfg.Matrix); err != nil {
+			logrus.WithError(err).Fatal("unable to set up sending emails")
+		}
+	}
+
 	unstableFeatures := map[string]bool{
 		"org.matrix.e2e_cross_signing": true,
 	}
@@ -76,21 +89,15 @@ func Setup(
 
 	if cfg.Matrix.WellKnownClientName != "" {
 		logrus.Infof("Setting m.homeserver base_url as %s at /.well-known/matrix/client", cfg.Matrix.WellKnownClientName)
-		wkMux.Handle("/client", httputil.MakeExternalAPI("wellknown", func(r *http.Request) util.JSONResponse {
-			return util.JSONResponse{
-				Code: http.StatusOK,
-				JSON: struct {
-					HomeserverName struct {
-						BaseUrl string `json:"base_url"`
-					} `json:"m.homeserver"`
-				}{
-					HomeserverName: struct {
-						BaseUrl string `json:"base_url"`
-					}{
-						BaseUrl: cfg.Matrix.WellKnownClientName,
-					},
-				},
-			}
+		wkMux.Handle("/client", httputil.MakeExternalAPI("wellknown", func(req *http.Request) util.JSONResponse {
+			return WellKnownClient(req, cfg.Matrix)
+		})).Methods(http.MethodGet, http.MethodOptions)
+	}
+
+	if cfg.Matrix.WellKnown.HasSupport() {
+		logrus.Infof("Serving support contacts at /.well-known/matrix/support")
+		wkMux.Handle("/support", httputil.MakeExternalAPI("wellknown_support", func(req *http.Request) util.JSONResponse {
+			return WellKnownSupport(req, cfg.Matrix)
 		})).Methods(http.MethodGet, http.MethodOptions)
 	}
 
@@ -155,12 +162,102 @@ func Setup(
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
+	dendriteAdminRouter.Handle("/admin/policyRules",
+		httputil.MakeAdminAPI("admin_policy_rules", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminPolicyRules(req, cfg, device, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
 	dendriteAdminRouter.Handle("/admin/resetPassword/{localpart}",
 		httputil.MakeAdminAPI("admin_reset_password", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			return AdminResetPassword(req, cfg, device, userAPI)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
+	dendriteAdminRouter.Handle("/admin/shadowBan/{userID}",
+		httputil.MakeAdminAPI("admin_shadow_ban", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminShadowBan(req, cfg, device, userAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodDelete, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/pushers/{userID}",
+		httputil.MakeAdminAPI("admin_pushers", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminPushers(req, cfg, device, userAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/staleDeviceLists",
+		httputil.MakeAdminAPI("admin_stale_device_lists", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminStaleDeviceLists(req, cfg, device, keyAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/resyncDeviceLists/{userID}",
+		httputil.MakeAdminAPI("admin_resync_device_lists", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminResyncDeviceLists(req, cfg, device, keyAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/resyncServerDeviceLists/{serverName}",
+		httputil.MakeAdminAPI("admin_resync_server_device_lists", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminResyncDeviceLists(req, cfg, device, keyAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/registrationTokens",
+		httputil.MakeAdminAPI("admin_list_registration_tokens", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminListRegistrationTokens(req, cfg, device, userAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/registrationTokens/new",
+		httputil.MakeAdminAPI("admin_create_registration_token", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminCreateRegistrationToken(req, cfg, device, userAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/registrationTokens/{token}",
+		httputil.MakeAdminAPI("admin_registration_token", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminRegistrationToken(req, cfg, device, userAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodPut, http.MethodDelete, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/appserviceQueues",
+		httputil.MakeAdminAPI("admin_appservice_queues", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminAppserviceQueues(req, cfg, device, asAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/appserviceQueues/{appserviceID}",
+		httputil.MakeAdminAPI("admin_appservice_queue", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminAppserviceQueues(req, cfg, device, asAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/appserviceQueues/{appserviceID}/pause",
+		httputil.MakeAdminAPI("admin_appservice_queue_pause", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminAppserviceQueuePause(req, cfg, device, asAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodDelete, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/appserviceQueues/{appserviceID}/discard",
+		httputil.MakeAdminAPI("admin_appservice_queue_discard", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminAppserviceQueueDiscard(req, cfg, device, asAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/appserviceQueues/{appserviceID}/replay/{txnID}",
+		httputil.MakeAdminAPI("admin_appservice_queue_replay", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminAppserviceQueueReplay(req, cfg, device, asAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/reloadConfig",
+		httputil.MakeAdminAPI("admin_reload_config", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminReloadConfig(req, cfg, device, reloadConfig)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
 	// server notifications
 	if cfg.Matrix.ServerNotices.Enabled {
 		logrus.Info("Enabling server notices at /_synapse/admin/v1/send_server_notice")
@@ -213,11 +310,13 @@ func Setup(
 	// Note that 'apiversion' is chosen because it must not collide with a variable used in any of the routing!
 	v3mux := publicAPIMux.PathPrefix("/{apiversion:(?:r0|v3)}/").Subrouter()
 
+	v1mux := publicAPIMux.PathPrefix("/v1/").Subrouter()
+
 	unstableMux := publicAPIMux.PathPrefix("/unstable").Subrouter()
 
 	v3mux.Handle("/createRoom",
 		httputil.MakeAuthAPI("createRoom", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			return CreateRoom(req, device, cfg, userAPI, rsAPI, asAPI)
+			return CreateRoom(req, device, cfg, userAPI, rsAPI, asAPI, checker)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 	v3mux.Handle("/join/{roomIDOrAlias}",
@@ -313,7 +412,7 @@ func Setup(
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return SendInvite(req, userAPI, device, vars["roomID"], cfg, rsAPI, asAPI)
+			return SendInvite(req, userAPI, device, vars["roomID"], cfg, rsAPI, asAPI, checker)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 	v3mux.Handle("/rooms/{roomID}/kick",
@@ -340,7 +439,8 @@ func Setup(
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return SendEvent(req, device, vars["roomID"], vars["eventType"], nil, nil, cfg, rsAPI, nil)
+			return markActive(req, cfg, device, syncProducer,
+				SendEvent(req, device, vars["roomID"], vars["eventType"], nil, nil, cfg, rsAPI, nil, checker))
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 	v3mux.Handle("/rooms/{roomID}/send/{eventType}/{txnID}",
@@ -350,8 +450,9 @@ func Setup(
 				return util.ErrorResponse(err)
 			}
 			txnID := vars["txnID"]
-			return SendEvent(req, device, vars["roomID"], vars["eventType"], &txnID,
-				nil, cfg, rsAPI, transactionsCache)
+			return markActive(req, cfg, device, syncProducer,
+				SendEvent(req, device, vars["roomID"], vars["eventType"], &txnID,
+					nil, cfg, rsAPI, transactionsCache, checker))
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
 	v3mux.Handle("/rooms/{roomID}/event/{eventID}",
@@ -408,7 +509,7 @@ func Setup(
 			}
 			emptyString := ""
 			eventType := strings.TrimSuffix(vars["eventType"], "/")
-			return SendEvent(req, device, vars["roomID"], eventType, nil, &emptyString, cfg, rsAPI, nil)
+			return SendEvent(req, device, vars["roomID"], eventType, nil, &emptyString, cfg, rsAPI, nil, checker)
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
 
@@ -419,7 +520,7 @@ func Setup(
 				return util.ErrorResponse(err)
 			}
 			stateKey := vars["stateKey"]
-			return SendEvent(req, device, vars["roomID"], vars["eventType"], nil, &stateKey, cfg, rsAPI, nil)
+			return SendEvent(req, device, vars["roomID"], vars["eventType"], nil, &stateKey, cfg, rsAPI, nil, checker)
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
 
@@ -430,6 +531,15 @@ func Setup(
 		return Register(req, userAPI, cfg)
 	})).Methods(http.MethodPost, http.MethodOptions)
 
+	registrationTokenValidity := httputil.MakeExternalAPI("registrationTokenValidity", func(req *http.Request) util.JSONResponse {
+		if r := rateLimits.Limit(req, nil); r != nil {
+			return *r
+		}
+		return RegistrationTokenValidity(req, cfg, userAPI)
+	})
+	v1mux.Handle("/register/m.login.registration_token/validity", registrationTokenValidity).Methods(http.MethodGet, http.MethodOptions)
+	unstableMux.Handle("/org.matrix.msc3231/register/org.matrix.msc3231.login.registration_token/validity", registrationTokenValidity).Methods(http.MethodGet, http.MethodOptions)
+
 	v3mux.Handle("/register/available", httputil.MakeExternalAPI("registerAvailable", func(req *http.Request) util.JSONResponse {
 		if r := rateLimits.Limit(req, nil); r != nil {
 			return *r
@@ -569,6 +679,20 @@ func Setup(
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
+	// Requests to change the password without an access token are password
+	// resets, which are authorised by validating an email address instead.
+	v3mux.Handle("/account/password",
+		httputil.MakeExternalAPI("password_reset", func(req *http.Request) util.JSONResponse {
+			if r := rateLimits.Limit(req, nil); r != nil {
+				return *r
+			}
+			return PasswordReset(req, userAPI, cfg)
+		}),
+	).Methods(http.MethodPost).MatcherFunc(func(req *http.Request, _ *mux.RouteMatch) bool {
+		_, err := auth.ExtractAccessToken(req)
+		return err != nil
+	})
+
 	v3mux.Handle("/account/password",
 		httputil.MakeAuthAPI("password", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			if r := rateLimits.Limit(req, device); r != nil {
@@ -772,7 +896,7 @@ func Setup(
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return SetAvatarURL(req, userAPI, device, vars["userID"], cfg, rsAPI)
+			return SetAvatarURL(req, userAPI, device, vars["userID"], cfg, rsAPI, checker)
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
 	// Browsers use the OPTIONS HTTP method to check if the CORS policy allows
@@ -797,7 +921,7 @@ func Setup(
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return SetDisplayName(req, userAPI, device, vars["userID"], cfg, rsAPI)
+			return SetDisplayName(req, userAPI, device, vars["userID"], cfg, rsAPI, checker)
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
 	// Browsers use the OPTIONS HTTP method to check if the CORS policy allows
@@ -821,12 +945,37 @@ func Setup(
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
-	v3mux.Handle("/{path:(?:account/3pid|register)}/email/requestToken",
+	v3mux.Handle("/{path:(?:account/3pid|register|account/password)}/email/requestToken",
 		httputil.MakeExternalAPI("account_3pid_request_token", func(req *http.Request) util.JSONResponse {
-			return RequestEmailToken(req, userAPI, cfg)
+			if r := rateLimits.Limit(req, nil); r != nil {
+				return *r
+			}
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return RequestEmailToken(req, userAPI, cfg, mailer, vars["path"])
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
+	unstableMux.Handle("/{path:(?:add_threepid|password_reset)}/email/submit_token",
+		httputil.MakeExternalAPI("account_3pid_submit_token", func(req *http.Request) util.JSONResponse {
+			if r := rateLimits.Limit(req, nil); r != nil {
+				return *r
+			}
+			return SubmitEmailToken(req, userAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	unstableMux.Handle("/{path:(?:add_threepid|password_reset)}/email/submit_token",
+		httputil.MakeHTMLAPI("account_3pid_submit_token_page", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
+			if r := rateLimits.Limit(req, nil); r != nil {
+				return r
+			}
+			return SubmitEmailTokenPage(w, req, userAPI)
+		}),
+	).Methods(http.MethodGet)
+
 	v3mux.Handle("/voip/turnServer",
 		httputil.MakeAuthAPI("turn_server", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			if r := rateLimits.Limit(req, device); r != nil {
@@ -837,12 +986,50 @@ func Setup(
 	).Methods(http.MethodGet, http.MethodOptions)
 
 	v3mux.Handle("/thirdparty/protocols",
-		httputil.MakeExternalAPI("thirdparty_protocols", func(req *http.Request) util.JSONResponse {
-			// TODO: Return the third party protcols
-			return util.JSONResponse{
-				Code: http.StatusOK,
-				JSON: struct{}{},
+		httputil.MakeAuthAPI("thirdparty_protocols", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return Protocols(req, asAPI, "")
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	v3mux.Handle("/thirdparty/protocol/{protocolID}",
+		httputil.MakeAuthAPI("thirdparty_protocol", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
 			}
+			return Protocols(req, asAPI, vars["protocolID"])
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	v3mux.Handle("/thirdparty/location",
+		httputil.MakeAuthAPI("thirdparty_location", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return Locations(req, asAPI, "")
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	v3mux.Handle("/thirdparty/location/{protocolID}",
+		httputil.MakeAuthAPI("thirdparty_location_protocol", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return Locations(req, asAPI, vars["protocolID"])
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	v3mux.Handle("/thirdparty/user",
+		httputil.MakeAuthAPI("thirdparty_user", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return User(req, asAPI, "")
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	v3mux.Handle("/thirdparty/user/{protocolID}",
+		httputil.MakeAuthAPI("thirdparty_user_protocol", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return User(req, asAPI, vars["protocolID"])
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
@@ -935,11 +1122,10 @@ func Setup(
 			return SearchUserDirectory(
 				req.Context(),
 				device,
-				rsAPI,
+				userAPI,
 				userDirectoryProvider,
 				postContent.SearchString,
 				postContent.Limit,
-				federation,
 				cfg.Matrix.ServerName,
 			)
 		}),
@@ -974,7 +1160,8 @@ func Setup(
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return SaveReadMarker(req, userAPI, rsAPI, syncProducer, device, vars["roomID"])
+			return markActive(req, cfg, device, syncProducer,
+				SaveReadMarker(req, userAPI, rsAPI, syncProducer, device, vars["roomID"]))
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
@@ -1060,10 +1247,19 @@ func Setup(
 			if r := rateLimits.Limit(req, device); r != nil {
 				return *r
 			}
-			return SetPusher(req, device, userAPI)
+			return SetPusher(req, device, userAPI, cfg)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
+	unstableMux.Handle("/pushers/email/unsubscribe",
+		httputil.MakeExternalAPI("unsubscribe_email_pusher", func(req *http.Request) util.JSONResponse {
+			if r := rateLimits.Limit(req, nil); r != nil {
+				return *r
+			}
+			return UnsubscribeEmailPusher(req, userAPI, cfg)
+		}),
+	).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
+
 	// Stub implementations for sytest
 	v3mux.Handle("/events",
 		httputil.MakeExternalAPI("events", func(req *http.Request) util.JSONResponse {
@@ -1329,6 +1525,23 @@ func Setup(
 			return ClaimKeys(req, keyAPI)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
+	if mscCfg.Enabled("msc3814") {
+		unstableMux.Handle("/org.matrix.msc3814.v1/dehydrated_device",
+			httputil.MakeAuthAPI("put_dehydrated_device", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+				return PutDehydratedDevice(req, userAPI, keyAPI, device)
+			}),
+		).Methods(http.MethodPut, http.MethodOptions)
+		unstableMux.Handle("/org.matrix.msc3814.v1/dehydrated_device",
+			httputil.MakeAuthAPI("get_dehydrated_device", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+				return GetDehydratedDevice(req, keyAPI, device)
+			}),
+		).Methods(http.MethodGet)
+		unstableMux.Handle("/org.matrix.msc3814.v1/dehydrated_device",
+			httputil.MakeAuthAPI("delete_dehydrated_device", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+				return DeleteDehydratedDevice(req, userAPI, keyAPI, device)
+			}),
+		).Methods(http.MethodDelete)
+	}
 	v3mux.Handle("/rooms/{roomId}/receipt/{receiptType}/{eventId}",
 		httputil.MakeAuthAPI(gomatrixserverlib.Join, userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			if r := rateLimits.Limit(req, device); r != nil {
@@ -1339,7 +1552,8 @@ func Setup(
 				return util.ErrorResponse(err)
 			}
 
-			return SetReceipt(req, syncProducer, device, vars["roomId"], vars["receiptType"], vars["eventId"])
+			return markActive(req, cfg, device, syncProducer,
+				SetReceipt(req, syncProducer, device, vars["roomId"], vars["receiptType"], vars["eventId"]))
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 	v3mux.Handle("/presence/{userId}/status",
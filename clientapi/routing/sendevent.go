@@ -16,6 +16,8 @@ package routing
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -31,6 +33,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/internal/policy"
 	"github.com/matrix-org/dendrite/internal/transactions"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -74,6 +77,7 @@ func SendEvent(
 	cfg *config.ClientAPI,
 	rsAPI api.ClientRoomserverAPI,
 	txnCache *transactions.Cache,
+	checker policy.Checker,
 ) util.JSONResponse {
 	verReq := api.QueryRoomVersionForRoomRequest{RoomID: roomID}
 	verRes := api.QueryRoomVersionForRoomResponse{}
@@ -104,6 +108,19 @@ func SendEvent(
 		return *resErr
 	}
 
+	// Shadow-banned users get a plausible looking response, but the event
+	// never reaches the roomserver and so is never federated either.
+	if device.ShadowBanned {
+		res := util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: sendEventResponse{shadowBannedEventID()},
+		}
+		if txnID != nil {
+			txnCache.AddTransaction(device.AccessToken, *txnID, &res)
+		}
+		return res
+	}
+
 	if stateKey != nil {
 		// If the existing/new state content are equal, return the existing event_id, making the request idempotent.
 		if resp := stateEqual(req.Context(), rsAPI, eventType, *stateKey, roomID, r); resp != nil {
@@ -168,6 +185,23 @@ func SendEvent(
 		}
 	}
 
+	// Ask the policy module about the event. Soft-failed events get the same
+	// treatment as events from shadow-banned users.
+	headered := e.Headered(verRes.RoomVersion)
+	switch decision := checker.CheckEvent(req.Context(), policy.OriginClient, headered); decision.Action {
+	case policy.ActionReject:
+		return decision.RejectResponse()
+	case policy.ActionSoftFail:
+		res := util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: sendEventResponse{e.EventID()},
+		}
+		if txnID != nil {
+			txnCache.AddTransaction(device.AccessToken, *txnID, &res)
+		}
+		return res
+	}
+
 	var txnAndSessionID *api.TransactionID
 	if txnID != nil {
 		txnAndSessionID = &api.TransactionID{
@@ -182,9 +216,7 @@ func SendEvent(
 	if err := api.SendEvents(
 		req.Context(), rsAPI,
 		api.KindNew,
-		[]*gomatrixserverlib.HeaderedEvent{
-			e.Headered(verRes.RoomVersion),
-		},
+		[]*gomatrixserverlib.HeaderedEvent{headered},
 		cfg.Matrix.ServerName,
 		cfg.Matrix.ServerName,
 		txnAndSessionID,
@@ -217,6 +249,17 @@ func SendEvent(
 	return res
 }
 
+// shadowBannedEventID returns a random event ID in the same format as the
+// reference hash event IDs used by room versions 4 onwards, so that responses
+// to shadow-banned users are indistinguishable from real ones.
+func shadowBannedEventID() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return "$" + base64.RawURLEncoding.EncodeToString(b)
+}
+
 // stateEqual compares the new and the existing state event content. If they are equal, returns a *util.JSONResponse
 // with the existing event_id, making this an idempotent request.
 func stateEqual(ctx context.Context, rsAPI api.ClientRoomserverAPI, eventType, stateKey, roomID string, newContent map[string]interface{}) *util.JSONResponse {
@@ -0,0 +1,163 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+
+	"github.com/matrix-org/dendrite/internal/policy"
+	"github.com/matrix-org/dendrite/internal/transactions"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/test"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+// shadowBanRoomserverAPI fails the test if anything is ever sent into a room.
+type shadowBanRoomserverAPI struct {
+	roomserverAPI.ClientRoomserverAPI
+	t    *testing.T
+	room *test.Room
+}
+
+func (r *shadowBanRoomserverAPI) QueryRoomVersionForRoom(ctx context.Context, req *roomserverAPI.QueryRoomVersionForRoomRequest, res *roomserverAPI.QueryRoomVersionForRoomResponse) error {
+	res.RoomVersion = r.room.Version
+	return nil
+}
+
+func (r *shadowBanRoomserverAPI) QueryCurrentState(ctx context.Context, req *roomserverAPI.QueryCurrentStateRequest, res *roomserverAPI.QueryCurrentStateResponse) error {
+	res.StateEvents = map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent{}
+	for _, ev := range r.room.CurrentState() {
+		for _, tuple := range req.StateTuples {
+			if ev.Type() == tuple.EventType && ev.StateKeyEquals(tuple.StateKey) {
+				res.StateEvents[tuple] = ev
+			}
+		}
+	}
+	return nil
+}
+
+func (r *shadowBanRoomserverAPI) InputRoomEvents(ctx context.Context, req *roomserverAPI.InputRoomEventsRequest, res *roomserverAPI.InputRoomEventsResponse) error {
+	for _, ire := range req.InputRoomEvents {
+		if ire.Event.RoomID() == r.room.ID {
+			r.t.Errorf("event %s from a shadow-banned user was sent to the roomserver", ire.Event.EventID())
+		}
+	}
+	return nil
+}
+
+func (r *shadowBanRoomserverAPI) PerformInvite(ctx context.Context, req *roomserverAPI.PerformInviteRequest, res *roomserverAPI.PerformInviteResponse) error {
+	r.t.Errorf("invite from a shadow-banned user was sent to the roomserver")
+	return nil
+}
+
+type shadowBanUserAPI struct {
+	userapi.ClientUserAPI
+}
+
+func (u *shadowBanUserAPI) QueryProfile(ctx context.Context, req *userapi.QueryProfileRequest, res *userapi.QueryProfileResponse) error {
+	res.UserExists = true
+	return nil
+}
+
+func TestShadowBannedSendPaths(t *testing.T) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	device := &userapi.Device{
+		ID:           "ALICEDEVICE",
+		UserID:       alice.ID,
+		AccessToken:  "alice_access_token",
+		ShadowBanned: true,
+	}
+	cfg := &config.ClientAPI{
+		Matrix: &config.Global{
+			ServerName: "test",
+			KeyID:      "ed25519:test",
+			PrivateKey: test.PrivateKeyA,
+		},
+	}
+	rsAPI := &shadowBanRoomserverAPI{t: t, room: room}
+	userAPI := &shadowBanUserAPI{}
+	txnCache := transactions.New()
+
+	t.Run("SendEvent", func(t *testing.T) {
+		txnID := "txn1"
+		req := test.NewRequest(t, http.MethodPut, "/", test.WithJSONBody(t, map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "spam",
+		}))
+		res := SendEvent(req, device, room.ID, "m.room.message", &txnID, nil, cfg, rsAPI, txnCache, policy.AllowAll{})
+		if res.Code != http.StatusOK {
+			t.Fatalf("expected HTTP 200, got %d: %+v", res.Code, res.JSON)
+		}
+		eventID := res.JSON.(sendEventResponse).EventID
+		if !strings.HasPrefix(eventID, "$") || len(eventID) != 44 {
+			t.Fatalf("expected a plausible event ID, got %q", eventID)
+		}
+		// Retrying the same transaction should return the same event ID.
+		req = test.NewRequest(t, http.MethodPut, "/", test.WithJSONBody(t, map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "spam",
+		}))
+		res = SendEvent(req, device, room.ID, "m.room.message", &txnID, nil, cfg, rsAPI, txnCache, policy.AllowAll{})
+		if got := res.JSON.(sendEventResponse).EventID; got != eventID {
+			t.Fatalf("expected retried transaction to return %q, got %q", eventID, got)
+		}
+	})
+
+	t.Run("SendEvent state", func(t *testing.T) {
+		stateKey := ""
+		req := test.NewRequest(t, http.MethodPut, "/", test.WithJSONBody(t, map[string]interface{}{
+			"name": "spam room",
+		}))
+		res := SendEvent(req, device, room.ID, "m.room.name", nil, &stateKey, cfg, rsAPI, txnCache, policy.AllowAll{})
+		if res.Code != http.StatusOK {
+			t.Fatalf("expected HTTP 200, got %d: %+v", res.Code, res.JSON)
+		}
+	})
+
+	t.Run("SendInvite", func(t *testing.T) {
+		req := test.NewRequest(t, http.MethodPost, "/", test.WithJSONBody(t, map[string]interface{}{
+			"user_id": bob.ID,
+		}))
+		res := SendInvite(req, userAPI, device, room.ID, cfg, rsAPI, nil, policy.AllowAll{})
+		if res.Code != http.StatusOK {
+			t.Fatalf("expected HTTP 200, got %d: %+v", res.Code, res.JSON)
+		}
+	})
+
+	t.Run("createRoom invites", func(t *testing.T) {
+		res := createRoom(context.Background(), createRoomRequest{
+			Invite: []string{bob.ID},
+		}, device, cfg, userAPI, rsAPI, nil, time.Now())
+		if res.Code != http.StatusOK {
+			t.Fatalf("expected HTTP 200, got %d: %+v", res.Code, res.JSON)
+		}
+	})
+
+	t.Run("SendTyping", func(t *testing.T) {
+		req := test.NewRequest(t, http.MethodPut, "/", test.WithJSONBody(t, map[string]interface{}{
+			"typing":  true,
+			"timeout": 30000,
+		}))
+		// A nil producer will panic if the typing notification is sent.
+		res := SendTyping(req, device, room.ID, alice.ID, rsAPI, nil)
+		if res.Code != http.StatusOK {
+			t.Fatalf("expected HTTP 200, got %d: %+v", res.Code, res.JSON)
+		}
+	})
+
+	t.Run("SetReceipt", func(t *testing.T) {
+		req := test.NewRequest(t, http.MethodPost, "/")
+		// A nil producer will panic if the receipt is sent.
+		res := SetReceipt(req, nil, device, room.ID, "m.read", room.Events()[0].EventID())
+		if res.Code != http.StatusOK {
+			t.Fatalf("expected HTTP 200, got %d: %+v", res.Code, res.JSON)
+		}
+	})
+}
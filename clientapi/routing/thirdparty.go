@@ -0,0 +1,118 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/matrix-org/util"
+
+	appserviceAPI "github.com/matrix-org/dendrite/appservice/api"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+)
+
+// Protocols implements
+//
+//	GET /thirdparty/protocols
+//	GET /thirdparty/protocol/{protocol}
+func Protocols(req *http.Request, asAPI appserviceAPI.AppServiceInternalAPI, protocol string) util.JSONResponse {
+	var res appserviceAPI.ProtocolResponse
+	if err := asAPI.Protocols(req.Context(), &appserviceAPI.ProtocolRequest{Protocol: protocol}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("asAPI.Protocols failed")
+		return jsonerror.InternalServerError()
+	}
+	if protocol == "" {
+		if res.Protocols == nil {
+			res.Protocols = map[string]appserviceAPI.ASProtocolResponse{}
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: res.Protocols,
+		}
+	}
+	if !res.Exists {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("The protocol is unknown."),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res.Protocols[protocol],
+	}
+}
+
+// Locations implements
+//
+//	GET /thirdparty/location
+//	GET /thirdparty/location/{protocol}
+func Locations(req *http.Request, asAPI appserviceAPI.AppServiceInternalAPI, protocol string) util.JSONResponse {
+	var res appserviceAPI.LocationResponse
+	if err := asAPI.Locations(req.Context(), &appserviceAPI.LocationRequest{
+		Protocol: protocol,
+		Params:   thirdPartyParams(req),
+	}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("asAPI.Locations failed")
+		return jsonerror.InternalServerError()
+	}
+	if !res.Exists {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("No portal rooms were found."),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res.Locations,
+	}
+}
+
+// User implements
+//
+//	GET /thirdparty/user
+//	GET /thirdparty/user/{protocol}
+func User(req *http.Request, asAPI appserviceAPI.AppServiceInternalAPI, protocol string) util.JSONResponse {
+	var res appserviceAPI.UserResponse
+	if err := asAPI.User(req.Context(), &appserviceAPI.UserRequest{
+		Protocol: protocol,
+		Params:   thirdPartyParams(req),
+	}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("asAPI.User failed")
+		return jsonerror.InternalServerError()
+	}
+	if !res.Exists {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("The Matrix User ID was not found."),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res.Users,
+	}
+}
+
+// thirdPartyParams returns the query string of the request, which is passed on to
+// the application services, without the access token of the client.
+func thirdPartyParams(req *http.Request) string {
+	params := url.Values{}
+	for key, values := range req.URL.Query() {
+		if key != "access_token" {
+			params[key] = values
+		}
+	}
+	return params.Encode()
+}
@@ -15,12 +15,17 @@
 package routing
 
 import (
+	"context"
 	"net/http"
+	"net/mail"
+	"net/url"
+	"regexp"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/clientapi/threepid"
+	"github.com/matrix-org/dendrite/internal/email"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/userapi/api"
 	userdb "github.com/matrix-org/dendrite/userapi/storage"
@@ -30,9 +35,19 @@ import (
 )
 
 type reqTokenResponse struct {
-	SID string `json:"sid"`
+	SID       string `json:"sid"`
+	SubmitURL string `json:"submit_url,omitempty"`
 }
 
+type submitTokenRequest struct {
+	SID          string `json:"sid"`
+	ClientSecret string `json:"client_secret"`
+	Token        string `json:"token"`
+}
+
+// validClientSecretRegex matches the client secrets allowed by the spec.
+var validClientSecretRegex = regexp.MustCompile(`^[0-9a-zA-Z.=_-]{1,255}$`)
+
 type threePIDsResponse struct {
 	ThreePIDs []authtypes.ThreePID `json:"threepids"`
 }
@@ -41,7 +56,16 @@ type threePIDsResponse struct {
 //
 //	POST /account/3pid/email/requestToken
 //	POST /register/email/requestToken
-func RequestEmailToken(req *http.Request, threePIDAPI api.ClientUserAPI, cfg *config.ClientAPI) util.JSONResponse {
+//	POST /account/password/email/requestToken
+//
+// If sending emails is enabled, the tokens for adding an email address and
+// for password resets are sent by Dendrite itself, otherwise a session is
+// created on the given identity server. Registration doesn't accept emails
+// validated by Dendrite, so the identity server is always used for it.
+func RequestEmailToken(
+	req *http.Request, threePIDAPI api.ClientUserAPI, cfg *config.ClientAPI,
+	mailer *threepid.Mailer, path string,
+) util.JSONResponse {
 	var body threepid.EmailAssociationRequest
 	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
 		return *reqErr
@@ -50,6 +74,11 @@ func RequestEmailToken(req *http.Request, threePIDAPI api.ClientUserAPI, cfg *co
 	var resp reqTokenResponse
 	var err error
 
+	kind := email.TemplateAddThreePID
+	if path == "account/password" {
+		kind = email.TemplatePasswordReset
+	}
+
 	// Check if the 3PID is already in use locally
 	res := &api.QueryLocalpartForThreePIDResponse{}
 	err = threePIDAPI.QueryLocalpartForThreePID(req.Context(), &api.QueryLocalpartForThreePIDRequest{
@@ -62,7 +91,24 @@ func RequestEmailToken(req *http.Request, threePIDAPI api.ClientUserAPI, cfg *co
 		return jsonerror.InternalServerError()
 	}
 
-	if len(res.Localpart) > 0 {
+	if kind == email.TemplatePasswordReset {
+		// Password resets are only possible for 3PIDs which are in use
+		if len(res.Localpart) == 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.MatrixError{
+					ErrCode: "M_THREEPID_NOT_FOUND",
+					Err:     "Email address not found",
+				},
+			}
+		}
+		if !cfg.Matrix.Email.Enabled {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.Unknown("Email-based password resets are disabled on this server"),
+			}
+		}
+	} else if len(res.Localpart) > 0 {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
 			JSON: jsonerror.MatrixError{
@@ -72,6 +118,10 @@ func RequestEmailToken(req *http.Request, threePIDAPI api.ClientUserAPI, cfg *co
 		}
 	}
 
+	if cfg.Matrix.Email.Enabled && path != "register" {
+		return requestEmailTokenLocally(req, threePIDAPI, mailer, kind, &body)
+	}
+
 	resp.SID, err = threepid.CreateSession(req.Context(), body, cfg)
 	if err == threepid.ErrNotTrusted {
 		return util.JSONResponse{
@@ -89,6 +139,181 @@ func RequestEmailToken(req *http.Request, threePIDAPI api.ClientUserAPI, cfg *co
 	}
 }
 
+// requestEmailTokenLocally creates a validation session and emails the
+// validation token to the user, unless it was already sent for this attempt.
+func requestEmailTokenLocally(
+	req *http.Request, threePIDAPI api.ClientUserAPI, mailer *threepid.Mailer,
+	kind string, body *threepid.EmailAssociationRequest,
+) util.JSONResponse {
+	if !validClientSecretRegex.MatchString(body.Secret) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("Invalid client_secret"),
+		}
+	}
+	if addr, err := mail.ParseAddress(body.Email); err != nil || addr.Address != body.Email {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("Invalid email address"),
+		}
+	}
+	if body.NextLink != "" {
+		if u, err := url.Parse(body.NextLink); err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidParam("Invalid next_link"),
+			}
+		}
+	}
+
+	createRes := &api.PerformThreePIDSessionCreationResponse{}
+	if err := threePIDAPI.PerformThreePIDSessionCreation(req.Context(), &api.PerformThreePIDSessionCreationRequest{
+		ClientSecret: body.Secret,
+		Medium:       "email",
+		Address:      body.Email,
+		SendAttempt:  body.SendAttempt,
+		NextLink:     body.NextLink,
+	}, createRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("threePIDAPI.PerformThreePIDSessionCreation failed")
+		return jsonerror.InternalServerError()
+	}
+
+	if createRes.Send {
+		if err := mailer.SendValidationToken(
+			req.Context(), kind, body.Email, createRes.SessionID, body.Secret, createRes.Token,
+		); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("mailer.SendValidationToken failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: reqTokenResponse{
+			SID:       createRes.SessionID,
+			SubmitURL: mailer.SubmitURL(kind),
+		},
+	}
+}
+
+// submitTokenPageTemplate is shown when the link in a validation email is
+// followed. The next_link given when requesting the token is shown as a link
+// rather than redirected to, so that the homeserver can't be used to redirect
+// to arbitrary sites.
+const submitTokenPageTemplate = `
+<html>
+<head>
+<title>Email address validated</title>
+<meta name='viewport' content='width=device-width, initial-scale=1,
+    user-scalable=no, minimum-scale=1.0, maximum-scale=1.0'>
+</head>
+<body>
+    <div>
+        <p>Your email address has been validated.</p>
+        {{if .nextLink}}<p><a href="{{.nextLink}}">Continue</a></p>
+        {{else}}<p>You may now close this window and return to the application.</p>{{end}}
+    </div>
+</body>
+</html>
+`
+
+// SubmitEmailToken implements:
+//
+//	POST /unstable/{add_threepid|password_reset}/email/submit_token
+func SubmitEmailToken(req *http.Request, threePIDAPI api.ClientUserAPI) util.JSONResponse {
+	var body submitTokenRequest
+	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
+		return *reqErr
+	}
+	res, errRes := submitEmailToken(req, threePIDAPI, body)
+	if errRes != nil {
+		return *errRes
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct {
+			Success bool `json:"success"`
+		}{
+			Success: res.Validated,
+		},
+	}
+}
+
+// SubmitEmailTokenPage implements:
+//
+//	GET /unstable/{add_threepid|password_reset}/email/submit_token
+//
+// This is used by the link in the validation email, and shows a page with a
+// link to the next_link given when requesting the token, if any.
+func SubmitEmailTokenPage(w http.ResponseWriter, req *http.Request, threePIDAPI api.ClientUserAPI) *util.JSONResponse {
+	query := req.URL.Query()
+	res, errRes := submitEmailToken(req, threePIDAPI, submitTokenRequest{
+		SID:          query.Get("sid"),
+		ClientSecret: query.Get("client_secret"),
+		Token:        query.Get("token"),
+	})
+	if errRes != nil {
+		return errRes
+	}
+	if !res.Validated {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MatrixError{
+				ErrCode: "M_THREEPID_AUTH_FAILED",
+				Err:     "Invalid or expired token",
+			},
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	serveTemplate(w, submitTokenPageTemplate, map[string]string{
+		"nextLink": res.NextLink,
+	})
+	return nil
+}
+
+// submitEmailToken validates the session with the token, returning an error
+// response if the request is incomplete or the validation failed.
+func submitEmailToken(
+	req *http.Request, threePIDAPI api.ClientUserAPI, body submitTokenRequest,
+) (*api.PerformThreePIDSessionValidationResponse, *util.JSONResponse) {
+	if body.SID == "" || body.ClientSecret == "" || body.Token == "" {
+		return nil, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("sid, client_secret and token are required"),
+		}
+	}
+
+	res := &api.PerformThreePIDSessionValidationResponse{}
+	if err := threePIDAPI.PerformThreePIDSessionValidation(req.Context(), &api.PerformThreePIDSessionValidationRequest{
+		SessionID:    body.SID,
+		ClientSecret: body.ClientSecret,
+		Token:        body.Token,
+	}, res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("threePIDAPI.PerformThreePIDSessionValidation failed")
+		resErr := jsonerror.InternalServerError()
+		return nil, &resErr
+	}
+	return res, nil
+}
+
+// queryValidatedThreePIDSession returns the validation session created by
+// Dendrite itself for the credentials, or nil if it hasn't been validated.
+func queryValidatedThreePIDSession(
+	ctx context.Context, threePIDAPI api.ClientUserAPI, creds threepid.Credentials,
+) (*api.ThreePIDSession, error) {
+	res := &api.QueryThreePIDSessionResponse{}
+	if err := threePIDAPI.QueryThreePIDSession(ctx, &api.QueryThreePIDSessionRequest{
+		SessionID:    creds.SID,
+		ClientSecret: creds.Secret,
+	}, res); err != nil {
+		return nil, err
+	}
+	if res.Session == nil || !res.Session.Validated() {
+		return nil, nil
+	}
+	return res.Session, nil
+}
+
 // CheckAndSave3PIDAssociation implements POST /account/3pid
 func CheckAndSave3PIDAssociation(
 	req *http.Request, threePIDAPI api.ClientUserAPI, device *api.Device,
@@ -99,6 +324,11 @@ func CheckAndSave3PIDAssociation(
 		return *reqErr
 	}
 
+	// Sessions created by Dendrite itself don't have an identity server
+	if body.Creds.IDServer == "" && cfg.Matrix.Email.Enabled {
+		return saveLocallyValidated3PIDAssociation(req, threePIDAPI, device, body.Creds)
+	}
+
 	// Check if the association has been validated
 	verified, address, medium, err := threepid.CheckAssociation(req.Context(), body.Creds, cfg)
 	if err == threepid.ErrNotTrusted {
@@ -157,6 +387,53 @@ func CheckAndSave3PIDAssociation(
 	}
 }
 
+// saveLocallyValidated3PIDAssociation saves the association of a 3PID which
+// was validated by Dendrite itself, and removes the now used session.
+func saveLocallyValidated3PIDAssociation(
+	req *http.Request, threePIDAPI api.ClientUserAPI, device *api.Device, creds threepid.Credentials,
+) util.JSONResponse {
+	session, err := queryValidatedThreePIDSession(req.Context(), threePIDAPI, creds)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("queryValidatedThreePIDSession failed")
+		return jsonerror.InternalServerError()
+	}
+	if session == nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MatrixError{
+				ErrCode: "M_THREEPID_AUTH_FAILED",
+				Err:     "Failed to auth 3pid",
+			},
+		}
+	}
+
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+
+	if err = threePIDAPI.PerformSaveThreePIDAssociation(req.Context(), &api.PerformSaveThreePIDAssociationRequest{
+		ThreePID:  session.Address,
+		Localpart: localpart,
+		Medium:    session.Medium,
+	}, &struct{}{}); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("threePIDAPI.PerformSaveThreePIDAssociation failed")
+		return jsonerror.InternalServerError()
+	}
+
+	if err = threePIDAPI.PerformThreePIDSessionDeletion(req.Context(), &api.PerformThreePIDSessionDeletionRequest{
+		SessionID: session.SessionID,
+	}, &struct{}{}); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("threePIDAPI.PerformThreePIDSessionDeletion failed")
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
 // GetAssociated3PIDs implements GET /account/3pid
 func GetAssociated3PIDs(
 	req *http.Request, threepidAPI api.ClientUserAPI, device *api.Device,
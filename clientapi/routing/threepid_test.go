@@ -0,0 +1,200 @@
+package routing
+
+import (
+	"context"
+	"io"
+	"mime/quotedprintable"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/threepid"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/test"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+// threePIDUserAPI keeps a single 3PID validation session in memory.
+type threePIDUserAPI struct {
+	userapi.ClientUserAPI
+	session         *userapi.ThreePIDSession
+	updatedPassword map[string]string
+	loggedOut       []string
+}
+
+func (u *threePIDUserAPI) QueryLocalpartForThreePID(ctx context.Context, req *userapi.QueryLocalpartForThreePIDRequest, res *userapi.QueryLocalpartForThreePIDResponse) error {
+	if req.ThreePID == "alice@example.com" && req.Medium == "email" {
+		res.Localpart = "alice"
+	}
+	return nil
+}
+
+func (u *threePIDUserAPI) PerformThreePIDSessionCreation(ctx context.Context, req *userapi.PerformThreePIDSessionCreationRequest, res *userapi.PerformThreePIDSessionCreationResponse) error {
+	u.session = &userapi.ThreePIDSession{
+		SessionID:    "sid",
+		ClientSecret: req.ClientSecret,
+		Medium:       req.Medium,
+		Address:      req.Address,
+		Token:        "abcdef",
+		SendAttempt:  req.SendAttempt,
+		NextLink:     req.NextLink,
+	}
+	res.SessionID, res.Token, res.Send = "sid", "abcdef", true
+	return nil
+}
+
+func (u *threePIDUserAPI) PerformThreePIDSessionValidation(ctx context.Context, req *userapi.PerformThreePIDSessionValidationRequest, res *userapi.PerformThreePIDSessionValidationResponse) error {
+	if u.session != nil && req.SessionID == u.session.SessionID && req.ClientSecret == u.session.ClientSecret && req.Token == u.session.Token {
+		u.session.ValidatedAt = 1
+		res.Validated, res.NextLink = true, u.session.NextLink
+	}
+	return nil
+}
+
+func (u *threePIDUserAPI) QueryThreePIDSession(ctx context.Context, req *userapi.QueryThreePIDSessionRequest, res *userapi.QueryThreePIDSessionResponse) error {
+	if u.session != nil && req.SessionID == u.session.SessionID && req.ClientSecret == u.session.ClientSecret {
+		session := *u.session
+		res.Session = &session
+	}
+	return nil
+}
+
+func (u *threePIDUserAPI) PerformThreePIDSessionDeletion(ctx context.Context, req *userapi.PerformThreePIDSessionDeletionRequest, res *struct{}) error {
+	u.session = nil
+	return nil
+}
+
+func (u *threePIDUserAPI) PerformPasswordUpdate(ctx context.Context, req *userapi.PerformPasswordUpdateRequest, res *userapi.PerformPasswordUpdateResponse) error {
+	u.updatedPassword[req.Localpart] = req.Password
+	res.PasswordUpdated = true
+	return nil
+}
+
+func (u *threePIDUserAPI) PerformDeviceDeletion(ctx context.Context, req *userapi.PerformDeviceDeletionRequest, res *userapi.PerformDeviceDeletionResponse) error {
+	u.loggedOut = append(u.loggedOut, req.UserID)
+	return nil
+}
+
+func (u *threePIDUserAPI) PerformPusherDeletion(ctx context.Context, req *userapi.PerformPusherDeletionRequest, res *struct{}) error {
+	return nil
+}
+
+var emailTokenRegex = regexp.MustCompile(`token=([a-z]+)`)
+
+func TestPasswordResetByEmail(t *testing.T) {
+	smtpServer := test.NewSMTPServer(t)
+	cfg := &config.ClientAPI{
+		Matrix: &config.Global{
+			ServerName: "test",
+			Email: config.Email{
+				Enabled:       true,
+				From:          "noreply@test",
+				SMTPHost:      smtpServer.Addr,
+				PublicBaseURL: "https://test",
+			},
+		},
+	}
+	mailer, err := threepid.NewMailer(cfg.Matrix)
+	if err != nil {
+		t.Fatalf("failed to create mailer: %s", err)
+	}
+	userAPI := &threePIDUserAPI{updatedPassword: map[string]string{}}
+
+	t.Run("unknown email address is rejected", func(t *testing.T) {
+		req := test.NewRequest(t, http.MethodPost, "/", test.WithJSONBody(t, map[string]interface{}{
+			"client_secret": "secret",
+			"email":         "bob@example.com",
+			"send_attempt":  1,
+		}))
+		res := RequestEmailToken(req, userAPI, cfg, mailer, "account/password")
+		if res.Code != http.StatusBadRequest {
+			t.Fatalf("expected HTTP 400, got %d: %+v", res.Code, res.JSON)
+		}
+		if len(smtpServer.Messages()) != 0 {
+			t.Fatalf("expected no email to be sent")
+		}
+	})
+
+	req := test.NewRequest(t, http.MethodPost, "/", test.WithJSONBody(t, map[string]interface{}{
+		"client_secret": "secret",
+		"email":         "alice@example.com",
+		"send_attempt":  1,
+		"next_link":     "https://client.example.com/reset?a=1&b=2",
+	}))
+	res := RequestEmailToken(req, userAPI, cfg, mailer, "account/password")
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected HTTP 200, got %d: %+v", res.Code, res.JSON)
+	}
+	if resp := res.JSON.(reqTokenResponse); resp.SID != "sid" || resp.SubmitURL != "https://test/_matrix/client/unstable/password_reset/email/submit_token" {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+
+	// Find the token in the email sent to the user.
+	messages := smtpServer.Messages()
+	if len(messages) != 1 || messages[0].To[0] != "alice@example.com" {
+		t.Fatalf("expected an email to alice@example.com, got %+v", messages)
+	}
+	body, err := io.ReadAll(quotedprintable.NewReader(strings.NewReader(messages[0].Data)))
+	if err != nil {
+		t.Fatalf("failed to decode email: %s", err)
+	}
+	match := emailTokenRegex.FindStringSubmatch(string(body))
+	if match == nil {
+		t.Fatalf("expected email to contain a token:\n%s", body)
+	}
+
+	resetReq := map[string]interface{}{
+		"new_password": "my new password",
+		"auth": map[string]interface{}{
+			"type": "m.login.email.identity",
+			"threepid_creds": map[string]interface{}{
+				"sid":           "sid",
+				"client_secret": "secret",
+			},
+		},
+	}
+
+	t.Run("password can't be reset before validating the email address", func(t *testing.T) {
+		res := PasswordReset(test.NewRequest(t, http.MethodPost, "/", test.WithJSONBody(t, resetReq)), userAPI, cfg)
+		if res.Code != http.StatusUnauthorized {
+			t.Fatalf("expected HTTP 401, got %d: %+v", res.Code, res.JSON)
+		}
+	})
+
+	req = test.NewRequest(t, http.MethodGet, "/", test.WithQueryParams(map[string]string{
+		"sid":           "sid",
+		"client_secret": "secret",
+		"token":         match[1],
+	}))
+	rec := httptest.NewRecorder()
+	if errRes := SubmitEmailTokenPage(rec, req, userAPI); errRes != nil {
+		t.Fatalf("expected the token to be accepted, got %d: %+v", errRes.Code, errRes.JSON)
+	}
+	// The next_link is shown as a link on the page, rather than redirected to.
+	if rec.Code != http.StatusOK || rec.Header().Get("Location") != "" {
+		t.Fatalf("expected HTTP 200 without a redirect, got %d", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), `href="https://client.example.com/reset?a=1&amp;b=2"`) {
+		t.Fatalf("expected the page to link to the next_link:\n%s", rec.Body.String())
+	}
+
+	res = PasswordReset(test.NewRequest(t, http.MethodPost, "/", test.WithJSONBody(t, resetReq)), userAPI, cfg)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected HTTP 200, got %d: %+v", res.Code, res.JSON)
+	}
+	if userAPI.updatedPassword["alice"] != "my new password" {
+		t.Fatalf("expected password of alice to be updated")
+	}
+	if len(userAPI.loggedOut) != 1 || userAPI.loggedOut[0] != "@alice:test" {
+		t.Fatalf("expected all devices of alice to be logged out, got %v", userAPI.loggedOut)
+	}
+
+	t.Run("session can't be used twice", func(t *testing.T) {
+		res := PasswordReset(test.NewRequest(t, http.MethodPost, "/", test.WithJSONBody(t, resetReq)), userAPI, cfg)
+		if res.Code != http.StatusUnauthorized {
+			t.Fatalf("expected HTTP 401, got %d: %+v", res.Code, res.JSON)
+		}
+	})
+}
@@ -16,15 +16,10 @@ package routing
 
 import (
 	"context"
-	"database/sql"
 	"fmt"
-	"net/http"
-	"strings"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
-	"github.com/matrix-org/dendrite/roomserver/api"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
-	"github.com/matrix-org/gomatrix"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 )
@@ -34,102 +29,75 @@ type UserDirectoryResponse struct {
 	Limited bool                              `json:"limited"`
 }
 
+// SearchUserDirectory searches the user directory, which contains the users
+// who share a room with the searching user or are in public rooms. If an
+// extra provider is given, such as in the P2P demos, its results are added
+// after those from the user directory.
 func SearchUserDirectory(
 	ctx context.Context,
 	device *userapi.Device,
-	rsAPI api.ClientRoomserverAPI,
+	userAPI userapi.ClientUserAPI,
 	provider userapi.QuerySearchProfilesAPI,
 	searchString string,
 	limit int,
-	federation *gomatrixserverlib.FederationClient,
 	localServerName gomatrixserverlib.ServerName,
 ) util.JSONResponse {
 	if limit < 10 {
 		limit = 10
 	}
 
-	results := map[string]authtypes.FullyQualifiedProfile{}
-	response := &UserDirectoryResponse{
-		Results: []authtypes.FullyQualifiedProfile{},
-		Limited: false,
+	searchReq := &userapi.QuerySearchUserDirectoryRequest{
+		UserID:       device.UserID,
+		SearchString: searchString,
+		Limit:        limit,
 	}
-
-	// Get users we share a room with
-	knownUsersReq := &api.QueryKnownUsersRequest{
-		UserID: device.UserID,
-		Limit:  limit,
+	searchRes := &userapi.QuerySearchUserDirectoryResponse{}
+	if err := userAPI.QuerySearchUserDirectory(ctx, searchReq, searchRes); err != nil {
+		return util.ErrorResponse(fmt.Errorf("userAPI.QuerySearchUserDirectory: %w", err))
+	}
+	response := &UserDirectoryResponse{
+		Results: searchRes.Results,
+		Limited: searchRes.Limited,
 	}
-	knownUsersRes := &api.QueryKnownUsersResponse{}
-	if err := rsAPI.QueryKnownUsers(ctx, knownUsersReq, knownUsersRes); err != nil && err != sql.ErrNoRows {
-		return util.ErrorResponse(fmt.Errorf("rsAPI.QueryKnownUsers: %w", err))
+	if response.Results == nil {
+		response.Results = []authtypes.FullyQualifiedProfile{}
 	}
 
-knownUsersLoop:
-	for _, profile := range knownUsersRes.Users {
-		if len(results) == limit {
-			response.Limited = true
-			break
+	if provider != nil && !response.Limited {
+		providerReq := &userapi.QuerySearchProfilesRequest{
+			SearchString: searchString,
+			Limit:        limit,
 		}
-		userID := profile.UserID
-		// get the full profile of the local user
-		localpart, serverName, _ := gomatrixserverlib.SplitID('@', userID)
-		if serverName == localServerName {
-			userReq := &userapi.QuerySearchProfilesRequest{
-				SearchString: localpart,
-				Limit:        limit,
-			}
-			userRes := &userapi.QuerySearchProfilesResponse{}
-			if err := provider.QuerySearchProfiles(ctx, userReq, userRes); err != nil {
-				return util.ErrorResponse(fmt.Errorf("userAPI.QuerySearchProfiles: %w", err))
-			}
-			for _, p := range userRes.Profiles {
-				if strings.Contains(p.DisplayName, searchString) ||
-					strings.Contains(p.Localpart, searchString) {
-					profile.DisplayName = p.DisplayName
-					profile.AvatarURL = p.AvatarURL
-					results[userID] = profile
-					if len(results) == limit {
-						response.Limited = true
-						break knownUsersLoop
-					}
-				}
+		providerRes := &userapi.QuerySearchProfilesResponse{}
+		if err := provider.QuerySearchProfiles(ctx, providerReq, providerRes); err != nil {
+			return util.ErrorResponse(fmt.Errorf("provider.QuerySearchProfiles: %w", err))
+		}
+		found := make(map[string]struct{}, len(response.Results))
+		for _, profile := range response.Results {
+			found[profile.UserID] = struct{}{}
+		}
+		for _, profile := range providerRes.Profiles {
+			serverName := gomatrixserverlib.ServerName(profile.ServerName)
+			if serverName == "" {
+				serverName = localServerName
 			}
-		} else {
-			// If the username already contains the search string, don't bother hitting federation.
-			// This will result in missing avatars and displaynames, but saves the federation roundtrip.
-			if strings.Contains(localpart, searchString) {
-				results[userID] = profile
-				if len(results) == limit {
-					response.Limited = true
-					break knownUsersLoop
-				}
+			userID := fmt.Sprintf("@%s:%s", profile.Localpart, serverName)
+			if _, ok := found[userID]; ok {
 				continue
 			}
-			// TODO: We should probably cache/store this
-			fedProfile, fedErr := federation.LookupProfile(ctx, serverName, userID, "")
-			if fedErr != nil {
-				if x, ok := fedErr.(gomatrix.HTTPError); ok {
-					if x.Code == http.StatusNotFound {
-						continue
-					}
-				}
-			}
-			if strings.Contains(fedProfile.DisplayName, searchString) {
-				profile.DisplayName = fedProfile.DisplayName
-				profile.AvatarURL = fedProfile.AvatarURL
-				results[userID] = profile
-				if len(results) == limit {
-					response.Limited = true
-					break knownUsersLoop
-				}
+			if len(response.Results) == limit {
+				response.Limited = true
+				break
 			}
+			found[userID] = struct{}{}
+			response.Results = append(response.Results, authtypes.FullyQualifiedProfile{
+				UserID:      userID,
+				DisplayName: profile.DisplayName,
+				AvatarURL:   profile.AvatarURL,
+			})
 		}
 	}
 
-	for _, result := range results {
-		response.Results = append(response.Results, result)
-	}
-
 	return util.JSONResponse{
 		Code: 200,
 		JSON: response,
@@ -0,0 +1,117 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/matrix-org/util"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+type wellKnownSupportContact struct {
+	MatrixID     string `json:"matrix_id,omitempty"`
+	EmailAddress string `json:"email_address,omitempty"`
+	Role         string `json:"role"`
+}
+
+type wellKnownSupportResponse struct {
+	Contacts    []wellKnownSupportContact `json:"contacts,omitempty"`
+	SupportPage string                    `json:"support_page,omitempty"`
+}
+
+// WellKnownClient implements GET /.well-known/matrix/client, which tells
+// clients where to find the homeserver and related services.
+func WellKnownClient(req *http.Request, cfg *config.Global) util.JSONResponse {
+	document := map[string]interface{}{}
+	for key, value := range cfg.WellKnown.ClientExtra {
+		document[key] = jsonCompatible(value)
+	}
+	document["m.homeserver"] = map[string]string{
+		"base_url": cfg.WellKnownClientName,
+	}
+	if cfg.WellKnown.IdentityServer != "" {
+		document["m.identity_server"] = map[string]string{
+			"base_url": cfg.WellKnown.IdentityServer,
+		}
+	}
+	if cfg.WellKnown.SlidingSyncProxy != "" {
+		document["org.matrix.msc3575.proxy"] = map[string]string{
+			"url": cfg.WellKnown.SlidingSyncProxy,
+		}
+	}
+	return util.JSONResponse{
+		Code:    http.StatusOK,
+		JSON:    document,
+		Headers: wellKnownHeaders(cfg),
+	}
+}
+
+// WellKnownSupport implements GET /.well-known/matrix/support, which tells
+// users and other server admins how to contact the admins of this server.
+func WellKnownSupport(req *http.Request, cfg *config.Global) util.JSONResponse {
+	res := wellKnownSupportResponse{
+		SupportPage: cfg.WellKnown.Support.SupportPage,
+	}
+	for _, contact := range cfg.WellKnown.Support.Contacts {
+		res.Contacts = append(res.Contacts, wellKnownSupportContact{
+			MatrixID:     contact.MatrixID,
+			EmailAddress: contact.EmailAddress,
+			Role:         contact.Role,
+		})
+	}
+	return util.JSONResponse{
+		Code:    http.StatusOK,
+		JSON:    res,
+		Headers: wellKnownHeaders(cfg),
+	}
+}
+
+// wellKnownHeaders returns the headers which allow the documents to be cached.
+// The CORS headers are set for all responses of the external APIs already.
+func wellKnownHeaders(cfg *config.Global) map[string]string {
+	return map[string]string{
+		"Cache-Control": fmt.Sprintf("public, max-age=%d", int(cfg.WellKnown.CacheMaxAge.Seconds())),
+	}
+}
+
+// jsonCompatible converts the maps decoded from the YAML config, which can have
+// keys of any type, to maps which can be encoded as JSON.
+func jsonCompatible(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[fmt.Sprint(key)] = jsonCompatible(value)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[key] = jsonCompatible(value)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, value := range v {
+			s[i] = jsonCompatible(value)
+		}
+		return s
+	default:
+		return value
+	}
+}
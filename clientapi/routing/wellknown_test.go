@@ -0,0 +1,90 @@
+package routing
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/util"
+	"gopkg.in/yaml.v2"
+
+	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+const wellKnownConfig = `
+well_known_client_name: https://matrix.example.com
+well_known:
+  identity_server: https://id.example.com
+  sliding_sync_proxy: https://slidingsync.example.com
+  client_extra:
+    im.vector.riot.jitsi:
+      preferredDomain: jitsi.example.com
+    m.homeserver:
+      base_url: https://ignored.example.com
+  support:
+    contacts:
+      - matrix_id: "@admin:example.com"
+        role: m.role.admin
+      - email_address: security@example.com
+        role: m.role.security
+    support_page: https://example.com/support
+  cache_max_age: 2h
+`
+
+func serveWellKnown(t *testing.T, f func(*http.Request) util.JSONResponse) map[string]interface{} {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	httputil.MakeExternalAPI("wellknown", f).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/.well-known/matrix/client", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+	if got := rec.Header().Get("Cache-Control"); got != "public, max-age=7200" {
+		t.Errorf("unexpected Cache-Control header %q", got)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("unexpected Access-Control-Allow-Origin header %q", got)
+	}
+	var document map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &document); err != nil {
+		t.Fatalf("failed to decode document: %s", err)
+	}
+	return document
+}
+
+func TestWellKnown(t *testing.T) {
+	cfg := &config.Global{}
+	cfg.WellKnown.Defaults()
+	if err := yaml.Unmarshal([]byte(wellKnownConfig), cfg); err != nil {
+		t.Fatalf("failed to parse config: %s", err)
+	}
+
+	client := serveWellKnown(t, func(req *http.Request) util.JSONResponse {
+		return WellKnownClient(req, cfg)
+	})
+	wantClient := map[string]interface{}{
+		"m.homeserver":             map[string]interface{}{"base_url": "https://matrix.example.com"},
+		"m.identity_server":        map[string]interface{}{"base_url": "https://id.example.com"},
+		"org.matrix.msc3575.proxy": map[string]interface{}{"url": "https://slidingsync.example.com"},
+		"im.vector.riot.jitsi":     map[string]interface{}{"preferredDomain": "jitsi.example.com"},
+	}
+	if !reflect.DeepEqual(client, wantClient) {
+		t.Errorf("unexpected client document %+v", client)
+	}
+
+	support := serveWellKnown(t, func(req *http.Request) util.JSONResponse {
+		return WellKnownSupport(req, cfg)
+	})
+	wantSupport := map[string]interface{}{
+		"contacts": []interface{}{
+			map[string]interface{}{"matrix_id": "@admin:example.com", "role": "m.role.admin"},
+			map[string]interface{}{"email_address": "security@example.com", "role": "m.role.security"},
+		},
+		"support_page": "https://example.com/support",
+	}
+	if !reflect.DeepEqual(support, wantSupport) {
+		t.Errorf("unexpected support document %+v", support)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package threepid
+
+import (
+	"context"
+	"net/url"
+	"strings"
+
+	"github.com/matrix-org/dendrite/internal/email"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// Mailer sends emails containing validation tokens, for sessions created by
+// Dendrite itself rather than by an identity server.
+type Mailer struct {
+	cfg       *config.Global
+	sender    email.Sender
+	templates *email.Templates
+}
+
+// NewMailer creates a Mailer which sends emails using the email configuration.
+func NewMailer(cfg *config.Global) (*Mailer, error) {
+	sender, err := email.NewSMTPSender(&cfg.Email)
+	if err != nil {
+		return nil, err
+	}
+	templates, err := email.LoadTemplates(string(cfg.Email.TemplatesPath))
+	if err != nil {
+		return nil, err
+	}
+	return &Mailer{
+		cfg:       cfg,
+		sender:    sender,
+		templates: templates,
+	}, nil
+}
+
+// SubmitURL returns the URL which validation tokens for the given kind of
+// email, e.g. email.TemplatePasswordReset, can be submitted to.
+func (m *Mailer) SubmitURL(kind string) string {
+	return strings.TrimSuffix(m.cfg.Email.PublicBaseURL, "/") + "/_matrix/client/unstable/" + kind + "/email/submit_token"
+}
+
+// SendValidationToken sends an email of the given kind to the address,
+// containing a link which validates the session when followed.
+func (m *Mailer) SendValidationToken(
+	ctx context.Context, kind, address, sessionID, clientSecret, token string,
+) error {
+	query := url.Values{}
+	query.Set("token", token)
+	query.Set("client_secret", clientSecret)
+	query.Set("sid", sessionID)
+	msg, err := m.templates.Render(kind, email.TemplateData{
+		ServerName: string(m.cfg.ServerName),
+		Address:    address,
+		Link:       m.SubmitURL(kind) + "?" + query.Encode(),
+		Token:      token,
+	})
+	if err != nil {
+		return err
+	}
+	msg.To = address
+	return m.sender.Send(ctx, msg)
+}
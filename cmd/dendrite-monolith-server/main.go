@@ -17,6 +17,7 @@ package main
 import (
 	"flag"
 	"os"
+	"strings"
 
 	"github.com/matrix-org/dendrite/appservice"
 	"github.com/matrix-org/dendrite/federationapi"
@@ -35,9 +36,9 @@ import (
 )
 
 var (
-	httpBindAddr   = flag.String("http-bind-address", ":8008", "The HTTP listening port for the server")
+	httpBindAddr   = flag.String("http-bind-address", ":8008", "The HTTP listening port for the server, or a unix socket address like unix:///run/dendrite.sock?mode=0600 (the mode defaults to 0660)")
 	httpsBindAddr  = flag.String("https-bind-address", ":8448", "The HTTPS listening port for the server")
-	apiBindAddr    = flag.String("api-bind-address", "localhost:18008", "The HTTP listening port for the internal HTTP APIs (if -api is enabled)")
+	apiBindAddr    = flag.String("api-bind-address", "localhost:18008", "The HTTP listening port or unix socket address for the internal HTTP APIs (if -api is enabled), unix sockets are created with mode 0660 unless a mode is given")
 	certFile       = flag.String("tls-cert", "", "The PEM formatted X509 certificate to use for TLS")
 	keyFile        = flag.String("tls-key", "", "The PEM private key to use for TLS")
 	enableHTTPAPIs = flag.Bool("api", false, "Use HTTP APIs instead of short-circuiting (warning: exposes API endpoints!)")
@@ -46,13 +47,13 @@ var (
 
 func main() {
 	cfg := setup.ParseFlags(true)
-	httpAddr := config.HTTPAddress("http://" + *httpBindAddr)
+	httpAddr := bindAddress(*httpBindAddr)
 	httpsAddr := config.HTTPAddress("https://" + *httpsBindAddr)
 	httpAPIAddr := httpAddr
 	options := []basepkg.BaseDendriteOptions{}
 	if *enableHTTPAPIs {
 		logrus.Warnf("DANGER! The -api option is enabled, exposing internal APIs on %q!", *apiBindAddr)
-		httpAPIAddr = config.HTTPAddress("http://" + *apiBindAddr)
+		httpAPIAddr = bindAddress(*apiBindAddr)
 		// If the HTTP APIs are enabled then we need to update the Listen
 		// statements in the configuration so that we know where to find
 		// the API endpoints. They'll listen on the same port as the monolith
@@ -119,7 +120,7 @@ func main() {
 	// TODO: This should use userAPI, not userImpl, but the appservice setup races with
 	// the listeners and panics at startup if it tries to create appservice accounts
 	// before the listeners are up.
-	asAPI := appservice.NewInternalAPI(base, userImpl, rsAPI)
+	asAPI := appservice.NewInternalAPI(base, userImpl, rsAPI, keyAPI)
 	if base.UseHTTPAPIs {
 		appservice.AddInternalRoutes(base.InternalAPIMux, asAPI)
 		asAPI = base.AppserviceHTTPClient()
@@ -163,8 +164,12 @@ func main() {
 			nil, nil,    // TLS settings
 		)
 	}()
-	// Handle HTTPS if certificate and key are provided
-	if *certFile != "" && *keyFile != "" {
+	// Handle HTTPS if certificate and key are provided, or if they are
+	// obtained using ACME
+	if cfg.Global.ACME.Enabled || (*certFile != "" && *keyFile != "") {
+		if cfg.Global.ACME.Enabled && *certFile != "" {
+			logrus.Warn("ACME is enabled, ignoring the -tls-cert and -tls-key options")
+		}
 		go func() {
 			base.SetupAndServeHTTP(
 				basepkg.NoListener, // internal API
@@ -177,3 +182,12 @@ func main() {
 	// We want to block forever to let the HTTP and HTTPS handler serve the APIs
 	base.WaitForShutdown()
 }
+
+// bindAddress returns the HTTP address to listen on for the given flag value,
+// which is either a port to listen on or a unix socket address.
+func bindAddress(addr string) config.HTTPAddress {
+	if strings.HasPrefix(addr, "unix://") {
+		return config.HTTPAddress(addr)
+	}
+	return config.HTTPAddress("http://" + addr)
+}
@@ -24,8 +24,9 @@ import (
 func Appservice(base *base.BaseDendrite, cfg *config.Dendrite) {
 	userAPI := base.UserAPIClient()
 	rsAPI := base.RoomserverHTTPClient()
+	keyAPI := base.KeyServerHTTPClient()
 
-	intAPI := appservice.NewInternalAPI(base, userAPI, rsAPI)
+	intAPI := appservice.NewInternalAPI(base, userAPI, rsAPI, keyAPI)
 	appservice.AddInternalRoutes(base.InternalAPIMux, intAPI)
 
 	base.SetupAndServeHTTP(
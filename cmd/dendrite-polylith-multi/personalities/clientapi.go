@@ -32,7 +32,7 @@ func ClientAPI(base *basepkg.BaseDendrite, cfg *config.Dendrite) {
 
 	clientapi.AddPublicRoutes(
 		base, federation, rsAPI, asQuery,
-		transactions.New(), fsAPI, userAPI, userAPI,
+		transactions.New(), fsAPI, userAPI, nil,
 		keyAPI, nil,
 	)
 
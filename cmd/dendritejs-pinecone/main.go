@@ -192,7 +192,7 @@ func startup() {
 	keyAPI.SetUserAPI(userAPI)
 
 	asQuery := appservice.NewInternalAPI(
-		base, userAPI, rsAPI,
+		base, userAPI, rsAPI, keyAPI,
 	)
 	rsAPI.SetAppserviceAPI(asQuery)
 	fedSenderAPI := federationapi.NewInternalAPI(base, federation, rsAPI, base.Caches, keyRing, true)
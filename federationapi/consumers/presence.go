@@ -17,11 +17,15 @@ package consumers
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/matrix-org/dendrite/federationapi/queue"
 	"github.com/matrix-org/dendrite/federationapi/storage"
 	fedTypes "github.com/matrix-org/dendrite/federationapi/types"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/setup/jetstream"
 	"github.com/matrix-org/dendrite/setup/process"
@@ -31,16 +35,22 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-// OutputReceiptConsumer consumes events that originate in the clientapi.
+// How many presence updates are batched into EDUs at once.
+const presenceBatchSize = 100
+
+// OutputPresenceConsumer consumes presence updates and sends those of local
+// users to the servers which share rooms with them.
 type OutputPresenceConsumer struct {
 	ctx                     context.Context
 	jetstream               nats.JetStreamContext
 	durable                 string
 	db                      storage.Database
 	queues                  *queue.OutgoingQueues
+	rsAPI                   roomserverAPI.FederationRoomserverAPI
 	ServerName              gomatrixserverlib.ServerName
 	topic                   string
 	outboundPresenceEnabled bool
+	maxRoomSize             int
 }
 
 // NewOutputPresenceConsumer creates a new OutputPresenceConsumer. Call Start() to begin consuming events.
@@ -50,16 +60,19 @@ func NewOutputPresenceConsumer(
 	js nats.JetStreamContext,
 	queues *queue.OutgoingQueues,
 	store storage.Database,
+	rsAPI roomserverAPI.FederationRoomserverAPI,
 ) *OutputPresenceConsumer {
 	return &OutputPresenceConsumer{
 		ctx:                     process.Context(),
 		jetstream:               js,
 		queues:                  queues,
 		db:                      store,
+		rsAPI:                   rsAPI,
 		ServerName:              cfg.Matrix.ServerName,
 		durable:                 cfg.Matrix.JetStream.Durable("FederationAPIPresenceConsumer"),
 		topic:                   cfg.Matrix.JetStream.Prefixed(jetstream.OutputPresenceEvent),
 		outboundPresenceEnabled: cfg.Matrix.Presence.EnableOutbound,
+		maxRoomSize:             cfg.Matrix.Presence.MaxRoomSize,
 	}
 }
 
@@ -68,40 +81,68 @@ func (t *OutputPresenceConsumer) Start() error {
 	if !t.outboundPresenceEnabled {
 		return nil
 	}
-	return jetstream.JetStreamConsumer(
-		t.ctx, t.jetstream, t.topic, t.durable, t.onMessage,
+	return jetstream.JetStreamBatchConsumer(
+		t.ctx, t.jetstream, t.topic, t.durable, presenceBatchSize, t.onMessages,
 		nats.DeliverAll(), nats.ManualAck(), nats.HeadersOnly(),
 	)
 }
 
-// onMessage is called in response to a message received on the presence
-// events topic from the client api.
-func (t *OutputPresenceConsumer) onMessage(ctx context.Context, msg *nats.Msg) bool {
+// onMessages is called in response to messages received on the presence
+// events topic. The latest presence of each local user in the batch is sent
+// to the servers sharing rooms with them, using a single EDU for all servers
+// that get the presence of the same users.
+func (t *OutputPresenceConsumer) onMessages(ctx context.Context, msgs []*nats.Msg) {
+	updates := map[string]fedTypes.PresenceContent{}
+	for _, msg := range msgs {
+		_, span := jetstream.StartSpan(ctx, msg, t.durable)
+		defer span.End()
+		if content, ok := t.presenceContent(msg); ok {
+			updates[content.UserID] = content
+		}
+	}
+
+	edus, err := t.presenceEDUs(ctx, updates)
+	if err != nil {
+		log.WithError(err).Error("failed to calculate presence EDUs")
+	}
+	for _, edu := range edus {
+		log.Tracef("sending presence EDU to %d servers", len(edu.destinations))
+		if err = t.queues.SendEDU(edu.EDU, t.ServerName, edu.destinations); err != nil {
+			log.WithError(err).Error("failed to send EDU")
+			break
+		}
+	}
+
+	for _, msg := range msgs {
+		if err != nil {
+			if nakErr := msg.Nak(nats.Context(ctx)); nakErr != nil {
+				log.WithError(nakErr).Warn("federationapi presence consumer: msg.Nak failed")
+			}
+			continue
+		}
+		if ackErr := msg.AckSync(nats.Context(ctx)); ackErr != nil {
+			log.WithError(ackErr).Warn("federationapi presence consumer: msg.AckSync failed")
+		}
+	}
+}
+
+// presenceContent returns the presence update in the message, if it is
+// about a local user.
+func (t *OutputPresenceConsumer) presenceContent(msg *nats.Msg) (fedTypes.PresenceContent, bool) {
 	// only send presence events which originated from us
 	userID := msg.Header.Get(jetstream.UserID)
 	_, serverName, err := gomatrixserverlib.SplitID('@', userID)
 	if err != nil {
-		log.WithError(err).WithField("user_id", userID).Error("failed to extract domain from receipt sender")
-		return true
+		log.WithError(err).WithField("user_id", userID).Error("failed to extract domain from presence sender")
+		return fedTypes.PresenceContent{}, false
 	}
 	if serverName != t.ServerName {
-		return true
+		return fedTypes.PresenceContent{}, false
 	}
 
-	presence := msg.Header.Get("presence")
-
 	ts, err := strconv.Atoi(msg.Header.Get("last_active_ts"))
 	if err != nil {
-		return true
-	}
-
-	joined, err := t.db.GetAllJoinedHosts(ctx)
-	if err != nil {
-		log.WithError(err).Error("failed to get joined hosts")
-		return true
-	}
-	if len(joined) == 0 {
-		return true
+		return fedTypes.PresenceContent{}, false
 	}
 
 	var statusMsg *string = nil
@@ -110,34 +151,116 @@ func (t *OutputPresenceConsumer) onMessage(ctx context.Context, msg *nats.Msg) b
 		statusMsg = &status
 	}
 
+	presence := msg.Header.Get("presence")
 	p := types.PresenceInternal{LastActiveTS: gomatrixserverlib.Timestamp(ts)}
+	return fedTypes.PresenceContent{
+		// Only online users can be currently active.
+		CurrentlyActive: presence == types.PresenceOnline.String() && p.CurrentlyActive(),
+		LastActiveAgo:   p.LastActiveAgo(),
+		Presence:        presence,
+		StatusMsg:       statusMsg,
+		UserID:          userID,
+	}, true
+}
 
-	content := fedTypes.Presence{
-		Push: []fedTypes.PresenceContent{
-			{
-				CurrentlyActive: p.CurrentlyActive(),
-				LastActiveAgo:   p.LastActiveAgo(),
-				Presence:        presence,
-				StatusMsg:       statusMsg,
-				UserID:          userID,
-			},
-		},
+type presenceEDU struct {
+	*gomatrixserverlib.EDU
+	destinations []gomatrixserverlib.ServerName
+}
+
+// presenceEDUs returns the EDUs to send the presence updates to the servers
+// sharing rooms with the users. Servers which share rooms with the same
+// users get the same EDU.
+func (t *OutputPresenceConsumer) presenceEDUs(
+	ctx context.Context, updates map[string]fedTypes.PresenceContent,
+) ([]presenceEDU, error) {
+	userIDsByServer := map[gomatrixserverlib.ServerName][]string{}
+	roomServers := map[string][]gomatrixserverlib.ServerName{}
+	for userID := range updates {
+		servers, err := t.joinedServers(ctx, userID, roomServers)
+		if err != nil {
+			return nil, fmt.Errorf("t.joinedServers: %w", err)
+		}
+		for _, server := range servers {
+			userIDsByServer[server] = append(userIDsByServer[server], userID)
+		}
 	}
 
-	edu := &gomatrixserverlib.EDU{
-		Type:   gomatrixserverlib.MPresence,
-		Origin: string(t.ServerName),
+	edusByUserIDs := map[string]*presenceEDU{}
+	for server, userIDs := range userIDsByServer {
+		sort.Strings(userIDs)
+		key := strings.Join(userIDs, " ")
+		if edu, ok := edusByUserIDs[key]; ok {
+			edu.destinations = append(edu.destinations, server)
+			continue
+		}
+		content := fedTypes.Presence{
+			Push: make([]fedTypes.PresenceContent, 0, len(userIDs)),
+		}
+		for _, userID := range userIDs {
+			content.Push = append(content.Push, updates[userID])
+		}
+		edu := &presenceEDU{
+			EDU: &gomatrixserverlib.EDU{
+				Type:   gomatrixserverlib.MPresence,
+				Origin: string(t.ServerName),
+			},
+			destinations: []gomatrixserverlib.ServerName{server},
+		}
+		var err error
+		if edu.Content, err = json.Marshal(content); err != nil {
+			return nil, fmt.Errorf("json.Marshal: %w", err)
+		}
+		edusByUserIDs[key] = edu
+	}
+	edus := make([]presenceEDU, 0, len(edusByUserIDs))
+	for _, edu := range edusByUserIDs {
+		edus = append(edus, *edu)
 	}
-	if edu.Content, err = json.Marshal(content); err != nil {
-		log.WithError(err).Error("failed to marshal EDU JSON")
-		return true
+	return edus, nil
+}
+
+// joinedServers returns the remote servers which share rooms with the user,
+// ignoring rooms with more than presence.max_room_size joined members. The
+// servers of each room are cached in roomServers.
+func (t *OutputPresenceConsumer) joinedServers(
+	ctx context.Context, userID string, roomServers map[string][]gomatrixserverlib.ServerName,
+) ([]gomatrixserverlib.ServerName, error) {
+	var queryRes roomserverAPI.QueryRoomsForUserResponse
+	err := t.rsAPI.QueryRoomsForUser(ctx, &roomserverAPI.QueryRoomsForUserRequest{
+		UserID:         userID,
+		WantMembership: "join",
+	}, &queryRes)
+	if err != nil {
+		return nil, fmt.Errorf("t.rsAPI.QueryRoomsForUser: %w", err)
 	}
 
-	log.Tracef("sending presence EDU to %d servers", len(joined))
-	if err = t.queues.SendEDU(edu, t.ServerName, joined); err != nil {
-		log.WithError(err).Error("failed to send EDU")
-		return false
+	servers := map[gomatrixserverlib.ServerName]struct{}{}
+	for _, roomID := range queryRes.RoomIDs {
+		joined, ok := roomServers[roomID]
+		if !ok {
+			hosts, err := t.db.GetJoinedHosts(ctx, roomID)
+			if err != nil {
+				return nil, fmt.Errorf("t.db.GetJoinedHosts: %w", err)
+			}
+			// There is a joined host for each joined member.
+			if t.maxRoomSize == 0 || len(hosts) <= t.maxRoomSize {
+				for _, host := range hosts {
+					if host.ServerName != t.ServerName {
+						joined = append(joined, host.ServerName)
+					}
+				}
+			}
+			roomServers[roomID] = joined
+		}
+		for _, server := range joined {
+			servers[server] = struct{}{}
+		}
 	}
 
-	return true
+	result := make([]gomatrixserverlib.ServerName, 0, len(servers))
+	for server := range servers {
+		result = append(result, server)
+	}
+	return result, nil
 }
@@ -0,0 +1,119 @@
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"testing"
+
+	"github.com/matrix-org/dendrite/federationapi/storage"
+	fedTypes "github.com/matrix-org/dendrite/federationapi/types"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type presenceRoomserverAPI struct {
+	roomserverAPI.FederationRoomserverAPI
+	rooms map[string][]string
+}
+
+func (r *presenceRoomserverAPI) QueryRoomsForUser(
+	ctx context.Context, req *roomserverAPI.QueryRoomsForUserRequest, res *roomserverAPI.QueryRoomsForUserResponse,
+) error {
+	res.RoomIDs = r.rooms[req.UserID]
+	return nil
+}
+
+type presenceDatabase struct {
+	storage.Database
+	hosts map[string][]gomatrixserverlib.ServerName
+}
+
+func (d *presenceDatabase) GetJoinedHosts(ctx context.Context, roomID string) ([]fedTypes.JoinedHost, error) {
+	var hosts []fedTypes.JoinedHost
+	for _, serverName := range d.hosts[roomID] {
+		hosts = append(hosts, fedTypes.JoinedHost{ServerName: serverName})
+	}
+	return hosts, nil
+}
+
+func TestPresenceEDUs(t *testing.T) {
+	alice := "@alice:local"
+	bob := "@bob:local"
+	consumer := &OutputPresenceConsumer{
+		ServerName: "local",
+		rsAPI: &presenceRoomserverAPI{rooms: map[string][]string{
+			alice: {"!small:local", "!large:local"},
+			bob:   {"!small:local", "!other:local"},
+		}},
+		db: &presenceDatabase{hosts: map[string][]gomatrixserverlib.ServerName{
+			"!small:local": {"local", "local", "a"},
+			"!other:local": {"local", "b", "c"},
+			"!large:local": {"local", "a", "b", "c", "d"},
+		}},
+		maxRoomSize: 3,
+	}
+	updates := map[string]fedTypes.PresenceContent{
+		alice: {UserID: alice, Presence: "online"},
+		bob:   {UserID: bob, Presence: "unavailable"},
+	}
+
+	edus, err := consumer.presenceEDUs(context.Background(), updates)
+	if err != nil {
+		t.Fatalf("failed to calculate EDUs: %s", err)
+	}
+
+	// The large room is ignored, so only a shares a room with alice, and
+	// b and c get the same EDU about bob.
+	want := map[string][]string{
+		"a":   {alice, bob},
+		"b c": {bob},
+	}
+	if len(edus) != len(want) {
+		t.Fatalf("expected %d EDUs, got %d", len(want), len(edus))
+	}
+	for _, edu := range edus {
+		var destinations []string
+		for _, destination := range edu.destinations {
+			destinations = append(destinations, string(destination))
+		}
+		sort.Strings(destinations)
+		key := destinations[0]
+		for _, destination := range destinations[1:] {
+			key += " " + destination
+		}
+		wantUserIDs, ok := want[key]
+		if !ok {
+			t.Fatalf("unexpected EDU destinations %v", destinations)
+		}
+		if edu.Type != gomatrixserverlib.MPresence {
+			t.Fatalf("unexpected EDU type %q", edu.Type)
+		}
+		var content fedTypes.Presence
+		if err = json.Unmarshal(edu.Content, &content); err != nil {
+			t.Fatalf("failed to unmarshal EDU: %s", err)
+		}
+		if len(content.Push) != len(wantUserIDs) {
+			t.Fatalf("expected %d presence updates for %v, got %d", len(wantUserIDs), destinations, len(content.Push))
+		}
+		for i, userID := range wantUserIDs {
+			if content.Push[i] != updates[userID] {
+				t.Fatalf("expected presence update %+v, got %+v", updates[userID], content.Push[i])
+			}
+		}
+	}
+
+	// Without a limit, the large room is included too, so b and c also
+	// share a room with alice, and d shares a room with alice only.
+	consumer.maxRoomSize = 0
+	if edus, err = consumer.presenceEDUs(context.Background(), updates); err != nil {
+		t.Fatalf("failed to calculate EDUs: %s", err)
+	}
+	destinations := 0
+	for _, edu := range edus {
+		destinations += len(edu.destinations)
+	}
+	if len(edus) != 2 || destinations != 4 {
+		t.Fatalf("expected 2 EDUs to 4 servers, got %+v", edus)
+	}
+}
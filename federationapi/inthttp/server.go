@@ -2,14 +2,11 @@ package inthttp
 
 import (
 	"context"
-	"encoding/json"
-	"net/http"
 
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/dendrite/federationapi/api"
 	"github.com/matrix-org/dendrite/internal/httputil"
 	"github.com/matrix-org/gomatrixserverlib"
-	"github.com/matrix-org/util"
 )
 
 // AddRoutes adds the FederationInternalAPI handlers to the http.ServeMux.
@@ -188,36 +185,29 @@ func AddRoutes(intAPI api.FederationInternalAPI, internalAPIMux *mux.Router) {
 		),
 	)
 
-	// TODO: Look at this shape
-	internalAPIMux.Handle(FederationAPIQueryPublicKeyPath,
-		httputil.MakeInternalAPI("FederationAPIQueryPublicKeys", func(req *http.Request) util.JSONResponse {
-			request := api.QueryPublicKeysRequest{}
-			response := api.QueryPublicKeysResponse{}
-			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
-				return util.MessageResponse(http.StatusBadRequest, err.Error())
-			}
-			keys, err := intAPI.FetchKeys(req.Context(), request.Requests)
-			if err != nil {
-				return util.ErrorResponse(err)
-			}
-			response.Results = keys
-			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
-		}),
-	)
-
-	// TODO: Look at this shape
-	internalAPIMux.Handle(FederationAPIInputPublicKeyPath,
-		httputil.MakeInternalAPI("FederationAPIInputPublicKeys", func(req *http.Request) util.JSONResponse {
-			request := api.InputPublicKeysRequest{}
-			response := api.InputPublicKeysResponse{}
-			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
-				return util.MessageResponse(http.StatusBadRequest, err.Error())
-			}
-			if err := intAPI.StoreKeys(req.Context(), request.Keys); err != nil {
-				return util.ErrorResponse(err)
-			}
-			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
-		}),
+	internalAPIMux.Handle(
+		FederationAPIQueryPublicKeyPath,
+		httputil.MakeInternalRPCAPI(
+			"FederationAPIQueryPublicKeys",
+			func(ctx context.Context, req *api.QueryPublicKeysRequest, res *api.QueryPublicKeysResponse) error {
+				keys, err := intAPI.FetchKeys(ctx, req.Requests)
+				if err != nil {
+					return err
+				}
+				res.Results = keys
+				return nil
+			},
+		),
+	)
+
+	internalAPIMux.Handle(
+		FederationAPIInputPublicKeyPath,
+		httputil.MakeInternalRPCAPI(
+			"FederationAPIInputPublicKeys",
+			func(ctx context.Context, req *api.InputPublicKeysRequest, res *api.InputPublicKeysResponse) error {
+				return intAPI.StoreKeys(ctx, req.Keys)
+			},
+		),
 	)
 }
 
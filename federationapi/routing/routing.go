@@ -29,6 +29,7 @@ import (
 	"github.com/matrix-org/dendrite/federationapi/producers"
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/internal/policy"
 	keyserverAPI "github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
@@ -107,6 +108,9 @@ func Setup(
 				}{
 					ServerName: cfg.Matrix.WellKnownServerName,
 				},
+				Headers: map[string]string{
+					"Cache-Control": fmt.Sprintf("public, max-age=%d", int(cfg.Matrix.WellKnown.CacheMaxAge.Seconds())),
+				},
 			}
 		}),
 		).Methods(http.MethodGet, http.MethodOptions)
@@ -123,12 +127,13 @@ func Setup(
 	v2keysmux.Handle("/query/{serverName}/{keyID}", notaryKeys).Methods(http.MethodGet)
 
 	mu := internal.NewMutexByRoom()
+	checker := policy.NewChecker(&cfg.Matrix.Policy)
 	v1fedmux.Handle("/send/{txnID}", MakeFedAPI(
 		"federation_send", cfg.Matrix.ServerName, keys, wakeup,
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
 			return Send(
 				httpReq, request, gomatrixserverlib.TransactionID(vars["txnID"]),
-				cfg, rsAPI, keyAPI, keys, federation, mu, servers, producer,
+				cfg, rsAPI, keyAPI, keys, federation, mu, servers, producer, checker,
 			)
 		},
 	)).Methods(http.MethodPut, http.MethodOptions)
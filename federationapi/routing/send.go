@@ -27,6 +27,7 @@ import (
 	"github.com/matrix-org/dendrite/federationapi/producers"
 	"github.com/matrix-org/dendrite/federationapi/types"
 	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/policy"
 	keyapi "github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -89,7 +90,22 @@ func Send(
 	mu *internal.MutexByRoom,
 	servers federationAPI.ServersInRoomProvider,
 	producer *producers.SyncAPIProducer,
+	checker policy.Checker,
 ) util.JSONResponse {
+	// Refuse transactions from servers banned by the moderation policy lists.
+	banReq := api.QueryBannedByPolicyRequest{ServerName: request.Origin()}
+	banRes := api.QueryBannedByPolicyResponse{}
+	if err := rsAPI.QueryBannedByPolicy(httpReq.Context(), &banReq, &banRes); err != nil {
+		util.GetLogger(httpReq.Context()).WithError(err).Error("rsAPI.QueryBannedByPolicy failed")
+		return jsonerror.InternalServerError()
+	}
+	if banRes.Rule != nil {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("This server is banned by the receiving server's policy"),
+		}
+	}
+
 	// First we should check if this origin has already submitted this
 	// txn ID to us. If they have and the txnIDs map contains an entry,
 	// the transaction is still being worked on. The new client can wait
@@ -131,6 +147,7 @@ func Send(
 		roomsMu:                mu,
 		producer:               producer,
 		inboundPresenceEnabled: cfg.Matrix.Presence.EnableInbound,
+		checker:                checker,
 	}
 
 	var txnEvents struct {
@@ -191,6 +208,7 @@ type txnReq struct {
 	servers                federationAPI.ServersInRoomProvider
 	producer               *producers.SyncAPIProducer
 	inboundPresenceEnabled bool
+	checker                policy.Checker
 }
 
 // A subset of FederationClient functionality that txn requires. Useful for testing.
@@ -275,19 +293,34 @@ func (t *txnReq) processTransaction(ctx context.Context) (*gomatrixserverlib.Res
 			continue
 		}
 
+		// Ask the policy module about the event. Rejected events are reported
+		// as failures in the PDU results, whereas soft-failed events are still
+		// stored by the roomserver but don't become part of the room state or
+		// reach clients.
+		headered := event.Headered(roomVersion)
+		decision := t.checker.CheckEvent(ctx, policy.OriginFederation, headered)
+		if decision.Action == policy.ActionReject {
+			results[event.EventID()] = gomatrixserverlib.PDUResult{
+				Error: "Rejected by policy: " + decision.Error,
+			}
+			continue
+		}
+
 		// pass the event to the roomserver which will do auth checks
 		// If the event fail auth checks, gmsl.NotAllowed error will be returned which we be silently
 		// discarded by the caller of this function
-		if err = api.SendEvents(
+		if err = api.SendInputRoomEvents(
 			ctx,
 			t.rsAPI,
-			api.KindNew,
-			[]*gomatrixserverlib.HeaderedEvent{
-				event.Headered(roomVersion),
+			[]api.InputRoomEvent{
+				{
+					Kind:         api.KindNew,
+					Event:        headered,
+					Origin:       t.Origin,
+					SendAsServer: api.DoNotSendToOtherServers,
+					SoftFail:     decision.Action == policy.ActionSoftFail,
+				},
 			},
-			t.Origin,
-			api.DoNotSendToOtherServers,
-			nil,
 			true,
 		); err != nil {
 			util.GetLogger(ctx).WithError(err).Errorf("Transaction: Couldn't submit event %q to input queue: %s", event.EventID(), err)
@@ -379,7 +412,7 @@ func (t *txnReq) processEDUs(ctx context.Context) {
 						util.GetLogger(ctx).Debugf("Dropping receipt event where sender domain (%q) doesn't match origin (%q)", domain, t.Origin)
 						continue
 					}
-					if err := t.processReceiptEvent(ctx, userID, roomID, "m.read", mread.Data.TS, mread.EventIDs); err != nil {
+					if err := t.processReceiptEvent(ctx, userID, roomID, "m.read", mread.Data.ThreadID, mread.Data.TS, mread.EventIDs); err != nil {
 						util.GetLogger(ctx).WithError(err).WithFields(logrus.Fields{
 							"sender":  t.Origin,
 							"user_id": userID,
@@ -469,7 +502,7 @@ func (t *txnReq) processSigningKeyUpdate(ctx context.Context, e gomatrixserverli
 
 // processReceiptEvent sends receipt events to JetStream
 func (t *txnReq) processReceiptEvent(ctx context.Context,
-	userID, roomID, receiptType string,
+	userID, roomID, receiptType, threadID string,
 	timestamp gomatrixserverlib.Timestamp,
 	eventIDs []string,
 ) error {
@@ -482,7 +515,7 @@ func (t *txnReq) processReceiptEvent(ctx context.Context,
 	}
 	// store every event
 	for _, eventID := range eventIDs {
-		if err := t.producer.SendReceipt(ctx, userID, roomID, eventID, receiptType, timestamp); err != nil {
+		if err := t.producer.SendReceipt(ctx, userID, roomID, eventID, receiptType, threadID, timestamp); err != nil {
 			return fmt.Errorf("unable to set receipt event: %w", err)
 		}
 	}
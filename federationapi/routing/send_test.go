@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/policy"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/test"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -190,6 +191,7 @@ func mustCreateTransaction(rsAPI api.FederationRoomserverAPI, fedClient txnFeder
 		keys:       &test.NopJSONVerifier{},
 		federation: fedClient,
 		roomsMu:    internal.NewMutexByRoom(),
+		checker:    policy.AllowAll{},
 	}
 	t.PDUs = pdus
 	t.Origin = testOrigin
@@ -280,6 +282,40 @@ func TestTransactionFailAuthChecks(t *testing.T) {
 	assertInputRoomEvents(t, rsAPI.inputRoomEvents, []*gomatrixserverlib.HeaderedEvent{testEvents[len(testEvents)-1]})
 }
 
+// eventDecisionChecker returns the same decision for every event.
+type eventDecisionChecker struct {
+	policy.AllowAll
+	decision policy.Decision
+}
+
+func (c eventDecisionChecker) CheckEvent(context.Context, policy.Origin, *gomatrixserverlib.HeaderedEvent) policy.Decision {
+	return c.decision
+}
+
+// The purpose of this test is to check that events rejected by the policy module never reach the roomserver, and that
+// soft-failed events are sent to the roomserver marked as soft-failed.
+func TestTransactionPolicyChecks(t *testing.T) {
+	event := testEvents[len(testEvents)-1]
+	pdus := []json.RawMessage{
+		testData[len(testData)-1], // a message event
+	}
+
+	rsAPI := &testRoomserverAPI{}
+	txn := mustCreateTransaction(rsAPI, &txnFedClient{}, pdus)
+	txn.checker = eventDecisionChecker{decision: policy.Decision{Action: policy.ActionReject}}
+	mustProcessTransaction(t, txn, []string{event.EventID()})
+	assertInputRoomEvents(t, rsAPI.inputRoomEvents, nil)
+
+	rsAPI = &testRoomserverAPI{}
+	txn = mustCreateTransaction(rsAPI, &txnFedClient{}, pdus)
+	txn.checker = eventDecisionChecker{decision: policy.Decision{Action: policy.ActionSoftFail}}
+	mustProcessTransaction(t, txn, nil)
+	assertInputRoomEvents(t, rsAPI.inputRoomEvents, []*gomatrixserverlib.HeaderedEvent{event})
+	if !rsAPI.inputRoomEvents[0].SoftFail {
+		t.Errorf("expected soft-failed event to be sent to the roomserver with SoftFail set")
+	}
+}
+
 // The purpose of this test is to make sure that when an event is received for which we do not know the prev_events,
 // we request them from /get_missing_events. It works by setting PrevEventsExist=false in the roomserver query response,
 // resulting in a call to /get_missing_events which returns the missing prev event. Both events should be processed in
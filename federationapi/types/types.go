@@ -64,7 +64,8 @@ type FederationReceiptData struct {
 }
 
 type ReceiptTS struct {
-	TS gomatrixserverlib.Timestamp `json:"ts"`
+	TS       gomatrixserverlib.Timestamp `json:"ts"`
+	ThreadID string                      `json:"thread_id,omitempty"`
 }
 
 type Presence struct {
@@ -0,0 +1,195 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/util"
+)
+
+// sendTimeout is how long sending an email may take if the context has no deadline.
+const sendTimeout = time.Second * 30
+
+// Message is an email to be sent. Either Text or HTML may be empty, but not both.
+type Message struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+	// An optional URL which unsubscribes the recipient from emails like this
+	// one, sent in the List-Unsubscribe header.
+	UnsubscribeURL string
+}
+
+// Sender sends emails.
+type Sender interface {
+	Send(ctx context.Context, msg *Message) error
+}
+
+type smtpSender struct {
+	cfg  *config.Email
+	from *mail.Address
+}
+
+// NewSMTPSender creates a Sender which delivers emails to the configured SMTP server.
+func NewSMTPSender(cfg *config.Email) (Sender, error) {
+	from, err := mail.ParseAddress(cfg.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid from address %q: %w", cfg.From, err)
+	}
+	return &smtpSender{
+		cfg:  cfg,
+		from: from,
+	}, nil
+}
+
+func (s *smtpSender) Send(ctx context.Context, msg *Message) error {
+	to, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return fmt.Errorf("invalid recipient address %q: %w", msg.To, err)
+	}
+	body, err := buildMessage(s.from, to, msg)
+	if err != nil {
+		return err
+	}
+
+	host, _, err := net.SplitHostPort(s.cfg.SMTPHost)
+	if err != nil {
+		return fmt.Errorf("invalid SMTP host %q: %w", s.cfg.SMTPHost, err)
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", s.cfg.SMTPHost)
+	if err != nil {
+		return fmt.Errorf("failed to connect to SMTP server: %w", err)
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(sendTimeout)
+	}
+	if err = conn.SetDeadline(deadline); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		_ = conn.Close()
+		return fmt.Errorf("failed to start SMTP session: %w", err)
+	}
+	defer c.Close() // nolint: errcheck
+
+	if ok, _ = c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return fmt.Errorf("failed to start TLS: %w", err)
+		}
+	} else if s.cfg.RequireTLS {
+		return fmt.Errorf("SMTP server %s does not support STARTTLS", s.cfg.SMTPHost)
+	}
+	if s.cfg.SMTPUsername != "" {
+		if err = c.Auth(smtp.PlainAuth("", s.cfg.SMTPUsername, s.cfg.SMTPPassword, host)); err != nil {
+			return fmt.Errorf("failed to authenticate to SMTP server: %w", err)
+		}
+	}
+	if err = c.Mail(s.from.Address); err != nil {
+		return err
+	}
+	if err = c.Rcpt(to.Address); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(body); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// buildMessage builds a MIME message, using multipart/alternative if the
+// message has both a plain text and a HTML body.
+func buildMessage(from, to *mail.Address, msg *Message) ([]byte, error) {
+	var buf bytes.Buffer
+	domain := from.Address[strings.LastIndex(from.Address, "@")+1:]
+	header := textproto.MIMEHeader{}
+	header.Set("From", from.String())
+	header.Set("To", to.String())
+	header.Set("Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	header.Set("Date", time.Now().Format(time.RFC1123Z))
+	header.Set("Message-ID", fmt.Sprintf("<%s@%s>", util.RandomString(24), domain))
+	header.Set("MIME-Version", "1.0")
+	if msg.UnsubscribeURL != "" {
+		header.Set("List-Unsubscribe", "<"+msg.UnsubscribeURL+">")
+	}
+
+	var parts []struct{ contentType, body string }
+	if msg.Text != "" {
+		parts = append(parts, struct{ contentType, body string }{"text/plain; charset=utf-8", msg.Text})
+	}
+	if msg.HTML != "" {
+		parts = append(parts, struct{ contentType, body string }{"text/html; charset=utf-8", msg.HTML})
+	}
+	switch len(parts) {
+	case 0:
+		return nil, fmt.Errorf("email has no body")
+	case 1:
+		header.Set("Content-Type", parts[0].contentType)
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+		writeHeader(&buf, header)
+		if err := writeQuotedPrintable(&buf, parts[0].body); err != nil {
+			return nil, err
+		}
+	default:
+		mw := multipart.NewWriter(&buf)
+		header.Set("Content-Type", "multipart/alternative; boundary="+mw.Boundary())
+		writeHeader(&buf, header)
+		for _, part := range parts {
+			w, err := mw.CreatePart(textproto.MIMEHeader{
+				"Content-Type":              {part.contentType},
+				"Content-Transfer-Encoding": {"quoted-printable"},
+			})
+			if err != nil {
+				return nil, err
+			}
+			if err = writeQuotedPrintable(w, part.body); err != nil {
+				return nil, err
+			}
+		}
+		if err := mw.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func writeHeader(buf *bytes.Buffer, header textproto.MIMEHeader) {
+	for _, key := range []string{"From", "To", "Subject", "Date", "Message-ID", "List-Unsubscribe", "MIME-Version", "Content-Type", "Content-Transfer-Encoding"} {
+		if value := header.Get(key); value != "" {
+			fmt.Fprintf(buf, "%s: %s\r\n", key, value)
+		}
+	}
+	buf.WriteString("\r\n")
+}
+
+func writeQuotedPrintable(w io.Writer, body string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(body)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
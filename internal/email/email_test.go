@@ -0,0 +1,131 @@
+package email
+
+import (
+	"context"
+	"crypto/ed25519"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/test"
+)
+
+func TestSendEmail(t *testing.T) {
+	server := test.NewSMTPServer(t)
+	sender, err := NewSMTPSender(&config.Email{
+		From:     "Dendrite <noreply@example.com>",
+		SMTPHost: server.Addr,
+	})
+	if err != nil {
+		t.Fatalf("failed to create sender: %s", err)
+	}
+	templates, err := LoadTemplates("")
+	if err != nil {
+		t.Fatalf("failed to load templates: %s", err)
+	}
+	msg, err := templates.Render(TemplatePasswordReset, TemplateData{
+		ServerName: "example.com",
+		Link:       "https://example.com/submit_token?token=abc&sid=def",
+	})
+	if err != nil {
+		t.Fatalf("failed to render email: %s", err)
+	}
+	if msg.Subject != "[example.com] Password reset" {
+		t.Fatalf("unexpected subject %q", msg.Subject)
+	}
+	msg.To = "alice@example.com"
+	if err = sender.Send(context.Background(), msg); err != nil {
+		t.Fatalf("failed to send email: %s", err)
+	}
+
+	messages := server.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("expected 1 email, got %d", len(messages))
+	}
+	if messages[0].From != "noreply@example.com" {
+		t.Fatalf("unexpected sender %q", messages[0].From)
+	}
+	if len(messages[0].To) != 1 || messages[0].To[0] != "alice@example.com" {
+		t.Fatalf("unexpected recipients %v", messages[0].To)
+	}
+	for _, want := range []string{
+		"Subject: [example.com] Password reset",
+		"multipart/alternative",
+		// the HTML part escapes the ampersand
+		"https://example.com/submit_token?token=3Dabc&sid=3Ddef",
+		"https://example.com/submit_token?token=3Dabc&amp;sid=3Ddef",
+	} {
+		if !strings.Contains(messages[0].Data, want) {
+			t.Errorf("expected email to contain %q:\n%s", want, messages[0].Data)
+		}
+	}
+}
+
+func TestSendEmailRequireTLS(t *testing.T) {
+	server := test.NewSMTPServer(t)
+	sender, err := NewSMTPSender(&config.Email{
+		From:       "noreply@example.com",
+		SMTPHost:   server.Addr,
+		RequireTLS: true,
+	})
+	if err != nil {
+		t.Fatalf("failed to create sender: %s", err)
+	}
+	err = sender.Send(context.Background(), &Message{To: "alice@example.com", Subject: "Test", Text: "Test"})
+	if err == nil {
+		t.Fatalf("expected sending without STARTTLS to fail")
+	}
+	if len(server.Messages()) != 0 {
+		t.Fatalf("expected no emails to be sent")
+	}
+}
+
+func TestLoadCustomTemplates(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "password_reset_subject.txt"), []byte("Reset for {{.Address}}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	templates, err := LoadTemplates(dir)
+	if err != nil {
+		t.Fatalf("failed to load templates: %s", err)
+	}
+	msg, err := templates.Render(TemplatePasswordReset, TemplateData{Address: "alice@example.com"})
+	if err != nil {
+		t.Fatalf("failed to render email: %s", err)
+	}
+	if msg.Subject != "Reset for alice@example.com" {
+		t.Fatalf("unexpected subject %q", msg.Subject)
+	}
+	// templates which weren't overridden still use the built-in ones
+	if !strings.Contains(msg.Text, "password reset request") {
+		t.Fatalf("expected built-in text template, got %q", msg.Text)
+	}
+}
+
+func TestUnsubscribeURL(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Global{PrivateKey: key}
+	cfg.Email.PublicBaseURL = "https://matrix.example.com/"
+
+	link, err := url.Parse(UnsubscribeURL(cfg, "@alice:example.com", "m.email", "alice@example.com"))
+	if err != nil {
+		t.Fatalf("invalid unsubscribe URL: %s", err)
+	}
+	if link.Host != "matrix.example.com" || link.Path != UnsubscribePath {
+		t.Fatalf("unexpected unsubscribe URL %q", link)
+	}
+	query := link.Query()
+	if !ValidUnsubscribeToken(cfg, query.Get("user_id"), query.Get("app_id"), query.Get("pushkey"), query.Get("token")) {
+		t.Fatalf("token in unsubscribe URL %q is invalid", link)
+	}
+	// the token can't be used to unsubscribe other pushers
+	if ValidUnsubscribeToken(cfg, "@bob:example.com", "m.email", "alice@example.com", query.Get("token")) {
+		t.Fatalf("token is valid for another user")
+	}
+}
@@ -0,0 +1,113 @@
+package email
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// The kinds of emails which can be rendered. Each kind has a template named
+// <kind>_subject.txt for the subject, <kind>.txt for the plain text body and
+// <kind>.html for the HTML body.
+const (
+	TemplateAddThreePID   = "add_threepid"
+	TemplatePasswordReset = "password_reset"
+	TemplateNotification  = "notification"
+)
+
+//go:embed templates
+var defaultTemplates embed.FS
+
+// TemplateData is passed to the templates when rendering validation emails.
+type TemplateData struct {
+	ServerName string
+	Address    string
+	Link       string
+	Token      string
+}
+
+// NotificationTemplateData is passed to the templates when rendering emails
+// about unread notifications.
+type NotificationTemplateData struct {
+	ServerName        string
+	UserID            string
+	NotificationCount int
+	Rooms             []NotificationRoom
+	UnsubscribeLink   string
+}
+
+// NotificationRoom groups the unread notifications in a room.
+type NotificationRoom struct {
+	RoomID        string
+	Name          string // the room name, canonical alias or room ID
+	Link          string // a link which opens the room in a client
+	Notifications []NotificationMessage
+}
+
+// NotificationMessage describes the event which caused a notification.
+type NotificationMessage struct {
+	Sender string // the display name or user ID of the sender
+	Body   string
+	TS     time.Time
+}
+
+// Templates renders emails from the built-in templates, optionally
+// overridden by templates in a directory.
+type Templates struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+// LoadTemplates loads the built-in templates, replacing any of them which
+// also exist in the given directory. The directory may be empty.
+func LoadTemplates(dir string) (*Templates, error) {
+	text, err := texttemplate.ParseFS(defaultTemplates, "templates/*.txt")
+	if err != nil {
+		return nil, err
+	}
+	html, err := htmltemplate.ParseFS(defaultTemplates, "templates/*.html")
+	if err != nil {
+		return nil, err
+	}
+	if dir != "" {
+		if matches, _ := filepath.Glob(filepath.Join(dir, "*.txt")); len(matches) > 0 {
+			if text, err = text.ParseFiles(matches...); err != nil {
+				return nil, fmt.Errorf("failed to parse templates in %q: %w", dir, err)
+			}
+		}
+		if matches, _ := filepath.Glob(filepath.Join(dir, "*.html")); len(matches) > 0 {
+			if html, err = html.ParseFiles(matches...); err != nil {
+				return nil, fmt.Errorf("failed to parse templates in %q: %w", dir, err)
+			}
+		}
+	}
+	return &Templates{
+		text: text,
+		html: html,
+	}, nil
+}
+
+// Render renders an email of the given kind. The recipient of the returned
+// message is left empty.
+func (t *Templates) Render(kind string, data interface{}) (*Message, error) {
+	var subject, text, html bytes.Buffer
+	if err := t.text.ExecuteTemplate(&subject, kind+"_subject.txt", data); err != nil {
+		return nil, err
+	}
+	if err := t.text.ExecuteTemplate(&text, kind+".txt", data); err != nil {
+		return nil, err
+	}
+	if err := t.html.ExecuteTemplate(&html, kind+".html", data); err != nil {
+		return nil, err
+	}
+	return &Message{
+		Subject: strings.TrimSpace(subject.String()),
+		Text:    text.String(),
+		HTML:    html.String(),
+	}, nil
+}
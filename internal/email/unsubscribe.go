@@ -0,0 +1,54 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package email
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"strings"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// UnsubscribePath is the path of the client API endpoint which removes an
+// email pusher when the unsubscribe link in a notification email is followed.
+const UnsubscribePath = "/_matrix/client/unstable/pushers/email/unsubscribe"
+
+// UnsubscribeToken returns the token which proves that an unsubscribe link
+// for the email pusher was sent by us. The token is derived from the signing
+// key of the server, so it can't be guessed and doesn't need to be stored.
+func UnsubscribeToken(cfg *config.Global, userID, appID, pushKey string) string {
+	mac := hmac.New(sha256.New, cfg.PrivateKey)
+	mac.Write([]byte(strings.Join([]string{"unsubscribe", userID, appID, pushKey}, "\x00")))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// ValidUnsubscribeToken returns true if the token was returned by
+// UnsubscribeToken for the email pusher.
+func ValidUnsubscribeToken(cfg *config.Global, userID, appID, pushKey, token string) bool {
+	return hmac.Equal([]byte(token), []byte(UnsubscribeToken(cfg, userID, appID, pushKey)))
+}
+
+// UnsubscribeURL returns the link which removes the email pusher.
+func UnsubscribeURL(cfg *config.Global, userID, appID, pushKey string) string {
+	query := url.Values{}
+	query.Set("user_id", userID)
+	query.Set("app_id", appID)
+	query.Set("pushkey", pushKey)
+	query.Set("token", UnsubscribeToken(cfg, userID, appID, pushKey))
+	return strings.TrimSuffix(cfg.Email.PublicBaseURL, "/") + UnsubscribePath + "?" + query.Encode()
+}
@@ -35,8 +35,9 @@ type AccountData struct {
 }
 
 type ReadMarkerJSON struct {
-	FullyRead string `json:"m.fully_read"`
-	Read      string `json:"m.read"`
+	FullyRead   string `json:"m.fully_read"`
+	Read        string `json:"m.read"`
+	ReadPrivate string `json:"m.read.private"`
 }
 
 // NotificationData contains statistics about notifications, sent from
@@ -53,6 +54,11 @@ type NotificationData struct {
 	// UnreadNotificationCount is the total number of unread
 	// notifications.
 	UnreadNotificationCount int `json:"unread_notification_count"`
+
+	// UnreadThreadNotifications contains the unread notification counts
+	// of each thread, keyed by the root event ID of the thread. The room
+	// counts above include these.
+	UnreadThreadNotifications map[string]types.UnreadNotificationCounts `json:"unread_thread_notifications,omitempty"`
 }
 
 // ProfileResponse is a struct containing all known user profile data
@@ -0,0 +1,775 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"bufio"
+	"encoding"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sync"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// The binary encoding of the internal APIs. As both sides of an internal API
+// call share the same Go types, values are encoded in the order of the fields
+// of their types without any names:
+//   - bools are a single byte, integers are varints and floats are 8 bytes;
+//   - strings are their length followed by their bytes;
+//   - slices and maps are their length plus one followed by their elements,
+//     or 0 if they are nil, and arrays are their elements;
+//   - pointers are 0 if they are nil, or 1 followed by the value;
+//   - structs are their exported fields which aren't ignored by encoding/json;
+//   - events are their room version, event ID, whether they are redacted and
+//     their JSON, so that they are neither marshalled again nor is their event
+//     ID computed again;
+//   - empty interfaces holding values which encoding/json decodes into them
+//     (nil, bools, float64s, strings, []interface{} and map[string]interface{})
+//     are a tag followed by the value, and a tag followed by the marshalled JSON
+//     of any other value;
+//   - other types with their own binary, JSON or text marshalling, and other
+//     interfaces, are the length of the marshalled value followed by its bytes.
+
+// BinaryContentType is the content type of requests and responses using the
+// binary encoding.
+const BinaryContentType = "application/x-dendrite-binary"
+
+// maxBinaryLength is the maximum length of a string, slice or map, to avoid
+// huge allocations when decoding invalid data.
+const maxBinaryLength = 1 << 30
+
+var (
+	binaryMarshalerType   = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+	binaryUnmarshalerType = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+	jsonMarshalerType     = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	jsonUnmarshalerType   = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	textMarshalerType     = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	textUnmarshalerType   = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	eventType             = reflect.TypeOf(gomatrixserverlib.Event{})
+	headeredEventType     = reflect.TypeOf(gomatrixserverlib.HeaderedEvent{})
+)
+
+// The tags of the values held by empty interfaces.
+const (
+	anyNil byte = iota
+	anyFalse
+	anyTrue
+	anyFloat
+	anyString
+	anySlice
+	anyMap
+	anyJSON
+)
+
+type binaryEncoder struct {
+	w       *bufio.Writer
+	scratch [binary.MaxVarintLen64]byte
+}
+
+type binaryDecoder struct {
+	r *bufio.Reader
+}
+
+type binaryCodec struct {
+	encode func(e *binaryEncoder, v reflect.Value) error
+	decode func(d *binaryDecoder, v reflect.Value) error
+}
+
+var (
+	binaryCodecsMu sync.RWMutex
+	binaryCodecs   = map[reflect.Type]*binaryCodec{}
+)
+
+// encodeBinary writes the value pointed to by v to the writer.
+func encodeBinary(w *bufio.Writer, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("encodeBinary: expected a non-nil pointer, got %T", v)
+	}
+	return codecFor(rv.Type().Elem()).encode(&binaryEncoder{w: w}, rv.Elem())
+}
+
+// decodeBinary reads a value from the reader into the value pointed to by v.
+func decodeBinary(r *bufio.Reader, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("decodeBinary: expected a non-nil pointer, got %T", v)
+	}
+	return codecFor(rv.Type().Elem()).decode(&binaryDecoder{r: r}, rv.Elem())
+}
+
+// codecFor returns the codec for the type, building it on first use.
+func codecFor(t reflect.Type) *binaryCodec {
+	binaryCodecsMu.RLock()
+	c, ok := binaryCodecs[t]
+	binaryCodecsMu.RUnlock()
+	if ok {
+		return c
+	}
+	binaryCodecsMu.Lock()
+	defer binaryCodecsMu.Unlock()
+	return codecForLocked(t)
+}
+
+// codecForLocked returns the codec for the type. The codec is stored before it
+// is built so that recursive types refer to it.
+func codecForLocked(t reflect.Type) *binaryCodec {
+	if c, ok := binaryCodecs[t]; ok {
+		return c
+	}
+	c := &binaryCodec{}
+	binaryCodecs[t] = c
+	buildCodec(t, c)
+	return c
+}
+
+func buildCodec(t reflect.Type, c *binaryCodec) {
+	switch t {
+	case eventType:
+		buildEventCodec(c)
+		return
+	case headeredEventType:
+		buildHeaderedEventCodec(c)
+		return
+	}
+	if t.Kind() != reflect.Pointer && t.Kind() != reflect.Interface {
+		ptr := reflect.PointerTo(t)
+		switch {
+		case ptr.Implements(binaryMarshalerType) && ptr.Implements(binaryUnmarshalerType):
+			c.encode = encodeMarshaled(func(v interface{}) ([]byte, error) {
+				return v.(encoding.BinaryMarshaler).MarshalBinary()
+			})
+			c.decode = decodeMarshaled(func(v interface{}, b []byte) error {
+				return v.(encoding.BinaryUnmarshaler).UnmarshalBinary(b)
+			})
+			return
+		case ptr.Implements(jsonMarshalerType) && ptr.Implements(jsonUnmarshalerType):
+			c.encode = encodeMarshaled(func(v interface{}) ([]byte, error) {
+				return v.(json.Marshaler).MarshalJSON()
+			})
+			c.decode = decodeMarshaled(func(v interface{}, b []byte) error {
+				return v.(json.Unmarshaler).UnmarshalJSON(b)
+			})
+			return
+		case ptr.Implements(textMarshalerType) && ptr.Implements(textUnmarshalerType):
+			c.encode = encodeMarshaled(func(v interface{}) ([]byte, error) {
+				return v.(encoding.TextMarshaler).MarshalText()
+			})
+			c.decode = decodeMarshaled(func(v interface{}, b []byte) error {
+				return v.(encoding.TextUnmarshaler).UnmarshalText(b)
+			})
+			return
+		}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		c.encode = func(e *binaryEncoder, v reflect.Value) error {
+			if v.Bool() {
+				return e.w.WriteByte(1)
+			}
+			return e.w.WriteByte(0)
+		}
+		c.decode = func(d *binaryDecoder, v reflect.Value) error {
+			b, err := d.r.ReadByte()
+			v.SetBool(b != 0)
+			return err
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		c.encode = func(e *binaryEncoder, v reflect.Value) error {
+			return e.writeVarint(v.Int())
+		}
+		c.decode = func(d *binaryDecoder, v reflect.Value) error {
+			i, err := binary.ReadVarint(d.r)
+			if err != nil {
+				return err
+			}
+			if v.OverflowInt(i) {
+				return fmt.Errorf("value %d overflows %s", i, v.Type())
+			}
+			v.SetInt(i)
+			return nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		c.encode = func(e *binaryEncoder, v reflect.Value) error {
+			return e.writeUvarint(v.Uint())
+		}
+		c.decode = func(d *binaryDecoder, v reflect.Value) error {
+			u, err := binary.ReadUvarint(d.r)
+			if err != nil {
+				return err
+			}
+			if v.OverflowUint(u) {
+				return fmt.Errorf("value %d overflows %s", u, v.Type())
+			}
+			v.SetUint(u)
+			return nil
+		}
+	case reflect.Float32, reflect.Float64:
+		c.encode = func(e *binaryEncoder, v reflect.Value) error {
+			binary.LittleEndian.PutUint64(e.scratch[:8], math.Float64bits(v.Float()))
+			_, err := e.w.Write(e.scratch[:8])
+			return err
+		}
+		c.decode = func(d *binaryDecoder, v reflect.Value) error {
+			var b [8]byte
+			if _, err := io.ReadFull(d.r, b[:]); err != nil {
+				return err
+			}
+			v.SetFloat(math.Float64frombits(binary.LittleEndian.Uint64(b[:])))
+			return nil
+		}
+	case reflect.String:
+		c.encode = func(e *binaryEncoder, v reflect.Value) error {
+			return e.writeString(v.String())
+		}
+		c.decode = func(d *binaryDecoder, v reflect.Value) error {
+			b, err := d.readBytes()
+			v.SetString(string(b))
+			return err
+		}
+	case reflect.Slice:
+		buildSliceCodec(t, c)
+	case reflect.Array:
+		elem := codecForLocked(t.Elem())
+		c.encode = func(e *binaryEncoder, v reflect.Value) error {
+			for i := 0; i < v.Len(); i++ {
+				if err := elem.encode(e, v.Index(i)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		c.decode = func(d *binaryDecoder, v reflect.Value) error {
+			for i := 0; i < v.Len(); i++ {
+				if err := elem.decode(d, v.Index(i)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	case reflect.Map:
+		buildMapCodec(t, c)
+	case reflect.Pointer:
+		elem := codecForLocked(t.Elem())
+		c.encode = func(e *binaryEncoder, v reflect.Value) error {
+			if v.IsNil() {
+				return e.w.WriteByte(0)
+			}
+			if err := e.w.WriteByte(1); err != nil {
+				return err
+			}
+			return elem.encode(e, v.Elem())
+		}
+		c.decode = func(d *binaryDecoder, v reflect.Value) error {
+			b, err := d.r.ReadByte()
+			if err != nil {
+				return err
+			}
+			if b == 0 {
+				v.Set(reflect.Zero(t))
+				return nil
+			}
+			if v.IsNil() {
+				v.Set(reflect.New(t.Elem()))
+			}
+			return elem.decode(d, v.Elem())
+		}
+	case reflect.Struct:
+		buildStructCodec(t, c)
+	case reflect.Interface:
+		if t.NumMethod() == 0 {
+			c.encode = func(e *binaryEncoder, v reflect.Value) error {
+				return e.writeAny(v.Interface())
+			}
+			c.decode = func(d *binaryDecoder, v reflect.Value) error {
+				x, err := d.readAny()
+				if err != nil {
+					return err
+				}
+				if x == nil {
+					v.Set(reflect.Zero(t))
+				} else {
+					v.Set(reflect.ValueOf(x))
+				}
+				return nil
+			}
+			return
+		}
+		c.encode = func(e *binaryEncoder, v reflect.Value) error {
+			b, err := json.Marshal(v.Interface())
+			if err != nil {
+				return err
+			}
+			return e.writeBytes(b)
+		}
+		c.decode = func(d *binaryDecoder, v reflect.Value) error {
+			b, err := d.readBytes()
+			if err != nil {
+				return err
+			}
+			return json.Unmarshal(b, v.Addr().Interface())
+		}
+	default:
+		unsupported := fmt.Errorf("unsupported type %s", t)
+		c.encode = func(*binaryEncoder, reflect.Value) error { return unsupported }
+		c.decode = func(*binaryDecoder, reflect.Value) error { return unsupported }
+	}
+}
+
+func buildSliceCodec(t reflect.Type, c *binaryCodec) {
+	if t.Elem().Kind() == reflect.Uint8 && !reflect.PointerTo(t.Elem()).Implements(jsonMarshalerType) {
+		c.encode = func(e *binaryEncoder, v reflect.Value) error {
+			if v.IsNil() {
+				return e.w.WriteByte(0)
+			}
+			if err := e.writeUvarint(uint64(v.Len()) + 1); err != nil {
+				return err
+			}
+			_, err := e.w.Write(v.Bytes())
+			return err
+		}
+		c.decode = func(d *binaryDecoder, v reflect.Value) error {
+			n, err := d.readLength()
+			if err != nil || n < 0 {
+				v.Set(reflect.Zero(t))
+				return err
+			}
+			b := reflect.MakeSlice(t, n, n)
+			if _, err = io.ReadFull(d.r, b.Bytes()); err != nil {
+				return err
+			}
+			v.Set(b)
+			return nil
+		}
+		return
+	}
+	elem := codecForLocked(t.Elem())
+	c.encode = func(e *binaryEncoder, v reflect.Value) error {
+		if v.IsNil() {
+			return e.w.WriteByte(0)
+		}
+		if err := e.writeUvarint(uint64(v.Len()) + 1); err != nil {
+			return err
+		}
+		for i := 0; i < v.Len(); i++ {
+			if err := elem.encode(e, v.Index(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	c.decode = func(d *binaryDecoder, v reflect.Value) error {
+		n, err := d.readLength()
+		if err != nil || n < 0 {
+			v.Set(reflect.Zero(t))
+			return err
+		}
+		s := reflect.MakeSlice(t, n, n)
+		for i := 0; i < n; i++ {
+			if err = elem.decode(d, s.Index(i)); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+		return nil
+	}
+}
+
+func buildMapCodec(t reflect.Type, c *binaryCodec) {
+	key := codecForLocked(t.Key())
+	elem := codecForLocked(t.Elem())
+	c.encode = func(e *binaryEncoder, v reflect.Value) error {
+		if v.IsNil() {
+			return e.w.WriteByte(0)
+		}
+		if err := e.writeUvarint(uint64(v.Len()) + 1); err != nil {
+			return err
+		}
+		iter := v.MapRange()
+		for iter.Next() {
+			if err := key.encode(e, iter.Key()); err != nil {
+				return err
+			}
+			if err := elem.encode(e, iter.Value()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	c.decode = func(d *binaryDecoder, v reflect.Value) error {
+		n, err := d.readLength()
+		if err != nil || n < 0 {
+			v.Set(reflect.Zero(t))
+			return err
+		}
+		// Like encoding/json, keep the entries of an existing map.
+		if v.IsNil() {
+			v.Set(reflect.MakeMapWithSize(t, n))
+		}
+		for i := 0; i < n; i++ {
+			k := reflect.New(t.Key()).Elem()
+			if err = key.decode(d, k); err != nil {
+				return err
+			}
+			el := reflect.New(t.Elem()).Elem()
+			if err = elem.decode(d, el); err != nil {
+				return err
+			}
+			v.SetMapIndex(k, el)
+		}
+		return nil
+	}
+}
+
+func buildStructCodec(t reflect.Type, c *binaryCodec) {
+	type field struct {
+		index int
+		codec *binaryCodec
+	}
+	var fields []field
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Tag.Get("json") == "-" {
+			continue
+		}
+		// Exported fields of embedded structs are encoded by encoding/json
+		// even if the embedded struct isn't exported.
+		if !f.IsExported() && !(f.Anonymous && f.Type.Kind() == reflect.Struct) {
+			continue
+		}
+		fields = append(fields, field{i, codecForLocked(f.Type)})
+	}
+	c.encode = func(e *binaryEncoder, v reflect.Value) error {
+		for _, f := range fields {
+			if err := f.codec.encode(e, v.Field(f.index)); err != nil {
+				return fmt.Errorf("%s.%s: %w", t, t.Field(f.index).Name, err)
+			}
+		}
+		return nil
+	}
+	c.decode = func(d *binaryDecoder, v reflect.Value) error {
+		for _, f := range fields {
+			if err := f.codec.decode(d, v.Field(f.index)); err != nil {
+				return fmt.Errorf("%s.%s: %w", t, t.Field(f.index).Name, err)
+			}
+		}
+		return nil
+	}
+}
+
+func buildEventCodec(c *binaryCodec) {
+	c.encode = func(e *binaryEncoder, v reflect.Value) error {
+		ev := addressable(v).Addr().Interface().(*gomatrixserverlib.Event)
+		if err := e.writeString(string(ev.Version())); err != nil {
+			return err
+		}
+		if err := e.writeString(ev.EventID()); err != nil {
+			return err
+		}
+		redacted := byte(0)
+		if ev.Redacted() {
+			redacted = 1
+		}
+		if err := e.w.WriteByte(redacted); err != nil {
+			return err
+		}
+		return e.writeBytes(ev.JSON())
+	}
+	c.decode = func(d *binaryDecoder, v reflect.Value) error {
+		roomVersion, err := d.readBytes()
+		if err != nil {
+			return err
+		}
+		eventID, err := d.readBytes()
+		if err != nil {
+			return err
+		}
+		redacted, err := d.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		eventJSON, err := d.readBytes()
+		if err != nil {
+			return err
+		}
+		ev, err := gomatrixserverlib.NewEventFromTrustedJSONWithEventID(
+			string(eventID), eventJSON, redacted != 0, gomatrixserverlib.RoomVersion(roomVersion),
+		)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(ev).Elem())
+		return nil
+	}
+}
+
+// buildHeaderedEventCodec builds the codec of headered events, which are their
+// room version followed by the event. Like with encoding/json, the history
+// visibility isn't sent.
+func buildHeaderedEventCodec(c *binaryCodec) {
+	roomVersionField, _ := headeredEventType.FieldByName("RoomVersion")
+	eventField, _ := headeredEventType.FieldByName("Event")
+	event := codecForLocked(eventField.Type)
+	c.encode = func(e *binaryEncoder, v reflect.Value) error {
+		if err := e.writeString(v.FieldByIndex(roomVersionField.Index).String()); err != nil {
+			return err
+		}
+		return event.encode(e, v.FieldByIndex(eventField.Index))
+	}
+	c.decode = func(d *binaryDecoder, v reflect.Value) error {
+		roomVersion, err := d.readBytes()
+		if err != nil {
+			return err
+		}
+		v.FieldByIndex(roomVersionField.Index).SetString(string(roomVersion))
+		return event.decode(d, v.FieldByIndex(eventField.Index))
+	}
+}
+
+// addressable returns the value, or a copy of it if it isn't addressable, so
+// that methods with a pointer receiver can be called.
+func addressable(v reflect.Value) reflect.Value {
+	if v.CanAddr() {
+		return v
+	}
+	ptr := reflect.New(v.Type())
+	ptr.Elem().Set(v)
+	return ptr.Elem()
+}
+
+// encodeMarshaled returns an encoder for types which marshal themselves.
+func encodeMarshaled(marshal func(v interface{}) ([]byte, error)) func(e *binaryEncoder, v reflect.Value) error {
+	return func(e *binaryEncoder, v reflect.Value) error {
+		b, err := marshal(addressable(v).Addr().Interface())
+		if err != nil {
+			return err
+		}
+		return e.writeBytes(b)
+	}
+}
+
+func decodeMarshaled(unmarshal func(v interface{}, b []byte) error) func(d *binaryDecoder, v reflect.Value) error {
+	return func(d *binaryDecoder, v reflect.Value) error {
+		b, err := d.readBytes()
+		if err != nil {
+			return err
+		}
+		return unmarshal(v.Addr().Interface(), b)
+	}
+}
+
+func (e *binaryEncoder) writeVarint(i int64) error {
+	n := binary.PutVarint(e.scratch[:], i)
+	_, err := e.w.Write(e.scratch[:n])
+	return err
+}
+
+func (e *binaryEncoder) writeUvarint(u uint64) error {
+	n := binary.PutUvarint(e.scratch[:], u)
+	_, err := e.w.Write(e.scratch[:n])
+	return err
+}
+
+func (e *binaryEncoder) writeBytes(b []byte) error {
+	if err := e.writeUvarint(uint64(len(b))); err != nil {
+		return err
+	}
+	_, err := e.w.Write(b)
+	return err
+}
+
+func (e *binaryEncoder) writeString(s string) error {
+	if err := e.writeUvarint(uint64(len(s))); err != nil {
+		return err
+	}
+	_, err := e.w.WriteString(s)
+	return err
+}
+
+// writeAny writes a value held by an empty interface.
+func (e *binaryEncoder) writeAny(x interface{}) error {
+	switch x := x.(type) {
+	case nil:
+		return e.w.WriteByte(anyNil)
+	case bool:
+		if x {
+			return e.w.WriteByte(anyTrue)
+		}
+		return e.w.WriteByte(anyFalse)
+	case float64:
+		if err := e.w.WriteByte(anyFloat); err != nil {
+			return err
+		}
+		binary.LittleEndian.PutUint64(e.scratch[:8], math.Float64bits(x))
+		_, err := e.w.Write(e.scratch[:8])
+		return err
+	case string:
+		if err := e.w.WriteByte(anyString); err != nil {
+			return err
+		}
+		return e.writeString(x)
+	case []interface{}:
+		if x == nil {
+			return e.w.WriteByte(anyNil)
+		}
+		if err := e.w.WriteByte(anySlice); err != nil {
+			return err
+		}
+		if err := e.writeUvarint(uint64(len(x))); err != nil {
+			return err
+		}
+		for _, el := range x {
+			if err := e.writeAny(el); err != nil {
+				return err
+			}
+		}
+		return nil
+	case map[string]interface{}:
+		if x == nil {
+			return e.w.WriteByte(anyNil)
+		}
+		if err := e.w.WriteByte(anyMap); err != nil {
+			return err
+		}
+		if err := e.writeUvarint(uint64(len(x))); err != nil {
+			return err
+		}
+		for k, el := range x {
+			if err := e.writeString(k); err != nil {
+				return err
+			}
+			if err := e.writeAny(el); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		b, err := json.Marshal(x)
+		if err != nil {
+			return err
+		}
+		if err = e.w.WriteByte(anyJSON); err != nil {
+			return err
+		}
+		return e.writeBytes(b)
+	}
+}
+
+// readLength reads the length of a slice or map, which is -1 if it is nil.
+func (d *binaryDecoder) readLength() (int, error) {
+	u, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return 0, err
+	}
+	if u > maxBinaryLength {
+		return 0, fmt.Errorf("length %d is too large", u)
+	}
+	return int(u) - 1, nil
+}
+
+func (d *binaryDecoder) readBytes() ([]byte, error) {
+	u, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return nil, err
+	}
+	if u > maxBinaryLength {
+		return nil, fmt.Errorf("length %d is too large", u)
+	}
+	b := make([]byte, u)
+	_, err = io.ReadFull(d.r, b)
+	return b, err
+}
+
+// readAny reads a value held by an empty interface.
+func (d *binaryDecoder) readAny() (interface{}, error) {
+	tag, err := d.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch tag {
+	case anyNil:
+		return nil, nil
+	case anyFalse:
+		return false, nil
+	case anyTrue:
+		return true, nil
+	case anyFloat:
+		var b [8]byte
+		if _, err = io.ReadFull(d.r, b[:]); err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(b[:])), nil
+	case anyString:
+		b, err := d.readBytes()
+		return string(b), err
+	case anySlice:
+		n, err := d.readCount()
+		if err != nil {
+			return nil, err
+		}
+		s := make([]interface{}, n)
+		for i := range s {
+			if s[i], err = d.readAny(); err != nil {
+				return nil, err
+			}
+		}
+		return s, nil
+	case anyMap:
+		n, err := d.readCount()
+		if err != nil {
+			return nil, err
+		}
+		m := make(map[string]interface{}, n)
+		for i := 0; i < n; i++ {
+			k, err := d.readBytes()
+			if err != nil {
+				return nil, err
+			}
+			if m[string(k)], err = d.readAny(); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case anyJSON:
+		b, err := d.readBytes()
+		if err != nil {
+			return nil, err
+		}
+		var x interface{}
+		err = json.Unmarshal(b, &x)
+		return x, err
+	default:
+		return nil, fmt.Errorf("unknown value tag %d", tag)
+	}
+}
+
+// readCount reads the number of elements of a slice or map held by an empty
+// interface.
+func (d *binaryDecoder) readCount() (int, error) {
+	u, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return 0, err
+	}
+	if u > maxBinaryLength {
+		return 0, fmt.Errorf("length %d is too large", u)
+	}
+	return int(u), nil
+}
@@ -0,0 +1,260 @@
+package httputil
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/test"
+)
+
+type binaryTestKey struct {
+	ServerName gomatrixserverlib.ServerName
+	KeyID      gomatrixserverlib.KeyID
+}
+
+type binaryTestEmbedded struct {
+	Embedded string
+}
+
+type binaryTestValue struct {
+	binaryTestEmbedded
+	Bool      bool
+	Int       int
+	Negative  int64
+	Uint8     uint8
+	Float     float64
+	String    string
+	Bytes     []byte
+	NilSlice  []string
+	Empty     []string
+	Array     [2]int
+	Map       map[binaryTestKey][]int
+	NilMap    map[string]string
+	Pointer   *binaryTestValue
+	Time      time.Time
+	Timestamp gomatrixserverlib.Timestamp
+	RawJSON   json.RawMessage
+	Any       interface{}
+	Ignored   string `json:"-"`
+	private   string
+}
+
+func roundTripBinary(t *testing.T, in, out interface{}) {
+	t.Helper()
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	if err := encodeBinary(w, in); err != nil {
+		t.Fatalf("failed to encode: %s", err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("failed to flush: %s", err)
+	}
+	r := bufio.NewReader(&buf)
+	if err := decodeBinary(r, out); err != nil {
+		t.Fatalf("failed to decode: %s", err)
+	}
+	if r.Buffered() != 0 {
+		t.Fatalf("%d bytes left after decoding", r.Buffered())
+	}
+}
+
+func TestBinaryEncoding(t *testing.T) {
+	in := binaryTestValue{
+		binaryTestEmbedded: binaryTestEmbedded{Embedded: "embedded"},
+		Bool:               true,
+		Int:                1 << 40,
+		Negative:           -42,
+		Uint8:              255,
+		Float:              3.25,
+		String:             "héllo",
+		Bytes:              []byte{0, 1, 2},
+		Empty:              []string{},
+		Array:              [2]int{1, 2},
+		Map: map[binaryTestKey][]int{
+			{ServerName: "a.test", KeyID: "ed25519:1"}: {1, 2},
+			{ServerName: "b.test", KeyID: "ed25519:2"}: nil,
+		},
+		Pointer:   &binaryTestValue{String: "nested", RawJSON: json.RawMessage(`[]`)},
+		Time:      time.Date(2022, 10, 1, 12, 0, 0, 5, time.UTC),
+		Timestamp: 1234567890,
+		RawJSON:   json.RawMessage(`{"a":[1,2]}`),
+		Any:       map[string]interface{}{"b": "c"},
+		Ignored:   "ignored",
+		private:   "private",
+	}
+	var out binaryTestValue
+	roundTripBinary(t, &in, &out)
+
+	want := in
+	want.Ignored, want.private = "", ""
+	if !reflect.DeepEqual(out, want) {
+		t.Fatalf("round trip mismatch:\ngot  %+v\nwant %+v", out, want)
+	}
+	if out.NilSlice != nil || out.Empty == nil || out.NilMap != nil {
+		t.Fatalf("expected nil and empty values to be kept apart")
+	}
+}
+
+func TestBinaryEncodingAny(t *testing.T) {
+	// Values held by empty interfaces are decoded like encoding/json does.
+	in := map[string]interface{}{
+		"null":   nil,
+		"bool":   true,
+		"number": 1.5,
+		"string": "héllo",
+		"array":  []interface{}{false, 2.0, "x", []interface{}{}},
+		"object": map[string]interface{}{"nested": map[string]interface{}{}},
+		"nil":    []interface{}(nil),
+		"other":  map[string]int{"a": 1},
+	}
+	var out, want map[string]interface{}
+	roundTripBinary(t, &in, &out)
+	inJSON, err := json.Marshal(in)
+	if err != nil {
+		t.Fatalf("failed to marshal: %s", err)
+	}
+	if err = json.Unmarshal(inJSON, &want); err != nil {
+		t.Fatalf("failed to unmarshal: %s", err)
+	}
+	if !reflect.DeepEqual(out, want) {
+		t.Fatalf("round trip mismatch:\ngot  %#v\nwant %#v", out, want)
+	}
+}
+
+func TestBinaryEncodingEvents(t *testing.T) {
+	alice := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	in := api.QueryEventsByIDResponse{
+		Events: room.Events(),
+	}
+	var out api.QueryEventsByIDResponse
+	roundTripBinary(t, &in, &out)
+
+	inJSON, err := json.Marshal(in)
+	if err != nil {
+		t.Fatalf("failed to marshal: %s", err)
+	}
+	outJSON, err := json.Marshal(out)
+	if err != nil {
+		t.Fatalf("failed to marshal: %s", err)
+	}
+	if !bytes.Equal(inJSON, outJSON) {
+		t.Fatalf("round trip mismatch:\ngot  %s\nwant %s", outJSON, inJSON)
+	}
+	for i := range in.Events {
+		if out.Events[i].RoomVersion != in.Events[i].RoomVersion {
+			t.Fatalf("expected room version %s, got %s", in.Events[i].RoomVersion, out.Events[i].RoomVersion)
+		}
+	}
+
+	// Events are encoded without the headers which JSON adds to them, and
+	// keep whether they are redacted.
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	if err = encodeBinary(w, &in); err != nil {
+		t.Fatalf("failed to encode: %s", err)
+	}
+	_ = w.Flush()
+	if bytes.Contains(buf.Bytes(), []byte("_room_version")) {
+		t.Fatalf("expected the events to be encoded natively")
+	}
+	redacted, err := gomatrixserverlib.NewEventFromTrustedJSON(in.Events[0].JSON(), true, in.Events[0].RoomVersion)
+	if err != nil {
+		t.Fatalf("failed to load event: %s", err)
+	}
+	events := []*gomatrixserverlib.Event{redacted, nil}
+	var outEvents []*gomatrixserverlib.Event
+	roundTripBinary(t, &events, &outEvents)
+	if len(outEvents) != 2 || outEvents[1] != nil {
+		t.Fatalf("expected an event and nil, got %v", outEvents)
+	}
+	if !outEvents[0].Redacted() || outEvents[0].EventID() != redacted.EventID() || !bytes.Equal(outEvents[0].JSON(), redacted.JSON()) {
+		t.Fatalf("expected the redacted event %s, got %s", redacted.EventID(), outEvents[0].EventID())
+	}
+}
+
+func TestBinaryInternalAPI(t *testing.T) {
+	type request struct {
+		Name string
+	}
+	type response struct {
+		Greeting    string
+		HasDeadline bool
+	}
+	var contentType string
+	handler := MakeInternalRPCAPI("BinaryInternalAPITest", func(ctx context.Context, req *request, res *response) error {
+		if req.Name == "" {
+			return errors.New("no name given")
+		}
+		_, res.HasDeadline = ctx.Deadline()
+		res.Greeting = "hello " + req.Name
+		return nil
+	})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		handler.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	for _, client := range []*http.Client{srv.Client(), WithBinaryEncoding(srv.Client())} {
+		wantContentType := "application/json"
+		if usesBinaryEncoding(client) {
+			wantContentType = BinaryContentType
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		var res response
+		err := CallInternalRPCAPI("Test", srv.URL+"/test", client, ctx, &request{Name: "alice"}, &res)
+		cancel()
+		if err != nil {
+			t.Fatalf("call failed: %s", err)
+		}
+		if contentType != wantContentType {
+			t.Fatalf("expected content type %s, got %s", wantContentType, contentType)
+		}
+		if res.Greeting != "hello alice" || !res.HasDeadline {
+			t.Fatalf("unexpected response %+v", res)
+		}
+
+		if err = CallInternalRPCAPI("Test", srv.URL+"/test", client, context.Background(), &request{}, &res); err == nil {
+			t.Fatalf("expected an error")
+		}
+	}
+}
+
+func BenchmarkQueryEventsByIDResponse(b *testing.B) {
+	t := &testing.T{}
+	alice := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	res := api.QueryEventsByIDResponse{
+		Events: room.Events(),
+	}
+	b.Run("JSON", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			data, _ := json.Marshal(&res)
+			var out api.QueryEventsByIDResponse
+			_ = json.Unmarshal(data, &out)
+		}
+	})
+	b.Run("Binary", func(b *testing.B) {
+		var buf bytes.Buffer
+		for i := 0; i < b.N; i++ {
+			buf.Reset()
+			w := bufio.NewWriter(&buf)
+			_ = encodeBinary(w, &res)
+			_ = w.Flush()
+			var out api.QueryEventsByIDResponse
+			_ = decodeBinary(bufio.NewReader(&buf), &out)
+		}
+	})
+}
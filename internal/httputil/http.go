@@ -15,6 +15,7 @@
 package httputil
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
@@ -22,17 +23,19 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
-	opentracing "github.com/opentracing/opentracing-go"
-	"github.com/opentracing/opentracing-go/ext"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
 )
 
 // PostJSON performs a POST request with JSON on an internal HTTP API.
 // The error will match the errtype if returned from the remote API, or
 // will be a different type if there was a problem reaching the API.
 func PostJSON[reqtype, restype any, errtype error](
-	ctx context.Context, span opentracing.Span, httpClient *http.Client,
+	ctx context.Context, httpClient *http.Client,
 	apiURL string, request *reqtype, response *restype,
 ) error {
 	jsonBytes, err := json.Marshal(request)
@@ -40,54 +43,97 @@ func PostJSON[reqtype, restype any, errtype error](
 		return err
 	}
 
-	parsedAPIURL, err := url.Parse(apiURL)
+	res, err := postInternal[errtype](ctx, httpClient, apiURL, "application/json", jsonBytes)
+	if res != nil {
+		defer (func() { err = res.Body.Close() })()
+	}
 	if err != nil {
 		return err
 	}
-
-	parsedAPIURL.Path = InternalPathPrefix + strings.TrimLeft(parsedAPIURL.Path, "/")
-	apiURL = parsedAPIURL.String()
-
-	req, err := http.NewRequest(http.MethodPost, apiURL, bytes.NewReader(jsonBytes))
+	var body []byte
+	body, err = io.ReadAll(res.Body)
 	if err != nil {
 		return err
 	}
+	if err = json.Unmarshal(body, response); err != nil {
+		return fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	return nil
+}
 
-	// Mark the span as being an RPC client.
-	ext.SpanKindRPCClient.Set(span)
-	carrier := opentracing.HTTPHeadersCarrier(req.Header)
-	tracer := opentracing.GlobalTracer()
-
-	if err = tracer.Inject(span.Context(), opentracing.HTTPHeaders, carrier); err != nil {
+// PostBinary performs a POST request with the binary encoding on an internal
+// HTTP API. The response is decoded while it is being received. Errors are
+// returned like by PostJSON.
+func PostBinary[reqtype, restype any, errtype error](
+	ctx context.Context, httpClient *http.Client,
+	apiURL string, request *reqtype, response *restype,
+) error {
+	var buf bytes.Buffer
+	bw := bufio.NewWriter(&buf)
+	if err := encodeBinary(bw, request); err != nil {
+		return fmt.Errorf("encodeBinary: %w", err)
+	}
+	if err := bw.Flush(); err != nil {
 		return err
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-
-	res, err := httpClient.Do(req.WithContext(ctx))
+	res, err := postInternal[errtype](ctx, httpClient, apiURL, BinaryContentType, buf.Bytes())
 	if res != nil {
 		defer (func() { err = res.Body.Close() })()
 	}
 	if err != nil {
 		return err
 	}
-	var body []byte
-	body, err = io.ReadAll(res.Body)
+	if err = decodeBinary(bufio.NewReader(res.Body), response); err != nil {
+		return fmt.Errorf("decodeBinary: %w", err)
+	}
+	return nil
+}
+
+// postInternal performs a POST request on an internal HTTP API, passing on the
+// trace context and the deadline of the context. If the response isn't successful,
+// it returns the error of the remote API.
+func postInternal[errtype error](
+	ctx context.Context, httpClient *http.Client,
+	apiURL, contentType string, body []byte,
+) (*http.Response, error) {
+	parsedAPIURL, err := url.Parse(apiURL)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	parsedAPIURL.Path = InternalPathPrefix + strings.TrimLeft(parsedAPIURL.Path, "/")
+	apiURL = parsedAPIURL.String()
+
+	req, err := http.NewRequest(http.MethodPost, apiURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	req.Header.Set("Content-Type", contentType)
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Header.Set(InternalAPITimeoutHeader, strconv.FormatInt(time.Until(deadline).Milliseconds(), 10))
+	}
+
+	res, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return res, err
 	}
 	if res.StatusCode != http.StatusOK {
-		if len(body) == 0 {
-			return fmt.Errorf("HTTP %d from %s (no response body)", res.StatusCode, apiURL)
+		var resBody []byte
+		resBody, err = io.ReadAll(res.Body)
+		if err != nil {
+			return res, err
+		}
+		if len(resBody) == 0 {
+			return res, fmt.Errorf("HTTP %d from %s (no response body)", res.StatusCode, apiURL)
 		}
 		var reserr errtype
-		if err = json.Unmarshal(body, reserr); err != nil {
-			return fmt.Errorf("HTTP %d from %s", res.StatusCode, apiURL)
+		if err = json.Unmarshal(resBody, reserr); err != nil {
+			return res, fmt.Errorf("HTTP %d from %s", res.StatusCode, apiURL)
 		}
-		return reserr
+		return res, reserr
 	}
-	if err = json.Unmarshal(body, response); err != nil {
-		return fmt.Errorf("json.Unmarshal: %w", err)
-	}
-	return nil
+	return res, nil
 }
@@ -15,27 +15,33 @@
 package httputil
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/getsentry/sentry-go"
 	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/util"
-	opentracing "github.com/opentracing/opentracing-go"
-	"github.com/opentracing/opentracing-go/ext"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var tracer = otel.Tracer("github.com/matrix-org/dendrite/internal/httputil")
+
 // BasicAuth is used for authorization on /metrics handlers
 type BasicAuth struct {
 	Username string `yaml:"username"`
@@ -153,9 +159,9 @@ func MakeExternalAPI(metricsName string, f func(*http.Request) util.JSONResponse
 			}
 		}
 
-		span := opentracing.StartSpan(metricsName)
-		defer span.Finish()
-		req = req.WithContext(opentracing.ContextWithSpan(req.Context(), span))
+		ctx, span := tracer.Start(req.Context(), metricsName, trace.WithSpanKind(trace.SpanKindServer))
+		defer span.End()
+		req = req.WithContext(ctx)
 		h.ServeHTTP(nextWriter, req)
 
 	}
@@ -167,9 +173,9 @@ func MakeExternalAPI(metricsName string, f func(*http.Request) util.JSONResponse
 // This is used to serve HTML alongside JSON error messages
 func MakeHTMLAPI(metricsName string, f func(http.ResponseWriter, *http.Request) *util.JSONResponse) http.Handler {
 	withSpan := func(w http.ResponseWriter, req *http.Request) {
-		span := opentracing.StartSpan(metricsName)
-		defer span.Finish()
-		req = req.WithContext(opentracing.ContextWithSpan(req.Context(), span))
+		ctx, span := tracer.Start(req.Context(), metricsName, trace.WithSpanKind(trace.SpanKindServer))
+		defer span.End()
+		req = req.WithContext(ctx)
 		if err := f(w, req); err != nil {
 			h := util.MakeJSONAPI(util.NewJSONRequestHandler(func(req *http.Request) util.JSONResponse {
 				return *err
@@ -196,21 +202,23 @@ func MakeHTMLAPI(metricsName string, f func(http.ResponseWriter, *http.Request)
 // If we are passed a tracing context in the request headers then we use that
 // as the parent of any tracing spans we create.
 func MakeInternalAPI(metricsName string, f func(*http.Request) util.JSONResponse) http.Handler {
-	h := util.MakeJSONAPI(util.NewJSONRequestHandler(f))
+	return makeInternalAPI(metricsName, util.MakeJSONAPI(util.NewJSONRequestHandler(f)))
+}
+
+// makeInternalAPI wraps the handler of an internal API with tracing, metrics
+// and the timeout requested by the caller.
+func makeInternalAPI(metricsName string, h http.Handler) http.Handler {
 	withSpan := func(w http.ResponseWriter, req *http.Request) {
-		carrier := opentracing.HTTPHeadersCarrier(req.Header)
-		tracer := opentracing.GlobalTracer()
-		clientContext, err := tracer.Extract(opentracing.HTTPHeaders, carrier)
-		var span opentracing.Span
-		if err == nil {
-			// Default to a span without RPC context.
-			span = tracer.StartSpan(metricsName)
-		} else {
-			// Set the RPC context.
-			span = tracer.StartSpan(metricsName, ext.RPCServerOption(clientContext))
+		if timeout, err := strconv.ParseInt(req.Header.Get(InternalAPITimeoutHeader), 10, 64); err == nil {
+			ctx, cancel := context.WithTimeout(req.Context(), time.Duration(timeout)*time.Millisecond)
+			defer cancel()
+			req = req.WithContext(ctx)
 		}
-		defer span.Finish()
-		req = req.WithContext(opentracing.ContextWithSpan(req.Context(), span))
+		// Continue the trace of the caller, if it sent a traceparent.
+		ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+		ctx, span := tracer.Start(ctx, metricsName, trace.WithSpanKind(trace.SpanKindServer))
+		defer span.End()
+		req = req.WithContext(ctx)
 		h.ServeHTTP(w, req)
 	}
 
@@ -15,9 +15,16 @@
 package httputil
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func TestWrapHandlerInBasicAuth(t *testing.T) {
@@ -107,3 +114,65 @@ func TestWrapHandlerInBasicAuth(t *testing.T) {
 		})
 	}
 }
+
+func TestInternalAPITracePropagation(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer func() {
+		otel.SetTracerProvider(trace.NewNoopTracerProvider())
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	}()
+
+	type request struct{}
+	type response struct{}
+	var traceparent string
+	var handlerSpan trace.SpanContext
+	handler := MakeInternalRPCAPI("TracingInternalAPITest", func(ctx context.Context, req *request, res *response) error {
+		handlerSpan = trace.SpanContextFromContext(ctx)
+		return nil
+	})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		handler.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	ctx, caller := provider.Tracer("test").Start(context.Background(), "caller")
+	if err := CallInternalRPCAPI("Test", srv.URL+"/test", srv.Client(), ctx, &request{}, &response{}); err != nil {
+		t.Fatalf("call failed: %s", err)
+	}
+	caller.End()
+
+	if traceparent == "" {
+		t.Fatalf("expected the request to have a traceparent header")
+	}
+	if handlerSpan.TraceID() != caller.SpanContext().TraceID() {
+		t.Fatalf("expected the handler to continue the trace of the caller")
+	}
+	spans := recorder.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("expected 3 spans to be recorded, got %d", len(spans))
+	}
+	// The server span is a child of the client span, which is a child of
+	// the span of the caller.
+	var server, client sdktrace.ReadOnlySpan
+	for _, span := range spans {
+		switch span.SpanKind() {
+		case trace.SpanKindServer:
+			server = span
+		case trace.SpanKindClient:
+			client = span
+		}
+	}
+	if server == nil || client == nil {
+		t.Fatalf("expected a server and a client span")
+	}
+	if server.Parent().SpanID() != client.SpanContext().SpanID() {
+		t.Fatalf("expected the server span to be a child of the client span")
+	}
+	if client.Parent().SpanID() != caller.SpanContext().SpanID() {
+		t.Fatalf("expected the client span to be a child of the span of the caller")
+	}
+}
@@ -15,6 +15,7 @@
 package httputil
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -22,7 +23,7 @@ import (
 	"reflect"
 
 	"github.com/matrix-org/util"
-	opentracing "github.com/opentracing/opentracing-go"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type InternalAPIError struct {
@@ -34,11 +35,83 @@ func (e InternalAPIError) Error() string {
 	return fmt.Sprintf("internal API returned %q error: %s", e.Type, e.Message)
 }
 
+// InternalAPITimeoutHeader is the header in which callers of the internal APIs
+// send the time in milliseconds until the deadline of the call, if it has one.
+const InternalAPITimeoutHeader = "X-Dendrite-Timeout"
+
+// binaryEncodingTransport marks the clients which call the internal APIs using
+// the binary encoding.
+type binaryEncodingTransport struct {
+	http.RoundTripper
+}
+
+// WithBinaryEncoding returns a copy of the client which calls the internal APIs
+// using the binary encoding instead of JSON.
+func WithBinaryEncoding(client *http.Client) *http.Client {
+	transport := client.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	c := *client
+	c.Transport = binaryEncodingTransport{transport}
+	return &c
+}
+
+func usesBinaryEncoding(client *http.Client) bool {
+	_, ok := client.Transport.(binaryEncodingTransport)
+	return ok
+}
+
+// makeInternalRPCAPI creates the handler of an internal API which accepts requests
+// and sends responses using JSON or the binary encoding, depending on the content
+// type of the request. Responses using the binary encoding are encoded straight
+// onto the connection rather than into a buffer first, although the internal API
+// still builds the whole response before any of it is sent. Errors are always
+// sent as JSON.
+func makeInternalRPCAPI(metricsName string, f func(req *http.Request, decode func(interface{}) error) util.JSONResponse) http.Handler {
+	jsonHandler := util.MakeJSONAPI(util.NewJSONRequestHandler(func(req *http.Request) util.JSONResponse {
+		return f(req, json.NewDecoder(req.Body).Decode)
+	}))
+	binaryHandler := util.Protect(func(w http.ResponseWriter, req *http.Request) {
+		req = util.RequestWithLogging(req)
+		res := f(req, func(v interface{}) error {
+			return decodeBinary(bufio.NewReader(req.Body), v)
+		})
+		if res.Code != http.StatusOK {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(res.Code)
+			_ = json.NewEncoder(w).Encode(res.JSON)
+			return
+		}
+		if v := reflect.ValueOf(res.JSON); v.Kind() == reflect.Pointer && v.IsNil() {
+			// A nil response is sent as the zero value, which is what the
+			// caller is left with when decoding a JSON null anyway.
+			res.JSON = reflect.New(v.Type().Elem()).Interface()
+		}
+		w.Header().Set("Content-Type", BinaryContentType)
+		w.WriteHeader(http.StatusOK)
+		bw := bufio.NewWriter(w)
+		if err := encodeBinary(bw, res.JSON); err != nil {
+			// The response is cut short, so the caller fails to decode it.
+			util.GetLogger(req.Context()).WithError(err).Error("Failed to encode binary response")
+			return
+		}
+		_ = bw.Flush()
+	})
+	return makeInternalAPI(metricsName, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Content-Type") == BinaryContentType {
+			binaryHandler.ServeHTTP(w, req)
+		} else {
+			jsonHandler.ServeHTTP(w, req)
+		}
+	}))
+}
+
 func MakeInternalRPCAPI[reqtype, restype any](metricsName string, f func(context.Context, *reqtype, *restype) error) http.Handler {
-	return MakeInternalAPI(metricsName, func(req *http.Request) util.JSONResponse {
+	return makeInternalRPCAPI(metricsName, func(req *http.Request, decode func(interface{}) error) util.JSONResponse {
 		var request reqtype
 		var response restype
-		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		if err := decode(&request); err != nil {
 			return util.MessageResponse(http.StatusBadRequest, err.Error())
 		}
 		if err := f(req.Context(), &request, &response); err != nil {
@@ -58,9 +131,9 @@ func MakeInternalRPCAPI[reqtype, restype any](metricsName string, f func(context
 }
 
 func MakeInternalProxyAPI[reqtype, restype any](metricsName string, f func(context.Context, *reqtype) (*restype, error)) http.Handler {
-	return MakeInternalAPI(metricsName, func(req *http.Request) util.JSONResponse {
+	return makeInternalRPCAPI(metricsName, func(req *http.Request, decode func(interface{}) error) util.JSONResponse {
 		var request reqtype
-		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		if err := decode(&request); err != nil {
 			return util.MessageResponse(http.StatusBadRequest, err.Error())
 		}
 		response, err := f(req.Context(), &request)
@@ -78,16 +151,22 @@ func MakeInternalProxyAPI[reqtype, restype any](metricsName string, f func(conte
 }
 
 func CallInternalRPCAPI[reqtype, restype any](name, url string, client *http.Client, ctx context.Context, request *reqtype, response *restype) error {
-	span, ctx := opentracing.StartSpanFromContext(ctx, name)
-	defer span.Finish()
+	ctx, span := tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
 
-	return PostJSON[reqtype, restype, InternalAPIError](ctx, span, client, url, request, response)
+	if usesBinaryEncoding(client) {
+		return PostBinary[reqtype, restype, InternalAPIError](ctx, client, url, request, response)
+	}
+	return PostJSON[reqtype, restype, InternalAPIError](ctx, client, url, request, response)
 }
 
 func CallInternalProxyAPI[reqtype, restype any, errtype error](name, url string, client *http.Client, ctx context.Context, request *reqtype) (restype, error) {
-	span, ctx := opentracing.StartSpanFromContext(ctx, name)
-	defer span.Finish()
+	ctx, span := tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
 
 	var response restype
-	return response, PostJSON[reqtype, restype, errtype](ctx, span, client, url, request, &response)
+	if usesBinaryEncoding(client) {
+		return response, PostBinary[reqtype, restype, errtype](ctx, client, url, request, &response)
+	}
+	return response, PostJSON[reqtype, restype, errtype](ctx, client, url, request, &response)
 }
@@ -15,6 +15,8 @@ type RateLimits struct {
 	limits           map[string]chan struct{}
 	limitsMutex      sync.RWMutex
 	cleanMutex       sync.RWMutex
+	cleanOnce        sync.Once
+	settingsMutex    sync.RWMutex
 	enabled          bool
 	requestThreshold int64
 	cooloffDuration  time.Duration
@@ -23,19 +25,31 @@ type RateLimits struct {
 
 func NewRateLimits(cfg *config.RateLimiting) *RateLimits {
 	l := &RateLimits{
-		limits:           make(map[string]chan struct{}),
-		enabled:          cfg.Enabled,
-		requestThreshold: cfg.Threshold,
-		cooloffDuration:  time.Duration(cfg.CooloffMS) * time.Millisecond,
-		exemptUserIDs:    map[string]struct{}{},
+		limits: make(map[string]chan struct{}),
 	}
+	l.Update(cfg)
+	return l
+}
+
+// Update applies new rate limiting settings, e.g. when the config is reloaded.
+// Callers which are already being rate limited keep their existing limits until
+// their requests have cooled off.
+func (l *RateLimits) Update(cfg *config.RateLimiting) {
+	exemptUserIDs := make(map[string]struct{}, len(cfg.ExemptUserIDs))
 	for _, userID := range cfg.ExemptUserIDs {
-		l.exemptUserIDs[userID] = struct{}{}
+		exemptUserIDs[userID] = struct{}{}
 	}
-	if l.enabled {
-		go l.clean()
+	l.settingsMutex.Lock()
+	l.enabled = cfg.Enabled
+	l.requestThreshold = cfg.Threshold
+	l.cooloffDuration = time.Duration(cfg.CooloffMS) * time.Millisecond
+	l.exemptUserIDs = exemptUserIDs
+	l.settingsMutex.Unlock()
+	if cfg.Enabled {
+		l.cleanOnce.Do(func() {
+			go l.clean()
+		})
 	}
-	return l
 }
 
 func (l *RateLimits) clean() {
@@ -59,8 +73,12 @@ func (l *RateLimits) clean() {
 }
 
 func (l *RateLimits) Limit(req *http.Request, device *userapi.Device) *util.JSONResponse {
+	l.settingsMutex.RLock()
+	enabled, requestThreshold, cooloffDuration, exemptUserIDs := l.enabled, l.requestThreshold, l.cooloffDuration, l.exemptUserIDs
+	l.settingsMutex.RUnlock()
+
 	// If rate limiting is disabled then do nothing.
-	if !l.enabled {
+	if !enabled {
 		return nil
 	}
 
@@ -81,7 +99,7 @@ func (l *RateLimits) Limit(req *http.Request, device *userapi.Device) *util.JSON
 		case userapi.AccountTypeAppService:
 			return nil // don't rate-limit appservice users
 		default:
-			if _, ok := l.exemptUserIDs[device.UserID]; ok {
+			if _, ok := exemptUserIDs[device.UserID]; ok {
 				// If the user is exempt from rate limiting then do nothing.
 				return nil
 			}
@@ -103,7 +121,7 @@ func (l *RateLimits) Limit(req *http.Request, device *userapi.Device) *util.JSON
 	// If the caller doesn't have a channel, create one and write it
 	// back to the map.
 	if !ok {
-		rateLimit = make(chan struct{}, l.requestThreshold)
+		rateLimit = make(chan struct{}, requestThreshold)
 
 		l.limitsMutex.Lock()
 		l.limits[caller] = rateLimit
@@ -118,14 +136,14 @@ func (l *RateLimits) Limit(req *http.Request, device *userapi.Device) *util.JSON
 		// We hit the rate limit. Tell the client to back off.
 		return &util.JSONResponse{
 			Code: http.StatusTooManyRequests,
-			JSON: jsonerror.LimitExceeded("You are sending too many requests too quickly!", l.cooloffDuration.Milliseconds()),
+			JSON: jsonerror.LimitExceeded("You are sending too many requests too quickly!", cooloffDuration.Milliseconds()),
 		}
 	}
 
 	// After the time interval, drain a resource from the rate limiting
 	// channel. This will free up space in the channel for new requests.
 	go func() {
-		<-time.After(l.cooloffDuration)
+		<-time.After(cooloffDuration)
 		<-rateLimit
 	}()
 	return nil
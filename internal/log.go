@@ -22,13 +22,16 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"strings"
+	"sync"
 
 	"github.com/matrix-org/util"
 
 	"github.com/matrix-org/dugong"
 	"github.com/sirupsen/logrus"
+	"go.uber.org/atomic"
 
 	"github.com/matrix-org/dendrite/setup/config"
 )
@@ -46,21 +49,84 @@ func (f utcFormatter) Format(entry *logrus.Entry) ([]byte, error) {
 // (Note that we cannot use solely logrus.SetLevel, because Dendrite supports multiple
 // levels of logging at the same time.)
 type logLevelHook struct {
-	level logrus.Level
+	level atomic.Uint32
 	logrus.Hook
 }
 
-// Levels returns all the levels supported by this hook.
+func newLogLevelHook(level logrus.Level, hook logrus.Hook) *logLevelHook {
+	h := &logLevelHook{Hook: hook}
+	h.level.Store(uint32(level))
+	logrus.AddHook(h)
+	return h
+}
+
+// Levels returns all levels, as logrus only asks for them when the hook is added,
+// but the level of the hook can be changed when the config is reloaded.
 func (h *logLevelHook) Levels() []logrus.Level {
-	levels := make([]logrus.Level, 0)
+	return logrus.AllLevels
+}
+
+// Fire passes the log entry on to the wrapped hook if the entry is at the level
+// of the hook or above.
+func (h *logLevelHook) Fire(entry *logrus.Entry) error {
+	if entry.Level > logrus.Level(h.level.Load()) {
+		return nil
+	}
+	return h.Hook.Fire(entry)
+}
+
+// configuredHook is a logging hook which was set up from the config.
+type configuredHook struct {
+	config config.LogrusHook
+	hook   *logLevelHook // nil if the hook couldn't be set up
+}
+
+var (
+	configuredHooks      []configuredHook
+	configuredHooksMutex sync.Mutex
+)
 
-	for _, level := range logrus.AllLevels {
-		if level <= h.level {
-			levels = append(levels, level)
+// SetHookLogLevels changes the levels of the logging hooks which were set up by
+// SetupHookLogging, e.g. when the config is reloaded. Logging hooks can't be added,
+// removed or changed otherwise without restarting, so an error is returned if they
+// differ from the ones which were set up.
+func SetHookLogLevels(hooks []config.LogrusHook) error {
+	configuredHooksMutex.Lock()
+	defer configuredHooksMutex.Unlock()
+	if len(hooks) != len(configuredHooks) {
+		return fmt.Errorf("logging hooks were added or removed")
+	}
+	levels := make([]logrus.Level, len(hooks))
+	for i, hook := range hooks {
+		if hook.Type != configuredHooks[i].config.Type || !reflect.DeepEqual(hook.Params, configuredHooks[i].config.Params) {
+			return fmt.Errorf("logging hook %d was changed", i)
+		}
+		level, err := logrus.ParseLevel(hook.Level)
+		if err != nil {
+			return fmt.Errorf("unrecognised logging level %s: %w", hook.Level, err)
 		}
+		levels[i] = level
 	}
 
-	return levels
+	// As in SetupHookLogging, prevent logrus from processing logs which no hook wants.
+	maxLevel := logrus.InfoLevel
+	for i, level := range levels {
+		if configuredHooks[i].hook != nil {
+			configuredHooks[i].hook.level.Store(uint32(level))
+		}
+		configuredHooks[i].config.Level = hooks[i].Level
+		if level > maxLevel {
+			maxLevel = level
+		}
+	}
+	logrus.SetLevel(maxLevel)
+	return nil
+}
+
+func addConfiguredHook(hook config.LogrusHook, h *logLevelHook) {
+	configuredHooksMutex.Lock()
+	defer configuredHooksMutex.Unlock()
+	configuredHooks = append(configuredHooks, configuredHook{hook, h})
 }
 
 // callerPrettyfier is a function that given a runtime.Frame object, will
@@ -120,7 +186,7 @@ func checkFileHookParams(params map[string]interface{}) {
 }
 
 // Add a new FSHook to the logger. Each component will log in its own file
-func setupFileHook(hook config.LogrusHook, level logrus.Level, componentName string) {
+func setupFileHook(hook config.LogrusHook, level logrus.Level, componentName string) *logLevelHook {
 	dirPath := (hook.Params["path"]).(string)
 	fullPath := filepath.Join(dirPath, componentName+".log")
 
@@ -128,7 +194,7 @@ func setupFileHook(hook config.LogrusHook, level logrus.Level, componentName str
 		logrus.Fatalf("Couldn't create directory %s: %q", path.Dir(fullPath), err)
 	}
 
-	logrus.AddHook(&logLevelHook{
+	return newLogLevelHook(
 		level,
 		dugong.NewFSHook(
 			fullPath,
@@ -143,7 +209,7 @@ func setupFileHook(hook config.LogrusHook, level logrus.Level, componentName str
 			},
 			&dugong.DailyRotationSchedule{GZip: true},
 		),
-	})
+	)
 }
 
 // CloseAndLogIfError Closes io.Closer and logs the error if any
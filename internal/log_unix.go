@@ -45,19 +45,21 @@ func SetupHookLogging(hooks []config.LogrusHook, componentName string) {
 			logrus.SetLevel(level)
 		}
 
+		var h *logLevelHook
 		switch hook.Type {
 		case "file":
 			checkFileHookParams(hook.Params)
-			setupFileHook(hook, level, componentName)
+			h = setupFileHook(hook, level, componentName)
 		case "syslog":
 			checkSyslogHookParams(hook.Params)
-			setupSyslogHook(hook, level, componentName)
+			h = setupSyslogHook(hook, level, componentName)
 		case "std":
-			setupStdLogHook(level)
+			h = setupStdLogHook(level)
 			stdLogAdded = true
 		default:
 			logrus.Fatalf("Unrecognised logging hook type: %s", hook.Type)
 		}
+		addConfiguredHook(hook, h)
 	}
 	if !stdLogAdded {
 		setupStdLogHook(logrus.InfoLevel)
@@ -87,13 +89,14 @@ func checkSyslogHookParams(params map[string]interface{}) {
 
 }
 
-func setupStdLogHook(level logrus.Level) {
-	logrus.AddHook(&logLevelHook{level, stdemuxerhook.New(logrus.StandardLogger())})
+func setupStdLogHook(level logrus.Level) *logLevelHook {
+	return newLogLevelHook(level, stdemuxerhook.New(logrus.StandardLogger()))
 }
 
-func setupSyslogHook(hook config.LogrusHook, level logrus.Level, componentName string) {
+func setupSyslogHook(hook config.LogrusHook, level logrus.Level, componentName string) *logLevelHook {
 	syslogHook, err := lSyslog.NewSyslogHook(hook.Params["protocol"].(string), hook.Params["address"].(string), syslog.LOG_INFO, componentName)
 	if err == nil {
-		logrus.AddHook(&logLevelHook{level, syslogHook})
+		return newLogLevelHook(level, syslogHook)
 	}
+	return nil
 }
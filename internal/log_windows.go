@@ -37,12 +37,14 @@ func SetupHookLogging(hooks []config.LogrusHook, componentName string) {
 			logrus.SetLevel(level)
 		}
 
+		var h *logLevelHook
 		switch hook.Type {
 		case "file":
 			checkFileHookParams(hook.Params)
-			setupFileHook(hook, level, componentName)
+			h = setupFileHook(hook, level, componentName)
 		default:
 			logrus.Fatalf("Unrecognised logging hook type: %s", hook.Type)
 		}
+		addConfiguredHook(hook, h)
 	}
 }
@@ -0,0 +1,179 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package policy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The kinds of requests sent to the webhook.
+const (
+	requestTypeEvent         = "event"
+	requestTypeCreateRoom    = "create_room"
+	requestTypeInvite        = "invite"
+	requestTypeProfileChange = "profile_change"
+	requestTypeMediaUpload   = "media_upload"
+)
+
+var checkCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "policy",
+		Name:      "checks_total",
+		Help:      "Number of requests checked against the policy webhook, by type and outcome",
+	},
+	[]string{"type", "action"},
+)
+
+func init() {
+	prometheus.MustRegister(checkCounter)
+}
+
+// webhookRequest is the body POSTed to the webhook. Only the fields relevant
+// to the type of request are set.
+type webhookRequest struct {
+	Type    string          `json:"type"`
+	Origin  Origin          `json:"origin,omitempty"`
+	UserID  string          `json:"user_id,omitempty"`
+	RoomID  string          `json:"room_id,omitempty"`
+	Event   json.RawMessage `json:"event,omitempty"`
+	Request json.RawMessage `json:"request,omitempty"`
+	Invitee string          `json:"invitee,omitempty"`
+	Field   string          `json:"field,omitempty"`
+	Value   *string         `json:"value,omitempty"`
+	Upload  *MediaUpload    `json:"upload,omitempty"`
+}
+
+// HTTPChecker is a Checker which asks an HTTP webhook. The webhook is sent a
+// JSON object describing the request, and must respond with a JSON object
+// containing "action" ("allow", "reject" or "soft_fail") and optionally
+// "errcode" and "error" for rejected requests.
+type HTTPChecker struct {
+	url      string
+	failOpen bool
+	client   *http.Client
+}
+
+// NewHTTPChecker creates a Checker which asks the webhook configured in cfg.
+func NewHTTPChecker(cfg *config.Policy) *HTTPChecker {
+	return &HTTPChecker{
+		url:      cfg.URL,
+		failOpen: cfg.FailOpen,
+		client: &http.Client{
+			Timeout: cfg.Timeout,
+		},
+	}
+}
+
+func (c *HTTPChecker) CheckEvent(ctx context.Context, origin Origin, event *gomatrixserverlib.HeaderedEvent) Decision {
+	return c.check(ctx, &webhookRequest{
+		Type:   requestTypeEvent,
+		Origin: origin,
+		UserID: event.Sender(),
+		RoomID: event.RoomID(),
+		Event:  event.JSON(),
+	})
+}
+
+func (c *HTTPChecker) CheckRoomCreation(ctx context.Context, userID string, request json.RawMessage) Decision {
+	return c.check(ctx, &webhookRequest{
+		Type:    requestTypeCreateRoom,
+		UserID:  userID,
+		Request: request,
+	})
+}
+
+func (c *HTTPChecker) CheckInvite(ctx context.Context, inviter, invitee, roomID string) Decision {
+	return c.check(ctx, &webhookRequest{
+		Type:    requestTypeInvite,
+		UserID:  inviter,
+		RoomID:  roomID,
+		Invitee: invitee,
+	})
+}
+
+func (c *HTTPChecker) CheckProfileChange(ctx context.Context, userID, field, value string) Decision {
+	return c.check(ctx, &webhookRequest{
+		Type:   requestTypeProfileChange,
+		UserID: userID,
+		Field:  field,
+		Value:  &value,
+	})
+}
+
+func (c *HTTPChecker) CheckMediaUpload(ctx context.Context, userID string, upload *MediaUpload) Decision {
+	return c.check(ctx, &webhookRequest{
+		Type:   requestTypeMediaUpload,
+		UserID: userID,
+		Upload: upload,
+	})
+}
+
+func (c *HTTPChecker) check(ctx context.Context, req *webhookRequest) Decision {
+	decision, err := c.ask(ctx, req)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).WithField("type", req.Type).Error("Failed to check request against policy webhook")
+		if c.failOpen {
+			decision = Allow
+		} else {
+			decision = Decision{
+				Action:  ActionReject,
+				ErrCode: "M_UNKNOWN",
+				Error:   "Request could not be checked against the server's policy",
+			}
+		}
+	}
+	checkCounter.WithLabelValues(req.Type, string(decision.Action)).Inc()
+	return decision
+}
+
+func (c *HTTPChecker) ask(ctx context.Context, req *webhookRequest) (Decision, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return Decision{}, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return Decision{}, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(httpReq)
+	if err != nil {
+		return Decision{}, err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode != http.StatusOK {
+		return Decision{}, fmt.Errorf("webhook responded with HTTP %d", resp.StatusCode)
+	}
+	var decision Decision
+	if err = json.NewDecoder(resp.Body).Decode(&decision); err != nil {
+		return Decision{}, fmt.Errorf("failed to decode webhook response: %w", err)
+	}
+	switch decision.Action {
+	case ActionAllow, ActionReject, ActionSoftFail:
+		return decision, nil
+	default:
+		return Decision{}, fmt.Errorf("webhook responded with unknown action %q", decision.Action)
+	}
+}
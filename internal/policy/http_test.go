@@ -0,0 +1,95 @@
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func TestHTTPChecker(t *testing.T) {
+	var mu sync.Mutex
+	var last webhookRequest
+	lastRequest := func() webhookRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return last
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req webhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("failed to decode request: %s", err)
+		}
+		mu.Lock()
+		last = req
+		mu.Unlock()
+		switch req.UserID {
+		case "@spammer:test":
+			_, _ = w.Write([]byte(`{"action":"reject","errcode":"M_SPAM","error":"no spam please"}`))
+		case "@shadow:test":
+			_, _ = w.Write([]byte(`{"action":"soft_fail"}`))
+		case "@slow:test":
+			time.Sleep(200 * time.Millisecond)
+			_, _ = w.Write([]byte(`{"action":"reject"}`))
+		case "@broken:test":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "@unknown:test":
+			_, _ = w.Write([]byte(`{"action":"maybe"}`))
+		default:
+			_, _ = w.Write([]byte(`{"action":"allow"}`))
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	cfg := &config.Policy{
+		URL:      srv.URL,
+		Timeout:  50 * time.Millisecond,
+		FailOpen: true,
+	}
+	failOpen := NewHTTPChecker(cfg)
+	cfg.FailOpen = false
+	failClosed := NewHTTPChecker(cfg)
+
+	if d := failOpen.CheckProfileChange(ctx, "@alice:test", "displayname", "Alice"); d.Action != ActionAllow {
+		t.Errorf("expected allow, got %+v", d)
+	}
+	if got := lastRequest(); got.Type != requestTypeProfileChange || got.Field != "displayname" || got.Value == nil || *got.Value != "Alice" {
+		t.Errorf("unexpected webhook request %+v", got)
+	}
+
+	d := failOpen.CheckInvite(ctx, "@spammer:test", "@bob:test", "!room:test")
+	if d.Action != ActionReject || d.ErrCode != "M_SPAM" || d.Error != "no spam please" {
+		t.Errorf("expected rejection with M_SPAM, got %+v", d)
+	}
+	if got := lastRequest(); got.Type != requestTypeInvite || got.Invitee != "@bob:test" || got.RoomID != "!room:test" {
+		t.Errorf("unexpected webhook request %+v", got)
+	}
+	if res := d.RejectResponse(); res.Code != http.StatusForbidden {
+		t.Errorf("expected HTTP 403, got %d", res.Code)
+	}
+
+	if d = failOpen.CheckMediaUpload(ctx, "@shadow:test", &MediaUpload{ContentType: "image/png"}); d.Action != ActionSoftFail || d.Allowed() {
+		t.Errorf("expected soft-fail, got %+v", d)
+	}
+
+	for _, userID := range []string{"@slow:test", "@broken:test", "@unknown:test"} {
+		if d = failOpen.CheckRoomCreation(ctx, userID, json.RawMessage(`{}`)); d.Action != ActionAllow {
+			t.Errorf("%s: expected fail-open checker to allow, got %+v", userID, d)
+		}
+		if d = failClosed.CheckRoomCreation(ctx, userID, json.RawMessage(`{}`)); d.Action != ActionReject {
+			t.Errorf("%s: expected fail-closed checker to reject, got %+v", userID, d)
+		}
+	}
+}
+
+func TestNewCheckerWithoutURL(t *testing.T) {
+	if _, ok := NewChecker(&config.Policy{}).(AllowAll); !ok {
+		t.Errorf("expected a checker which allows everything when no URL is configured")
+	}
+}
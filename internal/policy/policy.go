@@ -0,0 +1,143 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package policy lets a policy module, e.g. a spam checker, decide whether
+// events and other requests are accepted before they are processed. Unlike
+// hooks, policy modules work in both monolith and polylith mode.
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// Action is what should happen to a checked request.
+type Action string
+
+const (
+	// ActionAllow lets the request be processed as normal.
+	ActionAllow Action = "allow"
+	// ActionReject refuses the request with an error.
+	ActionReject Action = "reject"
+	// ActionSoftFail pretends to accept the request but doesn't act on it.
+	// Soft-failed events from federation are stored but never become part
+	// of the room state or are sent to clients. Soft-failed events from local
+	// clients are never sent into the room at all.
+	ActionSoftFail Action = "soft_fail"
+)
+
+// Origin is where a checked event came from.
+type Origin string
+
+const (
+	OriginClient     Origin = "client"
+	OriginFederation Origin = "federation"
+)
+
+// Decision is the outcome of a policy check.
+type Decision struct {
+	Action Action `json:"action"`
+	// ErrCode and Error are returned to the client for rejected requests.
+	ErrCode string `json:"errcode,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Allow is the decision to allow a request.
+var Allow = Decision{Action: ActionAllow}
+
+// Allowed returns true if the request should be processed as normal.
+func (d Decision) Allowed() bool {
+	return d.Action != ActionReject && d.Action != ActionSoftFail
+}
+
+// RejectResponse returns the response to send to the client if the request
+// was rejected.
+func (d Decision) RejectResponse() util.JSONResponse {
+	errCode, msg := d.ErrCode, d.Error
+	if errCode == "" {
+		errCode = "M_FORBIDDEN"
+	}
+	if msg == "" {
+		msg = "Request rejected by the server's policy"
+	}
+	return util.JSONResponse{
+		Code: http.StatusForbidden,
+		JSON: jsonerror.MatrixError{
+			ErrCode: errCode,
+			Err:     msg,
+		},
+	}
+}
+
+// MediaUpload describes a file being uploaded to the media repository.
+type MediaUpload struct {
+	ContentType   string `json:"content_type"`
+	ContentLength int64  `json:"content_length"`
+	Filename      string `json:"filename"`
+}
+
+// Checker is implemented by policy modules. Implementations must be safe for
+// concurrent use.
+type Checker interface {
+	// CheckEvent is called for events sent by local clients and received
+	// over federation, before they are sent to the roomserver.
+	CheckEvent(ctx context.Context, origin Origin, event *gomatrixserverlib.HeaderedEvent) Decision
+	// CheckRoomCreation is called with the body of /createRoom requests.
+	CheckRoomCreation(ctx context.Context, userID string, request json.RawMessage) Decision
+	// CheckInvite is called when a local user invites another user to a room.
+	CheckInvite(ctx context.Context, inviter, invitee, roomID string) Decision
+	// CheckProfileChange is called when a local user changes their display
+	// name or avatar URL. The field is "displayname" or "avatar_url".
+	CheckProfileChange(ctx context.Context, userID, field, value string) Decision
+	// CheckMediaUpload is called when a local user uploads a file.
+	CheckMediaUpload(ctx context.Context, userID string, upload *MediaUpload) Decision
+}
+
+// NewChecker returns the policy module configured in cfg, or a Checker which
+// allows everything if there is none.
+func NewChecker(cfg *config.Policy) Checker {
+	if cfg.URL == "" {
+		return AllowAll{}
+	}
+	return NewHTTPChecker(cfg)
+}
+
+// AllowAll is a Checker which allows everything.
+type AllowAll struct{}
+
+func (AllowAll) CheckEvent(context.Context, Origin, *gomatrixserverlib.HeaderedEvent) Decision {
+	return Allow
+}
+
+func (AllowAll) CheckRoomCreation(context.Context, string, json.RawMessage) Decision {
+	return Allow
+}
+
+func (AllowAll) CheckInvite(context.Context, string, string, string) Decision {
+	return Allow
+}
+
+func (AllowAll) CheckProfileChange(context.Context, string, string, string) Decision {
+	return Allow
+}
+
+func (AllowAll) CheckMediaUpload(context.Context, string, *MediaUpload) Decision {
+	return Allow
+}
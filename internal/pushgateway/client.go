@@ -9,9 +9,11 @@ import (
 	"net/http"
 	"time"
 
-	"github.com/opentracing/opentracing-go"
+	"go.opentelemetry.io/otel"
 )
 
+var tracer = otel.Tracer("github.com/matrix-org/dendrite/internal/pushgateway")
+
 type httpClient struct {
 	hc *http.Client
 }
@@ -32,8 +34,8 @@ func NewHTTPClient(disableTLSValidation bool) Client {
 }
 
 func (h *httpClient) Notify(ctx context.Context, url string, req *NotifyRequest, resp *NotifyResponse) error {
-	span, ctx := opentracing.StartSpanFromContext(ctx, "Notify")
-	defer span.Finish()
+	ctx, span := tracer.Start(ctx, "Notify")
+	defer span.End()
 
 	body, err := json.Marshal(req)
 	if err != nil {
@@ -1,5 +1,7 @@
 package pushrules
 
+import "encoding/json"
+
 // A Condition dictates extra conditions for a matching rules. See
 // ConditionKind.
 type Condition struct {
@@ -8,17 +10,38 @@ type Condition struct {
 	Kind ConditionKind `json:"kind"`
 
 	// Key indicates the dot-separated path of Event fields to
-	// match. Required for EventMatchCondition and
-	// SenderNotificationPermissionCondition.
+	// match. Dots and backslashes in field names are escaped with a
+	// backslash. Required for EventMatchCondition,
+	// EventPropertyIsCondition, EventPropertyContainsCondition,
+	// ExactEventMatchCondition and
+	// SenderNotificationPermissionCondition. Optional for
+	// RelatedEventMatchCondition.
 	Key string `json:"key,omitempty"`
 
 	// Pattern indicates the value pattern that must match. Required
-	// for EventMatchCondition.
+	// for EventMatchCondition, optional for
+	// RelatedEventMatchCondition.
 	Pattern string `json:"pattern,omitempty"`
 
 	// Is indicates the condition that must be fulfilled. Required for
 	// RoomMemberCountCondition.
 	Is string `json:"is,omitempty"`
+
+	// Value is the JSON string, integer, boolean or null the property
+	// must be exactly equal to, or contain. Required for
+	// EventPropertyIsCondition, EventPropertyContainsCondition and
+	// ExactEventMatchCondition. It is kept as raw JSON so that a null
+	// value survives a round trip.
+	Value json.RawMessage `json:"value,omitempty"`
+
+	// RelType is the type of relation to the related event. Required
+	// for RelatedEventMatchCondition.
+	RelType string `json:"rel_type,omitempty"`
+
+	// IncludeFallbacks indicates whether replies which are only a
+	// fallback for clients which don't support threads also match.
+	// Optional for RelatedEventMatchCondition.
+	IncludeFallbacks *bool `json:"include_fallbacks,omitempty"`
 }
 
 // ConditionKind represents a kind of condition.
@@ -46,4 +69,21 @@ const (
 	// SenderNotificationPermissionCondition compares power level for
 	// the sender in the event's room.
 	SenderNotificationPermissionCondition ConditionKind = "sender_notification_permission"
+
+	// EventPropertyIsCondition indicates the value at a key path
+	// must be exactly equal to a value.
+	EventPropertyIsCondition ConditionKind = "event_property_is"
+
+	// EventPropertyContainsCondition indicates the array at a key
+	// path must contain a value.
+	EventPropertyContainsCondition ConditionKind = "event_property_contains"
+
+	// ExactEventMatchCondition is the name EventPropertyIsCondition
+	// was proposed under (MSC3758), and matches the same way.
+	ExactEventMatchCondition ConditionKind = "exact_event_match"
+
+	// RelatedEventMatchCondition matches a pattern against a key
+	// path of the event the event relates to (MSC3664), e.g. the
+	// event it is a reply to.
+	RelatedEventMatchCondition ConditionKind = "related_event_match"
 )
@@ -1,6 +1,8 @@
 package pushrules
 
 import (
+	"encoding/json"
+
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
@@ -15,9 +17,56 @@ func DefaultAccountRuleSets(localpart string, serverName gomatrixserverlib.Serve
 // DefaultGlobalRuleSet returns the default ruleset for a given (fully
 // qualified) MXID.
 func DefaultGlobalRuleSet(localpart string, serverName gomatrixserverlib.ServerName) *RuleSet {
+	userID := "@" + localpart + ":" + string(serverName)
 	return &RuleSet{
-		Override:  defaultOverrideRules("@" + localpart + ":" + string(serverName)),
+		Override:  defaultOverrideRules(userID),
 		Content:   defaultContentRules(localpart),
-		Underride: defaultUnderrideRules,
+		Underride: defaultUnderrideRules(userID),
 	}
 }
+
+// AddMissingDefaultRules adds the default rules which are missing from
+// a stored rule set, e.g. because they were added after it was created,
+// and returns whether any were added. Each missing rule is inserted
+// after the default rule which precedes it in the default rule set, so
+// the default rules stay in order.
+func AddMissingDefaultRules(ruleSet *RuleSet, localpart string, serverName gomatrixserverlib.ServerName) bool {
+	defaults := DefaultGlobalRuleSet(localpart, serverName)
+	added := false
+	for _, kr := range []struct {
+		rules    *[]*Rule
+		defaults []*Rule
+	}{
+		{&ruleSet.Override, defaults.Override},
+		{&ruleSet.Content, defaults.Content},
+		{&ruleSet.Underride, defaults.Underride},
+	} {
+		pos := 0
+		for _, def := range kr.defaults {
+			if i := indexOfRule(*kr.rules, def.RuleID); i >= 0 {
+				pos = i + 1
+				continue
+			}
+			rules := append([]*Rule{def}, (*kr.rules)[pos:]...)
+			*kr.rules = append((*kr.rules)[:pos], rules...)
+			pos++
+			added = true
+		}
+	}
+	return added
+}
+
+func indexOfRule(rules []*Rule, ruleID string) int {
+	for i, rule := range rules {
+		if rule.RuleID == ruleID {
+			return i
+		}
+	}
+	return -1
+}
+
+// jsonValue returns the JSON encoding of a condition value.
+func jsonValue(v interface{}) json.RawMessage {
+	b, _ := json.Marshal(v)
+	return b
+}
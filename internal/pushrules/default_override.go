@@ -6,9 +6,16 @@ func defaultOverrideRules(userID string) []*Rule {
 		&mRuleSuppressNoticesDefinition,
 		mRuleInviteForMeDefinition(userID),
 		&mRuleMemberEventDefinition,
+		mRuleIsUserMentionDefinition(userID),
 		&mRuleContainsDisplayNameDefinition,
+		&mRuleIsRoomMentionDefinition,
 		&mRuleTombstoneDefinition,
 		&mRuleRoomNotifDefinition,
+		&mRuleReactionDefinition,
+		&mRuleServerACLDefinition,
+		&mRuleSuppressEditsDefinition,
+		&mRulePollResponseDefinition,
+		mRuleReplyDefinition(userID),
 	}
 }
 
@@ -20,6 +27,13 @@ const (
 	MRuleContainsDisplayName = ".m.rule.contains_display_name"
 	MRuleTombstone           = ".m.rule.tombstone"
 	MRuleRoomNotif           = ".m.rule.roomnotif"
+	MRuleIsUserMention       = ".m.rule.is_user_mention"
+	MRuleIsRoomMention       = ".m.rule.is_room_mention"
+	MRuleReaction            = ".m.rule.reaction"
+	MRuleServerACL           = ".m.rule.room.server_acl"
+	MRuleSuppressEdits       = ".m.rule.suppress_edits"
+	MRulePollResponse        = ".m.rule.poll_response"
+	MRuleReply               = ".im.nheko.msc3664.reply"
 )
 
 var (
@@ -126,6 +140,149 @@ var (
 	}
 )
 
+var (
+	mRuleIsRoomMentionDefinition = Rule{
+		RuleID:  MRuleIsRoomMention,
+		Default: true,
+		Enabled: true,
+		Conditions: []*Condition{
+			{
+				Kind:  EventPropertyIsCondition,
+				Key:   `content.m\.mentions.room`,
+				Value: jsonValue(true),
+			},
+			{
+				Kind: SenderNotificationPermissionCondition,
+				Key:  "room",
+			},
+		},
+		Actions: []*Action{
+			{Kind: NotifyAction},
+			{
+				Kind:  SetTweakAction,
+				Tweak: HighlightTweak,
+				Value: true,
+			},
+		},
+	}
+	mRuleReactionDefinition = Rule{
+		RuleID:  MRuleReaction,
+		Default: true,
+		Enabled: true,
+		Conditions: []*Condition{
+			{
+				Kind:    EventMatchCondition,
+				Key:     "type",
+				Pattern: "m.reaction",
+			},
+		},
+		Actions: []*Action{{Kind: DontNotifyAction}},
+	}
+	mRuleServerACLDefinition = Rule{
+		RuleID:  MRuleServerACL,
+		Default: true,
+		Enabled: true,
+		Conditions: []*Condition{
+			{
+				Kind:    EventMatchCondition,
+				Key:     "type",
+				Pattern: "m.room.server_acl",
+			},
+			{
+				Kind:    EventMatchCondition,
+				Key:     "state_key",
+				Pattern: "",
+			},
+		},
+		Actions: []*Action{{Kind: DontNotifyAction}},
+	}
+	mRuleSuppressEditsDefinition = Rule{
+		RuleID:  MRuleSuppressEdits,
+		Default: true,
+		Enabled: true,
+		Conditions: []*Condition{
+			{
+				Kind:  EventPropertyIsCondition,
+				Key:   `content.m\.relates_to.rel_type`,
+				Value: jsonValue("m.replace"),
+			},
+		},
+		Actions: []*Action{{Kind: DontNotifyAction}},
+	}
+	mRulePollResponseDefinition = Rule{
+		RuleID:  MRulePollResponse,
+		Default: true,
+		Enabled: true,
+		Conditions: []*Condition{
+			{
+				Kind:    EventMatchCondition,
+				Key:     "type",
+				Pattern: "m.poll.response",
+			},
+		},
+		Actions: []*Action{{Kind: DontNotifyAction}},
+	}
+)
+
+func mRuleIsUserMentionDefinition(userID string) *Rule {
+	return &Rule{
+		RuleID:  MRuleIsUserMention,
+		Default: true,
+		Enabled: true,
+		Conditions: []*Condition{
+			{
+				Kind:  EventPropertyContainsCondition,
+				Key:   `content.m\.mentions.user_ids`,
+				Value: jsonValue(userID),
+			},
+		},
+		Actions: []*Action{
+			{Kind: NotifyAction},
+			{
+				Kind:  SetTweakAction,
+				Tweak: SoundTweak,
+				Value: "default",
+			},
+			{
+				Kind:  SetTweakAction,
+				Tweak: HighlightTweak,
+				Value: true,
+			},
+		},
+	}
+}
+
+// mRuleReplyDefinition matches replies to the user's events. The
+// relation isn't encrypted, so this also matches encrypted replies.
+func mRuleReplyDefinition(userID string) *Rule {
+	return &Rule{
+		RuleID:  MRuleReply,
+		Default: true,
+		Enabled: true,
+		Conditions: []*Condition{
+			{
+				Kind:    RelatedEventMatchCondition,
+				RelType: "m.in_reply_to",
+				Key:     "sender",
+				Pattern: userID,
+			},
+		},
+		Actions: []*Action{
+			{Kind: NotifyAction},
+			{
+				Kind:  SetTweakAction,
+				Tweak: SoundTweak,
+				Value: "default",
+			},
+			{
+				Kind:  SetTweakAction,
+				Tweak: HighlightTweak,
+				Value: true,
+			},
+		},
+	}
+}
+
 func mRuleInviteForMeDefinition(userID string) *Rule {
 	return &Rule{
 		RuleID:  MRuleInviteForMe,
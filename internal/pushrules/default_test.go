@@ -0,0 +1,54 @@
+package pushrules
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestAddMissingDefaultRules(t *testing.T) {
+	want := DefaultGlobalRuleSet("alice", "example.com")
+	userRule := &Rule{RuleID: "user", Enabled: true, Conditions: []*Condition{}, Actions: []*Action{{Kind: NotifyAction}}}
+
+	// A rule set created before some of the default rules existed, and
+	// where the user disabled one of the default rules and added their
+	// own rule.
+	disabled := *want.Override[len(want.Override)-2]
+	disabled.Enabled = false
+	ruleSet := &RuleSet{
+		Override:  []*Rule{userRule, want.Override[0], want.Override[2], &disabled},
+		Content:   want.Content,
+		Underride: want.Underride[:1],
+	}
+	if !AddMissingDefaultRules(ruleSet, "alice", "example.com") {
+		t.Fatalf("AddMissingDefaultRules didn't add any rules")
+	}
+
+	wantOverride := append([]*Rule{userRule}, want.Override...)
+	wantOverride[len(wantOverride)-2] = &disabled
+	if diff := cmp.Diff(wantOverride, ruleSet.Override); diff != "" {
+		t.Errorf("override rules: +got -want:\n%s", diff)
+	}
+	if diff := cmp.Diff(want.Underride, ruleSet.Underride); diff != "" {
+		t.Errorf("underride rules: +got -want:\n%s", diff)
+	}
+
+	if AddMissingDefaultRules(ruleSet, "alice", "example.com") {
+		t.Errorf("AddMissingDefaultRules added rules to a complete rule set")
+	}
+}
+
+func TestDefaultRulesValid(t *testing.T) {
+	ruleSet := DefaultGlobalRuleSet("alice", "example.com")
+	for kind, rules := range map[Kind][]*Rule{
+		OverrideKind:  ruleSet.Override,
+		ContentKind:   ruleSet.Content,
+		UnderrideKind: ruleSet.Underride,
+	} {
+		for _, rule := range rules {
+			if errs := ValidateRule(kind, rule); len(errs) > 0 {
+				t.Errorf("default rule %s is invalid: %v", rule.RuleID, errs)
+			}
+		}
+	}
+}
@@ -6,14 +6,26 @@ const (
 	MRuleRoomOneToOne          = ".m.rule.room_one_to_one"
 	MRuleMessage               = ".m.rule.message"
 	MRuleEncrypted             = ".m.rule.encrypted"
+	MRuleThreadReply           = ".org.matrix.msc3772.thread_reply"
+	MRulePollStartOneToOne     = ".m.rule.poll_start_one_to_one"
+	MRulePollStart             = ".m.rule.poll_start"
+	MRulePollEndOneToOne       = ".m.rule.poll_end_one_to_one"
+	MRulePollEnd               = ".m.rule.poll_end"
 )
 
-var defaultUnderrideRules = []*Rule{
-	&mRuleCallDefinition,
-	&mRuleEncryptedRoomOneToOneDefinition,
-	&mRuleRoomOneToOneDefinition,
-	&mRuleMessageDefinition,
-	&mRuleEncryptedDefinition,
+func defaultUnderrideRules(userID string) []*Rule {
+	return []*Rule{
+		&mRuleCallDefinition,
+		mRuleThreadReplyDefinition(userID),
+		&mRuleEncryptedRoomOneToOneDefinition,
+		&mRuleRoomOneToOneDefinition,
+		&mRuleMessageDefinition,
+		&mRuleEncryptedDefinition,
+		&mRulePollStartOneToOneDefinition,
+		&mRulePollStartDefinition,
+		&mRulePollEndOneToOneDefinition,
+		&mRulePollEndDefinition,
+	}
 }
 
 var (
@@ -116,4 +128,110 @@ var (
 		},
 		Actions: []*Action{{Kind: NotifyAction}},
 	}
+	mRulePollStartOneToOneDefinition = Rule{
+		RuleID:  MRulePollStartOneToOne,
+		Default: true,
+		Enabled: true,
+		Conditions: []*Condition{
+			{
+				Kind: RoomMemberCountCondition,
+				Is:   "2",
+			},
+			{
+				Kind:    EventMatchCondition,
+				Key:     "type",
+				Pattern: "m.poll.start",
+			},
+		},
+		Actions: []*Action{
+			{Kind: NotifyAction},
+			{
+				Kind:  SetTweakAction,
+				Tweak: SoundTweak,
+				Value: "default",
+			},
+		},
+	}
+	mRulePollStartDefinition = Rule{
+		RuleID:  MRulePollStart,
+		Default: true,
+		Enabled: true,
+		Conditions: []*Condition{
+			{
+				Kind:    EventMatchCondition,
+				Key:     "type",
+				Pattern: "m.poll.start",
+			},
+		},
+		Actions: []*Action{{Kind: NotifyAction}},
+	}
+	mRulePollEndOneToOneDefinition = Rule{
+		RuleID:  MRulePollEndOneToOne,
+		Default: true,
+		Enabled: true,
+		Conditions: []*Condition{
+			{
+				Kind: RoomMemberCountCondition,
+				Is:   "2",
+			},
+			{
+				Kind:    EventMatchCondition,
+				Key:     "type",
+				Pattern: "m.poll.end",
+			},
+		},
+		Actions: []*Action{
+			{Kind: NotifyAction},
+			{
+				Kind:  SetTweakAction,
+				Tweak: SoundTweak,
+				Value: "default",
+			},
+		},
+	}
+	mRulePollEndDefinition = Rule{
+		RuleID:  MRulePollEnd,
+		Default: true,
+		Enabled: true,
+		Conditions: []*Condition{
+			{
+				Kind:    EventMatchCondition,
+				Key:     "type",
+				Pattern: "m.poll.end",
+			},
+		},
+		Actions: []*Action{{Kind: NotifyAction}},
+	}
 )
+
+// mRuleThreadReplyDefinition matches events in threads the user
+// started. The relation isn't encrypted, so this also matches events in
+// encrypted threads, which would otherwise only match .m.rule.encrypted.
+func mRuleThreadReplyDefinition(userID string) *Rule {
+	return &Rule{
+		RuleID:  MRuleThreadReply,
+		Default: true,
+		Enabled: true,
+		Conditions: []*Condition{
+			{
+				Kind:    RelatedEventMatchCondition,
+				RelType: "m.thread",
+				Key:     "sender",
+				Pattern: userID,
+			},
+		},
+		Actions: []*Action{
+			{Kind: NotifyAction},
+			{
+				Kind:  SetTweakAction,
+				Tweak: SoundTweak,
+				Value: "default",
+			},
+			{
+				Kind:  SetTweakAction,
+				Tweak: HighlightTweak,
+				Value: false,
+			},
+		},
+	}
+}
@@ -3,7 +3,6 @@ package pushrules
 import (
 	"encoding/json"
 	"fmt"
-	"strings"
 
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -28,6 +27,10 @@ type EvaluationContext interface {
 	// HasPowerLevel returns whether the user has at least the given
 	// power in the room of the current event.
 	HasPowerLevel(userID, levelKey string) (bool, error)
+
+	// RelatedEvent returns the event with the given ID in the room of
+	// the current event, or nil if the event isn't known.
+	RelatedEvent(eventID string) (*gomatrixserverlib.Event, error)
 }
 
 // A kindAndRules is just here to simplify iteration of the (ordered)
@@ -88,6 +91,12 @@ func ruleMatches(rule *Rule, kind Kind, event *gomatrixserverlib.Event, ec Evalu
 		return false, nil
 	}
 
+	// SPEC: Events with the m.mentions property say who they mention,
+	// so the rules which guess that from the body don't apply to them.
+	if rule.Default && legacyMentionRules[rule.RuleID] && hasMentions(event) {
+		return false, nil
+	}
+
 	switch kind {
 	case OverrideKind, UnderrideKind:
 		for _, cond := range rule.Conditions {
@@ -139,27 +148,148 @@ func conditionMatches(cond *Condition, event *gomatrixserverlib.Event, ec Evalua
 	case SenderNotificationPermissionCondition:
 		return ec.HasPowerLevel(event.Sender(), cond.Key)
 
+	case EventPropertyIsCondition, ExactEventMatchCondition:
+		v, ok, err := eventProperty(cond.Key, event)
+		if err != nil || !ok {
+			return false, err
+		}
+		return valueEquals(v, cond.Value), nil
+
+	case EventPropertyContainsCondition:
+		v, ok, err := eventProperty(cond.Key, event)
+		if err != nil || !ok {
+			return false, err
+		}
+		vs, ok := v.([]interface{})
+		if !ok {
+			return false, nil
+		}
+		for _, v := range vs {
+			if valueEquals(v, cond.Value) {
+				return true, nil
+			}
+		}
+		return false, nil
+
+	case RelatedEventMatchCondition:
+		return relatedEventMatches(cond, event, ec)
+
 	default:
 		return false, nil
 	}
 }
 
+// legacyMentionRules are the default rules which guess whether the user
+// is mentioned from the body of the event.
+var legacyMentionRules = map[string]bool{
+	MRuleContainsDisplayName: true,
+	MRuleContainsUserName:    true,
+	MRuleRoomNotif:           true,
+}
+
+// hasMentions returns whether the event has the m.mentions property.
+func hasMentions(event *gomatrixserverlib.Event) bool {
+	var content struct {
+		Mentions json.RawMessage `json:"m.mentions"`
+	}
+	return json.Unmarshal(event.Content(), &content) == nil && content.Mentions != nil
+}
+
+func relatedEventMatches(cond *Condition, event *gomatrixserverlib.Event, ec EvaluationContext) (bool, error) {
+	var content struct {
+		RelatesTo struct {
+			RelType       string `json:"rel_type"`
+			EventID       string `json:"event_id"`
+			IsFallingBack bool   `json:"is_falling_back"`
+			InReplyTo     struct {
+				EventID string `json:"event_id"`
+			} `json:"m.in_reply_to"`
+		} `json:"m.relates_to"`
+	}
+	if err := json.Unmarshal(event.Content(), &content); err != nil {
+		return false, nil
+	}
+
+	var eventID string
+	switch rel := content.RelatesTo; {
+	case cond.RelType == "m.in_reply_to":
+		// Threaded events are replies to the latest event in the
+		// thread as a fallback, but aren't really replies to it.
+		if rel.IsFallingBack && (cond.IncludeFallbacks == nil || !*cond.IncludeFallbacks) {
+			return false, nil
+		}
+		eventID = rel.InReplyTo.EventID
+	case cond.RelType == rel.RelType:
+		eventID = rel.EventID
+	}
+	if eventID == "" {
+		return false, nil
+	}
+
+	related, err := ec.RelatedEvent(eventID)
+	if err != nil {
+		return false, fmt.Errorf("RelatedEvent failed: %w", err)
+	}
+	if related == nil {
+		return false, nil
+	}
+	if cond.Key == "" {
+		// Without a key, any related event matches.
+		return true, nil
+	}
+	return patternMatches(cond.Key, cond.Pattern, related)
+}
+
 func patternMatches(key, pattern string, event *gomatrixserverlib.Event) (bool, error) {
 	re, err := globToRegexp(pattern)
 	if err != nil {
 		return false, err
 	}
 
+	v, ok, err := eventProperty(key, event)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	return re.MatchString(fmt.Sprint(v)), nil
+}
+
+// eventProperty returns the value at the key path in the event, and
+// whether there is one.
+func eventProperty(key string, event *gomatrixserverlib.Event) (interface{}, bool, error) {
 	var eventMap map[string]interface{}
-	if err = json.Unmarshal(event.JSON(), &eventMap); err != nil {
-		return false, fmt.Errorf("parsing event: %w", err)
+	if err := json.Unmarshal(event.JSON(), &eventMap); err != nil {
+		return nil, false, fmt.Errorf("parsing event: %w", err)
 	}
-	v, err := lookupMapPath(strings.Split(key, "."), eventMap)
+	v, err := lookupMapPath(splitKeyPath(key), eventMap)
 	if err != nil {
 		// An unknown path is a benign error that shouldn't stop rule
 		// processing. It's just a non-match.
-		return false, nil
+		return nil, false, nil
 	}
+	return v, true, nil
+}
 
-	return re.MatchString(fmt.Sprint(v)), nil
+// valueEquals returns whether the value, as produced by json.Unmarshal,
+// is exactly equal to the JSON value. Only strings, numbers, booleans
+// and null can be equal.
+func valueEquals(v interface{}, value json.RawMessage) bool {
+	if len(value) == 0 {
+		return false
+	}
+	var want interface{}
+	if err := json.Unmarshal(value, &want); err != nil {
+		return false
+	}
+	switch want.(type) {
+	case string, float64, bool, nil:
+	default:
+		return false
+	}
+	switch v.(type) {
+	case string, float64, bool, nil:
+		return v == want
+	default:
+		return false
+	}
 }
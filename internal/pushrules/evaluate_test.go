@@ -83,6 +83,10 @@ func TestRuleMatches(t *testing.T) {
 
 		{"senderMatch", SenderKind, Rule{Enabled: true, RuleID: "@user@example.com"}, `{"sender":"@user@example.com"}`, true},
 		{"senderNoMatch", SenderKind, Rule{Enabled: true, RuleID: "@user@example.com"}, `{"sender":"@otheruser@example.com"}`, false},
+
+		{"legacyMentionMatch", ContentKind, Rule{Enabled: true, Default: true, RuleID: MRuleContainsUserName, Pattern: "alice"}, `{"content":{"body":"hi alice"}}`, true},
+		{"legacyMentionWithMentions", ContentKind, Rule{Enabled: true, Default: true, RuleID: MRuleContainsUserName, Pattern: "alice"}, `{"content":{"body":"hi alice","m.mentions":{}}}`, false},
+		{"userRuleWithMentions", ContentKind, Rule{Enabled: true, RuleID: "alice", Pattern: "alice"}, `{"content":{"body":"hi alice","m.mentions":{}}}`, true},
 	}
 	for _, tst := range tsts {
 		t.Run(tst.Name, func(t *testing.T) {
@@ -125,6 +129,28 @@ func TestConditionMatches(t *testing.T) {
 
 		{"senderNotificationPermissionMatch", Condition{Kind: SenderNotificationPermissionCondition, Key: "powerlevel"}, `{"sender":"@poweruser:example.com"}`, true},
 		{"senderNotificationPermissionNoMatch", Condition{Kind: SenderNotificationPermissionCondition, Key: "powerlevel"}, `{"sender":"@nobody:example.com"}`, false},
+
+		{"eventPropertyIsString", Condition{Kind: EventPropertyIsCondition, Key: "content.msgtype", Value: jsonValue("m.text")}, `{"content":{"msgtype":"m.text"}}`, true},
+		{"eventPropertyIsNoSubstring", Condition{Kind: EventPropertyIsCondition, Key: "content.msgtype", Value: jsonValue("m.tex")}, `{"content":{"msgtype":"m.text"}}`, false},
+		{"eventPropertyIsBool", Condition{Kind: EventPropertyIsCondition, Key: `content.m\.mentions.room`, Value: jsonValue(true)}, `{"content":{"m.mentions":{"room":true}}}`, true},
+		{"eventPropertyIsBoolNoMatch", Condition{Kind: EventPropertyIsCondition, Key: `content.m\.mentions.room`, Value: jsonValue(true)}, `{"content":{"m.mentions":{"room":"true"}}}`, false},
+		{"eventPropertyIsInt", Condition{Kind: EventPropertyIsCondition, Key: "content.n", Value: jsonValue(42)}, `{"content":{"n":42}}`, true},
+		{"eventPropertyIsNull", Condition{Kind: EventPropertyIsCondition, Key: "content.n", Value: jsonValue(nil)}, `{"content":{"n":null}}`, true},
+		{"eventPropertyIsMissing", Condition{Kind: EventPropertyIsCondition, Key: "content.n", Value: jsonValue(nil)}, `{"content":{}}`, false},
+		{"eventPropertyIsObject", Condition{Kind: EventPropertyIsCondition, Key: "content", Value: jsonValue(map[string]interface{}{})}, `{"content":{}}`, false},
+		{"exactEventMatch", Condition{Kind: ExactEventMatchCondition, Key: "content.msgtype", Value: jsonValue("m.text")}, `{"content":{"msgtype":"m.text"}}`, true},
+
+		{"eventPropertyContainsMatch", Condition{Kind: EventPropertyContainsCondition, Key: `content.m\.mentions.user_ids`, Value: jsonValue("@alice:example.com")}, `{"content":{"m.mentions":{"user_ids":["@bob:example.com","@alice:example.com"]}}}`, true},
+		{"eventPropertyContainsNoMatch", Condition{Kind: EventPropertyContainsCondition, Key: `content.m\.mentions.user_ids`, Value: jsonValue("@alice:example.com")}, `{"content":{"m.mentions":{"user_ids":["@bob:example.com"]}}}`, false},
+		{"eventPropertyContainsNotArray", Condition{Kind: EventPropertyContainsCondition, Key: `content.m\.mentions.user_ids`, Value: jsonValue("@alice:example.com")}, `{"content":{"m.mentions":{"user_ids":"@alice:example.com"}}}`, false},
+
+		{"relatedEventMatchReply", Condition{Kind: RelatedEventMatchCondition, RelType: "m.in_reply_to", Key: "sender", Pattern: "@alice:example.com"}, `{"content":{"m.relates_to":{"m.in_reply_to":{"event_id":"$related"}}}}`, true},
+		{"relatedEventMatchReplyNoMatch", Condition{Kind: RelatedEventMatchCondition, RelType: "m.in_reply_to", Key: "sender", Pattern: "@bob:example.com"}, `{"content":{"m.relates_to":{"m.in_reply_to":{"event_id":"$related"}}}}`, false},
+		{"relatedEventMatchFallback", Condition{Kind: RelatedEventMatchCondition, RelType: "m.in_reply_to", Key: "sender", Pattern: "@alice:example.com"}, `{"content":{"m.relates_to":{"rel_type":"m.thread","event_id":"$root","is_falling_back":true,"m.in_reply_to":{"event_id":"$related"}}}}`, false},
+		{"relatedEventMatchIncludeFallback", Condition{Kind: RelatedEventMatchCondition, RelType: "m.in_reply_to", Key: "sender", Pattern: "@alice:example.com", IncludeFallbacks: &[]bool{true}[0]}, `{"content":{"m.relates_to":{"rel_type":"m.thread","event_id":"$root","is_falling_back":true,"m.in_reply_to":{"event_id":"$related"}}}}`, true},
+		{"relatedEventMatchThread", Condition{Kind: RelatedEventMatchCondition, RelType: "m.thread"}, `{"content":{"m.relates_to":{"rel_type":"m.thread","event_id":"$related"}}}`, true},
+		{"relatedEventMatchOtherRelType", Condition{Kind: RelatedEventMatchCondition, RelType: "m.thread"}, `{"content":{"m.relates_to":{"rel_type":"m.annotation","event_id":"$related"}}}`, false},
+		{"relatedEventMatchUnknownEvent", Condition{Kind: RelatedEventMatchCondition, RelType: "m.thread"}, `{"content":{"m.relates_to":{"rel_type":"m.thread","event_id":"$unknown"}}}`, false},
 	}
 	for _, tst := range tsts {
 		t.Run(tst.Name, func(t *testing.T) {
@@ -146,6 +172,12 @@ func (fakeEvaluationContext) RoomMemberCount() (int, error) { return 2, nil }
 func (fakeEvaluationContext) HasPowerLevel(userID, levelKey string) (bool, error) {
 	return userID == "@poweruser:example.com" && levelKey == "powerlevel", nil
 }
+func (fakeEvaluationContext) RelatedEvent(eventID string) (*gomatrixserverlib.Event, error) {
+	if eventID != "$related" {
+		return nil, nil
+	}
+	return gomatrixserverlib.NewEventFromTrustedJSON([]byte(`{"sender":"@alice:example.com"}`), false, gomatrixserverlib.RoomVersionV7)
+}
 
 func TestPatternMatches(t *testing.T) {
 	tsts := []struct {
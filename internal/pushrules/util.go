@@ -68,6 +68,27 @@ func globToRegexp(pattern string) (*regexp.Regexp, error) {
 // meta-characters (i.e. may need escaping).
 var globNonMetaRegexp = regexp.MustCompile("[^*?]+")
 
+// splitKeyPath splits a dot-separated key path into its components.
+// Dots and backslashes in the components are escaped with a backslash,
+// e.g. `content.m\.relates_to`. Other backslashes are kept as they are.
+func splitKeyPath(key string) []string {
+	var path []string
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		switch c := key[i]; {
+		case c == '\\' && i+1 < len(key) && (key[i+1] == '.' || key[i+1] == '\\'):
+			i++
+			b.WriteByte(key[i])
+		case c == '.':
+			path = append(path, b.String())
+			b.Reset()
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return append(path, b.String())
+}
+
 // lookupMapPath traverses a hierarchical map structure, like the one
 // produced by json.Unmarshal, to return the leaf value. Traversing
 // arrays/slices is not supported, only objects/maps.
@@ -93,6 +93,26 @@ func TestGlobToRegexp(t *testing.T) {
 	}
 }
 
+func TestSplitKeyPath(t *testing.T) {
+	tsts := []struct {
+		Key  string
+		Want []string
+	}{
+		{"", []string{""}},
+		{"content.body", []string{"content", "body"}},
+		{`content.m\.relates_to.rel_type`, []string{"content", "m.relates_to", "rel_type"}},
+		{`content.a\\.b`, []string{"content", `a\`, "b"}},
+		{`content.a\b`, []string{"content", `a\b`}},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Key, func(t *testing.T) {
+			if diff := cmp.Diff(tst.Want, splitKeyPath(tst.Key)); diff != "" {
+				t.Errorf("+got -want:\n%s", diff)
+			}
+		})
+	}
+}
+
 func TestLookupMapPath(t *testing.T) {
 	tsts := []struct {
 		Path []string
@@ -77,6 +77,19 @@ func validateCondition(cond *Condition) []error {
 	case EventMatchCondition, ContainsDisplayNameCondition, RoomMemberCountCondition, SenderNotificationPermissionCondition:
 		// Do nothing.
 
+	case EventPropertyIsCondition, EventPropertyContainsCondition, ExactEventMatchCondition:
+		if cond.Key == "" {
+			errs = append(errs, fmt.Errorf("missing %s condition key", cond.Kind))
+		}
+		if len(cond.Value) == 0 {
+			errs = append(errs, fmt.Errorf("missing %s condition value", cond.Kind))
+		}
+
+	case RelatedEventMatchCondition:
+		if cond.RelType == "" {
+			errs = append(errs, fmt.Errorf("missing %s condition rel_type", cond.Kind))
+		}
+
 	default:
 		errs = append(errs, fmt.Errorf("invalid rule condition kind: %s", cond.Kind))
 	}
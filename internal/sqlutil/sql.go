@@ -112,6 +112,14 @@ func QueryVariadicOffset(count, offset int) string {
 	return str
 }
 
+// EscapeLike escapes the wildcards in s so that it can be used as part of
+// a LIKE pattern with ESCAPE '\'.
+func EscapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
 func minOfInts(a, b int) int {
 	if a <= b {
 		return a
@@ -11,7 +11,8 @@ import (
 
 // Open opens a database specified by its database driver name and a driver-specific data source name,
 // usually consisting of at least a database name and connection information. Includes tracing driver
-// if DENDRITE_TRACE_SQL=1
+// if DENDRITE_TRACE_SQL=1, in which case a span is also started for each statement executed as part
+// of a trace.
 func Open(dbProperties *config.DatabaseOptions, writer Writer) (*sql.DB, error) {
 	var err error
 	var driverName, dsn string
@@ -36,7 +37,7 @@ func Open(dbProperties *config.DatabaseOptions, writer Writer) (*sql.DB, error)
 	if err != nil {
 		return nil, err
 	}
-	if driverName != "sqlite3" {
+	if !dbProperties.ConnectionString.IsSQLite() {
 		logrus.WithFields(logrus.Fields{
 			"MaxOpenConns":    dbProperties.MaxOpenConns(),
 			"MaxIdleConns":    dbProperties.MaxIdleConns(),
@@ -28,8 +28,14 @@ import (
 
 	"github.com/ngrok/sqlmw"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var tracer = otel.Tracer("github.com/matrix-org/dendrite/internal/sqlutil")
+
 var tracingEnabled = os.Getenv("DENDRITE_TRACE_SQL") == "1"
 var goidToWriter sync.Map
 
@@ -37,31 +43,78 @@ type traceInterceptor struct {
 	sqlmw.NullInterceptor
 }
 
+func (in *traceInterceptor) ConnQueryContext(ctx context.Context, conn driver.QueryerContext, query string, args []driver.NamedValue) (context.Context, driver.Rows, error) {
+	ctx, span := startSpan(ctx, "sql.query", query)
+	rows, err := conn.QueryContext(ctx, query, args)
+	finishSpan(span, err)
+	return ctx, rows, err
+}
+
+func (in *traceInterceptor) ConnExecContext(ctx context.Context, conn driver.ExecerContext, query string, args []driver.NamedValue) (driver.Result, error) {
+	ctx, span := startSpan(ctx, "sql.exec", query)
+	result, err := conn.ExecContext(ctx, query, args)
+	finishSpan(span, err)
+	return result, err
+}
+
 func (in *traceInterceptor) StmtQueryContext(ctx context.Context, stmt driver.StmtQueryContext, query string, args []driver.NamedValue) (context.Context, driver.Rows, error) {
+	ctx, span := startSpan(ctx, "sql.query", query)
 	startedAt := time.Now()
 	rows, err := stmt.QueryContext(ctx, args)
+	finishSpan(span, err)
 
-	trackGoID(query)
+	if tracingEnabled {
+		trackGoID(query)
 
-	logrus.WithField("duration", time.Since(startedAt)).WithField(logrus.ErrorKey, err).Debug("executed sql query ", query, " args: ", args)
+		logrus.WithField("duration", time.Since(startedAt)).WithField(logrus.ErrorKey, err).Debug("executed sql query ", query, " args: ", args)
+	}
 
 	return ctx, rows, err
 }
 
 func (in *traceInterceptor) StmtExecContext(ctx context.Context, stmt driver.StmtExecContext, query string, args []driver.NamedValue) (driver.Result, error) {
+	ctx, span := startSpan(ctx, "sql.exec", query)
 	startedAt := time.Now()
 	result, err := stmt.ExecContext(ctx, args)
+	finishSpan(span, err)
 
-	trackGoID(query)
+	if tracingEnabled {
+		trackGoID(query)
 
-	logrus.WithField("duration", time.Since(startedAt)).WithField(logrus.ErrorKey, err).Debug("executed sql query ", query, " args: ", args)
+		logrus.WithField("duration", time.Since(startedAt)).WithField(logrus.ErrorKey, err).Debug("executed sql query ", query, " args: ", args)
+	}
 
 	return result, err
 }
 
+// startSpan starts a span for the SQL statement, as long as the statement is
+// executed as part of a trace. Statements which aren't, like the ones run by
+// background tasks, would otherwise each start a trace of their own.
+func startSpan(ctx context.Context, operationName, query string) (context.Context, trace.Span) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, nil
+	}
+	return tracer.Start(
+		ctx, operationName,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBStatementKey.String(strings.TrimSpace(query))),
+	)
+}
+
+func finishSpan(span trace.Span, err error) {
+	if span == nil {
+		return
+	}
+	if err != nil && err != driver.ErrSkip {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
 func (in *traceInterceptor) RowsNext(c context.Context, rows driver.Rows, dest []driver.Value) error {
 	err := rows.Next(dest)
-	if err == io.EOF {
+	if !tracingEnabled || err == io.EOF {
 		// For all cases, we call Next() n+1 times, the first to populate the initial dest, then eventually
 		// it will io.EOF. If we log on each Next() call we log the last element twice, so don't.
 		return err
@@ -31,6 +31,7 @@ type KeyInternalAPI interface {
 	ClientKeyAPI
 	FederationKeyAPI
 	UserKeyAPI
+	AppserviceKeyAPI
 
 	// SetUserAPI assigns a user API to query when extracting device names.
 	SetUserAPI(i userapi.KeyserverUserAPI)
@@ -44,6 +45,16 @@ type ClientKeyAPI interface {
 	PerformUploadDeviceSignatures(ctx context.Context, req *PerformUploadDeviceSignaturesRequest, res *PerformUploadDeviceSignaturesResponse) error
 	// PerformClaimKeys claims one-time keys for use in pre-key messages
 	PerformClaimKeys(ctx context.Context, req *PerformClaimKeysRequest, res *PerformClaimKeysResponse) error
+	// QueryStaleDeviceLists returns the remote users whose device lists are stale
+	QueryStaleDeviceLists(ctx context.Context, req *QueryStaleDeviceListsRequest, res *QueryStaleDeviceListsResponse) error
+	// PerformDeviceListResync fetches the device lists of a remote user, or all known users on a remote server
+	PerformDeviceListResync(ctx context.Context, req *PerformDeviceListResyncRequest, res *PerformDeviceListResyncResponse) error
+	// QueryDehydratedDevice returns the user's dehydrated device, if they have one
+	QueryDehydratedDevice(ctx context.Context, req *QueryDehydratedDeviceRequest, res *QueryDehydratedDeviceResponse) error
+	// PerformStoreDehydratedDevice replaces the user's dehydrated device
+	PerformStoreDehydratedDevice(ctx context.Context, req *PerformStoreDehydratedDeviceRequest, res *PerformStoreDehydratedDeviceResponse) error
+	// PerformRemoveDehydratedDevice removes the user's dehydrated device
+	PerformRemoveDehydratedDevice(ctx context.Context, req *PerformRemoveDehydratedDeviceRequest, res *PerformRemoveDehydratedDeviceResponse) error
 }
 
 // API functions required by the userapi
@@ -56,6 +67,13 @@ type UserKeyAPI interface {
 type SyncKeyAPI interface {
 	QueryKeyChanges(ctx context.Context, req *QueryKeyChangesRequest, res *QueryKeyChangesResponse) error
 	QueryOneTimeKeys(ctx context.Context, req *QueryOneTimeKeysRequest, res *QueryOneTimeKeysResponse) error
+	// PerformRemoveDehydratedDevice is used when a dehydrated device is claimed by a new device
+	PerformRemoveDehydratedDevice(ctx context.Context, req *PerformRemoveDehydratedDeviceRequest, res *PerformRemoveDehydratedDeviceResponse) error
+}
+
+// API functions required by the appservice
+type AppserviceKeyAPI interface {
+	QueryOneTimeKeys(ctx context.Context, req *QueryOneTimeKeysRequest, res *QueryOneTimeKeysResponse) error
 }
 
 type FederationKeyAPI interface {
@@ -335,3 +353,56 @@ type QuerySignaturesResponse struct {
 	// The request error, if any
 	Error *KeyError
 }
+
+type QueryStaleDeviceListsRequest struct {
+	// If set, only users on this server are returned
+	ServerName gomatrixserverlib.ServerName
+}
+
+type QueryStaleDeviceListsResponse struct {
+	UserIDs []string
+}
+
+type PerformDeviceListResyncRequest struct {
+	// The user whose device list to fetch. If empty, the device lists of all known users on ServerName are fetched.
+	UserID     string
+	ServerName gomatrixserverlib.ServerName
+}
+
+type PerformDeviceListResyncResponse struct {
+	// How many device lists are being fetched
+	Count int64
+}
+
+type QueryDehydratedDeviceRequest struct {
+	UserID string
+}
+
+type QueryDehydratedDeviceResponse struct {
+	// The ID of the dehydrated device, or empty if the user doesn't have one
+	DeviceID string
+	// The pickled device, which is opaque to the server
+	DeviceData json.RawMessage
+}
+
+type PerformStoreDehydratedDeviceRequest struct {
+	UserID     string
+	DeviceID   string
+	DeviceData json.RawMessage
+}
+
+type PerformStoreDehydratedDeviceResponse struct {
+	// The ID of the dehydrated device which was replaced, if any. It should be deleted by the caller.
+	ReplacedDeviceID string
+}
+
+type PerformRemoveDehydratedDeviceRequest struct {
+	UserID string
+	// If set, the dehydrated device is only removed if it has this ID
+	DeviceID string
+}
+
+type PerformRemoveDehydratedDeviceResponse struct {
+	// The ID of the dehydrated device which was removed, or empty if nothing was removed
+	DeviceID string
+}
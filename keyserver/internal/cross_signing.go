@@ -257,7 +257,7 @@ func (a *KeyInternalAPI) PerformUploadDeviceKeys(ctx context.Context, req *api.P
 	if update.MasterKey == nil && update.SelfSigningKey == nil {
 		return nil
 	}
-	if err := a.Producer.ProduceSigningKeyUpdate(update); err != nil {
+	if err := a.Producer.ProduceSigningKeyUpdate(ctx, update); err != nil {
 		res.Error = &api.KeyError{
 			Err: fmt.Sprintf("a.Producer.ProduceSigningKeyUpdate: %s", err),
 		}
@@ -342,7 +342,7 @@ func (a *KeyInternalAPI) PerformUploadDeviceSignatures(ctx context.Context, req
 			MasterKey:      &masterKey,
 			SelfSigningKey: &selfSigningKey,
 		}
-		if err := a.Producer.ProduceSigningKeyUpdate(update); err != nil {
+		if err := a.Producer.ProduceSigningKeyUpdate(ctx, update); err != nil {
 			res.Error = &api.KeyError{
 				Err: fmt.Sprintf("a.Producer.ProduceSigningKeyUpdate: %s", err),
 			}
@@ -26,6 +26,7 @@ import (
 	"github.com/matrix-org/util"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
 
 	fedsenderapi "github.com/matrix-org/dendrite/federationapi/api"
 	"github.com/matrix-org/dendrite/keyserver/api"
@@ -41,17 +42,38 @@ var (
 		},
 		[]string{"server"},
 	)
+	deviceListGapCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "dendrite",
+			Subsystem: "keyserver",
+			Name:      "device_list_gap",
+			Help:      "Number of device list updates from this server which we couldn't apply because we had missed earlier updates",
+		},
+		[]string{"server"},
+	)
+	staleDeviceListsGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "dendrite",
+			Subsystem: "keyserver",
+			Name:      "stale_device_lists",
+			Help:      "Number of users on this server whose device lists are stale and waiting to be fetched",
+		},
+		[]string{"server"},
+	)
 )
 
 func init() {
 	prometheus.MustRegister(
-		deviceListUpdateCount,
+		deviceListUpdateCount, deviceListGapCount, staleDeviceListsGauge,
 	)
 }
 
 // DeviceListUpdater handles device list updates from remote servers.
 //
+// The updater remembers the stream ID of the latest update it has for each user. Updates which are no newer than that
+// are ignored, as we already have them or a device list which includes them.
 // In the case where we have the prev_id for an update, the updater just stores the update (after acquiring a per-user lock).
+// We have a prev_id if it is no newer than the latest stream ID we have, or if it is the stream ID of one of the user's devices.
 // In the case where we do not have the prev_id for an update, the updater marks the user_id as stale and notifies
 // a worker to get the latest device list for this user. Note: stream IDs are scoped per user so missing a prev_id
 // for a (user, device) does not mean that DEVICE is outdated as the previous ID could be for a different device:
@@ -62,8 +84,8 @@ func init() {
 // Workers are scoped by homeserver domain, with one worker responsible for many domains, determined by hashing
 // mod N the server name. Work is sent via a channel which just serves to "poke" the worker as the data is retrieved
 // from the database (which allows us to batch requests to the same server). This has a number of desirable properties:
-//   - We guarantee only 1 in-flight /keys/query request per server at any time as there is exactly 1 worker responsible
-//     for that domain.
+//   - We guarantee at most M in-flight requests per server at any time as there is exactly 1 worker responsible
+//     for that domain, which fetches at most M device lists from it at once.
 //   - We don't have unbounded growth in proportion to the number of servers (this is more important in a P2P world where
 //     we have many many servers)
 //   - We can adjust concurrency (at the cost of memory usage) by tuning N, to accommodate mobile devices vs servers.
@@ -89,6 +111,8 @@ type DeviceListUpdater struct {
 	producer    KeyChangeProducer
 	fedClient   fedsenderapi.KeyserverFederationAPI
 	workerChans []chan gomatrixserverlib.ServerName
+	// The most device lists which are fetched from a single server at once.
+	maxRequestsPerServer int
 
 	// When device lists are stale for a user, they get inserted into this map with a channel which `Update` will
 	// block on or timeout via a select.
@@ -116,6 +140,17 @@ type DeviceListUpdaterDatabase interface {
 
 	// DeviceKeysJSON populates the KeyJSON for the given keys. If any proided `keys` have a `KeyJSON` or `StreamID` already then it will be replaced.
 	DeviceKeysJSON(ctx context.Context, keys []api.DeviceMessage) error
+
+	// DeviceListStreamID returns the stream ID of the latest update to the user's device list which we have,
+	// or 0 if we don't know about the user.
+	DeviceListStreamID(ctx context.Context, userID string) (int64, error)
+
+	// StoreDeviceListStreamID sets the stream ID of the latest update to the user's device list which we have.
+	StoreDeviceListStreamID(ctx context.Context, userID string, streamID int64) error
+
+	// MarkServerDeviceListsStale marks the device lists of all known users on the server as stale, returning
+	// how many there are.
+	MarkServerDeviceListsStale(ctx context.Context, serverName gomatrixserverlib.ServerName) (int64, error)
 }
 
 type DeviceListUpdaterAPI interface {
@@ -124,24 +159,25 @@ type DeviceListUpdaterAPI interface {
 
 // KeyChangeProducer is the interface for producers.KeyChange useful for testing.
 type KeyChangeProducer interface {
-	ProduceKeyChanges(keys []api.DeviceMessage) error
+	ProduceKeyChanges(ctx context.Context, keys []api.DeviceMessage) error
 }
 
 // NewDeviceListUpdater creates a new updater which fetches fresh device lists when they go stale.
 func NewDeviceListUpdater(
 	db DeviceListUpdaterDatabase, api DeviceListUpdaterAPI, producer KeyChangeProducer,
-	fedClient fedsenderapi.KeyserverFederationAPI, numWorkers int,
+	fedClient fedsenderapi.KeyserverFederationAPI, numWorkers, maxRequestsPerServer int,
 ) *DeviceListUpdater {
 	return &DeviceListUpdater{
-		userIDToMutex:  make(map[string]*sync.Mutex),
-		mu:             &sync.Mutex{},
-		db:             db,
-		api:            api,
-		producer:       producer,
-		fedClient:      fedClient,
-		workerChans:    make([]chan gomatrixserverlib.ServerName, numWorkers),
-		userIDToChan:   make(map[string]chan bool),
-		userIDToChanMu: &sync.Mutex{},
+		userIDToMutex:        make(map[string]*sync.Mutex),
+		mu:                   &sync.Mutex{},
+		db:                   db,
+		api:                  api,
+		producer:             producer,
+		fedClient:            fedClient,
+		workerChans:          make([]chan gomatrixserverlib.ServerName, numWorkers),
+		maxRequestsPerServer: maxRequestsPerServer,
+		userIDToChan:         make(map[string]chan bool),
+		userIDToChanMu:       &sync.Mutex{},
 	}
 }
 
@@ -160,6 +196,15 @@ func (u *DeviceListUpdater) Start() error {
 	if err != nil {
 		return err
 	}
+	staleCounts := make(map[gomatrixserverlib.ServerName]int)
+	for _, userID := range staleLists {
+		if _, serverName, err := gomatrixserverlib.SplitID('@', userID); err == nil {
+			staleCounts[serverName]++
+		}
+	}
+	for serverName, count := range staleCounts {
+		staleDeviceListsGauge.WithLabelValues(string(serverName)).Set(float64(count))
+	}
 	offset, step := time.Second*10, time.Second
 	if max := len(staleLists); max > 120 {
 		step = (time.Second * 120) / time.Duration(max)
@@ -196,6 +241,19 @@ func (u *DeviceListUpdater) ManualUpdate(ctx context.Context, serverName gomatri
 	return nil
 }
 
+// ManualServerUpdate invalidates the device lists of all known users on the given server and fetches the latest
+// ones. Unlike ManualUpdate, it doesn't wait for them to be fetched. Returns how many device lists are invalidated.
+func (u *DeviceListUpdater) ManualServerUpdate(ctx context.Context, serverName gomatrixserverlib.ServerName) (int64, error) {
+	count, err := u.db.MarkServerDeviceListsStale(ctx, serverName)
+	if err != nil {
+		return 0, fmt.Errorf("ManualServerUpdate: failed to mark device lists for %s as stale: %w", serverName, err)
+	}
+	if count > 0 {
+		u.workerChan(serverName) <- serverName
+	}
+	return count, nil
+}
+
 // Update blocks until the update has been stored in the database. It blocks primarily for satisfying sytest,
 // which assumes when /send 200 OKs that the device lists have been updated.
 func (u *DeviceListUpdater) Update(ctx context.Context, event gomatrixserverlib.DeviceListUpdateEvent) error {
@@ -214,24 +272,40 @@ func (u *DeviceListUpdater) update(ctx context.Context, event gomatrixserverlib.
 	mu := u.mutex(event.UserID)
 	mu.Lock()
 	defer mu.Unlock()
-	// check if we have the prev IDs
-	exists, err := u.db.PrevIDsExists(ctx, event.UserID, event.PrevID)
+	lastStreamID, err := u.db.DeviceListStreamID(ctx, event.UserID)
 	if err != nil {
-		return false, fmt.Errorf("failed to check prev IDs exist for %s (%s): %w", event.UserID, event.DeviceID, err)
+		return false, fmt.Errorf("failed to get device list stream ID for %s: %w", event.UserID, err)
 	}
-	// if this is the first time we're hearing about this user, sync the device list manually.
-	if len(event.PrevID) == 0 {
-		exists = false
-	}
-	util.GetLogger(ctx).WithFields(logrus.Fields{
-		"prev_ids_exist": exists,
+	logger := util.GetLogger(ctx).WithFields(logrus.Fields{
 		"user_id":        event.UserID,
 		"device_id":      event.DeviceID,
 		"stream_id":      event.StreamID,
+		"last_stream_id": lastStreamID,
 		"prev_ids":       event.PrevID,
 		"display_name":   event.DeviceDisplayName,
 		"deleted":        event.Deleted,
-	}).Info("DeviceListUpdater.Update")
+	})
+	// we already have this update, or a device list which includes it
+	if lastStreamID > 0 && event.StreamID <= lastStreamID {
+		logger.Debug("DeviceListUpdater.Update: ignoring old update")
+		return false, nil
+	}
+	// check if we have the prev IDs. If this is the first time we're hearing about this user,
+	// there are none, so sync the device list manually.
+	exists := len(event.PrevID) > 0
+	for _, prevID := range event.PrevID {
+		if prevID > lastStreamID {
+			exists = false
+			break
+		}
+	}
+	if !exists && len(event.PrevID) > 0 {
+		exists, err = u.db.PrevIDsExists(ctx, event.UserID, event.PrevID)
+		if err != nil {
+			return false, fmt.Errorf("failed to check prev IDs exist for %s (%s): %w", event.UserID, event.DeviceID, err)
+		}
+	}
+	logger.WithField("prev_ids_exist", exists).Info("DeviceListUpdater.Update")
 
 	// if we haven't missed anything update the database and notify users
 	if exists || event.Deleted {
@@ -277,12 +351,21 @@ func (u *DeviceListUpdater) update(ctx context.Context, event gomatrixserverlib.
 			return false, fmt.Errorf("failed to store remote device keys for %s (%s): %w", event.UserID, event.DeviceID, err)
 		}
 
-		if err = emitDeviceKeyChanges(u.producer, existingKeys, keys, false); err != nil {
+		if err = emitDeviceKeyChanges(ctx, u.producer, existingKeys, keys, false); err != nil {
 			return false, fmt.Errorf("failed to produce device key changes for %s (%s): %w", event.UserID, event.DeviceID, err)
 		}
-		return false, nil
+		if exists {
+			if err = u.db.StoreDeviceListStreamID(ctx, event.UserID, event.StreamID); err != nil {
+				return false, fmt.Errorf("failed to store device list stream ID for %s: %w", event.UserID, err)
+			}
+			return false, nil
+		}
 	}
 
+	// we've missed some updates, so fetch the whole device list
+	if _, serverName, err := gomatrixserverlib.SplitID('@', event.UserID); err == nil {
+		deviceListGapCount.WithLabelValues(string(serverName)).Inc()
+	}
 	err = u.db.MarkDeviceListStale(ctx, event.UserID, true)
 	if err != nil {
 		return false, fmt.Errorf("failed to mark device list for %s as stale: %w", event.UserID, err)
@@ -296,12 +379,9 @@ func (u *DeviceListUpdater) notifyWorkers(userID string) {
 	if err != nil {
 		return
 	}
-	hash := fnv.New32a()
-	_, _ = hash.Write([]byte(remoteServer))
-	index := int(int64(hash.Sum32()) % int64(len(u.workerChans)))
 
 	ch := u.assignChannel(userID)
-	u.workerChans[index] <- remoteServer
+	u.workerChan(remoteServer) <- remoteServer
 	select {
 	case <-ch:
 	case <-time.After(10 * time.Second):
@@ -310,6 +390,14 @@ func (u *DeviceListUpdater) notifyWorkers(userID string) {
 	}
 }
 
+// workerChan returns the channel of the worker responsible for the server.
+func (u *DeviceListUpdater) workerChan(serverName gomatrixserverlib.ServerName) chan gomatrixserverlib.ServerName {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(serverName))
+	index := int(int64(hash.Sum32()) % int64(len(u.workerChans)))
+	return u.workerChans[index]
+}
+
 func (u *DeviceListUpdater) assignChannel(userID string) chan bool {
 	u.userIDToChanMu.Lock()
 	defer u.userIDToChanMu.Unlock()
@@ -380,55 +468,39 @@ func (u *DeviceListUpdater) processServer(serverName gomatrixserverlib.ServerNam
 		logger.WithError(err).Error("Failed to load stale device lists")
 		return waitTime, true
 	}
+	// fetch up to maxRequestsPerServer device lists at once
+	var wg sync.WaitGroup
+	var mu sync.Mutex // protects failCount and waitTime
 	failCount := 0
+	sem := make(chan struct{}, u.maxRequestsPerServer)
 	for _, userID := range userIDs {
+		sem <- struct{}{}
 		if ctx.Err() != nil {
 			// we've timed out, give up and go to the back of the queue to let another server be processed.
+			<-sem
+			mu.Lock()
 			failCount += 1
+			mu.Unlock()
 			break
 		}
-		res, err := u.fedClient.GetUserDevices(ctx, serverName, userID)
-		if err != nil {
-			failCount += 1
-			fcerr, ok := err.(*fedsenderapi.FederationClientError)
-			if ok {
-				if fcerr.RetryAfter > 0 {
-					waitTime = fcerr.RetryAfter
-				} else if fcerr.Blacklisted {
-					waitTime = time.Hour * 8
-				} else {
-					// For all other errors (DNS resolution, network etc.) wait 1 hour.
-					waitTime = time.Hour
-				}
-			} else {
-				waitTime = time.Hour
-				logger.WithError(err).WithField("user_id", userID).Debug("GetUserDevices returned unknown error type")
-			}
-			continue
-		}
-		if res.MasterKey != nil || res.SelfSigningKey != nil {
-			uploadReq := &api.PerformUploadDeviceKeysRequest{
-				UserID: userID,
-			}
-			uploadRes := &api.PerformUploadDeviceKeysResponse{}
-			if res.MasterKey != nil {
-				if err = sanityCheckKey(*res.MasterKey, userID, gomatrixserverlib.CrossSigningKeyPurposeMaster); err == nil {
-					uploadReq.MasterKey = *res.MasterKey
-				}
+		wg.Add(1)
+		go func(userID string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			userWaitTime, err := u.processUser(ctx, serverName, userID)
+			if err == nil {
+				return
 			}
-			if res.SelfSigningKey != nil {
-				if err = sanityCheckKey(*res.SelfSigningKey, userID, gomatrixserverlib.CrossSigningKeyPurposeSelfSigning); err == nil {
-					uploadReq.SelfSigningKey = *res.SelfSigningKey
-				}
-			}
-			_ = u.api.PerformUploadDeviceKeys(ctx, uploadReq, uploadRes)
-		}
-		err = u.updateDeviceList(&res)
-		if err != nil {
-			logger.WithError(err).WithField("user_id", userID).Error("Fetched device list but failed to store/emit it")
+			mu.Lock()
+			defer mu.Unlock()
 			failCount += 1
-		}
+			if userWaitTime > waitTime {
+				waitTime = userWaitTime
+			}
+		}(userID)
 	}
+	wg.Wait()
+	staleDeviceListsGauge.WithLabelValues(string(serverName)).Set(float64(failCount))
 	if failCount > 0 {
 		logger.WithField("total", len(userIDs)).WithField("failed", failCount).WithField("wait", waitTime).Warn("Failed to query device keys for some users")
 	}
@@ -439,8 +511,54 @@ func (u *DeviceListUpdater) processServer(serverName gomatrixserverlib.ServerNam
 	return waitTime, failCount > 0
 }
 
-func (u *DeviceListUpdater) updateDeviceList(res *gomatrixserverlib.RespUserDevices) error {
-	ctx := context.Background() // we've got the keys, don't time out when persisting them to the database.
+// processUser fetches and stores the device list of the user. If it fails, it returns how long to wait before
+// trying again, or 0 if there is no preference.
+func (u *DeviceListUpdater) processUser(
+	ctx context.Context, serverName gomatrixserverlib.ServerName, userID string,
+) (time.Duration, error) {
+	logger := util.GetLogger(ctx).WithField("server_name", serverName).WithField("user_id", userID)
+	res, err := u.fedClient.GetUserDevices(ctx, serverName, userID)
+	if err != nil {
+		fcerr, ok := err.(*fedsenderapi.FederationClientError)
+		switch {
+		case ok && fcerr.RetryAfter > 0:
+			return fcerr.RetryAfter, err
+		case ok && fcerr.Blacklisted:
+			return time.Hour * 8, err
+		case !ok:
+			logger.WithError(err).Debug("GetUserDevices returned unknown error type")
+		}
+		// For all other errors (DNS resolution, network etc.) wait 1 hour.
+		return time.Hour, err
+	}
+	if res.MasterKey != nil || res.SelfSigningKey != nil {
+		uploadReq := &api.PerformUploadDeviceKeysRequest{
+			UserID: userID,
+		}
+		uploadRes := &api.PerformUploadDeviceKeysResponse{}
+		if res.MasterKey != nil {
+			if err = sanityCheckKey(*res.MasterKey, userID, gomatrixserverlib.CrossSigningKeyPurposeMaster); err == nil {
+				uploadReq.MasterKey = *res.MasterKey
+			}
+		}
+		if res.SelfSigningKey != nil {
+			if err = sanityCheckKey(*res.SelfSigningKey, userID, gomatrixserverlib.CrossSigningKeyPurposeSelfSigning); err == nil {
+				uploadReq.SelfSigningKey = *res.SelfSigningKey
+			}
+		}
+		_ = u.api.PerformUploadDeviceKeys(ctx, uploadReq, uploadRes)
+	}
+	err = u.updateDeviceList(ctx, &res)
+	if err != nil {
+		logger.WithError(err).Error("Fetched device list but failed to store/emit it")
+		return 0, err
+	}
+	return 0, nil
+}
+
+func (u *DeviceListUpdater) updateDeviceList(ctx context.Context, res *gomatrixserverlib.RespUserDevices) error {
+	// we've got the keys, don't time out when persisting them to the database.
+	ctx = trace.ContextWithSpan(context.Background(), trace.SpanFromContext(ctx))
 	keys := make([]api.DeviceMessage, len(res.Devices))
 	existingKeys := make([]api.DeviceMessage, len(res.Devices))
 	for i, device := range res.Devices {
@@ -479,11 +597,15 @@ func (u *DeviceListUpdater) updateDeviceList(res *gomatrixserverlib.RespUserDevi
 	if err != nil {
 		return fmt.Errorf("failed to store remote device keys: %w", err)
 	}
+	err = u.db.StoreDeviceListStreamID(ctx, res.UserID, res.StreamID)
+	if err != nil {
+		return fmt.Errorf("failed to store device list stream ID: %w", err)
+	}
 	err = u.db.MarkDeviceListStale(ctx, res.UserID, false)
 	if err != nil {
 		return fmt.Errorf("failed to mark device list as fresh: %w", err)
 	}
-	err = emitDeviceKeyChanges(u.producer, existingKeys, keys, false)
+	err = emitDeviceKeyChanges(ctx, u.producer, existingKeys, keys, false)
 	if err != nil {
 		return fmt.Errorf("failed to emit key changes for fresh device list: %w", err)
 	}
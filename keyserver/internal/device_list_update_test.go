@@ -40,16 +40,17 @@ type mockKeyChangeProducer struct {
 	events []api.DeviceMessage
 }
 
-func (p *mockKeyChangeProducer) ProduceKeyChanges(keys []api.DeviceMessage) error {
+func (p *mockKeyChangeProducer) ProduceKeyChanges(ctx context.Context, keys []api.DeviceMessage) error {
 	p.events = append(p.events, keys...)
 	return nil
 }
 
 type mockDeviceListUpdaterDatabase struct {
 	staleUsers   map[string]bool
+	streamIDs    map[string]int64
 	prevIDsExist func(string, []int64) bool
 	storedKeys   []api.DeviceMessage
-	mu           sync.Mutex // protect staleUsers
+	mu           sync.Mutex // protect staleUsers and streamIDs
 }
 
 // StaleDeviceLists returns a list of user IDs ending with the domains provided who have stale device lists.
@@ -110,6 +111,35 @@ func (d *mockDeviceListUpdaterDatabase) DeviceKeysJSON(ctx context.Context, keys
 	return nil
 }
 
+func (d *mockDeviceListUpdaterDatabase) DeviceListStreamID(ctx context.Context, userID string) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.streamIDs[userID], nil
+}
+
+func (d *mockDeviceListUpdaterDatabase) StoreDeviceListStreamID(ctx context.Context, userID string, streamID int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.streamIDs == nil {
+		d.streamIDs = make(map[string]int64)
+	}
+	d.streamIDs[userID] = streamID
+	return nil
+}
+
+func (d *mockDeviceListUpdaterDatabase) MarkServerDeviceListsStale(ctx context.Context, serverName gomatrixserverlib.ServerName) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var count int64
+	for userID := range d.streamIDs {
+		if _, domain, _ := gomatrixserverlib.SplitID('@', userID); domain == serverName {
+			d.staleUsers[userID] = true
+			count++
+		}
+	}
+	return count, nil
+}
+
 type mockDeviceListUpdaterAPI struct {
 }
 
@@ -146,7 +176,7 @@ func TestUpdateHavePrevID(t *testing.T) {
 	}
 	ap := &mockDeviceListUpdaterAPI{}
 	producer := &mockKeyChangeProducer{}
-	updater := NewDeviceListUpdater(db, ap, producer, nil, 1)
+	updater := NewDeviceListUpdater(db, ap, producer, nil, 1, 1)
 	event := gomatrixserverlib.DeviceListUpdateEvent{
 		DeviceDisplayName: "Foo Bar",
 		Deleted:           false,
@@ -179,6 +209,63 @@ func TestUpdateHavePrevID(t *testing.T) {
 	if db.isStale(event.UserID) {
 		t.Errorf("%s incorrectly marked as stale", event.UserID)
 	}
+	if streamID, _ := db.DeviceListStreamID(ctx, event.UserID); streamID != event.StreamID {
+		t.Errorf("stream ID for %s is %d, want %d", event.UserID, streamID, event.StreamID)
+	}
+}
+
+// Test that updates are checked against the latest stream ID we have for the user, even if
+// the device with the prev ID no longer exists, and that older updates are ignored.
+func TestUpdateStreamIDs(t *testing.T) {
+	userID := "@alice:example.somewhere"
+	db := &mockDeviceListUpdaterDatabase{
+		staleUsers: make(map[string]bool),
+		streamIDs:  map[string]int64{userID: 5},
+		prevIDsExist: func(string, []int64) bool {
+			return false
+		},
+	}
+	producer := &mockKeyChangeProducer{}
+	updater := NewDeviceListUpdater(db, &mockDeviceListUpdaterAPI{}, producer, nil, 1, 1)
+	event := gomatrixserverlib.DeviceListUpdateEvent{
+		DeviceID: "FOO",
+		Keys:     []byte(`{"key":"value"}`),
+		PrevID:   []int64{3, 5},
+		StreamID: 6,
+		UserID:   userID,
+	}
+
+	// the update follows on from the latest one we have
+	stale, err := updater.update(ctx, event)
+	if err != nil {
+		t.Fatalf("update returned an error: %s", err)
+	}
+	if stale || len(db.storedKeys) != 1 {
+		t.Fatalf("update wasn't applied: stale=%v stored=%v", stale, db.storedKeys)
+	}
+	if streamID, _ := db.DeviceListStreamID(ctx, userID); streamID != 6 {
+		t.Fatalf("stream ID is %d, want 6", streamID)
+	}
+
+	// the update has already been applied
+	if stale, err = updater.update(ctx, event); err != nil {
+		t.Fatalf("update returned an error: %s", err)
+	}
+	if stale || len(db.storedKeys) != 1 {
+		t.Fatalf("old update was applied: stale=%v stored=%v", stale, db.storedKeys)
+	}
+
+	// we've missed the update with stream ID 7
+	event.PrevID, event.StreamID = []int64{7}, 8
+	if stale, err = updater.update(ctx, event); err != nil {
+		t.Fatalf("update returned an error: %s", err)
+	}
+	if !stale || !db.isStale(userID) || len(db.storedKeys) != 1 {
+		t.Fatalf("update after a gap wasn't marked as stale: stale=%v stored=%v", stale, db.storedKeys)
+	}
+	if streamID, _ := db.DeviceListStreamID(ctx, userID); streamID != 6 {
+		t.Fatalf("stream ID is %d, want 6", streamID)
+	}
 }
 
 // Test that device keys are fetched from the remote server if we are missing prev IDs
@@ -218,7 +305,7 @@ func TestUpdateNoPrevID(t *testing.T) {
 			`)),
 		}, nil
 	})
-	updater := NewDeviceListUpdater(db, ap, producer, fedClient, 2)
+	updater := NewDeviceListUpdater(db, ap, producer, fedClient, 2, 2)
 	if err := updater.Start(); err != nil {
 		t.Fatalf("failed to start updater: %s", err)
 	}
@@ -260,7 +347,9 @@ func TestUpdateNoPrevID(t *testing.T) {
 	if !reflect.DeepEqual(db.storedKeys, []api.DeviceMessage{want}) {
 		t.Errorf("DB didn't store correct event, got %v want %v", db.storedKeys, want)
 	}
-
+	if streamID, _ := db.DeviceListStreamID(ctx, event.UserID); streamID != 5 {
+		t.Errorf("stream ID for %s is %d, want 5", event.UserID, streamID)
+	}
 }
 
 // Test that if we make N calls to ManualUpdate for the same user, we only do it once, assuming the
@@ -287,7 +376,7 @@ func TestDebounce(t *testing.T) {
 		close(incomingFedReq)
 		return <-fedCh, nil
 	})
-	updater := NewDeviceListUpdater(db, ap, producer, fedClient, 1)
+	updater := NewDeviceListUpdater(db, ap, producer, fedClient, 1, 1)
 	if err := updater.Start(); err != nil {
 		t.Fatalf("failed to start updater: %s", err)
 	}
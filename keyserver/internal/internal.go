@@ -185,6 +185,73 @@ func (a *KeyInternalAPI) PerformDeleteKeys(ctx context.Context, req *api.Perform
 	return nil
 }
 
+func (a *KeyInternalAPI) QueryStaleDeviceLists(ctx context.Context, req *api.QueryStaleDeviceListsRequest, res *api.QueryStaleDeviceListsResponse) error {
+	var domains []gomatrixserverlib.ServerName
+	if req.ServerName != "" {
+		domains = append(domains, req.ServerName)
+	}
+	userIDs, err := a.DB.StaleDeviceLists(ctx, domains)
+	if err != nil {
+		return fmt.Errorf("a.DB.StaleDeviceLists: %w", err)
+	}
+	res.UserIDs = userIDs
+	return nil
+}
+
+func (a *KeyInternalAPI) PerformDeviceListResync(ctx context.Context, req *api.PerformDeviceListResyncRequest, res *api.PerformDeviceListResyncResponse) error {
+	if req.UserID == "" {
+		if req.ServerName == a.ThisServer {
+			return fmt.Errorf("device lists of local users can't be fetched")
+		}
+		count, err := a.Updater.ManualServerUpdate(ctx, req.ServerName)
+		if err != nil {
+			return err
+		}
+		res.Count = count
+		return nil
+	}
+	_, serverName, err := gomatrixserverlib.SplitID('@', req.UserID)
+	if err != nil {
+		return err
+	}
+	if serverName == a.ThisServer {
+		return fmt.Errorf("device lists of local users can't be fetched")
+	}
+	if err = a.Updater.ManualUpdate(ctx, serverName, req.UserID); err != nil {
+		return err
+	}
+	res.Count = 1
+	return nil
+}
+
+func (a *KeyInternalAPI) QueryDehydratedDevice(ctx context.Context, req *api.QueryDehydratedDeviceRequest, res *api.QueryDehydratedDeviceResponse) error {
+	deviceID, deviceData, err := a.DB.DehydratedDevice(ctx, req.UserID)
+	if err != nil {
+		return fmt.Errorf("a.DB.DehydratedDevice: %w", err)
+	}
+	res.DeviceID = deviceID
+	res.DeviceData = deviceData
+	return nil
+}
+
+func (a *KeyInternalAPI) PerformStoreDehydratedDevice(ctx context.Context, req *api.PerformStoreDehydratedDeviceRequest, res *api.PerformStoreDehydratedDeviceResponse) error {
+	replacedDeviceID, err := a.DB.StoreDehydratedDevice(ctx, req.UserID, req.DeviceID, req.DeviceData)
+	if err != nil {
+		return fmt.Errorf("a.DB.StoreDehydratedDevice: %w", err)
+	}
+	res.ReplacedDeviceID = replacedDeviceID
+	return nil
+}
+
+func (a *KeyInternalAPI) PerformRemoveDehydratedDevice(ctx context.Context, req *api.PerformRemoveDehydratedDeviceRequest, res *api.PerformRemoveDehydratedDeviceResponse) error {
+	deviceID, err := a.DB.RemoveDehydratedDevice(ctx, req.UserID, req.DeviceID)
+	if err != nil {
+		return fmt.Errorf("a.DB.RemoveDehydratedDevice: %w", err)
+	}
+	res.DeviceID = deviceID
+	return nil
+}
+
 func (a *KeyInternalAPI) QueryOneTimeKeys(ctx context.Context, req *api.QueryOneTimeKeysRequest, res *api.QueryOneTimeKeysResponse) error {
 	count, err := a.DB.OneTimeKeysCount(ctx, req.UserID, req.DeviceID)
 	if err != nil {
@@ -699,7 +766,7 @@ func (a *KeyInternalAPI) uploadLocalDeviceKeys(ctx context.Context, req *api.Per
 		}
 		return
 	}
-	err = emitDeviceKeyChanges(a.Producer, existingKeys, keysToStore, req.OnlyDisplayNameUpdates)
+	err = emitDeviceKeyChanges(ctx, a.Producer, existingKeys, keysToStore, req.OnlyDisplayNameUpdates)
 	if err != nil {
 		util.GetLogger(ctx).Errorf("Failed to emitDeviceKeyChanges: %s", err)
 	}
@@ -761,10 +828,10 @@ func (a *KeyInternalAPI) uploadOneTimeKeys(ctx context.Context, req *api.Perform
 
 }
 
-func emitDeviceKeyChanges(producer KeyChangeProducer, existing, new []api.DeviceMessage, onlyUpdateDisplayName bool) error {
+func emitDeviceKeyChanges(ctx context.Context, producer KeyChangeProducer, existing, new []api.DeviceMessage, onlyUpdateDisplayName bool) error {
 	// if we only want to update the display names, we can skip the checks below
 	if onlyUpdateDisplayName {
-		return producer.ProduceKeyChanges(new)
+		return producer.ProduceKeyChanges(ctx, new)
 	}
 	// find keys in new that are not in existing
 	var keysAdded []api.DeviceMessage
@@ -782,5 +849,5 @@ func emitDeviceKeyChanges(producer KeyChangeProducer, existing, new []api.Device
 			keysAdded = append(keysAdded, newKey)
 		}
 	}
-	return producer.ProduceKeyChanges(keysAdded)
+	return producer.ProduceKeyChanges(ctx, keysAdded)
 }
@@ -37,6 +37,11 @@ const (
 	QueryOneTimeKeysPath              = "/keyserver/queryOneTimeKeys"
 	QueryDeviceMessagesPath           = "/keyserver/queryDeviceMessages"
 	QuerySignaturesPath               = "/keyserver/querySignatures"
+	QueryStaleDeviceListsPath         = "/keyserver/queryStaleDeviceLists"
+	PerformDeviceListResyncPath       = "/keyserver/performDeviceListResync"
+	QueryDehydratedDevicePath         = "/keyserver/queryDehydratedDevice"
+	PerformStoreDehydratedDevicePath  = "/keyserver/performStoreDehydratedDevice"
+	PerformRemoveDehydratedDevicePath = "/keyserver/performRemoveDehydratedDevice"
 )
 
 // NewKeyServerClient creates a KeyInternalAPI implemented by talking to a HTTP POST API.
@@ -172,3 +177,58 @@ func (h *httpKeyInternalAPI) QuerySignatures(
 		h.httpClient, ctx, request, response,
 	)
 }
+
+func (h *httpKeyInternalAPI) QueryStaleDeviceLists(
+	ctx context.Context,
+	request *api.QueryStaleDeviceListsRequest,
+	response *api.QueryStaleDeviceListsResponse,
+) error {
+	return httputil.CallInternalRPCAPI(
+		"QueryStaleDeviceLists", h.apiURL+QueryStaleDeviceListsPath,
+		h.httpClient, ctx, request, response,
+	)
+}
+
+func (h *httpKeyInternalAPI) PerformDeviceListResync(
+	ctx context.Context,
+	request *api.PerformDeviceListResyncRequest,
+	response *api.PerformDeviceListResyncResponse,
+) error {
+	return httputil.CallInternalRPCAPI(
+		"PerformDeviceListResync", h.apiURL+PerformDeviceListResyncPath,
+		h.httpClient, ctx, request, response,
+	)
+}
+
+func (h *httpKeyInternalAPI) QueryDehydratedDevice(
+	ctx context.Context,
+	request *api.QueryDehydratedDeviceRequest,
+	response *api.QueryDehydratedDeviceResponse,
+) error {
+	return httputil.CallInternalRPCAPI(
+		"QueryDehydratedDevice", h.apiURL+QueryDehydratedDevicePath,
+		h.httpClient, ctx, request, response,
+	)
+}
+
+func (h *httpKeyInternalAPI) PerformStoreDehydratedDevice(
+	ctx context.Context,
+	request *api.PerformStoreDehydratedDeviceRequest,
+	response *api.PerformStoreDehydratedDeviceResponse,
+) error {
+	return httputil.CallInternalRPCAPI(
+		"PerformStoreDehydratedDevice", h.apiURL+PerformStoreDehydratedDevicePath,
+		h.httpClient, ctx, request, response,
+	)
+}
+
+func (h *httpKeyInternalAPI) PerformRemoveDehydratedDevice(
+	ctx context.Context,
+	request *api.PerformRemoveDehydratedDeviceRequest,
+	response *api.PerformRemoveDehydratedDeviceResponse,
+) error {
+	return httputil.CallInternalRPCAPI(
+		"PerformRemoveDehydratedDevice", h.apiURL+PerformRemoveDehydratedDevicePath,
+		h.httpClient, ctx, request, response,
+	)
+}
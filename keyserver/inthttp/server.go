@@ -70,4 +70,29 @@ func AddRoutes(internalAPIMux *mux.Router, s api.KeyInternalAPI) {
 		QuerySignaturesPath,
 		httputil.MakeInternalRPCAPI("KeyserverQuerySignatures", s.QuerySignatures),
 	)
+
+	internalAPIMux.Handle(
+		QueryStaleDeviceListsPath,
+		httputil.MakeInternalRPCAPI("KeyserverQueryStaleDeviceLists", s.QueryStaleDeviceLists),
+	)
+
+	internalAPIMux.Handle(
+		PerformDeviceListResyncPath,
+		httputil.MakeInternalRPCAPI("KeyserverPerformDeviceListResync", s.PerformDeviceListResync),
+	)
+
+	internalAPIMux.Handle(
+		QueryDehydratedDevicePath,
+		httputil.MakeInternalRPCAPI("KeyserverQueryDehydratedDevice", s.QueryDehydratedDevice),
+	)
+
+	internalAPIMux.Handle(
+		PerformStoreDehydratedDevicePath,
+		httputil.MakeInternalRPCAPI("KeyserverPerformStoreDehydratedDevice", s.PerformStoreDehydratedDevice),
+	)
+
+	internalAPIMux.Handle(
+		PerformRemoveDehydratedDevicePath,
+		httputil.MakeInternalRPCAPI("KeyserverPerformRemoveDehydratedDevice", s.PerformRemoveDehydratedDevice),
+	)
 }
@@ -57,7 +57,10 @@ func NewInternalAPI(
 		FedClient:  fedClient,
 		Producer:   keyChangeProducer,
 	}
-	updater := internal.NewDeviceListUpdater(db, ap, keyChangeProducer, fedClient, 8) // 8 workers TODO: configurable
+	updater := internal.NewDeviceListUpdater(
+		db, ap, keyChangeProducer, fedClient,
+		cfg.DeviceListUpdater.Workers, cfg.DeviceListUpdater.MaxRequestsPerServer,
+	)
 	ap.Updater = updater
 	go func() {
 		if err = updater.Start(); err != nil {
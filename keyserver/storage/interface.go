@@ -79,10 +79,32 @@ type Database interface {
 	// MarkDeviceListStale sets the stale bit for this user to isStale.
 	MarkDeviceListStale(ctx context.Context, userID string, isStale bool) error
 
+	// DeviceListStreamID returns the stream ID of the latest update to the user's device list which we have,
+	// or 0 if we don't know about the user.
+	DeviceListStreamID(ctx context.Context, userID string) (int64, error)
+
+	// StoreDeviceListStreamID sets the stream ID of the latest update to the user's device list which we have.
+	StoreDeviceListStreamID(ctx context.Context, userID string, streamID int64) error
+
+	// MarkServerDeviceListsStale marks the device lists of all known users on the server as stale, returning
+	// how many there are.
+	MarkServerDeviceListsStale(ctx context.Context, serverName gomatrixserverlib.ServerName) (int64, error)
+
 	CrossSigningKeysForUser(ctx context.Context, userID string) (map[gomatrixserverlib.CrossSigningKeyPurpose]gomatrixserverlib.CrossSigningKey, error)
 	CrossSigningKeysDataForUser(ctx context.Context, userID string) (types.CrossSigningKeyMap, error)
 	CrossSigningSigsForTarget(ctx context.Context, originUserID, targetUserID string, targetKeyID gomatrixserverlib.KeyID) (types.CrossSigningSigMap, error)
 
 	StoreCrossSigningKeysForUser(ctx context.Context, userID string, keyMap types.CrossSigningKeyMap) error
 	StoreCrossSigningSigsForTarget(ctx context.Context, originUserID string, originKeyID gomatrixserverlib.KeyID, targetUserID string, targetKeyID gomatrixserverlib.KeyID, signature gomatrixserverlib.Base64Bytes) error
+
+	// DehydratedDevice returns the ID and pickled data of the user's dehydrated device, or an empty device ID if
+	// they don't have one.
+	DehydratedDevice(ctx context.Context, userID string) (deviceID string, deviceData json.RawMessage, err error)
+
+	// StoreDehydratedDevice sets the user's dehydrated device, returning the ID of the one it replaces, if any.
+	StoreDehydratedDevice(ctx context.Context, userID, deviceID string, deviceData json.RawMessage) (replacedDeviceID string, err error)
+
+	// RemoveDehydratedDevice removes the user's dehydrated device, returning its ID, or an empty string if
+	// there was nothing to remove. If deviceID is set, the dehydrated device is only removed if it has that ID.
+	RemoveDehydratedDevice(ctx context.Context, userID, deviceID string) (removedDeviceID string, err error)
 }
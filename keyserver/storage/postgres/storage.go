@@ -52,18 +52,23 @@ func NewDatabase(base *base.BaseDendrite, dbProperties *config.DatabaseOptions)
 	if err != nil {
 		return nil, err
 	}
+	dd, err := NewPostgresDehydratedDevicesTable(db)
+	if err != nil {
+		return nil, err
+	}
 	if err = kc.Prepare(); err != nil {
 		return nil, err
 	}
 	d := &shared.Database{
-		DB:                    db,
-		Writer:                writer,
-		OneTimeKeysTable:      otk,
-		DeviceKeysTable:       dk,
-		KeyChangesTable:       kc,
-		StaleDeviceListsTable: sdl,
-		CrossSigningKeysTable: csk,
-		CrossSigningSigsTable: css,
+		DB:                     db,
+		Writer:                 writer,
+		OneTimeKeysTable:       otk,
+		DeviceKeysTable:        dk,
+		KeyChangesTable:        kc,
+		StaleDeviceListsTable:  sdl,
+		CrossSigningKeysTable:  csk,
+		CrossSigningSigsTable:  css,
+		DehydratedDevicesTable: dd,
 	}
 	return d, nil
 }
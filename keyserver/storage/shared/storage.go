@@ -28,14 +28,15 @@ import (
 )
 
 type Database struct {
-	DB                    *sql.DB
-	Writer                sqlutil.Writer
-	OneTimeKeysTable      tables.OneTimeKeys
-	DeviceKeysTable       tables.DeviceKeys
-	KeyChangesTable       tables.KeyChanges
-	StaleDeviceListsTable tables.StaleDeviceLists
-	CrossSigningKeysTable tables.CrossSigningKeys
-	CrossSigningSigsTable tables.CrossSigningSigs
+	DB                     *sql.DB
+	Writer                 sqlutil.Writer
+	OneTimeKeysTable       tables.OneTimeKeys
+	DeviceKeysTable        tables.DeviceKeys
+	KeyChangesTable        tables.KeyChanges
+	StaleDeviceListsTable  tables.StaleDeviceLists
+	CrossSigningKeysTable  tables.CrossSigningKeys
+	CrossSigningSigsTable  tables.CrossSigningSigs
+	DehydratedDevicesTable tables.DehydratedDevices
 }
 
 func (d *Database) ExistingOneTimeKeys(ctx context.Context, userID, deviceID string, keyIDsWithAlgorithms []string) (map[string]json.RawMessage, error) {
@@ -155,6 +156,29 @@ func (d *Database) MarkDeviceListStale(ctx context.Context, userID string, isSta
 	})
 }
 
+// DeviceListStreamID returns the stream ID of the latest update to the user's device list which we have,
+// or 0 if we don't know about the user.
+func (d *Database) DeviceListStreamID(ctx context.Context, userID string) (int64, error) {
+	return d.StaleDeviceListsTable.SelectDeviceListStreamID(ctx, userID)
+}
+
+// StoreDeviceListStreamID sets the stream ID of the latest update to the user's device list which we have.
+func (d *Database) StoreDeviceListStreamID(ctx context.Context, userID string, streamID int64) error {
+	return d.Writer.Do(nil, nil, func(_ *sql.Tx) error {
+		return d.StaleDeviceListsTable.UpsertDeviceListStreamID(ctx, userID, streamID)
+	})
+}
+
+// MarkServerDeviceListsStale marks the device lists of all known users on the server as stale, returning
+// how many there are.
+func (d *Database) MarkServerDeviceListsStale(ctx context.Context, serverName gomatrixserverlib.ServerName) (count int64, err error) {
+	err = d.Writer.Do(nil, nil, func(_ *sql.Tx) error {
+		count, err = d.StaleDeviceListsTable.UpdateStaleDeviceListsForDomain(ctx, serverName, true)
+		return err
+	})
+	return
+}
+
 // DeleteDeviceKeys removes the device keys for a given user/device, and any accompanying
 // cross-signing signatures relating to that device.
 func (d *Database) DeleteDeviceKeys(ctx context.Context, userID string, deviceIDs []gomatrixserverlib.KeyID) error {
@@ -249,3 +273,35 @@ func (d *Database) StoreCrossSigningSigsForTarget(
 		return nil
 	})
 }
+
+func (d *Database) DehydratedDevice(ctx context.Context, userID string) (string, json.RawMessage, error) {
+	return d.DehydratedDevicesTable.SelectDehydratedDevice(ctx, nil, userID)
+}
+
+func (d *Database) StoreDehydratedDevice(ctx context.Context, userID, deviceID string, deviceData json.RawMessage) (replacedDeviceID string, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		replacedDeviceID, _, err = d.DehydratedDevicesTable.SelectDehydratedDevice(ctx, txn, userID)
+		if err != nil {
+			return err
+		}
+		return d.DehydratedDevicesTable.UpsertDehydratedDevice(ctx, txn, userID, deviceID, deviceData)
+	})
+	return
+}
+
+func (d *Database) RemoveDehydratedDevice(ctx context.Context, userID, deviceID string) (removedDeviceID string, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		if deviceID == "" {
+			deviceID, _, err = d.DehydratedDevicesTable.SelectDehydratedDevice(ctx, txn, userID)
+			if err != nil || deviceID == "" {
+				return err
+			}
+		}
+		removed, err := d.DehydratedDevicesTable.DeleteDehydratedDevice(ctx, txn, userID, deviceID)
+		if removed {
+			removedDeviceID = deviceID
+		}
+		return err
+	})
+	return
+}
@@ -0,0 +1,103 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/keyserver/storage/tables"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+var dehydratedDevicesSchema = `
+-- Stores the dehydrated device of each user, which receives to-device messages
+-- while the user has no other devices online.
+CREATE TABLE IF NOT EXISTS keyserver_dehydrated_devices (
+	user_id TEXT NOT NULL PRIMARY KEY,
+	device_id TEXT NOT NULL,
+	-- The pickled device, encrypted by the client.
+	device_data TEXT NOT NULL,
+	created_ts BIGINT NOT NULL
+);
+`
+
+const selectDehydratedDeviceSQL = "" +
+	"SELECT device_id, device_data FROM keyserver_dehydrated_devices" +
+	" WHERE user_id = $1"
+
+const upsertDehydratedDeviceSQL = "" +
+	"INSERT OR REPLACE INTO keyserver_dehydrated_devices (user_id, device_id, device_data, created_ts)" +
+	" VALUES($1, $2, $3, $4)"
+
+const deleteDehydratedDeviceSQL = "" +
+	"DELETE FROM keyserver_dehydrated_devices" +
+	" WHERE user_id = $1 AND device_id = $2"
+
+type dehydratedDevicesStatements struct {
+	selectDehydratedDeviceStmt *sql.Stmt
+	upsertDehydratedDeviceStmt *sql.Stmt
+	deleteDehydratedDeviceStmt *sql.Stmt
+}
+
+func NewSqliteDehydratedDevicesTable(db *sql.DB) (tables.DehydratedDevices, error) {
+	s := &dehydratedDevicesStatements{}
+	_, err := db.Exec(dehydratedDevicesSchema)
+	if err != nil {
+		return nil, err
+	}
+	return s, sqlutil.StatementList{
+		{&s.selectDehydratedDeviceStmt, selectDehydratedDeviceSQL},
+		{&s.upsertDehydratedDeviceStmt, upsertDehydratedDeviceSQL},
+		{&s.deleteDehydratedDeviceStmt, deleteDehydratedDeviceSQL},
+	}.Prepare(db)
+}
+
+func (s *dehydratedDevicesStatements) SelectDehydratedDevice(
+	ctx context.Context, txn *sql.Tx, userID string,
+) (deviceID string, deviceData json.RawMessage, err error) {
+	var data string
+	err = sqlutil.TxStmt(txn, s.selectDehydratedDeviceStmt).QueryRowContext(ctx, userID).Scan(&deviceID, &data)
+	if err == sql.ErrNoRows {
+		return "", nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return deviceID, json.RawMessage(data), nil
+}
+
+func (s *dehydratedDevicesStatements) UpsertDehydratedDevice(
+	ctx context.Context, txn *sql.Tx, userID, deviceID string, deviceData json.RawMessage,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.upsertDehydratedDeviceStmt).ExecContext(
+		ctx, userID, deviceID, string(deviceData), gomatrixserverlib.AsTimestamp(time.Now()),
+	)
+	return err
+}
+
+func (s *dehydratedDevicesStatements) DeleteDehydratedDevice(
+	ctx context.Context, txn *sql.Tx, userID, deviceID string,
+) (bool, error) {
+	res, err := sqlutil.TxStmt(txn, s.deleteDehydratedDeviceStmt).ExecContext(ctx, userID, deviceID)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	return count > 0, err
+}
@@ -20,6 +20,8 @@ import (
 	"time"
 
 	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/keyserver/storage/sqlite3/deltas"
 	"github.com/matrix-org/dendrite/keyserver/storage/tables"
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -42,6 +44,18 @@ const upsertStaleDeviceListSQL = "" +
 	" ON CONFLICT (user_id)" +
 	" DO UPDATE SET is_stale = $3, ts_added_secs = $4"
 
+const upsertDeviceListStreamIDSQL = "" +
+	"INSERT INTO keyserver_stale_device_lists (user_id, domain, is_stale, ts_added_secs, stream_id)" +
+	" VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT (user_id)" +
+	" DO UPDATE SET stream_id = $5"
+
+const selectDeviceListStreamIDSQL = "" +
+	"SELECT stream_id FROM keyserver_stale_device_lists WHERE user_id = $1"
+
+const updateStaleDeviceListsForDomainSQL = "" +
+	"UPDATE keyserver_stale_device_lists SET is_stale = $1, ts_added_secs = $2 WHERE domain = $3"
+
 const selectStaleDeviceListsWithDomainsSQL = "" +
 	"SELECT user_id FROM keyserver_stale_device_lists WHERE is_stale = $1 AND domain = $2"
 
@@ -53,6 +67,9 @@ type staleDeviceListsStatements struct {
 	upsertStaleDeviceListStmt             *sql.Stmt
 	selectStaleDeviceListsWithDomainsStmt *sql.Stmt
 	selectStaleDeviceListsStmt            *sql.Stmt
+	upsertDeviceListStreamIDStmt          *sql.Stmt
+	selectDeviceListStreamIDStmt          *sql.Stmt
+	updateStaleDeviceListsForDomainStmt   *sql.Stmt
 }
 
 func NewSqliteStaleDeviceListsTable(db *sql.DB) (tables.StaleDeviceLists, error) {
@@ -63,6 +80,15 @@ func NewSqliteStaleDeviceListsTable(db *sql.DB) (tables.StaleDeviceLists, error)
 	if err != nil {
 		return nil, err
 	}
+	m := sqlutil.NewMigrator(db)
+	m.AddMigrations(sqlutil.Migration{
+		Version: "keyserver: add stale device lists stream ID",
+		Up:      deltas.UpAddStaleDeviceListsStreamID,
+		Down:    deltas.DownAddStaleDeviceListsStreamID,
+	})
+	if err = m.Up(context.Background()); err != nil {
+		return nil, err
+	}
 	if s.upsertStaleDeviceListStmt, err = db.Prepare(upsertStaleDeviceListSQL); err != nil {
 		return nil, err
 	}
@@ -72,6 +98,15 @@ func NewSqliteStaleDeviceListsTable(db *sql.DB) (tables.StaleDeviceLists, error)
 	if s.selectStaleDeviceListsWithDomainsStmt, err = db.Prepare(selectStaleDeviceListsWithDomainsSQL); err != nil {
 		return nil, err
 	}
+	if s.upsertDeviceListStreamIDStmt, err = db.Prepare(upsertDeviceListStreamIDSQL); err != nil {
+		return nil, err
+	}
+	if s.selectDeviceListStreamIDStmt, err = db.Prepare(selectDeviceListStreamIDSQL); err != nil {
+		return nil, err
+	}
+	if s.updateStaleDeviceListsForDomainStmt, err = db.Prepare(updateStaleDeviceListsForDomainSQL); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
@@ -84,6 +119,31 @@ func (s *staleDeviceListsStatements) InsertStaleDeviceList(ctx context.Context,
 	return err
 }
 
+func (s *staleDeviceListsStatements) UpsertDeviceListStreamID(ctx context.Context, userID string, streamID int64) error {
+	_, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return err
+	}
+	_, err = s.upsertDeviceListStreamIDStmt.ExecContext(ctx, userID, string(domain), false, time.Now().Unix(), streamID)
+	return err
+}
+
+func (s *staleDeviceListsStatements) SelectDeviceListStreamID(ctx context.Context, userID string) (streamID int64, err error) {
+	err = s.selectDeviceListStreamIDStmt.QueryRowContext(ctx, userID).Scan(&streamID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return
+}
+
+func (s *staleDeviceListsStatements) UpdateStaleDeviceListsForDomain(ctx context.Context, domain gomatrixserverlib.ServerName, isStale bool) (int64, error) {
+	res, err := s.updateStaleDeviceListsForDomainStmt.ExecContext(ctx, isStale, time.Now().Unix(), string(domain))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
 func (s *staleDeviceListsStatements) SelectUserIDsWithStaleDeviceLists(ctx context.Context, domains []gomatrixserverlib.ServerName) ([]string, error) {
 	// we only query for 1 domain or all domains so optimise for those use cases
 	if len(domains) == 0 {
@@ -50,19 +50,24 @@ func NewDatabase(base *base.BaseDendrite, dbProperties *config.DatabaseOptions)
 	if err != nil {
 		return nil, err
 	}
+	dd, err := NewSqliteDehydratedDevicesTable(db)
+	if err != nil {
+		return nil, err
+	}
 
 	if err = kc.Prepare(); err != nil {
 		return nil, err
 	}
 	d := &shared.Database{
-		DB:                    db,
-		Writer:                writer,
-		OneTimeKeysTable:      otk,
-		DeviceKeysTable:       dk,
-		KeyChangesTable:       kc,
-		StaleDeviceListsTable: sdl,
-		CrossSigningKeysTable: csk,
-		CrossSigningSigsTable: css,
+		DB:                     db,
+		Writer:                 writer,
+		OneTimeKeysTable:       otk,
+		DeviceKeysTable:        dk,
+		KeyChangesTable:        kc,
+		StaleDeviceListsTable:  sdl,
+		CrossSigningKeysTable:  csk,
+		CrossSigningSigsTable:  css,
+		DehydratedDevicesTable: dd,
 	}
 	return d, nil
 }
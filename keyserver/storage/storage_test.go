@@ -3,6 +3,7 @@ package storage_test
 import (
 	"context"
 	"reflect"
+	"sort"
 	"sync"
 	"testing"
 
@@ -195,3 +196,94 @@ func TestDeviceKeysStreamIDGeneration(t *testing.T) {
 		}
 	})
 }
+
+func TestDeviceListStreamIDs(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, clean := MustCreateDatabase(t, dbType)
+		defer clean()
+		alice := "@alice:remote"
+		bob := "@bob:remote"
+		charlie := "@charlie:elsewhere"
+
+		// unknown users have no stream ID
+		streamID, err := db.DeviceListStreamID(ctx, alice)
+		MustNotError(t, err)
+		if streamID != 0 {
+			t.Fatalf("expected no stream ID, got %d", streamID)
+		}
+
+		MustNotError(t, db.StoreDeviceListStreamID(ctx, alice, 5))
+		MustNotError(t, db.MarkDeviceListStale(ctx, bob, true))
+		MustNotError(t, db.MarkDeviceListStale(ctx, bob, false))
+		MustNotError(t, db.StoreDeviceListStreamID(ctx, charlie, 2))
+
+		// marking the device list as stale keeps the stream ID
+		MustNotError(t, db.MarkDeviceListStale(ctx, alice, true))
+		streamID, err = db.DeviceListStreamID(ctx, alice)
+		MustNotError(t, err)
+		if streamID != 5 {
+			t.Fatalf("expected stream ID 5, got %d", streamID)
+		}
+		MustNotError(t, db.MarkDeviceListStale(ctx, alice, false))
+
+		// all known users on the server are marked as stale
+		count, err := db.MarkServerDeviceListsStale(ctx, "remote")
+		MustNotError(t, err)
+		if count != 2 {
+			t.Fatalf("expected 2 device lists to be marked as stale, got %d", count)
+		}
+		stale, err := db.StaleDeviceLists(ctx, nil)
+		MustNotError(t, err)
+		sort.Strings(stale)
+		if !reflect.DeepEqual(stale, []string{alice, bob}) {
+			t.Fatalf("expected stale device lists for %s and %s, got %v", alice, bob, stale)
+		}
+	})
+}
+
+func TestDehydratedDevices(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, clean := MustCreateDatabase(t, dbType)
+		defer clean()
+		alice := "@alice:localhost"
+
+		deviceID, _, err := db.DehydratedDevice(ctx, alice)
+		MustNotError(t, err)
+		if deviceID != "" {
+			t.Fatalf("expected no dehydrated device, got %s", deviceID)
+		}
+
+		replaced, err := db.StoreDehydratedDevice(ctx, alice, "DEVICE1", []byte(`{"algorithm":"a"}`))
+		MustNotError(t, err)
+		if replaced != "" {
+			t.Fatalf("expected no device to be replaced, got %s", replaced)
+		}
+		replaced, err = db.StoreDehydratedDevice(ctx, alice, "DEVICE2", []byte(`{"algorithm":"b"}`))
+		MustNotError(t, err)
+		if replaced != "DEVICE1" {
+			t.Fatalf("expected DEVICE1 to be replaced, got %q", replaced)
+		}
+		deviceID, deviceData, err := db.DehydratedDevice(ctx, alice)
+		MustNotError(t, err)
+		if deviceID != "DEVICE2" || string(deviceData) != `{"algorithm":"b"}` {
+			t.Fatalf("unexpected dehydrated device %s: %s", deviceID, deviceData)
+		}
+
+		// the replaced device can't be removed
+		removed, err := db.RemoveDehydratedDevice(ctx, alice, "DEVICE1")
+		MustNotError(t, err)
+		if removed != "" {
+			t.Fatalf("expected nothing to be removed, got %s", removed)
+		}
+		removed, err = db.RemoveDehydratedDevice(ctx, alice, "")
+		MustNotError(t, err)
+		if removed != "DEVICE2" {
+			t.Fatalf("expected DEVICE2 to be removed, got %q", removed)
+		}
+		deviceID, _, err = db.DehydratedDevice(ctx, alice)
+		MustNotError(t, err)
+		if deviceID != "" {
+			t.Fatalf("expected no dehydrated device, got %s", deviceID)
+		}
+	})
+}
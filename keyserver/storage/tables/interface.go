@@ -56,6 +56,13 @@ type KeyChanges interface {
 type StaleDeviceLists interface {
 	InsertStaleDeviceList(ctx context.Context, userID string, isStale bool) error
 	SelectUserIDsWithStaleDeviceLists(ctx context.Context, domains []gomatrixserverlib.ServerName) ([]string, error)
+	// UpsertDeviceListStreamID sets the stream ID of the latest update to the user's device list which we have.
+	UpsertDeviceListStreamID(ctx context.Context, userID string, streamID int64) error
+	// SelectDeviceListStreamID returns the stream ID of the latest update to the user's device list which we have,
+	// or 0 if we don't know about the user.
+	SelectDeviceListStreamID(ctx context.Context, userID string) (int64, error)
+	// UpdateStaleDeviceListsForDomain sets the stale bit of all known users on the domain, returning how many there are.
+	UpdateStaleDeviceListsForDomain(ctx context.Context, domain gomatrixserverlib.ServerName, isStale bool) (int64, error)
 }
 
 type CrossSigningKeys interface {
@@ -68,3 +75,11 @@ type CrossSigningSigs interface {
 	UpsertCrossSigningSigsForTarget(ctx context.Context, txn *sql.Tx, originUserID string, originKeyID gomatrixserverlib.KeyID, targetUserID string, targetKeyID gomatrixserverlib.KeyID, signature gomatrixserverlib.Base64Bytes) error
 	DeleteCrossSigningSigsForTarget(ctx context.Context, txn *sql.Tx, targetUserID string, targetKeyID gomatrixserverlib.KeyID) error
 }
+
+type DehydratedDevices interface {
+	// SelectDehydratedDevice returns the dehydrated device of the user, or an empty device ID if they don't have one.
+	SelectDehydratedDevice(ctx context.Context, txn *sql.Tx, userID string) (deviceID string, deviceData json.RawMessage, err error)
+	UpsertDehydratedDevice(ctx context.Context, txn *sql.Tx, userID, deviceID string, deviceData json.RawMessage) error
+	// DeleteDehydratedDevice removes the dehydrated device of the user if it has the given device ID, returning whether it did.
+	DeleteDehydratedDevice(ctx context.Context, txn *sql.Tx, userID, deviceID string) (bool, error)
+}
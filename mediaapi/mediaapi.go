@@ -15,9 +15,11 @@
 package mediaapi
 
 import (
+	"github.com/matrix-org/dendrite/internal/httputil"
 	"github.com/matrix-org/dendrite/mediaapi/routing"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/setup/base"
+	"github.com/matrix-org/dendrite/setup/config"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/sirupsen/logrus"
@@ -30,7 +32,10 @@ func AddPublicRoutes(
 	client *gomatrixserverlib.Client,
 ) {
 	cfg := &base.Cfg.MediaAPI
-	rateCfg := &base.Cfg.ClientAPI.RateLimiting
+	rateLimits := httputil.NewRateLimits(&base.Cfg.ClientAPI.RateLimiting)
+	base.OnConfigReload(func(cfg *config.Dendrite) {
+		rateLimits.Update(&cfg.ClientAPI.RateLimiting)
+	})
 
 	mediaDB, err := storage.NewMediaAPIDatasource(base, &cfg.Database)
 	if err != nil {
@@ -38,6 +43,6 @@ func AddPublicRoutes(
 	}
 
 	routing.Setup(
-		base.PublicMediaAPIMux, cfg, rateCfg, mediaDB, userAPI, client,
+		base.PublicMediaAPIMux, cfg, rateLimits, mediaDB, userAPI, client,
 	)
 }
@@ -21,6 +21,7 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/internal/policy"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/types"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -46,12 +47,12 @@ type configResponse struct {
 func Setup(
 	publicAPIMux *mux.Router,
 	cfg *config.MediaAPI,
-	rateLimit *config.RateLimiting,
+	rateLimits *httputil.RateLimits,
 	db storage.Database,
 	userAPI userapi.MediaUserAPI,
 	client *gomatrixserverlib.Client,
 ) {
-	rateLimits := httputil.NewRateLimits(rateLimit)
+	checker := policy.NewChecker(&cfg.Matrix.Policy)
 
 	v3mux := publicAPIMux.PathPrefix("/{apiversion:(?:r0|v1|v3)}/").Subrouter()
 
@@ -65,7 +66,7 @@ func Setup(
 			if r := rateLimits.Limit(req, dev); r != nil {
 				return *r
 			}
-			return Upload(req, cfg, dev, db, activeThumbnailGeneration)
+			return Upload(req, cfg, dev, db, activeThumbnailGeneration, checker)
 		},
 	)
 
@@ -362,6 +362,20 @@ func (t *RoomserverInternalAPITrace) QueryServerBannedFromRoom(ctx context.Conte
 	return err
 }
 
+// QueryBannedByPolicy returns whether users, a room or a server are banned by moderation policy lists.
+func (t *RoomserverInternalAPITrace) QueryBannedByPolicy(ctx context.Context, req *QueryBannedByPolicyRequest, res *QueryBannedByPolicyResponse) error {
+	err := t.Impl.QueryBannedByPolicy(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryBannedByPolicy req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+// QueryPolicyRules returns the active rules from the moderation policy lists.
+func (t *RoomserverInternalAPITrace) QueryPolicyRules(ctx context.Context, req *QueryPolicyRulesRequest, res *QueryPolicyRulesResponse) error {
+	err := t.Impl.QueryPolicyRules(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryPolicyRules req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
 func (t *RoomserverInternalAPITrace) QueryAuthChain(
 	ctx context.Context,
 	request *QueryAuthChainRequest,
@@ -83,6 +83,10 @@ type InputRoomEvent struct {
 	// The transaction ID of the send request if sent by a local user and one
 	// was specified
 	TransactionID *TransactionID `json:"transaction_id"`
+	// Whether the event should be soft-failed regardless of whether it passes
+	// auth checks against the current room state, e.g. because a policy
+	// module asked for it to be.
+	SoftFail bool `json:"soft_fail,omitempty"`
 }
 
 // TransactionID contains the transaction ID sent by a client when sending an
@@ -348,6 +348,40 @@ type QueryServerBannedFromRoomResponse struct {
 	Banned bool `json:"banned"`
 }
 
+// PolicyRule is a ban rule from a moderation policy list.
+type PolicyRule struct {
+	// The room ID of the policy list the rule came from.
+	RoomID string `json:"room_id"`
+	// The event ID of the m.policy.rule.* event.
+	EventID string `json:"event_id"`
+	// The kind of entity the rule applies to: "user", "room" or "server".
+	Kind string `json:"kind"`
+	// The entity, which may contain * and ? glob characters.
+	Entity         string `json:"entity"`
+	Recommendation string `json:"recommendation"`
+	Reason         string `json:"reason"`
+}
+
+type QueryPolicyRulesRequest struct{}
+
+type QueryPolicyRulesResponse struct {
+	Rules []PolicyRule `json:"rules"`
+}
+
+// QueryBannedByPolicyRequest asks whether any of the given entities are banned
+// by the configured moderation policy lists. Server rules also apply to the
+// server names of the given user IDs.
+type QueryBannedByPolicyRequest struct {
+	UserIDs    []string                     `json:"user_ids"`
+	RoomID     string                       `json:"room_id"`
+	ServerName gomatrixserverlib.ServerName `json:"server_name"`
+}
+
+type QueryBannedByPolicyResponse struct {
+	// The first matching rule, or nil if nothing is banned.
+	Rule *PolicyRule `json:"rule,omitempty"`
+}
+
 type QueryRestrictedJoinAllowedRequest struct {
 	UserID string `json:"user_id"`
 	RoomID string `json:"room_id"`
@@ -12,6 +12,7 @@ import (
 	"github.com/matrix-org/dendrite/roomserver/internal/input"
 	"github.com/matrix-org/dendrite/roomserver/internal/perform"
 	"github.com/matrix-org/dendrite/roomserver/internal/query"
+	"github.com/matrix-org/dendrite/roomserver/policylist"
 	"github.com/matrix-org/dendrite/roomserver/producers"
 	"github.com/matrix-org/dendrite/roomserver/storage"
 	"github.com/matrix-org/dendrite/setup/base"
@@ -47,6 +48,7 @@ type RoomserverInternalAPI struct {
 	ServerName             gomatrixserverlib.ServerName
 	KeyRing                gomatrixserverlib.JSONVerifier
 	ServerACLs             *acls.ServerACLs
+	PolicyLists            *policylist.PolicyLists
 	fsAPI                  fsAPI.RoomserverFederationAPI
 	asAPI                  asAPI.AppServiceInternalAPI
 	NATSClient             *nats.Conn
@@ -67,10 +69,12 @@ func NewRoomserverAPI(
 	}
 
 	serverACLs := acls.NewServerACLs(roomserverDB)
+	policyLists := policylist.NewPolicyLists(roomserverDB, base.Cfg.RoomServer.PolicyLists)
 	producer := &producers.RoomEventProducer{
-		Topic:     string(base.Cfg.Global.JetStream.Prefixed(jetstream.OutputRoomEvent)),
-		JetStream: js,
-		ACLs:      serverACLs,
+		Topic:       string(base.Cfg.Global.JetStream.Prefixed(jetstream.OutputRoomEvent)),
+		JetStream:   js,
+		ACLs:        serverACLs,
+		PolicyLists: policyLists,
 	}
 	a := &RoomserverInternalAPI{
 		ProcessContext:         base.ProcessContext,
@@ -86,11 +90,13 @@ func NewRoomserverAPI(
 		NATSClient:             nc,
 		Durable:                base.Cfg.Global.JetStream.Durable("RoomserverInputConsumer"),
 		ServerACLs:             serverACLs,
+		PolicyLists:            policyLists,
 		Queryer: &query.Queryer{
-			DB:         roomserverDB,
-			Cache:      base.Caches,
-			ServerName: base.Cfg.Global.ServerName,
-			ServerACLs: serverACLs,
+			DB:          roomserverDB,
+			Cache:       base.Caches,
+			ServerName:  base.Cfg.Global.ServerName,
+			ServerACLs:  serverACLs,
+			PolicyLists: policyLists,
 		},
 		// perform-er structs get initialised when we have a federation sender to use
 	}
@@ -121,19 +127,21 @@ func (r *RoomserverInternalAPI) SetFederationAPI(fsAPI fsAPI.RoomserverFederatio
 		Queryer:             r.Queryer,
 	}
 	r.Inviter = &perform.Inviter{
-		DB:      r.DB,
-		Cfg:     r.Cfg,
-		FSAPI:   r.fsAPI,
-		Inputer: r.Inputer,
+		DB:          r.DB,
+		Cfg:         r.Cfg,
+		FSAPI:       r.fsAPI,
+		Inputer:     r.Inputer,
+		PolicyLists: r.PolicyLists,
 	}
 	r.Joiner = &perform.Joiner{
-		ServerName: r.Cfg.Matrix.ServerName,
-		Cfg:        r.Cfg,
-		DB:         r.DB,
-		FSAPI:      r.fsAPI,
-		RSAPI:      r,
-		Inputer:    r.Inputer,
-		Queryer:    r.Queryer,
+		ServerName:  r.Cfg.Matrix.ServerName,
+		Cfg:         r.Cfg,
+		DB:          r.DB,
+		FSAPI:       r.fsAPI,
+		RSAPI:       r,
+		Inputer:     r.Inputer,
+		Queryer:     r.Queryer,
+		PolicyLists: r.PolicyLists,
 	}
 	r.Peeker = &perform.Peeker{
 		ServerName: r.Cfg.Matrix.ServerName,
@@ -213,7 +221,7 @@ func (r *RoomserverInternalAPI) PerformInvite(
 	if len(outputEvents) == 0 {
 		return nil
 	}
-	return r.OutputProducer.ProduceRoomEvents(req.Event.RoomID(), outputEvents)
+	return r.OutputProducer.ProduceRoomEvents(ctx, req.Event.RoomID(), outputEvents)
 }
 
 func (r *RoomserverInternalAPI) PerformLeave(
@@ -229,7 +237,7 @@ func (r *RoomserverInternalAPI) PerformLeave(
 	if len(outputEvents) == 0 {
 		return nil
 	}
-	return r.OutputProducer.ProduceRoomEvents(req.RoomID, outputEvents)
+	return r.OutputProducer.ProduceRoomEvents(ctx, req.RoomID, outputEvents)
 }
 
 func (r *RoomserverInternalAPI) PerformForget(
@@ -29,6 +29,7 @@ import (
 	"github.com/nats-io/nats.go"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
 
 	fedapi "github.com/matrix-org/dendrite/federationapi/api"
 	"github.com/matrix-org/dendrite/roomserver/acls"
@@ -42,6 +43,8 @@ import (
 	"github.com/matrix-org/dendrite/setup/process"
 )
 
+var tracer = otel.Tracer("github.com/matrix-org/dendrite/roomserver/internal/input")
+
 // Inputer is responsible for consuming from the roomserver input
 // streams and processing the events. All input events are queued
 // into a single NATS stream and the order is preserved strictly.
@@ -245,8 +248,10 @@ func (w *worker) _next() {
 	// NATS to terminate the message. We'll store the error result as
 	// a string, because we might want to return that to the caller if
 	// it was a synchronous request.
+	ctx, span := jetstream.StartSpan(w.r.ProcessContext.Context(), msg, "InputRoomEvent")
+	defer span.End()
 	var errString string
-	if err = w.r.processRoomEvent(w.r.ProcessContext.Context(), &inputRoomEvent); err != nil {
+	if err = w.r.processRoomEvent(ctx, &inputRoomEvent); err != nil {
 		if !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, context.Canceled) {
 			sentry.CaptureException(err)
 		}
@@ -320,6 +325,7 @@ func (r *Inputer) queueInputRoomEvents(
 		if err != nil {
 			return nil, fmt.Errorf("json.Marshal: %w", err)
 		}
+		jetstream.InjectSpan(ctx, msg)
 		if _, err = r.JetStream.PublishMsg(msg, nats.Context(ctx)); err != nil {
 			logrus.WithError(err).WithFields(logrus.Fields{
 				"room_id":  roomID,
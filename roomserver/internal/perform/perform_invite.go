@@ -22,6 +22,7 @@ import (
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/internal/helpers"
 	"github.com/matrix-org/dendrite/roomserver/internal/input"
+	"github.com/matrix-org/dendrite/roomserver/policylist"
 	"github.com/matrix-org/dendrite/roomserver/state"
 	"github.com/matrix-org/dendrite/roomserver/storage"
 	"github.com/matrix-org/dendrite/roomserver/storage/shared"
@@ -33,10 +34,11 @@ import (
 )
 
 type Inviter struct {
-	DB      storage.Database
-	Cfg     *config.RoomServer
-	FSAPI   federationAPI.RoomserverFederationAPI
-	Inputer *input.Inputer
+	DB          storage.Database
+	Cfg         *config.RoomServer
+	FSAPI       federationAPI.RoomserverFederationAPI
+	Inputer     *input.Inputer
+	PolicyLists *policylist.PolicyLists
 }
 
 // nolint:gocyclo
@@ -76,6 +78,22 @@ func (r *Inviter) PerformInvite(
 		return nil, nil
 	}
 
+	// Refuse invites from or to users, and to rooms, which are banned by the
+	// moderation policy lists.
+	for _, rule := range []*api.PolicyRule{
+		r.PolicyLists.MatchUser(event.Sender()),
+		r.PolicyLists.MatchUser(targetUserID),
+		r.PolicyLists.MatchRoom(roomID),
+	} {
+		if rule != nil {
+			res.Error = &api.PerformError{
+				Code: api.PerformErrorNotAllowed,
+				Msg:  "The invite is not allowed by the server's policy",
+			}
+			return nil, nil
+		}
+	}
+
 	logger := util.GetLogger(ctx).WithFields(map[string]interface{}{
 		"inviter":  event.Sender(),
 		"invitee":  *event.StateKey(),
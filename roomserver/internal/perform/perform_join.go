@@ -29,6 +29,7 @@ import (
 	"github.com/matrix-org/dendrite/roomserver/internal/helpers"
 	"github.com/matrix-org/dendrite/roomserver/internal/input"
 	"github.com/matrix-org/dendrite/roomserver/internal/query"
+	"github.com/matrix-org/dendrite/roomserver/policylist"
 	"github.com/matrix-org/dendrite/roomserver/storage"
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -43,8 +44,9 @@ type Joiner struct {
 	RSAPI      rsAPI.RoomserverInternalAPI
 	DB         storage.Database
 
-	Inputer *input.Inputer
-	Queryer *query.Queryer
+	Inputer     *input.Inputer
+	Queryer     *query.Queryer
+	PolicyLists *policylist.PolicyLists
 }
 
 // PerformJoin handles joining matrix rooms, including over federation by talking to the federationapi.
@@ -186,6 +188,14 @@ func (r *Joiner) performJoinRoomByID(
 		}
 	}
 
+	// Refuse to join rooms which are banned by the moderation policy lists.
+	if rule := r.PolicyLists.MatchRoom(req.RoomIDOrAlias); rule != nil {
+		return "", "", &rsAPI.PerformError{
+			Code: rsAPI.PerformErrorNotAllowed,
+			Msg:  "Joining this room is not allowed by the server's policy",
+		}
+	}
+
 	// If the server name in the room ID isn't ours then it's a
 	// possible candidate for finding the room via federation. Add
 	// it to the list of servers to try.
@@ -83,7 +83,7 @@ func (r *Unpeeker) performUnpeek(
 }
 
 func (r *Unpeeker) performUnpeekRoomByID(
-	_ context.Context,
+	ctx context.Context,
 	req *api.PerformUnpeekRequest,
 ) (err error) {
 	// Get the domain part of the room ID.
@@ -97,7 +97,7 @@ func (r *Unpeeker) performUnpeekRoomByID(
 
 	// TODO: handle federated peeks
 
-	err = r.Inputer.OutputProducer.ProduceRoomEvents(req.RoomID, []api.OutputEvent{
+	err = r.Inputer.OutputProducer.ProduceRoomEvents(ctx, req.RoomID, []api.OutputEvent{
 		{
 			Type: api.OutputTypeRetirePeek,
 			RetirePeek: &api.OutputRetirePeek{
@@ -30,6 +30,7 @@ import (
 	"github.com/matrix-org/dendrite/roomserver/acls"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/internal/helpers"
+	"github.com/matrix-org/dendrite/roomserver/policylist"
 	"github.com/matrix-org/dendrite/roomserver/state"
 	"github.com/matrix-org/dendrite/roomserver/storage"
 	"github.com/matrix-org/dendrite/roomserver/types"
@@ -37,10 +38,11 @@ import (
 )
 
 type Queryer struct {
-	DB         storage.Database
-	Cache      caching.RoomServerCaches
-	ServerName gomatrixserverlib.ServerName
-	ServerACLs *acls.ServerACLs
+	DB          storage.Database
+	Cache       caching.RoomServerCaches
+	ServerName  gomatrixserverlib.ServerName
+	ServerACLs  *acls.ServerACLs
+	PolicyLists *policylist.PolicyLists
 }
 
 // QueryLatestEventsAndState implements api.RoomserverInternalAPI
@@ -805,6 +807,28 @@ func (r *Queryer) QueryServerBannedFromRoom(ctx context.Context, req *api.QueryS
 	return nil
 }
 
+func (r *Queryer) QueryPolicyRules(ctx context.Context, req *api.QueryPolicyRulesRequest, res *api.QueryPolicyRulesResponse) error {
+	res.Rules = r.PolicyLists.Rules()
+	return nil
+}
+
+func (r *Queryer) QueryBannedByPolicy(ctx context.Context, req *api.QueryBannedByPolicyRequest, res *api.QueryBannedByPolicyResponse) error {
+	for _, userID := range req.UserIDs {
+		if res.Rule = r.PolicyLists.MatchUser(userID); res.Rule != nil {
+			return nil
+		}
+	}
+	if req.RoomID != "" {
+		if res.Rule = r.PolicyLists.MatchRoom(req.RoomID); res.Rule != nil {
+			return nil
+		}
+	}
+	if req.ServerName != "" {
+		res.Rule = r.PolicyLists.MatchServer(req.ServerName)
+	}
+	return nil
+}
+
 func (r *Queryer) QueryAuthChain(ctx context.Context, req *api.QueryAuthChainRequest, res *api.QueryAuthChainResponse) error {
 	chain, err := GetAuthChain(ctx, r.DB.EventsFromIDs, req.EventIDs)
 	if err != nil {
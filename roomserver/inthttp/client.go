@@ -59,6 +59,8 @@ const (
 	RoomserverQuerySharedUsersPath             = "/roomserver/querySharedUsers"
 	RoomserverQueryKnownUsersPath              = "/roomserver/queryKnownUsers"
 	RoomserverQueryServerBannedFromRoomPath    = "/roomserver/queryServerBannedFromRoom"
+	RoomserverQueryBannedByPolicyPath          = "/roomserver/queryBannedByPolicy"
+	RoomserverQueryPolicyRulesPath             = "/roomserver/queryPolicyRules"
 	RoomserverQueryAuthChainPath               = "/roomserver/queryAuthChain"
 	RoomserverQueryRestrictedJoinAllowed       = "/roomserver/queryRestrictedJoinAllowed"
 	RoomserverQueryMembershipAtEventPath       = "/roomserver/queryMembershipAtEvent"
@@ -512,6 +514,28 @@ func (h *httpRoomserverInternalAPI) QueryServerBannedFromRoom(
 	)
 }
 
+func (h *httpRoomserverInternalAPI) QueryBannedByPolicy(
+	ctx context.Context,
+	request *api.QueryBannedByPolicyRequest,
+	response *api.QueryBannedByPolicyResponse,
+) error {
+	return httputil.CallInternalRPCAPI(
+		"QueryBannedByPolicy", h.roomserverURL+RoomserverQueryBannedByPolicyPath,
+		h.httpClient, ctx, request, response,
+	)
+}
+
+func (h *httpRoomserverInternalAPI) QueryPolicyRules(
+	ctx context.Context,
+	request *api.QueryPolicyRulesRequest,
+	response *api.QueryPolicyRulesResponse,
+) error {
+	return httputil.CallInternalRPCAPI(
+		"QueryPolicyRules", h.roomserverURL+RoomserverQueryPolicyRulesPath,
+		h.httpClient, ctx, request, response,
+	)
+}
+
 func (h *httpRoomserverInternalAPI) QueryRestrictedJoinAllowed(
 	ctx context.Context,
 	request *api.QueryRestrictedJoinAllowedRequest,
@@ -185,6 +185,16 @@ func AddRoutes(r api.RoomserverInternalAPI, internalAPIMux *mux.Router) {
 		httputil.MakeInternalRPCAPI("RoomserverQueryServerBannedFromRoom", r.QueryServerBannedFromRoom),
 	)
 
+	internalAPIMux.Handle(
+		RoomserverQueryBannedByPolicyPath,
+		httputil.MakeInternalRPCAPI("RoomserverQueryBannedByPolicy", r.QueryBannedByPolicy),
+	)
+
+	internalAPIMux.Handle(
+		RoomserverQueryPolicyRulesPath,
+		httputil.MakeInternalRPCAPI("RoomserverQueryPolicyRules", r.QueryPolicyRules),
+	)
+
 	internalAPIMux.Handle(
 		RoomserverQueryAuthChainPath,
 		httputil.MakeInternalRPCAPI("RoomserverQueryAuthChain", r.QueryAuthChain),
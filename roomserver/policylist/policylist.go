@@ -0,0 +1,259 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package policylist
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+)
+
+// The state event types of moderation policy rules.
+// https://spec.matrix.org/v1.3/client-server-api/#moderation-policy-lists
+const (
+	MPolicyRuleUser   = "m.policy.rule.user"
+	MPolicyRuleRoom   = "m.policy.rule.room"
+	MPolicyRuleServer = "m.policy.rule.server"
+)
+
+// ruleKinds maps policy rule event types to the kind of entity they apply to.
+var ruleKinds = map[string]string{
+	MPolicyRuleUser:   "user",
+	MPolicyRuleRoom:   "room",
+	MPolicyRuleServer: "server",
+}
+
+// banRecommendations are the recommendations which we enforce. Rules with
+// any other recommendation are ignored.
+var banRecommendations = map[string]bool{
+	"m.ban":                  true,
+	"org.matrix.mjolnir.ban": true,
+}
+
+type PolicyListDatabase interface {
+	// GetStateEventsWithEventType returns all current state events of the
+	// given type in a room.
+	GetStateEventsWithEventType(ctx context.Context, roomID, evType string) ([]*gomatrixserverlib.HeaderedEvent, error)
+}
+
+type policyRule struct {
+	api.PolicyRule
+	regex *regexp.Regexp
+}
+
+// PolicyLists holds the ban rules from the configured moderation policy lists.
+// A nil *PolicyLists has no rules.
+type PolicyLists struct {
+	rooms      map[string]struct{}                                        // room IDs of the policy lists
+	rules      map[string]map[gomatrixserverlib.StateKeyTuple]*policyRule // room ID -> rule event -> rule
+	rulesMutex sync.RWMutex                                               // protects the above
+}
+
+func NewPolicyLists(db PolicyListDatabase, roomIDs []string) *PolicyLists {
+	ctx := context.TODO()
+	lists := &PolicyLists{
+		rooms: make(map[string]struct{}, len(roomIDs)),
+		rules: make(map[string]map[gomatrixserverlib.StateKeyTuple]*policyRule),
+	}
+	// Load the rules which are already in the current state of the policy
+	// lists. From then on, updates come from new events being sent through
+	// the roomserver output stream.
+	for _, roomID := range roomIDs {
+		lists.rooms[roomID] = struct{}{}
+		for evType := range ruleKinds {
+			events, err := db.GetStateEventsWithEventType(ctx, roomID, evType)
+			if err != nil {
+				logrus.WithError(err).Errorf("Failed to get %s rules for policy list %q", evType, roomID)
+				continue
+			}
+			for _, event := range events {
+				lists.OnPolicyRuleUpdate(event.Event)
+			}
+		}
+	}
+	return lists
+}
+
+// IsPolicyRule returns true if the event is a policy rule in one of the
+// configured policy lists.
+func (p *PolicyLists) IsPolicyRule(event *gomatrixserverlib.Event) bool {
+	if p == nil || event.StateKey() == nil {
+		return false
+	}
+	if _, ok := ruleKinds[event.Type()]; !ok {
+		return false
+	}
+	_, ok := p.rooms[event.RoomID()]
+	return ok
+}
+
+func compileGlob(orig string) (*regexp.Regexp, error) {
+	escaped := regexp.QuoteMeta(orig)
+	escaped = strings.Replace(escaped, "\\?", ".", -1)
+	escaped = strings.Replace(escaped, "\\*", ".*", -1)
+	return regexp.Compile("^" + escaped + "$")
+}
+
+// OnPolicyRuleUpdate adds, replaces or removes the rule in the given state event.
+func (p *PolicyLists) OnPolicyRuleUpdate(event *gomatrixserverlib.Event) {
+	if !p.IsPolicyRule(event) {
+		return
+	}
+	tuple := gomatrixserverlib.StateKeyTuple{
+		EventType: event.Type(),
+		StateKey:  *event.StateKey(),
+	}
+	var content struct {
+		Entity         string `json:"entity"`
+		Recommendation string `json:"recommendation"`
+		Reason         string `json:"reason"`
+	}
+	if err := json.Unmarshal(event.Content(), &content); err != nil {
+		logrus.WithError(err).Errorf("Failed to unmarshal policy rule %q", event.EventID())
+	}
+	// Rules are removed by replacing them with an event without an entity,
+	// which is usually an event with empty content.
+	var rule *policyRule
+	if content.Entity != "" && banRecommendations[content.Recommendation] {
+		regex, err := compileGlob(content.Entity)
+		if err != nil {
+			logrus.WithError(err).Errorf("Failed to compile policy rule %q", event.EventID())
+			return
+		}
+		rule = &policyRule{
+			PolicyRule: api.PolicyRule{
+				RoomID:         event.RoomID(),
+				EventID:        event.EventID(),
+				Kind:           ruleKinds[event.Type()],
+				Entity:         content.Entity,
+				Recommendation: content.Recommendation,
+				Reason:         content.Reason,
+			},
+			regex: regex,
+		}
+	}
+	logrus.WithFields(logrus.Fields{
+		"room_id":  event.RoomID(),
+		"event_id": event.EventID(),
+		"entity":   content.Entity,
+		"removed":  rule == nil,
+	}).Debug("Updating policy rule")
+	p.rulesMutex.Lock()
+	defer p.rulesMutex.Unlock()
+	rules, ok := p.rules[event.RoomID()]
+	if !ok {
+		rules = make(map[gomatrixserverlib.StateKeyTuple]*policyRule)
+		p.rules[event.RoomID()] = rules
+	}
+	if rule == nil {
+		delete(rules, tuple)
+	} else {
+		rules[tuple] = rule
+	}
+}
+
+// OnRedaction removes the rule from the given event, if it is a rule.
+func (p *PolicyLists) OnRedaction(roomID, eventID string) {
+	if p == nil {
+		return
+	}
+	p.rulesMutex.Lock()
+	defer p.rulesMutex.Unlock()
+	for tuple, rule := range p.rules[roomID] {
+		if rule.EventID == eventID {
+			delete(p.rules[roomID], tuple)
+		}
+	}
+}
+
+// Rules returns all of the active rules.
+func (p *PolicyLists) Rules() []api.PolicyRule {
+	if p == nil {
+		return nil
+	}
+	p.rulesMutex.RLock()
+	defer p.rulesMutex.RUnlock()
+	result := []api.PolicyRule{}
+	for _, rules := range p.rules {
+		for _, rule := range rules {
+			result = append(result, rule.PolicyRule)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].RoomID != result[j].RoomID {
+			return result[i].RoomID < result[j].RoomID
+		}
+		if result[i].Kind != result[j].Kind {
+			return result[i].Kind < result[j].Kind
+		}
+		return result[i].Entity < result[j].Entity
+	})
+	return result
+}
+
+func (p *PolicyLists) match(kind, entity string) *api.PolicyRule {
+	if p == nil || entity == "" {
+		return nil
+	}
+	p.rulesMutex.RLock()
+	defer p.rulesMutex.RUnlock()
+	for _, rules := range p.rules {
+		for _, rule := range rules {
+			if rule.Kind == kind && rule.regex.MatchString(entity) {
+				r := rule.PolicyRule
+				return &r
+			}
+		}
+	}
+	return nil
+}
+
+// MatchUser returns the rule banning the user, or nil if they aren't banned.
+// Users are also banned if their server is.
+func (p *PolicyLists) MatchUser(userID string) *api.PolicyRule {
+	if rule := p.match("user", userID); rule != nil {
+		return rule
+	}
+	if _, domain, err := gomatrixserverlib.SplitID('@', userID); err == nil {
+		return p.MatchServer(domain)
+	}
+	return nil
+}
+
+// MatchRoom returns the rule banning the room, or nil if it isn't banned.
+func (p *PolicyLists) MatchRoom(roomID string) *api.PolicyRule {
+	return p.match("room", roomID)
+}
+
+// MatchServer returns the rule banning the server, or nil if it isn't banned.
+func (p *PolicyLists) MatchServer(serverName gomatrixserverlib.ServerName) *api.PolicyRule {
+	if rule := p.match("server", string(serverName)); rule != nil {
+		return rule
+	}
+	// Server rules apply to hostnames, so also check without the port.
+	if host, _, err := net.SplitHostPort(string(serverName)); err == nil {
+		return p.match("server", host)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package policylist
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+
+	"github.com/matrix-org/dendrite/test"
+)
+
+type fakePolicyListDatabase struct {
+	room *test.Room
+}
+
+func (db *fakePolicyListDatabase) GetStateEventsWithEventType(ctx context.Context, roomID, evType string) ([]*gomatrixserverlib.HeaderedEvent, error) {
+	var events []*gomatrixserverlib.HeaderedEvent
+	if roomID != db.room.ID {
+		return nil, nil
+	}
+	for _, ev := range db.room.CurrentState() {
+		if ev.Type() == evType {
+			events = append(events, ev)
+		}
+	}
+	return events, nil
+}
+
+func banRule(entity string) map[string]interface{} {
+	return map[string]interface{}{
+		"entity":         entity,
+		"recommendation": "m.ban",
+		"reason":         "spam",
+	}
+}
+
+func TestPolicyLists(t *testing.T) {
+	alice := test.NewUser(t)
+	policyRoom := test.NewRoom(t, alice)
+	otherRoom := test.NewRoom(t, alice)
+
+	// Rules which are already in the room state are loaded at startup.
+	policyRoom.CreateAndInsert(t, alice, MPolicyRuleUser, banRule("@spammer:*"), test.WithStateKey("rule1"))
+	policyRoom.CreateAndInsert(t, alice, MPolicyRuleServer, banRule("*.evil.com"), test.WithStateKey("rule2"))
+	policyRoom.CreateAndInsert(t, alice, MPolicyRuleUser, map[string]interface{}{
+		"entity":         "@someone:test",
+		"recommendation": "org.example.watch",
+	}, test.WithStateKey("rule3"))
+
+	lists := NewPolicyLists(&fakePolicyListDatabase{room: policyRoom}, []string{policyRoom.ID})
+	if rules := lists.Rules(); len(rules) != 2 {
+		t.Fatalf("expected 2 ban rules, got %+v", rules)
+	}
+
+	for userID, banned := range map[string]bool{
+		"@spammer:test":        true,
+		"@spammer:example.com": true,
+		"@alice:test":          false,
+		"@someone:test":        false,
+		"@bob:chat.evil.com":   true,
+		"@bob:evil.com":        false,
+	} {
+		if rule := lists.MatchUser(userID); (rule != nil) != banned {
+			t.Errorf("expected %s banned=%v, got rule %+v", userID, banned, rule)
+		}
+	}
+	if lists.MatchServer("chat.evil.com:8448") == nil {
+		t.Errorf("expected server with port to be banned")
+	}
+
+	// New rules are added as events are sent into the policy list.
+	roomRule := policyRoom.CreateAndInsert(t, alice, MPolicyRuleRoom, banRule(otherRoom.ID), test.WithStateKey("rule4"))
+	lists.OnPolicyRuleUpdate(roomRule.Event)
+	if lists.MatchRoom(otherRoom.ID) == nil {
+		t.Errorf("expected room %s to be banned", otherRoom.ID)
+	}
+	if lists.MatchRoom(policyRoom.ID) != nil {
+		t.Errorf("expected room %s not to be banned", policyRoom.ID)
+	}
+
+	// Redacting a rule removes it.
+	lists.OnRedaction(policyRoom.ID, roomRule.EventID())
+	if lists.MatchRoom(otherRoom.ID) != nil {
+		t.Errorf("expected room %s not to be banned after redaction", otherRoom.ID)
+	}
+
+	// Replacing a rule with empty content removes it.
+	removed := policyRoom.CreateAndInsert(t, alice, MPolicyRuleUser, map[string]interface{}{}, test.WithStateKey("rule1"))
+	lists.OnPolicyRuleUpdate(removed.Event)
+	if lists.MatchUser("@spammer:test") != nil {
+		t.Errorf("expected removed rule not to match")
+	}
+
+	// Rules in other rooms are ignored.
+	ignored := otherRoom.CreateAndInsert(t, alice, MPolicyRuleUser, banRule("@alice:test"), test.WithStateKey("rule1"))
+	lists.OnPolicyRuleUpdate(ignored.Event)
+	if lists.MatchUser("@alice:test") != nil {
+		t.Errorf("expected rules outside of policy lists to be ignored")
+	}
+}
+
+func TestNilPolicyLists(t *testing.T) {
+	var lists *PolicyLists
+	if lists.MatchUser("@alice:test") != nil || lists.MatchRoom("!room:test") != nil || lists.MatchServer("test") != nil {
+		t.Errorf("expected nil policy lists not to match anything")
+	}
+}
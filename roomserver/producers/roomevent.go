@@ -15,10 +15,12 @@
 package producers
 
 import (
+	"context"
 	"encoding/json"
 
 	"github.com/matrix-org/dendrite/roomserver/acls"
 	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/policylist"
 	"github.com/matrix-org/dendrite/setup/jetstream"
 	"github.com/nats-io/nats.go"
 	log "github.com/sirupsen/logrus"
@@ -32,12 +34,13 @@ var keyContentFields = map[string]string{
 }
 
 type RoomEventProducer struct {
-	Topic     string
-	ACLs      *acls.ServerACLs
-	JetStream nats.JetStreamContext
+	Topic       string
+	ACLs        *acls.ServerACLs
+	PolicyLists *policylist.PolicyLists
+	JetStream   nats.JetStreamContext
 }
 
-func (r *RoomEventProducer) ProduceRoomEvents(roomID string, updates []api.OutputEvent) error {
+func (r *RoomEventProducer) ProduceRoomEvents(ctx context.Context, roomID string, updates []api.OutputEvent) error {
 	var err error
 	for _, update := range updates {
 		msg := &nats.Msg{
@@ -78,8 +81,15 @@ func (r *RoomEventProducer) ProduceRoomEvents(roomID string, updates []api.Outpu
 				ev := update.NewRoomEvent.Event.Unwrap()
 				defer r.ACLs.OnServerACLUpdate(ev)
 			}
+			if ev := update.NewRoomEvent.Event.Unwrap(); r.PolicyLists.IsPolicyRule(ev) {
+				defer r.PolicyLists.OnPolicyRuleUpdate(ev)
+			}
+		}
+		if update.RedactedEvent != nil {
+			defer r.PolicyLists.OnRedaction(roomID, update.RedactedEvent.RedactedEventID)
 		}
 		logger.Tracef("Producing to topic '%s'", r.Topic)
+		jetstream.InjectSpan(ctx, msg)
 		if _, err := r.JetStream.PublishMsg(msg); err != nil {
 			logger.WithError(err).Errorf("Failed to produce to topic '%s': %s", r.Topic, err)
 			return err
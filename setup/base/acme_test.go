@@ -0,0 +1,479 @@
+package base
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// acmeServer is a minimal in-process ACME certificate authority, implementing
+// just enough of RFC 8555 for autocert to obtain and renew certificates. It
+// offers a single challenge type for each authorization and validates it with
+// the validate function, which is given the key authorization expected in the
+// response to the challenge.
+type acmeServer struct {
+	*httptest.Server
+	challengeType string
+	validate      func(domain, token, keyAuth string) error
+	// validity returns how long the nth certificate issued is valid for.
+	validity func(n int) time.Duration
+	caFile   string
+	caKey    *ecdsa.PrivateKey
+	caCert   *x509.Certificate
+
+	mu       sync.Mutex
+	ids      int
+	issued   int
+	nonces   map[string]struct{}
+	accounts map[string]*ecdsa.PublicKey
+	orders   map[string]*acmeOrder
+	authzs   map[string]*acmeAuthz
+	chals    map[string]*acmeAuthz
+	certs    map[string][]byte
+}
+
+type acmeOrder struct {
+	Status         string         `json:"status"`
+	Identifiers    []acme.AuthzID `json:"identifiers"`
+	Authorizations []string       `json:"authorizations"`
+	Finalize       string         `json:"finalize"`
+	Certificate    string         `json:"certificate,omitempty"`
+	authzs         []*acmeAuthz
+}
+
+type acmeAuthz struct {
+	Status     string          `json:"status"`
+	Identifier acme.AuthzID    `json:"identifier"`
+	Challenges []acmeChallenge `json:"challenges"`
+}
+
+type acmeChallenge struct {
+	Type   string `json:"type"`
+	URL    string `json:"url"`
+	Token  string `json:"token"`
+	Status string `json:"status"`
+}
+
+func newACMEServer(t *testing.T, challengeType string) *acmeServer {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate CA key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Dendrite test ACME CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour * 24 * 365),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("failed to create CA certificate: %s", err)
+	}
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse CA certificate: %s", err)
+	}
+	s := &acmeServer{
+		challengeType: challengeType,
+		validity:      func(int) time.Duration { return time.Hour * 24 * 90 },
+		caKey:         caKey,
+		caCert:        caCert,
+		nonces:        map[string]struct{}{},
+		accounts:      map[string]*ecdsa.PublicKey{},
+		orders:        map[string]*acmeOrder{},
+		authzs:        map[string]*acmeAuthz{},
+		chals:         map[string]*acmeAuthz{},
+		certs:         map[string][]byte{},
+	}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.Close)
+
+	// The directory is served over HTTPS, so write the certificate of the
+	// listener for the client to trust it.
+	s.caFile = filepath.Join(t.TempDir(), "acme-ca.crt")
+	listenerCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw})
+	if err = os.WriteFile(s.caFile, listenerCert, 0600); err != nil {
+		t.Fatalf("failed to write CA certificate: %s", err)
+	}
+	return s
+}
+
+// Issued returns how many certificates have been issued.
+func (s *acmeServer) Issued() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.issued
+}
+
+func (s *acmeServer) newID() string {
+	s.ids++
+	return fmt.Sprintf("%d", s.ids)
+}
+
+func (s *acmeServer) newNonce() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	nonce := s.newID()
+	s.nonces[nonce] = struct{}{}
+	return nonce
+}
+
+func (s *acmeServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", s.newNonce())
+	switch r.URL.Path {
+	case "/directory":
+		s.writeJSON(w, http.StatusOK, map[string]interface{}{
+			"newNonce":   s.URL + "/new-nonce",
+			"newAccount": s.URL + "/new-account",
+			"newOrder":   s.URL + "/new-order",
+			"revokeCert": s.URL + "/revoke-cert",
+			"keyChange":  s.URL + "/key-change",
+			"meta": map[string]string{
+				"termsOfService": s.URL + "/terms",
+			},
+		})
+		return
+	case "/new-nonce":
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPost {
+		s.writeError(w, http.StatusMethodNotAllowed, "malformed", "unexpected method")
+		return
+	}
+	payload, account, problem, err := s.verifyRequest(r)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, problem, err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kind, id := splitACMEPath(r.URL.Path)
+	switch kind {
+	case "new-account":
+		kid := s.URL + "/account/" + s.newID()
+		s.accounts[kid] = account
+		w.Header().Set("Location", kid)
+		s.writeJSON(w, http.StatusCreated, map[string]string{"status": acme.StatusValid})
+	case "new-order":
+		var req struct {
+			Identifiers []acme.AuthzID `json:"identifiers"`
+		}
+		if err = json.Unmarshal(payload, &req); err != nil {
+			s.writeError(w, http.StatusBadRequest, "malformed", err.Error())
+			return
+		}
+		orderID := s.newID()
+		order := &acmeOrder{
+			Status:      acme.StatusPending,
+			Identifiers: req.Identifiers,
+			Finalize:    s.URL + "/finalize/" + orderID,
+		}
+		for _, identifier := range req.Identifiers {
+			authzID, chalID := s.newID(), s.newID()
+			token := make([]byte, 16)
+			_, _ = rand.Read(token)
+			authz := &acmeAuthz{
+				Status:     acme.StatusPending,
+				Identifier: identifier,
+				Challenges: []acmeChallenge{{
+					Type:   s.challengeType,
+					URL:    s.URL + "/challenge/" + chalID,
+					Token:  base64.RawURLEncoding.EncodeToString(token),
+					Status: acme.StatusPending,
+				}},
+			}
+			s.authzs[authzID] = authz
+			s.chals[chalID] = authz
+			order.authzs = append(order.authzs, authz)
+			order.Authorizations = append(order.Authorizations, s.URL+"/authz/"+authzID)
+		}
+		s.orders[orderID] = order
+		w.Header().Set("Location", s.URL+"/order/"+orderID)
+		s.writeJSON(w, http.StatusCreated, order)
+	case "authz":
+		authz, ok := s.authzs[id]
+		if !ok {
+			s.writeError(w, http.StatusNotFound, "malformed", "no such authorization")
+			return
+		}
+		if len(payload) > 0 {
+			// Deactivation of authorizations which weren't used.
+			authz.Status = acme.StatusDeactivated
+		}
+		s.writeJSON(w, http.StatusOK, authz)
+	case "challenge":
+		authz, ok := s.chals[id]
+		if !ok {
+			s.writeError(w, http.StatusNotFound, "malformed", "no such challenge")
+			return
+		}
+		chal := &authz.Challenges[0]
+		thumbprint, err := acme.JWKThumbprint(account)
+		if err != nil {
+			s.writeError(w, http.StatusBadRequest, "malformed", err.Error())
+			return
+		}
+		// Validating the challenge connects back to the manager, so don't
+		// hold the lock while doing so.
+		s.mu.Unlock()
+		err = s.validate(authz.Identifier.Value, chal.Token, chal.Token+"."+thumbprint)
+		s.mu.Lock()
+		if err != nil {
+			chal.Status, authz.Status = acme.StatusInvalid, acme.StatusInvalid
+		} else {
+			chal.Status, authz.Status = acme.StatusValid, acme.StatusValid
+		}
+		for _, order := range s.orders {
+			order.updateStatus()
+		}
+		s.writeJSON(w, http.StatusOK, chal)
+	case "order":
+		order, ok := s.orders[id]
+		if !ok {
+			s.writeError(w, http.StatusNotFound, "malformed", "no such order")
+			return
+		}
+		w.Header().Set("Location", s.URL+"/order/"+id)
+		s.writeJSON(w, http.StatusOK, order)
+	case "finalize":
+		order, ok := s.orders[id]
+		if !ok || order.Status != acme.StatusReady {
+			s.writeError(w, http.StatusForbidden, "orderNotReady", "order is not ready")
+			return
+		}
+		certPEM, err := s.issue(order, payload)
+		if err != nil {
+			s.writeError(w, http.StatusBadRequest, "badCSR", err.Error())
+			return
+		}
+		s.certs[id] = certPEM
+		order.Status = acme.StatusValid
+		order.Certificate = s.URL + "/cert/" + id
+		w.Header().Set("Location", s.URL+"/order/"+id)
+		s.writeJSON(w, http.StatusOK, order)
+	case "cert":
+		certPEM, ok := s.certs[id]
+		if !ok {
+			s.writeError(w, http.StatusNotFound, "malformed", "no such certificate")
+			return
+		}
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		_, _ = w.Write(certPEM)
+	default:
+		s.writeError(w, http.StatusNotFound, "malformed", "unknown resource")
+	}
+}
+
+// issue signs a certificate for the CSR in the finalize request, returning
+// it followed by the certificate of the CA.
+func (s *acmeServer) issue(order *acmeOrder, payload []byte) ([]byte, error) {
+	var req struct {
+		CSR string `json:"csr"`
+	}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, err
+	}
+	der, err := base64.RawURLEncoding.DecodeString(req.CSR)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, err
+	}
+	if err = csr.CheckSignature(); err != nil {
+		return nil, err
+	}
+	if len(csr.DNSNames) != len(order.Identifiers) {
+		return nil, fmt.Errorf("CSR names %v don't match the order", csr.DNSNames)
+	}
+	for i, name := range csr.DNSNames {
+		if order.Identifiers[i].Value != name {
+			return nil, fmt.Errorf("CSR names %v don't match the order", csr.DNSNames)
+		}
+	}
+	s.issued++
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: csr.DNSNames[0]},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(s.validity(s.issued)),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	leaf, err := x509.CreateCertificate(rand.Reader, template, s.caCert, csr.PublicKey, s.caKey)
+	if err != nil {
+		return nil, err
+	}
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf})
+	return append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.caCert.Raw})...), nil
+}
+
+// verifyRequest checks the nonce, URL and signature of the JWS in the body of
+// the request, and returns its payload and the key of the account which made
+// it. Only ES256 signatures are supported, which is what autocert uses. If the
+// request isn't valid, the ACME problem type is returned with the error.
+func (s *acmeServer) verifyRequest(r *http.Request) ([]byte, *ecdsa.PublicKey, string, error) {
+	var jws struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+		Signature string `json:"signature"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&jws); err != nil {
+		return nil, nil, "malformed", err
+	}
+	protected, err := base64.RawURLEncoding.DecodeString(jws.Protected)
+	if err != nil {
+		return nil, nil, "malformed", err
+	}
+	var header struct {
+		Alg   string          `json:"alg"`
+		KID   string          `json:"kid"`
+		JWK   json.RawMessage `json:"jwk"`
+		Nonce string          `json:"nonce"`
+		URL   string          `json:"url"`
+	}
+	if err = json.Unmarshal(protected, &header); err != nil {
+		return nil, nil, "malformed", err
+	}
+	if header.Alg != "ES256" {
+		return nil, nil, "malformed", fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+	if header.URL != s.URL+r.URL.Path {
+		return nil, nil, "malformed", fmt.Errorf("signed URL %q doesn't match the request", header.URL)
+	}
+
+	s.mu.Lock()
+	_, ok := s.nonces[header.Nonce]
+	delete(s.nonces, header.Nonce)
+	key := s.accounts[header.KID]
+	s.mu.Unlock()
+	if !ok {
+		return nil, nil, "badNonce", fmt.Errorf("unknown nonce %q", header.Nonce)
+	}
+	if header.KID == "" {
+		if key, err = parseJWK(header.JWK); err != nil {
+			return nil, nil, "malformed", err
+		}
+	} else if key == nil {
+		return nil, nil, "malformed", fmt.Errorf("unknown account %q", header.KID)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(jws.Signature)
+	if err != nil || len(sig) != 64 {
+		return nil, nil, "malformed", fmt.Errorf("malformed signature")
+	}
+	hash := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	rs, ss := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(key, hash[:], rs, ss) {
+		return nil, nil, "unauthorized", fmt.Errorf("invalid signature")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err != nil {
+		return nil, nil, "malformed", err
+	}
+	return payload, key, "", nil
+}
+
+func (s *acmeServer) writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (s *acmeServer) writeError(w http.ResponseWriter, code int, typ, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"type":   "urn:ietf:params:acme:error:" + typ,
+		"detail": detail,
+		"status": code,
+	})
+}
+
+// updateStatus marks the order ready once all of its authorizations are valid,
+// or invalid if any of them are.
+func (o *acmeOrder) updateStatus() {
+	if o.Status != acme.StatusPending {
+		return
+	}
+	status := acme.StatusReady
+	for _, authz := range o.authzs {
+		switch authz.Status {
+		case acme.StatusInvalid:
+			o.Status = acme.StatusInvalid
+			return
+		case acme.StatusValid:
+		default:
+			status = acme.StatusPending
+		}
+	}
+	o.Status = status
+}
+
+// splitACMEPath splits a request path into the kind of resource and its ID.
+func splitACMEPath(p string) (kind, id string) {
+	parts := strings.SplitN(strings.TrimPrefix(p, "/"), "/", 2)
+	if len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	return parts[0], ""
+}
+
+func parseJWK(raw json.RawMessage) (*ecdsa.PublicKey, error) {
+	var jwk struct {
+		Kty string `json:"kty"`
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}
+	if err := json.Unmarshal(raw, &jwk); err != nil {
+		return nil, err
+	}
+	if jwk.Kty != "EC" || jwk.Crv != "P-256" {
+		return nil, fmt.Errorf("unsupported key type %q %q", jwk.Kty, jwk.Crv)
+	}
+	x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+	if err != nil {
+		return nil, err
+	}
+	return &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(x),
+		Y:     new(big.Int).SetBytes(y),
+	}, nil
+}
@@ -16,7 +16,6 @@ package base
 
 import (
 	"context"
-	"crypto/tls"
 	"database/sql"
 	"fmt"
 	"io"
@@ -25,6 +24,7 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
@@ -37,6 +37,7 @@ import (
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/atomic"
+	"golang.org/x/crypto/acme/autocert"
 	"golang.org/x/net/http2"
 	"golang.org/x/net/http2/h2c"
 
@@ -87,6 +88,11 @@ type BaseDendrite struct {
 	Database               *sql.DB
 	DatabaseWriter         sqlutil.Writer
 	EnableMetrics          bool
+	reloadMutex            sync.Mutex
+	reloadCallbacks        []func(cfg *config.Dendrite)
+	acmeOnce               sync.Once
+	acme                   *autocert.Manager
+	acmeErr                error
 }
 
 const NoListener = ""
@@ -143,7 +149,7 @@ func NewBaseDendrite(cfg *config.Dendrite, componentName string, options ...Base
 
 	closer, err := cfg.SetupTracing("Dendrite" + componentName)
 	if err != nil {
-		logrus.WithError(err).Panicf("failed to start opentracing")
+		logrus.WithError(err).Panicf("failed to start tracing")
 	}
 
 	if cfg.Global.Sentry.Enabled {
@@ -174,22 +180,7 @@ func NewBaseDendrite(cfg *config.Dendrite, componentName string, options ...Base
 		)
 	}
 
-	apiClient := http.Client{
-		Timeout: time.Minute * 10,
-		Transport: &http2.Transport{
-			AllowHTTP: true,
-			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
-				// Ordinarily HTTP/2 would expect TLS, but the remote listener is
-				// H2C-enabled (HTTP/2 without encryption). Overriding the DialTLS
-				// function with a plain Dial allows us to trick the HTTP client
-				// into establishing a HTTP/2 connection without TLS.
-				// TODO: Eventually we will want to look at authenticating and
-				// encrypting these internal HTTP APIs, at which point we will have
-				// to reconsider H2C and change all this anyway.
-				return net.Dial(network, addr)
-			},
-		},
-	}
+	apiClient := newInternalAPIClient(net.Dial)
 
 	// If we're in monolith mode, we'll set up a global pool of database
 	// connections. A component is welcome to use this pool if they don't
@@ -239,7 +230,7 @@ func NewBaseDendrite(cfg *config.Dendrite, componentName string, options ...Base
 		DendriteAdminMux:       mux.NewRouter().SkipClean(true).PathPrefix(httputil.DendriteAdminPathPrefix).Subrouter().UseEncodedPath(),
 		SynapseAdminMux:        mux.NewRouter().SkipClean(true).PathPrefix(httputil.SynapseAdminPathPrefix).Subrouter().UseEncodedPath(),
 		NATS:                   &jetstream.NATSInstance{},
-		apiHttpClient:          &apiClient,
+		apiHttpClient:          apiClient,
 		Database:               db,     // set if monolith with global connection pool only
 		DatabaseWriter:         writer, // set if monolith with global connection pool only
 		EnableMetrics:          enableMetrics,
@@ -276,7 +267,8 @@ func (b *BaseDendrite) DatabaseConnection(dbProperties *config.DatabaseOptions,
 
 // AppserviceHTTPClient returns the AppServiceInternalAPI for hitting the appservice component over HTTP.
 func (b *BaseDendrite) AppserviceHTTPClient() appserviceAPI.AppServiceInternalAPI {
-	a, err := asinthttp.NewAppserviceClient(b.Cfg.AppServiceURL(), b.apiHttpClient)
+	url, client := b.internalAPIClient(b.Cfg.AppServiceAPI.InternalAPI)
+	a, err := asinthttp.NewAppserviceClient(url, client)
 	if err != nil {
 		logrus.WithError(err).Panic("CreateHTTPAppServiceAPIs failed")
 	}
@@ -285,18 +277,20 @@ func (b *BaseDendrite) AppserviceHTTPClient() appserviceAPI.AppServiceInternalAP
 
 // RoomserverHTTPClient returns RoomserverInternalAPI for hitting the roomserver over HTTP.
 func (b *BaseDendrite) RoomserverHTTPClient() roomserverAPI.RoomserverInternalAPI {
-	rsAPI, err := rsinthttp.NewRoomserverClient(b.Cfg.RoomServerURL(), b.apiHttpClient, b.Caches)
+	url, client := b.internalAPIClient(b.Cfg.RoomServer.InternalAPI)
+	rsAPI, err := rsinthttp.NewRoomserverClient(url, client, b.Caches)
 	if err != nil {
-		logrus.WithError(err).Panic("RoomserverHTTPClient failed", b.apiHttpClient)
+		logrus.WithError(err).Panic("RoomserverHTTPClient failed")
 	}
 	return rsAPI
 }
 
 // UserAPIClient returns UserInternalAPI for hitting the userapi over HTTP.
 func (b *BaseDendrite) UserAPIClient() userapi.UserInternalAPI {
-	userAPI, err := userapiinthttp.NewUserAPIClient(b.Cfg.UserAPIURL(), b.apiHttpClient)
+	url, client := b.internalAPIClient(b.Cfg.UserAPI.InternalAPI)
+	userAPI, err := userapiinthttp.NewUserAPIClient(url, client)
 	if err != nil {
-		logrus.WithError(err).Panic("UserAPIClient failed", b.apiHttpClient)
+		logrus.WithError(err).Panic("UserAPIClient failed")
 	}
 	return userAPI
 }
@@ -304,18 +298,20 @@ func (b *BaseDendrite) UserAPIClient() userapi.UserInternalAPI {
 // FederationAPIHTTPClient returns FederationInternalAPI for hitting
 // the federation API server over HTTP
 func (b *BaseDendrite) FederationAPIHTTPClient() federationAPI.FederationInternalAPI {
-	f, err := federationIntHTTP.NewFederationAPIClient(b.Cfg.FederationAPIURL(), b.apiHttpClient, b.Caches)
+	url, client := b.internalAPIClient(b.Cfg.FederationAPI.InternalAPI)
+	f, err := federationIntHTTP.NewFederationAPIClient(url, client, b.Caches)
 	if err != nil {
-		logrus.WithError(err).Panic("FederationAPIHTTPClient failed", b.apiHttpClient)
+		logrus.WithError(err).Panic("FederationAPIHTTPClient failed")
 	}
 	return f
 }
 
 // KeyServerHTTPClient returns KeyInternalAPI for hitting the key server over HTTP
 func (b *BaseDendrite) KeyServerHTTPClient() keyserverAPI.KeyInternalAPI {
-	f, err := keyinthttp.NewKeyServerClient(b.Cfg.KeyServerURL(), b.apiHttpClient)
+	url, client := b.internalAPIClient(b.Cfg.KeyServer.InternalAPI)
+	f, err := keyinthttp.NewKeyServerClient(url, client)
 	if err != nil {
-		logrus.WithError(err).Panic("KeyServerHTTPClient failed", b.apiHttpClient)
+		logrus.WithError(err).Panic("KeyServerHTTPClient failed")
 	}
 	return f
 }
@@ -365,6 +361,13 @@ func (b *BaseDendrite) CreateFederationClient() *gomatrixserverlib.FederationCli
 		b.Cfg.Global.ServerName, b.Cfg.Global.KeyID,
 		b.Cfg.Global.PrivateKey, opts...,
 	)
+	if b.Cfg.Tracing.Enabled {
+		if !wrapFederationTransport(client, func(transport http.RoundTripper) http.RoundTripper {
+			return &tracingHTTPTransport{transport}
+		}) {
+			logrus.Warn("Outbound federation requests won't be traced, as the federation client transport couldn't be found")
+		}
+	}
 	client.SetUserAgent(fmt.Sprintf("Dendrite/%s", internal.VersionString()))
 	return client
 }
@@ -428,6 +431,22 @@ func (b *BaseDendrite) SetupAndServeHTTP(
 		}
 	}
 
+	tlsConfig, err := b.tlsConfig(externalHTTPAddr, certFile, keyFile)
+	if err != nil {
+		logrus.WithError(err).Fatal("failed to configure TLS")
+	}
+	if tlsConfig != nil {
+		externalServ.TLSConfig = tlsConfig
+		internalServ.TLSConfig = tlsConfig
+	} else if b.Cfg.Global.ACME.Enabled {
+		// Answer ACME HTTP-01 challenges on the plain HTTP listener.
+		acmeManager, err := b.acmeManager()
+		if err != nil {
+			logrus.WithError(err).Fatal("failed to configure ACME")
+		}
+		externalServ.Handler = acmeManager.HTTPHandler(externalRouter)
+	}
+
 	b.configureHTTPErrors()
 
 	internalRouter.PathPrefix(httputil.InternalPathPrefix).Handler(b.InternalAPIMux)
@@ -483,14 +502,19 @@ func (b *BaseDendrite) SetupAndServeHTTP(
 					logrus.Infof("Stopped internal HTTP listener")
 				}
 			})
-			if certFile != nil && keyFile != nil {
-				if err := internalServ.ListenAndServeTLS(*certFile, *keyFile); err != nil {
+			listener, err := listen(internalHTTPAddr)
+			if err != nil {
+				logrus.WithError(err).Fatal("failed to listen")
+			}
+			if tlsConfig != nil {
+				// The certificates are provided by the TLS config.
+				if err := internalServ.ServeTLS(listener, "", ""); err != nil {
 					if err != http.ErrServerClosed {
 						logrus.WithError(err).Fatal("failed to serve HTTPS")
 					}
 				}
 			} else {
-				if err := internalServ.ListenAndServe(); err != nil {
+				if err := internalServ.Serve(listener); err != nil {
 					if err != http.ErrServerClosed {
 						logrus.WithError(err).Fatal("failed to serve HTTP")
 					}
@@ -511,14 +535,19 @@ func (b *BaseDendrite) SetupAndServeHTTP(
 					logrus.Infof("Stopped external HTTP listener")
 				}
 			})
-			if certFile != nil && keyFile != nil {
-				if err := externalServ.ListenAndServeTLS(*certFile, *keyFile); err != nil {
+			listener, err := listen(externalHTTPAddr)
+			if err != nil {
+				logrus.WithError(err).Fatal("failed to listen")
+			}
+			if tlsConfig != nil {
+				// The certificates are provided by the TLS config.
+				if err := externalServ.ServeTLS(listener, "", ""); err != nil {
 					if err != http.ErrServerClosed {
 						logrus.WithError(err).Fatal("failed to serve HTTPS")
 					}
 				}
 			} else {
-				if err := externalServ.ListenAndServe(); err != nil {
+				if err := externalServ.Serve(listener); err != nil {
 					if err != http.ErrServerClosed {
 						logrus.WithError(err).Fatal("failed to serve HTTP")
 					}
@@ -537,14 +566,54 @@ func (b *BaseDendrite) SetupAndServeHTTP(
 	logrus.Infof("Stopped HTTP listeners")
 }
 
+// OnConfigReload registers a function which is called with the config after
+// it has been reloaded, so that the component can apply the changes. The
+// reloaded config is a copy, the config the component was created with only
+// has its application services updated.
+func (b *BaseDendrite) OnConfigReload(f func(cfg *config.Dendrite)) {
+	b.reloadMutex.Lock()
+	defer b.reloadMutex.Unlock()
+	b.reloadCallbacks = append(b.reloadCallbacks, f)
+}
+
+// ReloadConfig reloads the config file and applies the settings which can be
+// changed at runtime. If the config file is invalid, nothing is changed.
+func (b *BaseDendrite) ReloadConfig() error {
+	b.reloadMutex.Lock()
+	defer b.reloadMutex.Unlock()
+	cfg, err := b.Cfg.Reload()
+	if err != nil {
+		return fmt.Errorf("b.Cfg.Reload: %w", err)
+	}
+	if err = internal.SetHookLogLevels(cfg.Logging); err != nil {
+		logrus.WithError(err).Warn("Unable to change the logging levels, restart Dendrite to apply the logging config")
+	}
+	for _, f := range b.reloadCallbacks {
+		f(cfg)
+	}
+	logrus.Infof("Reloaded config with %d application service(s)", len(cfg.Derived.AppServices()))
+	return nil
+}
+
 func (b *BaseDendrite) WaitForShutdown() {
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	select {
-	case <-sigs:
-	case <-b.ProcessContext.WaitForShutdown():
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for waiting := true; waiting; {
+		select {
+		case sig := <-sigs:
+			if sig != syscall.SIGHUP {
+				waiting = false
+				break
+			}
+			logrus.Info("Reloading config")
+			if err := b.ReloadConfig(); err != nil {
+				logrus.WithError(err).Error("Failed to reload config")
+			}
+		case <-b.ProcessContext.WaitForShutdown():
+			waiting = false
+		}
 	}
-	signal.Reset(syscall.SIGINT, syscall.SIGTERM)
+	signal.Reset(syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
 	logrus.Warnf("Shutdown signal received")
 
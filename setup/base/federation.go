@@ -5,8 +5,18 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"reflect"
+	"unsafe"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var tracer = otel.Tracer("github.com/matrix-org/dendrite/setup/base")
+
 // noOpHTTPTransport is used to disable federation.
 var noOpHTTPTransport = &http.Transport{
 	Dial: func(_, _ string) (net.Conn, error) {
@@ -30,3 +40,53 @@ type noOpHTTPRoundTripper struct {
 func (y *noOpHTTPRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 	return nil, fmt.Errorf("federation prohibited by configuration")
 }
+
+// tracingHTTPTransport starts a span for each outbound federation request,
+// and then hands the request to the transport of the federation client.
+type tracingHTTPTransport struct {
+	transport http.RoundTripper
+}
+
+func (t *tracingHTTPTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := tracer.Start(
+		req.Context(), "federation "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPMethodKey.String(req.Method),
+			semconv.HTTPTargetKey.String(req.URL.Path),
+			semconv.NetPeerNameKey.String(req.URL.Host),
+		),
+	)
+	defer span.End()
+
+	res, err := t.transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	span.SetAttributes(semconv.HTTPStatusCodeKey.Int(res.StatusCode))
+	if res.StatusCode >= 500 {
+		span.SetStatus(codes.Error, res.Status)
+	}
+	return res, nil
+}
+
+// wrapFederationTransport replaces the transport of the federation client
+// with the one returned by wrap, which is given the existing transport. The
+// transport which resolves the matrix:// URLs isn't exported by
+// gomatrixserverlib, so the http.Client holding it is reached by reflection.
+// If the http.Client can't be found, the client is left as it is and false
+// is returned. It must be called before the client is used.
+func wrapFederationTransport(client *gomatrixserverlib.FederationClient, wrap func(http.RoundTripper) http.RoundTripper) bool {
+	field := reflect.ValueOf(&client.Client).Elem().FieldByName("client")
+	if !field.IsValid() || field.Type() != reflect.TypeOf(http.Client{}) {
+		return false
+	}
+	httpClient := (*http.Client)(unsafe.Pointer(field.UnsafeAddr()))
+	if httpClient.Transport == nil {
+		return false
+	}
+	httpClient.Transport = wrap(httpClient.Transport)
+	return true
+}
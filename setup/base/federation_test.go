@@ -0,0 +1,98 @@
+package base
+
+import (
+	"context"
+	"crypto/ed25519"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type recordingTransport struct {
+	requests []*http.Request
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.requests = append(t.requests, req)
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader("{}")),
+		Request:    req,
+	}, nil
+}
+
+func TestTracingFederationTransport(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The transport of the client is wrapped, rather than replaced.
+	transport := &recordingTransport{}
+	client := gomatrixserverlib.NewFederationClient(
+		"localhost", "ed25519:test", privateKey,
+		gomatrixserverlib.WithTransport(transport),
+	)
+	var existing http.RoundTripper
+	if !wrapFederationTransport(client, func(rt http.RoundTripper) http.RoundTripper {
+		existing = rt
+		return &tracingHTTPTransport{rt}
+	}) {
+		t.Fatalf("expected the transport to be wrapped")
+	}
+	if existing != transport {
+		t.Fatalf("expected the existing transport to be wrapped, got %T", existing)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "matrix://remote/_matrix/federation/v1/version", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := client.DoHTTPRequest(context.Background(), req)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	_ = res.Body.Close()
+
+	if len(transport.requests) != 1 {
+		t.Fatalf("expected the transport to get 1 request, got %d", len(transport.requests))
+	}
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span to be recorded, got %d", len(spans))
+	}
+	if !trace.SpanContextFromContext(transport.requests[0].Context()).Equal(spans[0].SpanContext()) {
+		t.Fatalf("expected the request to be made with the context of the span")
+	}
+	attrs := map[string]string{}
+	for _, attr := range spans[0].Attributes() {
+		attrs[string(attr.Key)] = attr.Value.Emit()
+	}
+	if attrs["net.peer.name"] != "remote" || attrs["http.status_code"] != "200" {
+		t.Fatalf("unexpected span attributes %v", attrs)
+	}
+
+	// The transport which gomatrixserverlib creates can be wrapped too.
+	client = gomatrixserverlib.NewFederationClient("localhost", "ed25519:test", privateKey)
+	if !wrapFederationTransport(client, func(rt http.RoundTripper) http.RoundTripper {
+		existing = rt
+		return rt
+	}) {
+		t.Fatalf("expected the transport to be wrapped")
+	}
+	if existing == nil {
+		t.Fatalf("expected the existing transport to be given")
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+
+	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// newInternalAPIClient returns a client for the internal HTTP APIs which makes
+// connections using the given dial function.
+func newInternalAPIClient(dial func(network, addr string) (net.Conn, error)) *http.Client {
+	return &http.Client{
+		Timeout: time.Minute * 10,
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				// Ordinarily HTTP/2 would expect TLS, but the remote listener is
+				// H2C-enabled (HTTP/2 without encryption). Overriding the DialTLS
+				// function with a plain Dial allows us to trick the HTTP client
+				// into establishing a HTTP/2 connection without TLS.
+				// TODO: Eventually we will want to look at authenticating and
+				// encrypting these internal HTTP APIs, at which point we will have
+				// to reconsider H2C and change all this anyway.
+				return dial(network, addr)
+			},
+		},
+	}
+}
+
+// internalAPIClient returns the base URL and the client to use for requests to
+// the internal API. Requests to a unix socket are made with a client which always
+// dials the socket, so the host of the URL is a dummy.
+func (b *BaseDendrite) internalAPIClient(opts config.InternalAPIOptions) (string, *http.Client) {
+	url, client := string(opts.Connect), b.apiHttpClient
+	if opts.Connect.IsUnixSocket() {
+		path, _, err := opts.Connect.UnixSocket()
+		if err != nil {
+			logrus.WithError(err).Panic("invalid internal API address")
+		}
+		url, client = "http://unix", newInternalAPIClient(func(_, _ string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		})
+	}
+	if opts.Transport == config.InternalAPITransportBinary {
+		client = httputil.WithBinaryEncoding(client)
+	}
+	return url, client
+}
+
+// listen listens on the given address, which is either a TCP address or a unix
+// socket. A unix socket left behind by a previous run is replaced.
+func listen(addr config.HTTPAddress) (net.Listener, error) {
+	if !addr.IsUnixSocket() {
+		host, err := addr.Address()
+		if err != nil {
+			return nil, err
+		}
+		return net.Listen("tcp", string(host))
+	}
+	path, mode, err := addr.UnixSocket()
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("%q exists and is not a unix socket", path)
+		}
+		if err = os.Remove(path); err != nil {
+			return nil, fmt.Errorf("os.Remove: %w", err)
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(path, mode); err != nil {
+		_ = l.Close()
+		return nil, fmt.Errorf("os.Chmod: %w", err)
+	}
+	return l, nil
+}
@@ -0,0 +1,71 @@
+package base
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func TestUnixSocketInternalAPI(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "internal.sock")
+	addr := config.HTTPAddress(fmt.Sprintf("unix://%s?mode=0600", path))
+
+	// A socket left behind by a previous run must be replaced.
+	for i := 0; i < 2; i++ {
+		l, err := listen(addr)
+		if err != nil {
+			t.Fatalf("failed to listen: %s", err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("failed to stat socket: %s", err)
+		}
+		if info.Mode().Perm() != 0600 {
+			t.Fatalf("expected mode 0600, got %o", info.Mode().Perm())
+		}
+		if i == 0 {
+			l.(*net.UnixListener).SetUnlinkOnClose(false)
+			_ = l.Close()
+			continue
+		}
+
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(r.Proto))
+		})
+		serv := &http.Server{Handler: h2c.NewHandler(handler, &http2.Server{})}
+		go serv.Serve(l)   // nolint: errcheck
+		defer serv.Close() // nolint: errcheck
+	}
+
+	url, client := (&BaseDendrite{}).internalAPIClient(config.InternalAPIOptions{Connect: addr})
+	res, err := client.Get(url + "/api/test")
+	if err != nil {
+		t.Fatalf("failed to make request: %s", err)
+	}
+	defer res.Body.Close() // nolint: errcheck
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("failed to read response: %s", err)
+	}
+	if string(body) != "HTTP/2.0" {
+		t.Fatalf("expected request over HTTP/2, got %s", body)
+	}
+
+	// Other files must not be replaced by the socket.
+	file := filepath.Join(t.TempDir(), "file")
+	if err = os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+	if _, err = listen(config.HTTPAddress("unix://" + file)); err == nil {
+		t.Fatalf("expected listening on a regular file to fail")
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// certificateReloadInterval is how often the certificate files are checked
+// for changes.
+const certificateReloadInterval = time.Minute
+
+// tlsConfig returns the TLS config for a listener on the given address, or nil
+// if the listener should serve plain HTTP. Certificates are obtained using ACME
+// for HTTPS addresses if it is enabled, otherwise they are loaded from the given
+// files, if any.
+func (b *BaseDendrite) tlsConfig(addr config.HTTPAddress, certFile, keyFile *string) (*tls.Config, error) {
+	if b.Cfg.Global.ACME.Enabled && strings.HasPrefix(string(addr), "https://") {
+		m, err := b.acmeManager()
+		if err != nil {
+			return nil, err
+		}
+		return m.TLSConfig(), nil
+	}
+	if certFile == nil || keyFile == nil || *certFile == "" || *keyFile == "" {
+		return nil, nil
+	}
+	r, err := newCertificateReloader(*certFile, *keyFile)
+	if err != nil {
+		return nil, err
+	}
+	go r.watch(b.ProcessContext.Context(), certificateReloadInterval)
+	return &tls.Config{
+		GetCertificate: r.GetCertificate,
+	}, nil
+}
+
+// acmeManager returns the ACME certificate manager, creating it on first use
+// so that all listeners share it. It also starts the dedicated listener for
+// HTTP-01 challenges, if configured.
+func (b *BaseDendrite) acmeManager() (*autocert.Manager, error) {
+	b.acmeOnce.Do(func() {
+		cfg := &b.Cfg.Global.ACME
+		b.acme, b.acmeErr = newACMEManager(cfg, string(b.Cfg.Global.ServerName))
+		if b.acmeErr != nil || cfg.HTTPChallengeAddress == "" {
+			return
+		}
+		serv := &http.Server{
+			Addr:    cfg.HTTPChallengeAddress,
+			Handler: b.acme.HTTPHandler(nil),
+		}
+		go func() {
+			<-b.ProcessContext.WaitForShutdown()
+			_ = serv.Shutdown(context.Background())
+		}()
+		go func() {
+			logrus.Infof("Starting ACME HTTP-01 challenge listener on %s", serv.Addr)
+			if err := serv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logrus.WithError(err).Fatal("failed to serve ACME HTTP-01 challenges")
+			}
+		}()
+	})
+	return b.acme, b.acmeErr
+}
+
+// newACMEManager creates a certificate manager which obtains certificates for
+// the configured domains, or the server name if none are configured, and renews
+// them in the background before they expire.
+func newACMEManager(cfg *config.ACME, serverName string) (*autocert.Manager, error) {
+	domains := cfg.Domains
+	if len(domains) == 0 {
+		domains = []string{serverName}
+	}
+	if err := os.MkdirAll(string(cfg.CacheDirectory), 0700); err != nil {
+		return nil, fmt.Errorf("os.MkdirAll: %w", err)
+	}
+	client := &acme.Client{
+		DirectoryURL: cfg.DirectoryURL,
+	}
+	if cfg.DirectoryCA != "" {
+		pem, err := os.ReadFile(string(cfg.DirectoryCA))
+		if err != nil {
+			return nil, fmt.Errorf("os.ReadFile: %w", err)
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %q", cfg.DirectoryCA)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{
+			RootCAs: roots,
+		}
+		client.HTTPClient = &http.Client{
+			Transport: transport,
+		}
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cfg.CacheDirectory),
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Email:      cfg.Email,
+		Client:     client,
+	}, nil
+}
+
+// certificateReloader serves a certificate and key loaded from files, and loads
+// them again when they change so that renewed certificates are used without a
+// restart.
+type certificateReloader struct {
+	certFile string
+	keyFile  string
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	certMod  time.Time
+	keyMod   time.Time
+}
+
+func newCertificateReloader(certFile, keyFile string) (*certificateReloader, error) {
+	r := &certificateReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if _, err := r.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate returns the currently loaded certificate.
+func (r *certificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// reloadIfChanged loads the certificate and key again if either file has been
+// modified since they were last loaded. The current certificate is kept if they
+// can't be loaded, e.g. because only one of the files has been replaced so far.
+func (r *certificateReloader) reloadIfChanged() (bool, error) {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return false, fmt.Errorf("os.Stat: %w", err)
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("os.Stat: %w", err)
+	}
+	r.mu.RLock()
+	unchanged := r.cert != nil && certInfo.ModTime().Equal(r.certMod) && keyInfo.ModTime().Equal(r.keyMod)
+	r.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("tls.LoadX509KeyPair: %w", err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.certMod = certInfo.ModTime()
+	r.keyMod = keyInfo.ModTime()
+	return true, nil
+}
+
+// watch checks the files for changes at the given interval until the context
+// is done.
+func (r *certificateReloader) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := r.reloadIfChanged()
+			if err != nil {
+				logrus.WithError(err).Warn("Unable to reload TLS certificate, will retry")
+			} else if reloaded {
+				logrus.Infof("Reloaded TLS certificate from %s", r.certFile)
+			}
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package base
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// writeCertificate writes a self-signed certificate for the given common name
+// and its key to the given files, and sets their modification time.
+func writeCertificate(t *testing.T, certFile, keyFile, commonName string, modTime time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %s", err)
+	}
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("failed to write certificate: %s", err)
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("failed to write key: %s", err)
+	}
+	for _, file := range []string{certFile, keyFile} {
+		if err = os.Chtimes(file, modTime, modTime); err != nil {
+			t.Fatalf("failed to set modification time: %s", err)
+		}
+	}
+}
+
+func mustGetCommonName(t *testing.T, r *certificateReloader) string {
+	t.Helper()
+	cert, err := r.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatalf("failed to get certificate: %s", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %s", err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertificateReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	modTime := time.Now().Add(-time.Hour)
+	writeCertificate(t, certFile, keyFile, "first", modTime)
+
+	r, err := newCertificateReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("failed to load certificate: %s", err)
+	}
+	if name := mustGetCommonName(t, r); name != "first" {
+		t.Fatalf("expected certificate %q, got %q", "first", name)
+	}
+	if reloaded, err := r.reloadIfChanged(); err != nil || reloaded {
+		t.Fatalf("expected unchanged certificate not to be reloaded, got %v (%v)", reloaded, err)
+	}
+
+	// Replacing only the certificate leaves a mismatched key, so the current
+	// certificate must be kept until the key has been replaced too.
+	otherDir := t.TempDir()
+	writeCertificate(t, filepath.Join(otherDir, "server.crt"), filepath.Join(otherDir, "server.key"), "second", modTime)
+	renewed, err := os.ReadFile(filepath.Join(otherDir, "server.crt"))
+	if err != nil {
+		t.Fatalf("failed to read certificate: %s", err)
+	}
+	if err = os.WriteFile(certFile, renewed, 0600); err != nil {
+		t.Fatalf("failed to write certificate: %s", err)
+	}
+	if _, err = r.reloadIfChanged(); err == nil {
+		t.Fatalf("expected mismatched certificate and key to fail to load")
+	}
+	if name := mustGetCommonName(t, r); name != "first" {
+		t.Fatalf("expected certificate %q to be kept, got %q", "first", name)
+	}
+
+	writeCertificate(t, certFile, keyFile, "third", time.Now())
+	if reloaded, err := r.reloadIfChanged(); err != nil || !reloaded {
+		t.Fatalf("expected changed certificate to be reloaded, got %v (%v)", reloaded, err)
+	}
+	if name := mustGetCommonName(t, r); name != "third" {
+		t.Fatalf("expected certificate %q, got %q", "third", name)
+	}
+}
+
+// TestACMEManager obtains and renews a certificate from an in-process ACME
+// server, using each of the challenge types. The manager is served the same
+// way as the HTTPS listener and the HTTP-01 challenge listener.
+func TestACMEManager(t *testing.T) {
+	for _, challengeType := range []string{"tls-alpn-01", "http-01"} {
+		t.Run(challengeType, func(t *testing.T) {
+			testACMEManager(t, challengeType)
+		})
+	}
+}
+
+func testACMEManager(t *testing.T, challengeType string) {
+	ca := newACMEServer(t, challengeType)
+	cfg := &config.ACME{
+		Enabled:              true,
+		DirectoryURL:         ca.URL + "/directory",
+		DirectoryCA:          config.Path(ca.caFile),
+		AcceptTermsOfService: true,
+		CacheDirectory:       config.Path(t.TempDir()),
+	}
+	m, err := newACMEManager(cfg, "dendrite.test")
+	if err != nil {
+		t.Fatalf("failed to create ACME manager: %s", err)
+	}
+
+	switch challengeType {
+	case "tls-alpn-01":
+		https := httptest.NewUnstartedServer(http.NotFoundHandler())
+		https.TLS = m.TLSConfig()
+		https.StartTLS()
+		defer https.Close()
+		ca.validate = func(domain, token, keyAuth string) error {
+			conn, err := tls.Dial("tcp", https.Listener.Addr().String(), &tls.Config{
+				ServerName:         domain,
+				NextProtos:         []string{acme.ALPNProto},
+				InsecureSkipVerify: true, // nolint:gosec
+			})
+			if err != nil {
+				return err
+			}
+			defer conn.Close() // nolint:errcheck
+			state := conn.ConnectionState()
+			if state.NegotiatedProtocol != acme.ALPNProto {
+				return fmt.Errorf("negotiated protocol %q", state.NegotiatedProtocol)
+			}
+			leaf := state.PeerCertificates[0]
+			if err = leaf.VerifyHostname(domain); err != nil {
+				return err
+			}
+			want := sha256.Sum256([]byte(keyAuth))
+			wantExt, _ := asn1.Marshal(want[:])
+			for _, ext := range leaf.Extensions {
+				if ext.Id.Equal(asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}) && bytes.Equal(ext.Value, wantExt) {
+					return nil
+				}
+			}
+			return fmt.Errorf("no acmeIdentifier extension for the key authorization")
+		}
+	case "http-01":
+		challenges := httptest.NewServer(m.HTTPHandler(nil))
+		defer challenges.Close()
+		ca.validate = func(domain, token, keyAuth string) error {
+			req, err := http.NewRequest(http.MethodGet, challenges.URL+"/.well-known/acme-challenge/"+token, nil)
+			if err != nil {
+				return err
+			}
+			req.Host = domain
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				return err
+			}
+			defer res.Body.Close() // nolint:errcheck
+			body, err := io.ReadAll(res.Body)
+			if err != nil {
+				return err
+			}
+			if res.StatusCode != http.StatusOK || string(body) != keyAuth {
+				return fmt.Errorf("got %d %q, want the key authorization", res.StatusCode, body)
+			}
+			return nil
+		}
+	}
+
+	if _, err = m.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.test"}); err == nil {
+		t.Fatalf("expected no certificate for a domain which isn't configured")
+	}
+
+	// The first certificate expires within the renewal window, so it is
+	// renewed straight away. The renewed one is valid for longer.
+	ca.validity = func(n int) time.Duration {
+		if n == 1 {
+			return time.Hour
+		}
+		return time.Hour * 24 * 90
+	}
+	cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "dendrite.test"})
+	if err != nil {
+		t.Fatalf("failed to obtain certificate: %s", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.caCert)
+	if _, err = cert.Leaf.Verify(x509.VerifyOptions{DNSName: "dendrite.test", Roots: roots}); err != nil {
+		t.Fatalf("certificate is not valid for the server name: %s", err)
+	}
+	deadline := time.Now().Add(time.Second * 10)
+	for {
+		renewed, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "dendrite.test"})
+		if err != nil {
+			t.Fatalf("failed to get certificate: %s", err)
+		}
+		if renewed.Leaf.SerialNumber.Cmp(cert.Leaf.SerialNumber) != 0 {
+			if renewed.Leaf.NotAfter.Before(time.Now().Add(time.Hour * 24)) {
+				t.Fatalf("expected the renewed certificate to be valid for longer")
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the certificate to be renewed")
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	if issued := ca.Issued(); issued != 2 {
+		t.Fatalf("expected 2 certificates to be issued, got %d", issued)
+	}
+
+	// The renewed certificate is cached on disk, so a new manager doesn't
+	// need to obtain it again.
+	cfg.DirectoryURL = "http://127.0.0.1:1/directory"
+	cfg.DirectoryCA = ""
+	m, err = newACMEManager(cfg, "dendrite.test")
+	if err != nil {
+		t.Fatalf("failed to create ACME manager: %s", err)
+	}
+	if _, err = m.GetCertificate(&tls.ClientHelloInfo{ServerName: "dendrite.test"}); err != nil {
+		t.Fatalf("failed to get cached certificate: %s", err)
+	}
+}
@@ -16,23 +16,31 @@ package config
 
 import (
 	"bytes"
+	"context"
 	"encoding/pem"
 	"fmt"
 	"io"
+	"io/fs"
 	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
 	"golang.org/x/crypto/ed25519"
 	yaml "gopkg.in/yaml.v2"
-
-	jaegerconfig "github.com/uber/jaeger-client-go/config"
-	jaegermetrics "github.com/uber/jaeger-lib/metrics"
 )
 
 // keyIDRegexp defines allowable characters in Key IDs.
@@ -65,13 +73,11 @@ type Dendrite struct {
 
 	MSCs MSCs `yaml:"mscs"`
 
+	// The path of the config file, so that it can be reloaded.
+	path string
+
 	// The config for tracing the dendrite servers.
-	Tracing struct {
-		// Set to true to enable tracer hooks. If false, no tracing is set up.
-		Enabled bool `yaml:"enabled"`
-		// The config for the jaeger opentracing reporter.
-		Jaeger jaegerconfig.Configuration `yaml:"jaeger"`
-	} `yaml:"tracing"`
+	Tracing Tracing `yaml:"tracing"`
 
 	// The config for logging informations. Each hook will be added to logrus.
 	Logging []LogrusHook `yaml:"logging"`
@@ -97,7 +103,8 @@ type Derived struct {
 	}
 
 	// Application services parsed from their config files
-	// The paths of which were given above in the main config file
+	// The paths of which were given above in the main config file.
+	// They can be reloaded at runtime, so use AppServices() to read them.
 	ApplicationServices []ApplicationService
 
 	// Meta-regexes compiled from all exclusive application service
@@ -111,13 +118,27 @@ type Derived struct {
 	ExclusiveApplicationServicesAliasRegexp *regexp.Regexp
 	// Note: An Exclusive Regex for room ID isn't necessary as we aren't blocking
 	// servers from creating RoomIDs in exclusive application service namespaces
+
+	// Protects the application services and the regexes when they are reloaded.
+	appServicesMu sync.RWMutex
 }
 
 type InternalAPIOptions struct {
 	Listen  HTTPAddress `yaml:"listen"`
 	Connect HTTPAddress `yaml:"connect"`
+	// The transport which other components use to call the API, either "json"
+	// or "binary". Defaults to "json". The API accepts calls using either.
+	Transport InternalAPITransport `yaml:"transport"`
 }
 
+// InternalAPITransport is the encoding used to call an internal API.
+type InternalAPITransport string
+
+const (
+	InternalAPITransportJSON   InternalAPITransport = "json"
+	InternalAPITransportBinary InternalAPITransport = "binary"
+)
+
 type ExternalAPIOptions struct {
 	Listen HTTPAddress `yaml:"listen"`
 }
@@ -144,17 +165,57 @@ type Topic string
 // An Address to listen on.
 type Address string
 
-// An HTTPAddress to listen on, starting with either http:// or https://.
+// An HTTPAddress to listen on, starting with either http:// or https://, or
+// unix:// followed by the absolute path of a unix socket. The file mode of a
+// unix socket to listen on can be given in octal with the mode parameter, e.g.
+// unix:///run/dendrite/client.sock?mode=0600, and defaults to 0660.
 type HTTPAddress string
 
+// DefaultUnixSocketMode is the file mode of unix sockets to listen on if no
+// mode is given. Only the owner and the group can connect, since anyone who can
+// connect to the socket of an internal API can use it without authentication.
+const DefaultUnixSocketMode fs.FileMode = 0660
+
 func (h HTTPAddress) Address() (Address, error) {
 	url, err := url.Parse(string(h))
 	if err != nil {
 		return "", err
 	}
+	if url.Scheme == "unix" {
+		return Address(url.Path), nil
+	}
 	return Address(url.Host), nil
 }
 
+// IsUnixSocket returns whether the address is a unix socket.
+func (h HTTPAddress) IsUnixSocket() bool {
+	return strings.HasPrefix(string(h), "unix://")
+}
+
+// UnixSocket returns the path of the unix socket and the file mode to create
+// it with.
+func (h HTTPAddress) UnixSocket() (string, fs.FileMode, error) {
+	url, err := url.Parse(string(h))
+	if err != nil {
+		return "", 0, err
+	}
+	if url.Scheme != "unix" {
+		return "", 0, fmt.Errorf("%q is not a unix socket address", h)
+	}
+	if url.Host != "" || !filepath.IsAbs(url.Path) {
+		return "", 0, fmt.Errorf("%q must contain an absolute path, e.g. unix:///run/dendrite.sock", h)
+	}
+	mode := DefaultUnixSocketMode
+	if m := url.Query().Get("mode"); m != "" {
+		parsed, err := strconv.ParseUint(m, 8, 32)
+		if err != nil || parsed > 0777 {
+			return "", 0, fmt.Errorf("%q contains an invalid mode", h)
+		}
+		mode = fs.FileMode(parsed)
+	}
+	return url.Path, mode, nil
+}
+
 // FileSizeBytes is a file size in bytes
 type FileSizeBytes int64
 
@@ -201,7 +262,36 @@ func Load(configPath string, monolith bool) (*Dendrite, error) {
 	}
 	// Pass the current working directory and os.ReadFile so that they can
 	// be mocked in the tests
-	return loadConfig(basePath, configData, os.ReadFile, monolith)
+	c, err := loadConfig(basePath, configData, os.ReadFile, monolith)
+	if err != nil {
+		return nil, err
+	}
+	c.path = configPath
+	return c, nil
+}
+
+// Reload reads the config file which the config was loaded from again, and returns
+// it so that the settings which can be changed at runtime can be applied: the
+// application services, rate limiting and logging levels. Other settings only
+// change when Dendrite is restarted. Only the application services are updated in
+// this config, since they are protected by a lock, so components which use the
+// other settings must be told about the change, see BaseDendrite.ReloadConfig.
+func (c *Dendrite) Reload() (*Dendrite, error) {
+	if c.path == "" {
+		return nil, fmt.Errorf("the config wasn't loaded from a file")
+	}
+	reloaded, err := Load(c.path, c.IsMonolith)
+	if err != nil {
+		return nil, err
+	}
+	configErrs := &ConfigErrors{}
+	reloaded.Verify(configErrs, c.IsMonolith)
+	if len(*configErrs) > 0 {
+		return nil, *configErrs
+	}
+
+	c.Derived.setAppServices(&reloaded.Derived)
+	return reloaded, nil
 }
 
 func loadConfig(
@@ -284,6 +374,15 @@ func (config *Dendrite) Derive() error {
 			authtypes.Flow{Stages: []authtypes.LoginType{authtypes.LoginTypeDummy}})
 	}
 
+	// If a registration token is required then every flow must include it.
+	if config.ClientAPI.RegistrationRequiresToken {
+		for i, flow := range config.Derived.Registration.Flows {
+			config.Derived.Registration.Flows[i].Stages = append(
+				[]authtypes.LoginType{authtypes.LoginTypeRegistrationToken}, flow.Stages...,
+			)
+		}
+	}
+
 	// Load application service configuration files
 	if err := loadAppServices(&config.AppServiceAPI, &config.Derived); err != nil {
 		return err
@@ -306,6 +405,7 @@ func (c *Dendrite) Defaults(generate bool) {
 	c.UserAPI.Defaults(generate)
 	c.AppServiceAPI.Defaults(generate)
 	c.MSCs.Defaults(generate)
+	c.Tracing.Defaults(generate)
 
 	c.Wiring()
 }
@@ -318,7 +418,7 @@ func (c *Dendrite) Verify(configErrs *ConfigErrors, isMonolith bool) {
 		&c.Global, &c.ClientAPI, &c.FederationAPI,
 		&c.KeyServer, &c.MediaAPI, &c.RoomServer,
 		&c.SyncAPI, &c.UserAPI,
-		&c.AppServiceAPI, &c.MSCs,
+		&c.AppServiceAPI, &c.MSCs, &c.Tracing,
 	} {
 		c.Verify(configErrs, isMonolith)
 	}
@@ -405,6 +505,28 @@ func checkURL(configErrs *ConfigErrors, key, value string) {
 	}
 }
 
+// checkHTTPAddress verifies that the parameter is a valid address to listen on
+// or connect to.
+func checkHTTPAddress(configErrs *ConfigErrors, key string, value HTTPAddress) {
+	if !value.IsUnixSocket() {
+		checkURL(configErrs, key, string(value))
+		return
+	}
+	if _, _, err := value.UnixSocket(); err != nil {
+		configErrs.Add(fmt.Sprintf("config key %q contains an invalid unix socket address (%s)", key, err.Error()))
+	}
+}
+
+// checkInternalAPITransport verifies that the parameter is a known transport
+// for the internal APIs.
+func checkInternalAPITransport(configErrs *ConfigErrors, key string, value InternalAPITransport) {
+	switch value {
+	case "", InternalAPITransportJSON, InternalAPITransportBinary:
+	default:
+		configErrs.Add(fmt.Sprintf("config key %q should be %q or %q", key, InternalAPITransportJSON, InternalAPITransportBinary))
+	}
+}
+
 // checkLogging verifies the parameters logging.* are valid.
 func (config *Dendrite) checkLogging(configErrs *ConfigErrors) {
 	for _, logrusHook := range config.Logging {
@@ -527,27 +649,47 @@ func (config *Dendrite) KeyServerURL() string {
 	return string(config.KeyServer.InternalAPI.Connect)
 }
 
-// SetupTracing configures the opentracing using the supplied configuration.
+// SetupTracing configures OpenTelemetry using the supplied configuration. The
+// spans are exported to the OTLP collector, and the trace context is propagated
+// using the W3C traceparent header.
 func (config *Dendrite) SetupTracing(serviceName string) (closer io.Closer, err error) {
 	if !config.Tracing.Enabled {
 		return io.NopCloser(bytes.NewReader([]byte{})), nil
 	}
-	return config.Tracing.Jaeger.InitGlobalTracer(
-		serviceName,
-		jaegerconfig.Logger(logrusLogger{logrus.StandardLogger()}),
-		jaegerconfig.Metrics(jaegermetrics.NullFactory),
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(config.Tracing.OTLP.Endpoint),
+	}
+	if config.Tracing.OTLP.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	if len(config.Tracing.OTLP.Headers) > 0 {
+		opts = append(opts, otlptracehttp.WithHeaders(config.Tracing.OTLP.Headers))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("otlptracehttp.New: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.Tracing.OTLP.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceNameKey.String(serviceName))),
 	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		logrus.WithError(err).Warn("OpenTelemetry error")
+	}))
+	return tracerProviderCloser{provider}, nil
 }
 
-// logrusLogger is a small wrapper that implements jaeger.Logger using logrus.
-type logrusLogger struct {
-	l *logrus.Logger
-}
-
-func (l logrusLogger) Error(msg string) {
-	l.l.Error(msg)
+// tracerProviderCloser flushes any spans which haven't been exported yet and
+// stops the tracer provider when it is closed.
+type tracerProviderCloser struct {
+	provider *sdktrace.TracerProvider
 }
 
-func (l logrusLogger) Infof(msg string, args ...interface{}) {
-	l.l.Infof(msg, args...)
+func (c tracerProviderCloser) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	return c.provider.Shutdown(ctx)
 }
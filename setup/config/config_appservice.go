@@ -56,8 +56,9 @@ func (c *AppServiceAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	if isMonolith { // polylith required configs below
 		return
 	}
-	checkURL(configErrs, "app_service_api.internal_api.listen", string(c.InternalAPI.Listen))
-	checkURL(configErrs, "app_service_api.internal_api.connect", string(c.InternalAPI.Connect))
+	checkHTTPAddress(configErrs, "app_service_api.internal_api.listen", c.InternalAPI.Listen)
+	checkHTTPAddress(configErrs, "app_service_api.internal_api.connect", c.InternalAPI.Connect)
+	checkInternalAPITransport(configErrs, "app_service_api.internal_api.transport", c.InternalAPI.Transport)
 }
 
 // ApplicationServiceNamespace is the namespace that a specific application
@@ -99,6 +100,39 @@ type ApplicationService struct {
 	RateLimited bool `yaml:"rate_limited"`
 	// Any custom protocols that this application service provides (e.g. IRC)
 	Protocols []string `yaml:"protocols"`
+	// Whether typing notifications, receipts, presence and to-device messages
+	// are sent to the application service in transactions (MSC2409)
+	ReceiveEphemeral bool `yaml:"receive_ephemeral"`
+	// Whether device list changes and one-time key counts are sent to the
+	// application service in transactions, and whether the application service
+	// may masquerade as devices of its users (MSC3202)
+	MSC3202 bool `yaml:"org.matrix.msc3202"`
+}
+
+// AppServices returns the application services. As they can be reloaded at any
+// time, the application services should be looked up again for each request.
+func (d *Derived) AppServices() []ApplicationService {
+	d.appServicesMu.RLock()
+	defer d.appServicesMu.RUnlock()
+	return d.ApplicationServices
+}
+
+// ExclusiveUsernameRegexp returns the regex which matches the user IDs in any
+// exclusive namespace of the application services.
+func (d *Derived) ExclusiveUsernameRegexp() *regexp.Regexp {
+	d.appServicesMu.RLock()
+	defer d.appServicesMu.RUnlock()
+	return d.ExclusiveApplicationServicesUsernameRegexp
+}
+
+// setAppServices replaces the application services with the ones which were
+// loaded into other.
+func (d *Derived) setAppServices(other *Derived) {
+	d.appServicesMu.Lock()
+	defer d.appServicesMu.Unlock()
+	d.ApplicationServices = other.ApplicationServices
+	d.ExclusiveApplicationServicesUsernameRegexp = other.ExclusiveApplicationServicesUsernameRegexp
+	d.ExclusiveApplicationServicesAliasRegexp = other.ExclusiveApplicationServicesAliasRegexp
 }
 
 // IsInterestedInRoomID returns a bool on whether an application service's
@@ -355,13 +389,47 @@ func checkErrors(config *AppServiceAPI, derived *Derived) (err error) {
 		if appservice.RateLimited {
 			log.Warn("WARNING: Application service option rate_limited is currently unimplemented")
 		}
-		// TODO: Remove once protocols is implemented
-		if len(appservice.Protocols) > 0 {
-			log.Warn("WARNING: Application service option protocols is currently unimplemented")
+	}
+
+	if err = setupRegexps(config, derived); err != nil {
+		return err
+	}
+	return checkExclusiveNamespaces(config, derived)
+}
+
+// checkExclusiveNamespaces checks that no two application services claim the
+// same users or aliases exclusively, including each other's sender user.
+func checkExclusiveNamespaces(config *AppServiceAPI, derived *Derived) error {
+	exclusiveRegexes := map[string]string{}
+	for _, appservice := range derived.ApplicationServices {
+		for key, namespaceSlice := range appservice.NamespaceMap {
+			for _, namespace := range namespaceSlice {
+				if !namespace.Exclusive {
+					continue
+				}
+				if otherID, ok := exclusiveRegexes[key+" "+namespace.Regex]; ok && otherID != appservice.ID {
+					return ConfigErrors([]string{fmt.Sprintf(
+						"Application services %s and %s both have the exclusive %s namespace %q",
+						otherID, appservice.ID, key, namespace.Regex,
+					)})
+				}
+				exclusiveRegexes[key+" "+namespace.Regex] = appservice.ID
+			}
 		}
 	}
 
-	return setupRegexps(config, derived)
+	for _, appservice := range derived.ApplicationServices {
+		senderUserID := fmt.Sprintf("@%s:%s", appservice.SenderLocalpart, config.Matrix.ServerName)
+		for _, other := range derived.ApplicationServices {
+			if other.ID != appservice.ID && other.OwnsNamespaceCoveringUserId(senderUserID) {
+				return ConfigErrors([]string{fmt.Sprintf(
+					"The sender %s of application service %s is in an exclusive namespace of application service %s",
+					senderUserID, appservice.ID, other.ID,
+				)})
+			}
+		}
+	}
+	return nil
 }
 
 // validateNamespace returns nil or an error based on whether a given
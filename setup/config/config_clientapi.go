@@ -42,6 +42,10 @@ type ClientAPI struct {
 	// was successful
 	RecaptchaSiteVerifyAPI string `yaml:"recaptcha_siteverify_api"`
 
+	// If set, requires a registration token (m.login.registration_token)
+	// to be supplied when registering.
+	RegistrationRequiresToken bool `yaml:"registration_requires_token"`
+
 	// TURN options
 	TURN TURN `yaml:"turn"`
 
@@ -62,6 +66,7 @@ func (c *ClientAPI) Defaults(generate bool) {
 	c.RecaptchaBypassSecret = ""
 	c.RecaptchaSiteVerifyAPI = ""
 	c.RegistrationDisabled = true
+	c.RegistrationRequiresToken = false
 	c.OpenRegistrationWithoutVerificationEnabled = false
 	c.RateLimiting.Defaults()
 }
@@ -76,10 +81,10 @@ func (c *ClientAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	}
 	// Ensure there is any spam counter measure when enabling registration
 	if !c.RegistrationDisabled && !c.OpenRegistrationWithoutVerificationEnabled {
-		if !c.RecaptchaEnabled {
+		if !c.RecaptchaEnabled && !c.RegistrationRequiresToken {
 			configErrs.Add(
 				"You have tried to enable open registration without any secondary verification methods " +
-					"(such as reCAPTCHA). By enabling open registration, you are SIGNIFICANTLY " +
+					"(such as reCAPTCHA or registration tokens). By enabling open registration, you are SIGNIFICANTLY " +
 					"increasing the risk that your server will be used to send spam or abuse, and may result in " +
 					"your server being banned from some rooms. If you are ABSOLUTELY CERTAIN you want to do this, " +
 					"start Dendrite with the -really-enable-open-registration command line flag. Otherwise, you " +
@@ -90,9 +95,10 @@ func (c *ClientAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	if isMonolith { // polylith required configs below
 		return
 	}
-	checkURL(configErrs, "client_api.internal_api.listen", string(c.InternalAPI.Listen))
-	checkURL(configErrs, "client_api.internal_api.connect", string(c.InternalAPI.Connect))
-	checkURL(configErrs, "client_api.external_api.listen", string(c.ExternalAPI.Listen))
+	checkHTTPAddress(configErrs, "client_api.internal_api.listen", c.InternalAPI.Listen)
+	checkHTTPAddress(configErrs, "client_api.internal_api.connect", c.InternalAPI.Connect)
+	checkInternalAPITransport(configErrs, "client_api.internal_api.transport", c.InternalAPI.Transport)
+	checkHTTPAddress(configErrs, "client_api.external_api.listen", c.ExternalAPI.Listen)
 }
 
 type TURN struct {
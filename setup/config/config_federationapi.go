@@ -49,9 +49,10 @@ func (c *FederationAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	if isMonolith { // polylith required configs below
 		return
 	}
-	checkURL(configErrs, "federation_api.external_api.listen", string(c.ExternalAPI.Listen))
-	checkURL(configErrs, "federation_api.internal_api.listen", string(c.InternalAPI.Listen))
-	checkURL(configErrs, "federation_api.internal_api.connect", string(c.InternalAPI.Connect))
+	checkHTTPAddress(configErrs, "federation_api.external_api.listen", c.ExternalAPI.Listen)
+	checkHTTPAddress(configErrs, "federation_api.internal_api.listen", c.InternalAPI.Listen)
+	checkHTTPAddress(configErrs, "federation_api.internal_api.connect", c.InternalAPI.Connect)
+	checkInternalAPITransport(configErrs, "federation_api.internal_api.transport", c.InternalAPI.Transport)
 }
 
 // The config for setting a proxy to use for server->server requests
@@ -49,6 +49,10 @@ type Global struct {
 	// The server name to delegate client-server communications to, with optional port
 	WellKnownClientName string `yaml:"well_known_client_name"`
 
+	// Additional content of the /.well-known/matrix/client document, and the
+	// /.well-known/matrix/support document.
+	WellKnown WellKnown `yaml:"well_known"`
+
 	// Disables federation. Dendrite will not be able to make any outbound HTTP requests
 	// to other servers and the federation API will not be exposed.
 	DisableFederation bool `yaml:"disable_federation"`
@@ -79,8 +83,20 @@ type Global struct {
 	// ReportStats configures opt-in phone-home statistics reporting.
 	ReportStats ReportStats `yaml:"report_stats"`
 
+	// Policy configures an optional policy module, which is asked whether to
+	// accept events and other requests before they are processed.
+	Policy Policy `yaml:"policy"`
+
+	// Email configures sending emails, e.g. to verify email addresses or to
+	// reset passwords without an identity server.
+	Email Email `yaml:"email"`
+
 	// Configuration for the caches.
 	Cache Cache `yaml:"cache"`
+
+	// ACME configures obtaining and renewing the certificates for the HTTPS
+	// listener automatically, instead of using static certificate files.
+	ACME ACME `yaml:"acme"`
 }
 
 func (c *Global) Defaults(generate bool) {
@@ -98,7 +114,12 @@ func (c *Global) Defaults(generate bool) {
 	c.Sentry.Defaults()
 	c.ServerNotices.Defaults(generate)
 	c.ReportStats.Defaults()
+	c.Email.Defaults(generate)
+	c.Policy.Defaults()
 	c.Cache.Defaults(generate)
+	c.Presence.Defaults()
+	c.ACME.Defaults()
+	c.WellKnown.Defaults()
 }
 
 func (c *Global) Verify(configErrs *ConfigErrors, isMonolith bool) {
@@ -111,7 +132,15 @@ func (c *Global) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	c.DNSCache.Verify(configErrs, isMonolith)
 	c.ServerNotices.Verify(configErrs, isMonolith)
 	c.ReportStats.Verify(configErrs, isMonolith)
+	c.Email.Verify(configErrs, isMonolith)
+	c.Policy.Verify(configErrs, isMonolith)
 	c.Cache.Verify(configErrs, isMonolith)
+	c.Presence.Verify(configErrs, isMonolith)
+	c.ACME.Verify(configErrs, isMonolith)
+	c.WellKnown.Verify(configErrs, isMonolith)
+	if c.WellKnownClientName == "" && c.WellKnown.HasClientContent() {
+		configErrs.Add("config key \"global.well_known_client_name\" must be set to serve the other keys of /.well-known/matrix/client")
+	}
 }
 
 type OldVerifyKeys struct {
@@ -212,6 +241,209 @@ func (c *ReportStats) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	}
 }
 
+// WellKnown configures the documents served under /.well-known/matrix/ in
+// addition to the delegation of the server and client names.
+type WellKnown struct {
+	// The base URL of the identity server advertised to clients as
+	// m.identity_server.
+	IdentityServer string `yaml:"identity_server"`
+
+	// The URL of the sliding sync proxy advertised to clients as
+	// org.matrix.msc3575.proxy.
+	SlidingSyncProxy string `yaml:"sliding_sync_proxy"`
+
+	// Custom keys added to the client document, e.g. settings for a specific
+	// client. They can't replace the keys set by the options above.
+	ClientExtra map[string]interface{} `yaml:"client_extra"`
+
+	// The contents of the support document. It is only served if any contacts
+	// or a support page are configured.
+	Support WellKnownSupport `yaml:"support"`
+
+	// How long clients and proxies may cache the documents for.
+	CacheMaxAge time.Duration `yaml:"cache_max_age"`
+}
+
+// WellKnownSupport is the content of /.well-known/matrix/support.
+type WellKnownSupport struct {
+	// The people to contact about the server.
+	Contacts []WellKnownSupportContact `yaml:"contacts"`
+
+	// A URL of a page with support information for the users of the server.
+	SupportPage string `yaml:"support_page"`
+}
+
+// WellKnownSupportContact is a contact in /.well-known/matrix/support. At least
+// one of the Matrix ID and the email address must be set.
+type WellKnownSupportContact struct {
+	MatrixID     string `yaml:"matrix_id"`
+	EmailAddress string `yaml:"email_address"`
+	// The role of the contact, e.g. "m.role.admin" or "m.role.security".
+	Role string `yaml:"role"`
+}
+
+func (c *WellKnown) Defaults() {
+	c.CacheMaxAge = time.Hour
+}
+
+func (c *WellKnown) Verify(configErrs *ConfigErrors, isMonolith bool) {
+	if c.IdentityServer != "" {
+		checkURL(configErrs, "global.well_known.identity_server", c.IdentityServer)
+	}
+	if c.SlidingSyncProxy != "" {
+		checkURL(configErrs, "global.well_known.sliding_sync_proxy", c.SlidingSyncProxy)
+	}
+	if c.Support.SupportPage != "" {
+		checkURL(configErrs, "global.well_known.support.support_page", c.Support.SupportPage)
+	}
+	for _, contact := range c.Support.Contacts {
+		checkNotEmpty(configErrs, "global.well_known.support.contacts.role", contact.Role)
+		if contact.MatrixID == "" && contact.EmailAddress == "" {
+			configErrs.Add("config key \"global.well_known.support.contacts\" contains a contact without a matrix_id or email_address")
+		}
+	}
+	checkPositive(configErrs, "global.well_known.cache_max_age", int64(c.CacheMaxAge))
+}
+
+// HasClientContent returns whether any keys are configured for the client
+// document besides m.homeserver.
+func (c *WellKnown) HasClientContent() bool {
+	return c.IdentityServer != "" || c.SlidingSyncProxy != "" || len(c.ClientExtra) > 0
+}
+
+// HasSupport returns whether the support document should be served.
+func (c *WellKnown) HasSupport() bool {
+	return len(c.Support.Contacts) > 0 || c.Support.SupportPage != ""
+}
+
+// ACME configures obtaining certificates from an ACME certificate authority,
+// e.g. Let's Encrypt, using the HTTP-01 and TLS-ALPN-01 challenges.
+type ACME struct {
+	// Enabled configures whether certificates are obtained using ACME. Any
+	// certificate and key given on the command line are ignored if so.
+	Enabled bool `yaml:"enabled"`
+
+	// The directory URL of the certificate authority.
+	DirectoryURL string `yaml:"directory_url"`
+
+	// An optional PEM file with additional CA certificates to trust when
+	// connecting to the directory, e.g. for a private certificate authority.
+	DirectoryCA Path `yaml:"directory_ca"`
+
+	// The contact email address of the ACME account, which is used to notify
+	// about problems with the certificates.
+	Email string `yaml:"email"`
+
+	// Whether the terms of service of the certificate authority are accepted,
+	// which is required to create an account.
+	AcceptTermsOfService bool `yaml:"accept_terms_of_service"`
+
+	// The domains to obtain certificates for. Defaults to the server name.
+	Domains []string `yaml:"domains"`
+
+	// The directory the account key and the certificates are cached in, so
+	// that they survive restarts.
+	CacheDirectory Path `yaml:"cache_dir"`
+
+	// An optional address to answer HTTP-01 challenges on, e.g. ":80". The
+	// challenges are always answered on the plain HTTP listener too.
+	HTTPChallengeAddress string `yaml:"http_challenge_address"`
+}
+
+func (c *ACME) Defaults() {
+	c.Enabled = false
+	c.DirectoryURL = "https://acme-v02.api.letsencrypt.org/directory"
+	c.CacheDirectory = "./acme"
+}
+
+func (c *ACME) Verify(configErrs *ConfigErrors, isMonolith bool) {
+	if !c.Enabled {
+		return
+	}
+	checkURL(configErrs, "global.acme.directory_url", c.DirectoryURL)
+	checkNotEmpty(configErrs, "global.acme.cache_dir", string(c.CacheDirectory))
+	if !c.AcceptTermsOfService {
+		configErrs.Add("the terms of service of the ACME certificate authority must be accepted by setting \"global.acme.accept_terms_of_service\"")
+	}
+}
+
+// Email configures sending emails using SMTP.
+type Email struct {
+	// Enabled configures whether emails are sent by Dendrite itself, e.g. to
+	// verify email addresses, rather than relying on an identity server.
+	Enabled bool `yaml:"enabled"`
+
+	// The address emails are sent from, e.g. "Dendrite <noreply@example.com>".
+	From string `yaml:"from"`
+
+	// The SMTP server to send emails through, as host:port.
+	SMTPHost string `yaml:"smtp_host"`
+
+	// The credentials to authenticate to the SMTP server with, if any.
+	SMTPUsername string `yaml:"smtp_username"`
+	SMTPPassword string `yaml:"smtp_password"`
+
+	// Refuse to send emails if the SMTP server doesn't support STARTTLS.
+	RequireTLS bool `yaml:"require_tls"`
+
+	// The public base URL of the client API, used to build the links in
+	// emails, e.g. "https://matrix.example.com".
+	PublicBaseURL string `yaml:"public_base_url"`
+
+	// An optional directory containing templates to use instead of the
+	// built-in ones.
+	TemplatesPath Path `yaml:"templates_path"`
+
+	// How long the validation tokens sent in emails are valid for.
+	TokenLifetime time.Duration `yaml:"token_lifetime"`
+}
+
+func (c *Email) Defaults(generate bool) {
+	c.Enabled = false
+	c.TokenLifetime = time.Hour
+	if generate {
+		c.From = "Dendrite <noreply@localhost>"
+		c.SMTPHost = "localhost:25"
+		c.PublicBaseURL = "https://localhost"
+	}
+}
+
+func (c *Email) Verify(configErrs *ConfigErrors, isMonolith bool) {
+	if c.Enabled {
+		checkNotEmpty(configErrs, "global.email.from", c.From)
+		checkNotEmpty(configErrs, "global.email.smtp_host", c.SMTPHost)
+		checkNotEmpty(configErrs, "global.email.public_base_url", c.PublicBaseURL)
+		checkPositive(configErrs, "global.email.token_lifetime", int64(c.TokenLifetime))
+	}
+}
+
+// Policy configures a policy module, e.g. a spam checker, which can allow,
+// reject or soft-fail events and other requests.
+type Policy struct {
+	// The URL of an HTTP webhook which is asked about each request. If empty,
+	// all requests are allowed.
+	URL string `yaml:"url"`
+
+	// How long to wait for the webhook to respond.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// Whether to allow requests if the webhook can't be reached or responds
+	// with an error. If false, such requests are rejected.
+	FailOpen bool `yaml:"fail_open"`
+}
+
+func (c *Policy) Defaults() {
+	c.Timeout = time.Second * 5
+	c.FailOpen = true
+}
+
+func (c *Policy) Verify(configErrs *ConfigErrors, isMonolith bool) {
+	if c.URL != "" {
+		checkURL(configErrs, "global.policy.url", c.URL)
+		checkPositive(configErrs, "global.policy.timeout", int64(c.Timeout))
+	}
+}
+
 // The configuration to use for Sentry error reporting
 type Sentry struct {
 	Enabled bool `yaml:"enabled"`
@@ -291,6 +523,27 @@ type PresenceOptions struct {
 	EnableInbound bool `yaml:"enable_inbound"`
 	// Whether outbound presence events are allowed
 	EnableOutbound bool `yaml:"enable_outbound"`
+	// How long a local user can go without sending events, receipts or
+	// presence updates before they are marked as unavailable.
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+	// How long after their last /sync request finished a local user is
+	// marked as offline.
+	OfflineTimeout time.Duration `yaml:"offline_timeout"`
+	// Presence updates of local users are not sent to the servers in rooms
+	// with more joined members than this. 0 means no limit.
+	MaxRoomSize int `yaml:"max_room_size"`
+}
+
+func (c *PresenceOptions) Defaults() {
+	c.IdleTimeout = time.Minute * 5
+	c.OfflineTimeout = time.Second * 30
+	c.MaxRoomSize = 0
+}
+
+func (c *PresenceOptions) Verify(configErrs *ConfigErrors, isMonolith bool) {
+	checkPositive(configErrs, "global.presence.idle_timeout", int64(c.IdleTimeout))
+	checkPositive(configErrs, "global.presence.offline_timeout", int64(c.OfflineTimeout))
+	checkPositive(configErrs, "global.presence.max_room_size", int64(c.MaxRoomSize))
 }
 
 type DataUnit int64
@@ -1,29 +1,52 @@
 package config
 
+import "fmt"
+
 type KeyServer struct {
 	Matrix *Global `yaml:"-"`
 
 	InternalAPI InternalAPIOptions `yaml:"internal_api"`
 
 	Database DatabaseOptions `yaml:"database"`
+
+	// Configuration for fetching the device lists of remote users.
+	DeviceListUpdater DeviceListUpdater `yaml:"device_list_updater"`
+}
+
+type DeviceListUpdater struct {
+	// How many workers fetch device lists from remote servers. Each remote
+	// server is always handled by the same worker.
+	Workers int `yaml:"workers"`
+	// The most device lists which are fetched from a single remote server at
+	// the same time.
+	MaxRequestsPerServer int `yaml:"max_requests_per_server"`
 }
 
 func (c *KeyServer) Defaults(generate bool) {
 	c.InternalAPI.Listen = "http://localhost:7779"
 	c.InternalAPI.Connect = "http://localhost:7779"
 	c.Database.Defaults(10)
+	c.DeviceListUpdater.Workers = 8
+	c.DeviceListUpdater.MaxRequestsPerServer = 4
 	if generate {
 		c.Database.ConnectionString = "file:keyserver.db"
 	}
 }
 
 func (c *KeyServer) Verify(configErrs *ConfigErrors, isMonolith bool) {
+	if c.DeviceListUpdater.Workers <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "key_server.device_list_updater.workers", c.DeviceListUpdater.Workers))
+	}
+	if c.DeviceListUpdater.MaxRequestsPerServer <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "key_server.device_list_updater.max_requests_per_server", c.DeviceListUpdater.MaxRequestsPerServer))
+	}
 	if c.Matrix.DatabaseOptions.ConnectionString == "" {
 		checkNotEmpty(configErrs, "key_server.database.connection_string", string(c.Database.ConnectionString))
 	}
 	if isMonolith { // polylith required configs below
 		return
 	}
-	checkURL(configErrs, "key_server.internal_api.listen", string(c.InternalAPI.Listen))
-	checkURL(configErrs, "key_server.internal_api.connect", string(c.InternalAPI.Connect))
+	checkHTTPAddress(configErrs, "key_server.internal_api.listen", c.InternalAPI.Listen)
+	checkHTTPAddress(configErrs, "key_server.internal_api.connect", c.InternalAPI.Connect)
+	checkInternalAPITransport(configErrs, "key_server.internal_api.transport", c.InternalAPI.Transport)
 }
@@ -66,7 +66,8 @@ func (c *MediaAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	if isMonolith { // polylith required configs below
 		return
 	}
-	checkURL(configErrs, "media_api.internal_api.listen", string(c.InternalAPI.Listen))
-	checkURL(configErrs, "media_api.internal_api.connect", string(c.InternalAPI.Connect))
-	checkURL(configErrs, "media_api.external_api.listen", string(c.ExternalAPI.Listen))
+	checkHTTPAddress(configErrs, "media_api.internal_api.listen", c.InternalAPI.Listen)
+	checkHTTPAddress(configErrs, "media_api.internal_api.connect", c.InternalAPI.Connect)
+	checkInternalAPITransport(configErrs, "media_api.internal_api.transport", c.InternalAPI.Transport)
+	checkHTTPAddress(configErrs, "media_api.external_api.listen", c.ExternalAPI.Listen)
 }
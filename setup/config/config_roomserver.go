@@ -1,11 +1,20 @@
 package config
 
+import (
+	"fmt"
+	"strings"
+)
+
 type RoomServer struct {
 	Matrix *Global `yaml:"-"`
 
 	InternalAPI InternalAPIOptions `yaml:"internal_api"`
 
 	Database DatabaseOptions `yaml:"database"`
+
+	// The room IDs of moderation policy lists, i.e. rooms containing
+	// m.policy.rule.* state events, whose ban rules should be enforced.
+	PolicyLists []string `yaml:"policy_lists"`
 }
 
 func (c *RoomServer) Defaults(generate bool) {
@@ -21,9 +30,15 @@ func (c *RoomServer) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	if c.Matrix.DatabaseOptions.ConnectionString == "" {
 		checkNotEmpty(configErrs, "room_server.database.connection_string", string(c.Database.ConnectionString))
 	}
+	for _, roomID := range c.PolicyLists {
+		if !strings.HasPrefix(roomID, "!") {
+			configErrs.Add(fmt.Sprintf("invalid room ID %q for config key %q", roomID, "room_server.policy_lists"))
+		}
+	}
 	if isMonolith { // polylith required configs below
 		return
 	}
-	checkURL(configErrs, "room_server.internal_api.listen", string(c.InternalAPI.Listen))
-	checkURL(configErrs, "room_server.internal_ap.connect", string(c.InternalAPI.Connect))
+	checkHTTPAddress(configErrs, "room_server.internal_api.listen", c.InternalAPI.Listen)
+	checkHTTPAddress(configErrs, "room_server.internal_api.connect", c.InternalAPI.Connect)
+	checkInternalAPITransport(configErrs, "room_server.internal_api.transport", c.InternalAPI.Transport)
 }
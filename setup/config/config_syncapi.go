@@ -28,7 +28,8 @@ func (c *SyncAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	if isMonolith { // polylith required configs below
 		return
 	}
-	checkURL(configErrs, "sync_api.internal_api.listen", string(c.InternalAPI.Listen))
-	checkURL(configErrs, "sync_api.internal_api.connect", string(c.InternalAPI.Connect))
-	checkURL(configErrs, "sync_api.external_api.listen", string(c.ExternalAPI.Listen))
+	checkHTTPAddress(configErrs, "sync_api.internal_api.listen", c.InternalAPI.Listen)
+	checkHTTPAddress(configErrs, "sync_api.internal_api.connect", c.InternalAPI.Connect)
+	checkInternalAPITransport(configErrs, "sync_api.internal_api.transport", c.InternalAPI.Transport)
+	checkHTTPAddress(configErrs, "sync_api.external_api.listen", c.ExternalAPI.Listen)
 }
@@ -16,6 +16,7 @@ package config
 
 import (
 	"fmt"
+	"io/fs"
 	"testing"
 
 	"gopkg.in/yaml.v2"
@@ -194,16 +195,11 @@ user_api:
     conn_max_lifetime: -1
 tracing:
   enabled: false
-  jaeger:
-    serviceName: ""
-    disabled: false
-    rpc_metrics: false
-    tags: []
-    sampler: null
-    reporter: null
-    headers: null
-    baggage_restrictions: null
-    throttler: null
+  otlp:
+    endpoint: localhost:4318
+    insecure: false
+    headers: {}
+    sample_ratio: 1.0
 logging:
 - type: file
   level: info
@@ -290,3 +286,92 @@ func TestUnmarshalDataUnit(t *testing.T) {
 		}
 	}
 }
+
+func TestCheckExclusiveNamespaces(t *testing.T) {
+	appservice := func(id, senderLocalpart, userRegex string) ApplicationService {
+		return ApplicationService{
+			ID:              id,
+			SenderLocalpart: senderLocalpart,
+			NamespaceMap: map[string][]ApplicationServiceNamespace{
+				"users": {{Exclusive: true, Regex: userRegex}},
+			},
+		}
+	}
+	for name, tc := range map[string]struct {
+		appservices []ApplicationService
+		wantErr     bool
+	}{
+		"distinct namespaces": {
+			appservices: []ApplicationService{
+				appservice("irc", "ircbot", "@irc_.*:localhost"),
+				appservice("slack", "slackbot", "@slack_.*:localhost"),
+			},
+		},
+		"same exclusive namespace": {
+			appservices: []ApplicationService{
+				appservice("irc", "ircbot", "@bridged_.*:localhost"),
+				appservice("slack", "slackbot", "@bridged_.*:localhost"),
+			},
+			wantErr: true,
+		},
+		"sender in other namespace": {
+			appservices: []ApplicationService{
+				appservice("irc", "ircbot", "@irc.*:localhost"),
+				appservice("slack", "irc_slackbot", "@slack_.*:localhost"),
+			},
+			wantErr: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			asAPI := &AppServiceAPI{Matrix: &Global{ServerName: "localhost"}}
+			derived := &Derived{ApplicationServices: tc.appservices}
+			if err := setupRegexps(asAPI, derived); err != nil {
+				t.Fatalf("failed to set up regexps: %s", err)
+			}
+			err := checkExclusiveNamespaces(asAPI, derived)
+			if tc.wantErr && err == nil {
+				t.Fatal("expected an error, got none")
+			}
+			if !tc.wantErr && err != nil {
+				t.Fatalf("expected no error, got %s", err)
+			}
+		})
+	}
+}
+
+func TestUnixSocketAddress(t *testing.T) {
+	tests := []struct {
+		addr    HTTPAddress
+		path    string
+		mode    fs.FileMode
+		wantErr bool
+	}{
+		{addr: "unix:///run/dendrite.sock", path: "/run/dendrite.sock", mode: DefaultUnixSocketMode},
+		{addr: "unix:///run/dendrite.sock?mode=0600", path: "/run/dendrite.sock", mode: 0600},
+		{addr: "unix:///run/dendrite.sock?mode=0999", wantErr: true},
+		{addr: "unix://run/dendrite.sock", wantErr: true},
+		{addr: "http://localhost:8008", wantErr: true},
+	}
+	for _, tt := range tests {
+		path, mode, err := tt.addr.UnixSocket()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: unexpected error %v", tt.addr, err)
+			continue
+		}
+		if path != tt.path || mode != tt.mode {
+			t.Errorf("%s: expected %s with mode %o, got %s with mode %o", tt.addr, tt.path, tt.mode, path, mode)
+		}
+	}
+
+	configErrs := &ConfigErrors{}
+	checkHTTPAddress(configErrs, "listen", "unix:///run/dendrite.sock")
+	checkHTTPAddress(configErrs, "listen", "http://localhost:8008")
+	if len(*configErrs) != 0 {
+		t.Errorf("expected valid addresses, got %v", *configErrs)
+	}
+	checkHTTPAddress(configErrs, "listen", "unix://dendrite.sock")
+	checkHTTPAddress(configErrs, "listen", "tcp://localhost:8008")
+	if len(*configErrs) != 2 {
+		t.Errorf("expected two invalid addresses, got %v", *configErrs)
+	}
+}
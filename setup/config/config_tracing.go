@@ -0,0 +1,42 @@
+package config
+
+import (
+	"fmt"
+)
+
+type Tracing struct {
+	// Set to true to enable tracer hooks. If false, no tracing is set up.
+	Enabled bool `yaml:"enabled"`
+	// The OTLP collector to export the traces to.
+	OTLP OTLP `yaml:"otlp"`
+}
+
+type OTLP struct {
+	// The host and port of the OTLP/HTTP collector, e.g. "localhost:4318".
+	Endpoint string `yaml:"endpoint"`
+	// Send the traces over plain HTTP rather than HTTPS.
+	Insecure bool `yaml:"insecure"`
+	// Extra HTTP headers to send with each export, e.g. for authentication.
+	Headers map[string]string `yaml:"headers"`
+	// The fraction of traces which are sampled, between 0 and 1. Traces
+	// which are continued from another component keep the decision made
+	// there.
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+func (c *Tracing) Defaults(generate bool) {
+	c.Enabled = false
+	c.OTLP.Endpoint = "localhost:4318"
+	c.OTLP.Insecure = false
+	c.OTLP.SampleRatio = 1
+}
+
+func (c *Tracing) Verify(configErrs *ConfigErrors, isMonolith bool) {
+	if !c.Enabled {
+		return
+	}
+	checkNotEmpty(configErrs, "tracing.otlp.endpoint", c.OTLP.Endpoint)
+	if c.OTLP.SampleRatio < 0 || c.OTLP.SampleRatio > 1 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %v (must be between 0 and 1)", "tracing.otlp.sample_ratio", c.OTLP.SampleRatio))
+	}
+}
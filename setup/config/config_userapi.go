@@ -1,6 +1,10 @@
 package config
 
-import "golang.org/x/crypto/bcrypt"
+import (
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
 
 type UserAPI struct {
 	Matrix *Global `yaml:"-"`
@@ -16,11 +20,26 @@ type UserAPI struct {
 	// Disable TLS validation on HTTPS calls to push gatways. NOT RECOMMENDED!
 	PushGatewayDisableTLSValidation bool `yaml:"push_gateway_disable_tls_validation"`
 
+	// How long to wait before emailing notifications to email pushers, so that
+	// notifications which are read in the meantime aren't emailed and the rest
+	// are sent together in a single email. Requires global.email to be enabled.
+	EmailNotificationDelay time.Duration `yaml:"email_notification_delay"`
+
+	// Configuration for the user directory.
+	UserDirectory UserDirectory `yaml:"user_directory"`
+
 	// The Account database stores the login details and account information
 	// for local users. It is accessed by the UserAPI.
 	AccountDatabase DatabaseOptions `yaml:"account_database"`
 }
 
+type UserDirectory struct {
+	// Whether searching the user directory returns all users known to the
+	// server. Otherwise only the users who share a room with the searching
+	// user or are joined to public rooms are returned.
+	SearchAllUsers bool `yaml:"search_all_users"`
+}
+
 const DefaultOpenIDTokenLifetimeMS = 3600000 // 60 minutes
 
 func (c *UserAPI) Defaults(generate bool) {
@@ -28,6 +47,7 @@ func (c *UserAPI) Defaults(generate bool) {
 	c.InternalAPI.Connect = "http://localhost:7781"
 	c.BCryptCost = bcrypt.DefaultCost
 	c.OpenIDTokenLifetimeMS = DefaultOpenIDTokenLifetimeMS
+	c.EmailNotificationDelay = time.Minute * 10
 	c.AccountDatabase.Defaults(10)
 	if generate {
 		c.AccountDatabase.ConnectionString = "file:userapi_accounts.db"
@@ -36,12 +56,14 @@ func (c *UserAPI) Defaults(generate bool) {
 
 func (c *UserAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	checkPositive(configErrs, "user_api.openid_token_lifetime_ms", c.OpenIDTokenLifetimeMS)
+	checkPositive(configErrs, "user_api.email_notification_delay", int64(c.EmailNotificationDelay))
 	if c.Matrix.DatabaseOptions.ConnectionString == "" {
 		checkNotEmpty(configErrs, "user_api.account_database.connection_string", string(c.AccountDatabase.ConnectionString))
 	}
 	if isMonolith { // polylith required configs below
 		return
 	}
-	checkURL(configErrs, "user_api.internal_api.listen", string(c.InternalAPI.Listen))
-	checkURL(configErrs, "user_api.internal_api.connect", string(c.InternalAPI.Connect))
+	checkHTTPAddress(configErrs, "user_api.internal_api.listen", c.InternalAPI.Listen)
+	checkHTTPAddress(configErrs, "user_api.internal_api.connect", c.InternalAPI.Connect)
+	checkInternalAPITransport(configErrs, "user_api.internal_api.transport", c.InternalAPI.Transport)
 }
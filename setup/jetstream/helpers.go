@@ -13,6 +13,34 @@ func JetStreamConsumer(
 	ctx context.Context, js nats.JetStreamContext, subj, durable string,
 	f func(ctx context.Context, msg *nats.Msg) bool,
 	opts ...nats.SubOpt,
+) error {
+	return JetStreamBatchConsumer(ctx, js, subj, durable, 1, func(ctx context.Context, msgs []*nats.Msg) {
+		msg := msgs[0]
+		ctx, span := StartSpan(ctx, msg, durable)
+		defer span.End()
+		if f(ctx, msg) {
+			if err := msg.AckSync(nats.Context(ctx)); err != nil {
+				logrus.WithContext(ctx).WithField("subject", subj).Warn(fmt.Errorf("msg.AckSync: %w", err))
+				sentry.CaptureException(err)
+			}
+		} else {
+			if err := msg.Nak(nats.Context(ctx)); err != nil {
+				logrus.WithContext(ctx).WithField("subject", subj).Warn(fmt.Errorf("msg.Nak: %w", err))
+				sentry.CaptureException(err)
+			}
+		}
+	}, opts...)
+}
+
+// JetStreamBatchConsumer starts a pull consumer which fetches up to batch
+// messages at a time. Unlike JetStreamConsumer, f is responsible for
+// acknowledging each of the messages it is given, which allows it to retry
+// some of them later using msg.NakWithDelay. It is also responsible for
+// starting a span for each message using StartSpan.
+func JetStreamBatchConsumer(
+	ctx context.Context, js nats.JetStreamContext, subj, durable string, batch int,
+	f func(ctx context.Context, msgs []*nats.Msg),
+	opts ...nats.SubOpt,
 ) error {
 	defer func() {
 		// If there are existing consumers from before they were pull
@@ -50,7 +78,7 @@ func JetStreamConsumer(
 			// enforce its own deadline (roughly 5 seconds by default). Therefore
 			// it is our responsibility to check whether our context expired or
 			// not when a context error is returned. Footguns. Footguns everywhere.
-			msgs, err := sub.Fetch(1, nats.Context(ctx))
+			msgs, err := sub.Fetch(batch, nats.Context(ctx))
 			if err != nil {
 				if err == context.Canceled || err == context.DeadlineExceeded {
 					// Work out whether it was the JetStream context that expired
@@ -74,23 +102,19 @@ func JetStreamConsumer(
 			if len(msgs) < 1 {
 				continue
 			}
-			msg := msgs[0]
-			if err = msg.InProgress(nats.Context(ctx)); err != nil {
-				logrus.WithContext(ctx).WithField("subject", subj).Warn(fmt.Errorf("msg.InProgress: %w", err))
-				sentry.CaptureException(err)
-				continue
-			}
-			if f(ctx, msg) {
-				if err = msg.AckSync(nats.Context(ctx)); err != nil {
-					logrus.WithContext(ctx).WithField("subject", subj).Warn(fmt.Errorf("msg.AckSync: %w", err))
-					sentry.CaptureException(err)
-				}
-			} else {
-				if err = msg.Nak(nats.Context(ctx)); err != nil {
-					logrus.WithContext(ctx).WithField("subject", subj).Warn(fmt.Errorf("msg.Nak: %w", err))
+			inProgress := msgs[:0]
+			for _, msg := range msgs {
+				if err = msg.InProgress(nats.Context(ctx)); err != nil {
+					logrus.WithContext(ctx).WithField("subject", subj).Warn(fmt.Errorf("msg.InProgress: %w", err))
 					sentry.CaptureException(err)
+					continue
 				}
+				inProgress = append(inProgress, msg)
+			}
+			if len(inProgress) < 1 {
+				continue
 			}
+			f(ctx, inProgress)
 		}
 	}()
 	return nil
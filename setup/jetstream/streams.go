@@ -28,6 +28,7 @@ var (
 	OutputReadUpdate        = "OutputReadUpdate"
 	RequestPresence         = "GetPresence"
 	OutputPresenceEvent     = "OutputPresenceEvent"
+	OutputPushNotification  = "OutputPushNotification"
 )
 
 var safeCharacters = regexp.MustCompile("[^A-Za-z0-9$]+")
@@ -103,4 +104,15 @@ var streams = []*nats.StreamConfig{
 		Storage:   nats.MemoryStorage,
 		MaxAge:    time.Minute * 5,
 	},
+	{
+		// Each pusher has its own subjects, and only the latest badge count
+		// update for a pusher is worth delivering. The push gateway consumer
+		// gives up on notifications after a day, so they are kept for longer
+		// than that, leaving room for the last backoff before it does.
+		Name:              OutputPushNotification,
+		Retention:         nats.InterestPolicy,
+		Storage:           nats.FileStorage,
+		MaxAge:            time.Hour * 48,
+		MaxMsgsPerSubject: 1,
+	},
 }
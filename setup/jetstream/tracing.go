@@ -0,0 +1,81 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jetstream
+
+import (
+	"context"
+
+	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/matrix-org/dendrite/setup/jetstream")
+
+// InjectSpan adds the span of the given context, if there is one, to the
+// headers of the message as a W3C traceparent, so that the consumers of the
+// message can continue the trace. It should be called just before the
+// message is published.
+func InjectSpan(ctx context.Context, msg *nats.Msg) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return
+	}
+	if msg.Header == nil {
+		msg.Header = nats.Header{}
+	}
+	otel.GetTextMapPropagator().Inject(ctx, headerCarrier(msg.Header))
+}
+
+// StartSpan starts a span for consuming the message. If the message was
+// published with InjectSpan then the span is a child of the span of the
+// producer. The caller must end the span.
+func StartSpan(ctx context.Context, msg *nats.Msg, operationName string) (context.Context, trace.Span) {
+	if msg.Header != nil {
+		ctx = otel.GetTextMapPropagator().Extract(ctx, headerCarrier(msg.Header))
+	}
+	return tracer.Start(
+		ctx, operationName,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			semconv.MessagingSystemKey.String("nats"),
+			semconv.MessagingDestinationKey.String(msg.Subject),
+		),
+	)
+}
+
+// headerCarrier allows the trace context to be read from and written to NATS
+// message headers. Unlike propagation.HeaderCarrier the keys are used as they
+// are, since NATS headers are case-sensitive.
+type headerCarrier nats.Header
+
+func (c headerCarrier) Get(key string) string {
+	if vals := c[key]; len(vals) > 0 {
+		return vals[0]
+	}
+	return ""
+}
+
+func (c headerCarrier) Set(key, val string) {
+	c[key] = []string{val}
+}
+
+func (c headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
@@ -0,0 +1,74 @@
+package jetstream
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestSpanPropagation(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer func() {
+		otel.SetTracerProvider(trace.NewNoopTracerProvider())
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	}()
+
+	ctx, producer := provider.Tracer("test").Start(context.Background(), "producer")
+	msg := &nats.Msg{Subject: "subject"}
+	InjectSpan(ctx, msg)
+	producer.End()
+	if msg.Header.Get("traceparent") == "" {
+		t.Fatalf("expected the traceparent to be added to the message headers")
+	}
+
+	ctx, span := StartSpan(context.Background(), msg, "consumer")
+	if trace.SpanFromContext(ctx) != span {
+		t.Fatalf("expected the context to have the consumer span")
+	}
+	span.End()
+
+	consumer := span.(sdktrace.ReadOnlySpan)
+	if consumer.SpanContext().TraceID() != producer.SpanContext().TraceID() {
+		t.Fatalf("expected the consumer span to be part of the trace of the producer")
+	}
+	if consumer.Parent().SpanID() != producer.SpanContext().SpanID() {
+		t.Fatalf("expected the consumer span to be a child of the producer span")
+	}
+	if consumer.SpanKind() != trace.SpanKindConsumer {
+		t.Fatalf("expected the consumer span to be of the consumer kind")
+	}
+	found := false
+	for _, attr := range consumer.Attributes() {
+		if attr.Key == "messaging.destination" && attr.Value.AsString() == "subject" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected the consumer span to have the subject as an attribute")
+	}
+
+	// Messages published without a span don't get any headers, and start a
+	// trace of their own.
+	msg = &nats.Msg{Subject: "subject"}
+	InjectSpan(context.Background(), msg)
+	if msg.Header != nil {
+		t.Fatalf("expected no headers to be added to the message")
+	}
+	_, span = StartSpan(context.Background(), msg, "consumer")
+	span.End()
+	if span.(sdktrace.ReadOnlySpan).Parent().IsValid() {
+		t.Fatalf("expected the consumer span to have no parent")
+	}
+	if len(recorder.Ended()) != 3 {
+		t.Fatalf("expected 3 spans to be recorded, got %d", len(recorder.Ended()))
+	}
+}
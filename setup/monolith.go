@@ -52,13 +52,9 @@ type Monolith struct {
 
 // AddAllPublicRoutes attaches all public paths to the given router
 func (m *Monolith) AddAllPublicRoutes(base *base.BaseDendrite) {
-	userDirectoryProvider := m.ExtUserDirectoryProvider
-	if userDirectoryProvider == nil {
-		userDirectoryProvider = m.UserAPI
-	}
 	clientapi.AddPublicRoutes(
 		base, m.FedClient, m.RoomserverAPI, m.AppserviceAPI, transactions.New(),
-		m.FederationAPI, m.UserAPI, userDirectoryProvider, m.KeyAPI,
+		m.FederationAPI, m.UserAPI, m.ExtUserDirectoryProvider, m.KeyAPI,
 		m.ExtPublicRoomsProvider,
 	)
 	federationapi.AddPublicRoutes(
@@ -9,6 +9,7 @@ import (
 	"encoding/json"
 	"io"
 	"net/http"
+	"path/filepath"
 	"sort"
 	"strings"
 	"testing"
@@ -549,7 +550,7 @@ func injectEvents(t *testing.T, userAPI userapi.UserInternalAPI, rsAPI roomserve
 	cfg := &config.Dendrite{}
 	cfg.Defaults(true)
 	cfg.Global.ServerName = "localhost"
-	cfg.MSCs.Database.ConnectionString = "file:msc2836_test.db"
+	cfg.MSCs.Database.ConnectionString = config.DataSource("file:" + filepath.Join(t.TempDir(), "msc2836_test.db"))
 	cfg.MSCs.MSCs = []string{"msc2836"}
 	base := &base.BaseDendrite{
 		Cfg:                    cfg,
@@ -160,7 +160,7 @@ func (s *OutputClientDataConsumer) sendReadUpdate(ctx context.Context, userID st
 		}
 	}
 	if readPos > 0 || fullyReadPos > 0 {
-		if err := s.producer.SendReadUpdate(userID, output.RoomID, readPos, fullyReadPos); err != nil {
+		if err := s.producer.SendReadUpdate(ctx, userID, output.RoomID, "", readPos, fullyReadPos); err != nil {
 			return fmt.Errorf("s.producer.SendReadUpdate: %w", err)
 		}
 	}
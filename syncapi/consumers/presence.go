@@ -76,8 +76,10 @@ func NewPresenceConsumer(
 func (s *PresenceConsumer) Start() error {
 	// Normal NATS subscription, used by Request/Reply
 	_, err := s.nats.Subscribe(s.requestTopic, func(msg *nats.Msg) {
+		ctx, span := jetstream.StartSpan(s.ctx, msg, "GetPresence")
+		defer span.End()
 		userID := msg.Header.Get(jetstream.UserID)
-		presence, err := s.db.GetPresence(context.Background(), userID)
+		presence, err := s.db.GetPresence(ctx, userID)
 		m := &nats.Msg{
 			Header: nats.Header{},
 		}
@@ -94,8 +96,14 @@ func (s *PresenceConsumer) Start() error {
 			}
 		}
 
+		// Syncing doesn't count as activity for users who are idle or offline.
+		if presence.Presence == types.PresenceUnavailable || presence.Presence == types.PresenceOffline {
+			s.respondPresence(msg, m, presence)
+			return
+		}
+
 		deviceRes := api.QueryDevicesResponse{}
-		if err = s.deviceAPI.QueryDevices(s.ctx, &api.QueryDevicesRequest{UserID: userID}, &deviceRes); err != nil {
+		if err = s.deviceAPI.QueryDevices(ctx, &api.QueryDevicesRequest{UserID: userID}, &deviceRes); err != nil {
 			m.Header.Set("error", err.Error())
 			if err = msg.RespondMsg(m); err != nil {
 				logrus.WithError(err).Error("Unable to respond to messages")
@@ -109,17 +117,7 @@ func (s *PresenceConsumer) Start() error {
 			}
 		}
 
-		m.Header.Set(jetstream.UserID, presence.UserID)
-		m.Header.Set("presence", presence.ClientFields.Presence)
-		if presence.ClientFields.StatusMsg != nil {
-			m.Header.Set("status_msg", *presence.ClientFields.StatusMsg)
-		}
-		m.Header.Set("last_active_ts", strconv.Itoa(int(presence.LastActiveTS)))
-
-		if err = msg.RespondMsg(m); err != nil {
-			logrus.WithError(err).Error("Unable to respond to messages")
-			return
-		}
+		s.respondPresence(msg, m, presence)
 	})
 	if err != nil {
 		return err
@@ -133,6 +131,19 @@ func (s *PresenceConsumer) Start() error {
 	)
 }
 
+func (s *PresenceConsumer) respondPresence(msg, m *nats.Msg, presence *types.PresenceInternal) {
+	m.Header.Set(jetstream.UserID, presence.UserID)
+	m.Header.Set("presence", presence.ClientFields.Presence)
+	if presence.ClientFields.StatusMsg != nil {
+		m.Header.Set("status_msg", *presence.ClientFields.StatusMsg)
+	}
+	m.Header.Set("last_active_ts", strconv.Itoa(int(presence.LastActiveTS)))
+
+	if err := msg.RespondMsg(m); err != nil {
+		logrus.WithError(err).Error("Unable to respond to messages")
+	}
+}
+
 func (s *PresenceConsumer) onMessage(ctx context.Context, msg *nats.Msg) bool {
 	userID := msg.Header.Get(jetstream.UserID)
 	presence := msg.Header.Get("presence")
@@ -81,10 +81,11 @@ func (s *OutputReceiptEventConsumer) Start() error {
 
 func (s *OutputReceiptEventConsumer) onMessage(ctx context.Context, msg *nats.Msg) bool {
 	output := types.OutputReceiptEvent{
-		UserID:  msg.Header.Get(jetstream.UserID),
-		RoomID:  msg.Header.Get(jetstream.RoomID),
-		EventID: msg.Header.Get(jetstream.EventID),
-		Type:    msg.Header.Get("type"),
+		UserID:   msg.Header.Get(jetstream.UserID),
+		RoomID:   msg.Header.Get(jetstream.RoomID),
+		EventID:  msg.Header.Get(jetstream.EventID),
+		Type:     msg.Header.Get("type"),
+		ThreadID: msg.Header.Get("thread_id"),
 	}
 
 	timestamp, err := strconv.ParseUint(msg.Header.Get("timestamp"), 10, 64)
@@ -103,6 +104,7 @@ func (s *OutputReceiptEventConsumer) onMessage(ctx context.Context, msg *nats.Ms
 		output.Type,
 		output.UserID,
 		output.EventID,
+		output.ThreadID,
 		output.Timestamp,
 	)
 	if err != nil {
@@ -126,7 +128,8 @@ func (s *OutputReceiptEventConsumer) onMessage(ctx context.Context, msg *nats.Ms
 }
 
 func (s *OutputReceiptEventConsumer) sendReadUpdate(ctx context.Context, output types.OutputReceiptEvent) error {
-	if output.Type != "m.read" {
+	// Both public and private read receipts mark notifications as read.
+	if output.Type != "m.read" && output.Type != "m.read.private" {
 		return nil
 	}
 	_, serverName, err := gomatrixserverlib.SplitID('@', output.UserID)
@@ -143,7 +146,7 @@ func (s *OutputReceiptEventConsumer) sendReadUpdate(ctx context.Context, output
 		}
 	}
 	if readPos > 0 {
-		if err := s.producer.SendReadUpdate(output.UserID, output.RoomID, readPos, 0); err != nil {
+		if err := s.producer.SendReadUpdate(ctx, output.UserID, output.RoomID, output.ThreadID, readPos, 0); err != nil {
 			return fmt.Errorf("s.producer.SendReadUpdate: %w", err)
 		}
 	}
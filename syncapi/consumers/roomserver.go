@@ -254,7 +254,7 @@ func (s *OutputRoomEventConsumer) onNewRoomEvent(
 		return nil
 	}
 
-	if err = s.producer.SendStreamEvent(ev.RoomID(), ev, pduPos); err != nil {
+	if err = s.producer.SendStreamEvent(ctx, ev.RoomID(), ev, pduPos); err != nil {
 		log.WithError(err).Errorf("Failed to send stream output event for event %s", ev.EventID())
 		sentry.CaptureException(err)
 		return err
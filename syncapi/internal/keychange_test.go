@@ -58,6 +58,9 @@ func (k *mockKeyAPI) QueryDeviceMessages(ctx context.Context, req *keyapi.QueryD
 func (k *mockKeyAPI) QuerySignatures(ctx context.Context, req *keyapi.QuerySignaturesRequest, res *keyapi.QuerySignaturesResponse) error {
 	return nil
 }
+func (k *mockKeyAPI) PerformRemoveDehydratedDevice(ctx context.Context, req *keyapi.PerformRemoveDehydratedDeviceRequest, res *keyapi.PerformRemoveDehydratedDeviceResponse) error {
+	return nil
+}
 
 type mockRoomserverAPI struct {
 	api.RoomserverInternalAPITrace
@@ -355,6 +355,19 @@ func (n *Notifier) CurrentPosition() types.StreamingToken {
 	return n.currPos
 }
 
+// DevicePosition returns the last sync position at which there may have been
+// an update for the device. It only changes when the device is woken up, so it
+// can be used to tell whether anything may have happened for the device since.
+func (n *Notifier) DevicePosition(userID, deviceID string) types.StreamingToken {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	stream := n._fetchUserDeviceStream(userID, deviceID, true)
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+	return stream.pos
+}
+
 // setUsersJoinedToRooms marks the given users as 'joined' to the given rooms, such that new events from
 // these rooms will wake the given users /sync requests. This should be called prior to ANY calls to
 // OnNewEvent (eg on startup) to prevent racing.
@@ -15,8 +15,8 @@
 package producers
 
 import (
+	"context"
 	"strconv"
-	"time"
 
 	"github.com/matrix-org/dendrite/setup/jetstream"
 	"github.com/matrix-org/dendrite/syncapi/types"
@@ -31,18 +31,19 @@ type FederationAPIPresenceProducer struct {
 }
 
 func (f *FederationAPIPresenceProducer) SendPresence(
-	userID string, presence types.Presence, statusMsg *string,
+	ctx context.Context, userID string, presence types.Presence, statusMsg *string, lastActiveTS gomatrixserverlib.Timestamp,
 ) error {
 	msg := nats.NewMsg(f.Topic)
 	msg.Header.Set(jetstream.UserID, userID)
 	msg.Header.Set("presence", presence.String())
 	msg.Header.Set("from_sync", "true") // only update last_active_ts and presence
-	msg.Header.Set("last_active_ts", strconv.Itoa(int(gomatrixserverlib.AsTimestamp(time.Now()))))
+	msg.Header.Set("last_active_ts", strconv.Itoa(int(lastActiveTS)))
 
 	if statusMsg != nil {
 		msg.Header.Set("status_msg", *statusMsg)
 	}
 
+	jetstream.InjectSpan(ctx, msg)
 	_, err := f.JetStream.PublishMsg(msg)
 	return err
 }
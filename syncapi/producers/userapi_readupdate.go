@@ -15,6 +15,7 @@
 package producers
 
 import (
+	"context"
 	"encoding/json"
 
 	"github.com/matrix-org/dendrite/setup/jetstream"
@@ -30,7 +31,9 @@ type UserAPIReadProducer struct {
 }
 
 // SendData sends account data to the user API server
-func (p *UserAPIReadProducer) SendReadUpdate(userID, roomID string, readPos, fullyReadPos types.StreamPosition) error {
+// SendReadUpdate sends the position of a read receipt or fully read marker
+// to the user API server. The thread ID is only set for threaded read receipts.
+func (p *UserAPIReadProducer) SendReadUpdate(ctx context.Context, userID, roomID, threadID string, readPos, fullyReadPos types.StreamPosition) error {
 	m := &nats.Msg{
 		Subject: p.Topic,
 		Header:  nats.Header{},
@@ -43,6 +46,7 @@ func (p *UserAPIReadProducer) SendReadUpdate(userID, roomID string, readPos, ful
 		RoomID:    roomID,
 		Read:      readPos,
 		FullyRead: fullyReadPos,
+		ThreadID:  threadID,
 	}
 	var err error
 	m.Data, err = json.Marshal(data)
@@ -55,8 +59,10 @@ func (p *UserAPIReadProducer) SendReadUpdate(userID, roomID string, readPos, ful
 		"room_id":        roomID,
 		"read_pos":       readPos,
 		"fully_read_pos": fullyReadPos,
+		"thread_id":      threadID,
 	}).Tracef("Producing to topic '%s'", p.Topic)
 
+	jetstream.InjectSpan(ctx, m)
 	_, err = p.JetStream.PublishMsg(m)
 	return err
 }
@@ -15,6 +15,7 @@
 package producers
 
 import (
+	"context"
 	"encoding/json"
 
 	"github.com/matrix-org/dendrite/setup/jetstream"
@@ -31,7 +32,7 @@ type UserAPIStreamEventProducer struct {
 }
 
 // SendData sends account data to the user API server
-func (p *UserAPIStreamEventProducer) SendStreamEvent(roomID string, event *gomatrixserverlib.HeaderedEvent, pos types.StreamPosition) error {
+func (p *UserAPIStreamEventProducer) SendStreamEvent(ctx context.Context, roomID string, event *gomatrixserverlib.HeaderedEvent, pos types.StreamPosition) error {
 	m := &nats.Msg{
 		Subject: p.Topic,
 		Header:  nats.Header{},
@@ -55,6 +56,7 @@ func (p *UserAPIStreamEventProducer) SendStreamEvent(roomID string, event *gomat
 		"stream_pos": pos,
 	}).Tracef("Producing to topic '%s'", p.Topic)
 
+	jetstream.InjectSpan(ctx, m)
 	_, err = p.JetStream.PublishMsg(m)
 	return err
 }
@@ -40,14 +40,26 @@ func Setup(
 	rsAPI api.SyncRoomserverAPI,
 	cfg *config.SyncAPI,
 	lazyLoadCache caching.LazyLoadCache,
+	mscCfg *config.MSCs,
 ) {
 	v3mux := csMux.PathPrefix("/{apiversion:(?:r0|v3)}/").Subrouter()
+	unstableMux := csMux.PathPrefix("/unstable").Subrouter()
 
 	// TODO: Add AS support for all handlers below.
 	v3mux.Handle("/sync", httputil.MakeAuthAPI("sync", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 		return srp.OnIncomingSyncRequest(req, device)
 	})).Methods(http.MethodGet, http.MethodOptions)
 
+	unstableMux.Handle("/org.matrix.msc3575/sync", httputil.MakeAuthAPI("sliding_sync", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		return srp.OnIncomingSlidingSyncRequest(req, device)
+	})).Methods(http.MethodPost, http.MethodOptions)
+
+	if mscCfg.Enabled("msc3814") {
+		unstableMux.Handle("/org.matrix.msc3814.v1/dehydrated_device/claim", httputil.MakeAuthAPI("claim_dehydrated_device", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return srp.OnIncomingClaimDehydratedDeviceRequest(req, device)
+		})).Methods(http.MethodPost, http.MethodOptions)
+	}
+
 	v3mux.Handle("/rooms/{roomID}/messages", httputil.MakeAuthAPI("room_messages", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 		vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 		if err != nil {
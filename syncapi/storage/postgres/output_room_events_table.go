@@ -125,6 +125,15 @@ const selectEarlyEventsSQL = "" +
 	" AND ( $7::text[] IS NULL OR NOT(type LIKE ANY($7)) )" +
 	" ORDER BY id ASC LIMIT $8"
 
+// The most recent event in each of the rooms which isn't excluded from sync.
+const selectLatestEventsSQL = "" +
+	"SELECT event_id, id, headered_event_json, session_id, exclude_from_sync, transaction_id, history_visibility FROM syncapi_output_room_events" +
+	" WHERE id IN (" +
+	"  SELECT MAX(id) FROM syncapi_output_room_events" +
+	"  WHERE room_id = ANY($1) AND id <= $2 AND exclude_from_sync = FALSE" +
+	"  GROUP BY room_id" +
+	" )"
+
 const selectMaxEventIDSQL = "" +
 	"SELECT MAX(id) FROM syncapi_output_room_events"
 
@@ -172,6 +181,7 @@ type outputRoomEventsStatements struct {
 	selectEventsStmt              *sql.Stmt
 	selectEventsWitFilterStmt     *sql.Stmt
 	selectMaxEventIDStmt          *sql.Stmt
+	selectLatestEventsStmt        *sql.Stmt
 	selectRecentEventsStmt        *sql.Stmt
 	selectRecentEventsForSyncStmt *sql.Stmt
 	selectEarlyEventsStmt         *sql.Stmt
@@ -207,6 +217,7 @@ func NewPostgresEventsTable(db *sql.DB) (tables.Events, error) {
 		{&s.selectEventsStmt, selectEventsSQL},
 		{&s.selectEventsWitFilterStmt, selectEventsWithFilterSQL},
 		{&s.selectMaxEventIDStmt, selectMaxEventIDSQL},
+		{&s.selectLatestEventsStmt, selectLatestEventsSQL},
 		{&s.selectRecentEventsStmt, selectRecentEventsSQL},
 		{&s.selectRecentEventsForSyncStmt, selectRecentEventsForSyncSQL},
 		{&s.selectEarlyEventsStmt, selectEarlyEventsSQL},
@@ -512,6 +523,27 @@ func (s *outputRoomEventsStatements) SelectEvents(
 	return streamEvents, nil
 }
 
+// SelectLatestEvents returns the most recent event in each of the given rooms,
+// keyed by room ID. Rooms without any events are omitted.
+func (s *outputRoomEventsStatements) SelectLatestEvents(
+	ctx context.Context, txn *sql.Tx, roomIDs []string, to types.StreamPosition,
+) (map[string]types.StreamEvent, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectLatestEventsStmt).QueryContext(ctx, pq.StringArray(roomIDs), to)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectLatestEvents: rows.close() failed")
+	streamEvents, err := rowsToStreamEvents(rows)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]types.StreamEvent, len(streamEvents))
+	for _, ev := range streamEvents {
+		result[ev.RoomID()] = ev
+	}
+	return result, nil
+}
+
 func (s *outputRoomEventsStatements) DeleteEventsForRoom(
 	ctx context.Context, txn *sql.Tx, roomID string,
 ) (err error) {
@@ -22,6 +22,7 @@ import (
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/lib/pq"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
@@ -67,19 +68,27 @@ const selectPresenceForUserSQL = "" +
 	" FROM syncapi_presence" +
 	" WHERE user_id = $1 LIMIT 1"
 
+const selectPresenceForUsersSQL = "" +
+	"SELECT user_id, presence, status_msg, last_active_ts" +
+	" FROM syncapi_presence" +
+	" WHERE user_id = ANY($1)"
+
 const selectMaxPresenceSQL = "" +
 	"SELECT COALESCE(MAX(id), 0) FROM syncapi_presence"
 
+// Initial syncs only get the presence of recently active users, whereas
+// incremental syncs also get users who went unavailable or offline.
 const selectPresenceAfter = "" +
 	" SELECT id, user_id, presence, status_msg, last_active_ts" +
 	" FROM syncapi_presence" +
-	" WHERE id > $1 AND last_active_ts >= $2" +
+	" WHERE id > $1 AND ($1 > 0 OR last_active_ts >= $2)" +
 	" ORDER BY id ASC LIMIT $3"
 
 type presenceStatements struct {
 	upsertPresenceStmt         *sql.Stmt
 	upsertPresenceFromSyncStmt *sql.Stmt
 	selectPresenceForUsersStmt *sql.Stmt
+	selectPresencesStmt        *sql.Stmt
 	selectMaxPresenceStmt      *sql.Stmt
 	selectPresenceAfterStmt    *sql.Stmt
 }
@@ -94,6 +103,7 @@ func NewPostgresPresenceTable(db *sql.DB) (*presenceStatements, error) {
 		{&s.upsertPresenceStmt, upsertPresenceSQL},
 		{&s.upsertPresenceFromSyncStmt, upsertPresenceFromSyncSQL},
 		{&s.selectPresenceForUsersStmt, selectPresenceForUserSQL},
+		{&s.selectPresencesStmt, selectPresenceForUsersSQL},
 		{&s.selectMaxPresenceStmt, selectMaxPresenceSQL},
 		{&s.selectPresenceAfterStmt, selectPresenceAfter},
 	}.Prepare(db)
@@ -136,6 +146,29 @@ func (p *presenceStatements) GetPresenceForUser(
 	return result, err
 }
 
+// GetPresenceForUsers returns the current presence of the users, keyed by user
+// ID. Users without a presence are omitted.
+func (p *presenceStatements) GetPresenceForUsers(
+	ctx context.Context, txn *sql.Tx,
+	userIDs []string,
+) (map[string]*types.PresenceInternal, error) {
+	rows, err := sqlutil.TxStmt(txn, p.selectPresencesStmt).QueryContext(ctx, pq.StringArray(userIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "GetPresenceForUsers: failed to close rows")
+	presences := make(map[string]*types.PresenceInternal, len(userIDs))
+	for rows.Next() {
+		qryRes := &types.PresenceInternal{}
+		if err = rows.Scan(&qryRes.UserID, &qryRes.Presence, &qryRes.ClientFields.StatusMsg, &qryRes.LastActiveTS); err != nil {
+			return nil, err
+		}
+		qryRes.ClientFields.Presence = qryRes.Presence.String()
+		presences[qryRes.UserID] = qryRes
+	}
+	return presences, rows.Err()
+}
+
 func (p *presenceStatements) GetMaxPresenceID(ctx context.Context, txn *sql.Tx) (pos types.StreamPosition, err error) {
 	stmt := sqlutil.TxStmt(txn, p.selectMaxPresenceStmt)
 	err = stmt.QueryRowContext(ctx).Scan(&pos)
@@ -132,6 +132,10 @@ func (d *Database) RecentEvents(ctx context.Context, roomID string, r types.Rang
 	return d.OutputEvents.SelectRecentEvents(ctx, nil, roomID, r, eventFilter, chronologicalOrder, onlySyncEvents)
 }
 
+func (d *Database) LatestEvents(ctx context.Context, roomIDs []string, to types.StreamPosition) (map[string]types.StreamEvent, error) {
+	return d.OutputEvents.SelectLatestEvents(ctx, nil, roomIDs, to)
+}
+
 func (d *Database) PositionInTopology(ctx context.Context, eventID string) (pos types.StreamPosition, spos types.StreamPosition, err error) {
 	return d.Topology.SelectPositionInTopology(ctx, nil, eventID)
 }
@@ -525,13 +529,13 @@ func (d *Database) StreamToTopologicalPosition(
 }
 
 func (d *Database) GetFilter(
-	ctx context.Context, target *gomatrixserverlib.Filter, localpart string, filterID string,
+	ctx context.Context, target *types.Filter, localpart string, filterID string,
 ) error {
 	return d.Filter.SelectFilter(ctx, target, localpart, filterID)
 }
 
 func (d *Database) PutFilter(
-	ctx context.Context, localpart string, filter *gomatrixserverlib.Filter,
+	ctx context.Context, localpart string, filter *types.Filter,
 ) (string, error) {
 	var filterID string
 	var err error
@@ -971,6 +975,34 @@ func (d *Database) StoreNewSendForDeviceMessage(
 	return newPos, nil
 }
 
+func (d *Database) MoveSendToDeviceMessages(
+	ctx context.Context, userID, fromDeviceID, toDeviceID string,
+) (newPos types.StreamPosition, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		maxID, err := d.SendToDevice.SelectMaxSendToDeviceMessageID(ctx, txn)
+		if err != nil {
+			return fmt.Errorf("d.SendToDevice.SelectMaxSendToDeviceMessageID: %w", err)
+		}
+		_, events, err := d.SendToDevice.SelectSendToDeviceMessages(ctx, txn, userID, fromDeviceID, 0, types.StreamPosition(maxID))
+		if err != nil {
+			return fmt.Errorf("d.SendToDevice.SelectSendToDeviceMessages: %w", err)
+		}
+		// The messages get new stream positions, so that they are sent to the
+		// device even if it has synced past the original ones.
+		for _, event := range events {
+			j, err := json.Marshal(event.SendToDeviceEvent)
+			if err != nil {
+				return err
+			}
+			if newPos, err = d.SendToDevice.InsertSendToDeviceMessage(ctx, txn, userID, toDeviceID, string(j)); err != nil {
+				return fmt.Errorf("d.SendToDevice.InsertSendToDeviceMessage: %w", err)
+			}
+		}
+		return d.SendToDevice.DeleteSendToDeviceMessages(ctx, txn, userID, fromDeviceID, types.StreamPosition(maxID))
+	})
+	return
+}
+
 func (d *Database) SendToDeviceUpdatesForSync(
 	ctx context.Context,
 	userID, deviceID string,
@@ -1015,9 +1047,9 @@ func getMembershipFromEvent(ev *gomatrixserverlib.Event, userID string) string {
 }
 
 // StoreReceipt stores user receipts
-func (d *Database) StoreReceipt(ctx context.Context, roomId, receiptType, userId, eventId string, timestamp gomatrixserverlib.Timestamp) (pos types.StreamPosition, err error) {
+func (d *Database) StoreReceipt(ctx context.Context, roomId, receiptType, userId, eventId, threadId string, timestamp gomatrixserverlib.Timestamp) (pos types.StreamPosition, err error) {
 	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
-		pos, err = d.Receipts.UpsertReceipt(ctx, txn, roomId, receiptType, userId, eventId, timestamp)
+		pos, err = d.Receipts.UpsertReceipt(ctx, txn, roomId, receiptType, userId, eventId, threadId, timestamp)
 		return err
 	})
 	return
@@ -1028,9 +1060,9 @@ func (d *Database) GetRoomReceipts(ctx context.Context, roomIDs []string, stream
 	return receipts, err
 }
 
-func (d *Database) UpsertRoomUnreadNotificationCounts(ctx context.Context, userID, roomID string, notificationCount, highlightCount int) (pos types.StreamPosition, err error) {
+func (d *Database) UpsertRoomUnreadNotificationCounts(ctx context.Context, userID string, data *eventutil.NotificationData) (pos types.StreamPosition, err error) {
 	err = d.Writer.Do(nil, nil, func(_ *sql.Tx) error {
-		pos, err = d.NotificationData.UpsertRoomUnreadCounts(ctx, userID, roomID, notificationCount, highlightCount)
+		pos, err = d.NotificationData.UpsertRoomUnreadCounts(ctx, userID, data)
 		return err
 	})
 	return
@@ -1067,6 +1099,10 @@ func (d *Database) GetPresence(ctx context.Context, userID string) (*types.Prese
 	return d.Presence.GetPresenceForUser(ctx, nil, userID)
 }
 
+func (d *Database) GetPresences(ctx context.Context, userIDs []string) (map[string]*types.PresenceInternal, error) {
+	return d.Presence.GetPresenceForUsers(ctx, nil, userIDs)
+}
+
 func (d *Database) PresenceAfter(ctx context.Context, after types.StreamPosition, filter gomatrixserverlib.EventFilter) (map[string]*types.PresenceInternal, error) {
 	return d.Presence.GetPresenceAfter(ctx, nil, after, filter)
 }
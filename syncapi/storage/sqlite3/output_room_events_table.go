@@ -85,6 +85,15 @@ const selectEarlyEventsSQL = "" +
 
 // WHEN, ORDER BY and LIMIT are appended by prepareWithFilters
 
+// The most recent event in each of the rooms which isn't excluded from sync.
+const selectLatestEventsSQL = "" +
+	"SELECT event_id, id, headered_event_json, session_id, exclude_from_sync, transaction_id, history_visibility FROM syncapi_output_room_events" +
+	" WHERE id IN (" +
+	"  SELECT MAX(id) FROM syncapi_output_room_events" +
+	"  WHERE id <= $1 AND exclude_from_sync = FALSE AND room_id IN ($2)" +
+	"  GROUP BY room_id" +
+	" )"
+
 const selectMaxEventIDSQL = "" +
 	"SELECT MAX(id) FROM syncapi_output_room_events"
 
@@ -488,6 +497,48 @@ func (s *outputRoomEventsStatements) SelectEvents(
 	return streamEvents, nil
 }
 
+// SelectLatestEvents returns the most recent event in each of the given rooms,
+// keyed by room ID. Rooms without any events are omitted.
+func (s *outputRoomEventsStatements) SelectLatestEvents(
+	ctx context.Context, txn *sql.Tx, roomIDs []string, to types.StreamPosition,
+) (map[string]types.StreamEvent, error) {
+	result := make(map[string]types.StreamEvent, len(roomIDs))
+	for len(roomIDs) > 0 {
+		// Leave room for the stream position parameter.
+		n := len(roomIDs)
+		if n > sqlutil.SQLite3MaxVariables-1 {
+			n = sqlutil.SQLite3MaxVariables - 1
+		}
+		params := make([]interface{}, n+1)
+		params[0] = to
+		for i, roomID := range roomIDs[:n] {
+			params[i+1] = roomID
+		}
+		roomIDs = roomIDs[n:]
+
+		query := strings.Replace(selectLatestEventsSQL, "($2)", sqlutil.QueryVariadicOffset(n, 1), 1)
+		var rows *sql.Rows
+		var err error
+		if txn != nil {
+			rows, err = txn.QueryContext(ctx, query, params...)
+		} else {
+			rows, err = s.db.QueryContext(ctx, query, params...)
+		}
+		if err != nil {
+			return nil, err
+		}
+		streamEvents, err := rowsToStreamEvents(rows)
+		internal.CloseAndLogIfError(ctx, rows, "selectLatestEvents: rows.close() failed")
+		if err != nil {
+			return nil, err
+		}
+		for _, ev := range streamEvents {
+			result[ev.RoomID()] = ev
+		}
+	}
+	return result, nil
+}
+
 func (s *outputRoomEventsStatements) DeleteEventsForRoom(
 	ctx context.Context, txn *sql.Tx, roomID string,
 ) (err error) {
@@ -66,13 +66,20 @@ const selectPresenceForUserSQL = "" +
 	" FROM syncapi_presence" +
 	" WHERE user_id = $1 LIMIT 1"
 
+const selectPresenceForUsersSQL = "" +
+	"SELECT user_id, presence, status_msg, last_active_ts" +
+	" FROM syncapi_presence" +
+	" WHERE user_id IN ($1)"
+
 const selectMaxPresenceSQL = "" +
 	"SELECT COALESCE(MAX(id), 0) FROM syncapi_presence"
 
+// Initial syncs only get the presence of recently active users, whereas
+// incremental syncs also get users who went unavailable or offline.
 const selectPresenceAfter = "" +
 	" SELECT id, user_id, presence, status_msg, last_active_ts" +
 	" FROM syncapi_presence" +
-	" WHERE id > $1 AND last_active_ts >= $2" +
+	" WHERE id > $1 AND ($1 > 0 OR last_active_ts >= $2)" +
 	" ORDER BY id ASC LIMIT $3"
 
 type presenceStatements struct {
@@ -151,6 +158,34 @@ func (p *presenceStatements) GetPresenceForUser(
 	return result, err
 }
 
+// GetPresenceForUsers returns the current presence of the users, keyed by user
+// ID. Users without a presence are omitted.
+func (p *presenceStatements) GetPresenceForUsers(
+	ctx context.Context, txn *sql.Tx,
+	userIDs []string,
+) (map[string]*types.PresenceInternal, error) {
+	params := make([]interface{}, len(userIDs))
+	for i, userID := range userIDs {
+		params[i] = userID
+	}
+	presences := make(map[string]*types.PresenceInternal, len(userIDs))
+	err := sqlutil.RunLimitedVariablesQuery(
+		ctx, selectPresenceForUsersSQL, p.db, params, sqlutil.SQLite3MaxVariables,
+		func(rows *sql.Rows) error {
+			for rows.Next() {
+				qryRes := &types.PresenceInternal{}
+				if err := rows.Scan(&qryRes.UserID, &qryRes.Presence, &qryRes.ClientFields.StatusMsg, &qryRes.LastActiveTS); err != nil {
+					return err
+				}
+				qryRes.ClientFields.Presence = qryRes.Presence.String()
+				presences[qryRes.UserID] = qryRes
+			}
+			return rows.Err()
+		},
+	)
+	return presences, err
+}
+
 func (p *presenceStatements) GetMaxPresenceID(ctx context.Context, txn *sql.Tx) (pos types.StreamPosition, err error) {
 	stmt := sqlutil.TxStmt(txn, p.selectMaxPresenceStmt)
 	err = stmt.QueryRowContext(ctx).Scan(&pos)
@@ -7,7 +7,9 @@ import (
 	"fmt"
 	"reflect"
 	"testing"
+	"time"
 
+	"github.com/matrix-org/dendrite/internal/eventutil"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/types"
@@ -507,6 +509,137 @@ func TestSendToDeviceBehaviour(t *testing.T) {
 	})
 }
 
+func TestMoveSendToDeviceMessages(t *testing.T) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close, closeBase := MustCreateDatabase(t, dbType)
+		defer close()
+		defer closeBase()
+
+		// nothing to move
+		pos, err := db.MoveSendToDeviceMessages(ctx, alice.ID, "dehydrated", "new")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pos != 0 {
+			t.Fatalf("expected no stream position, got %d", pos)
+		}
+
+		var lastPos types.StreamPosition
+		for i := 0; i < 3; i++ {
+			lastPos, err = db.StoreNewSendForDeviceMessage(ctx, alice.ID, "dehydrated", gomatrixserverlib.SendToDeviceEvent{
+				Sender:  bob.ID,
+				Type:    "m.type",
+				Content: json.RawMessage(fmt.Sprintf(`{"count":%d}`, i)),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// the new device has already synced past the messages, but still gets them
+		pos, err = db.MoveSendToDeviceMessages(ctx, alice.ID, "dehydrated", "new")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pos <= lastPos {
+			t.Fatalf("expected a stream position after %d, got %d", lastPos, pos)
+		}
+		_, events, err := db.SendToDeviceUpdatesForSync(ctx, alice.ID, "new", lastPos, pos)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 3 {
+			t.Fatalf("expected 3 messages for the new device, got %d", len(events))
+		}
+		for i, event := range events {
+			want := json.RawMessage(fmt.Sprintf(`{"count":%d}`, i))
+			if !bytes.Equal(event.Content, want) || event.Sender != bob.ID {
+				t.Fatalf("unexpected message\nwant: %s\ngot: %s", string(want), string(event.Content))
+			}
+		}
+		_, events, err = db.SendToDeviceUpdatesForSync(ctx, alice.ID, "dehydrated", 0, pos)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 0 {
+			t.Fatalf("expected no messages for the dehydrated device, got %d", len(events))
+		}
+	})
+}
+
+func TestThreadedReceipts(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		alice := test.NewUser(t)
+		room := test.NewRoom(t, alice)
+		db, close, closeBase := MustCreateDatabase(t, dbType)
+		defer close()
+		defer closeBase()
+
+		ts := gomatrixserverlib.AsTimestamp(time.Now())
+		receipts := []types.OutputReceiptEvent{
+			{RoomID: room.ID, Type: "m.read", UserID: alice.ID, EventID: "$main"},
+			{RoomID: room.ID, Type: "m.read", UserID: alice.ID, EventID: "$thread", ThreadID: "$root"},
+			{RoomID: room.ID, Type: "m.read.private", UserID: alice.ID, EventID: "$private"},
+			// replaces the first receipt
+			{RoomID: room.ID, Type: "m.read", UserID: alice.ID, EventID: "$main2"},
+		}
+		for _, r := range receipts {
+			if _, err := db.StoreReceipt(ctx, r.RoomID, r.Type, r.UserID, r.EventID, r.ThreadID, ts); err != nil {
+				t.Fatalf("failed to store receipt: %s", err)
+			}
+		}
+
+		_, got, err := db.RoomReceiptsAfter(ctx, []string{room.ID}, 0)
+		if err != nil {
+			t.Fatalf("failed to get receipts: %s", err)
+		}
+		gotEventIDs := map[string]string{}
+		for _, r := range got {
+			gotEventIDs[r.Type+"/"+r.ThreadID] = r.EventID
+		}
+		wantEventIDs := map[string]string{
+			"m.read/":         "$main2",
+			"m.read/$root":    "$thread",
+			"m.read.private/": "$private",
+		}
+		if !reflect.DeepEqual(gotEventIDs, wantEventIDs) {
+			t.Fatalf("got receipts %v want %v", gotEventIDs, wantEventIDs)
+		}
+	})
+}
+
+func TestNotificationDataThreadCounts(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		alice := test.NewUser(t)
+		room := test.NewRoom(t, alice)
+		db, close, closeBase := MustCreateDatabase(t, dbType)
+		defer close()
+		defer closeBase()
+
+		data := &eventutil.NotificationData{
+			RoomID:                  room.ID,
+			UnreadNotificationCount: 3,
+			UnreadHighlightCount:    1,
+			UnreadThreadNotifications: map[string]types.UnreadNotificationCounts{
+				"$root": {NotificationCount: 2, HighlightCount: 1},
+			},
+		}
+		pos, err := db.UpsertRoomUnreadNotificationCounts(ctx, alice.ID, data)
+		if err != nil {
+			t.Fatalf("failed to store notification data: %s", err)
+		}
+		got, err := db.GetUserUnreadNotificationCounts(ctx, alice.ID, 0, pos)
+		if err != nil {
+			t.Fatalf("failed to get notification data: %s", err)
+		}
+		if !reflect.DeepEqual(got[room.ID], data) {
+			t.Fatalf("got notification data %+v want %+v", got[room.ID], data)
+		}
+	})
+}
+
 /*
 func TestInviteBehaviour(t *testing.T) {
 	db := MustCreateDatabase(t)
@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"math"
 	"reflect"
 	"testing"
 
@@ -12,6 +13,7 @@ import (
 	"github.com/matrix-org/dendrite/syncapi/storage/postgres"
 	"github.com/matrix-org/dendrite/syncapi/storage/sqlite3"
 	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/dendrite/test"
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -103,3 +105,61 @@ func TestOutputRoomEventsTable(t *testing.T) {
 		}
 	})
 }
+
+func TestSelectLatestEvents(t *testing.T) {
+	ctx := context.Background()
+	alice := test.NewUser(t)
+	room1 := test.NewRoom(t, alice)
+	room2 := test.NewRoom(t, alice)
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		tab, db, close := newOutputRoomEventsTable(t, dbType)
+		defer close()
+		err := sqlutil.WithTransaction(db, func(txn *sql.Tx) error {
+			var pos types.StreamPosition
+			for _, ev := range append(room1.Events(), room2.Events()...) {
+				p, err := tab.InsertEvent(ctx, txn, ev, nil, nil, nil, false, gomatrixserverlib.HistoryVisibilityShared)
+				if err != nil {
+					return fmt.Errorf("failed to InsertEvent: %s", err)
+				}
+				if ev.RoomID() == room1.ID {
+					pos = p
+				}
+			}
+			// Events which are excluded from sync are skipped.
+			excluded := room2.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "hi"})
+			if _, err := tab.InsertEvent(ctx, txn, excluded, nil, nil, nil, true, gomatrixserverlib.HistoryVisibilityShared); err != nil {
+				return fmt.Errorf("failed to InsertEvent: %s", err)
+			}
+			room1Events, room2Events := room1.Events(), room2.Events()
+
+			got, err := tab.SelectLatestEvents(ctx, txn, []string{room1.ID, room2.ID, "!unknown:test"}, math.MaxInt64)
+			if err != nil {
+				return fmt.Errorf("failed to SelectLatestEvents: %s", err)
+			}
+			want := map[string]string{
+				room1.ID: room1Events[len(room1Events)-1].EventID(),
+				room2.ID: room2Events[len(room2Events)-2].EventID(),
+			}
+			gotIDs := make(map[string]string, len(got))
+			for roomID, ev := range got {
+				gotIDs[roomID] = ev.EventID()
+			}
+			if !reflect.DeepEqual(gotIDs, want) {
+				return fmt.Errorf("SelectLatestEvents\ngot  %v\n want %v", gotIDs, want)
+			}
+
+			// Only events at or before the position are returned.
+			got, err = tab.SelectLatestEvents(ctx, txn, []string{room1.ID, room2.ID}, pos)
+			if err != nil {
+				return fmt.Errorf("failed to SelectLatestEvents: %s", err)
+			}
+			if len(got) != 1 || got[room1.ID].EventID() != want[room1.ID] {
+				return fmt.Errorf("SelectLatestEvents: expected only the latest event of the first room, got %v", got)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	})
+}
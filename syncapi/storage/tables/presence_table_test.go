@@ -0,0 +1,121 @@
+package tables_test
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/syncapi/storage/postgres"
+	"github.com/matrix-org/dendrite/syncapi/storage/sqlite3"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func newPresenceTable(t *testing.T, dbType test.DBType) (tables.Presence, *sql.DB, func()) {
+	t.Helper()
+	connStr, close := test.PrepareDBConnectionString(t, dbType)
+	db, err := sqlutil.Open(&config.DatabaseOptions{
+		ConnectionString: config.DataSource(connStr),
+	}, sqlutil.NewExclusiveWriter())
+	if err != nil {
+		t.Fatalf("failed to open db: %s", err)
+	}
+
+	var tab tables.Presence
+	switch dbType {
+	case test.DBTypePostgres:
+		tab, err = postgres.NewPostgresPresenceTable(db)
+	case test.DBTypeSQLite:
+		var stream sqlite3.StreamIDStatements
+		if err = stream.Prepare(db); err != nil {
+			t.Fatalf("failed to prepare stream stmts: %s", err)
+		}
+		tab, err = sqlite3.NewSqlitePresenceTable(db, &stream)
+	}
+	if err != nil {
+		t.Fatalf("failed to make new table: %s", err)
+	}
+	return tab, db, close
+}
+
+func TestPresenceTable_GetPresenceAfter(t *testing.T) {
+	ctx := context.Background()
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		tab, _, close := newPresenceTable(t, dbType)
+		defer close()
+
+		now := gomatrixserverlib.AsTimestamp(time.Now())
+		idle := gomatrixserverlib.AsTimestamp(time.Now().Add(-time.Hour))
+		pos, err := tab.UpsertPresence(ctx, nil, alice.ID, nil, types.PresenceOnline, now, false)
+		if err != nil {
+			t.Fatalf("failed to upsert presence: %s", err)
+		}
+		if _, err = tab.UpsertPresence(ctx, nil, bob.ID, nil, types.PresenceUnavailable, idle, false); err != nil {
+			t.Fatalf("failed to upsert presence: %s", err)
+		}
+
+		filter := gomatrixserverlib.EventFilter{Limit: 10}
+		// Initial syncs only get recently active users.
+		presences, err := tab.GetPresenceAfter(ctx, nil, 0, filter)
+		if err != nil {
+			t.Fatalf("failed to get presence: %s", err)
+		}
+		if _, ok := presences[alice.ID]; !ok || len(presences) != 1 {
+			t.Fatalf("expected only presence of %s, got %+v", alice.ID, presences)
+		}
+
+		// Incremental syncs get all changes, including users going idle.
+		presences, err = tab.GetPresenceAfter(ctx, nil, pos, filter)
+		if err != nil {
+			t.Fatalf("failed to get presence: %s", err)
+		}
+		p, ok := presences[bob.ID]
+		if !ok || len(presences) != 1 {
+			t.Fatalf("expected only presence of %s, got %+v", bob.ID, presences)
+		}
+		if p.Presence != types.PresenceUnavailable || p.LastActiveTS != idle {
+			t.Fatalf("unexpected presence: %+v", p)
+		}
+	})
+}
+
+func TestPresenceTable_GetPresenceForUsers(t *testing.T) {
+	ctx := context.Background()
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	charlie := test.NewUser(t)
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		tab, _, close := newPresenceTable(t, dbType)
+		defer close()
+
+		now := gomatrixserverlib.AsTimestamp(time.Now())
+		if _, err := tab.UpsertPresence(ctx, nil, alice.ID, nil, types.PresenceOnline, now, false); err != nil {
+			t.Fatalf("failed to upsert presence: %s", err)
+		}
+		if _, err := tab.UpsertPresence(ctx, nil, bob.ID, nil, types.PresenceUnavailable, now, false); err != nil {
+			t.Fatalf("failed to upsert presence: %s", err)
+		}
+
+		// Users without a presence are omitted.
+		presences, err := tab.GetPresenceForUsers(ctx, nil, []string{alice.ID, bob.ID, charlie.ID})
+		if err != nil {
+			t.Fatalf("failed to get presence: %s", err)
+		}
+		if len(presences) != 2 {
+			t.Fatalf("expected 2 presences, got %+v", presences)
+		}
+		if p := presences[alice.ID]; p == nil || p.Presence != types.PresenceOnline {
+			t.Fatalf("expected %s to be online, got %+v", alice.ID, p)
+		}
+		if p := presences[bob.ID]; p == nil || p.Presence != types.PresenceUnavailable {
+			t.Fatalf("expected %s to be unavailable, got %+v", bob.ID, p)
+		}
+	})
+}
@@ -49,6 +49,15 @@ func (p *NotificationDataStreamProvider) IncrementalSync(
 
 		jr.UnreadNotifications.HighlightCount = counts.UnreadHighlightCount
 		jr.UnreadNotifications.NotificationCount = counts.UnreadNotificationCount
+		if req.UnreadThreadNotifications {
+			// The room counts only cover the main timeline if the client
+			// asked for the counts of threads separately.
+			for _, threadCounts := range counts.UnreadThreadNotifications {
+				jr.UnreadNotifications.HighlightCount -= threadCounts.HighlightCount
+				jr.UnreadNotifications.NotificationCount -= threadCounts.NotificationCount
+			}
+			jr.UnreadThreadNotifications = counts.UnreadThreadNotifications
+		}
 		req.Response.Rooms.Join[roomID] = jr
 	}
 	return to
@@ -58,6 +58,10 @@ func (p *ReceiptStreamProvider) IncrementalSync(
 		if _, ok := req.IgnoredUsers.List[receipt.UserID]; ok {
 			continue
 		}
+		// private read receipts are only sent to the user who sent them
+		if receipt.Type == "m.read.private" && receipt.UserID != req.Device.UserID {
+			continue
+		}
 		receiptsByRoom[receipt.RoomID] = append(receiptsByRoom[receipt.RoomID], receipt)
 	}
 
@@ -77,16 +81,21 @@ func (p *ReceiptStreamProvider) IncrementalSync(
 			Type:   gomatrixserverlib.MReceipt,
 			RoomID: roomID,
 		}
-		content := make(map[string]ReceiptMRead)
+		// The content maps event IDs to receipt types to user IDs.
+		content := make(map[string]map[string]map[string]ReceiptTS)
 		for _, receipt := range receipts {
-			read, ok := content[receipt.EventID]
+			if _, ok := content[receipt.EventID]; !ok {
+				content[receipt.EventID] = make(map[string]map[string]ReceiptTS)
+			}
+			users, ok := content[receipt.EventID][receipt.Type]
 			if !ok {
-				read = ReceiptMRead{
-					User: make(map[string]ReceiptTS),
-				}
+				users = make(map[string]ReceiptTS)
+				content[receipt.EventID][receipt.Type] = users
+			}
+			users[receipt.UserID] = ReceiptTS{
+				TS:       receipt.Timestamp,
+				ThreadID: receipt.ThreadID,
 			}
-			read.User[receipt.UserID] = ReceiptTS{TS: receipt.Timestamp}
-			content[receipt.EventID] = read
 		}
 		ev.Content, err = json.Marshal(content)
 		if err != nil {
@@ -101,10 +110,7 @@ func (p *ReceiptStreamProvider) IncrementalSync(
 	return lastPos
 }
 
-type ReceiptMRead struct {
-	User map[string]ReceiptTS `json:"m.read"`
-}
-
 type ReceiptTS struct {
-	TS gomatrixserverlib.Timestamp `json:"ts"`
+	TS       gomatrixserverlib.Timestamp `json:"ts"`
+	ThreadID string                      `json:"thread_id,omitempty"`
 }
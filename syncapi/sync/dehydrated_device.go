@@ -0,0 +1,109 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/matrix-org/util"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	keyapi "github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+type claimDehydratedDeviceRequest struct {
+	DeviceID string `json:"device_id"`
+}
+
+// OnIncomingClaimDehydratedDeviceRequest is called when a device claims the user's dehydrated
+// device. The to-device messages which the dehydrated device received are handed to the
+// claiming device, and the dehydrated device is deleted.
+func (rp *RequestPool) OnIncomingClaimDehydratedDeviceRequest(req *http.Request, device *userapi.Device) util.JSONResponse {
+	var body claimDehydratedDeviceRequest
+	data, err := io.ReadAll(req.Body)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be read. " + err.Error()),
+		}
+	}
+	if err = json.Unmarshal(data, &body); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+	if body.DeviceID == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("device_id is required"),
+		}
+	}
+	if body.DeviceID == device.ID {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("A dehydrated device can't claim itself"),
+		}
+	}
+
+	// Removing the dehydrated device first means that only one device can claim it.
+	var removeRes keyapi.PerformRemoveDehydratedDeviceResponse
+	if err = rp.keyAPI.PerformRemoveDehydratedDevice(req.Context(), &keyapi.PerformRemoveDehydratedDeviceRequest{
+		UserID:   device.UserID,
+		DeviceID: body.DeviceID,
+	}, &removeRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("keyAPI.PerformRemoveDehydratedDevice failed")
+		return jsonerror.InternalServerError()
+	}
+	if removeRes.DeviceID == "" {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("The dehydrated device doesn't exist or has already been claimed"),
+		}
+	}
+
+	pos, err := rp.db.MoveSendToDeviceMessages(req.Context(), device.UserID, removeRes.DeviceID, device.ID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rp.db.MoveSendToDeviceMessages failed")
+		return jsonerror.InternalServerError()
+	}
+	if pos > 0 {
+		rp.streams.SendToDeviceStreamProvider.Advance(pos)
+		rp.Notifier.OnNewSendToDevice(
+			device.UserID,
+			[]string{device.ID},
+			types.StreamingToken{SendToDevicePosition: pos},
+		)
+	}
+
+	if err = rp.userAPI.PerformDeviceDeletion(req.Context(), &userapi.PerformDeviceDeletionRequest{
+		UserID:    device.UserID,
+		DeviceIDs: []string{removeRes.DeviceID},
+	}, &userapi.PerformDeviceDeletionResponse{}); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformDeviceDeletion failed")
+		return jsonerror.InternalServerError()
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct {
+			Success bool `json:"success"`
+		}{true},
+	}
+}
@@ -47,7 +47,7 @@ func newSyncRequest(req *http.Request, device userapi.Device, syncDB storage.Dat
 		}
 	}
 	// TODO: read from stored filters too
-	filter := gomatrixserverlib.DefaultFilter()
+	filter := types.Filter{Filter: gomatrixserverlib.DefaultFilter()}
 	if since.IsEmpty() {
 		// Send as much account data down for complete syncs as possible
 		// by default, otherwise clients do weird things while waiting
@@ -89,11 +89,13 @@ func newSyncRequest(req *http.Request, device userapi.Device, syncDB storage.Dat
 		Log:           logger,                  //
 		Device:        &device,                 //
 		Response:      types.NewResponse(),     // Populated by all streams
-		Filter:        filter,                  //
+		Filter:        filter.Filter,           //
 		Since:         since,                   //
 		Timeout:       timeout,                 //
 		Rooms:         make(map[string]string), // Populated by the PDU stream
 		WantFullState: wantFullState,           //
+
+		UnreadThreadNotifications: filter.UnreadThreadNotifications,
 	}, nil
 }
 
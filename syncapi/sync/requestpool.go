@@ -50,15 +50,29 @@ type RequestPool struct {
 	keyAPI   keyapi.SyncKeyAPI
 	rsAPI    roomserverAPI.SyncRoomserverAPI
 	lastseen *sync.Map
-	presence *sync.Map
 	streams  *streams.Streams
 	Notifier *notifier.Notifier
 	producer PresencePublisher
 	consumer PresenceConsumer
+
+	responseCache *syncResponseCache
+	slidingSync   *slidingSyncConns
+
+	presenceMu   sync.Mutex
+	syncingUsers map[string]*syncingUser
+}
+
+// syncingUser tracks the /sync requests of a local user, which decide when
+// the user goes offline.
+type syncingUser struct {
+	syncing  int           // the number of /sync requests in progress
+	lastSync time.Time     // when the last /sync request finished
+	idle     bool          // whether the user was marked as unavailable for being idle
+	expiring chan struct{} // closed once the user has been marked as offline for no longer syncing
 }
 
 type PresencePublisher interface {
-	SendPresence(userID string, presence types.Presence, statusMsg *string) error
+	SendPresence(ctx context.Context, userID string, presence types.Presence, statusMsg *string, lastActiveTS gomatrixserverlib.Timestamp) error
 }
 
 type PresenceConsumer interface {
@@ -75,7 +89,7 @@ func NewRequestPool(
 ) *RequestPool {
 	if enableMetrics {
 		prometheus.MustRegister(
-			activeSyncRequests, waitingSyncRequests,
+			activeSyncRequests, waitingSyncRequests, syncResponseCacheRequests,
 		)
 	}
 	rp := &RequestPool{
@@ -85,14 +99,17 @@ func NewRequestPool(
 		keyAPI:   keyAPI,
 		rsAPI:    rsAPI,
 		lastseen: &sync.Map{},
-		presence: &sync.Map{},
 		streams:  streams,
 		Notifier: notifier,
 		producer: producer,
 		consumer: consumer,
+
+		responseCache: newSyncResponseCache(notifier),
+		slidingSync:   newSlidingSyncConns(),
+		syncingUsers:  map[string]*syncingUser{},
 	}
 	go rp.cleanLastSeen()
-	go rp.cleanPresence(db, time.Minute*5)
+	go rp.cleanPresence(db, time.Second*10)
 	return rp
 }
 
@@ -106,74 +123,167 @@ func (rp *RequestPool) cleanLastSeen() {
 	}
 }
 
-func (rp *RequestPool) cleanPresence(db storage.Presence, cleanupTime time.Duration) {
+// cleanPresence periodically marks syncing users as unavailable when they
+// have been idle for too long, and as offline when they stop syncing.
+func (rp *RequestPool) cleanPresence(db storage.Presence, interval time.Duration) {
 	if !rp.cfg.Matrix.Presence.EnableOutbound {
 		return
 	}
 	for {
-		rp.presence.Range(func(key interface{}, v interface{}) bool {
-			p := v.(types.PresenceInternal)
-			if time.Since(p.LastActiveTS.Time()) > cleanupTime {
-				rp.updatePresence(db, types.PresenceUnavailable.String(), p.UserID)
-				rp.presence.Delete(key)
+		time.Sleep(interval)
+		rp.expirePresence(db, time.Now())
+	}
+}
+
+func (rp *RequestPool) expirePresence(db storage.Presence, now time.Time) {
+	idleTimeout := rp.cfg.Matrix.Presence.IdleTimeout
+	offlineTimeout := rp.cfg.Matrix.Presence.OfflineTimeout
+	isOffline := func(user *syncingUser) bool {
+		return user.syncing == 0 && now.Sub(user.lastSync) > offlineTimeout
+	}
+
+	rp.presenceMu.Lock()
+	userIDs := make([]string, 0, len(rp.syncingUsers))
+	for userID := range rp.syncingUsers {
+		userIDs = append(userIDs, userID)
+	}
+	rp.presenceMu.Unlock()
+	if len(userIDs) == 0 {
+		return
+	}
+
+	presences, err := db.GetPresences(context.Background(), userIDs)
+	if err != nil {
+		logrus.WithError(err).Error("Unable to get presence")
+		return
+	}
+
+	// Work out which users need their presence changed under the lock, but
+	// change it afterwards, as that publishes and writes to the database.
+	type transition struct {
+		userID   string
+		user     *syncingUser
+		presence types.Presence
+		current  *types.PresenceInternal
+	}
+	var transitions []transition
+	rp.presenceMu.Lock()
+	for _, userID := range userIDs {
+		p := presences[userID]
+		user, ok := rp.syncingUsers[userID]
+		switch {
+		case !ok || user.expiring != nil:
+		case isOffline(user):
+			if p == nil || p.Presence == types.PresenceOffline {
+				delete(rp.syncingUsers, userID)
+				continue
 			}
-			return true
-		})
-		time.Sleep(cleanupTime)
+			// New /sync requests wait until the user has been marked as
+			// offline, so that they can't be marked as online in the meantime.
+			user.expiring = make(chan struct{})
+			transitions = append(transitions, transition{userID, user, types.PresenceOffline, p})
+		case p != nil && p.Presence == types.PresenceOnline:
+			user.idle = now.Sub(p.LastActiveTS.Time()) > idleTimeout
+			if user.idle {
+				transitions = append(transitions, transition{userID, user, types.PresenceUnavailable, p})
+			}
+		}
+	}
+	rp.presenceMu.Unlock()
+
+	for _, t := range transitions {
+		rp.setPresence(context.Background(), t.userID, t.presence, t.current.ClientFields.StatusMsg, t.current.LastActiveTS)
+		if t.presence == types.PresenceOffline {
+			rp.presenceMu.Lock()
+			delete(rp.syncingUsers, t.userID)
+			close(t.user.expiring)
+			rp.presenceMu.Unlock()
+		}
 	}
 }
 
-// updatePresence sends presence updates to the SyncAPI and FederationAPI
-func (rp *RequestPool) updatePresence(db storage.Presence, presence string, userID string) {
+// updatePresence marks the user as syncing and sets their presence as requested
+// by the set_presence parameter of /sync. The returned function must be called
+// once the /sync request is finished.
+func (rp *RequestPool) updatePresence(ctx context.Context, db storage.Presence, presence string, userID string) func() {
 	if !rp.cfg.Matrix.Presence.EnableOutbound {
-		return
+		return func() {}
 	}
 	if presence == "" {
 		presence = types.PresenceOnline.String()
 	}
 
 	presenceID, ok := types.PresenceFromString(presence)
-	if !ok { // this should almost never happen
-		return
+	if !ok || presenceID == types.PresenceOffline {
+		// Syncing with set_presence=offline doesn't affect the presence of the user.
+		return func() {}
 	}
 
-	newPresence := types.PresenceInternal{
-		Presence:     presenceID,
-		UserID:       userID,
-		LastActiveTS: gomatrixserverlib.AsTimestamp(time.Now()),
+	rp.presenceMu.Lock()
+	user, ok := rp.syncingUsers[userID]
+	for ok && user.expiring != nil {
+		expiring := user.expiring
+		rp.presenceMu.Unlock()
+		<-expiring
+		rp.presenceMu.Lock()
+		user, ok = rp.syncingUsers[userID]
+	}
+	if !ok {
+		user = &syncingUser{}
+		rp.syncingUsers[userID] = user
+	}
+	user.syncing++
+	idle := user.idle
+	rp.presenceMu.Unlock()
+
+	done := func() {
+		rp.presenceMu.Lock()
+		defer rp.presenceMu.Unlock()
+		user.syncing--
+		user.lastSync = time.Now()
 	}
 
 	// ensure we also send the current status_msg to federated servers and not nil
-	dbPresence, err := db.GetPresence(context.Background(), userID)
+	dbPresence, err := db.GetPresence(ctx, userID)
 	if err != nil && err != sql.ErrNoRows {
-		return
-	}
-	if dbPresence != nil {
-		newPresence.ClientFields = dbPresence.ClientFields
+		logrus.WithError(err).WithField("user_id", userID).Error("Unable to get presence")
+		return done
 	}
-	newPresence.ClientFields.Presence = presenceID.String()
 
-	defer rp.presence.Store(userID, newPresence)
-	// avoid spamming presence updates when syncing
-	existingPresence, ok := rp.presence.LoadOrStore(userID, newPresence)
-	if ok {
-		p := existingPresence.(types.PresenceInternal)
-		if p.ClientFields.Presence == newPresence.ClientFields.Presence {
-			return
+	lastActiveTS := gomatrixserverlib.AsTimestamp(time.Now())
+	var statusMsg *string
+	if dbPresence != nil {
+		statusMsg = dbPresence.ClientFields.StatusMsg
+		switch {
+		case dbPresence.Presence == presenceID:
+			// avoid spamming presence updates when syncing
+			return done
+		case dbPresence.Presence == types.PresenceUnavailable && idle:
+			// Users who went idle stay unavailable until they are active again.
+			return done
+		case dbPresence.Presence == types.PresenceOnline:
+			// Going unavailable doesn't make the user active, but coming online does.
+			lastActiveTS = dbPresence.LastActiveTS
 		}
 	}
 
-	if err := rp.producer.SendPresence(userID, presenceID, newPresence.ClientFields.StatusMsg); err != nil {
+	rp.setPresence(ctx, userID, presenceID, statusMsg, lastActiveTS)
+	return done
+}
+
+// setPresence sends a presence update of a local user to the FederationAPI
+// and updates it in the SyncAPI.
+func (rp *RequestPool) setPresence(
+	ctx context.Context, userID string, presence types.Presence, statusMsg *string, lastActiveTS gomatrixserverlib.Timestamp,
+) {
+	if err := rp.producer.SendPresence(ctx, userID, presence, statusMsg, lastActiveTS); err != nil {
 		logrus.WithError(err).Error("Unable to publish presence message from sync")
 		return
 	}
 
 	// now synchronously update our view of the world. It's critical we do this before calculating
 	// the /sync response else we may not return presence: online immediately.
-	rp.consumer.EmitPresence(
-		context.Background(), userID, presenceID, newPresence.ClientFields.StatusMsg,
-		gomatrixserverlib.AsTimestamp(time.Now()), true,
-	)
+	rp.consumer.EmitPresence(context.Background(), userID, presence, statusMsg, lastActiveTS, true)
 }
 
 func (rp *RequestPool) updateLastSeen(req *http.Request, device *userapi.Device) {
@@ -226,8 +336,18 @@ var waitingSyncRequests = prometheus.NewGauge(
 
 // OnIncomingSyncRequest is called when a client makes a /sync request. This function MUST be
 // called in a dedicated goroutine for this request. This function will block the goroutine
-// until a response is ready, or it times out.
+// until a response is ready, or it times out. Retried and concurrent identical requests are
+// served from the response cache.
 func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.Device) util.JSONResponse {
+	rp.updateLastSeen(req, device)
+	defer rp.updatePresence(req.Context(), rp.db, req.FormValue("set_presence"), device.UserID)()
+
+	return rp.responseCache.get(newSyncRequestKey(req, device), func(devicePos *types.StreamingToken) util.JSONResponse {
+		return rp.onIncomingSyncRequest(req, device, devicePos)
+	})
+}
+
+func (rp *RequestPool) onIncomingSyncRequest(req *http.Request, device *userapi.Device, devicePos *types.StreamingToken) util.JSONResponse {
 	// Extract values from request
 	syncReq, err := newSyncRequest(req, *device, rp.db)
 	if err != nil {
@@ -246,9 +366,6 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 	activeSyncRequests.Inc()
 	defer activeSyncRequests.Dec()
 
-	rp.updateLastSeen(req, device)
-	rp.updatePresence(rp.db, req.FormValue("set_presence"), device.UserID)
-
 	waitingSyncRequests.Inc()
 	defer waitingSyncRequests.Dec()
 
@@ -299,7 +416,8 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 
 			case <-userStreamListener.GetNotifyChannel(syncReq.Since):
 				syncReq.Log.Debugln("Responding to sync after wake-up")
-				currentPos.ApplyUpdates(userStreamListener.GetSyncPosition())
+				*devicePos = userStreamListener.GetSyncPosition()
+				currentPos.ApplyUpdates(*devicePos)
 			}
 		} else {
 			syncReq.Log.WithField("currentPos", currentPos).Debugln("Responding to sync immediately")
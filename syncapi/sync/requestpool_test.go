@@ -16,61 +16,115 @@ type dummyPublisher struct {
 	count int
 }
 
-func (d *dummyPublisher) SendPresence(userID string, presence types.Presence, statusMsg *string) error {
+func (d *dummyPublisher) SendPresence(ctx context.Context, userID string, presence types.Presence, statusMsg *string, lastActiveTS gomatrixserverlib.Timestamp) error {
 	d.lock.Lock()
 	defer d.lock.Unlock()
 	d.count++
 	return nil
 }
 
-type dummyDB struct{}
+type dummyDB struct {
+	lock      sync.Mutex
+	presences map[string]*types.PresenceInternal
+}
 
-func (d dummyDB) UpdatePresence(ctx context.Context, userID string, presence types.Presence, statusMsg *string, lastActiveTS gomatrixserverlib.Timestamp, fromSync bool) (types.StreamPosition, error) {
+func (d *dummyDB) UpdatePresence(ctx context.Context, userID string, presence types.Presence, statusMsg *string, lastActiveTS gomatrixserverlib.Timestamp, fromSync bool) (types.StreamPosition, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.presences[userID] = &types.PresenceInternal{
+		UserID:       userID,
+		Presence:     presence,
+		LastActiveTS: lastActiveTS,
+		ClientFields: types.PresenceClientResponse{
+			Presence:  presence.String(),
+			StatusMsg: statusMsg,
+		},
+	}
 	return 0, nil
 }
 
-func (d dummyDB) GetPresence(ctx context.Context, userID string) (*types.PresenceInternal, error) {
-	return &types.PresenceInternal{}, nil
+func (d *dummyDB) GetPresence(ctx context.Context, userID string) (*types.PresenceInternal, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if p, ok := d.presences[userID]; ok {
+		presence := *p
+		return &presence, nil
+	}
+	return nil, nil
+}
+
+func (d *dummyDB) GetPresences(ctx context.Context, userIDs []string) (map[string]*types.PresenceInternal, error) {
+	presences := make(map[string]*types.PresenceInternal, len(userIDs))
+	for _, userID := range userIDs {
+		if p, _ := d.GetPresence(ctx, userID); p != nil {
+			presences[userID] = p
+		}
+	}
+	return presences, nil
 }
 
-func (d dummyDB) PresenceAfter(ctx context.Context, after types.StreamPosition, filter gomatrixserverlib.EventFilter) (map[string]*types.PresenceInternal, error) {
+func (d *dummyDB) PresenceAfter(ctx context.Context, after types.StreamPosition, filter gomatrixserverlib.EventFilter) (map[string]*types.PresenceInternal, error) {
 	return map[string]*types.PresenceInternal{}, nil
 }
 
-func (d dummyDB) MaxStreamPositionForPresence(ctx context.Context) (types.StreamPosition, error) {
+func (d *dummyDB) MaxStreamPositionForPresence(ctx context.Context) (types.StreamPosition, error) {
 	return 0, nil
 }
 
-type dummyConsumer struct{}
+type dummyConsumer struct {
+	db *dummyDB
+}
 
 func (d dummyConsumer) EmitPresence(ctx context.Context, userID string, presence types.Presence, statusMsg *string, ts gomatrixserverlib.Timestamp, fromSync bool) {
+	_, _ = d.db.UpdatePresence(ctx, userID, presence, statusMsg, ts, fromSync)
+}
 
+func newTestRequestPool(db *dummyDB, publisher *dummyPublisher) *RequestPool {
+	return &RequestPool{
+		syncingUsers: map[string]*syncingUser{},
+		producer:     publisher,
+		consumer:     dummyConsumer{db: db},
+		cfg: &config.SyncAPI{
+			Matrix: &config.Global{
+				JetStream: config.JetStream{
+					TopicPrefix: "Dendrite",
+				},
+				Presence: config.PresenceOptions{
+					EnableInbound:  true,
+					EnableOutbound: true,
+					IdleTimeout:    time.Minute * 5,
+					OfflineTimeout: time.Second * 30,
+				},
+			},
+		},
+	}
 }
 
 func TestRequestPool_updatePresence(t *testing.T) {
 	type args struct {
 		presence string
 		userID   string
-		sleep    time.Duration
 	}
 	publisher := &dummyPublisher{}
-	consumer := &dummyConsumer{}
-	syncMap := sync.Map{}
+	db := &dummyDB{presences: map[string]*types.PresenceInternal{}}
 
 	tests := []struct {
 		name         string
 		args         args
 		wantIncrease bool
+		wantPresence types.Presence
 	}{
 		{
 			name:         "new presence is published",
 			wantIncrease: true,
+			wantPresence: types.PresenceOnline,
 			args: args{
 				userID: "dummy",
 			},
 		},
 		{
-			name: "presence not published, no change",
+			name:         "presence not published, no change",
+			wantPresence: types.PresenceOnline,
 			args: args{
 				userID: "dummy",
 			},
@@ -78,6 +132,7 @@ func TestRequestPool_updatePresence(t *testing.T) {
 		{
 			name:         "new presence is published dummy2",
 			wantIncrease: true,
+			wantPresence: types.PresenceOnline,
 			args: args{
 				userID:   "dummy2",
 				presence: "online",
@@ -86,58 +141,96 @@ func TestRequestPool_updatePresence(t *testing.T) {
 		{
 			name:         "different presence is published dummy2",
 			wantIncrease: true,
+			wantPresence: types.PresenceUnavailable,
 			args: args{
 				userID:   "dummy2",
 				presence: "unavailable",
 			},
 		},
 		{
-			name: "same presence is not published dummy2",
+			name:         "same presence is not published dummy2",
+			wantPresence: types.PresenceUnavailable,
 			args: args{
 				userID:   "dummy2",
 				presence: "unavailable",
-				sleep:    time.Millisecond * 150,
 			},
 		},
 		{
-			name:         "same presence is published after being deleted",
-			wantIncrease: true,
+			name:         "offline does not affect presence dummy2",
+			wantPresence: types.PresenceUnavailable,
 			args: args{
 				userID:   "dummy2",
-				presence: "unavailable",
-			},
-		},
-	}
-	rp := &RequestPool{
-		presence: &syncMap,
-		producer: publisher,
-		consumer: consumer,
-		cfg: &config.SyncAPI{
-			Matrix: &config.Global{
-				JetStream: config.JetStream{
-					TopicPrefix: "Dendrite",
-				},
-				Presence: config.PresenceOptions{
-					EnableInbound:  true,
-					EnableOutbound: true,
-				},
+				presence: "offline",
 			},
 		},
 	}
-	db := dummyDB{}
-	go rp.cleanPresence(db, time.Millisecond*50)
+	rp := newTestRequestPool(db, publisher)
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			publisher.lock.Lock()
 			beforeCount := publisher.count
 			publisher.lock.Unlock()
-			rp.updatePresence(db, tt.args.presence, tt.args.userID)
+			rp.updatePresence(context.Background(), db, tt.args.presence, tt.args.userID)()
 			publisher.lock.Lock()
 			if tt.wantIncrease && publisher.count <= beforeCount {
 				t.Fatalf("expected count to increase: %d <= %d", publisher.count, beforeCount)
 			}
+			if !tt.wantIncrease && publisher.count != beforeCount {
+				t.Fatalf("expected count to stay the same: %d != %d", publisher.count, beforeCount)
+			}
 			publisher.lock.Unlock()
-			time.Sleep(tt.args.sleep)
+			p, _ := db.GetPresence(context.Background(), tt.args.userID)
+			if p == nil || p.Presence != tt.wantPresence {
+				t.Fatalf("expected presence %s, got %+v", tt.wantPresence, p)
+			}
 		})
 	}
 }
+
+func TestRequestPool_expirePresence(t *testing.T) {
+	publisher := &dummyPublisher{}
+	db := &dummyDB{presences: map[string]*types.PresenceInternal{}}
+	rp := newTestRequestPool(db, publisher)
+	userID := "@alice:test"
+	assertPresence := func(t *testing.T, want types.Presence) {
+		t.Helper()
+		p, _ := db.GetPresence(context.Background(), userID)
+		if p == nil || p.Presence != want {
+			t.Fatalf("expected presence %s, got %+v", want, p)
+		}
+	}
+
+	// A sync in progress keeps the user from going offline, but not from going idle.
+	done := rp.updatePresence(context.Background(), db, "", userID)
+	assertPresence(t, types.PresenceOnline)
+	rp.expirePresence(db, time.Now().Add(time.Minute))
+	assertPresence(t, types.PresenceOnline)
+	rp.expirePresence(db, time.Now().Add(time.Minute*6))
+	assertPresence(t, types.PresenceUnavailable)
+	done()
+
+	// Idle users stay unavailable when syncing again...
+	rp.updatePresence(context.Background(), db, "online", userID)()
+	assertPresence(t, types.PresenceUnavailable)
+
+	// ... until they are active again.
+	_, _ = db.UpdatePresence(context.Background(), userID, types.PresenceOnline, nil, gomatrixserverlib.AsTimestamp(time.Now()), false)
+	rp.expirePresence(db, time.Now())
+	rp.updatePresence(context.Background(), db, "online", userID)()
+	assertPresence(t, types.PresenceOnline)
+
+	// Users who stopped syncing go offline.
+	rp.expirePresence(db, time.Now().Add(time.Minute))
+	assertPresence(t, types.PresenceOffline)
+	if _, ok := rp.syncingUsers[userID]; ok {
+		t.Fatalf("expected %s to no longer be tracked", userID)
+	}
+
+	// Coming back online counts as activity.
+	rp.updatePresence(context.Background(), db, "", userID)()
+	assertPresence(t, types.PresenceOnline)
+	p, _ := db.GetPresence(context.Background(), userID)
+	if !p.CurrentlyActive() {
+		t.Fatalf("expected %s to be currently active", userID)
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/util"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/matrix-org/dendrite/syncapi/notifier"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+// syncResponseCacheTime is how long a sync response is kept around for
+// retried requests.
+const syncResponseCacheTime = time.Minute * 2
+
+var syncResponseCacheRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "syncapi",
+		Name:      "sync_response_cache_requests_total",
+		Help:      "The number of sync requests by whether they were served from the response cache (hit), waited for an identical request in progress (coalesced) or were computed (miss)",
+	},
+	[]string{"result"},
+)
+
+// syncRequestKey identifies sync requests which would get the same response.
+// The timeout and set_presence parameters are included too, since a request
+// which doesn't want to wait, or wants to set a different presence, mustn't
+// get the response of a request which did.
+type syncRequestKey struct {
+	userID      string
+	deviceID    string
+	since       string
+	filter      string
+	fullState   string
+	timeout     string
+	setPresence string
+}
+
+func newSyncRequestKey(req *http.Request, device *userapi.Device) syncRequestKey {
+	query := req.URL.Query()
+	return syncRequestKey{
+		userID:      device.UserID,
+		deviceID:    device.ID,
+		since:       query.Get("since"),
+		filter:      query.Get("filter"),
+		fullState:   query.Get("full_state"),
+		timeout:     query.Get("timeout"),
+		setPresence: query.Get("set_presence"),
+	}
+}
+
+type syncDeviceKey struct {
+	userID   string
+	deviceID string
+}
+
+type cachedSyncResponse struct {
+	key       syncRequestKey
+	res       util.JSONResponse
+	devicePos types.StreamingToken // the device position before computing the response
+	expires   time.Time
+}
+
+type inflightSyncRequest struct {
+	done chan struct{}
+	res  util.JSONResponse
+}
+
+// syncResponseCache remembers the last sync response for each device, so
+// that clients which retry a request, e.g. because the connection dropped
+// before they got the response, get the same response again instead of
+// making us compute it again. Responses are only used for as long as the
+// notifier hasn't woken up the device, as until then computing the response
+// again would give the same result. Identical requests which arrive while the
+// first one is still being computed wait for its response.
+type syncResponseCache struct {
+	notifier  *notifier.Notifier
+	mutex     sync.Mutex
+	responses map[syncDeviceKey]*cachedSyncResponse
+	inflight  map[syncRequestKey]*inflightSyncRequest
+}
+
+func newSyncResponseCache(notifier *notifier.Notifier) *syncResponseCache {
+	c := &syncResponseCache{
+		notifier:  notifier,
+		responses: make(map[syncDeviceKey]*cachedSyncResponse),
+		inflight:  make(map[syncRequestKey]*inflightSyncRequest),
+	}
+	go c.clean()
+	return c
+}
+
+func (c *syncResponseCache) clean() {
+	for {
+		time.Sleep(syncResponseCacheTime)
+		c.mutex.Lock()
+		for deviceKey, cached := range c.responses {
+			if time.Now().After(cached.expires) {
+				delete(c.responses, deviceKey)
+			}
+		}
+		c.mutex.Unlock()
+	}
+}
+
+// get returns the response for the request, calling compute if there is
+// neither a cached response nor an identical request in progress. If compute
+// waits for the device to be woken up, it must update devicePos to the
+// position it was woken up at. Initial syncs are always computed, as their
+// responses are large and retrying them is rare. Requests which waited for an
+// identical one only get its response if it could have been cached, and
+// compute their own otherwise.
+func (c *syncResponseCache) get(key syncRequestKey, compute func(devicePos *types.StreamingToken) util.JSONResponse) util.JSONResponse {
+	deviceKey := syncDeviceKey{key.userID, key.deviceID}
+	devicePos := c.notifier.DevicePosition(key.userID, key.deviceID)
+	if key.since == "" {
+		syncResponseCacheRequests.WithLabelValues("miss").Inc()
+		return compute(&devicePos)
+	}
+	c.mutex.Lock()
+	if cached, ok := c.responses[deviceKey]; ok && cached.key == key && time.Now().Before(cached.expires) {
+		if !devicePos.IsAfter(cached.devicePos) {
+			c.mutex.Unlock()
+			syncResponseCacheRequests.WithLabelValues("hit").Inc()
+			return cached.res
+		}
+		delete(c.responses, deviceKey)
+	}
+	for {
+		inflight, ok := c.inflight[key]
+		if !ok {
+			break
+		}
+		c.mutex.Unlock()
+		syncResponseCacheRequests.WithLabelValues("coalesced").Inc()
+		<-inflight.done
+		// The response was computed under the context of the request which
+		// started it, so if that gave up early, e.g. because the client went
+		// away, the response isn't any good to us and we have to compute our
+		// own.
+		if isCacheableSyncResponse(key, inflight.res) {
+			return inflight.res
+		}
+		c.mutex.Lock()
+	}
+	inflight := &inflightSyncRequest{
+		done: make(chan struct{}),
+	}
+	c.inflight[key] = inflight
+	c.mutex.Unlock()
+	syncResponseCacheRequests.WithLabelValues("miss").Inc()
+
+	defer func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		delete(c.inflight, key)
+		close(inflight.done)
+		if isCacheableSyncResponse(key, inflight.res) {
+			c.responses[deviceKey] = &cachedSyncResponse{
+				key:       key,
+				res:       inflight.res,
+				devicePos: devicePos,
+				expires:   time.Now().Add(syncResponseCacheTime),
+			}
+		}
+	}()
+	inflight.res = compute(&devicePos)
+	return inflight.res
+}
+
+// isCacheableSyncResponse returns true if the response moved the client on
+// from the since token. Errors and responses to requests which timed out
+// aren't worth keeping, as computing them again is cheap.
+func isCacheableSyncResponse(key syncRequestKey, res util.JSONResponse) bool {
+	if res.Code != http.StatusOK {
+		return false
+	}
+	syncRes, ok := res.JSON.(*types.Response)
+	if !ok {
+		return false
+	}
+	return syncRes.NextBatch.String() != key.since
+}
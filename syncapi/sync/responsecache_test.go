@@ -0,0 +1,185 @@
+package sync
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/util"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/matrix-org/dendrite/syncapi/notifier"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+func TestSyncResponseCache(t *testing.T) {
+	n := notifier.NewNotifier()
+	cache := newSyncResponseCache(n)
+	key := syncRequestKey{
+		userID:   "@alice:test",
+		deviceID: "ALICE",
+		since:    types.StreamingToken{PDUPosition: 1}.String(),
+	}
+
+	computed := 0
+	compute := func(next types.StreamPosition) func(*types.StreamingToken) util.JSONResponse {
+		return func(*types.StreamingToken) util.JSONResponse {
+			computed++
+			res := types.NewResponse()
+			res.NextBatch = types.StreamingToken{PDUPosition: next}
+			return util.JSONResponse{Code: http.StatusOK, JSON: res}
+		}
+	}
+	nextBatch := func(res util.JSONResponse) types.StreamPosition {
+		return res.JSON.(*types.Response).NextBatch.PDUPosition
+	}
+
+	// Retrying the request gets the same response.
+	if got := nextBatch(cache.get(key, compute(2))); got != 2 {
+		t.Fatalf("got next batch %d want 2", got)
+	}
+	if got := nextBatch(cache.get(key, compute(3))); got != 2 || computed != 1 {
+		t.Fatalf("got next batch %d after %d computations, want the cached response", got, computed)
+	}
+
+	// Once the device has been woken up, the response is computed again.
+	n.OnNewSendToDevice(key.userID, []string{key.deviceID}, types.StreamingToken{SendToDevicePosition: 1})
+	if got := nextBatch(cache.get(key, compute(3))); got != 3 || computed != 2 {
+		t.Fatalf("got next batch %d after %d computations, want a new response", got, computed)
+	}
+
+	// Responses which didn't move on from the since token aren't cached.
+	otherKey := key
+	otherKey.since = types.StreamingToken{PDUPosition: 5}.String()
+	cache.get(otherKey, compute(5))
+	cache.get(otherKey, compute(5))
+	if computed != 4 {
+		t.Fatalf("got %d computations, want 4", computed)
+	}
+
+	// Requests with a different timeout don't get the cached response.
+	timeoutKey := key
+	timeoutKey.timeout = "0"
+	if got := nextBatch(cache.get(timeoutKey, compute(4))); got != 4 || computed != 5 {
+		t.Fatalf("got next batch %d after %d computations, want a new response", got, computed)
+	}
+
+	// Initial syncs are neither cached nor coalesced.
+	initialKey := key
+	initialKey.since = ""
+	cache.get(initialKey, compute(6))
+	cache.get(initialKey, compute(6))
+	if computed != 7 {
+		t.Fatalf("got %d computations, want 7", computed)
+	}
+}
+
+func TestSyncResponseCacheCoalescing(t *testing.T) {
+	cache := newSyncResponseCache(notifier.NewNotifier())
+	key := syncRequestKey{
+		userID:   "@alice:test",
+		deviceID: "ALICE",
+		since:    types.StreamingToken{PDUPosition: 1}.String(),
+	}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var mu sync.Mutex
+	computed := 0
+	compute := func(*types.StreamingToken) util.JSONResponse {
+		mu.Lock()
+		computed++
+		mu.Unlock()
+		close(started)
+		<-release
+		return util.JSONResponse{Code: http.StatusOK, JSON: types.NewResponse()}
+	}
+
+	before := testutil.ToFloat64(syncResponseCacheRequests.WithLabelValues("coalesced"))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		cache.get(key, compute)
+	}()
+	<-started
+
+	// An identical request waits for the one in progress instead of computing
+	// the response again.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		cache.get(key, compute)
+	}()
+	coalesced := syncResponseCacheRequests.WithLabelValues("coalesced")
+	for testutil.ToFloat64(coalesced) < before+1 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	if computed != 1 {
+		t.Fatalf("got %d computations, want 1", computed)
+	}
+}
+
+func TestSyncResponseCacheCoalescingGaveUp(t *testing.T) {
+	cache := newSyncResponseCache(notifier.NewNotifier())
+	since := types.StreamingToken{PDUPosition: 1}
+	key := syncRequestKey{
+		userID:   "@alice:test",
+		deviceID: "ALICE",
+		since:    since.String(),
+	}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var mu sync.Mutex
+	computed := 0
+	compute := func(*types.StreamingToken) util.JSONResponse {
+		mu.Lock()
+		computed++
+		first := computed == 1
+		mu.Unlock()
+		res := types.NewResponse()
+		if first {
+			// The first request gives up, e.g. because the client went away.
+			close(started)
+			<-release
+			res.NextBatch = since
+		} else {
+			res.NextBatch = types.StreamingToken{PDUPosition: 2}
+		}
+		return util.JSONResponse{Code: http.StatusOK, JSON: res}
+	}
+
+	before := testutil.ToFloat64(syncResponseCacheRequests.WithLabelValues("coalesced"))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		cache.get(key, compute)
+	}()
+	<-started
+
+	// The waiting request doesn't get the response of the request which gave
+	// up, but computes its own.
+	var res util.JSONResponse
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		res = cache.get(key, compute)
+	}()
+	coalesced := syncResponseCacheRequests.WithLabelValues("coalesced")
+	for testutil.ToFloat64(coalesced) < before+1 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	if computed != 2 {
+		t.Fatalf("got %d computations, want 2", computed)
+	}
+	if got := res.JSON.(*types.Response).NextBatch.PDUPosition; got != 2 {
+		t.Fatalf("got next batch %d want 2", got)
+	}
+}
@@ -0,0 +1,1149 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/syncapi/internal"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+// slidingSyncConnTimeout is how long we keep the state of a sliding sync
+// connection around after the last request on it. Clients which come back
+// after this will get M_UNKNOWN_POS and have to start again.
+const slidingSyncConnTimeout = time.Minute * 30
+
+type slidingSyncConnKey struct {
+	userID   string
+	deviceID string
+	connID   string
+}
+
+// slidingSyncConn is the server-side state of a sliding sync connection.
+// Requests on the same connection are processed one at a time.
+type slidingSyncConn struct {
+	sync.Mutex
+	lastUsed      time.Time
+	nextPos       int64
+	positions     map[string]*slidingSyncPos // pos -> state at that pos
+	lists         map[string]types.SlidingList
+	subscriptions map[string]types.SlidingRoomSubscription
+	extensions    types.SlidingExtensionsRequest
+}
+
+// slidingSyncPos is what the client knew about after receiving a response.
+type slidingSyncPos struct {
+	token   types.StreamingToken
+	counts  map[string]int                  // list name -> number of rooms
+	windows map[string]map[[2]int][]string  // list name -> range -> room IDs
+	rooms   map[string]slidingSyncRoomState // rooms sent so far
+}
+
+type slidingSyncRoomState struct {
+	position          types.StreamPosition // the last timeline position sent
+	notificationCount int
+	highlightCount    int
+}
+
+type slidingSyncConns struct {
+	sync.Mutex
+	conns map[slidingSyncConnKey]*slidingSyncConn
+}
+
+func newSlidingSyncConns() *slidingSyncConns {
+	c := &slidingSyncConns{
+		conns: make(map[slidingSyncConnKey]*slidingSyncConn),
+	}
+	go c.clean()
+	return c
+}
+
+func (c *slidingSyncConns) clean() {
+	for {
+		time.Sleep(time.Minute)
+		c.Lock()
+		for key, conn := range c.conns {
+			if conn.TryLock() {
+				if time.Since(conn.lastUsed) > slidingSyncConnTimeout {
+					delete(c.conns, key)
+				}
+				conn.Unlock()
+			}
+		}
+		c.Unlock()
+	}
+}
+
+// get returns the connection for the key, replacing it with a new connection
+// if reset is true. Returns nil if there is no such connection.
+func (c *slidingSyncConns) get(key slidingSyncConnKey, reset bool) *slidingSyncConn {
+	c.Lock()
+	defer c.Unlock()
+	if reset {
+		c.conns[key] = &slidingSyncConn{
+			positions:     make(map[string]*slidingSyncPos),
+			lists:         make(map[string]types.SlidingList),
+			subscriptions: make(map[string]types.SlidingRoomSubscription),
+		}
+	}
+	return c.conns[key]
+}
+
+// update merges the sticky parameters of the request into the connection.
+// Fields which are omitted from the request keep their previous values.
+func (conn *slidingSyncConn) update(body *types.SlidingSyncRequest) {
+	for name, list := range body.Lists {
+		existing, ok := conn.lists[name]
+		if !ok {
+			conn.lists[name] = list
+			continue
+		}
+		if list.Ranges != nil {
+			existing.Ranges = list.Ranges
+		}
+		if list.Sort != nil {
+			existing.Sort = list.Sort
+		}
+		if list.Filters != nil {
+			existing.Filters = list.Filters
+		}
+		if list.RequiredState != nil {
+			existing.RequiredState = list.RequiredState
+		}
+		if list.TimelineLimit != 0 {
+			existing.TimelineLimit = list.TimelineLimit
+		}
+		conn.lists[name] = existing
+	}
+	for roomID, sub := range body.RoomSubscriptions {
+		conn.subscriptions[roomID] = sub
+	}
+	for _, roomID := range body.UnsubscribeRooms {
+		delete(conn.subscriptions, roomID)
+	}
+	ext := &conn.extensions
+	if e := body.Extensions.E2EE; e != nil && e.Enabled != nil {
+		ext.E2EE = e
+	}
+	if e := body.Extensions.ToDevice; e != nil && e.Enabled != nil {
+		ext.ToDevice = &types.SlidingToDeviceExtension{SlidingExtension: e.SlidingExtension}
+	}
+	if e := body.Extensions.AccountData; e != nil && e.Enabled != nil {
+		ext.AccountData = e
+	}
+	if e := body.Extensions.Typing; e != nil && e.Enabled != nil {
+		ext.Typing = e
+	}
+}
+
+func validateSlidingSyncRequest(body *types.SlidingSyncRequest) error {
+	for name, list := range body.Lists {
+		for _, r := range list.Ranges {
+			if r[0] < 0 || r[1] < r[0] {
+				return fmt.Errorf("list %q has invalid range %v", name, r)
+			}
+		}
+		for _, s := range list.Sort {
+			switch s {
+			case types.SlidingSortByRecency, types.SlidingSortByName, types.SlidingSortByNotificationLevel:
+			default:
+				return fmt.Errorf("list %q has unknown sort %q", name, s)
+			}
+		}
+		if list.TimelineLimit < 0 {
+			return fmt.Errorf("list %q has negative timeline_limit", name)
+		}
+	}
+	for roomID, sub := range body.RoomSubscriptions {
+		if sub.TimelineLimit < 0 {
+			return fmt.Errorf("subscription to %q has negative timeline_limit", roomID)
+		}
+	}
+	return nil
+}
+
+// OnIncomingSlidingSyncRequest is called when a client makes a sliding sync
+// (MSC3575) request. Like OnIncomingSyncRequest, this function will block
+// until there is something to send to the client, or it times out.
+func (rp *RequestPool) OnIncomingSlidingSyncRequest(req *http.Request, device *userapi.Device) util.JSONResponse {
+	var body types.SlidingSyncRequest
+	data, err := io.ReadAll(req.Body)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be read. " + err.Error()),
+		}
+	}
+	if err = json.Unmarshal(data, &body); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+	if err = validateSlidingSyncRequest(&body); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(err.Error()),
+		}
+	}
+
+	pos := req.URL.Query().Get("pos")
+	key := slidingSyncConnKey{
+		userID:   device.UserID,
+		deviceID: device.ID,
+		connID:   body.ConnID,
+	}
+	conn := rp.slidingSync.get(key, pos == "")
+	if conn == nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.UnknownPos("Unknown connection, start again without a pos"),
+		}
+	}
+	conn.Lock()
+	defer conn.Unlock()
+	conn.lastUsed = time.Now()
+
+	var prev *slidingSyncPos
+	if pos != "" {
+		var ok bool
+		if prev, ok = conn.positions[pos]; !ok {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.UnknownPos("Unknown pos " + pos),
+			}
+		}
+	}
+	conn.update(&body)
+
+	activeSyncRequests.Inc()
+	defer activeSyncRequests.Dec()
+
+	rp.updateLastSeen(req, device)
+
+	logger := util.GetLogger(req.Context()).WithFields(logrus.Fields{
+		"user_id":   device.UserID,
+		"device_id": device.ID,
+		"conn_id":   body.ConnID,
+		"pos":       pos,
+	})
+	timeout := getTimeout(req.URL.Query().Get("timeout"))
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var toDeviceSince types.StreamPosition
+	if e := body.Extensions.ToDevice; e != nil && e.Since != "" {
+		var since int64
+		if since, err = strconv.ParseInt(e.Since, 10, 64); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Invalid to_device since token"),
+			}
+		}
+		toDeviceSince = types.StreamPosition(since)
+		// Clean up old send-to-device messages from before this position,
+		// the client has acknowledged them.
+		if err = rp.db.CleanSendToDeviceUpdates(req.Context(), device.UserID, device.ID, toDeviceSince); err != nil {
+			logger.WithError(err).Error("p.DB.CleanSendToDeviceUpdates failed")
+		}
+	}
+
+	waitingSyncRequests.Inc()
+	defer waitingSyncRequests.Dec()
+
+	for {
+		currentPos := rp.Notifier.CurrentPosition()
+		b := &slidingSyncBuilder{
+			rp:            rp,
+			ctx:           req.Context(),
+			log:           logger,
+			device:        device,
+			conn:          conn,
+			prev:          prev,
+			token:         currentPos,
+			toDeviceSince: toDeviceSince,
+		}
+		res, next, err := b.build()
+		if err != nil {
+			logger.WithError(err).Error("Failed to build sliding sync response")
+			return jsonerror.InternalServerError()
+		}
+		res.TxnID = body.TxnID
+
+		wait := prev != nil && body.TxnID == "" && !b.hasUpdates(res)
+		if wait {
+			listener := rp.Notifier.GetListener(types.SyncRequest{
+				Context: req.Context(),
+				Device:  device,
+			})
+			select {
+			case <-req.Context().Done(): // Caller gave up
+				listener.Close()
+				return util.JSONResponse{Code: http.StatusOK, JSON: rp.commitSlidingSync(conn, pos, prev, res, next)}
+			case <-timer.C: // Timeout reached
+				listener.Close()
+				return util.JSONResponse{Code: http.StatusOK, JSON: rp.commitSlidingSync(conn, pos, prev, res, next)}
+			case <-listener.GetNotifyChannel(currentPos):
+				listener.Close()
+				continue
+			}
+		}
+		return util.JSONResponse{Code: http.StatusOK, JSON: rp.commitSlidingSync(conn, pos, prev, res, next)}
+	}
+}
+
+// commitSlidingSync remembers the state for the response. We only keep the
+// state for the pos the request was made at, so that clients can retry a
+// request whose response they didn't receive, and the new pos.
+func (rp *RequestPool) commitSlidingSync(conn *slidingSyncConn, pos string, prev *slidingSyncPos, res *types.SlidingSyncResponse, next *slidingSyncPos) *types.SlidingSyncResponse {
+	conn.nextPos++
+	res.Pos = strconv.FormatInt(conn.nextPos, 10)
+	conn.positions = map[string]*slidingSyncPos{
+		res.Pos: next,
+	}
+	if prev != nil {
+		conn.positions[pos] = prev
+	}
+	return res
+}
+
+// slidingSyncRoom holds the information needed to filter and sort a room.
+// Some of it is only loaded when needed.
+type slidingSyncRoom struct {
+	roomID       string
+	membership   string
+	invite       *gomatrixserverlib.HeaderedEvent
+	latest       *types.StreamEvent
+	latestLoaded bool
+	loaded       bool
+	name         string
+	encrypted    bool
+	roomType     *string
+}
+
+type slidingSyncBuilder struct {
+	rp            *RequestPool
+	ctx           context.Context
+	log           *logrus.Entry
+	device        *userapi.Device
+	conn          *slidingSyncConn
+	prev          *slidingSyncPos
+	token         types.StreamingToken
+	toDeviceSince types.StreamPosition
+
+	rooms       map[string]*slidingSyncRoom
+	counts      map[string]*eventutil.NotificationData
+	accountData *userapi.QueryAccountDataResponse
+	directRooms map[string]struct{}
+	ignored     []string
+}
+
+func (b *slidingSyncBuilder) build() (*types.SlidingSyncResponse, *slidingSyncPos, error) {
+	res := &types.SlidingSyncResponse{
+		Lists: make(map[string]types.SlidingListResponse),
+		Rooms: make(map[string]*types.SlidingRoomResponse),
+	}
+	next := &slidingSyncPos{
+		token:   b.token,
+		counts:  make(map[string]int),
+		windows: make(map[string]map[[2]int][]string),
+		rooms:   make(map[string]slidingSyncRoomState),
+	}
+	if b.prev != nil {
+		for roomID, state := range b.prev.rooms {
+			next.rooms[roomID] = state
+		}
+	}
+	if err := b.load(); err != nil {
+		return nil, nil, err
+	}
+
+	// Work out the lists, and collect what to send for each room in the
+	// windows of the lists and for each room subscription.
+	subscriptions := make(map[string]types.SlidingRoomSubscription)
+	addSubscription := func(roomID string, sub types.SlidingRoomSubscription) {
+		existing := subscriptions[roomID]
+		existing.RequiredState = append(existing.RequiredState, sub.RequiredState...)
+		if sub.TimelineLimit > existing.TimelineLimit {
+			existing.TimelineLimit = sub.TimelineLimit
+		}
+		subscriptions[roomID] = existing
+	}
+	for name, list := range b.conn.lists {
+		roomIDs, err := b.listRooms(&list)
+		if err != nil {
+			return nil, nil, fmt.Errorf("b.listRooms: %w", err)
+		}
+		listRes := types.SlidingListResponse{
+			Count: len(roomIDs),
+		}
+		windows := make(map[[2]int][]string, len(list.Ranges))
+		for _, r := range list.Ranges {
+			var window []string
+			if r[0] < len(roomIDs) {
+				end := r[1] + 1
+				if end > len(roomIDs) {
+					end = len(roomIDs)
+				}
+				window = roomIDs[r[0]:end]
+			}
+			windows[r] = window
+			for _, roomID := range window {
+				addSubscription(roomID, list.SlidingRoomSubscription)
+			}
+			var prevWindow []string
+			if b.prev != nil {
+				prevWindow = b.prev.windows[name][r]
+			}
+			switch {
+			case len(window) == 0 && len(prevWindow) > 0:
+				listRes.Ops = append(listRes.Ops, types.SlidingOperation{
+					Op:    types.SlidingOpInvalidate,
+					Range: r,
+				})
+			case len(window) > 0 && !equalRoomIDs(window, prevWindow):
+				listRes.Ops = append(listRes.Ops, types.SlidingOperation{
+					Op:      types.SlidingOpSync,
+					Range:   [2]int{r[0], r[0] + len(window) - 1},
+					RoomIDs: window,
+				})
+			}
+		}
+		// Ranges which the client is no longer interested in are invalidated.
+		if b.prev != nil {
+			for r, prevWindow := range b.prev.windows[name] {
+				if _, ok := windows[r]; !ok && len(prevWindow) > 0 {
+					listRes.Ops = append(listRes.Ops, types.SlidingOperation{
+						Op:    types.SlidingOpInvalidate,
+						Range: r,
+					})
+				}
+			}
+		}
+		next.counts[name] = len(roomIDs)
+		next.windows[name] = windows
+		res.Lists[name] = listRes
+	}
+	for roomID, sub := range b.conn.subscriptions {
+		// Only send rooms the user is in or invited to.
+		if _, ok := b.rooms[roomID]; ok {
+			addSubscription(roomID, sub)
+		}
+	}
+
+	for roomID, sub := range subscriptions {
+		roomRes, state, err := b.room(b.rooms[roomID], sub, next.rooms)
+		if err != nil {
+			return nil, nil, fmt.Errorf("b.room: %w", err)
+		}
+		if roomRes != nil {
+			res.Rooms[roomID] = roomRes
+			next.rooms[roomID] = state
+		}
+	}
+
+	if err := b.extensions(res, subscriptions); err != nil {
+		return nil, nil, fmt.Errorf("b.extensions: %w", err)
+	}
+	return res, next, nil
+}
+
+func (b *slidingSyncBuilder) hasUpdates(res *types.SlidingSyncResponse) bool {
+	if len(res.Rooms) > 0 || !res.Extensions.IsEmpty() {
+		return true
+	}
+	for name, list := range res.Lists {
+		if len(list.Ops) > 0 {
+			return true
+		}
+		if count, ok := b.prev.counts[name]; !ok || count != list.Count {
+			return true
+		}
+	}
+	return false
+}
+
+func equalRoomIDs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// load fetches the rooms of the user along with everything else which is
+// needed for all of the rooms.
+func (b *slidingSyncBuilder) load() error {
+	b.rooms = make(map[string]*slidingSyncRoom)
+	joined, err := b.rp.db.RoomIDsWithMembership(b.ctx, b.device.UserID, gomatrixserverlib.Join)
+	if err != nil {
+		return fmt.Errorf("b.rp.db.RoomIDsWithMembership: %w", err)
+	}
+	for _, roomID := range joined {
+		b.rooms[roomID] = &slidingSyncRoom{
+			roomID:     roomID,
+			membership: gomatrixserverlib.Join,
+		}
+	}
+	invites, _, err := b.rp.db.InviteEventsInRange(b.ctx, b.device.UserID, types.Range{
+		From: 0,
+		To:   b.token.InvitePosition,
+	})
+	if err != nil {
+		return fmt.Errorf("b.rp.db.InviteEventsInRange: %w", err)
+	}
+	for roomID, invite := range invites {
+		if _, ok := b.rooms[roomID]; ok {
+			continue
+		}
+		b.rooms[roomID] = &slidingSyncRoom{
+			roomID:     roomID,
+			membership: gomatrixserverlib.Invite,
+			invite:     invite,
+		}
+	}
+
+	b.counts, err = b.rp.db.GetUserUnreadNotificationCounts(b.ctx, b.device.UserID, 0, b.token.NotificationDataPosition)
+	if err != nil {
+		return fmt.Errorf("b.rp.db.GetUserUnreadNotificationCounts: %w", err)
+	}
+
+	b.accountData = &userapi.QueryAccountDataResponse{}
+	if err = b.rp.userAPI.QueryAccountData(b.ctx, &userapi.QueryAccountDataRequest{
+		UserID: b.device.UserID,
+	}, b.accountData); err != nil {
+		return fmt.Errorf("b.rp.userAPI.QueryAccountData: %w", err)
+	}
+	b.directRooms = make(map[string]struct{})
+	if direct, ok := b.accountData.GlobalAccountData["m.direct"]; ok {
+		var content map[string][]string
+		if err = json.Unmarshal(direct, &content); err != nil {
+			b.log.WithError(err).Warn("Failed to unmarshal m.direct account data")
+		}
+		for _, roomIDs := range content {
+			for _, roomID := range roomIDs {
+				b.directRooms[roomID] = struct{}{}
+			}
+		}
+	}
+
+	ignores, err := b.rp.db.IgnoresForUser(b.ctx, b.device.UserID)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("b.rp.db.IgnoresForUser: %w", err)
+	}
+	if ignores != nil {
+		for userID := range ignores.List {
+			b.ignored = append(b.ignored, userID)
+		}
+	}
+	return nil
+}
+
+// latest returns the most recent event in the room, or nil if there isn't one.
+func (b *slidingSyncBuilder) latest(room *slidingSyncRoom) *types.StreamEvent {
+	b.loadLatest([]*slidingSyncRoom{room})
+	return room.latest
+}
+
+// loadLatest fetches the most recent events of the joined rooms in one go,
+// remembering which rooms don't have any so that they aren't queried again.
+func (b *slidingSyncBuilder) loadLatest(rooms []*slidingSyncRoom) {
+	pending := make(map[string]*slidingSyncRoom)
+	var roomIDs []string
+	for _, room := range rooms {
+		if !room.latestLoaded && room.membership == gomatrixserverlib.Join {
+			pending[room.roomID] = room
+			roomIDs = append(roomIDs, room.roomID)
+		}
+	}
+	if len(roomIDs) == 0 {
+		return
+	}
+	events, err := b.rp.db.LatestEvents(b.ctx, roomIDs, b.token.PDUPosition)
+	if err != nil {
+		b.log.WithError(err).Error("b.rp.db.LatestEvents failed")
+		return
+	}
+	for roomID, room := range pending {
+		room.latestLoaded = true
+		if ev, ok := events[roomID]; ok {
+			room.latest = &ev
+		}
+	}
+}
+
+func (b *slidingSyncBuilder) timestamp(room *slidingSyncRoom) gomatrixserverlib.Timestamp {
+	if room.invite != nil {
+		return room.invite.OriginServerTS()
+	}
+	if latest := b.latest(room); latest != nil {
+		return latest.OriginServerTS()
+	}
+	return 0
+}
+
+// details loads the name, encryption and type of the room.
+func (b *slidingSyncBuilder) details(room *slidingSyncRoom) *slidingSyncRoom {
+	if room.loaded {
+		return room
+	}
+	room.loaded = true
+	if room.invite != nil {
+		// We aren't in the room yet, so use the stripped state in the invite.
+		for _, raw := range gjson.GetBytes(room.invite.Unsigned(), "invite_room_state").Array() {
+			b.applyState(room, raw.Get("type").Str, []byte(raw.Get("content").Raw))
+		}
+		return room
+	}
+	for _, evType := range []string{
+		gomatrixserverlib.MRoomCreate, gomatrixserverlib.MRoomCanonicalAlias,
+		gomatrixserverlib.MRoomName, "m.room.encryption",
+	} {
+		ev, err := b.rp.db.GetStateEvent(b.ctx, room.roomID, evType, "")
+		if err != nil {
+			b.log.WithError(err).WithField("room_id", room.roomID).Error("b.rp.db.GetStateEvent failed")
+			continue
+		}
+		if ev != nil {
+			b.applyState(room, evType, ev.Content())
+		}
+	}
+	return room
+}
+
+func (b *slidingSyncBuilder) applyState(room *slidingSyncRoom, evType string, content []byte) {
+	switch evType {
+	case gomatrixserverlib.MRoomCreate:
+		if roomType := gjson.GetBytes(content, "type"); roomType.Exists() {
+			room.roomType = &roomType.Str
+		}
+	case gomatrixserverlib.MRoomCanonicalAlias:
+		if alias := gjson.GetBytes(content, "alias").Str; alias != "" && room.name == "" {
+			room.name = alias
+		}
+	case gomatrixserverlib.MRoomName:
+		if name := gjson.GetBytes(content, "name").Str; name != "" {
+			room.name = name
+		}
+	case "m.room.encryption":
+		room.encrypted = true
+	}
+}
+
+func (b *slidingSyncBuilder) isDM(roomID string) bool {
+	_, ok := b.directRooms[roomID]
+	return ok
+}
+
+func (b *slidingSyncBuilder) tags(roomID string) map[string]json.RawMessage {
+	var content struct {
+		Tags map[string]json.RawMessage `json:"tags"`
+	}
+	if data, ok := b.accountData.RoomAccountData[roomID]["m.tag"]; ok {
+		_ = json.Unmarshal(data, &content)
+	}
+	return content.Tags
+}
+
+func matchesRoomType(roomType *string, roomTypes []*string) bool {
+	for _, t := range roomTypes {
+		if (t == nil && roomType == nil) || (t != nil && roomType != nil && *t == *roomType) {
+			return true
+		}
+	}
+	return false
+}
+
+// spaceChildren returns the rooms which are children of the given spaces.
+func (b *slidingSyncBuilder) spaceChildren(spaces []string) (map[string]struct{}, error) {
+	children := make(map[string]struct{})
+	filter := gomatrixserverlib.DefaultStateFilter()
+	filter.Types = &[]string{"m.space.child"}
+	for _, spaceID := range spaces {
+		events, err := b.rp.db.GetStateEventsForRoom(b.ctx, spaceID, &filter)
+		if err != nil {
+			return nil, fmt.Errorf("b.rp.db.GetStateEventsForRoom: %w", err)
+		}
+		for _, ev := range events {
+			// Children are removed by sending an event without "via".
+			if ev.StateKey() != nil && len(gjson.GetBytes(ev.Content(), "via").Array()) > 0 {
+				children[*ev.StateKey()] = struct{}{}
+			}
+		}
+	}
+	return children, nil
+}
+
+func (b *slidingSyncBuilder) matchesFilter(room *slidingSyncRoom, f *types.SlidingListFilter, children map[string]struct{}) bool {
+	if f.IsDM != nil && *f.IsDM != b.isDM(room.roomID) {
+		return false
+	}
+	if f.IsInvite != nil && *f.IsInvite != (room.membership == gomatrixserverlib.Invite) {
+		return false
+	}
+	if f.IsEncrypted != nil && *f.IsEncrypted != b.details(room).encrypted {
+		return false
+	}
+	if f.RoomNameLike != "" && !strings.Contains(strings.ToLower(b.details(room).name), strings.ToLower(f.RoomNameLike)) {
+		return false
+	}
+	if len(f.RoomTypes) > 0 && !matchesRoomType(b.details(room).roomType, f.RoomTypes) {
+		return false
+	}
+	if len(f.NotRoomTypes) > 0 && matchesRoomType(b.details(room).roomType, f.NotRoomTypes) {
+		return false
+	}
+	if len(f.Tags) > 0 || len(f.NotTags) > 0 {
+		tags := b.tags(room.roomID)
+		for _, tag := range f.NotTags {
+			if _, ok := tags[tag]; ok {
+				return false
+			}
+		}
+		if len(f.Tags) > 0 {
+			found := false
+			for _, tag := range f.Tags {
+				if _, ok := tags[tag]; ok {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+	}
+	if children != nil {
+		if _, ok := children[room.roomID]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// listRooms returns the IDs of the rooms in the list, in order.
+func (b *slidingSyncBuilder) listRooms(list *types.SlidingList) ([]string, error) {
+	var children map[string]struct{}
+	if list.Filters != nil && len(list.Filters.Spaces) > 0 {
+		var err error
+		if children, err = b.spaceChildren(list.Filters.Spaces); err != nil {
+			return nil, err
+		}
+	}
+	rooms := make([]*slidingSyncRoom, 0, len(b.rooms))
+	for _, room := range b.rooms {
+		if list.Filters == nil || b.matchesFilter(room, list.Filters, children) {
+			rooms = append(rooms, room)
+		}
+	}
+	sorts := list.Sort
+	if len(sorts) == 0 {
+		sorts = []string{types.SlidingSortByRecency}
+	}
+	notificationLevel := func(roomID string) int {
+		counts := b.counts[roomID]
+		switch {
+		case counts == nil:
+			return 0
+		case counts.UnreadHighlightCount > 0:
+			return 2
+		case counts.UnreadNotificationCount > 0:
+			return 1
+		default:
+			return 0
+		}
+	}
+	// Work out the sort keys up front, rather than on every comparison.
+	type sortKeys struct {
+		room      *slidingSyncRoom
+		timestamp gomatrixserverlib.Timestamp
+		name      string
+		level     int
+	}
+	keys := make([]sortKeys, len(rooms))
+	for i, room := range rooms {
+		keys[i].room = room
+	}
+	for _, s := range sorts {
+		switch s {
+		case types.SlidingSortByRecency:
+			b.loadLatest(rooms)
+			for i := range keys {
+				keys[i].timestamp = b.timestamp(keys[i].room)
+			}
+		case types.SlidingSortByName:
+			for i := range keys {
+				keys[i].name = strings.ToLower(b.details(keys[i].room).name)
+			}
+		case types.SlidingSortByNotificationLevel:
+			for i := range keys {
+				keys[i].level = notificationLevel(keys[i].room.roomID)
+			}
+		}
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		for _, s := range sorts {
+			switch s {
+			case types.SlidingSortByRecency:
+				if ti, tj := keys[i].timestamp, keys[j].timestamp; ti != tj {
+					return ti > tj
+				}
+			case types.SlidingSortByName:
+				if ni, nj := keys[i].name, keys[j].name; ni != nj {
+					// Rooms without names go last.
+					if ni == "" || nj == "" {
+						return nj == ""
+					}
+					return ni < nj
+				}
+			case types.SlidingSortByNotificationLevel:
+				if li, lj := keys[i].level, keys[j].level; li != lj {
+					return li > lj
+				}
+			}
+		}
+		return keys[i].room.roomID < keys[j].room.roomID
+	})
+	roomIDs := make([]string, len(keys))
+	for i := range keys {
+		roomIDs[i] = keys[i].room.roomID
+	}
+	return roomIDs, nil
+}
+
+// room builds the response for a single room. Returns nil if there is nothing
+// new to send for the room.
+func (b *slidingSyncBuilder) room(
+	room *slidingSyncRoom, sub types.SlidingRoomSubscription, sent map[string]slidingSyncRoomState,
+) (*types.SlidingRoomResponse, slidingSyncRoomState, error) {
+	prevState, wasSent := sent[room.roomID]
+	state := slidingSyncRoomState{
+		position: b.token.PDUPosition,
+	}
+	if counts := b.counts[room.roomID]; counts != nil {
+		state.notificationCount = counts.UnreadNotificationCount
+		state.highlightCount = counts.UnreadHighlightCount
+	}
+	res := &types.SlidingRoomResponse{
+		Initial:           !wasSent,
+		IsDM:              b.isDM(room.roomID),
+		NotificationCount: state.notificationCount,
+		HighlightCount:    state.highlightCount,
+		Timestamp:         b.timestamp(room),
+	}
+	if !wasSent {
+		res.Name = b.details(room).name
+	}
+
+	if room.membership == gomatrixserverlib.Invite {
+		if wasSent {
+			return nil, prevState, nil
+		}
+		res.InviteState = types.NewInviteResponse(room.invite).InviteState.Events
+		return res, state, nil
+	}
+
+	latest := b.latest(room)
+	hasNewEvents := latest != nil && (!wasSent || latest.StreamPosition > prevState.position)
+	countsChanged := wasSent && (prevState.notificationCount != state.notificationCount || prevState.highlightCount != state.highlightCount)
+	if wasSent && !hasNewEvents && !countsChanged {
+		return nil, prevState, nil
+	}
+
+	if hasNewEvents && sub.TimelineLimit > 0 {
+		r := types.Range{
+			From:      b.token.PDUPosition,
+			To:        0,
+			Backwards: true,
+		}
+		if wasSent {
+			r = types.Range{
+				From: prevState.position,
+				To:   b.token.PDUPosition,
+			}
+		}
+		filter := gomatrixserverlib.DefaultRoomEventFilter()
+		filter.Limit = sub.TimelineLimit
+		if len(b.ignored) > 0 {
+			filter.NotSenders = &b.ignored
+		}
+		recentStreamEvents, limited, err := b.rp.db.RecentEvents(b.ctx, room.roomID, r, &filter, true, true)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, state, fmt.Errorf("b.rp.db.RecentEvents: %w", err)
+		}
+		recentEvents := b.rp.db.StreamEventsToEvents(b.device, recentStreamEvents)
+		events, err := b.applyHistoryVisibility(room.roomID, sub.TimelineLimit, recentEvents)
+		if err != nil {
+			b.log.WithError(err).Error("unable to apply history visibility filter")
+		}
+		if len(recentStreamEvents) > 0 {
+			prevBatch, err := b.rp.db.GetBackwardTopologyPos(b.ctx, recentStreamEvents)
+			if err != nil {
+				return nil, state, fmt.Errorf("b.rp.db.GetBackwardTopologyPos: %w", err)
+			}
+			res.PrevBatch = &prevBatch
+		}
+		res.Timeline = gomatrixserverlib.HeaderedToClientEvents(events, gomatrixserverlib.FormatSync)
+		res.Limited = limited && len(events) == len(recentEvents)
+		// If there's a gap in the timeline then the client might have missed
+		// state changes, so send the required state again.
+		if wasSent && limited {
+			res.Initial = true
+		}
+		if !wasSent || limited {
+			if res.RequiredState, err = b.requiredState(room.roomID, sub.RequiredState, events); err != nil {
+				return nil, state, err
+			}
+		}
+	} else if !wasSent {
+		var err error
+		if res.RequiredState, err = b.requiredState(room.roomID, sub.RequiredState, nil); err != nil {
+			return nil, state, err
+		}
+	}
+
+	if !wasSent {
+		joinedCount, err := b.rp.db.MembershipCount(b.ctx, room.roomID, gomatrixserverlib.Join, b.token.PDUPosition)
+		if err != nil {
+			return nil, state, fmt.Errorf("b.rp.db.MembershipCount: %w", err)
+		}
+		invitedCount, err := b.rp.db.MembershipCount(b.ctx, room.roomID, gomatrixserverlib.Invite, b.token.PDUPosition)
+		if err != nil {
+			return nil, state, fmt.Errorf("b.rp.db.MembershipCount: %w", err)
+		}
+		res.JoinedCount = joinedCount
+		res.InvitedCount = invitedCount
+	}
+	return res, state, nil
+}
+
+// applyHistoryVisibility removes events the user isn't allowed to see, always
+// keeping the current state events.
+func (b *slidingSyncBuilder) applyHistoryVisibility(
+	roomID string, limit int, events []*gomatrixserverlib.HeaderedEvent,
+) ([]*gomatrixserverlib.HeaderedEvent, error) {
+	stateEvents, err := b.rp.db.CurrentState(b.ctx, roomID, &gomatrixserverlib.StateFilter{Limit: limit * 2}, nil)
+	if err != nil {
+		b.log.WithError(err).Warn("failed to get current room state")
+	}
+	alwaysIncludeIDs := make(map[string]struct{}, len(stateEvents))
+	for _, ev := range stateEvents {
+		alwaysIncludeIDs[ev.EventID()] = struct{}{}
+	}
+	return internal.ApplyHistoryVisibilityFilter(b.ctx, b.rp.db, b.rp.rsAPI, events, alwaysIncludeIDs, b.device.UserID, "sync")
+}
+
+// requiredState returns the current state events of the room which match the
+// required_state of the subscription. The members of the timeline senders are
+// included for $LAZY.
+func (b *slidingSyncBuilder) requiredState(
+	roomID string, required [][2]string, timeline []*gomatrixserverlib.HeaderedEvent,
+) ([]gomatrixserverlib.ClientEvent, error) {
+	if len(required) == 0 {
+		return nil, nil
+	}
+	filter := gomatrixserverlib.DefaultStateFilter()
+	evTypes := make([]string, 0, len(required))
+	for _, r := range required {
+		if r[0] == types.SlidingStateKeyWildcard {
+			evTypes = nil
+			break
+		}
+		evTypes = append(evTypes, r[0])
+	}
+	if evTypes != nil {
+		filter.Types = &evTypes
+	}
+	stateEvents, err := b.rp.db.CurrentState(b.ctx, roomID, &filter, nil)
+	if err != nil {
+		return nil, fmt.Errorf("b.rp.db.CurrentState: %w", err)
+	}
+	senders := make(map[string]struct{}, len(timeline))
+	for _, ev := range timeline {
+		senders[ev.Sender()] = struct{}{}
+	}
+	matches := func(ev *gomatrixserverlib.HeaderedEvent) bool {
+		stateKey := *ev.StateKey()
+		for _, r := range required {
+			if r[0] != types.SlidingStateKeyWildcard && r[0] != ev.Type() {
+				continue
+			}
+			switch r[1] {
+			case types.SlidingStateKeyWildcard, stateKey:
+				return true
+			case types.SlidingStateKeyMe:
+				if stateKey == b.device.UserID {
+					return true
+				}
+			case types.SlidingStateKeyLazy:
+				if _, ok := senders[stateKey]; ok {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	result := make([]*gomatrixserverlib.HeaderedEvent, 0, len(stateEvents))
+	for _, ev := range stateEvents {
+		if ev.StateKey() != nil && matches(ev) {
+			result = append(result, ev)
+		}
+	}
+	return gomatrixserverlib.HeaderedToClientEvents(result, gomatrixserverlib.FormatSync), nil
+}
+
+// extensions fills in the extensions which are enabled on the connection,
+// using the stream providers of the normal /sync.
+func (b *slidingSyncBuilder) extensions(res *types.SlidingSyncResponse, rooms map[string]types.SlidingRoomSubscription) error {
+	ext := &b.conn.extensions
+	newSyncRequest := func(roomIDs map[string]string) *types.SyncRequest {
+		req := &types.SyncRequest{
+			Context:  b.ctx,
+			Log:      b.log,
+			Device:   b.device,
+			Response: types.NewResponse(),
+			Filter:   gomatrixserverlib.DefaultFilter(),
+			Rooms:    roomIDs,
+		}
+		req.IgnoredUsers.List = make(map[string]interface{}, len(b.ignored))
+		for _, userID := range b.ignored {
+			req.IgnoredUsers.List[userID] = nil
+		}
+		return req
+	}
+	var from types.StreamingToken
+	if b.prev != nil {
+		from = b.prev.token
+	}
+	streams := b.rp.streams
+
+	if ext.ToDevice != nil && ext.ToDevice.IsEnabled() {
+		req := newSyncRequest(nil)
+		pos := streams.SendToDeviceStreamProvider.IncrementalSync(b.ctx, req, b.toDeviceSince, b.token.SendToDevicePosition)
+		res.Extensions.ToDevice = &types.SlidingToDeviceResponse{
+			NextBatch: strconv.FormatInt(int64(pos), 10),
+			Events:    req.Response.ToDevice.Events,
+		}
+		if res.Extensions.ToDevice.Events == nil {
+			res.Extensions.ToDevice.Events = []gomatrixserverlib.SendToDeviceEvent{}
+		}
+	}
+
+	if ext.E2EE.IsEnabled() {
+		req := newSyncRequest(nil)
+		if b.prev != nil {
+			streams.DeviceListStreamProvider.IncrementalSync(b.ctx, req, from.DeviceListPosition, b.token.DeviceListPosition)
+		} else if err := internal.DeviceOTKCounts(b.ctx, b.rp.keyAPI, b.device.UserID, b.device.ID, req.Response); err != nil {
+			b.log.WithError(err).Warn("failed to get OTK counts")
+		}
+		e2ee := &types.SlidingE2EEResponse{
+			DeviceOneTimeKeysCount: req.Response.DeviceListsOTKCount,
+		}
+		e2ee.DeviceLists.Changed = req.Response.DeviceLists.Changed
+		e2ee.DeviceLists.Left = req.Response.DeviceLists.Left
+		res.Extensions.E2EE = e2ee
+	}
+
+	// Rooms which are new to the client get all of their account data and
+	// typing notifications, the rest only get what changed.
+	newRooms := make(map[string]string)
+	oldRooms := make(map[string]string)
+	for roomID := range rooms {
+		membership := b.rooms[roomID].membership
+		if roomRes, ok := res.Rooms[roomID]; ok && roomRes.Initial {
+			newRooms[roomID] = membership
+		} else {
+			oldRooms[roomID] = membership
+		}
+	}
+
+	if ext.AccountData.IsEnabled() {
+		accountData := &types.SlidingAccountDataResponse{
+			Rooms: make(map[string][]gomatrixserverlib.ClientEvent),
+		}
+		if b.prev == nil {
+			for dataType, data := range b.accountData.GlobalAccountData {
+				accountData.Global = append(accountData.Global, gomatrixserverlib.ClientEvent{
+					Type:    dataType,
+					Content: gomatrixserverlib.RawJSON(data),
+				})
+			}
+		} else {
+			req := newSyncRequest(oldRooms)
+			streams.AccountDataStreamProvider.IncrementalSync(b.ctx, req, from.AccountDataPosition, b.token.AccountDataPosition)
+			accountData.Global = req.Response.AccountData.Events
+			for roomID, jr := range req.Response.Rooms.Join {
+				if _, ok := oldRooms[roomID]; ok && len(jr.AccountData.Events) > 0 {
+					accountData.Rooms[roomID] = jr.AccountData.Events
+				}
+			}
+		}
+		for roomID := range newRooms {
+			for dataType, data := range b.accountData.RoomAccountData[roomID] {
+				accountData.Rooms[roomID] = append(accountData.Rooms[roomID], gomatrixserverlib.ClientEvent{
+					Type:    dataType,
+					Content: gomatrixserverlib.RawJSON(data),
+				})
+			}
+		}
+		res.Extensions.AccountData = accountData
+	}
+
+	if ext.Typing.IsEnabled() {
+		typing := &types.SlidingTypingResponse{
+			Rooms: make(map[string]gomatrixserverlib.ClientEvent),
+		}
+		for _, r := range []struct {
+			rooms map[string]string
+			from  types.StreamPosition
+		}{
+			{newRooms, 0},
+			{oldRooms, from.TypingPosition},
+		} {
+			req := newSyncRequest(r.rooms)
+			streams.TypingStreamProvider.IncrementalSync(b.ctx, req, r.from, b.token.TypingPosition)
+			for roomID, jr := range req.Response.Rooms.Join {
+				for _, ev := range jr.Ephemeral.Events {
+					typing.Rooms[roomID] = ev
+				}
+			}
+		}
+		res.Extensions.Typing = typing
+	}
+	return nil
+}
@@ -15,6 +15,7 @@ import (
 	"github.com/tidwall/gjson"
 
 	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/internal/eventutil"
 	keyapi "github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/dendrite/roomserver"
 	"github.com/matrix-org/dendrite/roomserver/api"
@@ -82,6 +83,10 @@ func (s *syncUserAPI) QueryAccessToken(ctx context.Context, req *userapi.QueryAc
 	return nil
 }
 
+func (s *syncUserAPI) QueryAccountData(ctx context.Context, req *userapi.QueryAccountDataRequest, res *userapi.QueryAccountDataResponse) error {
+	return nil
+}
+
 func (s *syncUserAPI) PerformLastSeenUpdate(ctx context.Context, req *userapi.PerformLastSeenUpdateRequest, res *userapi.PerformLastSeenUpdateResponse) error {
 	return nil
 }
@@ -630,6 +635,239 @@ func testSendToDevice(t *testing.T, dbType test.DBType) {
 	}
 }
 
+func TestSlidingSync(t *testing.T) {
+	test.WithAllDatabases(t, testSlidingSync)
+}
+
+func testSlidingSync(t *testing.T, dbType test.DBType) {
+	user := test.NewUser(t)
+	room := test.NewRoom(t, user)
+	alice := userapi.Device{
+		ID:          "ALICEID",
+		UserID:      user.ID,
+		AccessToken: "ALICE_BEARER_TOKEN",
+		DisplayName: "Alice",
+		AccountType: userapi.AccountTypeUser,
+	}
+
+	base, close := testrig.CreateBaseDendrite(t, dbType)
+	defer close()
+
+	jsctx, _ := base.NATS.Prepare(base.ProcessContext, &base.Cfg.Global.JetStream)
+	defer jetstream.DeleteAllStreams(jsctx, &base.Cfg.Global.JetStream)
+
+	AddPublicRoutes(base, &syncUserAPI{accounts: []userapi.Device{alice}}, &syncRoomserverAPI{rooms: []*test.Room{room}}, &syncKeyAPI{})
+	testrig.MustPublishMsgs(t, jsctx, toNATSMsgs(t, base, room.Events()...)...)
+	time.Sleep(100 * time.Millisecond)
+
+	slidingSync := func(pos string, body map[string]interface{}) (int, gjson.Result) {
+		w := httptest.NewRecorder()
+		base.PublicClientAPIMux.ServeHTTP(w, test.NewRequest(t, "POST", "/_matrix/client/unstable/org.matrix.msc3575/sync",
+			test.WithQueryParams(map[string]string{
+				"access_token": alice.AccessToken,
+				"timeout":      "0",
+				"pos":          pos,
+			}),
+			test.WithJSONBody(t, body),
+		))
+		return w.Code, gjson.Parse(w.Body.String())
+	}
+
+	// The initial request gets the room in the window along with its state and timeline.
+	code, res := slidingSync("", map[string]interface{}{
+		"lists": map[string]interface{}{
+			"all": map[string]interface{}{
+				"ranges":         [][2]int{{0, 9}},
+				"sort":           []string{"by_recency"},
+				"required_state": [][2]string{{"m.room.create", ""}},
+				"timeline_limit": 2,
+			},
+		},
+		"extensions": map[string]interface{}{
+			"to_device":    map[string]interface{}{"enabled": true},
+			"e2ee":         map[string]interface{}{"enabled": true},
+			"account_data": map[string]interface{}{"enabled": true},
+			"typing":       map[string]interface{}{"enabled": true},
+		},
+	})
+	if code != 200 {
+		t.Fatalf("got HTTP %d want 200: %s", code, res.Raw)
+	}
+	if count := res.Get("lists.all.count").Int(); count != 1 {
+		t.Fatalf("got list count %d want 1", count)
+	}
+	if got := res.Get("lists.all.ops.0.room_ids").String(); got != `["`+room.ID+`"]` {
+		t.Fatalf("got room IDs %s in SYNC op, want the room", got)
+	}
+	roomRes := res.Get("rooms").Map()[room.ID]
+	if !roomRes.Get("initial").Bool() {
+		t.Errorf("expected room to be initial: %s", roomRes.Raw)
+	}
+	if got := roomRes.Get("required_state.#.type").String(); got != `["m.room.create"]` {
+		t.Errorf("got required_state types %s, want the create event", got)
+	}
+	var gotEventIDs []string
+	for _, eventID := range roomRes.Get("timeline.#.event_id").Array() {
+		gotEventIDs = append(gotEventIDs, eventID.Str)
+	}
+	test.AssertEventIDsEqual(t, gotEventIDs, room.Events()[len(room.Events())-2:])
+	for _, ext := range []string{"to_device.next_batch", "e2ee", "account_data", "typing"} {
+		if !res.Get("extensions." + ext).Exists() {
+			t.Errorf("expected extensions.%s in the response: %s", ext, res.Raw)
+		}
+	}
+	pos := res.Get("pos").Str
+
+	// Nothing has changed, so the list and room are not sent again.
+	code, res = slidingSync(pos, map[string]interface{}{})
+	if code != 200 {
+		t.Fatalf("got HTTP %d want 200: %s", code, res.Raw)
+	}
+	if res.Get("lists.all.ops").Exists() || len(res.Get("rooms").Map()) != 0 {
+		t.Fatalf("expected no updates: %s", res.Raw)
+	}
+	pos = res.Get("pos").Str
+
+	// A new message is sent as an update to the room.
+	msg := room.CreateAndInsert(t, user, "m.room.message", map[string]interface{}{"body": "hello", "msgtype": "m.text"})
+	testrig.MustPublishMsgs(t, jsctx, toNATSMsgs(t, base, msg)...)
+	time.Sleep(100 * time.Millisecond)
+	code, res = slidingSync(pos, map[string]interface{}{})
+	if code != 200 {
+		t.Fatalf("got HTTP %d want 200: %s", code, res.Raw)
+	}
+	roomRes = res.Get("rooms").Map()[room.ID]
+	if roomRes.Get("initial").Bool() || roomRes.Get("required_state").Exists() {
+		t.Errorf("expected only the new timeline event: %s", roomRes.Raw)
+	}
+	if got := roomRes.Get("timeline.#.event_id").String(); got != `["`+msg.EventID()+`"]` {
+		t.Errorf("got timeline %s, want the new message", got)
+	}
+
+	// Unknown positions are rejected.
+	code, res = slidingSync("1000", map[string]interface{}{})
+	if code != 400 || res.Get("errcode").Str != "M_UNKNOWN_POS" {
+		t.Fatalf("got HTTP %d %s, want M_UNKNOWN_POS", code, res.Raw)
+	}
+}
+
+func TestPrivateAndThreadedReceipts(t *testing.T) {
+	test.WithAllDatabases(t, testPrivateAndThreadedReceipts)
+}
+
+func testPrivateAndThreadedReceipts(t *testing.T, dbType test.DBType) {
+	aliceUser := test.NewUser(t)
+	bobUser := test.NewUser(t)
+	room := test.NewRoom(t, aliceUser)
+	room.CreateAndInsert(t, bobUser, gomatrixserverlib.MRoomMember, map[string]interface{}{
+		"membership": "join",
+	}, test.WithStateKey(bobUser.ID))
+	alice := userapi.Device{
+		ID:          "ALICEID",
+		UserID:      aliceUser.ID,
+		AccessToken: "ALICE_BEARER_TOKEN",
+		AccountType: userapi.AccountTypeUser,
+	}
+	bob := userapi.Device{
+		ID:          "BOBID",
+		UserID:      bobUser.ID,
+		AccessToken: "BOB_BEARER_TOKEN",
+		AccountType: userapi.AccountTypeUser,
+	}
+
+	base, close := testrig.CreateBaseDendrite(t, dbType)
+	defer close()
+
+	jsctx, _ := base.NATS.Prepare(base.ProcessContext, &base.Cfg.Global.JetStream)
+	defer jetstream.DeleteAllStreams(jsctx, &base.Cfg.Global.JetStream)
+
+	AddPublicRoutes(base, &syncUserAPI{accounts: []userapi.Device{alice, bob}}, &syncRoomserverAPI{rooms: []*test.Room{room}}, &syncKeyAPI{})
+	testrig.MustPublishMsgs(t, jsctx, toNATSMsgs(t, base, room.Events()...)...)
+
+	producer := producers.SyncAPIProducer{
+		TopicReceiptEvent: base.Cfg.Global.JetStream.Prefixed(jetstream.OutputReceiptEvent),
+		JetStream:         jsctx,
+	}
+	ctx := context.Background()
+	eventID := room.Events()[len(room.Events())-1].EventID()
+	ts := gomatrixserverlib.AsTimestamp(time.Now())
+	if err := producer.SendReceipt(ctx, alice.UserID, room.ID, eventID, "m.read.private", "", ts); err != nil {
+		t.Fatalf("failed to send receipt: %s", err)
+	}
+	if err := producer.SendReceipt(ctx, bob.UserID, room.ID, eventID, "m.read", "main", ts); err != nil {
+		t.Fatalf("failed to send receipt: %s", err)
+	}
+
+	// alice has three unread notifications, two of which are in a thread
+	notificationData, err := json.Marshal(eventutil.NotificationData{
+		RoomID:                  room.ID,
+		UnreadNotificationCount: 3,
+		UnreadThreadNotifications: map[string]types.UnreadNotificationCounts{
+			"$root": {NotificationCount: 2},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal notification data: %s", err)
+	}
+	testrig.MustPublishMsgs(t, jsctx, &nats.Msg{
+		Subject: base.Cfg.Global.JetStream.Prefixed(jetstream.OutputNotificationData),
+		Header:  nats.Header{jetstream.UserID: []string{alice.UserID}},
+		Data:    notificationData,
+	})
+	time.Sleep(100 * time.Millisecond)
+
+	sync := func(device userapi.Device, filter string) gjson.Result {
+		w := httptest.NewRecorder()
+		base.PublicClientAPIMux.ServeHTTP(w, test.NewRequest(t, "GET", "/_matrix/client/v3/sync", test.WithQueryParams(map[string]string{
+			"access_token": device.AccessToken,
+			"timeout":      "0",
+			"filter":       filter,
+		})))
+		if w.Code != 200 {
+			t.Fatalf("got HTTP %d want 200: %s", w.Code, w.Body.String())
+		}
+		return gjson.Parse(w.Body.String()).Get("rooms.join").Map()[room.ID]
+	}
+	receiptContent := func(roomRes gjson.Result) gjson.Result {
+		for _, ev := range roomRes.Get("ephemeral.events").Array() {
+			if ev.Get("type").Str == gomatrixserverlib.MReceipt {
+				return ev.Get("content").Map()[eventID]
+			}
+		}
+		return gjson.Result{}
+	}
+
+	// bob only sees his own receipt
+	bobReceipts := receiptContent(sync(bob, ""))
+	if got := bobReceipts.Get(`m\.read`).Map()[bob.UserID].Get("thread_id").Str; got != "main" {
+		t.Errorf("got thread ID %q for bob's receipt, want main: %s", got, bobReceipts.Raw)
+	}
+	if bobReceipts.Get(`m\.read\.private`).Exists() {
+		t.Errorf("bob got alice's private receipt: %s", bobReceipts.Raw)
+	}
+
+	// alice sees her private receipt and the room counts, including threads
+	roomRes := sync(alice, "")
+	if !receiptContent(roomRes).Get(`m\.read\.private`).Map()[alice.UserID].Exists() {
+		t.Errorf("alice didn't get her private receipt: %s", roomRes.Get("ephemeral").Raw)
+	}
+	if got := roomRes.Get("unread_notifications.notification_count").Int(); got != 3 {
+		t.Errorf("got notification count %d want 3", got)
+	}
+	if roomRes.Get("unread_thread_notifications").Exists() {
+		t.Errorf("got unread_thread_notifications without asking for them: %s", roomRes.Raw)
+	}
+
+	// when asked for, the counts of threads are sent separately
+	roomRes = sync(alice, `{"room":{"timeline":{"unread_thread_notifications":true}}}`)
+	if got := roomRes.Get("unread_notifications.notification_count").Int(); got != 1 {
+		t.Errorf("got notification count %d want 1", got)
+	}
+	if got := roomRes.Get("unread_thread_notifications").Map()["$root"].Get("notification_count").Int(); got != 2 {
+		t.Errorf("got thread notification count %d want 2: %s", got, roomRes.Get("unread_thread_notifications").Raw)
+	}
+}
+
 func toNATSMsgs(t *testing.T, base *base.BaseDendrite, input ...*gomatrixserverlib.HeaderedEvent) []*nats.Msg {
 	result := make([]*nats.Msg, len(input))
 	for i, ev := range input {
@@ -0,0 +1,51 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"encoding/json"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+const unreadThreadNotificationsPath = "room.timeline.unread_thread_notifications"
+
+// Filter is a gomatrixserverlib.Filter which also keeps the filter options
+// that gomatrixserverlib doesn't know about yet, so that they survive
+// storing the filter.
+type Filter struct {
+	gomatrixserverlib.Filter
+	// UnreadThreadNotifications is set if the client wants the unread
+	// notification counts of threads separately from the room.
+	UnreadThreadNotifications bool
+}
+
+func (f Filter) MarshalJSON() ([]byte, error) {
+	data, err := json.Marshal(f.Filter)
+	if err != nil || !f.UnreadThreadNotifications {
+		return data, err
+	}
+	return sjson.SetBytes(data, unreadThreadNotificationsPath, true)
+}
+
+func (f *Filter) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &f.Filter); err != nil {
+		return err
+	}
+	f.UnreadThreadNotifications = gjson.GetBytes(data, unreadThreadNotificationsPath).Bool()
+	return nil
+}
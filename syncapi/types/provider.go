@@ -19,6 +19,10 @@ type SyncRequest struct {
 	Timeout       time.Duration
 	WantFullState bool
 
+	// Set if the filter asked for the unread notification counts of threads
+	// to be sent separately from the room counts.
+	UnreadThreadNotifications bool
+
 	// Updated by the PDU stream.
 	Rooms map[string]string
 	// Updated by the PDU stream.
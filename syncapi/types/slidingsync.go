@@ -0,0 +1,184 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"encoding/json"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// Sort orders for sliding sync lists.
+const (
+	SlidingSortByRecency           = "by_recency"
+	SlidingSortByName              = "by_name"
+	SlidingSortByNotificationLevel = "by_notification_level"
+)
+
+// Special values for the state key of required_state entries.
+const (
+	SlidingStateKeyWildcard = "*"
+	SlidingStateKeyLazy     = "$LAZY"
+	SlidingStateKeyMe       = "$ME"
+)
+
+// Sliding sync list operations.
+const (
+	SlidingOpSync       = "SYNC"
+	SlidingOpInvalidate = "INVALIDATE"
+)
+
+// SlidingSyncRequest is the body of a sliding sync (MSC3575) request.
+// https://github.com/matrix-org/matrix-spec-proposals/pull/3575
+type SlidingSyncRequest struct {
+	ConnID            string                             `json:"conn_id,omitempty"`
+	TxnID             string                             `json:"txn_id,omitempty"`
+	Lists             map[string]SlidingList             `json:"lists,omitempty"`
+	RoomSubscriptions map[string]SlidingRoomSubscription `json:"room_subscriptions,omitempty"`
+	UnsubscribeRooms  []string                           `json:"unsubscribe_rooms,omitempty"`
+	Extensions        SlidingExtensionsRequest           `json:"extensions,omitempty"`
+}
+
+// SlidingRoomSubscription describes which data to send for a room.
+type SlidingRoomSubscription struct {
+	RequiredState [][2]string `json:"required_state,omitempty"`
+	TimelineLimit int         `json:"timeline_limit,omitempty"`
+}
+
+// SlidingList is a sorted list of rooms, of which the client is only
+// interested in the rooms within Ranges.
+type SlidingList struct {
+	SlidingRoomSubscription
+	Ranges  [][2]int           `json:"ranges,omitempty"`
+	Sort    []string           `json:"sort,omitempty"`
+	Filters *SlidingListFilter `json:"filters,omitempty"`
+}
+
+// SlidingListFilter restricts which rooms appear in a list. Unset fields
+// don't filter anything.
+type SlidingListFilter struct {
+	IsDM         *bool     `json:"is_dm,omitempty"`
+	IsEncrypted  *bool     `json:"is_encrypted,omitempty"`
+	IsInvite     *bool     `json:"is_invite,omitempty"`
+	RoomNameLike string    `json:"room_name_like,omitempty"`
+	Tags         []string  `json:"tags,omitempty"`
+	NotTags      []string  `json:"not_tags,omitempty"`
+	RoomTypes    []*string `json:"room_types,omitempty"`
+	NotRoomTypes []*string `json:"not_room_types,omitempty"`
+	Spaces       []string  `json:"spaces,omitempty"`
+}
+
+type SlidingExtensionsRequest struct {
+	E2EE        *SlidingExtension         `json:"e2ee,omitempty"`
+	ToDevice    *SlidingToDeviceExtension `json:"to_device,omitempty"`
+	AccountData *SlidingExtension         `json:"account_data,omitempty"`
+	Typing      *SlidingExtension         `json:"typing,omitempty"`
+}
+
+type SlidingExtension struct {
+	Enabled *bool `json:"enabled,omitempty"`
+}
+
+// IsEnabled returns true if the extension was enabled on the connection.
+func (e *SlidingExtension) IsEnabled() bool {
+	return e != nil && e.Enabled != nil && *e.Enabled
+}
+
+type SlidingToDeviceExtension struct {
+	SlidingExtension
+	Since string `json:"since,omitempty"`
+}
+
+// SlidingSyncResponse is the response to a sliding sync request.
+type SlidingSyncResponse struct {
+	Pos        string                          `json:"pos"`
+	TxnID      string                          `json:"txn_id,omitempty"`
+	Lists      map[string]SlidingListResponse  `json:"lists"`
+	Rooms      map[string]*SlidingRoomResponse `json:"rooms"`
+	Extensions SlidingExtensionsResponse       `json:"extensions"`
+}
+
+type SlidingListResponse struct {
+	Count int                `json:"count"`
+	Ops   []SlidingOperation `json:"ops,omitempty"`
+}
+
+type SlidingOperation struct {
+	Op      string   `json:"op"`
+	Range   [2]int   `json:"range"`
+	RoomIDs []string `json:"room_ids,omitempty"`
+}
+
+type SlidingRoomResponse struct {
+	Name              string                          `json:"name,omitempty"`
+	RequiredState     []gomatrixserverlib.ClientEvent `json:"required_state,omitempty"`
+	Timeline          []gomatrixserverlib.ClientEvent `json:"timeline,omitempty"`
+	InviteState       []json.RawMessage               `json:"invite_state,omitempty"`
+	PrevBatch         *TopologyToken                  `json:"prev_batch,omitempty"`
+	Limited           bool                            `json:"limited,omitempty"`
+	Initial           bool                            `json:"initial,omitempty"`
+	IsDM              bool                            `json:"is_dm,omitempty"`
+	JoinedCount       int                             `json:"joined_count,omitempty"`
+	InvitedCount      int                             `json:"invited_count,omitempty"`
+	NotificationCount int                             `json:"notification_count"`
+	HighlightCount    int                             `json:"highlight_count"`
+	Timestamp         gomatrixserverlib.Timestamp     `json:"timestamp,omitempty"`
+}
+
+type SlidingExtensionsResponse struct {
+	E2EE        *SlidingE2EEResponse        `json:"e2ee,omitempty"`
+	ToDevice    *SlidingToDeviceResponse    `json:"to_device,omitempty"`
+	AccountData *SlidingAccountDataResponse `json:"account_data,omitempty"`
+	Typing      *SlidingTypingResponse      `json:"typing,omitempty"`
+}
+
+// IsEmpty returns true if none of the extensions have anything new to send.
+func (r *SlidingExtensionsResponse) IsEmpty() bool {
+	if r.E2EE != nil && (len(r.E2EE.DeviceLists.Changed) > 0 || len(r.E2EE.DeviceLists.Left) > 0) {
+		return false
+	}
+	if r.ToDevice != nil && len(r.ToDevice.Events) > 0 {
+		return false
+	}
+	if r.AccountData != nil && (len(r.AccountData.Global) > 0 || len(r.AccountData.Rooms) > 0) {
+		return false
+	}
+	if r.Typing != nil && len(r.Typing.Rooms) > 0 {
+		return false
+	}
+	return true
+}
+
+type SlidingE2EEResponse struct {
+	DeviceLists struct {
+		Changed []string `json:"changed,omitempty"`
+		Left    []string `json:"left,omitempty"`
+	} `json:"device_lists"`
+	DeviceOneTimeKeysCount map[string]int `json:"device_one_time_keys_count"`
+}
+
+type SlidingToDeviceResponse struct {
+	NextBatch string                                `json:"next_batch"`
+	Events    []gomatrixserverlib.SendToDeviceEvent `json:"events"`
+}
+
+type SlidingAccountDataResponse struct {
+	Global []gomatrixserverlib.ClientEvent            `json:"global,omitempty"`
+	Rooms  map[string][]gomatrixserverlib.ClientEvent `json:"rooms,omitempty"`
+}
+
+type SlidingTypingResponse struct {
+	Rooms map[string]gomatrixserverlib.ClientEvent `json:"rooms,omitempty"`
+}
@@ -0,0 +1,121 @@
+package test
+
+import (
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// SMTPMessage is an email received by an SMTPServer.
+type SMTPMessage struct {
+	From string
+	To   []string
+	Data string
+}
+
+// SMTPServer is a minimal SMTP server which accepts all emails sent to it,
+// for use in tests. It doesn't support STARTTLS or authentication.
+type SMTPServer struct {
+	Addr     string
+	listener net.Listener
+	mu       sync.Mutex
+	messages []SMTPMessage
+}
+
+// NewSMTPServer starts an SMTPServer listening on localhost, which is
+// closed once the test finishes.
+func NewSMTPServer(t *testing.T) *SMTPServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start SMTP server: %s", err)
+	}
+	s := &SMTPServer{
+		Addr:     listener.Addr().String(),
+		listener: listener,
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go s.serve()
+	return s
+}
+
+// Messages returns all emails received so far.
+func (s *SMTPServer) Messages() []SMTPMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]SMTPMessage(nil), s.messages...)
+}
+
+func (s *SMTPServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *SMTPServer) handle(conn net.Conn) {
+	defer conn.Close() // nolint: errcheck
+	c := textproto.NewConn(conn)
+	if err := c.PrintfLine("220 localhost ESMTP test server"); err != nil {
+		return
+	}
+	var msg SMTPMessage
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			err = c.PrintfLine("250 localhost")
+		case "MAIL":
+			msg = SMTPMessage{From: trimAddress(arg)}
+			err = c.PrintfLine("250 OK")
+		case "RCPT":
+			msg.To = append(msg.To, trimAddress(arg))
+			err = c.PrintfLine("250 OK")
+		case "DATA":
+			if err = c.PrintfLine("354 End data with <CR><LF>.<CR><LF>"); err != nil {
+				return
+			}
+			var data []byte
+			if data, err = io.ReadAll(c.DotReader()); err != nil {
+				return
+			}
+			msg.Data = string(data)
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.mu.Unlock()
+			err = c.PrintfLine("250 OK")
+		case "RSET", "NOOP":
+			err = c.PrintfLine("250 OK")
+		case "QUIT":
+			_ = c.PrintfLine("221 Bye")
+			return
+		default:
+			err = c.PrintfLine("502 Command not implemented")
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// trimAddress extracts the address from "FROM:<address>" or "TO:<address>".
+func trimAddress(arg string) string {
+	_, addr, _ := strings.Cut(arg, ":")
+	addr = strings.TrimSpace(addr)
+	if i := strings.Index(addr, ">"); i >= 0 {
+		addr = addr[:i]
+	}
+	return strings.TrimPrefix(addr, "<")
+}
@@ -71,18 +71,23 @@ type SyncUserAPI interface {
 	PerformDeviceUpdate(ctx context.Context, req *PerformDeviceUpdateRequest, res *PerformDeviceUpdateResponse) error
 	QueryDevices(ctx context.Context, req *QueryDevicesRequest, res *QueryDevicesResponse) error
 	QueryDeviceInfos(ctx context.Context, req *QueryDeviceInfosRequest, res *QueryDeviceInfosResponse) error
+	PerformDeviceDeletion(ctx context.Context, req *PerformDeviceDeletionRequest, res *PerformDeviceDeletionResponse) error
 }
 
 // api functions required by the client api
 type ClientUserAPI interface {
 	QueryAcccessTokenAPI
 	LoginTokenInternalAPI
+	RegistrationTokenInternalAPI
+	ThreePIDSessionInternalAPI
 	UserLoginAPI
 	QueryNumericLocalpart(ctx context.Context, res *QueryNumericLocalpartResponse) error
 	QueryDevices(ctx context.Context, req *QueryDevicesRequest, res *QueryDevicesResponse) error
 	QueryProfile(ctx context.Context, req *QueryProfileRequest, res *QueryProfileResponse) error
+	QuerySearchUserDirectory(ctx context.Context, req *QuerySearchUserDirectoryRequest, res *QuerySearchUserDirectoryResponse) error
 	QueryAccountData(ctx context.Context, req *QueryAccountDataRequest, res *QueryAccountDataResponse) error
 	QueryPushers(ctx context.Context, req *QueryPushersRequest, res *QueryPushersResponse) error
+	QueryPusherStatus(ctx context.Context, req *QueryPusherStatusRequest, res *QueryPusherStatusResponse) error
 	QueryPushRules(ctx context.Context, req *QueryPushRulesRequest, res *QueryPushRulesResponse) error
 	QueryAccountAvailability(ctx context.Context, req *QueryAccountAvailabilityRequest, res *QueryAccountAvailabilityResponse) error
 	PerformAccountCreation(ctx context.Context, req *PerformAccountCreationRequest, res *PerformAccountCreationResponse) error
@@ -94,6 +99,7 @@ type ClientUserAPI interface {
 	PerformPusherSet(ctx context.Context, req *PerformPusherSetRequest, res *struct{}) error
 	PerformPushRulesPut(ctx context.Context, req *PerformPushRulesPutRequest, res *struct{}) error
 	PerformAccountDeactivation(ctx context.Context, req *PerformAccountDeactivationRequest, res *PerformAccountDeactivationResponse) error
+	PerformAccountShadowBan(ctx context.Context, req *PerformAccountShadowBanRequest, res *PerformAccountShadowBanResponse) error
 	PerformOpenIDTokenCreation(ctx context.Context, req *PerformOpenIDTokenCreationRequest, res *PerformOpenIDTokenCreationResponse) error
 	SetAvatarURL(ctx context.Context, req *PerformSetAvatarURLRequest, res *PerformSetAvatarURLResponse) error
 	SetDisplayName(ctx context.Context, req *PerformUpdateDisplayNameRequest, res *struct{}) error
@@ -254,6 +260,10 @@ type QueryAccessTokenRequest struct {
 	// optional user ID, valid only if the token is an appservice.
 	// https://matrix.org/docs/spec/application_service/r0.1.2#using-sync-and-events
 	AppServiceUserID string
+	// optional device ID of the user, valid only if the token is an appservice
+	// which has enabled MSC3202.
+	// https://github.com/matrix-org/matrix-spec-proposals/pull/3202
+	AppServiceDeviceID string
 }
 
 // QueryAccessTokenResponse is the response for QueryAccessToken
@@ -316,6 +326,25 @@ type QuerySearchProfilesResponse struct {
 	Profiles []authtypes.Profile
 }
 
+// QuerySearchUserDirectoryRequest is the request for QuerySearchUserDirectory
+type QuerySearchUserDirectoryRequest struct {
+	// The user who is searching
+	UserID string
+	// The search string to match
+	SearchString string
+	// How many results to return
+	Limit int
+}
+
+// QuerySearchUserDirectoryResponse is the response for QuerySearchUserDirectoryRequest
+type QuerySearchUserDirectoryResponse struct {
+	// Users matching the search, ordered by the number of rooms they share
+	// with the searching user
+	Results []authtypes.FullyQualifiedProfile
+	// True if there were more results than the limit
+	Limited bool
+}
+
 // PerformAccountCreationRequest is the request for PerformAccountCreation
 type PerformAccountCreationRequest struct {
 	AccountType AccountType // Required: whether this is a guest or user account
@@ -392,6 +421,17 @@ type PerformAccountDeactivationResponse struct {
 	AccountDeactivated bool
 }
 
+// PerformAccountShadowBanRequest is the request for PerformAccountShadowBan
+type PerformAccountShadowBanRequest struct {
+	Localpart    string
+	ShadowBanned bool // true to shadow-ban the account, false to lift the shadow-ban
+}
+
+// PerformAccountShadowBanResponse is the response for PerformAccountShadowBan
+type PerformAccountShadowBanResponse struct {
+	AccountExists bool
+}
+
 // PerformOpenIDTokenCreationRequest is the request for PerformOpenIDTokenCreation
 type PerformOpenIDTokenCreationRequest struct {
 	UserID string
@@ -432,6 +472,9 @@ type Device struct {
 	// this is the appservice ID.
 	AppserviceID string
 	AccountType  AccountType
+	// If the account has been shadow-banned, requests from this device
+	// should appear to succeed without having any real effect.
+	ShadowBanned bool
 }
 
 // Account represents a Matrix account on this home server.
@@ -441,6 +484,7 @@ type Account struct {
 	ServerName   gomatrixserverlib.ServerName
 	AppServiceID string
 	AccountType  AccountType
+	ShadowBanned bool
 	// TODO: Associations (e.g. with application services)
 }
 
@@ -510,6 +554,32 @@ type QueryPushersResponse struct {
 	Pushers []Pusher `json:"pushers"`
 }
 
+type QueryPusherStatusRequest struct {
+	Localpart string
+}
+
+type QueryPusherStatusResponse struct {
+	Pushers []PusherStatus `json:"pushers"`
+}
+
+// PusherStatus is a pusher along with the state of deliveries to it.
+type PusherStatus struct {
+	Pusher
+	Failure *PusherFailure `json:"failure,omitempty"`
+}
+
+// PusherFailure describes the failed deliveries to a pusher since the last
+// successful one.
+type PusherFailure struct {
+	AppID           string `json:"-"`
+	PushKey         string `json:"-"`
+	FailureCount    int64  `json:"failure_count"`    // consecutive failed deliveries
+	LastFailureTS   int64  `json:"last_failure_ts"`  // when the last delivery failed
+	LastError       string `json:"last_error"`       // why the last delivery failed
+	BackoffUntilTS  int64  `json:"backoff_until_ts"` // no deliveries are attempted until then
+	DeadLetterCount int64  `json:"dead_letter_count"`
+}
+
 type PerformPusherSetRequest struct {
 	Pusher    // Anonymous field because that's how clientapi unmarshals it.
 	Localpart string
@@ -0,0 +1,138 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type RegistrationTokenInternalAPI interface {
+	// PerformRegistrationTokenCreation creates a new registration token. If
+	// no token is given in the request then a random one will be generated.
+	PerformRegistrationTokenCreation(ctx context.Context, req *PerformRegistrationTokenCreationRequest, res *PerformRegistrationTokenCreationResponse) error
+
+	// PerformRegistrationTokenUpdate updates the uses allowed and/or the
+	// expiry time of an existing registration token.
+	PerformRegistrationTokenUpdate(ctx context.Context, req *PerformRegistrationTokenUpdateRequest, res *PerformRegistrationTokenUpdateResponse) error
+
+	// PerformRegistrationTokenDeletion deletes a registration token.
+	PerformRegistrationTokenDeletion(ctx context.Context, req *PerformRegistrationTokenDeletionRequest, res *PerformRegistrationTokenDeletionResponse) error
+
+	// PerformRegistrationTokenUse updates the pending and completed counters
+	// of a registration token as a registration progresses.
+	PerformRegistrationTokenUse(ctx context.Context, req *PerformRegistrationTokenUseRequest, res *PerformRegistrationTokenUseResponse) error
+
+	// QueryRegistrationTokens returns registration tokens, optionally
+	// filtered by token or by validity.
+	QueryRegistrationTokens(ctx context.Context, req *QueryRegistrationTokensRequest, res *QueryRegistrationTokensResponse) error
+}
+
+// RegistrationToken is a token which can be used to complete the
+// m.login.registration_token registration stage.
+type RegistrationToken struct {
+	Token string `json:"token"`
+	// UsesAllowed is the number of times the token can be used to complete
+	// a registration. If nil, the token can be used an unlimited number of times.
+	UsesAllowed *int32 `json:"uses_allowed"`
+	// Pending is the number of registrations in progress using the token.
+	Pending int32 `json:"pending"`
+	// Completed is the number of registrations completed using the token.
+	Completed int32 `json:"completed"`
+	// ExpiryTime is when the token expires. If nil, the token does not expire.
+	ExpiryTime *gomatrixserverlib.Timestamp `json:"expiry_time"`
+}
+
+// IsValid returns true if the token can be used to start a new registration
+// at the given time.
+func (t *RegistrationToken) IsValid(now time.Time) bool {
+	if t.ExpiryTime != nil && !now.Before(t.ExpiryTime.Time()) {
+		return false
+	}
+	if t.UsesAllowed != nil && t.Pending+t.Completed >= *t.UsesAllowed {
+		return false
+	}
+	return true
+}
+
+type PerformRegistrationTokenCreationRequest struct {
+	Token       string // optional: if blank, a token of Length characters will be generated
+	Length      int    // optional: the length of the generated token, defaults to 16
+	UsesAllowed *int32
+	ExpiryTime  *gomatrixserverlib.Timestamp
+}
+
+type PerformRegistrationTokenCreationResponse struct {
+	Token   *RegistrationToken
+	Created bool // false if the token already exists
+}
+
+type PerformRegistrationTokenUpdateRequest struct {
+	Token string
+	// UpdateUsesAllowed and UpdateExpiryTime control whether the respective
+	// fields are changed, so that they can be cleared by setting them to nil.
+	UpdateUsesAllowed bool
+	UsesAllowed       *int32
+	UpdateExpiryTime  bool
+	ExpiryTime        *gomatrixserverlib.Timestamp
+}
+
+type PerformRegistrationTokenUpdateResponse struct {
+	Token *RegistrationToken // nil if the token doesn't exist
+}
+
+type PerformRegistrationTokenDeletionRequest struct {
+	Token string
+}
+
+type PerformRegistrationTokenDeletionResponse struct {
+	Deleted bool // false if the token doesn't exist
+}
+
+// RegistrationTokenUse describes a change in the usage of a registration token.
+type RegistrationTokenUse int
+
+const (
+	// RegistrationTokenUseBegin marks the token as pending for a registration,
+	// if the token is still valid.
+	RegistrationTokenUseBegin RegistrationTokenUse = iota + 1
+	// RegistrationTokenUseComplete turns a pending use into a completed one.
+	RegistrationTokenUseComplete
+	// RegistrationTokenUseRelease releases a pending use, e.g. because the
+	// registration session expired before being completed.
+	RegistrationTokenUseRelease
+)
+
+type PerformRegistrationTokenUseRequest struct {
+	Token string
+	Use   RegistrationTokenUse
+}
+
+type PerformRegistrationTokenUseResponse struct {
+	// Valid is set for RegistrationTokenUseBegin if the token was valid
+	// and has been marked as pending.
+	Valid bool
+}
+
+type QueryRegistrationTokensRequest struct {
+	Token string // optional: only return this token
+	Valid *bool  // optional: only return valid (true) or invalid (false) tokens
+}
+
+type QueryRegistrationTokensResponse struct {
+	Tokens []RegistrationToken
+}
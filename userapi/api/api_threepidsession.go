@@ -0,0 +1,103 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type ThreePIDSessionInternalAPI interface {
+	// PerformThreePIDSessionCreation creates a session to validate a third-party
+	// identifier, or returns the existing session for the same client secret and
+	// identifier. Clients can ask for the validation token to be sent again by
+	// incrementing the send attempt.
+	PerformThreePIDSessionCreation(ctx context.Context, req *PerformThreePIDSessionCreationRequest, res *PerformThreePIDSessionCreationResponse) error
+
+	// PerformThreePIDSessionValidation marks a session as validated if the
+	// client secret and the validation token match.
+	PerformThreePIDSessionValidation(ctx context.Context, req *PerformThreePIDSessionValidationRequest, res *PerformThreePIDSessionValidationResponse) error
+
+	// PerformThreePIDSessionDeletion deletes a session once it has been used.
+	PerformThreePIDSessionDeletion(ctx context.Context, req *PerformThreePIDSessionDeletionRequest, res *struct{}) error
+
+	// QueryThreePIDSession returns a session which hasn't expired yet.
+	QueryThreePIDSession(ctx context.Context, req *QueryThreePIDSessionRequest, res *QueryThreePIDSessionResponse) error
+}
+
+// ThreePIDSession is a session used to validate that a user owns a
+// third-party identifier, e.g. an email address.
+type ThreePIDSession struct {
+	SessionID    string
+	ClientSecret string
+	Medium       string
+	Address      string
+	// Token is the validation token sent to the user. It is never returned
+	// by QueryThreePIDSession.
+	Token       string
+	SendAttempt int
+	NextLink    string
+	// ValidatedAt is zero if the session hasn't been validated yet.
+	ValidatedAt gomatrixserverlib.Timestamp
+	ExpiresAt   gomatrixserverlib.Timestamp
+}
+
+// Validated returns true if the session has been validated.
+func (s *ThreePIDSession) Validated() bool {
+	return s.ValidatedAt != 0
+}
+
+type PerformThreePIDSessionCreationRequest struct {
+	ClientSecret string
+	Medium       string
+	Address      string
+	SendAttempt  int
+	NextLink     string
+}
+
+type PerformThreePIDSessionCreationResponse struct {
+	SessionID string
+	// Token is the validation token to send to the user. It is only set
+	// if Send is true.
+	Token string
+	// Send is true if the validation token should be sent to the user,
+	// i.e. this is a new session or a new send attempt.
+	Send bool
+}
+
+type PerformThreePIDSessionValidationRequest struct {
+	SessionID    string
+	ClientSecret string
+	Token        string
+}
+
+type PerformThreePIDSessionValidationResponse struct {
+	Validated bool // false if the session doesn't exist, has expired or the token is wrong
+	NextLink  string
+}
+
+type PerformThreePIDSessionDeletionRequest struct {
+	SessionID string
+}
+
+type QueryThreePIDSessionRequest struct {
+	SessionID    string
+	ClientSecret string
+}
+
+type QueryThreePIDSessionResponse struct {
+	Session *ThreePIDSession // nil if the session doesn't exist, has expired or the client secret is wrong
+}
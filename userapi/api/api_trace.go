@@ -44,6 +44,12 @@ func (t *UserInternalAPITrace) PerformPasswordUpdate(ctx context.Context, req *P
 	return err
 }
 
+func (t *UserInternalAPITrace) PerformAccountShadowBan(ctx context.Context, req *PerformAccountShadowBanRequest, res *PerformAccountShadowBanResponse) error {
+	err := t.Impl.PerformAccountShadowBan(ctx, req, res)
+	util.GetLogger(ctx).Infof("PerformAccountShadowBan req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
 func (t *UserInternalAPITrace) PerformDeviceCreation(ctx context.Context, req *PerformDeviceCreationRequest, res *PerformDeviceCreationResponse) error {
 	err := t.Impl.PerformDeviceCreation(ctx, req, res)
 	util.GetLogger(ctx).Infof("PerformDeviceCreation req=%+v res=%+v", js(req), js(res))
@@ -129,6 +135,11 @@ func (t *UserInternalAPITrace) QuerySearchProfiles(ctx context.Context, req *Que
 	util.GetLogger(ctx).Infof("QuerySearchProfiles req=%+v res=%+v", js(req), js(res))
 	return err
 }
+func (t *UserInternalAPITrace) QuerySearchUserDirectory(ctx context.Context, req *QuerySearchUserDirectoryRequest, res *QuerySearchUserDirectoryResponse) error {
+	err := t.Impl.QuerySearchUserDirectory(ctx, req, res)
+	util.GetLogger(ctx).Infof("QuerySearchUserDirectory req=%+v res=%+v", js(req), js(res))
+	return err
+}
 func (t *UserInternalAPITrace) QueryOpenIDToken(ctx context.Context, req *QueryOpenIDTokenRequest, res *QueryOpenIDTokenResponse) error {
 	err := t.Impl.QueryOpenIDToken(ctx, req, res)
 	util.GetLogger(ctx).Infof("QueryOpenIDToken req=%+v res=%+v", js(req), js(res))
@@ -139,6 +150,11 @@ func (t *UserInternalAPITrace) QueryPushers(ctx context.Context, req *QueryPushe
 	util.GetLogger(ctx).Infof("QueryPushers req=%+v res=%+v", js(req), js(res))
 	return err
 }
+func (t *UserInternalAPITrace) QueryPusherStatus(ctx context.Context, req *QueryPusherStatusRequest, res *QueryPusherStatusResponse) error {
+	err := t.Impl.QueryPusherStatus(ctx, req, res)
+	util.GetLogger(ctx).Infof("QueryPusherStatus req=%+v res=%+v", js(req), js(res))
+	return err
+}
 func (t *UserInternalAPITrace) QueryPushRules(ctx context.Context, req *QueryPushRulesRequest, res *QueryPushRulesResponse) error {
 	err := t.Impl.QueryPushRules(ctx, req, res)
 	util.GetLogger(ctx).Infof("QueryPushRules req=%+v res=%+v", js(req), js(res))
@@ -0,0 +1,51 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+
+	"github.com/matrix-org/util"
+)
+
+func (t *UserInternalAPITrace) PerformRegistrationTokenCreation(ctx context.Context, req *PerformRegistrationTokenCreationRequest, res *PerformRegistrationTokenCreationResponse) error {
+	err := t.Impl.PerformRegistrationTokenCreation(ctx, req, res)
+	util.GetLogger(ctx).Infof("PerformRegistrationTokenCreation req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+func (t *UserInternalAPITrace) PerformRegistrationTokenUpdate(ctx context.Context, req *PerformRegistrationTokenUpdateRequest, res *PerformRegistrationTokenUpdateResponse) error {
+	err := t.Impl.PerformRegistrationTokenUpdate(ctx, req, res)
+	util.GetLogger(ctx).Infof("PerformRegistrationTokenUpdate req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+func (t *UserInternalAPITrace) PerformRegistrationTokenDeletion(ctx context.Context, req *PerformRegistrationTokenDeletionRequest, res *PerformRegistrationTokenDeletionResponse) error {
+	err := t.Impl.PerformRegistrationTokenDeletion(ctx, req, res)
+	util.GetLogger(ctx).Infof("PerformRegistrationTokenDeletion req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+func (t *UserInternalAPITrace) PerformRegistrationTokenUse(ctx context.Context, req *PerformRegistrationTokenUseRequest, res *PerformRegistrationTokenUseResponse) error {
+	err := t.Impl.PerformRegistrationTokenUse(ctx, req, res)
+	util.GetLogger(ctx).Infof("PerformRegistrationTokenUse req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+func (t *UserInternalAPITrace) QueryRegistrationTokens(ctx context.Context, req *QueryRegistrationTokensRequest, res *QueryRegistrationTokensResponse) error {
+	err := t.Impl.QueryRegistrationTokens(ctx, req, res)
+	util.GetLogger(ctx).Infof("QueryRegistrationTokens req=%+v res=%+v", js(req), js(res))
+	return err
+}
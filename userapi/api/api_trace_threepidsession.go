@@ -0,0 +1,45 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+
+	"github.com/matrix-org/util"
+)
+
+func (t *UserInternalAPITrace) PerformThreePIDSessionCreation(ctx context.Context, req *PerformThreePIDSessionCreationRequest, res *PerformThreePIDSessionCreationResponse) error {
+	err := t.Impl.PerformThreePIDSessionCreation(ctx, req, res)
+	util.GetLogger(ctx).Infof("PerformThreePIDSessionCreation req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+func (t *UserInternalAPITrace) PerformThreePIDSessionValidation(ctx context.Context, req *PerformThreePIDSessionValidationRequest, res *PerformThreePIDSessionValidationResponse) error {
+	err := t.Impl.PerformThreePIDSessionValidation(ctx, req, res)
+	util.GetLogger(ctx).Infof("PerformThreePIDSessionValidation req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+func (t *UserInternalAPITrace) PerformThreePIDSessionDeletion(ctx context.Context, req *PerformThreePIDSessionDeletionRequest, res *struct{}) error {
+	err := t.Impl.PerformThreePIDSessionDeletion(ctx, req, res)
+	util.GetLogger(ctx).Infof("PerformThreePIDSessionDeletion req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+func (t *UserInternalAPITrace) QueryThreePIDSession(ctx context.Context, req *QueryThreePIDSessionRequest, res *QueryThreePIDSessionResponse) error {
+	err := t.Impl.QueryThreePIDSession(ctx, req, res)
+	util.GetLogger(ctx).Infof("QueryThreePIDSession req=%+v res=%+v", js(req), js(res))
+	return err
+}
@@ -0,0 +1,295 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/email"
+	rsapi "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage"
+	"github.com/matrix-org/dendrite/userapi/storage/tables"
+	"github.com/matrix-org/gomatrixserverlib"
+	log "github.com/sirupsen/logrus"
+)
+
+// The most notifications that are included in a single email.
+const emailNotificationLimit = 100
+
+// EmailNotifier periodically emails the unread notifications of users to
+// their email pushers. Notifications are only emailed once the oldest of
+// them has been unread for user_api.email_notification_delay, so that
+// users who are active in a client don't get emails, and the rest get a
+// single digest rather than an email per notification.
+type EmailNotifier struct {
+	ctx       context.Context
+	cfg       *config.UserAPI
+	db        storage.Database
+	rsAPI     rsapi.UserRoomserverAPI
+	sender    email.Sender
+	templates *email.Templates
+	interval  time.Duration
+}
+
+func NewEmailNotifier(
+	process *process.ProcessContext,
+	cfg *config.UserAPI,
+	store storage.Database,
+	rsAPI rsapi.UserRoomserverAPI,
+) (*EmailNotifier, error) {
+	sender, err := email.NewSMTPSender(&cfg.Matrix.Email)
+	if err != nil {
+		return nil, err
+	}
+	templates, err := email.LoadTemplates(string(cfg.Matrix.Email.TemplatesPath))
+	if err != nil {
+		return nil, err
+	}
+	interval := time.Minute
+	if cfg.EmailNotificationDelay < interval {
+		interval = cfg.EmailNotificationDelay
+	}
+	return &EmailNotifier{
+		ctx:       process.Context(),
+		cfg:       cfg,
+		db:        store,
+		rsAPI:     rsAPI,
+		sender:    sender,
+		templates: templates,
+		interval:  interval,
+	}, nil
+}
+
+func (n *EmailNotifier) Start() {
+	go func() {
+		ticker := time.NewTicker(n.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-n.ctx.Done():
+				return
+			case <-ticker.C:
+				n.notifyAll(n.ctx)
+			}
+		}
+	}()
+}
+
+// notifyAll emails the due notifications to all email pushers.
+func (n *EmailNotifier) notifyAll(ctx context.Context) {
+	pushers, err := n.db.GetPushersByKind(ctx, api.EmailKind)
+	if err != nil {
+		log.WithError(err).Error("userapi email notifier: failed to get email pushers")
+		return
+	}
+	for localpart, pushers := range pushers {
+		for i := range pushers {
+			n.notifyPusher(ctx, localpart, &pushers[i])
+		}
+	}
+}
+
+// notifyPusher emails the notifications of the user which haven't been
+// emailed to the pusher yet, if the oldest of them is due.
+func (n *EmailNotifier) notifyPusher(ctx context.Context, localpart string, pusher *api.Pusher) {
+	logger := log.WithFields(log.Fields{
+		"localpart": localpart,
+		"app_id":    pusher.AppID,
+	})
+
+	lastID, err := n.db.GetPusherLastEmailedNotificationID(ctx, localpart, pusher.AppID, pusher.PushKey)
+	if err != nil {
+		logger.WithError(err).Error("userapi email notifier: failed to get email pusher state")
+		return
+	}
+	notifs, maxID, err := n.db.GetNotifications(ctx, localpart, lastID, emailNotificationLimit, tables.AllNotifications)
+	if err != nil {
+		logger.WithError(err).Error("userapi email notifier: failed to get notifications")
+		return
+	}
+	// Notifications are returned oldest first. The ones which have been read
+	// already are never emailed.
+	unread := make([]*api.Notification, 0, len(notifs))
+	for _, notif := range notifs {
+		if !notif.Read {
+			unread = append(unread, notif)
+		}
+	}
+	if len(unread) == 0 {
+		if len(notifs) > 0 {
+			if err = n.db.SetPusherLastEmailedNotificationID(ctx, localpart, pusher.AppID, pusher.PushKey, maxID); err != nil {
+				logger.WithError(err).Error("userapi email notifier: failed to store email pusher state")
+			}
+		}
+		return
+	}
+	if time.Since(unread[0].TS.Time()) < n.cfg.EmailNotificationDelay {
+		return
+	}
+	notifs = unread
+
+	userID := fmt.Sprintf("@%s:%s", localpart, n.cfg.Matrix.ServerName)
+	unsubscribeURL := email.UnsubscribeURL(n.cfg.Matrix, userID, pusher.AppID, pusher.PushKey)
+	msg, err := n.templates.Render(email.TemplateNotification, email.NotificationTemplateData{
+		ServerName:        string(n.cfg.Matrix.ServerName),
+		UserID:            userID,
+		NotificationCount: len(notifs),
+		Rooms:             n.groupByRoom(ctx, notifs),
+		UnsubscribeLink:   unsubscribeURL,
+	})
+	if err != nil {
+		logger.WithError(err).Error("userapi email notifier: failed to render email")
+		return
+	}
+	msg.To = pusher.PushKey
+	msg.UnsubscribeURL = unsubscribeURL
+
+	failure, err := n.db.GetPusherFailure(ctx, localpart, pusher.AppID, pusher.PushKey)
+	if err != nil {
+		logger.WithError(err).Error("userapi email notifier: failed to get pusher failure state")
+		return
+	}
+	if err = n.sender.Send(ctx, msg); err != nil {
+		// The notifications are emailed again next time around.
+		logger.WithError(err).Warn("Failed to email notifications")
+		if failure == nil {
+			failure = &api.PusherFailure{AppID: pusher.AppID, PushKey: pusher.PushKey}
+		}
+		failure.FailureCount++
+		failure.LastFailureTS = int64(gomatrixserverlib.AsTimestamp(time.Now()))
+		failure.LastError = err.Error()
+		if err = n.db.UpsertPusherFailure(ctx, localpart, failure); err != nil {
+			logger.WithError(err).Error("userapi email notifier: failed to store pusher failure state")
+		}
+		return
+	}
+
+	if err = n.db.SetPusherLastEmailedNotificationID(ctx, localpart, pusher.AppID, pusher.PushKey, maxID); err != nil {
+		logger.WithError(err).Error("userapi email notifier: failed to store email pusher state")
+	}
+	if failure != nil {
+		if err = n.db.RemovePusherFailure(ctx, localpart, pusher.AppID, pusher.PushKey); err != nil {
+			logger.WithError(err).Error("userapi email notifier: failed to clear pusher failure state")
+		}
+	}
+}
+
+// groupByRoom groups the notifications by room, in the order the rooms
+// first appear in.
+func (n *EmailNotifier) groupByRoom(ctx context.Context, notifs []*api.Notification) []email.NotificationRoom {
+	var rooms []email.NotificationRoom
+	senders := map[string]map[string]struct{}{}
+	index := map[string]int{}
+	for _, notif := range notifs {
+		i, ok := index[notif.RoomID]
+		if !ok {
+			i = len(rooms)
+			index[notif.RoomID] = i
+			rooms = append(rooms, email.NotificationRoom{
+				RoomID: notif.RoomID,
+				Link:   "https://matrix.to/#/" + notif.RoomID,
+			})
+			senders[notif.RoomID] = map[string]struct{}{}
+		}
+		senders[notif.RoomID][notif.Event.Sender] = struct{}{}
+		rooms[i].Notifications = append(rooms[i].Notifications, email.NotificationMessage{
+			Sender: notif.Event.Sender,
+			Body:   notificationBody(&notif.Event),
+			TS:     notif.Event.OriginServerTS.Time(),
+		})
+	}
+
+	for i := range rooms {
+		name, displayNames := n.roomState(ctx, rooms[i].RoomID, senders[rooms[i].RoomID])
+		rooms[i].Name = name
+		if name == "" {
+			rooms[i].Name = rooms[i].RoomID
+		}
+		for j, msg := range rooms[i].Notifications {
+			if displayName := displayNames[msg.Sender]; displayName != "" {
+				rooms[i].Notifications[j].Sender = displayName
+			}
+		}
+	}
+	return rooms
+}
+
+// roomState returns the name or canonical alias of the room, and the
+// display names of the given members.
+func (n *EmailNotifier) roomState(
+	ctx context.Context, roomID string, members map[string]struct{},
+) (name string, displayNames map[string]string) {
+	req := &rsapi.QueryCurrentStateRequest{
+		RoomID:      roomID,
+		StateTuples: []gomatrixserverlib.StateKeyTuple{roomNameTuple, canonicalAliasTuple},
+	}
+	for userID := range members {
+		req.StateTuples = append(req.StateTuples, gomatrixserverlib.StateKeyTuple{
+			EventType: gomatrixserverlib.MRoomMember,
+			StateKey:  userID,
+		})
+	}
+	var res rsapi.QueryCurrentStateResponse
+	if err := n.rsAPI.QueryCurrentState(ctx, req, &res); err != nil {
+		log.WithError(err).WithField("room_id", roomID).Warn("userapi email notifier: failed to query room state")
+		return "", nil
+	}
+
+	if event := res.StateEvents[roomNameTuple]; event != nil {
+		name, _ = unmarshalRoomName(event)
+	}
+	if event := res.StateEvents[canonicalAliasTuple]; name == "" && event != nil {
+		name, _ = unmarshalCanonicalAlias(event)
+	}
+	displayNames = make(map[string]string, len(members))
+	for tuple, event := range res.StateEvents {
+		if tuple.EventType != gomatrixserverlib.MRoomMember {
+			continue
+		}
+		var content gomatrixserverlib.MemberContent
+		if err := json.Unmarshal(event.Content(), &content); err == nil {
+			displayNames[tuple.StateKey] = content.DisplayName
+		}
+	}
+	return name, displayNames
+}
+
+// notificationBody returns a short description of the event which caused
+// a notification.
+func notificationBody(event *gomatrixserverlib.ClientEvent) string {
+	switch event.Type {
+	case "m.room.message":
+		var content struct {
+			Body string `json:"body"`
+		}
+		if err := json.Unmarshal(event.Content, &content); err == nil && content.Body != "" {
+			return content.Body
+		}
+	case "m.room.encrypted":
+		return "Encrypted message"
+	case gomatrixserverlib.MRoomMember:
+		var content gomatrixserverlib.MemberContent
+		if err := json.Unmarshal(event.Content, &content); err == nil && content.Membership == gomatrixserverlib.Invite {
+			return "Invited you to the room"
+		}
+	}
+	return "Sent an event of type " + event.Type
+}
@@ -0,0 +1,267 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/pushgateway"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/jetstream"
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/producers"
+	"github.com/matrix-org/dendrite/userapi/storage"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// How many queued notifications to deliver at once. Notifications for
+	// different pushers are delivered concurrently.
+	pushGatewayBatchSize = 32
+	// How long after a notification was queued a failed delivery gives up
+	// on it. This is measured in time rather than in deliveries to us, as
+	// most deliveries are retries while the pusher is still backing off.
+	// This must stay well below the MaxAge of the OutputPushNotification
+	// stream, otherwise notifications expire before they are given up on.
+	pushGatewayMaxAge = time.Hour * 24
+)
+
+var pushGatewayDeliveries = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "userapi",
+		Name:      "push_gateway_deliveries_total",
+		Help:      "The number of push notifications by whether they were sent, failed and will be retried, were given up on (dead_lettered) or were dropped because the pusher was rejected",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(pushGatewayDeliveries)
+}
+
+// PushGatewayConsumer delivers the notifications queued by
+// producers.PushGateway to push gateways. If a push gateway fails, the
+// pusher backs off exponentially and its notifications are retried later.
+type PushGatewayConsumer struct {
+	ctx        context.Context
+	jetstream  nats.JetStreamContext
+	durable    string
+	topic      string
+	db         storage.Database
+	pgClient   pushgateway.Client
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	maxAge     time.Duration
+}
+
+func NewPushGatewayConsumer(
+	process *process.ProcessContext,
+	cfg *config.UserAPI,
+	js nats.JetStreamContext,
+	store storage.Database,
+	pgClient pushgateway.Client,
+) *PushGatewayConsumer {
+	return &PushGatewayConsumer{
+		ctx:        process.Context(),
+		jetstream:  js,
+		db:         store,
+		durable:    cfg.Matrix.JetStream.Durable("UserAPIPushGatewayConsumer"),
+		topic:      cfg.Matrix.JetStream.Prefixed(jetstream.OutputPushNotification),
+		pgClient:   pgClient,
+		minBackoff: time.Second,
+		maxBackoff: time.Hour,
+		maxAge:     pushGatewayMaxAge,
+	}
+}
+
+func (s *PushGatewayConsumer) Start() error {
+	// Notifications are published to a subject per pusher, see
+	// producers.PushGateway.
+	return jetstream.JetStreamBatchConsumer(
+		s.ctx, s.jetstream, s.topic+".>", s.durable, pushGatewayBatchSize, s.onMessages,
+		nats.DeliverAll(), nats.ManualAck(),
+	)
+}
+
+type queuedPushNotification struct {
+	producers.PushNotification
+	msg *nats.Msg
+}
+
+type pusherKey struct {
+	localpart string
+	appID     string
+	pushKey   string
+}
+
+func (s *PushGatewayConsumer) onMessages(ctx context.Context, msgs []*nats.Msg) {
+	// Notifications for the same pusher are delivered in order, so that
+	// the pusher only backs off once if its push gateway is failing.
+	queued := make(map[pusherKey][]*queuedPushNotification, len(msgs))
+	for _, msg := range msgs {
+		q := &queuedPushNotification{msg: msg}
+		if err := json.Unmarshal(msg.Data, &q.PushNotification); err != nil || q.Device() == nil {
+			log.WithError(err).Errorf("userapi push gateway consumer: message parse failure")
+			s.ack(ctx, msg)
+			continue
+		}
+		dev := q.Device()
+		key := pusherKey{q.Localpart, dev.AppID, dev.PushKey}
+		queued[key] = append(queued[key], q)
+	}
+
+	var wg sync.WaitGroup
+	for key, notifications := range queued {
+		wg.Add(1)
+		go func(key pusherKey, notifications []*queuedPushNotification) {
+			defer wg.Done()
+			s.deliver(ctx, key, notifications)
+		}(key, notifications)
+	}
+	wg.Wait()
+}
+
+// deliver sends the notifications to the push gateway of a single pusher.
+func (s *PushGatewayConsumer) deliver(ctx context.Context, key pusherKey, notifications []*queuedPushNotification) {
+	logger := log.WithFields(log.Fields{
+		"localpart": key.localpart,
+		"app_id":    key.appID,
+	})
+
+	failure, err := s.db.GetPusherFailure(ctx, key.localpart, key.appID, key.pushKey)
+	if err != nil {
+		logger.WithError(err).Error("userapi push gateway consumer: failed to get pusher failure state")
+		s.retry(ctx, notifications, s.minBackoff)
+		return
+	}
+
+	for i, q := range notifications {
+		if failure != nil {
+			if until := gomatrixserverlib.Timestamp(failure.BackoffUntilTS).Time(); time.Now().Before(until) {
+				s.retry(ctx, notifications[i:], time.Until(until))
+				return
+			}
+		}
+
+		var res pushgateway.NotifyResponse
+		notifyCtx, span := jetstream.StartSpan(ctx, q.msg, s.durable)
+		err = s.pgClient.Notify(notifyCtx, q.URL, &q.Request, &res)
+		span.End()
+		if err != nil {
+			logger.WithError(err).Warnf("Failed to notify push gateway %s", q.URL)
+			failure = s.failed(ctx, key, failure, q, err)
+			continue
+		}
+		pushGatewayDeliveries.WithLabelValues("sent").Inc()
+		s.ack(ctx, q.msg)
+
+		if failure != nil {
+			if err = s.db.RemovePusherFailure(ctx, key.localpart, key.appID, key.pushKey); err != nil {
+				logger.WithError(err).Error("userapi push gateway consumer: failed to clear pusher failure state")
+			}
+			failure = nil
+		}
+
+		for _, pushKey := range res.Rejected {
+			if pushKey != key.pushKey {
+				continue
+			}
+			logger.Warnf("Deleting pusher rejected by the HTTP push gateway")
+			if err = s.db.RemovePusher(ctx, key.appID, key.pushKey, key.localpart); err != nil {
+				logger.WithError(err).Error("Unable to delete rejected pusher")
+			}
+			for _, q := range notifications[i+1:] {
+				pushGatewayDeliveries.WithLabelValues("rejected").Inc()
+				s.ack(ctx, q.msg)
+			}
+			return
+		}
+	}
+}
+
+// failed records a failed delivery and either retries the notification once
+// the pusher has backed off, or gives up on it if it has been delivered to
+// us too long ago. Returns the new failure state of the pusher.
+func (s *PushGatewayConsumer) failed(
+	ctx context.Context, key pusherKey, failure *api.PusherFailure,
+	q *queuedPushNotification, notifyErr error,
+) *api.PusherFailure {
+	if failure == nil {
+		failure = &api.PusherFailure{
+			AppID:   key.appID,
+			PushKey: key.pushKey,
+		}
+	}
+	now := time.Now()
+	backoff := s.backoff(failure.FailureCount)
+	failure.FailureCount++
+	failure.LastFailureTS = int64(gomatrixserverlib.AsTimestamp(now))
+	failure.LastError = notifyErr.Error()
+	failure.BackoffUntilTS = int64(gomatrixserverlib.AsTimestamp(now.Add(backoff)))
+
+	if meta, err := q.msg.Metadata(); err == nil && now.Sub(meta.Timestamp) >= s.maxAge {
+		log.WithFields(log.Fields{
+			"localpart": key.localpart,
+			"app_id":    key.appID,
+			"event_id":  q.Request.Notification.EventID,
+		}).Errorf("Giving up on push notification queued %s ago", now.Sub(meta.Timestamp).Round(time.Second))
+		failure.DeadLetterCount++
+		pushGatewayDeliveries.WithLabelValues("dead_lettered").Inc()
+		s.ack(ctx, q.msg)
+	} else {
+		pushGatewayDeliveries.WithLabelValues("failed").Inc()
+		s.retry(ctx, []*queuedPushNotification{q}, backoff)
+	}
+
+	if err := s.db.UpsertPusherFailure(ctx, key.localpart, failure); err != nil {
+		log.WithError(err).Error("userapi push gateway consumer: failed to store pusher failure state")
+	}
+	return failure
+}
+
+// backoff returns how long to wait before the next delivery to a pusher,
+// given how many times in a row the deliveries to it have failed.
+func (s *PushGatewayConsumer) backoff(failures int64) time.Duration {
+	backoff := s.maxBackoff
+	if failures < 32 {
+		if d := s.minBackoff * time.Duration(math.Exp2(float64(failures))); d < backoff {
+			backoff = d
+		}
+	}
+	return backoff
+}
+
+func (s *PushGatewayConsumer) retry(ctx context.Context, notifications []*queuedPushNotification, delay time.Duration) {
+	for _, q := range notifications {
+		if err := q.msg.NakWithDelay(delay, nats.Context(ctx)); err != nil {
+			log.WithError(err).Warn("userapi push gateway consumer: msg.NakWithDelay failed")
+		}
+	}
+}
+
+func (s *PushGatewayConsumer) ack(ctx context.Context, msg *nats.Msg) {
+	if err := msg.AckSync(nats.Context(ctx)); err != nil {
+		log.WithError(err).Warn("userapi push gateway consumer: msg.AckSync failed")
+	}
+}
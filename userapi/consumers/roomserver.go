@@ -0,0 +1,227 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/userutil"
+	rsapi "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/jetstream"
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/matrix-org/dendrite/userapi/storage"
+	"github.com/matrix-org/dendrite/userapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+)
+
+// OutputRoomEventConsumer maintains the user directory from the state
+// changes of rooms, as reported by the roomserver.
+type OutputRoomEventConsumer struct {
+	ctx        context.Context
+	jetstream  nats.JetStreamContext
+	durable    string
+	topic      string
+	db         storage.Database
+	rsAPI      rsapi.UserRoomserverAPI
+	serverName gomatrixserverlib.ServerName
+}
+
+func NewOutputRoomEventConsumer(
+	process *process.ProcessContext,
+	cfg *config.UserAPI,
+	js nats.JetStreamContext,
+	store storage.Database,
+	rsAPI rsapi.UserRoomserverAPI,
+) *OutputRoomEventConsumer {
+	return &OutputRoomEventConsumer{
+		ctx:        process.Context(),
+		jetstream:  js,
+		db:         store,
+		rsAPI:      rsAPI,
+		serverName: cfg.Matrix.ServerName,
+		durable:    cfg.Matrix.JetStream.Durable("UserAPIRoomServerConsumer"),
+		topic:      cfg.Matrix.JetStream.Prefixed(jetstream.OutputRoomEvent),
+	}
+}
+
+func (s *OutputRoomEventConsumer) Start() error {
+	// The roomserver only sends us the events which were added after we
+	// started consuming them, so fill the directory from the rooms which
+	// local users are already joined to first.
+	if err := s.backfillUserDirectory(s.ctx); err != nil {
+		log.WithError(err).Error("userapi roomserver consumer: failed to backfill user directory, will retry on restart")
+	}
+	return jetstream.JetStreamConsumer(
+		s.ctx, s.jetstream, s.topic, s.durable, s.onMessage,
+		nats.DeliverAll(), nats.ManualAck(),
+	)
+}
+
+func (s *OutputRoomEventConsumer) onMessage(ctx context.Context, msg *nats.Msg) bool {
+	var output rsapi.OutputEvent
+	if err := json.Unmarshal(msg.Data, &output); err != nil {
+		log.WithError(err).Error("userapi roomserver consumer: message parse failure")
+		return true
+	}
+	if output.Type != rsapi.OutputTypeNewRoomEvent || output.NewRoomEvent == nil {
+		return true
+	}
+	ore := output.NewRoomEvent
+	if !ore.RewritesState && len(ore.AddsStateEventIDs) == 0 {
+		return true
+	}
+
+	events, err := s.addedStateEvents(ctx, ore)
+	if err != nil {
+		log.WithError(err).WithField("event_id", ore.Event.EventID()).Error("userapi roomserver consumer: failed to get state events")
+		return false
+	}
+	update := userDirectoryUpdate(ore.Event.RoomID(), ore.RewritesState, events)
+	if update == nil {
+		return true
+	}
+	if err = s.db.UpdateUserDirectoryRoom(ctx, update); err != nil {
+		log.WithError(err).WithField("room_id", update.RoomID).Error("userapi roomserver consumer: failed to update user directory")
+		return false
+	}
+	return true
+}
+
+// addedStateEvents returns the state events added by the output event,
+// fetching those which weren't included in it from the roomserver.
+func (s *OutputRoomEventConsumer) addedStateEvents(
+	ctx context.Context, ore *rsapi.OutputNewRoomEvent,
+) ([]*gomatrixserverlib.HeaderedEvent, error) {
+	events, missingEventIDs := ore.NeededStateEventIDs()
+	if len(missingEventIDs) == 0 {
+		return events, nil
+	}
+	eventsReq := &rsapi.QueryEventsByIDRequest{
+		EventIDs: missingEventIDs,
+	}
+	eventsRes := &rsapi.QueryEventsByIDResponse{}
+	if err := s.rsAPI.QueryEventsByID(ctx, eventsReq, eventsRes); err != nil {
+		return nil, fmt.Errorf("s.rsAPI.QueryEventsByID: %w", err)
+	}
+	if len(eventsRes.Events) != len(missingEventIDs) {
+		return nil, fmt.Errorf("missing state events")
+	}
+	return append(events, eventsRes.Events...), nil
+}
+
+// backfillUserDirectory fills the user directory from the current state of
+// the rooms which local users are joined to, if that hasn't been done yet.
+func (s *OutputRoomEventConsumer) backfillUserDirectory(ctx context.Context) error {
+	backfilled, err := s.db.UserDirectoryBackfilled(ctx)
+	if err != nil || backfilled {
+		return err
+	}
+	localparts, err := s.db.GetLocalparts(ctx)
+	if err != nil {
+		return fmt.Errorf("s.db.GetLocalparts: %w", err)
+	}
+	roomIDs := map[string]struct{}{}
+	for _, localpart := range localparts {
+		roomsReq := &rsapi.QueryRoomsForUserRequest{
+			UserID:         userutil.MakeUserID(localpart, s.serverName),
+			WantMembership: gomatrixserverlib.Join,
+		}
+		roomsRes := &rsapi.QueryRoomsForUserResponse{}
+		if err = s.rsAPI.QueryRoomsForUser(ctx, roomsReq, roomsRes); err != nil {
+			return fmt.Errorf("s.rsAPI.QueryRoomsForUser: %w", err)
+		}
+		for _, roomID := range roomsRes.RoomIDs {
+			roomIDs[roomID] = struct{}{}
+		}
+	}
+	updates := make([]*types.UserDirectoryRoomUpdate, 0, len(roomIDs))
+	for roomID := range roomIDs {
+		stateReq := &rsapi.QueryCurrentStateRequest{
+			RoomID:         roomID,
+			AllowWildcards: true,
+			StateTuples: []gomatrixserverlib.StateKeyTuple{
+				{EventType: gomatrixserverlib.MRoomMember, StateKey: "*"},
+				{EventType: gomatrixserverlib.MRoomJoinRules, StateKey: ""},
+				{EventType: gomatrixserverlib.MRoomHistoryVisibility, StateKey: ""},
+			},
+		}
+		stateRes := &rsapi.QueryCurrentStateResponse{}
+		if err = s.rsAPI.QueryCurrentState(ctx, stateReq, stateRes); err != nil {
+			return fmt.Errorf("s.rsAPI.QueryCurrentState: %w", err)
+		}
+		events := make([]*gomatrixserverlib.HeaderedEvent, 0, len(stateRes.StateEvents))
+		for _, event := range stateRes.StateEvents {
+			events = append(events, event)
+		}
+		updates = append(updates, userDirectoryUpdate(roomID, true, events))
+	}
+	if err = s.db.BackfillUserDirectory(ctx, updates); err != nil {
+		return fmt.Errorf("s.db.BackfillUserDirectory: %w", err)
+	}
+	log.Infof("Backfilled user directory from %d rooms", len(updates))
+	return nil
+}
+
+// userDirectoryUpdate works out how the user directory changes from the
+// state events added to the room. Returns nil if it doesn't change.
+func userDirectoryUpdate(
+	roomID string, rewritesState bool, events []*gomatrixserverlib.HeaderedEvent,
+) *types.UserDirectoryRoomUpdate {
+	update := &types.UserDirectoryRoomUpdate{
+		RoomID:        roomID,
+		RewritesState: rewritesState,
+	}
+	for _, event := range events {
+		switch event.Type() {
+		case gomatrixserverlib.MRoomMember:
+			if event.StateKey() == nil {
+				continue
+			}
+			var content gomatrixserverlib.MemberContent
+			if err := json.Unmarshal(event.Content(), &content); err != nil {
+				continue
+			}
+			if content.Membership != gomatrixserverlib.Join {
+				update.Left = append(update.Left, *event.StateKey())
+				continue
+			}
+			update.Joined = append(update.Joined, authtypes.FullyQualifiedProfile{
+				UserID:      *event.StateKey(),
+				DisplayName: content.DisplayName,
+				AvatarURL:   content.AvatarURL,
+			})
+		case gomatrixserverlib.MRoomJoinRules:
+			if joinRule, err := event.JoinRule(); err == nil {
+				update.JoinRule = &joinRule
+			}
+		case gomatrixserverlib.MRoomHistoryVisibility:
+			if visibility, err := event.HistoryVisibility(); err == nil {
+				historyVisibility := string(visibility)
+				update.HistoryVisibility = &historyVisibility
+			}
+		}
+	}
+	if !rewritesState && len(update.Joined) == 0 && len(update.Left) == 0 &&
+		update.JoinRule == nil && update.HistoryVisibility == nil {
+		return nil
+	}
+	return update
+}
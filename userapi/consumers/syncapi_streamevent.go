@@ -34,7 +34,7 @@ type OutputStreamEventConsumer struct {
 	durable      string
 	db           storage.Database
 	topic        string
-	pgClient     pushgateway.Client
+	pushProducer *producers.PushGateway
 	syncProducer *producers.SyncAPI
 }
 
@@ -43,7 +43,7 @@ func NewOutputStreamEventConsumer(
 	cfg *config.UserAPI,
 	js nats.JetStreamContext,
 	store storage.Database,
-	pgClient pushgateway.Client,
+	pushProducer *producers.PushGateway,
 	userAPI api.UserInternalAPI,
 	rsAPI rsapi.UserRoomserverAPI,
 	syncProducer *producers.SyncAPI,
@@ -55,7 +55,7 @@ func NewOutputStreamEventConsumer(
 		db:           store,
 		durable:      cfg.Matrix.JetStream.Durable("UserAPISyncAPIStreamEventConsumer"),
 		topic:        cfg.Matrix.JetStream.Prefixed(jetstream.OutputStreamEvent),
-		pgClient:     pgClient,
+		pushProducer: pushProducer,
 		userAPI:      userAPI,
 		rsAPI:        rsAPI,
 		syncProducer: syncProducer,
@@ -287,6 +287,21 @@ func unmarshalCanonicalAlias(event *gomatrixserverlib.HeaderedEvent) (string, er
 	return cac.Alias, nil
 }
 
+// threadID returns the root event ID of the thread the event is in, or an
+// empty string if the event is on the main timeline.
+func threadID(event *gomatrixserverlib.HeaderedEvent) string {
+	var content struct {
+		RelatesTo struct {
+			RelType string `json:"rel_type"`
+			EventID string `json:"event_id"`
+		} `json:"m.relates_to"`
+	}
+	if err := json.Unmarshal(event.Content(), &content); err != nil || content.RelatesTo.RelType != "m.thread" {
+		return ""
+	}
+	return content.RelatesTo.EventID
+}
+
 // notifyLocal finds the right push actions for a local user, given an event.
 func (s *OutputStreamEventConsumer) notifyLocal(ctx context.Context, event *gomatrixserverlib.HeaderedEvent, pos int64, mem *localMembership, roomSize int, roomName string) error {
 	actions, err := s.evaluatePushRules(ctx, event, mem, roomSize)
@@ -326,7 +341,7 @@ func (s *OutputStreamEventConsumer) notifyLocal(ctx context.Context, event *goma
 		RoomID:     event.RoomID(),
 		TS:         gomatrixserverlib.AsTimestamp(time.Now()),
 	}
-	if err = s.db.InsertNotification(ctx, mem.Localpart, event.EventID(), pos, tweaks, n); err != nil {
+	if err = s.db.InsertNotification(ctx, mem.Localpart, event.EventID(), threadID(event), pos, tweaks, n); err != nil {
 		return err
 	}
 
@@ -348,49 +363,27 @@ func (s *OutputStreamEventConsumer) notifyLocal(ctx context.Context, event *goma
 		"num_unread": userNumUnreadNotifs,
 	}).Tracef("Notifying single member")
 
-	// Push gateways are out of our control, and we cannot risk
-	// looking up the server on a misbehaving push gateway. Each user
-	// receives a goroutine now that all internal API calls have been
-	// made.
-	//
-	// TODO: think about bounding this to one per user, and what
-	// ordering guarantees we must provide.
-	go func() {
-		// This background processing cannot be tied to a request.
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-		defer cancel()
-
-		var rejected []*pushgateway.Device
-		for url, fmts := range devicesByURLAndFormat {
-			for format, devices := range fmts {
-				// TODO: support "email".
-				if !strings.HasPrefix(url, "http") {
-					continue
-				}
+	// The notifications are queued, so that push gateways which are out
+	// of our control can't hold up processing events.
+	for url, fmts := range devicesByURLAndFormat {
+		for format, devices := range fmts {
+			// Email pushers are sent digests by consumers.EmailNotifier.
+			if !strings.HasPrefix(url, "http") {
+				continue
+			}
 
-				// UNSPEC: the specification suggests there can be
-				// more than one device per request. There is at least
-				// one Sytest that expects one HTTP request per
-				// device, rather than per URL. For now, we must
-				// notify each one separately.
-				for _, dev := range devices {
-					rej, err := s.notifyHTTP(ctx, event, url, format, []*pushgateway.Device{dev}, mem.Localpart, roomName, int(userNumUnreadNotifs))
-					if err != nil {
-						log.WithFields(log.Fields{
-							"event_id":  event.EventID(),
-							"localpart": mem.Localpart,
-						}).WithError(err).Errorf("Unable to notify HTTP pusher")
-						continue
-					}
-					rejected = append(rejected, rej...)
+			// UNSPEC: the specification suggests there can be
+			// more than one device per request. There is at least
+			// one Sytest that expects one HTTP request per
+			// device, rather than per URL. For now, we must
+			// notify each one separately.
+			for _, dev := range devices {
+				if err = s.notifyHTTP(ctx, event, url, format, dev, mem.Localpart, roomName, int(userNumUnreadNotifs)); err != nil {
+					return fmt.Errorf("s.notifyHTTP: %w", err)
 				}
 			}
 		}
-
-		if len(rejected) > 0 {
-			s.deleteRejectedPushers(ctx, rejected, mem.Localpart)
-		}
-	}()
+	}
 
 	return nil
 }
@@ -490,6 +483,20 @@ func (rse *ruleSetEvalContext) HasPowerLevel(userID, levelKey string) (bool, err
 	return true, nil
 }
 
+func (rse *ruleSetEvalContext) RelatedEvent(eventID string) (*gomatrixserverlib.Event, error) {
+	req := &rsapi.QueryEventsByIDRequest{EventIDs: []string{eventID}}
+	var res rsapi.QueryEventsByIDResponse
+	if err := rse.rsAPI.QueryEventsByID(rse.ctx, req, &res); err != nil {
+		return nil, err
+	}
+	for _, ev := range res.Events {
+		if ev.EventID() == eventID && ev.RoomID() == rse.roomID {
+			return ev.Event, nil
+		}
+	}
+	return nil, nil
+}
+
 // localPushDevices pushes to the configured devices of a local
 // user. The map keys are [url][format].
 func (s *OutputStreamEventConsumer) localPushDevices(ctx context.Context, localpart string, tweaks map[string]interface{}) (map[string]map[string][]*pushgateway.Device, string, error) {
@@ -515,14 +522,9 @@ func (s *OutputStreamEventConsumer) localPushDevices(ctx context.Context, localp
 	return devicesByURL, profileTag, nil
 }
 
-// notifyHTTP performs a notificatation to a Push Gateway.
-func (s *OutputStreamEventConsumer) notifyHTTP(ctx context.Context, event *gomatrixserverlib.HeaderedEvent, url, format string, devices []*pushgateway.Device, localpart, roomName string, userNumUnreadNotifs int) ([]*pushgateway.Device, error) {
-	logger := log.WithFields(log.Fields{
-		"event_id":    event.EventID(),
-		"url":         url,
-		"localpart":   localpart,
-		"num_devices": len(devices),
-	})
+// notifyHTTP queues a notification to a Push Gateway.
+func (s *OutputStreamEventConsumer) notifyHTTP(ctx context.Context, event *gomatrixserverlib.HeaderedEvent, url, format string, device *pushgateway.Device, localpart, roomName string, userNumUnreadNotifs int) error {
+	devices := []*pushgateway.Device{device}
 
 	var req pushgateway.NotifyRequest
 	switch format {
@@ -560,46 +562,10 @@ func (s *OutputStreamEventConsumer) notifyHTTP(ctx context.Context, event *gomat
 		}
 	}
 
-	logger.Debugf("Notifying push gateway %s", url)
-	var res pushgateway.NotifyResponse
-	if err := s.pgClient.Notify(ctx, url, &req, &res); err != nil {
-		logger.WithError(err).Errorf("Failed to notify push gateway %s", url)
-		return nil, err
-	}
-	logger.WithField("num_rejected", len(res.Rejected)).Tracef("Push gateway result")
-
-	if len(res.Rejected) == 0 {
-		return nil, nil
-	}
-
-	devMap := make(map[string]*pushgateway.Device, len(devices))
-	for _, d := range devices {
-		devMap[d.PushKey] = d
-	}
-	rejected := make([]*pushgateway.Device, 0, len(res.Rejected))
-	for _, pushKey := range res.Rejected {
-		d := devMap[pushKey]
-		if d != nil {
-			rejected = append(rejected, d)
-		}
-	}
-
-	return rejected, nil
-}
-
-// deleteRejectedPushers deletes the pushers associated with the given devices.
-func (s *OutputStreamEventConsumer) deleteRejectedPushers(ctx context.Context, devices []*pushgateway.Device, localpart string) {
 	log.WithFields(log.Fields{
-		"localpart":   localpart,
-		"app_id0":     devices[0].AppID,
-		"num_devices": len(devices),
-	}).Warnf("Deleting pushers rejected by the HTTP push gateway")
-
-	for _, d := range devices {
-		if err := s.db.RemovePusher(ctx, d.AppID, d.PushKey, localpart); err != nil {
-			log.WithFields(log.Fields{
-				"localpart": localpart,
-			}).WithError(err).Errorf("Unable to delete rejected pusher")
-		}
-	}
+		"event_id":  event.EventID(),
+		"url":       url,
+		"localpart": localpart,
+	}).Debugf("Queueing notification for push gateway %s", url)
+	return s.pushProducer.SendNotification(ctx, localpart, url, &req)
 }
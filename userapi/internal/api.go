@@ -21,6 +21,7 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/matrix-org/gomatrixserverlib"
@@ -51,8 +52,31 @@ type UserInternalAPI struct {
 	ServerName           gomatrixserverlib.ServerName
 	// AppServices is the list of all registered AS
 	AppServices []config.ApplicationService
-	KeyAPI      keyapi.UserKeyAPI
-	RSAPI       rsapi.UserRoomserverAPI
+	// Protects AppServices when the application services are reloaded
+	appServicesMu sync.RWMutex
+	KeyAPI        keyapi.UserKeyAPI
+	RSAPI         rsapi.UserRoomserverAPI
+	// ThreePIDSessionLifetime is how long third-party identifier validation
+	// sessions are valid for.
+	ThreePIDSessionLifetime time.Duration
+	// SearchAllUsers makes the user directory return all users known to the
+	// server, rather than only those who share a room with the searching
+	// user or are in public rooms.
+	SearchAllUsers bool
+}
+
+// SetAppServices replaces the registered application services, e.g. when
+// the config is reloaded.
+func (a *UserInternalAPI) SetAppServices(appServices []config.ApplicationService) {
+	a.appServicesMu.Lock()
+	defer a.appServicesMu.Unlock()
+	a.AppServices = appServices
+}
+
+func (a *UserInternalAPI) appServices() []config.ApplicationService {
+	a.appServicesMu.RLock()
+	defer a.appServicesMu.RUnlock()
+	return a.AppServices
 }
 
 func (a *UserInternalAPI) InputAccountData(ctx context.Context, req *api.InputAccountDataRequest, res *api.InputAccountDataResponse) error {
@@ -75,7 +99,7 @@ func (a *UserInternalAPI) InputAccountData(ctx context.Context, req *api.InputAc
 		ignoredUsers = &synctypes.IgnoredUsers{}
 		_ = json.Unmarshal(req.AccountData, ignoredUsers)
 	}
-	if err := a.SyncProducer.SendAccountData(req.UserID, eventutil.AccountData{
+	if err := a.SyncProducer.SendAccountData(ctx, req.UserID, eventutil.AccountData{
 		RoomID:       req.RoomID,
 		Type:         req.DataType,
 		IgnoredUsers: ignoredUsers,
@@ -112,7 +136,7 @@ func (a *UserInternalAPI) PerformAccountCreation(ctx context.Context, req *api.P
 	}
 
 	// Inform the SyncAPI about the newly created push_rules
-	if err = a.SyncProducer.SendAccountData(acc.UserID, eventutil.AccountData{
+	if err = a.SyncProducer.SendAccountData(ctx, acc.UserID, eventutil.AccountData{
 		Type: "m.push_rules",
 	}); err != nil {
 		util.GetLogger(ctx).WithFields(logrus.Fields{
@@ -331,6 +355,19 @@ func (a *UserInternalAPI) QuerySearchProfiles(ctx context.Context, req *api.Quer
 	return nil
 }
 
+func (a *UserInternalAPI) QuerySearchUserDirectory(ctx context.Context, req *api.QuerySearchUserDirectoryRequest, res *api.QuerySearchUserDirectoryResponse) error {
+	// Ask for one more result than the limit to find out if there are more.
+	results, err := a.DB.SearchUserDirectory(ctx, req.UserID, req.SearchString, req.Limit+1, a.SearchAllUsers)
+	if err != nil {
+		return err
+	}
+	if len(results) > req.Limit {
+		results, res.Limited = results[:req.Limit], true
+	}
+	res.Results = results
+	return nil
+}
+
 func (a *UserInternalAPI) QueryDeviceInfos(ctx context.Context, req *api.QueryDeviceInfosRequest, res *api.QueryDeviceInfosResponse) error {
 	devices, err := a.DB.GetDevicesByID(ctx, req.DeviceIDs)
 	if err != nil {
@@ -407,14 +444,16 @@ func (a *UserInternalAPI) QueryAccountData(ctx context.Context, req *api.QueryAc
 }
 
 func (a *UserInternalAPI) QueryAccessToken(ctx context.Context, req *api.QueryAccessTokenRequest, res *api.QueryAccessTokenResponse) error {
-	if req.AppServiceUserID != "" {
-		appServiceDevice, err := a.queryAppServiceToken(ctx, req.AccessToken, req.AppServiceUserID)
+	if req.AppServiceUserID != "" || req.AppServiceDeviceID != "" {
+		appServiceDevice, err := a.queryAppServiceToken(ctx, req.AccessToken, req.AppServiceUserID, req.AppServiceDeviceID)
 		if err != nil {
 			res.Err = err.Error()
 		}
-		res.Device = appServiceDevice
-
-		return nil
+		// A device ID on its own doesn't mean that the token is an appservice token.
+		if appServiceDevice != nil || err != nil || req.AppServiceUserID != "" {
+			res.Device = appServiceDevice
+			return nil
+		}
 	}
 	device, err := a.DB.GetDeviceByAccessToken(ctx, req.AccessToken)
 	if err != nil {
@@ -432,16 +471,17 @@ func (a *UserInternalAPI) QueryAccessToken(ctx context.Context, req *api.QueryAc
 		return err
 	}
 	device.AccountType = acc.AccountType
+	device.ShadowBanned = acc.ShadowBanned
 	res.Device = device
 	return nil
 }
 
 // Return the appservice 'device' or nil if the token is not an appservice. Returns an error if there was a problem
 // creating a 'device'.
-func (a *UserInternalAPI) queryAppServiceToken(ctx context.Context, token, appServiceUserID string) (*api.Device, error) {
+func (a *UserInternalAPI) queryAppServiceToken(ctx context.Context, token, appServiceUserID, appServiceDeviceID string) (*api.Device, error) {
 	// Search for app service with given access_token
 	var appService *config.ApplicationService
-	for _, as := range a.AppServices {
+	for _, as := range a.appServices() {
 		if as.ASToken == token {
 			appService = &as
 			break
@@ -474,16 +514,48 @@ func (a *UserInternalAPI) queryAppServiceToken(ctx context.Context, token, appSe
 		if err == nil && (account.AppServiceID == appService.ID || appService.IsInterestedInUserID(appServiceUserID)) {
 			// Set the userID of dummy device
 			dev.UserID = appServiceUserID
-			return &dev, nil
+			dev.ShadowBanned = account.ShadowBanned
+			return a.queryAppServiceDevice(ctx, appService, &dev, localpart, appServiceDeviceID)
 		}
 		return nil, &api.ErrorForbidden{Message: "appservice has not registered this user"}
 	}
 
 	// AS is not masquerading as any user, so use AS's sender_localpart
+	if appServiceDeviceID != "" && appService.MSC3202 {
+		// The device belongs to the sender, so the full user ID is needed.
+		dev.UserID = userutil.MakeUserID(appService.SenderLocalpart, a.ServerName)
+		return a.queryAppServiceDevice(ctx, appService, &dev, appService.SenderLocalpart, appServiceDeviceID)
+	}
+	if appServiceUserID == "" {
+		// Only a device ID was given, which this appservice can't use, so
+		// treat the token like any other.
+		return nil, nil
+	}
 	dev.UserID = appService.SenderLocalpart
 	return &dev, nil
 }
 
+// queryAppServiceDevice lets the appservice masquerade as a device of the user, if the appservice
+// has enabled MSC3202. Otherwise the device ID is ignored and the dummy device is returned.
+func (a *UserInternalAPI) queryAppServiceDevice(
+	ctx context.Context, appService *config.ApplicationService, dev *api.Device, localpart, deviceID string,
+) (*api.Device, error) {
+	if deviceID == "" || !appService.MSC3202 {
+		return dev, nil
+	}
+	device, err := a.DB.GetDeviceByID(ctx, localpart, deviceID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, &api.ErrorForbidden{Message: "appservice user has no device with this ID"}
+		}
+		return nil, err
+	}
+	dev.ID = device.ID
+	dev.SessionID = device.SessionID
+	dev.DisplayName = device.DisplayName
+	return dev, nil
+}
+
 // PerformAccountDeactivation deactivates the user's account, removing all ability for the user to login again.
 func (a *UserInternalAPI) PerformAccountDeactivation(ctx context.Context, req *api.PerformAccountDeactivationRequest, res *api.PerformAccountDeactivationResponse) error {
 	evacuateReq := &rsapi.PerformAdminEvacuateUserRequest{
@@ -517,6 +589,16 @@ func (a *UserInternalAPI) PerformAccountDeactivation(ctx context.Context, req *a
 	return err
 }
 
+// PerformAccountShadowBan sets or clears the shadow-ban flag on a local account.
+func (a *UserInternalAPI) PerformAccountShadowBan(ctx context.Context, req *api.PerformAccountShadowBanRequest, res *api.PerformAccountShadowBanResponse) error {
+	err := a.DB.SetShadowBanned(ctx, req.Localpart, req.ShadowBanned)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	res.AccountExists = err == nil
+	return err
+}
+
 // PerformOpenIDTokenCreation creates a new token that a relying party uses to authenticate a user
 func (a *UserInternalAPI) PerformOpenIDTokenCreation(ctx context.Context, req *api.PerformOpenIDTokenCreationRequest, res *api.PerformOpenIDTokenCreationResponse) error {
 	token := util.RandomString(24)
@@ -734,6 +816,29 @@ func (a *UserInternalAPI) QueryPushers(ctx context.Context, req *api.QueryPusher
 	return err
 }
 
+func (a *UserInternalAPI) QueryPusherStatus(ctx context.Context, req *api.QueryPusherStatusRequest, res *api.QueryPusherStatusResponse) error {
+	pushers, err := a.DB.GetPushers(ctx, req.Localpart)
+	if err != nil {
+		return err
+	}
+	failures, err := a.DB.GetPusherFailures(ctx, req.Localpart)
+	if err != nil {
+		return err
+	}
+	res.Pushers = make([]api.PusherStatus, 0, len(pushers))
+	for _, pusher := range pushers {
+		status := api.PusherStatus{Pusher: pusher}
+		for i := range failures {
+			if failures[i].AppID == pusher.AppID && failures[i].PushKey == pusher.PushKey {
+				status.Failure = &failures[i]
+				break
+			}
+		}
+		res.Pushers = append(res.Pushers, status)
+	}
+	return nil
+}
+
 func (a *UserInternalAPI) PerformPushRulesPut(
 	ctx context.Context,
 	req *api.PerformPushRulesPutRequest,
@@ -752,7 +857,7 @@ func (a *UserInternalAPI) PerformPushRulesPut(
 	if err := a.InputAccountData(ctx, &userReq, &userRes); err != nil {
 		return err
 	}
-	if err := a.SyncProducer.SendAccountData(req.UserID, eventutil.AccountData{
+	if err := a.SyncProducer.SendAccountData(ctx, req.UserID, eventutil.AccountData{
 		Type: pushRulesAccountDataType,
 	}); err != nil {
 		util.GetLogger(ctx).WithError(err).Errorf("syncProducer.SendData failed")
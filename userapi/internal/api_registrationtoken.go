@@ -0,0 +1,135 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
+)
+
+// defaultRegistrationTokenLength is the length of generated registration
+// tokens if no length was requested.
+const defaultRegistrationTokenLength = 16
+
+// PerformRegistrationTokenCreation creates a new registration token.
+func (a *UserInternalAPI) PerformRegistrationTokenCreation(ctx context.Context, req *api.PerformRegistrationTokenCreationRequest, res *api.PerformRegistrationTokenCreationResponse) error {
+	if req.UsesAllowed != nil && *req.UsesAllowed < 0 {
+		return fmt.Errorf("uses allowed must not be negative")
+	}
+	token := &api.RegistrationToken{
+		Token:       req.Token,
+		UsesAllowed: req.UsesAllowed,
+		ExpiryTime:  req.ExpiryTime,
+	}
+	if token.Token == "" {
+		length := req.Length
+		if length <= 0 {
+			length = defaultRegistrationTokenLength
+		}
+		token.Token = util.RandomString(length)
+	}
+	created, err := a.DB.CreateRegistrationToken(ctx, token)
+	if err != nil {
+		return err
+	}
+	res.Created = created
+	res.Token = token
+	return nil
+}
+
+// PerformRegistrationTokenUpdate updates the uses allowed and/or the expiry
+// time of an existing registration token. If the token doesn't exist,
+// success is returned, but res.Token == nil.
+func (a *UserInternalAPI) PerformRegistrationTokenUpdate(ctx context.Context, req *api.PerformRegistrationTokenUpdateRequest, res *api.PerformRegistrationTokenUpdateResponse) error {
+	if req.UsesAllowed != nil && *req.UsesAllowed < 0 {
+		return fmt.Errorf("uses allowed must not be negative")
+	}
+	existing, err := a.DB.GetRegistrationToken(ctx, req.Token)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+	usesAllowed, expiryTime := existing.UsesAllowed, existing.ExpiryTime
+	if req.UpdateUsesAllowed {
+		usesAllowed = req.UsesAllowed
+	}
+	if req.UpdateExpiryTime {
+		expiryTime = req.ExpiryTime
+	}
+	res.Token, err = a.DB.UpdateRegistrationToken(ctx, req.Token, usesAllowed, expiryTime)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	return err
+}
+
+// PerformRegistrationTokenDeletion deletes a registration token.
+func (a *UserInternalAPI) PerformRegistrationTokenDeletion(ctx context.Context, req *api.PerformRegistrationTokenDeletionRequest, res *api.PerformRegistrationTokenDeletionResponse) error {
+	deleted, err := a.DB.RemoveRegistrationToken(ctx, req.Token)
+	res.Deleted = deleted
+	return err
+}
+
+// PerformRegistrationTokenUse updates the pending and completed counters of
+// a registration token.
+func (a *UserInternalAPI) PerformRegistrationTokenUse(ctx context.Context, req *api.PerformRegistrationTokenUseRequest, res *api.PerformRegistrationTokenUseResponse) error {
+	switch req.Use {
+	case api.RegistrationTokenUseBegin:
+		valid, err := a.DB.BeginRegistrationTokenUse(ctx, req.Token)
+		res.Valid = valid
+		return err
+	case api.RegistrationTokenUseComplete:
+		return a.DB.CompleteRegistrationTokenUse(ctx, req.Token)
+	case api.RegistrationTokenUseRelease:
+		return a.DB.ReleaseRegistrationTokenUse(ctx, req.Token)
+	default:
+		return fmt.Errorf("unknown registration token use %d", req.Use)
+	}
+}
+
+// QueryRegistrationTokens returns registration tokens, optionally filtered
+// by token or by validity.
+func (a *UserInternalAPI) QueryRegistrationTokens(ctx context.Context, req *api.QueryRegistrationTokensRequest, res *api.QueryRegistrationTokensResponse) error {
+	var tokens []api.RegistrationToken
+	if req.Token != "" {
+		token, err := a.DB.GetRegistrationToken(ctx, req.Token)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return nil
+			}
+			return err
+		}
+		tokens = []api.RegistrationToken{*token}
+	} else {
+		var err error
+		if tokens, err = a.DB.GetRegistrationTokens(ctx); err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+	for i := range tokens {
+		if req.Valid == nil || tokens[i].IsValid(now) == *req.Valid {
+			res.Tokens = append(res.Tokens, tokens[i])
+		}
+	}
+	return nil
+}
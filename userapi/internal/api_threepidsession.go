@@ -0,0 +1,111 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"time"
+
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// threePIDSessionIDLength and threePIDTokenLength are the lengths of the
+// generated session IDs and validation tokens.
+const (
+	threePIDSessionIDLength = 32
+	threePIDTokenLength     = 32
+)
+
+// PerformThreePIDSessionCreation creates a session to validate a third-party
+// identifier, or returns the existing session for the same client secret.
+func (a *UserInternalAPI) PerformThreePIDSessionCreation(ctx context.Context, req *api.PerformThreePIDSessionCreationRequest, res *api.PerformThreePIDSessionCreationResponse) error {
+	session, send, err := a.DB.CreateThreePIDSession(ctx, &api.ThreePIDSession{
+		SessionID:    util.RandomString(threePIDSessionIDLength),
+		ClientSecret: req.ClientSecret,
+		Medium:       req.Medium,
+		Address:      req.Address,
+		Token:        util.RandomString(threePIDTokenLength),
+		SendAttempt:  req.SendAttempt,
+		NextLink:     req.NextLink,
+		ExpiresAt:    gomatrixserverlib.AsTimestamp(time.Now().Add(a.ThreePIDSessionLifetime)),
+	})
+	if err != nil {
+		return err
+	}
+	res.SessionID = session.SessionID
+	res.Send = send
+	if send {
+		res.Token = session.Token
+	}
+	return nil
+}
+
+// PerformThreePIDSessionValidation marks a session as validated if the client
+// secret and the validation token match.
+func (a *UserInternalAPI) PerformThreePIDSessionValidation(ctx context.Context, req *api.PerformThreePIDSessionValidationRequest, res *api.PerformThreePIDSessionValidationResponse) error {
+	session, err := a.getThreePIDSession(ctx, req.SessionID, req.ClientSecret)
+	if err != nil || session == nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(session.Token), []byte(req.Token)) != 1 {
+		return nil
+	}
+	if !session.Validated() {
+		if err = a.DB.ValidateThreePIDSession(ctx, session.SessionID, gomatrixserverlib.AsTimestamp(time.Now())); err != nil {
+			return err
+		}
+	}
+	res.Validated = true
+	res.NextLink = session.NextLink
+	return nil
+}
+
+// PerformThreePIDSessionDeletion deletes a session once it has been used.
+func (a *UserInternalAPI) PerformThreePIDSessionDeletion(ctx context.Context, req *api.PerformThreePIDSessionDeletionRequest, res *struct{}) error {
+	return a.DB.RemoveThreePIDSession(ctx, req.SessionID)
+}
+
+// QueryThreePIDSession returns a session which hasn't expired yet.
+func (a *UserInternalAPI) QueryThreePIDSession(ctx context.Context, req *api.QueryThreePIDSessionRequest, res *api.QueryThreePIDSessionResponse) error {
+	session, err := a.getThreePIDSession(ctx, req.SessionID, req.ClientSecret)
+	if err != nil || session == nil {
+		return err
+	}
+	session.Token = ""
+	res.Session = session
+	return nil
+}
+
+// getThreePIDSession returns the session if it exists, hasn't expired and the
+// client secret matches, or nil otherwise.
+func (a *UserInternalAPI) getThreePIDSession(ctx context.Context, sessionID, clientSecret string) (*api.ThreePIDSession, error) {
+	session, err := a.DB.GetThreePIDSession(ctx, sessionID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(session.ClientSecret), []byte(clientSecret)) != 1 {
+		return nil, nil
+	}
+	if !time.Now().Before(session.ExpiresAt.Time()) {
+		return nil, nil
+	}
+	return session, nil
+}
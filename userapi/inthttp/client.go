@@ -34,6 +34,7 @@ const (
 	PerformLastSeenUpdatePath          = "/userapi/performLastSeenUpdate"
 	PerformDeviceUpdatePath            = "/userapi/performDeviceUpdate"
 	PerformAccountDeactivationPath     = "/userapi/performAccountDeactivation"
+	PerformAccountShadowBanPath        = "/userapi/performAccountShadowBan"
 	PerformOpenIDTokenCreationPath     = "/userapi/performOpenIDTokenCreation"
 	PerformKeyBackupPath               = "/userapi/performKeyBackup"
 	PerformPusherSetPath               = "/pushserver/performPusherSet"
@@ -51,8 +52,10 @@ const (
 	QueryAccountDataPath           = "/userapi/queryAccountData"
 	QueryDeviceInfosPath           = "/userapi/queryDeviceInfos"
 	QuerySearchProfilesPath        = "/userapi/querySearchProfiles"
+	QuerySearchUserDirectoryPath   = "/userapi/querySearchUserDirectory"
 	QueryOpenIDTokenPath           = "/userapi/queryOpenIDToken"
 	QueryPushersPath               = "/pushserver/queryPushers"
+	QueryPusherStatusPath          = "/pushserver/queryPusherStatus"
 	QueryPushRulesPath             = "/pushserver/queryPushRules"
 	QueryNotificationsPath         = "/pushserver/queryNotifications"
 	QueryNumericLocalpartPath      = "/userapi/queryNumericLocalpart"
@@ -166,6 +169,17 @@ func (h *httpUserInternalAPI) PerformAccountDeactivation(
 	)
 }
 
+func (h *httpUserInternalAPI) PerformAccountShadowBan(
+	ctx context.Context,
+	request *api.PerformAccountShadowBanRequest,
+	response *api.PerformAccountShadowBanResponse,
+) error {
+	return httputil.CallInternalRPCAPI(
+		"PerformAccountShadowBan", h.apiURL+PerformAccountShadowBanPath,
+		h.httpClient, ctx, request, response,
+	)
+}
+
 func (h *httpUserInternalAPI) PerformOpenIDTokenCreation(
 	ctx context.Context,
 	request *api.PerformOpenIDTokenCreationRequest,
@@ -243,6 +257,17 @@ func (h *httpUserInternalAPI) QuerySearchProfiles(
 	)
 }
 
+func (h *httpUserInternalAPI) QuerySearchUserDirectory(
+	ctx context.Context,
+	request *api.QuerySearchUserDirectoryRequest,
+	response *api.QuerySearchUserDirectoryResponse,
+) error {
+	return httputil.CallInternalRPCAPI(
+		"QuerySearchUserDirectory", h.apiURL+QuerySearchUserDirectoryPath,
+		h.httpClient, ctx, request, response,
+	)
+}
+
 func (h *httpUserInternalAPI) QueryOpenIDToken(
 	ctx context.Context,
 	request *api.QueryOpenIDTokenRequest,
@@ -320,6 +345,17 @@ func (h *httpUserInternalAPI) QueryPushers(
 	)
 }
 
+func (h *httpUserInternalAPI) QueryPusherStatus(
+	ctx context.Context,
+	request *api.QueryPusherStatusRequest,
+	response *api.QueryPusherStatusResponse,
+) error {
+	return httputil.CallInternalRPCAPI(
+		"QueryPusherStatus", h.apiURL+QueryPusherStatusPath,
+		h.httpClient, ctx, request, response,
+	)
+}
+
 func (h *httpUserInternalAPI) PerformPushRulesPut(
 	ctx context.Context,
 	request *api.PerformPushRulesPutRequest,
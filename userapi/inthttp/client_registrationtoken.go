@@ -0,0 +1,85 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inthttp
+
+import (
+	"context"
+
+	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+const (
+	PerformRegistrationTokenCreationPath = "/userapi/performRegistrationTokenCreation"
+	PerformRegistrationTokenUpdatePath   = "/userapi/performRegistrationTokenUpdate"
+	PerformRegistrationTokenDeletionPath = "/userapi/performRegistrationTokenDeletion"
+	PerformRegistrationTokenUsePath      = "/userapi/performRegistrationTokenUse"
+	QueryRegistrationTokensPath          = "/userapi/queryRegistrationTokens"
+)
+
+func (h *httpUserInternalAPI) PerformRegistrationTokenCreation(
+	ctx context.Context,
+	request *api.PerformRegistrationTokenCreationRequest,
+	response *api.PerformRegistrationTokenCreationResponse,
+) error {
+	return httputil.CallInternalRPCAPI(
+		"PerformRegistrationTokenCreation", h.apiURL+PerformRegistrationTokenCreationPath,
+		h.httpClient, ctx, request, response,
+	)
+}
+
+func (h *httpUserInternalAPI) PerformRegistrationTokenUpdate(
+	ctx context.Context,
+	request *api.PerformRegistrationTokenUpdateRequest,
+	response *api.PerformRegistrationTokenUpdateResponse,
+) error {
+	return httputil.CallInternalRPCAPI(
+		"PerformRegistrationTokenUpdate", h.apiURL+PerformRegistrationTokenUpdatePath,
+		h.httpClient, ctx, request, response,
+	)
+}
+
+func (h *httpUserInternalAPI) PerformRegistrationTokenDeletion(
+	ctx context.Context,
+	request *api.PerformRegistrationTokenDeletionRequest,
+	response *api.PerformRegistrationTokenDeletionResponse,
+) error {
+	return httputil.CallInternalRPCAPI(
+		"PerformRegistrationTokenDeletion", h.apiURL+PerformRegistrationTokenDeletionPath,
+		h.httpClient, ctx, request, response,
+	)
+}
+
+func (h *httpUserInternalAPI) PerformRegistrationTokenUse(
+	ctx context.Context,
+	request *api.PerformRegistrationTokenUseRequest,
+	response *api.PerformRegistrationTokenUseResponse,
+) error {
+	return httputil.CallInternalRPCAPI(
+		"PerformRegistrationTokenUse", h.apiURL+PerformRegistrationTokenUsePath,
+		h.httpClient, ctx, request, response,
+	)
+}
+
+func (h *httpUserInternalAPI) QueryRegistrationTokens(
+	ctx context.Context,
+	request *api.QueryRegistrationTokensRequest,
+	response *api.QueryRegistrationTokensResponse,
+) error {
+	return httputil.CallInternalRPCAPI(
+		"QueryRegistrationTokens", h.apiURL+QueryRegistrationTokensPath,
+		h.httpClient, ctx, request, response,
+	)
+}
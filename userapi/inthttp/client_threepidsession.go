@@ -0,0 +1,73 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inthttp
+
+import (
+	"context"
+
+	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+const (
+	PerformThreePIDSessionCreationPath   = "/userapi/performThreePIDSessionCreation"
+	PerformThreePIDSessionValidationPath = "/userapi/performThreePIDSessionValidation"
+	PerformThreePIDSessionDeletionPath   = "/userapi/performThreePIDSessionDeletion"
+	QueryThreePIDSessionPath             = "/userapi/queryThreePIDSession"
+)
+
+func (h *httpUserInternalAPI) PerformThreePIDSessionCreation(
+	ctx context.Context,
+	request *api.PerformThreePIDSessionCreationRequest,
+	response *api.PerformThreePIDSessionCreationResponse,
+) error {
+	return httputil.CallInternalRPCAPI(
+		"PerformThreePIDSessionCreation", h.apiURL+PerformThreePIDSessionCreationPath,
+		h.httpClient, ctx, request, response,
+	)
+}
+
+func (h *httpUserInternalAPI) PerformThreePIDSessionValidation(
+	ctx context.Context,
+	request *api.PerformThreePIDSessionValidationRequest,
+	response *api.PerformThreePIDSessionValidationResponse,
+) error {
+	return httputil.CallInternalRPCAPI(
+		"PerformThreePIDSessionValidation", h.apiURL+PerformThreePIDSessionValidationPath,
+		h.httpClient, ctx, request, response,
+	)
+}
+
+func (h *httpUserInternalAPI) PerformThreePIDSessionDeletion(
+	ctx context.Context,
+	request *api.PerformThreePIDSessionDeletionRequest,
+	response *struct{},
+) error {
+	return httputil.CallInternalRPCAPI(
+		"PerformThreePIDSessionDeletion", h.apiURL+PerformThreePIDSessionDeletionPath,
+		h.httpClient, ctx, request, response,
+	)
+}
+
+func (h *httpUserInternalAPI) QueryThreePIDSession(
+	ctx context.Context,
+	request *api.QueryThreePIDSessionRequest,
+	response *api.QueryThreePIDSessionResponse,
+) error {
+	return httputil.CallInternalRPCAPI(
+		"QueryThreePIDSession", h.apiURL+QueryThreePIDSessionPath,
+		h.httpClient, ctx, request, response,
+	)
+}
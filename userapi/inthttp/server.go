@@ -15,17 +15,18 @@
 package inthttp
 
 import (
-	"net/http"
+	"context"
 
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/dendrite/internal/httputil"
 	"github.com/matrix-org/dendrite/userapi/api"
-	"github.com/matrix-org/util"
 )
 
 // nolint: gocyclo
 func AddRoutes(internalAPIMux *mux.Router, s api.UserInternalAPI) {
 	addRoutesLoginToken(internalAPIMux, s)
+	addRoutesRegistrationToken(internalAPIMux, s)
+	addRoutesThreePIDSession(internalAPIMux, s)
 
 	internalAPIMux.Handle(
 		PerformAccountCreationPath,
@@ -62,6 +63,11 @@ func AddRoutes(internalAPIMux *mux.Router, s api.UserInternalAPI) {
 		httputil.MakeInternalRPCAPI("UserAPIPerformAccountDeactivation", s.PerformAccountDeactivation),
 	)
 
+	internalAPIMux.Handle(
+		PerformAccountShadowBanPath,
+		httputil.MakeInternalRPCAPI("UserAPIPerformAccountShadowBan", s.PerformAccountShadowBan),
+	)
+
 	internalAPIMux.Handle(
 		PerformOpenIDTokenCreationPath,
 		httputil.MakeInternalRPCAPI("UserAPIPerformOpenIDTokenCreation", s.PerformOpenIDTokenCreation),
@@ -97,6 +103,11 @@ func AddRoutes(internalAPIMux *mux.Router, s api.UserInternalAPI) {
 		httputil.MakeInternalRPCAPI("UserAPIQuerySearchProfiles", s.QuerySearchProfiles),
 	)
 
+	internalAPIMux.Handle(
+		QuerySearchUserDirectoryPath,
+		httputil.MakeInternalRPCAPI("UserAPIQuerySearchUserDirectory", s.QuerySearchUserDirectory),
+	)
+
 	internalAPIMux.Handle(
 		QueryOpenIDTokenPath,
 		httputil.MakeInternalRPCAPI("UserAPIQueryOpenIDToken", s.QueryOpenIDToken),
@@ -137,6 +148,11 @@ func AddRoutes(internalAPIMux *mux.Router, s api.UserInternalAPI) {
 		httputil.MakeInternalRPCAPI("UserAPIQueryPushers", s.QueryPushers),
 	)
 
+	internalAPIMux.Handle(
+		QueryPusherStatusPath,
+		httputil.MakeInternalRPCAPI("UserAPIQueryPusherStatus", s.QueryPusherStatus),
+	)
+
 	internalAPIMux.Handle(
 		PerformPushRulesPutPath,
 		httputil.MakeInternalRPCAPI("UserAPIPerformPushRulesPut", s.PerformPushRulesPut),
@@ -152,15 +168,14 @@ func AddRoutes(internalAPIMux *mux.Router, s api.UserInternalAPI) {
 		httputil.MakeInternalRPCAPI("UserAPIPerformSetAvatarURL", s.SetAvatarURL),
 	)
 
-	// TODO: Look at the shape of this
-	internalAPIMux.Handle(QueryNumericLocalpartPath,
-		httputil.MakeInternalAPI("UserAPIQueryNumericLocalpart", func(req *http.Request) util.JSONResponse {
-			response := api.QueryNumericLocalpartResponse{}
-			if err := s.QueryNumericLocalpart(req.Context(), &response); err != nil {
-				return util.ErrorResponse(err)
-			}
-			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
-		}),
+	internalAPIMux.Handle(
+		QueryNumericLocalpartPath,
+		httputil.MakeInternalRPCAPI(
+			"UserAPIQueryNumericLocalpart",
+			func(ctx context.Context, _ *struct{}, res *api.QueryNumericLocalpartResponse) error {
+				return s.QueryNumericLocalpart(ctx, res)
+			},
+		),
 	)
 
 	internalAPIMux.Handle(
@@ -0,0 +1,49 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inthttp
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+// addRoutesRegistrationToken adds routes for all registration token API calls.
+func addRoutesRegistrationToken(internalAPIMux *mux.Router, s api.UserInternalAPI) {
+	internalAPIMux.Handle(
+		PerformRegistrationTokenCreationPath,
+		httputil.MakeInternalRPCAPI("UserAPIPerformRegistrationTokenCreation", s.PerformRegistrationTokenCreation),
+	)
+
+	internalAPIMux.Handle(
+		PerformRegistrationTokenUpdatePath,
+		httputil.MakeInternalRPCAPI("UserAPIPerformRegistrationTokenUpdate", s.PerformRegistrationTokenUpdate),
+	)
+
+	internalAPIMux.Handle(
+		PerformRegistrationTokenDeletionPath,
+		httputil.MakeInternalRPCAPI("UserAPIPerformRegistrationTokenDeletion", s.PerformRegistrationTokenDeletion),
+	)
+
+	internalAPIMux.Handle(
+		PerformRegistrationTokenUsePath,
+		httputil.MakeInternalRPCAPI("UserAPIPerformRegistrationTokenUse", s.PerformRegistrationTokenUse),
+	)
+
+	internalAPIMux.Handle(
+		QueryRegistrationTokensPath,
+		httputil.MakeInternalRPCAPI("UserAPIQueryRegistrationTokens", s.QueryRegistrationTokens),
+	)
+}
@@ -0,0 +1,99 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/pushgateway"
+	"github.com/matrix-org/dendrite/setup/jetstream"
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+)
+
+// PushNotification is a notification which is waiting to be delivered to
+// the push gateway of a single pusher.
+type PushNotification struct {
+	Localpart string                    `json:"localpart"`
+	URL       string                    `json:"url"`
+	Request   pushgateway.NotifyRequest `json:"request"`
+}
+
+// Device returns the pusher which the notification is for.
+func (n *PushNotification) Device() *pushgateway.Device {
+	if len(n.Request.Notification.Devices) == 0 {
+		return nil
+	}
+	return n.Request.Notification.Devices[0]
+}
+
+// PushGateway queues notifications for delivery to push gateways.
+type PushGateway struct {
+	producer JetStreamPublisher
+	topic    string
+}
+
+func NewPushGateway(js JetStreamPublisher, topic string) *PushGateway {
+	return &PushGateway{
+		producer: js,
+		topic:    topic,
+	}
+}
+
+// SendNotification queues a notification for a single pusher, which must
+// be the only device in the request. Notifications which only update the
+// badge count of a pusher replace any such update which is still queued.
+func (p *PushGateway) SendNotification(ctx context.Context, localpart, url string, req *pushgateway.NotifyRequest) error {
+	if len(req.Notification.Devices) != 1 {
+		return fmt.Errorf("expected a single device, got %d", len(req.Notification.Devices))
+	}
+	dev := req.Notification.Devices[0]
+
+	// Every pusher gets its own subjects, so that the stream can drop
+	// badge count updates which have been superseded.
+	pusher := sha256.Sum256([]byte(localpart + "\x00" + dev.AppID + "\x00" + dev.PushKey))
+	kind := "counts"
+	if req.Notification.EventID != "" {
+		kind = jetstream.Tokenise(req.Notification.EventID)
+	}
+
+	m := &nats.Msg{
+		Subject: fmt.Sprintf("%s.%s.%s", p.topic, hex.EncodeToString(pusher[:16]), kind),
+		Header:  nats.Header{},
+	}
+	var err error
+	m.Data, err = json.Marshal(PushNotification{
+		Localpart: localpart,
+		URL:       url,
+		Request:   *req,
+	})
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"localpart": localpart,
+		"app_id":    dev.AppID,
+		"event_id":  req.Notification.EventID,
+	}).Tracef("Producing to topic '%s'", p.topic)
+
+	jetstream.InjectSpan(ctx, m)
+	_, err = p.producer.PublishMsg(m)
+	return err
+}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/matrix-org/dendrite/internal/eventutil"
 	"github.com/matrix-org/dendrite/setup/jetstream"
+	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/dendrite/userapi/storage"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/nats-io/nats.go"
@@ -34,7 +35,7 @@ func NewSyncAPI(db storage.Database, js JetStreamPublisher, clientDataTopic stri
 }
 
 // SendAccountData sends account data to the Sync API server.
-func (p *SyncAPI) SendAccountData(userID string, data eventutil.AccountData) error {
+func (p *SyncAPI) SendAccountData(ctx context.Context, userID string, data eventutil.AccountData) error {
 	m := &nats.Msg{
 		Subject: p.clientDataTopic,
 		Header:  nats.Header{},
@@ -53,6 +54,7 @@ func (p *SyncAPI) SendAccountData(userID string, data eventutil.AccountData) err
 		"data_type": data.Type,
 	}).Tracef("Producing to topic '%s'", p.clientDataTopic)
 
+	jetstream.InjectSpan(ctx, m)
 	_, err = p.producer.PublishMsg(m)
 	return err
 }
@@ -69,16 +71,30 @@ func (p *SyncAPI) GetAndSendNotificationData(ctx context.Context, userID, roomID
 	if err != nil {
 		return err
 	}
+	threadCounts, err := p.db.GetThreadNotificationCounts(ctx, localpart, roomID)
+	if err != nil {
+		return err
+	}
 
-	return p.sendNotificationData(userID, &eventutil.NotificationData{
+	data := &eventutil.NotificationData{
 		RoomID:                  roomID,
 		UnreadHighlightCount:    int(nhighlight),
 		UnreadNotificationCount: int(ntotal),
-	})
+	}
+	if len(threadCounts) > 0 {
+		data.UnreadThreadNotifications = make(map[string]types.UnreadNotificationCounts, len(threadCounts))
+		for threadID, counts := range threadCounts {
+			data.UnreadThreadNotifications[threadID] = types.UnreadNotificationCounts{
+				HighlightCount:    int(counts.Highlight),
+				NotificationCount: int(counts.Total),
+			}
+		}
+	}
+	return p.sendNotificationData(ctx, userID, data)
 }
 
 // sendNotificationData sends data about unread notifications to the Sync API server.
-func (p *SyncAPI) sendNotificationData(userID string, data *eventutil.NotificationData) error {
+func (p *SyncAPI) sendNotificationData(ctx context.Context, userID string, data *eventutil.NotificationData) error {
 	m := &nats.Msg{
 		Subject: p.notificationDataTopic,
 		Header:  nats.Header{},
@@ -96,6 +112,7 @@ func (p *SyncAPI) sendNotificationData(userID string, data *eventutil.Notificati
 		"room_id": data.RoomID,
 	}).Tracef("Producing to topic '%s'", p.clientDataTopic)
 
+	jetstream.InjectSpan(ctx, m)
 	_, err = p.producer.PublishMsg(m)
 	return err
 }
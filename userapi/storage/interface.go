@@ -23,6 +23,7 @@ import (
 	"github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/dendrite/userapi/storage/tables"
 	"github.com/matrix-org/dendrite/userapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 type Profile interface {
@@ -43,6 +44,11 @@ type Account interface {
 	GetAccountByLocalpart(ctx context.Context, localpart string) (*api.Account, error)
 	DeactivateAccount(ctx context.Context, localpart string) (err error)
 	SetPassword(ctx context.Context, localpart string, plaintextPassword string) error
+	// SetShadowBanned marks or unmarks the account as shadow-banned. Returns
+	// sql.ErrNoRows if the account doesn't exist.
+	SetShadowBanned(ctx context.Context, localpart string, shadowBanned bool) error
+	// GetLocalparts returns the localparts of all accounts which aren't deactivated.
+	GetLocalparts(ctx context.Context) ([]string, error)
 }
 
 type AccountData interface {
@@ -97,6 +103,37 @@ type LoginToken interface {
 	GetLoginTokenDataByToken(ctx context.Context, token string) (*api.LoginTokenData, error)
 }
 
+type RegistrationToken interface {
+	// CreateRegistrationToken stores a new registration token. Returns false
+	// if a token with the same value already exists.
+	CreateRegistrationToken(ctx context.Context, token *api.RegistrationToken) (bool, error)
+	GetRegistrationTokens(ctx context.Context) ([]api.RegistrationToken, error)
+	// GetRegistrationToken returns the named token. May return sql.ErrNoRows.
+	GetRegistrationToken(ctx context.Context, token string) (*api.RegistrationToken, error)
+	// UpdateRegistrationToken replaces the uses allowed and expiry time of the
+	// named token and returns the updated token. May return sql.ErrNoRows.
+	UpdateRegistrationToken(ctx context.Context, token string, usesAllowed *int32, expiryTime *gomatrixserverlib.Timestamp) (*api.RegistrationToken, error)
+	RemoveRegistrationToken(ctx context.Context, token string) (bool, error)
+	// BeginRegistrationTokenUse marks a use of the token as pending, returning
+	// false if the token doesn't exist or is no longer valid.
+	BeginRegistrationTokenUse(ctx context.Context, token string) (bool, error)
+	CompleteRegistrationTokenUse(ctx context.Context, token string) error
+	ReleaseRegistrationTokenUse(ctx context.Context, token string) error
+}
+
+type ThreePIDSession interface {
+	// CreateThreePIDSession stores the given session, unless a session already
+	// exists for the same client secret and third-party identifier. In that case
+	// the existing session is returned instead, updated with the new send attempt
+	// if it is higher. The returned bool is true if the validation token should
+	// be sent, i.e. the session is new or the send attempt was higher.
+	CreateThreePIDSession(ctx context.Context, session *api.ThreePIDSession) (*api.ThreePIDSession, bool, error)
+	// GetThreePIDSession returns the session. May return sql.ErrNoRows.
+	GetThreePIDSession(ctx context.Context, sessionID string) (*api.ThreePIDSession, error)
+	ValidateThreePIDSession(ctx context.Context, sessionID string, validatedAt gomatrixserverlib.Timestamp) error
+	RemoveThreePIDSession(ctx context.Context, sessionID string) error
+}
+
 type OpenID interface {
 	CreateOpenIDToken(ctx context.Context, token, userID string) (exp int64, err error)
 	GetOpenIDTokenAttributes(ctx context.Context, token string) (*api.OpenIDTokenAttributes, error)
@@ -107,6 +144,13 @@ type Pusher interface {
 	GetPushers(ctx context.Context, localpart string) ([]api.Pusher, error)
 	RemovePusher(ctx context.Context, appid, pushkey, localpart string) error
 	RemovePushers(ctx context.Context, appid, pushkey string) error
+	GetPusherFailure(ctx context.Context, localpart, appid, pushkey string) (*api.PusherFailure, error)
+	GetPusherFailures(ctx context.Context, localpart string) ([]api.PusherFailure, error)
+	UpsertPusherFailure(ctx context.Context, localpart string, f *api.PusherFailure) error
+	RemovePusherFailure(ctx context.Context, localpart, appid, pushkey string) error
+	GetPushersByKind(ctx context.Context, kind api.PusherKind) (map[string][]api.Pusher, error)
+	GetPusherLastEmailedNotificationID(ctx context.Context, localpart, appid, pushkey string) (int64, error)
+	SetPusherLastEmailedNotificationID(ctx context.Context, localpart, appid, pushkey string, id int64) error
 }
 
 type ThreePID interface {
@@ -117,12 +161,13 @@ type ThreePID interface {
 }
 
 type Notification interface {
-	InsertNotification(ctx context.Context, localpart, eventID string, pos int64, tweaks map[string]interface{}, n *api.Notification) error
+	InsertNotification(ctx context.Context, localpart, eventID, threadID string, pos int64, tweaks map[string]interface{}, n *api.Notification) error
 	DeleteNotificationsUpTo(ctx context.Context, localpart, roomID string, pos int64) (affected bool, err error)
-	SetNotificationsRead(ctx context.Context, localpart, roomID string, pos int64, read bool) (affected bool, err error)
+	SetNotificationsRead(ctx context.Context, localpart, roomID, threadID string, pos int64, read bool) (affected bool, err error)
 	GetNotifications(ctx context.Context, localpart string, fromID int64, limit int, filter tables.NotificationFilter) ([]*api.Notification, int64, error)
 	GetNotificationCount(ctx context.Context, localpart string, filter tables.NotificationFilter) (int64, error)
 	GetRoomNotificationCounts(ctx context.Context, localpart, roomID string) (total int64, highlight int64, _ error)
+	GetThreadNotificationCounts(ctx context.Context, localpart, roomID string) (map[string]tables.NotificationCounts, error)
 	DeleteOldNotifications(ctx context.Context) error
 }
 
@@ -136,8 +181,29 @@ type Database interface {
 	OpenID
 	Profile
 	Pusher
+	RegistrationToken
 	Statistics
 	ThreePID
+	ThreePIDSession
+	UserDirectory
+}
+
+type UserDirectory interface {
+	// UpdateUserDirectoryRoom applies a change to the state of a room to the
+	// user directory.
+	UpdateUserDirectoryRoom(ctx context.Context, update *types.UserDirectoryRoomUpdate) error
+	// UserDirectoryBackfilled returns true if BackfillUserDirectory has
+	// already completed.
+	UserDirectoryBackfilled(ctx context.Context) (bool, error)
+	// BackfillUserDirectory applies the current state of rooms to the user
+	// directory, as for rewrites of their state, and records that it has done
+	// so. It does nothing if that was already recorded.
+	BackfillUserDirectory(ctx context.Context, updates []*types.UserDirectoryRoomUpdate) error
+	// SearchUserDirectory returns the users matching the search string which
+	// are visible to the searching user. If searchAll is true, all users
+	// known to the server are searched, including local users who aren't
+	// joined to any rooms.
+	SearchUserDirectory(ctx context.Context, userID, searchString string, limit int, searchAll bool) ([]authtypes.FullyQualifiedProfile, error)
 }
 
 type Statistics interface {
@@ -21,7 +21,9 @@ import (
 
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/storage/postgres/deltas"
 	"github.com/matrix-org/dendrite/userapi/storage/tables"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 const accountDataSchema = `
@@ -57,12 +59,21 @@ type accountDataStatements struct {
 	selectAccountDataByTypeStmt *sql.Stmt
 }
 
-func NewPostgresAccountDataTable(db *sql.DB) (tables.AccountDataTable, error) {
+func NewPostgresAccountDataTable(db *sql.DB, serverName gomatrixserverlib.ServerName) (tables.AccountDataTable, error) {
 	s := &accountDataStatements{}
 	_, err := db.Exec(accountDataSchema)
 	if err != nil {
 		return nil, err
 	}
+	m := sqlutil.NewMigrator(db)
+	m.AddMigrations(sqlutil.Migration{
+		Version: "userapi: add default push rules",
+		Up:      deltas.UpAddDefaultPushRules(serverName),
+		Down:    deltas.DownAddDefaultPushRules,
+	})
+	if err = m.Up(context.Background()); err != nil {
+		return nil, err
+	}
 	return s, sqlutil.StatementList{
 		{&s.insertAccountDataStmt, insertAccountDataSQL},
 		{&s.selectAccountDataStmt, selectAccountDataSQL},
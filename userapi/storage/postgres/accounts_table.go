@@ -22,6 +22,7 @@ import (
 	"github.com/matrix-org/gomatrixserverlib"
 
 	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/dendrite/userapi/storage/postgres/deltas"
@@ -44,7 +45,9 @@ CREATE TABLE IF NOT EXISTS account_accounts (
     -- If the account is currently active
     is_deactivated BOOLEAN DEFAULT FALSE,
 	-- The account_type (user = 1, guest = 2, admin = 3, appservice = 4)
-	account_type SMALLINT NOT NULL
+	account_type SMALLINT NOT NULL,
+    -- Whether the account has been shadow-banned by a server admin
+    shadow_banned BOOLEAN NOT NULL DEFAULT FALSE
     -- TODO:
     -- upgraded_ts, devices, any email reset stuff?
 );
@@ -60,11 +63,17 @@ const deactivateAccountSQL = "" +
 	"UPDATE account_accounts SET is_deactivated = TRUE WHERE localpart = $1"
 
 const selectAccountByLocalpartSQL = "" +
-	"SELECT localpart, appservice_id, account_type FROM account_accounts WHERE localpart = $1"
+	"SELECT localpart, appservice_id, account_type, shadow_banned FROM account_accounts WHERE localpart = $1"
+
+const updateShadowBannedSQL = "" +
+	"UPDATE account_accounts SET shadow_banned = $1 WHERE localpart = $2"
 
 const selectPasswordHashSQL = "" +
 	"SELECT password_hash FROM account_accounts WHERE localpart = $1 AND is_deactivated = FALSE"
 
+const selectLocalpartsSQL = "" +
+	"SELECT localpart FROM account_accounts WHERE is_deactivated = FALSE"
+
 const selectNewNumericLocalpartSQL = "" +
 	"SELECT COALESCE(MAX(localpart::bigint), 0) FROM account_accounts WHERE localpart ~ '^[0-9]{1,}$'"
 
@@ -72,8 +81,10 @@ type accountsStatements struct {
 	insertAccountStmt             *sql.Stmt
 	updatePasswordStmt            *sql.Stmt
 	deactivateAccountStmt         *sql.Stmt
+	updateShadowBannedStmt        *sql.Stmt
 	selectAccountByLocalpartStmt  *sql.Stmt
 	selectPasswordHashStmt        *sql.Stmt
+	selectLocalpartsStmt          *sql.Stmt
 	selectNewNumericLocalpartStmt *sql.Stmt
 	serverName                    gomatrixserverlib.ServerName
 }
@@ -98,6 +109,11 @@ func NewPostgresAccountsTable(db *sql.DB, serverName gomatrixserverlib.ServerNam
 			Up:      deltas.UpAddAccountType,
 			Down:    deltas.DownAddAccountType,
 		},
+		{
+			Version: "userapi: add shadow banned",
+			Up:      deltas.UpAddShadowBanned,
+			Down:    deltas.DownAddShadowBanned,
+		},
 	}...)
 	err = m.Up(context.Background())
 	if err != nil {
@@ -107,8 +123,10 @@ func NewPostgresAccountsTable(db *sql.DB, serverName gomatrixserverlib.ServerNam
 		{&s.insertAccountStmt, insertAccountSQL},
 		{&s.updatePasswordStmt, updatePasswordSQL},
 		{&s.deactivateAccountStmt, deactivateAccountSQL},
+		{&s.updateShadowBannedStmt, updateShadowBannedSQL},
 		{&s.selectAccountByLocalpartStmt, selectAccountByLocalpartSQL},
 		{&s.selectPasswordHashStmt, selectPasswordHashSQL},
+		{&s.selectLocalpartsStmt, selectLocalpartsSQL},
 		{&s.selectNewNumericLocalpartStmt, selectNewNumericLocalpartSQL},
 	}.Prepare(db)
 }
@@ -155,6 +173,13 @@ func (s *accountsStatements) DeactivateAccount(
 	return
 }
 
+func (s *accountsStatements) UpdateShadowBanned(
+	ctx context.Context, txn *sql.Tx, localpart string, shadowBanned bool,
+) (err error) {
+	_, err = sqlutil.TxStmt(txn, s.updateShadowBannedStmt).ExecContext(ctx, shadowBanned, localpart)
+	return
+}
+
 func (s *accountsStatements) SelectPasswordHash(
 	ctx context.Context, localpart string,
 ) (hash string, err error) {
@@ -169,7 +194,7 @@ func (s *accountsStatements) SelectAccountByLocalpart(
 	var acc api.Account
 
 	stmt := s.selectAccountByLocalpartStmt
-	err := stmt.QueryRowContext(ctx, localpart).Scan(&acc.Localpart, &appserviceIDPtr, &acc.AccountType)
+	err := stmt.QueryRowContext(ctx, localpart).Scan(&acc.Localpart, &appserviceIDPtr, &acc.AccountType, &acc.ShadowBanned)
 	if err != nil {
 		if err != sql.ErrNoRows {
 			log.WithError(err).Error("Unable to retrieve user from the db")
@@ -186,6 +211,25 @@ func (s *accountsStatements) SelectAccountByLocalpart(
 	return &acc, nil
 }
 
+func (s *accountsStatements) SelectLocalparts(
+	ctx context.Context,
+) ([]string, error) {
+	rows, err := s.selectLocalpartsStmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectLocalparts: rows.close() failed")
+	var localparts []string
+	for rows.Next() {
+		var localpart string
+		if err = rows.Scan(&localpart); err != nil {
+			return nil, err
+		}
+		localparts = append(localparts, localpart)
+	}
+	return localparts, rows.Err()
+}
+
 func (s *accountsStatements) SelectNewNumericLocalpart(
 	ctx context.Context, txn *sql.Tx,
 ) (id int64, err error) {
@@ -0,0 +1,61 @@
+package deltas
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/pushrules"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// UpAddDefaultPushRules adds the default push rules which were added
+// since the stored push rules of users were created.
+func UpAddDefaultPushRules(serverName gomatrixserverlib.ServerName) func(ctx context.Context, tx *sql.Tx) error {
+	return func(ctx context.Context, tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, "SELECT localpart, content FROM account_data WHERE room_id = '' AND type = 'm.push_rules'")
+		if err != nil {
+			return fmt.Errorf("failed to select push rules: %w", err)
+		}
+		contents := map[string][]byte{}
+		for rows.Next() {
+			var localpart string
+			var content []byte
+			if err = rows.Scan(&localpart, &content); err != nil {
+				_ = rows.Close()
+				return fmt.Errorf("failed to scan push rules: %w", err)
+			}
+			contents[localpart] = content
+		}
+		if err = rows.Close(); err != nil {
+			return err
+		}
+
+		for localpart, content := range contents {
+			var ruleSets pushrules.AccountRuleSets
+			if err = json.Unmarshal(content, &ruleSets); err != nil {
+				// The push rules are replaced with the defaults when
+				// they are next queried.
+				continue
+			}
+			if !pushrules.AddMissingDefaultRules(&ruleSets.Global, localpart, serverName) {
+				continue
+			}
+			if content, err = json.Marshal(ruleSets); err != nil {
+				return fmt.Errorf("failed to marshal push rules: %w", err)
+			}
+			_, err = tx.ExecContext(ctx, "UPDATE account_data SET content = $1 WHERE localpart = $2 AND room_id = '' AND type = 'm.push_rules'", string(content), localpart)
+			if err != nil {
+				return fmt.Errorf("failed to update push rules: %w", err)
+			}
+		}
+		return nil
+	}
+}
+
+func DownAddDefaultPushRules(ctx context.Context, tx *sql.Tx) error {
+	// The added rules don't need removing, since conditions which aren't
+	// understood never match.
+	return nil
+}
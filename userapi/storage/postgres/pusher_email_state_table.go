@@ -0,0 +1,100 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/storage/tables"
+)
+
+const pusherEmailStateSchema = `
+-- Stores which notifications have been emailed to email pushers.
+CREATE TABLE IF NOT EXISTS userapi_pusher_email_state (
+	localpart TEXT NOT NULL,
+	app_id TEXT NOT NULL,
+	pushkey TEXT NOT NULL,
+	-- The ID of the last notification in userapi_notifications which was emailed
+	last_notification_id BIGINT NOT NULL DEFAULT 0,
+	PRIMARY KEY (localpart, app_id, pushkey)
+);
+`
+
+const upsertPusherEmailStateSQL = "" +
+	"INSERT INTO userapi_pusher_email_state (localpart, app_id, pushkey, last_notification_id) VALUES ($1, $2, $3, $4)" +
+	" ON CONFLICT (localpart, app_id, pushkey) DO UPDATE SET last_notification_id = $4"
+
+const selectPusherEmailStateSQL = "" +
+	"SELECT last_notification_id FROM userapi_pusher_email_state WHERE localpart = $1 AND app_id = $2 AND pushkey = $3"
+
+const deletePusherEmailStateSQL = "" +
+	"DELETE FROM userapi_pusher_email_state WHERE localpart = $1 AND app_id = $2 AND pushkey = $3"
+
+const deletePusherEmailStatesByAppIDAndPushKeySQL = "" +
+	"DELETE FROM userapi_pusher_email_state WHERE app_id = $1 AND pushkey = $2"
+
+type pusherEmailStateStatements struct {
+	upsertPusherEmailStateStmt                   *sql.Stmt
+	selectPusherEmailStateStmt                   *sql.Stmt
+	deletePusherEmailStateStmt                   *sql.Stmt
+	deletePusherEmailStatesByAppIDAndPushKeyStmt *sql.Stmt
+}
+
+func NewPostgresPusherEmailStateTable(db *sql.DB) (tables.PusherEmailStateTable, error) {
+	s := &pusherEmailStateStatements{}
+	_, err := db.Exec(pusherEmailStateSchema)
+	if err != nil {
+		return nil, err
+	}
+	return s, sqlutil.StatementList{
+		{&s.upsertPusherEmailStateStmt, upsertPusherEmailStateSQL},
+		{&s.selectPusherEmailStateStmt, selectPusherEmailStateSQL},
+		{&s.deletePusherEmailStateStmt, deletePusherEmailStateSQL},
+		{&s.deletePusherEmailStatesByAppIDAndPushKeyStmt, deletePusherEmailStatesByAppIDAndPushKeySQL},
+	}.Prepare(db)
+}
+
+func (s *pusherEmailStateStatements) UpsertLastNotificationID(
+	ctx context.Context, txn *sql.Tx, localpart, appID, pushKey string, id int64,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.upsertPusherEmailStateStmt).ExecContext(ctx, localpart, appID, pushKey, id)
+	return err
+}
+
+func (s *pusherEmailStateStatements) SelectLastNotificationID(
+	ctx context.Context, txn *sql.Tx, localpart, appID, pushKey string,
+) (id int64, err error) {
+	err = sqlutil.TxStmt(txn, s.selectPusherEmailStateStmt).QueryRowContext(ctx, localpart, appID, pushKey).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, err
+}
+
+func (s *pusherEmailStateStatements) DeletePusherEmailState(
+	ctx context.Context, txn *sql.Tx, localpart, appID, pushKey string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deletePusherEmailStateStmt).ExecContext(ctx, localpart, appID, pushKey)
+	return err
+}
+
+func (s *pusherEmailStateStatements) DeletePusherEmailStates(
+	ctx context.Context, txn *sql.Tx, appID, pushKey string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deletePusherEmailStatesByAppIDAndPushKeyStmt).ExecContext(ctx, appID, pushKey)
+	return err
+}
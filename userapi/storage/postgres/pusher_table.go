@@ -62,6 +62,9 @@ const insertPusherSQL = "" +
 const selectPushersSQL = "" +
 	"SELECT session_id, pushkey, pushkey_ts_ms, kind, app_id, app_display_name, device_display_name, profile_tag, lang, data FROM userapi_pushers WHERE localpart = $1"
 
+const selectPushersByKindSQL = "" +
+	"SELECT localpart, session_id, pushkey, pushkey_ts_ms, kind, app_id, app_display_name, device_display_name, profile_tag, lang, data FROM userapi_pushers WHERE kind = $1"
+
 const deletePusherSQL = "" +
 	"DELETE FROM userapi_pushers WHERE app_id = $1 AND pushkey = $2 AND localpart = $3"
 
@@ -77,6 +80,7 @@ func NewPostgresPusherTable(db *sql.DB) (tables.PusherTable, error) {
 	return s, sqlutil.StatementList{
 		{&s.insertPusherStmt, insertPusherSQL},
 		{&s.selectPushersStmt, selectPushersSQL},
+		{&s.selectPushersByKindStmt, selectPushersByKindSQL},
 		{&s.deletePusherStmt, deletePusherSQL},
 		{&s.deletePushersByAppIdAndPushKeyStmt, deletePushersByAppIdAndPushKeySQL},
 	}.Prepare(db)
@@ -85,6 +89,7 @@ func NewPostgresPusherTable(db *sql.DB) (tables.PusherTable, error) {
 type pushersStatements struct {
 	insertPusherStmt                   *sql.Stmt
 	selectPushersStmt                  *sql.Stmt
+	selectPushersByKindStmt            *sql.Stmt
 	deletePusherStmt                   *sql.Stmt
 	deletePushersByAppIdAndPushKeyStmt *sql.Stmt
 }
@@ -140,6 +145,45 @@ func (s *pushersStatements) SelectPushers(
 	return pushers, rows.Err()
 }
 
+// SelectPushersByKind returns all pushers of the given kind, keyed by the
+// localpart of the user they belong to.
+func (s *pushersStatements) SelectPushersByKind(
+	ctx context.Context, txn *sql.Tx, kind api.PusherKind,
+) (map[string][]api.Pusher, error) {
+	pushers := map[string][]api.Pusher{}
+	rows, err := sqlutil.TxStmt(txn, s.selectPushersByKindStmt).QueryContext(ctx, kind)
+	if err != nil {
+		return pushers, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectPushersByKind: rows.close() failed")
+
+	for rows.Next() {
+		var localpart string
+		var pusher api.Pusher
+		var data []byte
+		err = rows.Scan(
+			&localpart,
+			&pusher.SessionID,
+			&pusher.PushKey,
+			&pusher.PushKeyTS,
+			&pusher.Kind,
+			&pusher.AppID,
+			&pusher.AppDisplayName,
+			&pusher.DeviceDisplayName,
+			&pusher.ProfileTag,
+			&pusher.Language,
+			&data)
+		if err != nil {
+			return pushers, err
+		}
+		if err = json.Unmarshal(data, &pusher.Data); err != nil {
+			return pushers, err
+		}
+		pushers[localpart] = append(pushers[localpart], pusher)
+	}
+	return pushers, rows.Err()
+}
+
 // deletePusher removes a single pusher by pushkey and user localpart.
 func (s *pushersStatements) DeletePusher(
 	ctx context.Context, txn *sql.Tx, appid, pushkey, localpart string,
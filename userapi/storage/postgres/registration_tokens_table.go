@@ -0,0 +1,203 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/tables"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const registrationTokensSchema = `
+-- Stores tokens which can be used to complete the m.login.registration_token
+-- registration stage.
+CREATE TABLE IF NOT EXISTS userapi_registration_tokens (
+	token TEXT NOT NULL PRIMARY KEY,
+	-- How many times the token may be used. NULL means unlimited.
+	uses_allowed INTEGER,
+	-- How many registrations using this token are in progress.
+	pending INTEGER NOT NULL DEFAULT 0,
+	-- How many registrations using this token have completed.
+	completed INTEGER NOT NULL DEFAULT 0,
+	-- When the token expires, as a unix timestamp (ms resolution). NULL means never.
+	expiry_time BIGINT
+);
+`
+
+const insertRegistrationTokenSQL = "" +
+	"INSERT INTO userapi_registration_tokens (token, uses_allowed, expiry_time) VALUES ($1, $2, $3)" +
+	" ON CONFLICT (token) DO NOTHING"
+
+const selectRegistrationTokensSQL = "" +
+	"SELECT token, uses_allowed, pending, completed, expiry_time FROM userapi_registration_tokens ORDER BY token"
+
+const selectRegistrationTokenSQL = "" +
+	"SELECT token, uses_allowed, pending, completed, expiry_time FROM userapi_registration_tokens WHERE token = $1"
+
+const updateRegistrationTokenSQL = "" +
+	"UPDATE userapi_registration_tokens SET uses_allowed = $2, expiry_time = $3 WHERE token = $1"
+
+const deleteRegistrationTokenSQL = "" +
+	"DELETE FROM userapi_registration_tokens WHERE token = $1"
+
+// Only marks the token as pending if it is still valid, so that concurrent
+// registrations can't use the token more than uses_allowed times.
+const updateRegistrationTokenPendingSQL = "" +
+	"UPDATE userapi_registration_tokens SET pending = pending + 1 WHERE token = $1" +
+	" AND (uses_allowed IS NULL OR pending + completed < uses_allowed)" +
+	" AND (expiry_time IS NULL OR expiry_time > $2)"
+
+const updateRegistrationTokenCompletedSQL = "" +
+	"UPDATE userapi_registration_tokens SET pending = pending - 1, completed = completed + 1 WHERE token = $1 AND pending > 0"
+
+const updateRegistrationTokenReleasedSQL = "" +
+	"UPDATE userapi_registration_tokens SET pending = pending - 1 WHERE token = $1 AND pending > 0"
+
+type registrationTokensStatements struct {
+	insertRegistrationTokenStmt          *sql.Stmt
+	selectRegistrationTokensStmt         *sql.Stmt
+	selectRegistrationTokenStmt          *sql.Stmt
+	updateRegistrationTokenStmt          *sql.Stmt
+	deleteRegistrationTokenStmt          *sql.Stmt
+	updateRegistrationTokenPendingStmt   *sql.Stmt
+	updateRegistrationTokenCompletedStmt *sql.Stmt
+	updateRegistrationTokenReleasedStmt  *sql.Stmt
+}
+
+func NewPostgresRegistrationTokensTable(db *sql.DB) (tables.RegistrationTokensTable, error) {
+	s := &registrationTokensStatements{}
+	_, err := db.Exec(registrationTokensSchema)
+	if err != nil {
+		return nil, err
+	}
+	return s, sqlutil.StatementList{
+		{&s.insertRegistrationTokenStmt, insertRegistrationTokenSQL},
+		{&s.selectRegistrationTokensStmt, selectRegistrationTokensSQL},
+		{&s.selectRegistrationTokenStmt, selectRegistrationTokenSQL},
+		{&s.updateRegistrationTokenStmt, updateRegistrationTokenSQL},
+		{&s.deleteRegistrationTokenStmt, deleteRegistrationTokenSQL},
+		{&s.updateRegistrationTokenPendingStmt, updateRegistrationTokenPendingSQL},
+		{&s.updateRegistrationTokenCompletedStmt, updateRegistrationTokenCompletedSQL},
+		{&s.updateRegistrationTokenReleasedStmt, updateRegistrationTokenReleasedSQL},
+	}.Prepare(db)
+}
+
+func (s *registrationTokensStatements) InsertRegistrationToken(
+	ctx context.Context, txn *sql.Tx, token *api.RegistrationToken,
+) (bool, error) {
+	stmt := sqlutil.TxStmt(txn, s.insertRegistrationTokenStmt)
+	res, err := stmt.ExecContext(ctx, token.Token, token.UsesAllowed, token.ExpiryTime)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *registrationTokensStatements) SelectRegistrationTokens(
+	ctx context.Context, txn *sql.Tx,
+) ([]api.RegistrationToken, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectRegistrationTokensStmt).QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectRegistrationTokens: rows.close() failed")
+	var tokens []api.RegistrationToken
+	for rows.Next() {
+		token, err := scanRegistrationToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, *token)
+	}
+	return tokens, rows.Err()
+}
+
+func (s *registrationTokensStatements) SelectRegistrationToken(
+	ctx context.Context, txn *sql.Tx, token string,
+) (*api.RegistrationToken, error) {
+	row := sqlutil.TxStmt(txn, s.selectRegistrationTokenStmt).QueryRowContext(ctx, token)
+	return scanRegistrationToken(row)
+}
+
+func (s *registrationTokensStatements) UpdateRegistrationToken(
+	ctx context.Context, txn *sql.Tx, token string, usesAllowed *int32, expiryTime *gomatrixserverlib.Timestamp,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.updateRegistrationTokenStmt)
+	_, err := stmt.ExecContext(ctx, token, usesAllowed, expiryTime)
+	return err
+}
+
+func (s *registrationTokensStatements) DeleteRegistrationToken(
+	ctx context.Context, txn *sql.Tx, token string,
+) (bool, error) {
+	res, err := sqlutil.TxStmt(txn, s.deleteRegistrationTokenStmt).ExecContext(ctx, token)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *registrationTokensStatements) UpdateRegistrationTokenPending(
+	ctx context.Context, txn *sql.Tx, token string, now gomatrixserverlib.Timestamp,
+) (bool, error) {
+	res, err := sqlutil.TxStmt(txn, s.updateRegistrationTokenPendingStmt).ExecContext(ctx, token, now)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *registrationTokensStatements) UpdateRegistrationTokenCompleted(
+	ctx context.Context, txn *sql.Tx, token string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.updateRegistrationTokenCompletedStmt).ExecContext(ctx, token)
+	return err
+}
+
+func (s *registrationTokensStatements) UpdateRegistrationTokenReleased(
+	ctx context.Context, txn *sql.Tx, token string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.updateRegistrationTokenReleasedStmt).ExecContext(ctx, token)
+	return err
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanRegistrationToken(row rowScanner) (*api.RegistrationToken, error) {
+	var token api.RegistrationToken
+	var usesAllowed sql.NullInt32
+	var expiryTime sql.NullInt64
+	if err := row.Scan(&token.Token, &usesAllowed, &token.Pending, &token.Completed, &expiryTime); err != nil {
+		return nil, err
+	}
+	if usesAllowed.Valid {
+		token.UsesAllowed = &usesAllowed.Int32
+	}
+	if expiryTime.Valid {
+		ts := gomatrixserverlib.Timestamp(expiryTime.Int64)
+		token.ExpiryTime = &ts
+	}
+	return &token, nil
+}
@@ -36,7 +36,7 @@ func NewDatabase(base *base.BaseDendrite, dbProperties *config.DatabaseOptions,
 		return nil, err
 	}
 
-	accountDataTable, err := NewPostgresAccountDataTable(db)
+	accountDataTable, err := NewPostgresAccountDataTable(db, serverName)
 	if err != nil {
 		return nil, fmt.Errorf("NewPostgresAccountDataTable: %w", err)
 	}
@@ -76,14 +76,34 @@ func NewDatabase(base *base.BaseDendrite, dbProperties *config.DatabaseOptions,
 	if err != nil {
 		return nil, fmt.Errorf("NewPostgresPusherTable: %w", err)
 	}
+	pusherFailuresTable, err := NewPostgresPusherFailuresTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("NewPostgresPusherFailuresTable: %w", err)
+	}
+	pusherEmailStateTable, err := NewPostgresPusherEmailStateTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("NewPostgresPusherEmailStateTable: %w", err)
+	}
 	notificationsTable, err := NewPostgresNotificationTable(db)
 	if err != nil {
 		return nil, fmt.Errorf("NewPostgresNotificationTable: %w", err)
 	}
+	registrationTokensTable, err := NewPostgresRegistrationTokensTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("NewPostgresRegistrationTokensTable: %w", err)
+	}
+	threePIDSessionsTable, err := NewPostgresThreePIDSessionsTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("NewPostgresThreePIDSessionsTable: %w", err)
+	}
 	statsTable, err := NewPostgresStatsTable(db, serverName)
 	if err != nil {
 		return nil, fmt.Errorf("NewPostgresStatsTable: %w", err)
 	}
+	userDirectoryTable, err := NewPostgresUserDirectoryTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("NewPostgresUserDirectoryTable: %w", err)
+	}
 	return &shared.Database{
 		AccountDatas:          accountDataTable,
 		Accounts:              accountsTable,
@@ -95,8 +115,13 @@ func NewDatabase(base *base.BaseDendrite, dbProperties *config.DatabaseOptions,
 		Profiles:              profilesTable,
 		ThreePIDs:             threePIDTable,
 		Pushers:               pusherTable,
+		PusherFailures:        pusherFailuresTable,
+		PusherEmailState:      pusherEmailStateTable,
 		Notifications:         notificationsTable,
+		RegistrationTokens:    registrationTokensTable,
+		ThreePIDSessions:      threePIDSessionsTable,
 		Stats:                 statsTable,
+		UserDirectory:         userDirectoryTable,
 		ServerName:            serverName,
 		DB:                    db,
 		Writer:                writer,
@@ -0,0 +1,161 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/tables"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const threePIDSessionsSchema = `
+-- Stores sessions used to validate third-party identifiers, e.g. by sending
+-- a token to an email address.
+CREATE TABLE IF NOT EXISTS userapi_threepid_sessions (
+	session_id TEXT NOT NULL PRIMARY KEY,
+	client_secret TEXT NOT NULL,
+	medium TEXT NOT NULL,
+	address TEXT NOT NULL,
+	-- The token sent to the third-party identifier.
+	token TEXT NOT NULL,
+	-- The highest send attempt given by the client.
+	send_attempt INTEGER NOT NULL,
+	-- Where to redirect the user to once the session has been validated.
+	next_link TEXT NOT NULL DEFAULT '',
+	-- When the session was validated, as a unix timestamp (ms resolution). 0 means not validated.
+	validated_at BIGINT NOT NULL DEFAULT 0,
+	-- When the session expires, as a unix timestamp (ms resolution).
+	expires_at BIGINT NOT NULL,
+	UNIQUE (client_secret, medium, address)
+);
+`
+
+const insertThreePIDSessionSQL = "" +
+	"INSERT INTO userapi_threepid_sessions (session_id, client_secret, medium, address, token, send_attempt, next_link, expires_at)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8)"
+
+const selectThreePIDSessionSQL = "" +
+	"SELECT session_id, client_secret, medium, address, token, send_attempt, next_link, validated_at, expires_at" +
+	" FROM userapi_threepid_sessions WHERE session_id = $1"
+
+const selectThreePIDSessionByAddressSQL = "" +
+	"SELECT session_id, client_secret, medium, address, token, send_attempt, next_link, validated_at, expires_at" +
+	" FROM userapi_threepid_sessions WHERE client_secret = $1 AND medium = $2 AND address = $3"
+
+const updateThreePIDSessionSendAttemptSQL = "" +
+	"UPDATE userapi_threepid_sessions SET send_attempt = $1, next_link = $2, expires_at = $3 WHERE session_id = $4"
+
+const updateThreePIDSessionValidatedSQL = "" +
+	"UPDATE userapi_threepid_sessions SET validated_at = $1 WHERE session_id = $2"
+
+const deleteThreePIDSessionSQL = "" +
+	"DELETE FROM userapi_threepid_sessions WHERE session_id = $1"
+
+const deleteExpiredThreePIDSessionsSQL = "" +
+	"DELETE FROM userapi_threepid_sessions WHERE expires_at <= $1"
+
+type threePIDSessionsStatements struct {
+	insertThreePIDSessionStmt            *sql.Stmt
+	selectThreePIDSessionStmt            *sql.Stmt
+	selectThreePIDSessionByAddressStmt   *sql.Stmt
+	updateThreePIDSessionSendAttemptStmt *sql.Stmt
+	updateThreePIDSessionValidatedStmt   *sql.Stmt
+	deleteThreePIDSessionStmt            *sql.Stmt
+	deleteExpiredThreePIDSessionsStmt    *sql.Stmt
+}
+
+func NewPostgresThreePIDSessionsTable(db *sql.DB) (tables.ThreePIDSessionsTable, error) {
+	s := &threePIDSessionsStatements{}
+	_, err := db.Exec(threePIDSessionsSchema)
+	if err != nil {
+		return nil, err
+	}
+	return s, sqlutil.StatementList{
+		{&s.insertThreePIDSessionStmt, insertThreePIDSessionSQL},
+		{&s.selectThreePIDSessionStmt, selectThreePIDSessionSQL},
+		{&s.selectThreePIDSessionByAddressStmt, selectThreePIDSessionByAddressSQL},
+		{&s.updateThreePIDSessionSendAttemptStmt, updateThreePIDSessionSendAttemptSQL},
+		{&s.updateThreePIDSessionValidatedStmt, updateThreePIDSessionValidatedSQL},
+		{&s.deleteThreePIDSessionStmt, deleteThreePIDSessionSQL},
+		{&s.deleteExpiredThreePIDSessionsStmt, deleteExpiredThreePIDSessionsSQL},
+	}.Prepare(db)
+}
+
+func (s *threePIDSessionsStatements) InsertThreePIDSession(
+	ctx context.Context, txn *sql.Tx, session *api.ThreePIDSession,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.insertThreePIDSessionStmt).ExecContext(
+		ctx, session.SessionID, session.ClientSecret, session.Medium, session.Address,
+		session.Token, session.SendAttempt, session.NextLink, session.ExpiresAt,
+	)
+	return err
+}
+
+func (s *threePIDSessionsStatements) SelectThreePIDSession(
+	ctx context.Context, txn *sql.Tx, sessionID string,
+) (*api.ThreePIDSession, error) {
+	row := sqlutil.TxStmt(txn, s.selectThreePIDSessionStmt).QueryRowContext(ctx, sessionID)
+	return scanThreePIDSession(row)
+}
+
+func (s *threePIDSessionsStatements) SelectThreePIDSessionByAddress(
+	ctx context.Context, txn *sql.Tx, clientSecret, medium, address string,
+) (*api.ThreePIDSession, error) {
+	row := sqlutil.TxStmt(txn, s.selectThreePIDSessionByAddressStmt).QueryRowContext(ctx, clientSecret, medium, address)
+	return scanThreePIDSession(row)
+}
+
+func (s *threePIDSessionsStatements) UpdateThreePIDSessionSendAttempt(
+	ctx context.Context, txn *sql.Tx, sessionID string, sendAttempt int, nextLink string, expiresAt gomatrixserverlib.Timestamp,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.updateThreePIDSessionSendAttemptStmt).ExecContext(ctx, sendAttempt, nextLink, expiresAt, sessionID)
+	return err
+}
+
+func (s *threePIDSessionsStatements) UpdateThreePIDSessionValidated(
+	ctx context.Context, txn *sql.Tx, sessionID string, validatedAt gomatrixserverlib.Timestamp,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.updateThreePIDSessionValidatedStmt).ExecContext(ctx, validatedAt, sessionID)
+	return err
+}
+
+func (s *threePIDSessionsStatements) DeleteThreePIDSession(
+	ctx context.Context, txn *sql.Tx, sessionID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteThreePIDSessionStmt).ExecContext(ctx, sessionID)
+	return err
+}
+
+func (s *threePIDSessionsStatements) DeleteExpiredThreePIDSessions(
+	ctx context.Context, txn *sql.Tx, now gomatrixserverlib.Timestamp,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteExpiredThreePIDSessionsStmt).ExecContext(ctx, now)
+	return err
+}
+
+func scanThreePIDSession(row rowScanner) (*api.ThreePIDSession, error) {
+	var session api.ThreePIDSession
+	if err := row.Scan(
+		&session.SessionID, &session.ClientSecret, &session.Medium, &session.Address, &session.Token,
+		&session.SendAttempt, &session.NextLink, &session.ValidatedAt, &session.ExpiresAt,
+	); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
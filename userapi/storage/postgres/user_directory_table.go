@@ -0,0 +1,247 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/storage/tables"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const userDirectorySchema = `
+-- Stores the profiles of the users in the user directory, as found in their
+-- membership events.
+CREATE TABLE IF NOT EXISTS userapi_user_directory (
+	user_id TEXT NOT NULL PRIMARY KEY,
+	display_name TEXT NOT NULL DEFAULT '',
+	avatar_url TEXT NOT NULL DEFAULT ''
+);
+
+-- Stores which users are joined to which rooms.
+CREATE TABLE IF NOT EXISTS userapi_user_directory_memberships (
+	room_id TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	PRIMARY KEY (room_id, user_id)
+);
+CREATE INDEX IF NOT EXISTS userapi_user_directory_memberships_user_id_idx ON userapi_user_directory_memberships(user_id);
+
+-- Stores the state of rooms which decides whether their members are visible
+-- to everyone.
+CREATE TABLE IF NOT EXISTS userapi_user_directory_rooms (
+	room_id TEXT NOT NULL PRIMARY KEY,
+	join_rule TEXT NOT NULL DEFAULT '',
+	history_visibility TEXT NOT NULL DEFAULT ''
+);
+`
+
+const upsertUserDirectoryUserSQL = "" +
+	"INSERT INTO userapi_user_directory (user_id, display_name, avatar_url) VALUES ($1, $2, $3)" +
+	" ON CONFLICT (user_id) DO UPDATE SET display_name = $2, avatar_url = $3"
+
+const insertUserDirectoryMembershipSQL = "" +
+	"INSERT INTO userapi_user_directory_memberships (room_id, user_id) VALUES ($1, $2)" +
+	" ON CONFLICT DO NOTHING"
+
+const deleteUserDirectoryMembershipSQL = "" +
+	"DELETE FROM userapi_user_directory_memberships WHERE room_id = $1 AND user_id = $2"
+
+const deleteUserDirectoryRoomMembershipsSQL = "" +
+	"DELETE FROM userapi_user_directory_memberships WHERE room_id = $1"
+
+const deleteUserDirectoryRoomSQL = "" +
+	"DELETE FROM userapi_user_directory_rooms WHERE room_id = $1"
+
+const deleteUserDirectoryUserIfNotJoinedSQL = "" +
+	"DELETE FROM userapi_user_directory WHERE user_id = $1" +
+	" AND NOT EXISTS (SELECT 1 FROM userapi_user_directory_memberships WHERE user_id = $1)"
+
+const selectUserDirectoryRoomMembersSQL = "" +
+	"SELECT user_id FROM userapi_user_directory_memberships WHERE room_id = $1"
+
+const upsertUserDirectoryRoomJoinRuleSQL = "" +
+	"INSERT INTO userapi_user_directory_rooms (room_id, join_rule) VALUES ($1, $2)" +
+	" ON CONFLICT (room_id) DO UPDATE SET join_rule = $2"
+
+const upsertUserDirectoryRoomHistoryVisibilitySQL = "" +
+	"INSERT INTO userapi_user_directory_rooms (room_id, history_visibility) VALUES ($1, $2)" +
+	" ON CONFLICT (room_id) DO UPDATE SET history_visibility = $2"
+
+const selectUserDirectoryJoinedCountForServerSQL = "" +
+	"SELECT COUNT(*) FROM userapi_user_directory_memberships WHERE room_id = $1 AND user_id LIKE $2 ESCAPE '\\'"
+
+// Users are visible if they share a room with the searching user, or if they
+// are joined to a room which is public or world readable. They are ordered by
+// the number of rooms they share with the searching user.
+const selectUserDirectoryUsersBySearchSQL = "" +
+	"SELECT d.user_id, d.display_name, d.avatar_url FROM userapi_user_directory d" +
+	" LEFT JOIN (" +
+	"  SELECT m1.user_id, COUNT(*) AS shared_rooms FROM userapi_user_directory_memberships m1" +
+	"  JOIN userapi_user_directory_memberships m2 ON m1.room_id = m2.room_id" +
+	"  WHERE m2.user_id = $1 GROUP BY m1.user_id" +
+	" ) s ON s.user_id = d.user_id" +
+	" WHERE (LOWER(d.user_id) LIKE $2 ESCAPE '\\' OR LOWER(d.display_name) LIKE $2 ESCAPE '\\')" +
+	" AND ($3 OR s.shared_rooms > 0 OR EXISTS (" +
+	"  SELECT 1 FROM userapi_user_directory_memberships m" +
+	"  JOIN userapi_user_directory_rooms r ON r.room_id = m.room_id" +
+	"  WHERE m.user_id = d.user_id AND (r.join_rule = 'public' OR r.history_visibility = 'world_readable')" +
+	" ))" +
+	" ORDER BY COALESCE(s.shared_rooms, 0) DESC, d.user_id ASC LIMIT $4"
+
+type userDirectoryStatements struct {
+	upsertUserStmt                  *sql.Stmt
+	insertMembershipStmt            *sql.Stmt
+	deleteMembershipStmt            *sql.Stmt
+	deleteRoomMembershipsStmt       *sql.Stmt
+	deleteRoomStmt                  *sql.Stmt
+	deleteUserIfNotJoinedStmt       *sql.Stmt
+	upsertRoomJoinRuleStmt          *sql.Stmt
+	upsertRoomHistoryVisibilityStmt *sql.Stmt
+	selectRoomMembersStmt           *sql.Stmt
+	selectJoinedCountForServerStmt  *sql.Stmt
+	selectUsersBySearchStmt         *sql.Stmt
+}
+
+func NewPostgresUserDirectoryTable(db *sql.DB) (tables.UserDirectoryTable, error) {
+	s := &userDirectoryStatements{}
+	_, err := db.Exec(userDirectorySchema)
+	if err != nil {
+		return nil, err
+	}
+	return s, sqlutil.StatementList{
+		{&s.upsertUserStmt, upsertUserDirectoryUserSQL},
+		{&s.insertMembershipStmt, insertUserDirectoryMembershipSQL},
+		{&s.deleteMembershipStmt, deleteUserDirectoryMembershipSQL},
+		{&s.deleteRoomMembershipsStmt, deleteUserDirectoryRoomMembershipsSQL},
+		{&s.deleteRoomStmt, deleteUserDirectoryRoomSQL},
+		{&s.deleteUserIfNotJoinedStmt, deleteUserDirectoryUserIfNotJoinedSQL},
+		{&s.upsertRoomJoinRuleStmt, upsertUserDirectoryRoomJoinRuleSQL},
+		{&s.upsertRoomHistoryVisibilityStmt, upsertUserDirectoryRoomHistoryVisibilitySQL},
+		{&s.selectRoomMembersStmt, selectUserDirectoryRoomMembersSQL},
+		{&s.selectJoinedCountForServerStmt, selectUserDirectoryJoinedCountForServerSQL},
+		{&s.selectUsersBySearchStmt, selectUserDirectoryUsersBySearchSQL},
+	}.Prepare(db)
+}
+
+func (s *userDirectoryStatements) UpsertUser(
+	ctx context.Context, txn *sql.Tx, userID, displayName, avatarURL string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.upsertUserStmt).ExecContext(ctx, userID, displayName, avatarURL)
+	return err
+}
+
+func (s *userDirectoryStatements) InsertMembership(
+	ctx context.Context, txn *sql.Tx, roomID, userID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.insertMembershipStmt).ExecContext(ctx, roomID, userID)
+	return err
+}
+
+func (s *userDirectoryStatements) DeleteMembership(
+	ctx context.Context, txn *sql.Tx, roomID, userID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteMembershipStmt).ExecContext(ctx, roomID, userID)
+	return err
+}
+
+func (s *userDirectoryStatements) DeleteRoomMemberships(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteRoomMembershipsStmt).ExecContext(ctx, roomID)
+	return err
+}
+
+func (s *userDirectoryStatements) DeleteRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	if err := s.DeleteRoomMemberships(ctx, txn, roomID); err != nil {
+		return err
+	}
+	_, err := sqlutil.TxStmt(txn, s.deleteRoomStmt).ExecContext(ctx, roomID)
+	return err
+}
+
+func (s *userDirectoryStatements) DeleteUserIfNotJoined(
+	ctx context.Context, txn *sql.Tx, userID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteUserIfNotJoinedStmt).ExecContext(ctx, userID)
+	return err
+}
+
+func (s *userDirectoryStatements) UpsertRoomJoinRule(
+	ctx context.Context, txn *sql.Tx, roomID, joinRule string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.upsertRoomJoinRuleStmt).ExecContext(ctx, roomID, joinRule)
+	return err
+}
+
+func (s *userDirectoryStatements) UpsertRoomHistoryVisibility(
+	ctx context.Context, txn *sql.Tx, roomID, historyVisibility string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.upsertRoomHistoryVisibilityStmt).ExecContext(ctx, roomID, historyVisibility)
+	return err
+}
+
+func (s *userDirectoryStatements) SelectRoomMembers(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) ([]string, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectRoomMembersStmt).QueryContext(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectRoomMembers: rows.close() failed")
+	var userIDs []string
+	for rows.Next() {
+		var userID string
+		if err = rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs, rows.Err()
+}
+
+func (s *userDirectoryStatements) SelectJoinedCountForServer(
+	ctx context.Context, txn *sql.Tx, roomID string, serverName gomatrixserverlib.ServerName,
+) (count int, err error) {
+	pattern := "%:" + sqlutil.EscapeLike(string(serverName))
+	err = sqlutil.TxStmt(txn, s.selectJoinedCountForServerStmt).QueryRowContext(ctx, roomID, pattern).Scan(&count)
+	return
+}
+
+func (s *userDirectoryStatements) SelectUsersBySearch(
+	ctx context.Context, txn *sql.Tx, userID, searchString string, limit int, searchAll bool,
+) ([]authtypes.FullyQualifiedProfile, error) {
+	pattern := "%" + sqlutil.EscapeLike(strings.ToLower(searchString)) + "%"
+	rows, err := sqlutil.TxStmt(txn, s.selectUsersBySearchStmt).QueryContext(ctx, userID, pattern, searchAll, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectUsersBySearch: rows.close() failed")
+	var profiles []authtypes.FullyQualifiedProfile
+	for rows.Next() {
+		var profile authtypes.FullyQualifiedProfile
+		if err = rows.Scan(&profile.UserID, &profile.DisplayName, &profile.AvatarURL); err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, profile)
+	}
+	return profiles, rows.Err()
+}
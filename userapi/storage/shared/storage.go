@@ -51,8 +51,13 @@ type Database struct {
 	Devices               tables.DevicesTable
 	LoginTokens           tables.LoginTokenTable
 	Notifications         tables.NotificationTable
+	RegistrationTokens    tables.RegistrationTokensTable
+	ThreePIDSessions      tables.ThreePIDSessionsTable
 	Pushers               tables.PusherTable
+	PusherFailures        tables.PusherFailuresTable
+	PusherEmailState      tables.PusherEmailStateTable
 	Stats                 tables.StatsTable
+	UserDirectory         tables.UserDirectoryTable
 	LoginTokenLifetime    time.Duration
 	ServerName            gomatrixserverlib.ServerName
 	BcryptCost            int
@@ -121,6 +126,19 @@ func (d *Database) SetPassword(
 	})
 }
 
+// SetShadowBanned marks or unmarks the account as shadow-banned. Returns
+// sql.ErrNoRows if the account doesn't exist.
+func (d *Database) SetShadowBanned(
+	ctx context.Context, localpart string, shadowBanned bool,
+) error {
+	if _, err := d.Accounts.SelectAccountByLocalpart(ctx, localpart); err != nil {
+		return err
+	}
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.Accounts.UpdateShadowBanned(ctx, txn, localpart, shadowBanned)
+	})
+}
+
 // CreateAccount makes a new account with the given login name and password, and creates an empty profile
 // for this account. If no password is supplied, the account will be a passwordless account. If the
 // account already exists, it will return nil, ErrUserExists.
@@ -309,6 +327,11 @@ func (d *Database) GetAccountByLocalpart(ctx context.Context, localpart string,
 	return acc, err
 }
 
+// GetLocalparts returns the localparts of all accounts which aren't deactivated.
+func (d *Database) GetLocalparts(ctx context.Context) ([]string, error) {
+	return d.Accounts.SelectLocalparts(ctx)
+}
+
 // SearchProfiles returns all profiles where the provided localpart or display name
 // match any part of the profiles in the database.
 func (d *Database) SearchProfiles(ctx context.Context, searchString string, limit int,
@@ -651,6 +674,70 @@ func generateLoginToken() (string, error) {
 	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
+// CreateRegistrationToken stores a new registration token. Returns false
+// if a token with the same value already exists.
+func (d *Database) CreateRegistrationToken(ctx context.Context, token *api.RegistrationToken) (created bool, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		created, err = d.RegistrationTokens.InsertRegistrationToken(ctx, txn, token)
+		return err
+	})
+	return
+}
+
+func (d *Database) GetRegistrationTokens(ctx context.Context) ([]api.RegistrationToken, error) {
+	return d.RegistrationTokens.SelectRegistrationTokens(ctx, nil)
+}
+
+// GetRegistrationToken returns the named token. May return sql.ErrNoRows.
+func (d *Database) GetRegistrationToken(ctx context.Context, token string) (*api.RegistrationToken, error) {
+	return d.RegistrationTokens.SelectRegistrationToken(ctx, nil, token)
+}
+
+// UpdateRegistrationToken replaces the uses allowed and expiry time of the
+// named token and returns the updated token. May return sql.ErrNoRows.
+func (d *Database) UpdateRegistrationToken(
+	ctx context.Context, token string, usesAllowed *int32, expiryTime *gomatrixserverlib.Timestamp,
+) (updated *api.RegistrationToken, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		if err = d.RegistrationTokens.UpdateRegistrationToken(ctx, txn, token, usesAllowed, expiryTime); err != nil {
+			return err
+		}
+		updated, err = d.RegistrationTokens.SelectRegistrationToken(ctx, txn, token)
+		return err
+	})
+	return
+}
+
+func (d *Database) RemoveRegistrationToken(ctx context.Context, token string) (deleted bool, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		deleted, err = d.RegistrationTokens.DeleteRegistrationToken(ctx, txn, token)
+		return err
+	})
+	return
+}
+
+// BeginRegistrationTokenUse marks a use of the token as pending, returning
+// false if the token doesn't exist or is no longer valid.
+func (d *Database) BeginRegistrationTokenUse(ctx context.Context, token string) (valid bool, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		valid, err = d.RegistrationTokens.UpdateRegistrationTokenPending(ctx, txn, token, gomatrixserverlib.AsTimestamp(time.Now()))
+		return err
+	})
+	return
+}
+
+func (d *Database) CompleteRegistrationTokenUse(ctx context.Context, token string) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.RegistrationTokens.UpdateRegistrationTokenCompleted(ctx, txn, token)
+	})
+}
+
+func (d *Database) ReleaseRegistrationTokenUse(ctx context.Context, token string) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.RegistrationTokens.UpdateRegistrationTokenReleased(ctx, txn, token)
+	})
+}
+
 // RemoveLoginToken removes the named token (and may clean up other expired tokens).
 func (d *Database) RemoveLoginToken(ctx context.Context, token string) error {
 	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
@@ -664,9 +751,9 @@ func (d *Database) GetLoginTokenDataByToken(ctx context.Context, token string) (
 	return d.LoginTokens.SelectLoginToken(ctx, token)
 }
 
-func (d *Database) InsertNotification(ctx context.Context, localpart, eventID string, pos int64, tweaks map[string]interface{}, n *api.Notification) error {
+func (d *Database) InsertNotification(ctx context.Context, localpart, eventID, threadID string, pos int64, tweaks map[string]interface{}, n *api.Notification) error {
 	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
-		return d.Notifications.Insert(ctx, txn, localpart, eventID, pos, pushrules.BoolTweakOr(tweaks, pushrules.HighlightTweak, false), n)
+		return d.Notifications.Insert(ctx, txn, localpart, eventID, threadID, pos, pushrules.BoolTweakOr(tweaks, pushrules.HighlightTweak, false), n)
 	})
 }
 
@@ -678,9 +765,9 @@ func (d *Database) DeleteNotificationsUpTo(ctx context.Context, localpart, roomI
 	return
 }
 
-func (d *Database) SetNotificationsRead(ctx context.Context, localpart, roomID string, pos int64, b bool) (affected bool, err error) {
+func (d *Database) SetNotificationsRead(ctx context.Context, localpart, roomID, threadID string, pos int64, b bool) (affected bool, err error) {
 	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
-		affected, err = d.Notifications.UpdateRead(ctx, txn, localpart, roomID, pos, b)
+		affected, err = d.Notifications.UpdateRead(ctx, txn, localpart, roomID, threadID, pos, b)
 		return err
 	})
 	return
@@ -698,6 +785,10 @@ func (d *Database) GetRoomNotificationCounts(ctx context.Context, localpart, roo
 	return d.Notifications.SelectRoomCounts(ctx, nil, localpart, roomID)
 }
 
+func (d *Database) GetThreadNotificationCounts(ctx context.Context, localpart, roomID string) (map[string]tables.NotificationCounts, error) {
+	return d.Notifications.SelectThreadCounts(ctx, nil, localpart, roomID)
+}
+
 func (d *Database) DeleteOldNotifications(ctx context.Context) error {
 	return d.Notifications.Clean(ctx, nil)
 }
@@ -710,6 +801,10 @@ func (d *Database) UpsertPusher(
 		return err
 	}
 	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		// Setting the pusher again gives it a fresh start.
+		if err = d.PusherFailures.DeletePusherFailure(ctx, txn, localpart, p.AppID, p.PushKey); err != nil {
+			return err
+		}
 		return d.Pushers.InsertPusher(
 			ctx, txn,
 			p.SessionID,
@@ -744,7 +839,13 @@ func (d *Database) RemovePusher(
 		if err == sql.ErrNoRows {
 			return nil
 		}
-		return err
+		if err != nil {
+			return err
+		}
+		if err = d.PusherFailures.DeletePusherFailure(ctx, txn, localpart, appid, pushkey); err != nil {
+			return err
+		}
+		return d.PusherEmailState.DeletePusherEmailState(ctx, txn, localpart, appid, pushkey)
 	})
 }
 
@@ -755,7 +856,71 @@ func (d *Database) RemovePushers(
 	ctx context.Context, appid, pushkey string,
 ) error {
 	return d.Writer.Do(nil, nil, func(txn *sql.Tx) error {
-		return d.Pushers.DeletePushers(ctx, txn, appid, pushkey)
+		if err := d.Pushers.DeletePushers(ctx, txn, appid, pushkey); err != nil {
+			return err
+		}
+		if err := d.PusherFailures.DeletePusherFailures(ctx, txn, appid, pushkey); err != nil {
+			return err
+		}
+		return d.PusherEmailState.DeletePusherEmailStates(ctx, txn, appid, pushkey)
+	})
+}
+
+// GetPushersByKind returns all pushers of the given kind, keyed by localpart.
+func (d *Database) GetPushersByKind(
+	ctx context.Context, kind api.PusherKind,
+) (map[string][]api.Pusher, error) {
+	return d.Pushers.SelectPushersByKind(ctx, nil, kind)
+}
+
+// GetPusherLastEmailedNotificationID returns the ID of the last notification
+// which was emailed to an email pusher, or 0 if none has been yet.
+func (d *Database) GetPusherLastEmailedNotificationID(
+	ctx context.Context, localpart, appid, pushkey string,
+) (int64, error) {
+	return d.PusherEmailState.SelectLastNotificationID(ctx, nil, localpart, appid, pushkey)
+}
+
+func (d *Database) SetPusherLastEmailedNotificationID(
+	ctx context.Context, localpart, appid, pushkey string, id int64,
+) error {
+	return d.Writer.Do(nil, nil, func(txn *sql.Tx) error {
+		return d.PusherEmailState.UpsertLastNotificationID(ctx, txn, localpart, appid, pushkey, id)
+	})
+}
+
+// GetPusherFailure returns the failed deliveries to a pusher since the last
+// successful one, or nil if the last delivery succeeded.
+func (d *Database) GetPusherFailure(
+	ctx context.Context, localpart, appid, pushkey string,
+) (*api.PusherFailure, error) {
+	return d.PusherFailures.SelectPusherFailure(ctx, nil, localpart, appid, pushkey)
+}
+
+// GetPusherFailures returns the failure state of all pushers of the given
+// localpart which are failing.
+func (d *Database) GetPusherFailures(
+	ctx context.Context, localpart string,
+) ([]api.PusherFailure, error) {
+	return d.PusherFailures.SelectPusherFailures(ctx, nil, localpart)
+}
+
+// UpsertPusherFailure stores the failure state of a pusher.
+func (d *Database) UpsertPusherFailure(
+	ctx context.Context, localpart string, f *api.PusherFailure,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.PusherFailures.UpsertPusherFailure(ctx, txn, localpart, f)
+	})
+}
+
+// RemovePusherFailure clears the failure state of a pusher after a
+// successful delivery.
+func (d *Database) RemovePusherFailure(
+	ctx context.Context, localpart, appid, pushkey string,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.PusherFailures.DeletePusherFailure(ctx, txn, localpart, appid, pushkey)
 	})
 }
 
@@ -763,3 +928,195 @@ func (d *Database) RemovePushers(
 func (d *Database) UserStatistics(ctx context.Context) (*types.UserStatistics, *types.DatabaseEngine, error) {
 	return d.Stats.UserStatistics(ctx, nil)
 }
+
+func (d *Database) CreateThreePIDSession(
+	ctx context.Context, session *api.ThreePIDSession,
+) (result *api.ThreePIDSession, send bool, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		if err = d.ThreePIDSessions.DeleteExpiredThreePIDSessions(ctx, txn, gomatrixserverlib.AsTimestamp(time.Now())); err != nil {
+			return err
+		}
+		existing, err := d.ThreePIDSessions.SelectThreePIDSessionByAddress(ctx, txn, session.ClientSecret, session.Medium, session.Address)
+		switch {
+		case err == sql.ErrNoRows:
+			result, send = session, true
+			return d.ThreePIDSessions.InsertThreePIDSession(ctx, txn, session)
+		case err != nil:
+			return err
+		case session.SendAttempt > existing.SendAttempt:
+			existing.SendAttempt, existing.NextLink, existing.ExpiresAt = session.SendAttempt, session.NextLink, session.ExpiresAt
+			result, send = existing, true
+			return d.ThreePIDSessions.UpdateThreePIDSessionSendAttempt(ctx, txn, existing.SessionID, existing.SendAttempt, existing.NextLink, existing.ExpiresAt)
+		default:
+			result = existing
+			return nil
+		}
+	})
+	return
+}
+
+func (d *Database) GetThreePIDSession(ctx context.Context, sessionID string) (*api.ThreePIDSession, error) {
+	return d.ThreePIDSessions.SelectThreePIDSession(ctx, nil, sessionID)
+}
+
+func (d *Database) ValidateThreePIDSession(ctx context.Context, sessionID string, validatedAt gomatrixserverlib.Timestamp) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.ThreePIDSessions.UpdateThreePIDSessionValidated(ctx, txn, sessionID, validatedAt)
+	})
+}
+
+func (d *Database) RemoveThreePIDSession(ctx context.Context, sessionID string) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.ThreePIDSessions.DeleteThreePIDSession(ctx, txn, sessionID)
+	})
+}
+
+// userDirectoryBackfillVersion records in the migrations table that the
+// user directory has been backfilled from the rooms joined by local users.
+const userDirectoryBackfillVersion = "userapi: backfill user directory"
+
+// UpdateUserDirectoryRoom applies a change to the state of a room to the
+// user directory. Once no local users are joined to the room, it is
+// forgotten entirely, since we won't see any further updates for it.
+func (d *Database) UpdateUserDirectoryRoom(ctx context.Context, update *types.UserDirectoryRoomUpdate) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.updateUserDirectoryRoom(ctx, txn, update)
+	})
+}
+
+func (d *Database) updateUserDirectoryRoom(ctx context.Context, txn *sql.Tx, update *types.UserDirectoryRoomUpdate) error {
+	// Users who are no longer joined to the room may not be joined to any
+	// other rooms either, in which case they are removed from the directory.
+	var formerMembers []string
+	if update.RewritesState {
+		members, err := d.UserDirectory.SelectRoomMembers(ctx, txn, update.RoomID)
+		if err != nil {
+			return fmt.Errorf("d.UserDirectory.SelectRoomMembers: %w", err)
+		}
+		formerMembers = members
+		if err = d.UserDirectory.DeleteRoomMemberships(ctx, txn, update.RoomID); err != nil {
+			return fmt.Errorf("d.UserDirectory.DeleteRoomMemberships: %w", err)
+		}
+	}
+	for _, profile := range update.Joined {
+		if err := d.UserDirectory.UpsertUser(ctx, txn, profile.UserID, profile.DisplayName, profile.AvatarURL); err != nil {
+			return fmt.Errorf("d.UserDirectory.UpsertUser: %w", err)
+		}
+		if err := d.UserDirectory.InsertMembership(ctx, txn, update.RoomID, profile.UserID); err != nil {
+			return fmt.Errorf("d.UserDirectory.InsertMembership: %w", err)
+		}
+	}
+	localLeft := false
+	for _, userID := range update.Left {
+		if err := d.UserDirectory.DeleteMembership(ctx, txn, update.RoomID, userID); err != nil {
+			return fmt.Errorf("d.UserDirectory.DeleteMembership: %w", err)
+		}
+		formerMembers = append(formerMembers, userID)
+		if _, serverName, err := gomatrixserverlib.SplitID('@', userID); err == nil && serverName == d.ServerName {
+			localLeft = true
+		}
+	}
+	if update.JoinRule != nil {
+		if err := d.UserDirectory.UpsertRoomJoinRule(ctx, txn, update.RoomID, *update.JoinRule); err != nil {
+			return fmt.Errorf("d.UserDirectory.UpsertRoomJoinRule: %w", err)
+		}
+	}
+	if update.HistoryVisibility != nil {
+		if err := d.UserDirectory.UpsertRoomHistoryVisibility(ctx, txn, update.RoomID, *update.HistoryVisibility); err != nil {
+			return fmt.Errorf("d.UserDirectory.UpsertRoomHistoryVisibility: %w", err)
+		}
+	}
+
+	if localLeft || update.RewritesState {
+		count, err := d.UserDirectory.SelectJoinedCountForServer(ctx, txn, update.RoomID, d.ServerName)
+		if err != nil {
+			return fmt.Errorf("d.UserDirectory.SelectJoinedCountForServer: %w", err)
+		}
+		if count == 0 {
+			members, err := d.UserDirectory.SelectRoomMembers(ctx, txn, update.RoomID)
+			if err != nil {
+				return fmt.Errorf("d.UserDirectory.SelectRoomMembers: %w", err)
+			}
+			formerMembers = append(formerMembers, members...)
+			if err = d.UserDirectory.DeleteRoom(ctx, txn, update.RoomID); err != nil {
+				return fmt.Errorf("d.UserDirectory.DeleteRoom: %w", err)
+			}
+		}
+	}
+	for _, userID := range formerMembers {
+		if err := d.UserDirectory.DeleteUserIfNotJoined(ctx, txn, userID); err != nil {
+			return fmt.Errorf("d.UserDirectory.DeleteUserIfNotJoined: %w", err)
+		}
+	}
+	return nil
+}
+
+// UserDirectoryBackfilled returns true if BackfillUserDirectory has completed.
+func (d *Database) UserDirectoryBackfilled(ctx context.Context) (bool, error) {
+	executed, err := sqlutil.NewMigrator(d.DB).ExecutedMigrations(ctx)
+	if err != nil {
+		return false, fmt.Errorf("ExecutedMigrations: %w", err)
+	}
+	_, ok := executed[userDirectoryBackfillVersion]
+	return ok, nil
+}
+
+// BackfillUserDirectory applies the current state of the rooms to the user
+// directory, and records that it has done so, unless that was already done.
+func (d *Database) BackfillUserDirectory(ctx context.Context, updates []*types.UserDirectoryRoomUpdate) error {
+	m := sqlutil.NewMigrator(d.DB)
+	m.AddMigrations(sqlutil.Migration{
+		Version: userDirectoryBackfillVersion,
+		Up: func(ctx context.Context, txn *sql.Tx) error {
+			for _, update := range updates {
+				if err := d.updateUserDirectoryRoom(ctx, txn, update); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+	// The migrator uses its own transaction, so take the writer to stop it
+	// from racing with the other writes to the database.
+	return d.Writer.Do(nil, nil, func(_ *sql.Tx) error {
+		return m.Up(ctx)
+	})
+}
+
+// SearchUserDirectory returns the users matching the search string which
+// are visible to the searching user. If searchAll is true, local users who
+// aren't joined to any rooms are included too.
+func (d *Database) SearchUserDirectory(
+	ctx context.Context, userID, searchString string, limit int, searchAll bool,
+) ([]authtypes.FullyQualifiedProfile, error) {
+	profiles, err := d.UserDirectory.SelectUsersBySearch(ctx, nil, userID, searchString, limit, searchAll)
+	if err != nil {
+		return nil, fmt.Errorf("d.UserDirectory.SelectUsersBySearch: %w", err)
+	}
+	if !searchAll || len(profiles) >= limit {
+		return profiles, nil
+	}
+	localProfiles, err := d.Profiles.SelectProfilesBySearch(ctx, searchString, limit)
+	if err != nil {
+		return nil, fmt.Errorf("d.Profiles.SelectProfilesBySearch: %w", err)
+	}
+	found := make(map[string]struct{}, len(profiles))
+	for _, profile := range profiles {
+		found[profile.UserID] = struct{}{}
+	}
+	for _, profile := range localProfiles {
+		if len(profiles) >= limit {
+			break
+		}
+		localUserID := fmt.Sprintf("@%s:%s", profile.Localpart, d.ServerName)
+		if _, ok := found[localUserID]; ok {
+			continue
+		}
+		profiles = append(profiles, authtypes.FullyQualifiedProfile{
+			UserID:      localUserID,
+			DisplayName: profile.DisplayName,
+			AvatarURL:   profile.AvatarURL,
+		})
+	}
+	return profiles, nil
+}
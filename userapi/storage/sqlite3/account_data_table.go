@@ -20,7 +20,9 @@ import (
 	"encoding/json"
 
 	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/storage/sqlite3/deltas"
 	"github.com/matrix-org/dendrite/userapi/storage/tables"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 const accountDataSchema = `
@@ -57,7 +59,7 @@ type accountDataStatements struct {
 	selectAccountDataByTypeStmt *sql.Stmt
 }
 
-func NewSQLiteAccountDataTable(db *sql.DB) (tables.AccountDataTable, error) {
+func NewSQLiteAccountDataTable(db *sql.DB, serverName gomatrixserverlib.ServerName) (tables.AccountDataTable, error) {
 	s := &accountDataStatements{
 		db: db,
 	}
@@ -65,6 +67,15 @@ func NewSQLiteAccountDataTable(db *sql.DB) (tables.AccountDataTable, error) {
 	if err != nil {
 		return nil, err
 	}
+	m := sqlutil.NewMigrator(db)
+	m.AddMigrations(sqlutil.Migration{
+		Version: "userapi: add default push rules",
+		Up:      deltas.UpAddDefaultPushRules(serverName),
+		Down:    deltas.DownAddDefaultPushRules,
+	})
+	if err = m.Up(context.Background()); err != nil {
+		return nil, err
+	}
 	return s, sqlutil.StatementList{
 		{&s.insertAccountDataStmt, insertAccountDataSQL},
 		{&s.selectAccountDataStmt, selectAccountDataSQL},
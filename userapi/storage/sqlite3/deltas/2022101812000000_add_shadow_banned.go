@@ -0,0 +1,25 @@
+package deltas
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+func UpAddShadowBanned(ctx context.Context, tx *sql.Tx) error {
+	// The earlier migrations recreate account_accounts from scratch, so by the
+	// time this runs the column is guaranteed not to exist yet.
+	_, err := tx.ExecContext(ctx, `ALTER TABLE account_accounts ADD COLUMN shadow_banned BOOLEAN NOT NULL DEFAULT 0;`)
+	if err != nil {
+		return fmt.Errorf("failed to add column: %w", err)
+	}
+	return nil
+}
+
+func DownAddShadowBanned(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `ALTER TABLE account_accounts DROP COLUMN shadow_banned;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
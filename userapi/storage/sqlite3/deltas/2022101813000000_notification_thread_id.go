@@ -0,0 +1,29 @@
+package deltas
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+func UpNotificationThreadID(ctx context.Context, tx *sql.Tx) error {
+	// SQLite doesn't have "if not exists" for columns, and new databases
+	// already have the column, so check if it exists first.
+	rows, err := tx.QueryContext(ctx, "SELECT thread_id FROM userapi_notifications LIMIT 1")
+	if err == nil {
+		return rows.Close()
+	}
+	_, err = tx.ExecContext(ctx, `ALTER TABLE userapi_notifications ADD COLUMN thread_id TEXT NOT NULL DEFAULT '';`)
+	if err != nil {
+		return fmt.Errorf("failed to add column: %w", err)
+	}
+	return nil
+}
+
+func DownNotificationThreadID(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `ALTER TABLE userapi_notifications DROP COLUMN thread_id;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
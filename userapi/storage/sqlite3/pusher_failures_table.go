@@ -0,0 +1,146 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/tables"
+)
+
+const pusherFailuresSchema = `
+-- Stores the failed deliveries to pushers since their last successful one.
+CREATE TABLE IF NOT EXISTS userapi_pusher_failures (
+	localpart TEXT NOT NULL,
+	app_id TEXT NOT NULL,
+	pushkey TEXT NOT NULL,
+	-- The number of consecutive failed deliveries
+	failure_count INTEGER NOT NULL DEFAULT 0,
+	last_failure_ts INTEGER NOT NULL DEFAULT 0,
+	last_error TEXT NOT NULL DEFAULT '',
+	-- No deliveries are attempted before this time
+	backoff_until_ts INTEGER NOT NULL DEFAULT 0,
+	-- The number of notifications which were given up on
+	dead_letter_count INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (localpart, app_id, pushkey)
+);
+`
+
+const upsertPusherFailureSQL = "" +
+	"INSERT INTO userapi_pusher_failures (localpart, app_id, pushkey, failure_count, last_failure_ts, last_error, backoff_until_ts, dead_letter_count)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8)" +
+	" ON CONFLICT (localpart, app_id, pushkey) DO UPDATE SET failure_count = $4, last_failure_ts = $5, last_error = $6, backoff_until_ts = $7, dead_letter_count = $8"
+
+const selectPusherFailureSQL = "" +
+	"SELECT app_id, pushkey, failure_count, last_failure_ts, last_error, backoff_until_ts, dead_letter_count FROM userapi_pusher_failures" +
+	" WHERE localpart = $1 AND app_id = $2 AND pushkey = $3"
+
+const selectPusherFailuresSQL = "" +
+	"SELECT app_id, pushkey, failure_count, last_failure_ts, last_error, backoff_until_ts, dead_letter_count FROM userapi_pusher_failures" +
+	" WHERE localpart = $1"
+
+const deletePusherFailureSQL = "" +
+	"DELETE FROM userapi_pusher_failures WHERE localpart = $1 AND app_id = $2 AND pushkey = $3"
+
+const deletePusherFailuresByAppIDAndPushKeySQL = "" +
+	"DELETE FROM userapi_pusher_failures WHERE app_id = $1 AND pushkey = $2"
+
+type pusherFailuresStatements struct {
+	upsertPusherFailureStmt                   *sql.Stmt
+	selectPusherFailureStmt                   *sql.Stmt
+	selectPusherFailuresStmt                  *sql.Stmt
+	deletePusherFailureStmt                   *sql.Stmt
+	deletePusherFailuresByAppIDAndPushKeyStmt *sql.Stmt
+}
+
+func NewSQLitePusherFailuresTable(db *sql.DB) (tables.PusherFailuresTable, error) {
+	s := &pusherFailuresStatements{}
+	_, err := db.Exec(pusherFailuresSchema)
+	if err != nil {
+		return nil, err
+	}
+	return s, sqlutil.StatementList{
+		{&s.upsertPusherFailureStmt, upsertPusherFailureSQL},
+		{&s.selectPusherFailureStmt, selectPusherFailureSQL},
+		{&s.selectPusherFailuresStmt, selectPusherFailuresSQL},
+		{&s.deletePusherFailureStmt, deletePusherFailureSQL},
+		{&s.deletePusherFailuresByAppIDAndPushKeyStmt, deletePusherFailuresByAppIDAndPushKeySQL},
+	}.Prepare(db)
+}
+
+func (s *pusherFailuresStatements) UpsertPusherFailure(
+	ctx context.Context, txn *sql.Tx, localpart string, f *api.PusherFailure,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.upsertPusherFailureStmt).ExecContext(
+		ctx, localpart, f.AppID, f.PushKey, f.FailureCount, f.LastFailureTS, f.LastError, f.BackoffUntilTS, f.DeadLetterCount,
+	)
+	return err
+}
+
+func (s *pusherFailuresStatements) SelectPusherFailure(
+	ctx context.Context, txn *sql.Tx, localpart, appID, pushKey string,
+) (*api.PusherFailure, error) {
+	var f api.PusherFailure
+	err := sqlutil.TxStmt(txn, s.selectPusherFailureStmt).QueryRowContext(ctx, localpart, appID, pushKey).Scan(
+		&f.AppID, &f.PushKey, &f.FailureCount, &f.LastFailureTS, &f.LastError, &f.BackoffUntilTS, &f.DeadLetterCount,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+func (s *pusherFailuresStatements) SelectPusherFailures(
+	ctx context.Context, txn *sql.Tx, localpart string,
+) ([]api.PusherFailure, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectPusherFailuresStmt).QueryContext(ctx, localpart)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectPusherFailures: rows.close() failed")
+
+	var failures []api.PusherFailure
+	for rows.Next() {
+		var f api.PusherFailure
+		if err = rows.Scan(
+			&f.AppID, &f.PushKey, &f.FailureCount, &f.LastFailureTS, &f.LastError, &f.BackoffUntilTS, &f.DeadLetterCount,
+		); err != nil {
+			return nil, err
+		}
+		failures = append(failures, f)
+	}
+	return failures, rows.Err()
+}
+
+func (s *pusherFailuresStatements) DeletePusherFailure(
+	ctx context.Context, txn *sql.Tx, localpart, appID, pushKey string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deletePusherFailureStmt).ExecContext(ctx, localpart, appID, pushKey)
+	return err
+}
+
+func (s *pusherFailuresStatements) DeletePusherFailures(
+	ctx context.Context, txn *sql.Tx, appID, pushKey string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deletePusherFailuresByAppIDAndPushKeyStmt).ExecContext(ctx, appID, pushKey)
+	return err
+}
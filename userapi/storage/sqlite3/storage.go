@@ -34,7 +34,7 @@ func NewDatabase(base *base.BaseDendrite, dbProperties *config.DatabaseOptions,
 		return nil, err
 	}
 
-	accountDataTable, err := NewSQLiteAccountDataTable(db)
+	accountDataTable, err := NewSQLiteAccountDataTable(db, serverName)
 	if err != nil {
 		return nil, fmt.Errorf("NewSQLiteAccountDataTable: %w", err)
 	}
@@ -74,14 +74,34 @@ func NewDatabase(base *base.BaseDendrite, dbProperties *config.DatabaseOptions,
 	if err != nil {
 		return nil, fmt.Errorf("NewPostgresPusherTable: %w", err)
 	}
+	pusherFailuresTable, err := NewSQLitePusherFailuresTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("NewSQLitePusherFailuresTable: %w", err)
+	}
+	pusherEmailStateTable, err := NewSQLitePusherEmailStateTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("NewSQLitePusherEmailStateTable: %w", err)
+	}
 	notificationsTable, err := NewSQLiteNotificationTable(db)
 	if err != nil {
 		return nil, fmt.Errorf("NewPostgresNotificationTable: %w", err)
 	}
+	registrationTokensTable, err := NewSQLiteRegistrationTokensTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("NewSQLiteRegistrationTokensTable: %w", err)
+	}
+	threePIDSessionsTable, err := NewSQLiteThreePIDSessionsTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("NewSQLiteThreePIDSessionsTable: %w", err)
+	}
 	statsTable, err := NewSQLiteStatsTable(db, serverName)
 	if err != nil {
 		return nil, fmt.Errorf("NewSQLiteStatsTable: %w", err)
 	}
+	userDirectoryTable, err := NewSQLiteUserDirectoryTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("NewSQLiteUserDirectoryTable: %w", err)
+	}
 	return &shared.Database{
 		AccountDatas:          accountDataTable,
 		Accounts:              accountsTable,
@@ -93,8 +113,13 @@ func NewDatabase(base *base.BaseDendrite, dbProperties *config.DatabaseOptions,
 		Profiles:              profilesTable,
 		ThreePIDs:             threePIDTable,
 		Pushers:               pusherTable,
+		PusherFailures:        pusherFailuresTable,
+		PusherEmailState:      pusherEmailStateTable,
 		Notifications:         notificationsTable,
+		RegistrationTokens:    registrationTokensTable,
+		ThreePIDSessions:      threePIDSessionsTable,
 		Stats:                 statsTable,
+		UserDirectory:         userDirectoryTable,
 		ServerName:            serverName,
 		DB:                    db,
 		Writer:                writer,
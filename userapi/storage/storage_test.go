@@ -2,6 +2,7 @@ package storage_test
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"testing"
@@ -14,6 +15,7 @@ import (
 	"github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/dendrite/userapi/storage"
 	"github.com/matrix-org/dendrite/userapi/storage/tables"
+	"github.com/matrix-org/dendrite/userapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 	"github.com/stretchr/testify/assert"
@@ -115,6 +117,20 @@ func Test_Accounts(t *testing.T) {
 		assert.NoError(t, err, "failed to get account by new password")
 		assert.Equal(t, accAlice, accGet)
 
+		// shadow-ban and un-shadow-ban alice
+		err = db.SetShadowBanned(ctx, aliceLocalpart, true)
+		assert.NoError(t, err, "failed to shadow-ban account")
+		accGet, err = db.GetAccountByLocalpart(ctx, aliceLocalpart)
+		assert.NoError(t, err, "failed to get account by localpart")
+		assert.True(t, accGet.ShadowBanned)
+		err = db.SetShadowBanned(ctx, aliceLocalpart, false)
+		assert.NoError(t, err, "failed to lift shadow-ban on account")
+		accGet, err = db.GetAccountByLocalpart(ctx, aliceLocalpart)
+		assert.NoError(t, err, "failed to get account by localpart")
+		assert.False(t, accGet.ShadowBanned)
+		err = db.SetShadowBanned(ctx, "unusedname", true)
+		assert.Error(t, err, "expected an error shadow-banning a non existent localpart")
+
 		// deactivate account
 		err = db.DeactivateAccount(ctx, aliceLocalpart)
 		assert.NoError(t, err, "failed to deactivate account")
@@ -337,6 +353,145 @@ func Test_LoginToken(t *testing.T) {
 	})
 }
 
+func Test_RegistrationToken(t *testing.T) {
+	usesAllowed := int32(1)
+	expired := gomatrixserverlib.AsTimestamp(time.Now().Add(-time.Hour))
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateDatabase(t, dbType)
+		defer close()
+
+		created, err := db.CreateRegistrationToken(ctx, &api.RegistrationToken{Token: "once", UsesAllowed: &usesAllowed})
+		assert.NoError(t, err)
+		assert.True(t, created)
+		// creating the same token again fails
+		created, err = db.CreateRegistrationToken(ctx, &api.RegistrationToken{Token: "once"})
+		assert.NoError(t, err)
+		assert.False(t, created)
+
+		// a pending use counts towards uses allowed
+		valid, err := db.BeginRegistrationTokenUse(ctx, "once")
+		assert.NoError(t, err)
+		assert.True(t, valid)
+		valid, err = db.BeginRegistrationTokenUse(ctx, "once")
+		assert.NoError(t, err)
+		assert.False(t, valid)
+
+		// releasing the pending use allows the token to be used again
+		err = db.ReleaseRegistrationTokenUse(ctx, "once")
+		assert.NoError(t, err)
+		valid, err = db.BeginRegistrationTokenUse(ctx, "once")
+		assert.NoError(t, err)
+		assert.True(t, valid)
+		err = db.CompleteRegistrationTokenUse(ctx, "once")
+		assert.NoError(t, err)
+		token, err := db.GetRegistrationToken(ctx, "once")
+		assert.NoError(t, err)
+		assert.Equal(t, int32(0), token.Pending)
+		assert.Equal(t, int32(1), token.Completed)
+		assert.False(t, token.IsValid(time.Now()))
+
+		// allowing unlimited uses makes the token valid again
+		token, err = db.UpdateRegistrationToken(ctx, "once", nil, nil)
+		assert.NoError(t, err)
+		assert.Nil(t, token.UsesAllowed)
+		assert.True(t, token.IsValid(time.Now()))
+
+		// expired tokens can't be used
+		_, err = db.UpdateRegistrationToken(ctx, "once", nil, &expired)
+		assert.NoError(t, err)
+		valid, err = db.BeginRegistrationTokenUse(ctx, "once")
+		assert.NoError(t, err)
+		assert.False(t, valid)
+
+		// unknown tokens can't be used
+		valid, err = db.BeginRegistrationTokenUse(ctx, "unknown")
+		assert.NoError(t, err)
+		assert.False(t, valid)
+
+		tokens, err := db.GetRegistrationTokens(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(tokens))
+
+		deleted, err := db.RemoveRegistrationToken(ctx, "once")
+		assert.NoError(t, err)
+		assert.True(t, deleted)
+		deleted, err = db.RemoveRegistrationToken(ctx, "once")
+		assert.NoError(t, err)
+		assert.False(t, deleted)
+	})
+}
+
+func Test_ThreePIDSession(t *testing.T) {
+	expiresAt := gomatrixserverlib.AsTimestamp(time.Now().Add(time.Hour))
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateDatabase(t, dbType)
+		defer close()
+
+		session := &api.ThreePIDSession{
+			SessionID:    "session1",
+			ClientSecret: "secret",
+			Medium:       "email",
+			Address:      "alice@example.com",
+			Token:        "token1",
+			SendAttempt:  1,
+			ExpiresAt:    expiresAt,
+		}
+		got, send, err := db.CreateThreePIDSession(ctx, session)
+		assert.NoError(t, err)
+		assert.True(t, send)
+		assert.Equal(t, session, got)
+
+		// the same send attempt returns the existing session without resending
+		retry := *session
+		retry.SessionID, retry.Token = "session2", "token2"
+		got, send, err = db.CreateThreePIDSession(ctx, &retry)
+		assert.NoError(t, err)
+		assert.False(t, send)
+		assert.Equal(t, "session1", got.SessionID)
+		assert.Equal(t, "token1", got.Token)
+
+		// a higher send attempt resends the existing token
+		retry.SendAttempt = 2
+		retry.NextLink = "https://example.com"
+		got, send, err = db.CreateThreePIDSession(ctx, &retry)
+		assert.NoError(t, err)
+		assert.True(t, send)
+		assert.Equal(t, "session1", got.SessionID)
+		assert.Equal(t, "token1", got.Token)
+
+		got, err = db.GetThreePIDSession(ctx, "session1")
+		assert.NoError(t, err)
+		assert.Equal(t, 2, got.SendAttempt)
+		assert.Equal(t, "https://example.com", got.NextLink)
+		assert.False(t, got.Validated())
+
+		validatedAt := gomatrixserverlib.AsTimestamp(time.Now())
+		err = db.ValidateThreePIDSession(ctx, "session1", validatedAt)
+		assert.NoError(t, err)
+		got, err = db.GetThreePIDSession(ctx, "session1")
+		assert.NoError(t, err)
+		assert.Equal(t, validatedAt, got.ValidatedAt)
+
+		err = db.RemoveThreePIDSession(ctx, "session1")
+		assert.NoError(t, err)
+		_, err = db.GetThreePIDSession(ctx, "session1")
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+
+		// expired sessions are removed when creating new sessions
+		expired := *session
+		expired.ExpiresAt = gomatrixserverlib.AsTimestamp(time.Now().Add(-time.Minute))
+		_, _, err = db.CreateThreePIDSession(ctx, &expired)
+		assert.NoError(t, err)
+		other := *session
+		other.SessionID, other.Address = "session3", "bob@example.com"
+		_, _, err = db.CreateThreePIDSession(ctx, &other)
+		assert.NoError(t, err)
+		_, err = db.GetThreePIDSession(ctx, "session1")
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+}
+
 func Test_OpenID(t *testing.T) {
 	alice := test.NewUser(t)
 	token := util.RandomString(24)
@@ -446,6 +601,68 @@ func Test_Pusher(t *testing.T) {
 	})
 }
 
+func Test_PusherFailure(t *testing.T) {
+	alice := test.NewUser(t)
+	aliceLocalpart, _, err := gomatrixserverlib.SplitID('@', alice.ID)
+	assert.NoError(t, err)
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateDatabase(t, dbType)
+		defer close()
+
+		pusher := api.Pusher{
+			PushKey: util.RandomString(8),
+			Kind:    api.HTTPKind,
+			AppID:   util.RandomString(8),
+		}
+		err = db.UpsertPusher(ctx, pusher, aliceLocalpart)
+		assert.NoError(t, err, "unable to upsert pusher")
+
+		// a pusher which hasn't failed has no failure state
+		failure, err := db.GetPusherFailure(ctx, aliceLocalpart, pusher.AppID, pusher.PushKey)
+		assert.NoError(t, err, "unable to get pusher failure")
+		assert.Nil(t, failure)
+
+		wantFailure := api.PusherFailure{
+			AppID:           pusher.AppID,
+			PushKey:         pusher.PushKey,
+			FailureCount:    2,
+			LastFailureTS:   1000,
+			LastError:       "push gateway: 502",
+			BackoffUntilTS:  3000,
+			DeadLetterCount: 1,
+		}
+		err = db.UpsertPusherFailure(ctx, aliceLocalpart, &wantFailure)
+		assert.NoError(t, err, "unable to upsert pusher failure")
+		wantFailure.FailureCount = 3
+		err = db.UpsertPusherFailure(ctx, aliceLocalpart, &wantFailure)
+		assert.NoError(t, err, "unable to upsert pusher failure")
+
+		failure, err = db.GetPusherFailure(ctx, aliceLocalpart, pusher.AppID, pusher.PushKey)
+		assert.NoError(t, err, "unable to get pusher failure")
+		assert.Equal(t, &wantFailure, failure)
+		failures, err := db.GetPusherFailures(ctx, aliceLocalpart)
+		assert.NoError(t, err, "unable to get pusher failures")
+		assert.Equal(t, []api.PusherFailure{wantFailure}, failures)
+
+		// a successful delivery clears the failure state
+		err = db.RemovePusherFailure(ctx, aliceLocalpart, pusher.AppID, pusher.PushKey)
+		assert.NoError(t, err, "unable to remove pusher failure")
+		failures, err = db.GetPusherFailures(ctx, aliceLocalpart)
+		assert.NoError(t, err, "unable to get pusher failures")
+		assert.Empty(t, failures)
+
+		// and so does removing the pusher
+		err = db.UpsertPusherFailure(ctx, aliceLocalpart, &wantFailure)
+		assert.NoError(t, err, "unable to upsert pusher failure")
+		err = db.RemovePusher(ctx, pusher.AppID, pusher.PushKey, aliceLocalpart)
+		assert.NoError(t, err, "unable to remove pusher")
+		failures, err = db.GetPusherFailures(ctx, aliceLocalpart)
+		assert.NoError(t, err, "unable to get pusher failures")
+		assert.Empty(t, failures)
+	})
+}
+
 func Test_ThreePID(t *testing.T) {
 	alice := test.NewUser(t)
 	aliceLocalpart, _, err := gomatrixserverlib.SplitID('@', alice.ID)
@@ -513,7 +730,7 @@ func Test_Notification(t *testing.T) {
 				RoomID: roomID,
 				TS:     gomatrixserverlib.AsTimestamp(ts),
 			}
-			err = db.InsertNotification(ctx, aliceLocalpart, eventID, int64(i+1), nil, notification)
+			err = db.InsertNotification(ctx, aliceLocalpart, eventID, "", int64(i+1), nil, notification)
 			assert.NoError(t, err, "unable to insert notification")
 		}
 
@@ -531,7 +748,7 @@ func Test_Notification(t *testing.T) {
 		assert.Equal(t, int64(4), total)
 
 		// mark notification as read
-		affected, err := db.SetNotificationsRead(ctx, aliceLocalpart, room2.ID, 7, true)
+		affected, err := db.SetNotificationsRead(ctx, aliceLocalpart, room2.ID, "", 7, true)
 		assert.NoError(t, err, "unable to set notifications read")
 		assert.True(t, affected)
 
@@ -554,3 +771,226 @@ func Test_Notification(t *testing.T) {
 		assert.Equal(t, int64(0), total)
 	})
 }
+
+func Test_ThreadNotification(t *testing.T) {
+	alice := test.NewUser(t)
+	aliceLocalpart, _, err := gomatrixserverlib.SplitID('@', alice.ID)
+	assert.NoError(t, err)
+	room := test.NewRoom(t, alice)
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateDatabase(t, dbType)
+		defer close()
+		// two notifications on the main timeline, then two in each thread
+		threadIDs := []string{"", "", "$thread1", "$thread1", "$thread2", "$thread2"}
+		for i, threadID := range threadIDs {
+			notification := &api.Notification{
+				Actions: []*pushrules.Action{
+					{},
+				},
+				Event: gomatrixserverlib.ClientEvent{
+					Content: gomatrixserverlib.RawJSON("{}"),
+				},
+				RoomID: room.ID,
+				TS:     gomatrixserverlib.AsTimestamp(time.Now()),
+			}
+			err = db.InsertNotification(ctx, aliceLocalpart, util.RandomString(16), threadID, int64(i+1), nil, notification)
+			assert.NoError(t, err, "unable to insert notification")
+		}
+
+		threadCounts, err := db.GetThreadNotificationCounts(ctx, aliceLocalpart, room.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]tables.NotificationCounts{
+			"$thread1": {Total: 2},
+			"$thread2": {Total: 2},
+		}, threadCounts)
+
+		// a receipt in a thread only marks that thread as read
+		affected, err := db.SetNotificationsRead(ctx, aliceLocalpart, room.ID, "$thread1", 6, true)
+		assert.NoError(t, err)
+		assert.True(t, affected)
+		threadCounts, err = db.GetThreadNotificationCounts(ctx, aliceLocalpart, room.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]tables.NotificationCounts{"$thread2": {Total: 2}}, threadCounts)
+
+		// a receipt on the main timeline doesn't mark any threads as read
+		affected, err = db.SetNotificationsRead(ctx, aliceLocalpart, room.ID, "main", 6, true)
+		assert.NoError(t, err)
+		assert.True(t, affected)
+		total, _, err := db.GetRoomNotificationCounts(ctx, aliceLocalpart, room.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), total)
+
+		// an unthreaded receipt marks everything as read
+		affected, err = db.SetNotificationsRead(ctx, aliceLocalpart, room.ID, "", 6, true)
+		assert.NoError(t, err)
+		assert.True(t, affected)
+		total, _, err = db.GetRoomNotificationCounts(ctx, aliceLocalpart, room.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), total)
+	})
+}
+
+func Test_UserDirectory(t *testing.T) {
+	alice := "@alice:localhost"
+	bob := "@bob:localhost"
+	charlie := "@charlie:remote"
+	dave := "@dave:remote"
+	privateRoom := "!private:localhost"
+	publicRoom := "!public:remote"
+	public := "public"
+	invite := "invite"
+
+	userIDs := func(profiles []authtypes.FullyQualifiedProfile) []string {
+		var ids []string
+		for _, profile := range profiles {
+			ids = append(ids, profile.UserID)
+		}
+		return ids
+	}
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateDatabase(t, dbType)
+		defer close()
+
+		err := db.UpdateUserDirectoryRoom(ctx, &types.UserDirectoryRoomUpdate{
+			RoomID:   privateRoom,
+			JoinRule: &invite,
+			Joined: []authtypes.FullyQualifiedProfile{
+				{UserID: alice, DisplayName: "Alice"},
+				{UserID: charlie, DisplayName: "Charlie"},
+			},
+		})
+		assert.NoError(t, err)
+		err = db.UpdateUserDirectoryRoom(ctx, &types.UserDirectoryRoomUpdate{
+			RoomID:   publicRoom,
+			JoinRule: &public,
+			Joined: []authtypes.FullyQualifiedProfile{
+				{UserID: alice, DisplayName: "Alice"},
+				{UserID: bob, DisplayName: "Bob"},
+				{UserID: dave, DisplayName: "Dave"},
+			},
+		})
+		assert.NoError(t, err)
+
+		// users sharing a room with charlie are ranked above the members of
+		// the public room
+		results, err := db.SearchUserDirectory(ctx, charlie, "", 10, false)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{alice, charlie, bob, dave}, userIDs(results))
+
+		// charlie is only visible to those sharing the private room
+		results, err = db.SearchUserDirectory(ctx, bob, "charlie", 10, false)
+		assert.NoError(t, err)
+		assert.Empty(t, results)
+		results, err = db.SearchUserDirectory(ctx, alice, "CHAR", 10, false)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{charlie}, userIDs(results))
+		results, err = db.SearchUserDirectory(ctx, bob, "charlie", 10, true)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{charlie}, userIDs(results))
+
+		// profile changes are picked up from new membership events
+		err = db.UpdateUserDirectoryRoom(ctx, &types.UserDirectoryRoomUpdate{
+			RoomID: publicRoom,
+			Joined: []authtypes.FullyQualifiedProfile{{UserID: dave, DisplayName: "David", AvatarURL: "mxc://remote/dave"}},
+		})
+		assert.NoError(t, err)
+		results, err = db.SearchUserDirectory(ctx, bob, "david", 10, false)
+		assert.NoError(t, err)
+		assert.Equal(t, []authtypes.FullyQualifiedProfile{
+			{UserID: dave, DisplayName: "David", AvatarURL: "mxc://remote/dave"},
+		}, results)
+
+		// LIKE wildcards in the search string match literally
+		results, err = db.SearchUserDirectory(ctx, bob, "%", 10, false)
+		assert.NoError(t, err)
+		assert.Empty(t, results)
+
+		// once the only local user leaves the private room, it is forgotten
+		// along with charlie, who isn't in any other rooms
+		err = db.UpdateUserDirectoryRoom(ctx, &types.UserDirectoryRoomUpdate{
+			RoomID: privateRoom,
+			Left:   []string{alice},
+		})
+		assert.NoError(t, err)
+		results, err = db.SearchUserDirectory(ctx, bob, "charlie", 10, true)
+		assert.NoError(t, err)
+		assert.Empty(t, results)
+
+		// rewriting the state of the public room forgets dave, who is no
+		// longer joined to it
+		err = db.UpdateUserDirectoryRoom(ctx, &types.UserDirectoryRoomUpdate{
+			RoomID:        publicRoom,
+			RewritesState: true,
+			Joined: []authtypes.FullyQualifiedProfile{
+				{UserID: alice, DisplayName: "Alice"},
+				{UserID: bob, DisplayName: "Bob"},
+			},
+		})
+		assert.NoError(t, err)
+		results, err = db.SearchUserDirectory(ctx, bob, "", 10, false)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{alice, bob}, userIDs(results))
+
+		// searching all users includes local users who aren't in any rooms
+		_, err = db.CreateAccount(ctx, "eve", "testing", "", api.AccountTypeUser)
+		assert.NoError(t, err)
+		results, err = db.SearchUserDirectory(ctx, bob, "eve", 10, false)
+		assert.NoError(t, err)
+		assert.Empty(t, results)
+		results, err = db.SearchUserDirectory(ctx, bob, "eve", 10, true)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"@eve:localhost"}, userIDs(results))
+	})
+}
+
+func Test_UserDirectoryBackfill(t *testing.T) {
+	alice := "@alice:localhost"
+	bob := "@bob:remote"
+	roomID := "!room:localhost"
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateDatabase(t, dbType)
+		defer close()
+
+		_, err := db.CreateAccount(ctx, "alice", "testing", "", api.AccountTypeUser)
+		assert.NoError(t, err)
+		_, err = db.CreateAccount(ctx, "deactivated", "testing", "", api.AccountTypeUser)
+		assert.NoError(t, err)
+		assert.NoError(t, db.DeactivateAccount(ctx, "deactivated"))
+		localparts, err := db.GetLocalparts(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"alice"}, localparts)
+
+		backfilled, err := db.UserDirectoryBackfilled(ctx)
+		assert.NoError(t, err)
+		assert.False(t, backfilled)
+
+		err = db.BackfillUserDirectory(ctx, []*types.UserDirectoryRoomUpdate{{
+			RoomID:        roomID,
+			RewritesState: true,
+			Joined: []authtypes.FullyQualifiedProfile{
+				{UserID: alice, DisplayName: "Alice"},
+				{UserID: bob, DisplayName: "Bob"},
+			},
+		}})
+		assert.NoError(t, err)
+		backfilled, err = db.UserDirectoryBackfilled(ctx)
+		assert.NoError(t, err)
+		assert.True(t, backfilled)
+		results, err := db.SearchUserDirectory(ctx, alice, "bob", 10, false)
+		assert.NoError(t, err)
+		assert.Equal(t, []authtypes.FullyQualifiedProfile{{UserID: bob, DisplayName: "Bob"}}, results)
+
+		// the backfill only ever happens once
+		err = db.BackfillUserDirectory(ctx, []*types.UserDirectoryRoomUpdate{{
+			RoomID:        roomID,
+			RewritesState: true,
+			Joined:        []authtypes.FullyQualifiedProfile{{UserID: alice, DisplayName: "Alice"}},
+		}})
+		assert.NoError(t, err)
+		results, err = db.SearchUserDirectory(ctx, alice, "bob", 10, false)
+		assert.NoError(t, err)
+		assert.Len(t, results, 1)
+	})
+}
@@ -23,6 +23,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/dendrite/userapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 type AccountDataTable interface {
@@ -35,8 +36,11 @@ type AccountsTable interface {
 	InsertAccount(ctx context.Context, txn *sql.Tx, localpart, hash, appserviceID string, accountType api.AccountType) (*api.Account, error)
 	UpdatePassword(ctx context.Context, localpart, passwordHash string) (err error)
 	DeactivateAccount(ctx context.Context, localpart string) (err error)
+	UpdateShadowBanned(ctx context.Context, txn *sql.Tx, localpart string, shadowBanned bool) (err error)
 	SelectPasswordHash(ctx context.Context, localpart string) (hash string, err error)
 	SelectAccountByLocalpart(ctx context.Context, localpart string) (*api.Account, error)
+	// SelectLocalparts returns the localparts of all accounts which aren't deactivated.
+	SelectLocalparts(ctx context.Context) ([]string, error)
 	SelectNewNumericLocalpart(ctx context.Context, txn *sql.Tx) (id int64, err error)
 }
 
@@ -76,6 +80,27 @@ type LoginTokenTable interface {
 	SelectLoginToken(ctx context.Context, token string) (*api.LoginTokenData, error)
 }
 
+type RegistrationTokensTable interface {
+	InsertRegistrationToken(ctx context.Context, txn *sql.Tx, token *api.RegistrationToken) (bool, error)
+	SelectRegistrationTokens(ctx context.Context, txn *sql.Tx) ([]api.RegistrationToken, error)
+	SelectRegistrationToken(ctx context.Context, txn *sql.Tx, token string) (*api.RegistrationToken, error)
+	UpdateRegistrationToken(ctx context.Context, txn *sql.Tx, token string, usesAllowed *int32, expiryTime *gomatrixserverlib.Timestamp) error
+	DeleteRegistrationToken(ctx context.Context, txn *sql.Tx, token string) (bool, error)
+	UpdateRegistrationTokenPending(ctx context.Context, txn *sql.Tx, token string, now gomatrixserverlib.Timestamp) (bool, error)
+	UpdateRegistrationTokenCompleted(ctx context.Context, txn *sql.Tx, token string) error
+	UpdateRegistrationTokenReleased(ctx context.Context, txn *sql.Tx, token string) error
+}
+
+type ThreePIDSessionsTable interface {
+	InsertThreePIDSession(ctx context.Context, txn *sql.Tx, session *api.ThreePIDSession) error
+	SelectThreePIDSession(ctx context.Context, txn *sql.Tx, sessionID string) (*api.ThreePIDSession, error)
+	SelectThreePIDSessionByAddress(ctx context.Context, txn *sql.Tx, clientSecret, medium, address string) (*api.ThreePIDSession, error)
+	UpdateThreePIDSessionSendAttempt(ctx context.Context, txn *sql.Tx, sessionID string, sendAttempt int, nextLink string, expiresAt gomatrixserverlib.Timestamp) error
+	UpdateThreePIDSessionValidated(ctx context.Context, txn *sql.Tx, sessionID string, validatedAt gomatrixserverlib.Timestamp) error
+	DeleteThreePIDSession(ctx context.Context, txn *sql.Tx, sessionID string) error
+	DeleteExpiredThreePIDSessions(ctx context.Context, txn *sql.Tx, now gomatrixserverlib.Timestamp) error
+}
+
 type OpenIDTable interface {
 	InsertOpenIDToken(ctx context.Context, txn *sql.Tx, token, localpart string, expiresAtMS int64) (err error)
 	SelectOpenIDTokenAtrributes(ctx context.Context, token string) (*api.OpenIDTokenAttributes, error)
@@ -89,6 +114,28 @@ type ProfileTable interface {
 	SelectProfilesBySearch(ctx context.Context, searchString string, limit int) ([]authtypes.Profile, error)
 }
 
+type UserDirectoryTable interface {
+	UpsertUser(ctx context.Context, txn *sql.Tx, userID, displayName, avatarURL string) error
+	InsertMembership(ctx context.Context, txn *sql.Tx, roomID, userID string) error
+	DeleteMembership(ctx context.Context, txn *sql.Tx, roomID, userID string) error
+	DeleteRoomMemberships(ctx context.Context, txn *sql.Tx, roomID string) error
+	// DeleteRoom forgets the room and its members.
+	DeleteRoom(ctx context.Context, txn *sql.Tx, roomID string) error
+	// DeleteUserIfNotJoined removes the user from the directory if they are
+	// no longer joined to any rooms.
+	DeleteUserIfNotJoined(ctx context.Context, txn *sql.Tx, userID string) error
+	UpsertRoomJoinRule(ctx context.Context, txn *sql.Tx, roomID, joinRule string) error
+	UpsertRoomHistoryVisibility(ctx context.Context, txn *sql.Tx, roomID, historyVisibility string) error
+	// SelectRoomMembers returns the users joined to the room.
+	SelectRoomMembers(ctx context.Context, txn *sql.Tx, roomID string) ([]string, error)
+	// SelectJoinedCountForServer returns how many users of the server are joined to the room.
+	SelectJoinedCountForServer(ctx context.Context, txn *sql.Tx, roomID string, serverName gomatrixserverlib.ServerName) (int, error)
+	// SelectUsersBySearch returns the users matching the search string which
+	// are visible to the searching user, ordered by the number of rooms they
+	// share. If searchAll is true, all users matching the search are returned.
+	SelectUsersBySearch(ctx context.Context, txn *sql.Tx, userID, searchString string, limit int, searchAll bool) ([]authtypes.FullyQualifiedProfile, error)
+}
+
 type ThreePIDTable interface {
 	SelectLocalpartForThreePID(ctx context.Context, txn *sql.Tx, threepid string, medium string) (localpart string, err error)
 	SelectThreePIDsForLocalpart(ctx context.Context, localpart string) (threepids []authtypes.ThreePID, err error)
@@ -99,18 +146,35 @@ type ThreePIDTable interface {
 type PusherTable interface {
 	InsertPusher(ctx context.Context, txn *sql.Tx, session_id int64, pushkey string, pushkeyTS int64, kind api.PusherKind, appid, appdisplayname, devicedisplayname, profiletag, lang, data, localpart string) error
 	SelectPushers(ctx context.Context, txn *sql.Tx, localpart string) ([]api.Pusher, error)
+	SelectPushersByKind(ctx context.Context, txn *sql.Tx, kind api.PusherKind) (map[string][]api.Pusher, error)
 	DeletePusher(ctx context.Context, txn *sql.Tx, appid, pushkey, localpart string) error
 	DeletePushers(ctx context.Context, txn *sql.Tx, appid, pushkey string) error
 }
 
+type PusherFailuresTable interface {
+	UpsertPusherFailure(ctx context.Context, txn *sql.Tx, localpart string, f *api.PusherFailure) error
+	SelectPusherFailure(ctx context.Context, txn *sql.Tx, localpart, appID, pushKey string) (*api.PusherFailure, error)
+	SelectPusherFailures(ctx context.Context, txn *sql.Tx, localpart string) ([]api.PusherFailure, error)
+	DeletePusherFailure(ctx context.Context, txn *sql.Tx, localpart, appID, pushKey string) error
+	DeletePusherFailures(ctx context.Context, txn *sql.Tx, appID, pushKey string) error
+}
+
+type PusherEmailStateTable interface {
+	UpsertLastNotificationID(ctx context.Context, txn *sql.Tx, localpart, appID, pushKey string, id int64) error
+	SelectLastNotificationID(ctx context.Context, txn *sql.Tx, localpart, appID, pushKey string) (int64, error)
+	DeletePusherEmailState(ctx context.Context, txn *sql.Tx, localpart, appID, pushKey string) error
+	DeletePusherEmailStates(ctx context.Context, txn *sql.Tx, appID, pushKey string) error
+}
+
 type NotificationTable interface {
 	Clean(ctx context.Context, txn *sql.Tx) error
-	Insert(ctx context.Context, txn *sql.Tx, localpart, eventID string, pos int64, highlight bool, n *api.Notification) error
+	Insert(ctx context.Context, txn *sql.Tx, localpart, eventID, threadID string, pos int64, highlight bool, n *api.Notification) error
 	DeleteUpTo(ctx context.Context, txn *sql.Tx, localpart, roomID string, pos int64) (affected bool, _ error)
-	UpdateRead(ctx context.Context, txn *sql.Tx, localpart, roomID string, pos int64, v bool) (affected bool, _ error)
+	UpdateRead(ctx context.Context, txn *sql.Tx, localpart, roomID, threadID string, pos int64, v bool) (affected bool, _ error)
 	Select(ctx context.Context, txn *sql.Tx, localpart string, fromID int64, limit int, filter NotificationFilter) ([]*api.Notification, int64, error)
 	SelectCount(ctx context.Context, txn *sql.Tx, localpart string, filter NotificationFilter) (int64, error)
 	SelectRoomCounts(ctx context.Context, txn *sql.Tx, localpart, roomID string) (total int64, highlight int64, _ error)
+	SelectThreadCounts(ctx context.Context, txn *sql.Tx, localpart, roomID string) (map[string]NotificationCounts, error)
 }
 
 type StatsTable interface {
@@ -118,6 +182,13 @@ type StatsTable interface {
 	UpdateUserDailyVisits(ctx context.Context, txn *sql.Tx, startTime, lastUpdate time.Time) error
 }
 
+// NotificationCounts are the numbers of unread notifications, and how many
+// of them are highlights.
+type NotificationCounts struct {
+	Total     int64
+	Highlight int64
+}
+
 type NotificationFilter uint32
 
 const (
@@ -0,0 +1,34 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import "github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+
+// UserDirectoryRoomUpdate is a change to the state of a room which affects
+// the user directory.
+type UserDirectoryRoomUpdate struct {
+	RoomID string
+	// Whether the state of the room was rewritten, in which case all of its
+	// members are forgotten before adding the Joined ones.
+	RewritesState bool
+	// The users who joined the room or updated their profile in it.
+	Joined []authtypes.FullyQualifiedProfile
+	// The users who are no longer joined to the room.
+	Left []string
+	// The new join rule of the room, if it changed.
+	JoinRule *string
+	// The new history visibility of the room, if it changed.
+	HistoryVisibility *string
+}
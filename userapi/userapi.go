@@ -73,29 +73,60 @@ func NewInternalAPI(
 	)
 
 	userAPI := &internal.UserInternalAPI{
-		DB:                   db,
-		SyncProducer:         syncProducer,
-		ServerName:           cfg.Matrix.ServerName,
-		AppServices:          appServices,
-		KeyAPI:               keyAPI,
-		RSAPI:                rsAPI,
-		DisableTLSValidation: cfg.PushGatewayDisableTLSValidation,
+		DB:                      db,
+		SyncProducer:            syncProducer,
+		ServerName:              cfg.Matrix.ServerName,
+		AppServices:             appServices,
+		KeyAPI:                  keyAPI,
+		RSAPI:                   rsAPI,
+		DisableTLSValidation:    cfg.PushGatewayDisableTLSValidation,
+		ThreePIDSessionLifetime: cfg.Matrix.Email.TokenLifetime,
+		SearchAllUsers:          cfg.UserDirectory.SearchAllUsers,
+	}
+	base.OnConfigReload(func(cfg *config.Dendrite) {
+		userAPI.SetAppServices(cfg.Derived.AppServices())
+	})
+
+	pushProducer := producers.NewPushGateway(
+		js, cfg.Matrix.JetStream.Prefixed(jetstream.OutputPushNotification),
+	)
+
+	pushConsumer := consumers.NewPushGatewayConsumer(
+		base.ProcessContext, cfg, js, db, pgClient,
+	)
+	if err := pushConsumer.Start(); err != nil {
+		logrus.WithError(err).Panic("failed to start user API push gateway consumer")
 	}
 
 	readConsumer := consumers.NewOutputReadUpdateConsumer(
-		base.ProcessContext, cfg, js, db, pgClient, userAPI, syncProducer,
+		base.ProcessContext, cfg, js, db, pushProducer, userAPI, syncProducer,
 	)
 	if err := readConsumer.Start(); err != nil {
 		logrus.WithError(err).Panic("failed to start user API read update consumer")
 	}
 
 	eventConsumer := consumers.NewOutputStreamEventConsumer(
-		base.ProcessContext, cfg, js, db, pgClient, userAPI, rsAPI, syncProducer,
+		base.ProcessContext, cfg, js, db, pushProducer, userAPI, rsAPI, syncProducer,
 	)
 	if err := eventConsumer.Start(); err != nil {
 		logrus.WithError(err).Panic("failed to start user API streamed event consumer")
 	}
 
+	roomConsumer := consumers.NewOutputRoomEventConsumer(
+		base.ProcessContext, cfg, js, db, rsAPI,
+	)
+	if err := roomConsumer.Start(); err != nil {
+		logrus.WithError(err).Panic("failed to start user API room server consumer")
+	}
+
+	if cfg.Matrix.Email.Enabled {
+		emailNotifier, err := consumers.NewEmailNotifier(base.ProcessContext, cfg, db, rsAPI)
+		if err != nil {
+			logrus.WithError(err).Panic("failed to start user API email notifier")
+		}
+		emailNotifier.Start()
+	}
+
 	var cleanOldNotifs func()
 	cleanOldNotifs = func() {
 		logrus.Infof("Cleaning old notifications")
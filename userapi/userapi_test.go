@@ -19,14 +19,22 @@ import (
 	"fmt"
 	"net/http"
 	"reflect"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/internal/pushgateway"
+	rsapi "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/jetstream"
 	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/dendrite/test/testrig"
 	"github.com/matrix-org/dendrite/userapi"
 	"github.com/matrix-org/dendrite/userapi/inthttp"
+	"github.com/matrix-org/dendrite/userapi/producers"
 	"github.com/matrix-org/gomatrixserverlib"
 	"golang.org/x/crypto/bcrypt"
 
@@ -64,8 +72,9 @@ func MustMakeInternalAPI(t *testing.T, opts apiTestOpts, dbType test.DBType) (ap
 	}
 
 	return &internal.UserInternalAPI{
-		DB:         accountDB,
-		ServerName: cfg.Matrix.ServerName,
+		DB:                      accountDB,
+		ServerName:              cfg.Matrix.ServerName,
+		ThreePIDSessionLifetime: time.Hour,
 	}, accountDB, close
 }
 
@@ -151,6 +160,77 @@ func TestQueryProfile(t *testing.T) {
 	})
 }
 
+func TestQueryAccessTokenAppServiceDevice(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		userAPI, accountDB, close := MustMakeInternalAPI(t, apiTestOpts{}, dbType)
+		defer close()
+		ctx := context.Background()
+
+		appservice := config.ApplicationService{
+			ID:              "bridge",
+			ASToken:         "as_token",
+			SenderLocalpart: "bridgebot",
+			NamespaceMap: map[string][]config.ApplicationServiceNamespace{
+				"users": {{Exclusive: true, Regex: "@bridged_.*", RegexpObject: regexp.MustCompile("@bridged_.*")}},
+			},
+			MSC3202: true,
+		}
+		userAPI.(*internal.UserInternalAPI).AppServices = []config.ApplicationService{appservice}
+
+		if _, err := accountDB.CreateAccount(ctx, "bridged_alice", "", "bridge", api.AccountTypeAppService); err != nil {
+			t.Fatalf("failed to create account: %s", err)
+		}
+		deviceID := "ALICEDEVICE"
+		if _, err := accountDB.CreateDevice(ctx, "bridged_alice", &deviceID, "alice_token", nil, "", ""); err != nil {
+			t.Fatalf("failed to create device: %s", err)
+		}
+
+		tests := []struct {
+			name         string
+			token        string
+			userID       string
+			deviceID     string
+			msc3202      bool
+			wantDeviceID string
+			wantErr      bool
+		}{
+			{name: "masquerade as device", token: "as_token", userID: "@bridged_alice:example.com", deviceID: deviceID, msc3202: true, wantDeviceID: deviceID},
+			{name: "unknown device", token: "as_token", userID: "@bridged_alice:example.com", deviceID: "UNKNOWN", msc3202: true, wantErr: true},
+			{name: "MSC3202 disabled", token: "as_token", userID: "@bridged_alice:example.com", deviceID: deviceID, wantDeviceID: "AS_Device"},
+			{name: "no user ID", token: "alice_token", deviceID: "UNKNOWN", msc3202: true, wantDeviceID: deviceID},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				appservice.MSC3202 = tt.msc3202
+				userAPI.(*internal.UserInternalAPI).AppServices = []config.ApplicationService{appservice}
+				var res api.QueryAccessTokenResponse
+				if err := userAPI.QueryAccessToken(ctx, &api.QueryAccessTokenRequest{
+					AccessToken:        tt.token,
+					AppServiceUserID:   tt.userID,
+					AppServiceDeviceID: tt.deviceID,
+				}, &res); err != nil {
+					t.Fatalf("failed to query access token: %s", err)
+				}
+				if tt.wantErr {
+					if res.Err == "" {
+						t.Fatalf("expected an error, got device %+v", res.Device)
+					}
+					return
+				}
+				if res.Err != "" || res.Device == nil {
+					t.Fatalf("expected a device, got error %q", res.Err)
+				}
+				if res.Device.ID != tt.wantDeviceID {
+					t.Fatalf("got device ID %q, want %q", res.Device.ID, tt.wantDeviceID)
+				}
+				if res.Device.UserID != "@bridged_alice:example.com" {
+					t.Fatalf("got user ID %q, want @bridged_alice:example.com", res.Device.UserID)
+				}
+			})
+		}
+	})
+}
+
 func TestLoginToken(t *testing.T) {
 	ctx := context.Background()
 
@@ -272,3 +352,348 @@ func TestLoginToken(t *testing.T) {
 		})
 	})
 }
+
+func TestThreePIDSession(t *testing.T) {
+	ctx := context.Background()
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		userAPI, _, close := MustMakeInternalAPI(t, apiTestOpts{}, dbType)
+		defer close()
+
+		creq := &api.PerformThreePIDSessionCreationRequest{
+			ClientSecret: "secret",
+			Medium:       "email",
+			Address:      "alice@example.com",
+			SendAttempt:  1,
+			NextLink:     "https://example.com",
+		}
+		var cresp api.PerformThreePIDSessionCreationResponse
+		if err := userAPI.PerformThreePIDSessionCreation(ctx, creq, &cresp); err != nil {
+			t.Fatalf("PerformThreePIDSessionCreation failed: %v", err)
+		}
+		if !cresp.Send || cresp.SessionID == "" || cresp.Token == "" {
+			t.Fatalf("PerformThreePIDSessionCreation: got %+v, want a new session to send", cresp)
+		}
+
+		// Retrying the same send attempt mustn't send the token again.
+		var retryResp api.PerformThreePIDSessionCreationResponse
+		if err := userAPI.PerformThreePIDSessionCreation(ctx, creq, &retryResp); err != nil {
+			t.Fatalf("PerformThreePIDSessionCreation failed: %v", err)
+		}
+		if retryResp.Send || retryResp.Token != "" || retryResp.SessionID != cresp.SessionID {
+			t.Fatalf("PerformThreePIDSessionCreation retry: got %+v, want existing session without token", retryResp)
+		}
+
+		for _, vreq := range []api.PerformThreePIDSessionValidationRequest{
+			{SessionID: cresp.SessionID, ClientSecret: "secret", Token: "wrong"},
+			{SessionID: cresp.SessionID, ClientSecret: "wrong", Token: cresp.Token},
+			{SessionID: "unknown", ClientSecret: "secret", Token: cresp.Token},
+		} {
+			var vresp api.PerformThreePIDSessionValidationResponse
+			if err := userAPI.PerformThreePIDSessionValidation(ctx, &vreq, &vresp); err != nil {
+				t.Fatalf("PerformThreePIDSessionValidation failed: %v", err)
+			}
+			if vresp.Validated {
+				t.Fatalf("PerformThreePIDSessionValidation %+v: got validated, want not validated", vreq)
+			}
+		}
+
+		qreq := &api.QueryThreePIDSessionRequest{SessionID: cresp.SessionID, ClientSecret: "secret"}
+		var qresp api.QueryThreePIDSessionResponse
+		if err := userAPI.QueryThreePIDSession(ctx, qreq, &qresp); err != nil {
+			t.Fatalf("QueryThreePIDSession failed: %v", err)
+		}
+		if qresp.Session == nil || qresp.Session.Validated() || qresp.Session.Token != "" {
+			t.Fatalf("QueryThreePIDSession: got %+v, want unvalidated session without token", qresp.Session)
+		}
+
+		vreq := &api.PerformThreePIDSessionValidationRequest{SessionID: cresp.SessionID, ClientSecret: "secret", Token: cresp.Token}
+		var vresp api.PerformThreePIDSessionValidationResponse
+		if err := userAPI.PerformThreePIDSessionValidation(ctx, vreq, &vresp); err != nil {
+			t.Fatalf("PerformThreePIDSessionValidation failed: %v", err)
+		}
+		if !vresp.Validated || vresp.NextLink != "https://example.com" {
+			t.Fatalf("PerformThreePIDSessionValidation: got %+v, want validated", vresp)
+		}
+
+		qresp = api.QueryThreePIDSessionResponse{}
+		if err := userAPI.QueryThreePIDSession(ctx, qreq, &qresp); err != nil {
+			t.Fatalf("QueryThreePIDSession failed: %v", err)
+		}
+		if qresp.Session == nil || !qresp.Session.Validated() || qresp.Session.Address != "alice@example.com" {
+			t.Fatalf("QueryThreePIDSession: got %+v, want validated session", qresp.Session)
+		}
+
+		if err := userAPI.PerformThreePIDSessionDeletion(ctx, &api.PerformThreePIDSessionDeletionRequest{SessionID: cresp.SessionID}, &struct{}{}); err != nil {
+			t.Fatalf("PerformThreePIDSessionDeletion failed: %v", err)
+		}
+		qresp = api.QueryThreePIDSessionResponse{}
+		if err := userAPI.QueryThreePIDSession(ctx, qreq, &qresp); err != nil {
+			t.Fatalf("QueryThreePIDSession failed: %v", err)
+		}
+		if qresp.Session != nil {
+			t.Fatalf("QueryThreePIDSession: got %+v, want deleted session", qresp.Session)
+		}
+	})
+}
+
+type fakePushGateway struct {
+	sync.Mutex
+	failures      int  // how many more requests should fail
+	reject        bool // whether to reject the pushkey
+	notifications chan pushgateway.Notification
+}
+
+func (g *fakePushGateway) Notify(ctx context.Context, url string, req *pushgateway.NotifyRequest, res *pushgateway.NotifyResponse) error {
+	g.notifications <- req.Notification
+	g.Lock()
+	defer g.Unlock()
+	if g.failures > 0 {
+		g.failures--
+		return fmt.Errorf("push gateway: 502 from %s", url)
+	}
+	if g.reject {
+		res.Rejected = []string{req.Notification.Devices[0].PushKey}
+	}
+	return nil
+}
+
+func TestPushGatewayQueue(t *testing.T) {
+	ctx := context.Background()
+	// only one DBType, since the consumers register prometheus metrics
+	base, close := testrig.CreateBaseDendrite(t, test.DBTypeSQLite)
+	defer close()
+	gateway := &fakePushGateway{
+		failures:      1,
+		notifications: make(chan pushgateway.Notification, 10),
+	}
+	userAPI := userapi.NewInternalAPI(base, &base.Cfg.UserAPI, nil, nil, nil, gateway)
+	js, _ := base.NATS.Prepare(base.ProcessContext, &base.Cfg.Global.JetStream)
+	producer := producers.NewPushGateway(js, base.Cfg.Global.JetStream.Prefixed(jetstream.OutputPushNotification))
+
+	pusher := api.Pusher{
+		PushKey: "pushkey",
+		Kind:    api.HTTPKind,
+		AppID:   "com.example.app",
+		Data:    map[string]interface{}{"url": "https://push.example.com/notify"},
+	}
+	if err := userAPI.PerformPusherSet(ctx, &api.PerformPusherSetRequest{Pusher: pusher, Localpart: "alice"}, &struct{}{}); err != nil {
+		t.Fatalf("PerformPusherSet failed: %v", err)
+	}
+	notifyCounts := func(unread int) {
+		req := &pushgateway.NotifyRequest{
+			Notification: pushgateway.Notification{
+				Counts:  &pushgateway.Counts{Unread: unread},
+				Devices: []*pushgateway.Device{{AppID: pusher.AppID, PushKey: pusher.PushKey}},
+			},
+		}
+		if err := producer.SendNotification(context.Background(), "alice", "https://push.example.com/notify", req); err != nil {
+			t.Fatalf("SendNotification failed: %v", err)
+		}
+	}
+	mustReceive := func(wantUnread int) {
+		select {
+		case n := <-gateway.notifications:
+			if n.Counts.Unread != wantUnread {
+				t.Fatalf("got unread count %d, want %d", n.Counts.Unread, wantUnread)
+			}
+		case <-time.After(time.Second * 10):
+			t.Fatalf("timed out waiting for unread count %d", wantUnread)
+		}
+	}
+	pusherStatus := func() []api.PusherStatus {
+		var res api.QueryPusherStatusResponse
+		if err := userAPI.QueryPusherStatus(ctx, &api.QueryPusherStatusRequest{Localpart: "alice"}, &res); err != nil {
+			t.Fatalf("QueryPusherStatus failed: %v", err)
+		}
+		return res.Pushers
+	}
+
+	// The first delivery fails, so the pusher backs off.
+	notifyCounts(1)
+	mustReceive(1)
+	for {
+		status := pusherStatus()
+		if len(status) == 1 && status[0].Failure != nil {
+			if status[0].Failure.FailureCount != 1 || status[0].Failure.LastError == "" {
+				t.Fatalf("got failure %+v, want a single failure", status[0].Failure)
+			}
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// Badge count updates queued while the pusher is backing off replace
+	// each other, so only the latest one is delivered.
+	gateway.Lock()
+	gateway.reject = true
+	gateway.Unlock()
+	notifyCounts(2)
+	notifyCounts(3)
+	mustReceive(3)
+
+	// The push gateway rejected the pushkey, so the pusher is deleted.
+	for len(pusherStatus()) != 0 {
+		time.Sleep(time.Millisecond * 10)
+	}
+	select {
+	case n := <-gateway.notifications:
+		t.Fatalf("got unexpected notification %+v", n)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+type fakeRoomserverAPI struct {
+	rsapi.UserRoomserverAPI
+}
+
+func (r *fakeRoomserverAPI) QueryCurrentState(ctx context.Context, req *rsapi.QueryCurrentStateRequest, res *rsapi.QueryCurrentStateResponse) error {
+	return nil
+}
+
+func TestEmailNotifications(t *testing.T) {
+	ctx := context.Background()
+	base, close := testrig.CreateBaseDendrite(t, test.DBTypeSQLite)
+	defer close()
+	smtpServer := test.NewSMTPServer(t)
+	base.Cfg.Global.Email.Enabled = true
+	base.Cfg.Global.Email.From = "Dendrite <noreply@example.com>"
+	base.Cfg.Global.Email.SMTPHost = smtpServer.Addr
+	base.Cfg.Global.Email.PublicBaseURL = "https://matrix.example.com"
+	base.Cfg.UserAPI.EmailNotificationDelay = time.Millisecond * 100
+	userAPI := userapi.NewInternalAPI(base, &base.Cfg.UserAPI, nil, nil, &fakeRoomserverAPI{}, nil)
+	db := userAPI.(*internal.UserInternalAPI).DB
+
+	pusher := api.Pusher{
+		PushKey: "alice@example.com",
+		Kind:    api.EmailKind,
+		AppID:   "m.email",
+	}
+	if err := userAPI.PerformPusherSet(ctx, &api.PerformPusherSetRequest{Pusher: pusher, Localpart: "alice"}, &struct{}{}); err != nil {
+		t.Fatalf("PerformPusherSet failed: %v", err)
+	}
+	ts := gomatrixserverlib.AsTimestamp(time.Now().Add(-time.Hour))
+	insertNotification := func(eventID, roomID, body string, pos int64) {
+		if err := db.InsertNotification(ctx, "alice", eventID, "", pos, nil, &api.Notification{
+			Event: gomatrixserverlib.ClientEvent{
+				Content:        gomatrixserverlib.RawJSON(fmt.Sprintf(`{"msgtype":"m.text","body":%q}`, body)),
+				EventID:        eventID,
+				OriginServerTS: ts,
+				RoomID:         roomID,
+				Sender:         "@bob:example.com",
+				Type:           "m.room.message",
+			},
+			RoomID: roomID,
+			TS:     ts,
+		}); err != nil {
+			t.Fatalf("InsertNotification failed: %v", err)
+		}
+	}
+	markRead := func(roomID string, pos int64) {
+		if _, err := db.SetNotificationsRead(ctx, "alice", roomID, "", pos, true); err != nil {
+			t.Fatalf("SetNotificationsRead failed: %v", err)
+		}
+	}
+
+	// Notifications which have been read aren't emailed.
+	insertNotification("$read", "!room3:example.com", "read message", 10)
+	markRead("!room3:example.com", 10)
+	for i, roomID := range []string{"!room1:example.com", "!room2:example.com", "!room1:example.com"} {
+		insertNotification(fmt.Sprintf("$event%d", i), roomID, fmt.Sprintf("message %d", i), int64(i+1))
+	}
+
+	// All unread notifications are sent in a single email.
+	deadline := time.Now().Add(time.Second * 10)
+	for len(smtpServer.Messages()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for notification email")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	msg := smtpServer.Messages()[0]
+	if len(msg.To) != 1 || msg.To[0] != pusher.PushKey {
+		t.Fatalf("got recipients %v, want %s", msg.To, pusher.PushKey)
+	}
+	for _, want := range []string{"!room1:example.com", "!room2:example.com", "message 0", "message 1", "message 2", "List-Unsubscribe: <https://matrix.example.com/_matrix/client/unstable/pushers/email/unsubscribe?"} {
+		if !strings.Contains(msg.Data, want) {
+			t.Errorf("email doesn't contain %q:\n%s", want, msg.Data)
+		}
+	}
+	for _, unwanted := range []string{"!room3:example.com", "read message"} {
+		if strings.Contains(msg.Data, unwanted) {
+			t.Errorf("email contains %q:\n%s", unwanted, msg.Data)
+		}
+	}
+
+	// Notifications are only emailed once, and new notifications which were
+	// read before they were due aren't emailed either.
+	insertNotification("$read2", "!room3:example.com", "read message", 11)
+	markRead("!room3:example.com", 11)
+	time.Sleep(time.Millisecond * 500)
+	if got := len(smtpServer.Messages()); got != 1 {
+		t.Fatalf("got %d emails, want 1", got)
+	}
+}
+
+type directoryRoomserverAPI struct {
+	rsapi.UserRoomserverAPI
+	room *test.Room
+}
+
+func (r *directoryRoomserverAPI) QueryRoomsForUser(ctx context.Context, req *rsapi.QueryRoomsForUserRequest, res *rsapi.QueryRoomsForUserResponse) error {
+	res.RoomIDs = []string{r.room.ID}
+	return nil
+}
+
+func (r *directoryRoomserverAPI) QueryCurrentState(ctx context.Context, req *rsapi.QueryCurrentStateRequest, res *rsapi.QueryCurrentStateResponse) error {
+	res.StateEvents = map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent{}
+	for _, event := range r.room.CurrentState() {
+		switch event.Type() {
+		case gomatrixserverlib.MRoomMember, gomatrixserverlib.MRoomJoinRules, gomatrixserverlib.MRoomHistoryVisibility:
+			res.StateEvents[gomatrixserverlib.StateKeyTuple{EventType: event.Type(), StateKey: *event.StateKey()}] = event
+		}
+	}
+	return nil
+}
+
+func TestUserDirectoryBackfill(t *testing.T) {
+	ctx := context.Background()
+	base, close := testrig.CreateBaseDendrite(t, test.DBTypeSQLite)
+	defer close()
+
+	alice := test.NewUser(t)
+	bob := test.NewUser(t, test.WithSigningServer("remote", "ed25519:1", test.PrivateKeyB))
+	room := test.NewRoom(t, alice)
+	room.CreateAndInsert(t, bob, gomatrixserverlib.MRoomMember, map[string]interface{}{
+		"membership":  "join",
+		"displayname": "Bob",
+	}, test.WithStateKey(bob.ID))
+
+	// The user directory is filled from the rooms which local users were
+	// already joined to before the consumer started.
+	db, err := storage.NewUserAPIDatabase(base, &base.Cfg.UserAPI.AccountDatabase, base.Cfg.Global.ServerName, bcrypt.MinCost, 0, 0, "")
+	if err != nil {
+		t.Fatalf("failed to create database: %v", err)
+	}
+	localpart, _, _ := gomatrixserverlib.SplitID('@', alice.ID)
+	if _, err = db.CreateAccount(ctx, localpart, "", "", api.AccountTypeUser); err != nil {
+		t.Fatalf("CreateAccount failed: %v", err)
+	}
+	userAPI := userapi.NewInternalAPI(base, &base.Cfg.UserAPI, nil, nil, &directoryRoomserverAPI{room: room}, nil)
+
+	res := &api.QuerySearchUserDirectoryResponse{}
+	if err = userAPI.QuerySearchUserDirectory(ctx, &api.QuerySearchUserDirectoryRequest{
+		UserID:       alice.ID,
+		SearchString: "bob",
+		Limit:        10,
+	}, res); err != nil {
+		t.Fatalf("QuerySearchUserDirectory failed: %v", err)
+	}
+	if len(res.Results) != 1 || res.Results[0].UserID != bob.ID || res.Results[0].DisplayName != "Bob" {
+		t.Fatalf("got results %+v, want %s", res.Results, bob.ID)
+	}
+	backfilled, err := db.UserDirectoryBackfilled(ctx)
+	if err != nil || !backfilled {
+		t.Fatalf("expected the backfill to be recorded, got %v (%v)", backfilled, err)
+	}
+}